@@ -30,6 +30,7 @@ import (
 	"github.com/matrix-org/dendrite/appservice/query"
 	"github.com/matrix-org/dendrite/appservice/storage"
 	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/appservice/webhooks"
 	"github.com/matrix-org/dendrite/appservice/workers"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/base"
@@ -106,6 +107,10 @@ func NewInternalAPI(
 		}
 	}
 
+	if err := webhooks.Start(base.ProcessContext, base.Cfg, js); err != nil {
+		logrus.WithError(err).Panicf("failed to start webhooks")
+	}
+
 	// Create application service transaction workers
 	if err := workers.SetupTransactionWorkers(client, appserviceDB, workerStates); err != nil {
 		logrus.WithError(err).Panicf("failed to start app service transaction workers")
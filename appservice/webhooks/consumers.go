@@ -0,0 +1,167 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// consumer sends the messages from one stream to one webhook.
+type consumer struct {
+	ctx       context.Context
+	jetstream nats.JetStreamContext
+	durable   string
+	topic     string
+	stream    string
+	webhook   *Webhook
+	parse     func(msg *nats.Msg) (*Payload, bool, error)
+}
+
+// Start creates durable consumers for each of the configured webhooks.
+func Start(
+	process *process.ProcessContext,
+	cfg *config.Dendrite,
+	js nats.JetStreamContext,
+) error {
+	for i := range cfg.AppServiceAPI.Webhooks {
+		whCfg := &cfg.AppServiceAPI.Webhooks[i]
+		webhook := NewWebhook(whCfg)
+		streams := []struct {
+			stream string
+			topic  string
+			parse  func(msg *nats.Msg) (*Payload, bool, error)
+		}{
+			{config.WebhookStreamRoomEvents, jetstream.OutputRoomEvent, webhook.parseRoomEvent},
+			{config.WebhookStreamReceipts, jetstream.OutputReceiptEvent, webhook.parseReceipt},
+			{config.WebhookStreamAccountData, jetstream.OutputClientData, webhook.parseAccountData},
+		}
+		for _, s := range streams {
+			if !whCfg.WantsStream(s.stream) {
+				continue
+			}
+			c := &consumer{
+				ctx:       process.Context(),
+				jetstream: js,
+				durable:   cfg.Global.JetStream.Durable("AppserviceWebhook" + jetstream.Tokenise(whCfg.ID) + s.topic),
+				topic:     cfg.Global.JetStream.Prefixed(s.topic),
+				stream:    s.stream,
+				webhook:   webhook,
+				parse:     s.parse,
+			}
+			if err := jetstream.JetStreamConsumer(
+				c.ctx, c.jetstream, c.topic, c.durable, c.onMessage,
+				nats.DeliverAll(), nats.ManualAck(),
+			); err != nil {
+				return fmt.Errorf("failed to start webhook %q consumer for %s: %w", whCfg.ID, s.stream, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *consumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	payload, ok, err := c.parse(msg)
+	if err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).WithField("webhook", c.webhook.cfg.ID).Errorf("%s: message parse failure", c.stream)
+		return true
+	}
+	if !ok {
+		return true
+	}
+	payload.Stream = c.stream
+
+	deliveryID := msg.Header.Get(jetstream.EventID)
+	if meta, err := msg.Metadata(); err == nil {
+		deliveryID = fmt.Sprintf("%s-%d", meta.Stream, meta.Sequence.Stream)
+	}
+
+	// Keep telling NATS that we're still working on the message while we
+	// retry, so that it isn't redelivered while the endpoint is unavailable.
+	progress := func() {
+		_ = msg.InProgress(nats.Context(ctx))
+	}
+	if err = c.webhook.Send(ctx, deliveryID, payload, progress); err != nil {
+		// The context is done, so we're shutting down. The message will be
+		// redelivered next time.
+		return false
+	}
+	return true
+}
+
+func (w *Webhook) parseRoomEvent(msg *nats.Msg) (*Payload, bool, error) {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Data, &output); err != nil {
+		return nil, false, err
+	}
+	if output.Type != api.OutputTypeNewRoomEvent || output.NewRoomEvent == nil {
+		return nil, false, nil
+	}
+	ev := output.NewRoomEvent.Event
+	if !w.Matches(ev.RoomID(), ev.Sender(), ev.Type()) {
+		return nil, false, nil
+	}
+	clientEvent := gomatrixserverlib.HeaderedToClientEvent(ev, gomatrixserverlib.FormatAll)
+	return &Payload{Event: &clientEvent}, true, nil
+}
+
+func (w *Webhook) parseReceipt(msg *nats.Msg) (*Payload, bool, error) {
+	receipt := &Receipt{
+		RoomID:   msg.Header.Get(jetstream.RoomID),
+		UserID:   msg.Header.Get(jetstream.UserID),
+		EventID:  msg.Header.Get(jetstream.EventID),
+		Type:     msg.Header.Get("type"),
+		ThreadID: msg.Header.Get("thread_id"),
+	}
+	timestamp, err := strconv.ParseUint(msg.Header.Get("timestamp"), 10, 64)
+	if err != nil {
+		return nil, false, err
+	}
+	receipt.Timestamp = gomatrixserverlib.Timestamp(timestamp)
+	if !w.Matches(receipt.RoomID, receipt.UserID, receipt.Type) {
+		return nil, false, nil
+	}
+	return &Payload{Receipt: receipt}, true, nil
+}
+
+func (w *Webhook) parseAccountData(msg *nats.Msg) (*Payload, bool, error) {
+	var output eventutil.AccountData
+	if err := json.Unmarshal(msg.Data, &output); err != nil {
+		return nil, false, err
+	}
+	accountData := &AccountData{
+		UserID:  msg.Header.Get(jetstream.UserID),
+		RoomID:  output.RoomID,
+		Type:    output.Type,
+		Deleted: output.Deleted,
+	}
+	if !w.Matches(accountData.RoomID, accountData.UserID, accountData.Type) {
+		return nil, false, nil
+	}
+	return &Payload{AccountData: accountData}, true, nil
+}
@@ -0,0 +1,239 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webhooks sends a feed of room events, receipts and account data
+// updates to HTTP endpoints. Each webhook has its own durable JetStream
+// consumers, and a message is only acknowledged once the endpoint has accepted
+// it, so delivery is at-least-once. Endpoints can use the X-Dendrite-Delivery
+// header to discard duplicates.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTimeout = time.Second * 30
+	minBackoff     = time.Second
+	maxBackoff     = time.Minute * 5
+)
+
+// progressInterval is how often the progress function passed to Send is
+// called while waiting for the endpoint or to retry. It must be well within
+// the JetStream acknowledgement wait, so that the message isn't redelivered
+// meanwhile, however long the request timeout is.
+var progressInterval = time.Second * 10
+
+// Payload is the body of each request sent to a webhook. Exactly one of
+// Event, Receipt and AccountData is set, depending on the stream.
+type Payload struct {
+	WebhookID   string                         `json:"webhook_id"`
+	Stream      string                         `json:"stream"`
+	Event       *gomatrixserverlib.ClientEvent `json:"event,omitempty"`
+	Receipt     *Receipt                       `json:"receipt,omitempty"`
+	AccountData *AccountData                   `json:"account_data,omitempty"`
+}
+
+// Receipt is a read receipt sent by a local user, or by a user on another
+// server in a room that we are in. The senders filter of the webhook can be
+// used to only get receipts from some users.
+type Receipt struct {
+	RoomID    string                      `json:"room_id"`
+	UserID    string                      `json:"user_id"`
+	EventID   string                      `json:"event_id"`
+	Type      string                      `json:"receipt_type"`
+	ThreadID  string                      `json:"thread_id,omitempty"`
+	Timestamp gomatrixserverlib.Timestamp `json:"ts"`
+}
+
+// AccountData notes that a local user updated their account data. The room ID
+// is empty for global account data.
+type AccountData struct {
+	UserID  string `json:"user_id"`
+	RoomID  string `json:"room_id,omitempty"`
+	Type    string `json:"type"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// Webhook delivers payloads to a single configured endpoint.
+type Webhook struct {
+	cfg    *config.Webhook
+	client *http.Client
+}
+
+func NewWebhook(cfg *config.Webhook) *Webhook {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	return &Webhook{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+// Matches returns true if something in the given room, from the given user
+// and with the given type passes the webhook's filters.
+func (w *Webhook) Matches(roomID, userID, typ string) bool {
+	if len(w.cfg.Rooms) > 0 && !contains(w.cfg.Rooms, roomID) {
+		return false
+	}
+	if len(w.cfg.Senders) > 0 && !contains(w.cfg.Senders, userID) {
+		return false
+	}
+	if len(w.cfg.Types) > 0 {
+		for _, t := range w.cfg.Types {
+			if t == typ || (strings.HasSuffix(t, "*") && strings.HasPrefix(typ, strings.TrimSuffix(t, "*"))) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Send delivers the payload, retrying with exponential backoff until the
+// endpoint accepts it or the context is done. The delivery ID is sent in
+// the X-Dendrite-Delivery header and is the same for every attempt, so that
+// the endpoint can discard duplicates. The progress function is called before
+// each attempt, and every progressInterval while waiting for the endpoint to
+// respond or to retry.
+func (w *Webhook) Send(ctx context.Context, deliveryID string, payload *Payload, progress func()) error {
+	payload.WebhookID = w.cfg.ID
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	backoff := minBackoff
+	for attempt := 1; ; attempt++ {
+		if progress != nil {
+			progress()
+		}
+		if err = w.sendWithProgress(ctx, deliveryID, body, progress); err == nil {
+			return nil
+		}
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"webhook":  w.cfg.ID,
+			"delivery": deliveryID,
+			"attempt":  attempt,
+		}).Warnf("Failed to send to webhook, retrying in %s", backoff)
+		if !wait(ctx, backoff, progress) {
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// wait for the given duration, calling the progress function every
+// progressInterval meanwhile. Returns false if the context is done first.
+func wait(ctx context.Context, d time.Duration, progress func()) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		case <-ticker.C:
+			if progress != nil {
+				progress()
+			}
+		}
+	}
+}
+
+// sendWithProgress makes a single attempt to send the body, calling the
+// progress function every progressInterval until the endpoint responds.
+func (w *Webhook) sendWithProgress(ctx context.Context, deliveryID string, body []byte, progress func()) error {
+	if progress == nil {
+		return w.send(ctx, deliveryID, body)
+	}
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				progress()
+			}
+		}
+	}()
+	err := w.send(ctx, deliveryID, body)
+	// Don't return until the progress function has stopped being called,
+	// so that it is never called concurrently.
+	close(done)
+	<-stopped
+	return err
+}
+
+func (w *Webhook) send(ctx context.Context, deliveryID string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Dendrite-Delivery", deliveryID)
+	if w.cfg.Secret != "" {
+		req.Header.Set("X-Dendrite-Signature-256", "sha256="+Sign([]byte(w.cfg.Secret), body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("w.client.Do: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("received HTTP status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex-encoded HMAC-SHA256 of the body using the secret.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
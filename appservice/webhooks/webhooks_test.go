@@ -0,0 +1,128 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestMatches(t *testing.T) {
+	w := NewWebhook(&config.Webhook{
+		Rooms: []string{"!room:localhost"},
+		Types: []string{"m.room.*", "m.reaction"},
+	})
+	tests := []struct {
+		roomID, userID, typ string
+		want                bool
+	}{
+		{"!room:localhost", "@alice:localhost", "m.room.message", true},
+		{"!room:localhost", "@alice:localhost", "m.reaction", true},
+		{"!room:localhost", "@alice:localhost", "m.receipt", false},
+		{"!other:localhost", "@alice:localhost", "m.room.message", false},
+	}
+	for _, tt := range tests {
+		if got := w.Matches(tt.roomID, tt.userID, tt.typ); got != tt.want {
+			t.Errorf("Matches(%q, %q, %q) = %v, want %v", tt.roomID, tt.userID, tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	secret := "s3cret"
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, _ := io.ReadAll(r.Body)
+		if got, want := r.Header.Get("X-Dendrite-Signature-256"), "sha256="+Sign([]byte(secret), body); got != want {
+			t.Errorf("got signature %q, want %q", got, want)
+		}
+		if got := r.Header.Get("X-Dendrite-Delivery"); got != "OutputReceiptEvent-1" {
+			t.Errorf("got delivery ID %q", got)
+		}
+		var payload Payload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("failed to unmarshal payload: %s", err)
+		}
+		if payload.WebhookID != "test" || payload.Receipt == nil || payload.Receipt.EventID != "$event" {
+			t.Errorf("unexpected payload: %s", body)
+		}
+		// Fail the first attempt, to check that it is retried.
+		if attempts == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	w := NewWebhook(&config.Webhook{ID: "test", URL: srv.URL, Secret: secret})
+	progressed := 0
+	err := w.Send(context.Background(), "OutputReceiptEvent-1", &Payload{
+		Stream:  config.WebhookStreamReceipts,
+		Receipt: &Receipt{RoomID: "!room:localhost", EventID: "$event"},
+	}, func() { progressed++ })
+	if err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	if attempts != 2 || progressed != 2 {
+		t.Fatalf("expected 2 attempts, got %d (progressed %d)", attempts, progressed)
+	}
+}
+
+func TestSendProgressWhileWaiting(t *testing.T) {
+	defer func(interval time.Duration) { progressInterval = interval }(progressInterval)
+	progressInterval = time.Millisecond * 100
+
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if attempts++; attempts == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	// The first retry waits for minBackoff, during which the message should
+	// be kept from being redelivered.
+	w := NewWebhook(&config.Webhook{ID: "test", URL: srv.URL})
+	progressed := 0
+	err := w.Send(context.Background(), "OutputReceiptEvent-1", &Payload{
+		Stream:  config.WebhookStreamReceipts,
+		Receipt: &Receipt{RoomID: "!room:localhost", EventID: "$event"},
+	}, func() { progressed++ })
+	if err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	if want := attempts + int(minBackoff/progressInterval) - 1; progressed < want {
+		t.Fatalf("expected at least %d calls to progress, got %d", want, progressed)
+	}
+}
+
+func TestSendProgressWhileSending(t *testing.T) {
+	defer func(interval time.Duration) { progressInterval = interval }(progressInterval)
+	progressInterval = time.Millisecond * 100
+
+	// The endpoint takes longer to respond than several progress intervals,
+	// during which the message should be kept from being redelivered.
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(progressInterval * 5)
+	}))
+	defer srv.Close()
+
+	w := NewWebhook(&config.Webhook{ID: "test", URL: srv.URL})
+	var progressed int32
+	err := w.Send(context.Background(), "OutputReceiptEvent-1", &Payload{
+		Stream:  config.WebhookStreamReceipts,
+		Receipt: &Receipt{RoomID: "!room:localhost", EventID: "$event"},
+	}, func() { atomic.AddInt32(&progressed, 1) })
+	if err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	if got := atomic.LoadInt32(&progressed); got < 3 {
+		t.Fatalf("expected at least 3 calls to progress, got %d", got)
+	}
+}
@@ -61,9 +61,11 @@ func AddPublicRoutes(
 		base.PublicWellKnownAPIMux,
 		base.SynapseAdminMux,
 		base.DendriteAdminMux,
+		base.ProcessContext,
 		cfg, rsAPI, asAPI,
 		userAPI, userDirectoryProvider, federation,
 		syncProducer, transactionsCache, fsAPI, keyAPI,
-		extRoomsProvider, mscCfg, natsClient,
+		extRoomsProvider, mscCfg, &base.Cfg.UserAPI.EmailNotifications, natsClient,
+		base.SpamChecker,
 	)
 }
@@ -160,6 +160,13 @@ func UnableToAuthoriseJoin(msg string) *MatrixError {
 	return &MatrixError{"M_UNABLE_TO_AUTHORISE_JOIN", msg}
 }
 
+// UnknownPos is an error returned when a sliding sync request refers to a
+// connection position which the server doesn't know about, e.g. because the
+// connection has expired.
+func UnknownPos(msg string) *MatrixError {
+	return &MatrixError{"M_UNKNOWN_POS", msg}
+}
+
 // LeaveServerNoticeError is an error returned when trying to reject an invite
 // for a server notice room.
 func LeaveServerNoticeError() *MatrixError {
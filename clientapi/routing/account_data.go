@@ -132,6 +132,42 @@ func SaveAccountData(
 	}
 }
 
+// DeleteAccountData implements DELETE /user/{userId}/[rooms/{roomId}/]account_data/{type}
+// from MSC3391.
+func DeleteAccountData(
+	req *http.Request, userAPI api.ClientUserAPI, device *api.Device,
+	userID string, roomID string, dataType string,
+) util.JSONResponse {
+	if userID != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("userID does not match the current user"),
+		}
+	}
+
+	if dataType == "m.fully_read" || dataType == "m.push_rules" {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(fmt.Sprintf("Unable to delete %q using this API", dataType)),
+		}
+	}
+
+	dataReq := api.PerformAccountDataDeletionRequest{
+		UserID:   userID,
+		RoomID:   roomID,
+		DataType: dataType,
+	}
+	if err := userAPI.PerformAccountDataDeletion(req.Context(), &dataReq, &struct{}{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformAccountDataDeletion failed")
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
 type fullyReadEvent struct {
 	EventID string `json:"event_id"`
 }
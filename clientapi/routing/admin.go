@@ -1,12 +1,15 @@
 package routing
 
 import (
+	"encoding/json"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/util"
 )
@@ -84,3 +87,279 @@ func AdminEvacuateUser(req *http.Request, device *userapi.Device, rsAPI roomserv
 		},
 	}
 }
+
+func AdminEventReports(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	if device.AccountType != userapi.AccountTypeAdmin {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This API can only be used by admin users."),
+		}
+	}
+	query := req.URL.Query()
+	request := &roomserverAPI.QueryAdminEventReportsRequest{
+		Filter: types.EventReportFilter{
+			RoomID:          query.Get("room_id"),
+			ReportingUserID: query.Get("user_id"),
+			IncludeResolved: query.Get("include_resolved") == "true",
+		},
+		Limit: 100,
+	}
+	var err error
+	if from := query.Get("from"); from != "" {
+		if request.From, err = strconv.ParseInt(from, 10, 64); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("from must be a report ID"),
+			}
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if request.Limit, err = strconv.Atoi(limit); err != nil || request.Limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("limit must be a positive integer"),
+			}
+		}
+	}
+	res := &roomserverAPI.QueryAdminEventReportsResponse{}
+	if err = rsAPI.QueryAdminEventReports(req.Context(), request, res); err != nil {
+		return util.ErrorResponse(err)
+	}
+	response := map[string]interface{}{
+		"event_reports": res.Reports,
+		"total":         res.Total,
+	}
+	if res.Reports == nil {
+		response["event_reports"] = []types.EventReport{}
+	}
+	if len(res.Reports) == request.Limit {
+		response["next_batch"] = strconv.FormatInt(res.Reports[len(res.Reports)-1].ID, 10)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: response,
+	}
+}
+
+func AdminEventReport(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	if device.AccountType != userapi.AccountTypeAdmin {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This API can only be used by admin users."),
+		}
+	}
+	reportID, resErr := parseReportID(req)
+	if resErr != nil {
+		return *resErr
+	}
+	res := &roomserverAPI.QueryAdminEventReportResponse{}
+	if err := rsAPI.QueryAdminEventReport(req.Context(), &roomserverAPI.QueryAdminEventReportRequest{
+		ReportID: reportID,
+	}, res); err != nil {
+		return util.ErrorResponse(err)
+	}
+	if res.Report == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Event report not found."),
+		}
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res.Report,
+	}
+}
+
+func AdminResolveEventReport(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	if device.AccountType != userapi.AccountTypeAdmin {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This API can only be used by admin users."),
+		}
+	}
+	reportID, resErr := parseReportID(req)
+	if resErr != nil {
+		return *resErr
+	}
+	queryRes := &roomserverAPI.QueryAdminEventReportResponse{}
+	if err := rsAPI.QueryAdminEventReport(req.Context(), &roomserverAPI.QueryAdminEventReportRequest{
+		ReportID: reportID,
+	}, queryRes); err != nil {
+		return util.ErrorResponse(err)
+	}
+	if queryRes.Report == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Event report not found."),
+		}
+	}
+	res := &roomserverAPI.PerformAdminResolveEventReportResponse{}
+	rsAPI.PerformAdminResolveEventReport(
+		req.Context(),
+		&roomserverAPI.PerformAdminResolveEventReportRequest{
+			ReportID: reportID,
+			UserID:   device.UserID,
+		},
+		res,
+	)
+	if err := res.Error; err != nil {
+		return err.JSONResponse()
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+// AdminInputQueues returns the rooms which have the most events waiting to
+// be processed by the roomserver, and how many rooms are processing events
+// or waiting for their turn to.
+func AdminInputQueues(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	if device.AccountType != userapi.AccountTypeAdmin {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This API can only be used by admin users."),
+		}
+	}
+	request := &roomserverAPI.QueryAdminInputQueuesRequest{
+		Limit: 100,
+	}
+	if limit := req.URL.Query().Get("limit"); limit != "" {
+		var err error
+		if request.Limit, err = strconv.Atoi(limit); err != nil || request.Limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("limit must be a positive integer"),
+			}
+		}
+	}
+	res := &roomserverAPI.QueryAdminInputQueuesResponse{}
+	if err := rsAPI.QueryAdminInputQueues(req.Context(), request, res); err != nil {
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
+
+// AdminCompactState merges duplicate state blocks in the roomserver and
+// deletes state which is no longer referenced, returning what was removed.
+func AdminCompactState(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	if device.AccountType != userapi.AccountTypeAdmin {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This API can only be used by admin users."),
+		}
+	}
+	res := &roomserverAPI.PerformAdminCompactStateResponse{}
+	rsAPI.PerformAdminCompactState(req.Context(), &roomserverAPI.PerformAdminCompactStateRequest{}, res)
+	if err := res.Error; err != nil {
+		if err.Code == roomserverAPI.PerformErrorNoOperation {
+			return util.JSONResponse{
+				Code: http.StatusConflict,
+				JSON: jsonerror.Unknown(err.Msg),
+			}
+		}
+		return err.JSONResponse()
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res.Report,
+	}
+}
+
+// AdminCheckRoom checks the events and state that the roomserver has stored
+// for a room. A POST with a "repair" body also repairs the forward extremities
+// and current state of the room, if they are wrong. The sync API's current
+// state is checked separately by /_dendrite/admin/fsckSyncAPI/{roomID}.
+func AdminCheckRoom(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	if device.AccountType != userapi.AccountTypeAdmin {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This API can only be used by admin users."),
+		}
+	}
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	var body struct {
+		Repair bool `json:"repair"`
+	}
+	if req.Method == http.MethodPost && req.ContentLength != 0 {
+		if err = json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+	}
+	res := &roomserverAPI.PerformAdminCheckRoomResponse{}
+	rsAPI.PerformAdminCheckRoom(req.Context(), &roomserverAPI.PerformAdminCheckRoomRequest{
+		RoomID: vars["roomID"],
+		Repair: body.Repair,
+	}, res)
+	if err := res.Error; err != nil {
+		if err.Code == roomserverAPI.PerformErrorBadRequest {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("The room does not exist."),
+			}
+		}
+		return err.JSONResponse()
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res.Report,
+	}
+}
+
+// AdminDeleteAccountData removes a piece of global or room account data
+// of a local user, e.g. to purge data left behind by an integration.
+func AdminDeleteAccountData(req *http.Request, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	if device.AccountType != userapi.AccountTypeAdmin {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This API can only be used by admin users."),
+		}
+	}
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if vars["userID"] == "" || vars["type"] == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Expecting user ID and account data type."),
+		}
+	}
+	if err = userAPI.PerformAccountDataDeletion(req.Context(), &userapi.PerformAccountDataDeletionRequest{
+		UserID:   vars["userID"],
+		RoomID:   vars["roomID"],
+		DataType: vars["type"],
+	}, &struct{}{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformAccountDataDeletion failed")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+func parseReportID(req *http.Request) (int64, *util.JSONResponse) {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		res := util.ErrorResponse(err)
+		return 0, &res
+	}
+	reportID, err := strconv.ParseInt(vars["reportID"], 10, 64)
+	if err != nil {
+		return 0, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Expecting a numeric report ID."),
+		}
+	}
+	return reportID, nil
+}
@@ -23,6 +23,7 @@ import (
 	"time"
 
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/dendrite/userapi/api"
@@ -139,6 +140,7 @@ func CreateRoom(
 	cfg *config.ClientAPI,
 	profileAPI api.ClientUserAPI, rsAPI roomserverAPI.ClientRoomserverAPI,
 	asAPI appserviceAPI.AppServiceInternalAPI,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	var r createRoomRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
@@ -155,6 +157,14 @@ func CreateRoom(
 			JSON: jsonerror.InvalidArgumentValue(err.Error()),
 		}
 	}
+	spamRes, err := spamChecker.UserMayCreateRoom(req.Context(), device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("spamChecker.UserMayCreateRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if !spamRes.Allowed() {
+		return spamForbidden(spamRes, "You are not allowed to create rooms")
+	}
 	return createRoom(req.Context(), r, device, cfg, profileAPI, rsAPI, asAPI, evTime)
 }
 
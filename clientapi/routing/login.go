@@ -15,12 +15,17 @@
 package routing
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"io"
 	"net/http"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -54,7 +59,7 @@ func passwordLogin() flows {
 // Login implements GET and POST /login
 func Login(
 	req *http.Request, userAPI userapi.ClientUserAPI,
-	cfg *config.ClientAPI,
+	cfg *config.ClientAPI, rateLimits *httputil.RateLimits,
 ) util.JSONResponse {
 	if req.Method == http.MethodGet {
 		// TODO: support other forms of login other than password, depending on config options
@@ -63,8 +68,28 @@ func Login(
 			JSON: passwordLogin(),
 		}
 	} else if req.Method == http.MethodPost {
-		login, cleanup, authErr := auth.LoginFromJSONReader(req.Context(), req.Body, userAPI, userAPI, cfg)
+		reqBytes, err := io.ReadAll(req.Body)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("Reading request body failed: " + err.Error()),
+			}
+		}
+		// Limit failed login attempts for each account as well as for each IP
+		// address, so that guessing a password from many addresses is also
+		// limited. Successful logins don't count, so that nobody else can lock
+		// the user out of their account.
+		accountKey := loginAccountKey(reqBytes, cfg)
+		if accountKey != "" {
+			if r := rateLimits.CheckActionByKey(httputil.RateLimitLoginAccount, accountKey); r != nil {
+				return *r
+			}
+		}
+		login, cleanup, authErr := auth.LoginFromJSONReader(req.Context(), bytes.NewReader(reqBytes), userAPI, userAPI, cfg)
 		if authErr != nil {
+			if accountKey != "" {
+				rateLimits.LimitActionByKey(httputil.RateLimitLoginAccount, accountKey)
+			}
 			return *authErr
 		}
 		// make a device/access token
@@ -78,6 +103,21 @@ func Login(
 	}
 }
 
+// loginAccountKey returns the user ID that a login request is for, or an
+// empty string if the request doesn't name a local user.
+func loginAccountKey(reqBytes []byte, cfg *config.ClientAPI) string {
+	var r auth.Login
+	if err := json.Unmarshal(reqBytes, &r); err != nil || r.Username() == "" {
+		// Leave it to LoginFromJSONReader to reject the request.
+		return ""
+	}
+	localpart, err := userutil.ParseUsernameParam(strings.ToLower(r.Username()), &cfg.Matrix.ServerName)
+	if err != nil {
+		return ""
+	}
+	return userutil.MakeUserID(localpart, cfg.Matrix.ServerName)
+}
+
 func completeAuth(
 	ctx context.Context, serverName gomatrixserverlib.ServerName, userAPI userapi.ClientUserAPI, login *auth.Login,
 	ipAddr, userAgent string,
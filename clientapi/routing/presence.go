@@ -123,7 +123,8 @@ func GetPresence(
 		}
 	}
 
-	p := types.PresenceInternal{LastActiveTS: gomatrixserverlib.Timestamp(lastActive)}
+	presenceID, _ := types.PresenceFromString(presence.Header.Get("presence"))
+	p := types.PresenceInternal{Presence: presenceID, LastActiveTS: gomatrixserverlib.Timestamp(lastActive)}
 	currentlyActive := p.CurrentlyActive()
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -17,9 +17,12 @@ package routing
 import (
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -74,6 +77,17 @@ func SetPusher(
 	if len(body.PushKey) > 512 {
 		return invalidParam("length of pushkey must be no more than 512 bytes")
 	}
+	switch body.Kind {
+	case "", userapi.HTTPKind:
+	case userapi.EmailKind:
+		// The pushkey of an email pusher is the address to send to, which
+		// must be one that the user has verified.
+		if resErr := checkEmailPushKey(req, localpart, body.PushKey, userAPI); resErr != nil {
+			return *resErr
+		}
+	default:
+		return invalidParam("kind must be http or email")
+	}
 	uInt := body.Data["url"]
 	if uInt != nil {
 		u, ok := uInt.(string)
@@ -106,6 +120,87 @@ func SetPusher(
 	}
 }
 
+func checkEmailPushKey(
+	req *http.Request, localpart, pushKey string,
+	userAPI userapi.ClientUserAPI,
+) *util.JSONResponse {
+	var res userapi.QueryThreePIDsForLocalpartResponse
+	if err := userAPI.QueryThreePIDsForLocalpart(req.Context(), &userapi.QueryThreePIDsForLocalpartRequest{
+		Localpart: localpart,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("QueryThreePIDsForLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	for _, threePID := range res.ThreePIDs {
+		if threePID.Medium == "email" && strings.EqualFold(threePID.Address, pushKey) {
+			return nil
+		}
+	}
+	resErr := invalidParam("pushkey must be an email address associated with the account")
+	return &resErr
+}
+
+// emailUnsubscribeTemplate asks the user to confirm that they want to stop
+// receiving emails, so that email scanners and link prefetchers which only
+// follow the link don't unsubscribe them.
+const emailUnsubscribeTemplate = `
+<html>
+<head>
+<title>Unsubscribe</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+</head>
+<body>
+<form method="post" action="{{.myUrl}}">
+    <p>
+    Do you want to stop receiving notification emails at {{.pushKey}}?
+    </p>
+    <input type="submit" value="Unsubscribe" />
+</form>
+</body>
+</html>
+`
+
+// EmailUnsubscribe handles the unsubscribe links in notification emails,
+// which remove the email pusher that the email was sent to. The links are
+// followed from an email client rather than a Matrix client, so there is
+// no access token: instead the link is authenticated with a secret. A GET
+// only shows a confirmation page, and the pusher is removed on a POST,
+// either from that page or from an RFC 8058 one-click unsubscribe.
+func EmailUnsubscribe(
+	w http.ResponseWriter, req *http.Request,
+	cfg *config.ClientAPI, emailCfg *config.EmailNotifications,
+	userAPI userapi.ClientUserAPI,
+) *util.JSONResponse {
+	q := req.URL.Query()
+	userID, appID, pushKey := q.Get("user_id"), q.Get("app_id"), q.Get("pushkey")
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil || domain != cfg.Matrix.ServerName ||
+		!userapi.VerifyEmailUnsubscribeToken(emailCfg.UnsubscribeSecret, q, time.Now()) {
+		return writeHTTPMessage(w, req, "This unsubscribe link is not valid or has expired.", http.StatusBadRequest)
+	}
+	if req.Method != http.MethodPost {
+		serveTemplate(w, emailUnsubscribeTemplate, map[string]string{
+			"myUrl":   req.URL.String(),
+			"pushKey": pushKey,
+		})
+		return nil
+	}
+	if err = userAPI.PerformPusherSet(req.Context(), &userapi.PerformPusherSetRequest{
+		Pusher: userapi.Pusher{
+			AppID:   appID,
+			PushKey: pushKey,
+		},
+		Localpart: localpart,
+		Append:    true,
+	}, &struct{}{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("PerformPusherSet failed")
+		return writeHTTPMessage(w, req, "Failed to unsubscribe, please try again later.", http.StatusInternalServerError)
+	}
+	return writeHTTPMessage(w, req, "You have been unsubscribed from notification emails.", http.StatusOK)
+}
+
 func invalidParam(msg string) util.JSONResponse {
 	return util.JSONResponse{
 		Code: http.StatusBadRequest,
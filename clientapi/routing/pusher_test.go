@@ -0,0 +1,64 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+type unsubscribeUserAPI struct {
+	userapi.ClientUserAPI
+	removed []*userapi.PerformPusherSetRequest
+}
+
+func (a *unsubscribeUserAPI) PerformPusherSet(ctx context.Context, req *userapi.PerformPusherSetRequest, res *struct{}) error {
+	a.removed = append(a.removed, req)
+	return nil
+}
+
+func TestEmailUnsubscribe(t *testing.T) {
+	cfg := &config.ClientAPI{Matrix: &config.Global{ServerName: "test"}}
+	emailCfg := &config.EmailNotifications{UnsubscribeSecret: "secret"}
+	link := userapi.EmailUnsubscribeURL("https://matrix.test", emailCfg.UnsubscribeSecret, "@alice:test", "m.email", "alice@example.com", time.Now())
+	userAPI := &unsubscribeUserAPI{}
+
+	// Following the link only asks the user to confirm.
+	w := httptest.NewRecorder()
+	if res := EmailUnsubscribe(w, httptest.NewRequest(http.MethodGet, link, nil), cfg, emailCfg, userAPI); res != nil {
+		t.Fatalf("unexpected error response %+v", res)
+	}
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `method="post"`) {
+		t.Fatalf("expected a confirmation page, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(userAPI.removed) != 0 {
+		t.Fatalf("expected a GET not to remove the pusher")
+	}
+
+	// A one-click unsubscribe from the email client removes the pusher.
+	req := httptest.NewRequest(http.MethodPost, link, strings.NewReader("List-Unsubscribe=One-Click"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	if res := EmailUnsubscribe(w, req, cfg, emailCfg, userAPI); res != nil {
+		t.Fatalf("unexpected error response %+v", res)
+	}
+	if w.Code != http.StatusOK || len(userAPI.removed) != 1 {
+		t.Fatalf("expected the pusher to be removed, got %d", w.Code)
+	}
+	if r := userAPI.removed[0]; r.Localpart != "alice" || r.Pusher.AppID != "m.email" || r.Pusher.PushKey != "alice@example.com" || r.Pusher.Kind != "" {
+		t.Fatalf("removed the wrong pusher: %+v", r)
+	}
+
+	// Links for another server's users are refused.
+	w = httptest.NewRecorder()
+	link = userapi.EmailUnsubscribeURL("https://matrix.test", emailCfg.UnsubscribeSecret, "@alice:other", "m.email", "alice@example.com", time.Now())
+	_ = EmailUnsubscribe(w, httptest.NewRequest(http.MethodPost, link, nil), cfg, emailCfg, userAPI)
+	if w.Code != http.StatusBadRequest || len(userAPI.removed) != 1 {
+		t.Fatalf("expected the link to be refused, got %d", w.Code)
+	}
+}
@@ -15,10 +15,14 @@
 package routing
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/gomatrixserverlib"
 
@@ -27,12 +31,41 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+type receiptRequest struct {
+	// ThreadID is the MSC3771 thread which the receipt applies to. It is
+	// either "main", the ID of a thread root event, or empty if the receipt
+	// applies to the whole room.
+	ThreadID string `json:"thread_id,omitempty"`
+}
+
 func SetReceipt(req *http.Request, syncProducer *producers.SyncAPIProducer, device *userapi.Device, roomID, receiptType, eventID string) util.JSONResponse {
 	timestamp := gomatrixserverlib.AsTimestamp(time.Now())
+
+	// The body is optional, and may not be present at all for read markers.
+	var r receiptRequest
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+			}
+		}
+		if len(body) > 0 {
+			if err = json.Unmarshal(body, &r); err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON: " + err.Error()),
+				}
+			}
+		}
+	}
+
 	logrus.WithFields(logrus.Fields{
 		"roomID":      roomID,
 		"receiptType": receiptType,
 		"eventID":     eventID,
+		"threadID":    r.ThreadID,
 		"userId":      device.UserID,
 		"timestamp":   timestamp,
 	}).Debug("Setting receipt")
@@ -42,7 +75,14 @@ func SetReceipt(req *http.Request, syncProducer *producers.SyncAPIProducer, devi
 		return util.MessageResponse(400, fmt.Sprintf("receipt type must be m.read not '%s'", receiptType))
 	}
 
-	if err := syncProducer.SendReceipt(req.Context(), device.UserID, roomID, eventID, receiptType, timestamp); err != nil {
+	if r.ThreadID != "" && r.ThreadID != userapi.MainThreadID && !strings.HasPrefix(r.ThreadID, "$") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("thread_id must be \"main\" or the ID of a thread root event"),
+		}
+	}
+
+	if err := syncProducer.SendReceipt(req.Context(), device.UserID, roomID, eventID, receiptType, r.ThreadID, timestamp); err != nil {
 		return util.ErrorResponse(err)
 	}
 
@@ -32,6 +32,7 @@ import (
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/setup/config"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -537,6 +538,7 @@ func Register(
 	req *http.Request,
 	userAPI userapi.ClientUserAPI,
 	cfg *config.ClientAPI,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	defer req.Body.Close() // nolint: errcheck
 	reqBody, err := io.ReadAll(req.Body)
@@ -574,6 +576,9 @@ func Register(
 		return *resErr
 	}
 	if req.URL.Query().Get("kind") == "guest" {
+		if resErr := checkRegistrationSpam(req, spamChecker, "", true); resErr != nil {
+			return *resErr
+		}
 		return handleGuestRegistration(req, r, cfg, userAPI)
 	}
 
@@ -624,6 +629,9 @@ func Register(
 	if resErr := validatePassword(r.Password); resErr != nil {
 		return *resErr
 	}
+	if resErr := checkRegistrationSpam(req, spamChecker, r.Username, false); resErr != nil {
+		return *resErr
+	}
 
 	logger := util.GetLogger(req.Context())
 	logger.WithFields(log.Fields{
@@ -635,6 +643,28 @@ func Register(
 	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, accessToken, accessTokenErr)
 }
 
+// checkRegistrationSpam asks the spam checker modules whether the registration
+// may go ahead, returning an error response if it may not.
+func checkRegistrationSpam(
+	req *http.Request, spamChecker spamcheck.Checker, localpart string, isGuest bool,
+) *util.JSONResponse {
+	spamRes, err := spamChecker.CheckRegistration(req.Context(), &spamcheck.RegistrationRequest{
+		Localpart:  localpart,
+		IsGuest:    isGuest,
+		RemoteAddr: req.RemoteAddr,
+	})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("spamChecker.CheckRegistration failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if !spamRes.Allowed() {
+		res := spamForbidden(spamRes, "Registration has been rejected")
+		return &res
+	}
+	return nil
+}
+
 func handleGuestRegistration(
 	req *http.Request,
 	r registerRequest,
@@ -0,0 +1,125 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+type reportEventRequest struct {
+	Reason string `json:"reason"`
+	Score  *int64 `json:"score"`
+}
+
+// ReportEvent implements POST /rooms/{roomID}/report/{eventID}
+// https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3roomsroomidreporteventid
+func ReportEvent(
+	req *http.Request,
+	device *userapi.Device,
+	roomID, eventID string,
+	cfg *config.ClientAPI,
+	userAPI userapi.ClientUserAPI,
+	rsAPI api.ClientRoomserverAPI,
+	asAPI appserviceAPI.AppServiceInternalAPI,
+	senderDevice *userapi.Device,
+) util.JSONResponse {
+	var r reportEventRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	var score int64
+	if r.Score != nil {
+		score = *r.Score
+		if score < -100 || score > 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("score must be between -100 and 0"),
+			}
+		}
+	}
+
+	res := &api.PerformReportEventResponse{}
+	rsAPI.PerformReportEvent(req.Context(), &api.PerformReportEventRequest{
+		RoomID:  roomID,
+		EventID: eventID,
+		UserID:  device.UserID,
+		Reason:  r.Reason,
+		Score:   score,
+	}, res)
+	if res.Error != nil {
+		return res.Error.JSONResponse()
+	}
+
+	util.GetLogger(req.Context()).WithFields(logrus.Fields{
+		"report_id": res.Report.ID,
+		"room_id":   roomID,
+		"event_id":  eventID,
+	}).Info("Event reported")
+
+	if senderDevice != nil && len(cfg.EventReports.NotifyUserIDs) > 0 {
+		// Notifying the moderators may involve creating rooms, so don't make the
+		// reporting user wait for it.
+		go notifyEventReport(res.Report, cfg, userAPI, rsAPI, asAPI, senderDevice)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// notifyEventReport sends a server notice about a new event report to each
+// of the configured moderators.
+func notifyEventReport(
+	report *types.EventReport,
+	cfg *config.ClientAPI,
+	userAPI userapi.ClientUserAPI,
+	rsAPI api.ClientRoomserverAPI,
+	asAPI appserviceAPI.AppServiceInternalAPI,
+	senderDevice *userapi.Device,
+) {
+	body := fmt.Sprintf(
+		"%s reported event %s sent by %s in room %s (report %d, score %d)",
+		report.ReportingUserID, report.EventID, report.EventSender, report.RoomID, report.ID, report.Score,
+	)
+	if report.Reason != "" {
+		body += ": " + report.Reason
+	}
+	content := map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    body,
+	}
+	ctx := context.Background()
+	for _, userID := range cfg.EventReports.NotifyUserIDs {
+		if _, resErr := sendServerNotice(
+			ctx, userID, content, &cfg.Matrix.ServerNotices, cfg,
+			userAPI, rsAPI, asAPI, senderDevice, nil,
+		); resErr != nil {
+			logrus.WithField("user_id", userID).Errorf("Failed to notify user of event report: %+v", resErr.JSON)
+		}
+	}
+}
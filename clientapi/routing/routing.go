@@ -28,11 +28,13 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -49,6 +51,7 @@ import (
 // nolint: gocyclo
 func Setup(
 	publicAPIMux, wkMux, synapseAdminRouter, dendriteAdminRouter *mux.Router,
+	process *process.ProcessContext,
 	cfg *config.ClientAPI,
 	rsAPI roomserverAPI.ClientRoomserverAPI,
 	asAPI appserviceAPI.AppServiceInternalAPI,
@@ -60,15 +63,23 @@ func Setup(
 	federationSender federationAPI.ClientFederationAPI,
 	keyAPI keyserverAPI.ClientKeyAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
-	mscCfg *config.MSCs, natsClient *nats.Conn,
+	mscCfg *config.MSCs, emailCfg *config.EmailNotifications,
+	natsClient *nats.Conn, spamChecker spamcheck.Checker,
 ) {
 	prometheus.MustRegister(amtRegUsers, sendEventDuration)
 
-	rateLimits := httputil.NewRateLimits(&cfg.RateLimiting)
+	rateLimits := httputil.NewRateLimits(process, &cfg.RateLimiting)
+	if cfg.RateLimiting.Enabled && cfg.RateLimiting.RealIPHeader == "" {
+		logrus.Warn("client_api.rate_limiting.real_ip_header is not set, so login attempts and registrations are rate limited by the address they were received from. If Dendrite is behind a reverse proxy, set it and trusted_proxies to the header and addresses of your proxy, as otherwise all clients share one limit.")
+	}
 	userInteractiveAuth := auth.NewUserInteractive(userAPI, cfg)
 
 	unstableFeatures := map[string]bool{
 		"org.matrix.e2e_cross_signing": true,
+		"org.matrix.msc3030":           true,
+		"org.matrix.msc3391":           true,
+		"org.matrix.msc3771":           true,
+		"org.matrix.msc3773":           true,
 	}
 	for _, msc := range cfg.MSCs.MSCs {
 		unstableFeatures["org.matrix."+msc] = true
@@ -155,10 +166,60 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/eventReports",
+		httputil.MakeAuthAPI("admin_event_reports", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminEventReports(req, device, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/eventReports/{reportID}",
+		httputil.MakeAuthAPI("admin_event_report", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminEventReport(req, device, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/eventReports/{reportID}/resolve",
+		httputil.MakeAuthAPI("admin_resolve_event_report", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminResolveEventReport(req, device, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/inputQueues",
+		httputil.MakeAuthAPI("admin_input_queues", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminInputQueues(req, device, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/compactState",
+		httputil.MakeAuthAPI("admin_compact_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminCompactState(req, device, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/fsck/{roomID}",
+		httputil.MakeAuthAPI("admin_check_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminCheckRoom(req, device, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/accountData/{userID}/{type}",
+		httputil.MakeAuthAPI("admin_delete_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminDeleteAccountData(req, device, userAPI)
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/accountData/{userID}/rooms/{roomID}/{type}",
+		httputil.MakeAuthAPI("admin_delete_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminDeleteAccountData(req, device, userAPI)
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+
 	// server notifications
+	var serverNotificationSender *userapi.Device
 	if cfg.Matrix.ServerNotices.Enabled {
 		logrus.Info("Enabling server notices at /_synapse/admin/v1/send_server_notice")
-		serverNotificationSender, err := getSenderDevice(context.Background(), userAPI, cfg)
+		var err error
+		serverNotificationSender, err = getSenderDevice(context.Background(), userAPI, cfg)
 		if err != nil {
 			logrus.WithError(err).Fatal("unable to get account for sending sending server notices")
 		}
@@ -211,7 +272,7 @@ func Setup(
 
 	v3mux.Handle("/createRoom",
 		httputil.MakeAuthAPI("createRoom", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return CreateRoom(req, device, cfg, userAPI, rsAPI, asAPI)
+			return CreateRoom(req, device, cfg, userAPI, rsAPI, asAPI, spamChecker)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/join/{roomIDOrAlias}",
@@ -219,6 +280,9 @@ func Setup(
 			if r := rateLimits.Limit(req, device); r != nil {
 				return *r
 			}
+			if r := rateLimits.LimitAction(req, device, httputil.RateLimitJoin); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -255,6 +319,9 @@ func Setup(
 			if r := rateLimits.Limit(req, device); r != nil {
 				return *r
 			}
+			if r := rateLimits.LimitAction(req, device, httputil.RateLimitJoin); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -303,6 +370,9 @@ func Setup(
 			if r := rateLimits.Limit(req, device); r != nil {
 				return *r
 			}
+			if r := rateLimits.LimitAction(req, device, httputil.RateLimitInvite); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -330,6 +400,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/send/{eventType}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.LimitAction(req, device, httputil.RateLimitMessage); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -339,6 +412,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.LimitAction(req, device, httputil.RateLimitMessage); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -421,7 +497,10 @@ func Setup(
 		if r := rateLimits.Limit(req, nil); r != nil {
 			return *r
 		}
-		return Register(req, userAPI, cfg)
+		if r := rateLimits.LimitAction(req, nil, httputil.RateLimitRegistration); r != nil {
+			return *r
+		}
+		return Register(req, userAPI, cfg, spamChecker)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
 	v3mux.Handle("/register/available", httputil.MakeExternalAPI("registerAvailable", func(req *http.Request) util.JSONResponse {
@@ -509,6 +588,18 @@ func Setup(
 			return SendTyping(req, device, vars["roomID"], vars["userID"], rsAPI, syncProducer)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
+	v3mux.Handle("/rooms/{roomID}/report/{eventID}",
+		httputil.MakeAuthAPI("rooms_report", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ReportEvent(req, device, vars["roomID"], vars["eventID"], cfg, userAPI, rsAPI, asAPI, serverNotificationSender)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/redact/{eventID}",
 		httputil.MakeAuthAPI("rooms_redact", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -588,7 +679,12 @@ func Setup(
 			if r := rateLimits.Limit(req, nil); r != nil {
 				return *r
 			}
-			return Login(req, userAPI, cfg)
+			if req.Method == http.MethodPost {
+				if r := rateLimits.LimitAction(req, nil, httputil.RateLimitLoginAddress); r != nil {
+					return *r
+				}
+			}
+			return Login(req, userAPI, cfg, rateLimits)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
@@ -840,16 +936,6 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
-	v3mux.Handle("/rooms/{roomID}/initialSync",
-		httputil.MakeExternalAPI("rooms_initial_sync", func(req *http.Request) util.JSONResponse {
-			// TODO: Allow people to peek into rooms.
-			return util.JSONResponse{
-				Code: http.StatusForbidden,
-				JSON: jsonerror.GuestAccessForbidden("Guest access not implemented"),
-			}
-		}),
-	).Methods(http.MethodGet, http.MethodOptions)
-
 	v3mux.Handle("/user/{userID}/account_data/{type}",
 		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -890,6 +976,26 @@ func Setup(
 		}),
 	).Methods(http.MethodGet)
 
+	unstableMux.Handle("/org.matrix.msc3391/user/{userID}/account_data/{type}",
+		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeleteAccountData(req, userAPI, device, vars["userID"], "", vars["type"])
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+
+	unstableMux.Handle("/org.matrix.msc3391/user/{userID}/rooms/{roomID}/account_data/{type}",
+		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeleteAccountData(req, userAPI, device, vars["userID"], vars["roomID"], vars["type"])
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+
 	v3mux.Handle("/admin/whois/{userID}",
 		httputil.MakeAuthAPI("admin_whois", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -1058,24 +1164,16 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	// Stub implementations for sytest
-	v3mux.Handle("/events",
-		httputil.MakeExternalAPI("events", func(req *http.Request) util.JSONResponse {
-			return util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{
-				"chunk": []interface{}{},
-				"start": "",
-				"end":   "",
-			}}
-		}),
-	).Methods(http.MethodGet, http.MethodOptions)
-
-	v3mux.Handle("/initialSync",
-		httputil.MakeExternalAPI("initial_sync", func(req *http.Request) util.JSONResponse {
-			return util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{
-				"end": "",
-			}}
+	// The path must match userapi.EmailUnsubscribePath, which is used to
+	// build the links in notification emails.
+	unstableMux.Handle("/org.matrix.dendrite.email/unsubscribe",
+		httputil.MakeHTMLAPI("email_unsubscribe", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return r
+			}
+			return EmailUnsubscribe(w, req, cfg, emailCfg, userAPI)
 		}),
-	).Methods(http.MethodGet, http.MethodOptions)
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
 	v3mux.Handle("/user/{userId}/rooms/{roomId}/tags",
 		httputil.MakeAuthAPI("get_tags", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
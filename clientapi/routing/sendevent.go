@@ -190,6 +190,12 @@ func SendEvent(
 		txnAndSessionID,
 		false,
 	); err != nil {
+		if notAllowed, ok := err.(*gomatrixserverlib.NotAllowed); ok {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(notAllowed.Message),
+			}
+		}
 		util.GetLogger(req.Context()).WithError(err).Error("SendEvents failed")
 		return jsonerror.InternalServerError()
 	}
@@ -18,7 +18,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/roomserver/version"
@@ -93,16 +95,91 @@ func SendServerNotice(
 		}
 	}
 
+	var txnAndSessionID *api.TransactionID
+	if txnID != nil {
+		txnAndSessionID = &api.TransactionID{
+			TransactionID: *txnID,
+			SessionID:     device.SessionID,
+		}
+	}
+
+	content := map[string]interface{}{
+		"body":    r.Content.Body,
+		"msgtype": r.Content.MsgType,
+	}
+	e, resErr := sendServerNotice(
+		ctx, r.UserID, content, cfgNotices, cfgClient,
+		userAPI, rsAPI, asAPI, senderDevice, txnAndSessionID,
+	)
+	if resErr != nil {
+		return *resErr
+	}
+
+	res := util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: sendEventResponse{e.EventID()},
+	}
+	// Add response to transactionsCache
+	if txnID != nil {
+		txnCache.AddTransaction(device.AccessToken, *txnID, &res)
+	}
+
+	return res
+}
+
+// serverNoticesMutexes serialise sending server notices to each user, so that
+// concurrent notices to a user who doesn't have a server notices room yet don't
+// each create one. Users are spread across a fixed number of mutexes, rather
+// than having one each, so that they don't use more memory the more users
+// have been sent notices.
+var serverNoticesMutexes [64]sync.Mutex
+
+// serverNoticesMutex returns the mutex to hold when sending server notices to
+// the given user.
+func serverNoticesMutex(userID string) *sync.Mutex {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(userID))
+	return &serverNoticesMutexes[hash.Sum32()%uint32(len(serverNoticesMutexes))]
+}
+
+// sendServerNotice sends an m.room.message with the given content to the server
+// notices room of the given user, creating the room or re-inviting the user first
+// if needed.
+func sendServerNotice(
+	ctx context.Context,
+	userID string,
+	content map[string]interface{},
+	cfgNotices *config.ServerNotices,
+	cfgClient *config.ClientAPI,
+	userAPI userapi.ClientUserAPI,
+	rsAPI api.ClientRoomserverAPI,
+	asAPI appserviceAPI.AppServiceInternalAPI,
+	senderDevice *userapi.Device,
+	txnAndSessionID *api.TransactionID,
+) (*gomatrixserverlib.Event, *util.JSONResponse) {
+	errorResponse := func(err error) (*gomatrixserverlib.Event, *util.JSONResponse) {
+		res := util.ErrorResponse(err)
+		return nil, &res
+	}
+	internalServerError := func() (*gomatrixserverlib.Event, *util.JSONResponse) {
+		res := jsonerror.InternalServerError()
+		return nil, &res
+	}
+
+	mutex := serverNoticesMutex(userID)
+	mutex.Lock()
+	defer mutex.Unlock()
+
 	// get rooms for specified user
 	allUserRooms := []string{}
 	userRooms := api.QueryRoomsForUserResponse{}
 	// Get rooms the user is either joined, invited or has left.
 	for _, membership := range []string{"join", "invite", "leave"} {
 		if err := rsAPI.QueryRoomsForUser(ctx, &api.QueryRoomsForUserRequest{
-			UserID:         r.UserID,
+			UserID:         userID,
 			WantMembership: membership,
 		}, &userRooms); err != nil {
-			return util.ErrorResponse(err)
+			return errorResponse(err)
 		}
 		allUserRooms = append(allUserRooms, userRooms.RoomIDs...)
 	}
@@ -114,7 +191,7 @@ func SendServerNotice(
 		UserID:         senderUserID,
 		WantMembership: "join",
 	}, &senderRooms); err != nil {
-		return util.ErrorResponse(err)
+		return errorResponse(err)
 	}
 
 	// check if we have rooms in common
@@ -128,7 +205,7 @@ func SendServerNotice(
 	}
 
 	if len(commonRooms) > 1 {
-		return util.ErrorResponse(fmt.Errorf("expected to find one room, but got %d", len(commonRooms)))
+		return errorResponse(fmt.Errorf("expected to find one room, but got %d", len(commonRooms)))
 	}
 
 	var (
@@ -139,19 +216,19 @@ func SendServerNotice(
 	// create a new room for the user
 	if len(commonRooms) == 0 {
 		powerLevelContent := eventutil.InitialPowerLevelsContent(senderUserID)
-		powerLevelContent.Users[r.UserID] = -10 // taken from Synapse
+		powerLevelContent.Users[userID] = -10 // taken from Synapse
 		pl, err := json.Marshal(powerLevelContent)
 		if err != nil {
-			return util.ErrorResponse(err)
+			return errorResponse(err)
 		}
 		createContent := map[string]interface{}{}
 		createContent["m.federate"] = false
 		cc, err := json.Marshal(createContent)
 		if err != nil {
-			return util.ErrorResponse(err)
+			return errorResponse(err)
 		}
 		crReq := createRoomRequest{
-			Invite:                    []string{r.UserID},
+			Invite:                    []string{userID},
 			Name:                      cfgNotices.RoomName,
 			Visibility:                "private",
 			Preset:                    presetPrivateChat,
@@ -173,54 +250,42 @@ func SendServerNotice(
 					Order: 1.0,
 				},
 			}}
-			if err = saveTagData(req, r.UserID, roomID, userAPI, serverAlertTag); err != nil {
+			if err = saveTagData(ctx, userID, roomID, userAPI, serverAlertTag); err != nil {
 				util.GetLogger(ctx).WithError(err).Error("saveTagData failed")
-				return jsonerror.InternalServerError()
+				return internalServerError()
 			}
 
 		default:
 			// if we didn't get a createRoomResponse, we probably received an error, so return that.
-			return roomRes
+			return nil, &roomRes
 		}
 	} else {
 		// we've found a room in common, check the membership
 		roomID = commonRooms[0]
 		membershipRes := api.QueryMembershipForUserResponse{}
-		err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{UserID: r.UserID, RoomID: roomID}, &membershipRes)
+		err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{UserID: userID, RoomID: roomID}, &membershipRes)
 		if err != nil {
 			util.GetLogger(ctx).WithError(err).Error("unable to query membership for user")
-			return jsonerror.InternalServerError()
+			return internalServerError()
 		}
 		if !membershipRes.IsInRoom {
 			// re-invite the user
-			res, err := sendInvite(ctx, userAPI, senderDevice, roomID, r.UserID, "Server notice room", cfgClient, rsAPI, asAPI, time.Now())
+			res, err := sendInvite(ctx, userAPI, senderDevice, roomID, userID, "Server notice room", cfgClient, rsAPI, asAPI, time.Now())
 			if err != nil {
-				return res
+				return nil, &res
 			}
 		}
 	}
 
 	startedGeneratingEvent := time.Now()
 
-	request := map[string]interface{}{
-		"body":    r.Content.Body,
-		"msgtype": r.Content.MsgType,
-	}
-	e, resErr := generateSendEvent(ctx, request, senderDevice, roomID, "m.room.message", nil, cfgClient, rsAPI, time.Now())
+	e, resErr := generateSendEvent(ctx, content, senderDevice, roomID, "m.room.message", nil, cfgClient, rsAPI, time.Now())
 	if resErr != nil {
 		logrus.Errorf("failed to send message: %+v", resErr)
-		return *resErr
+		return nil, resErr
 	}
 	timeToGenerateEvent := time.Since(startedGeneratingEvent)
 
-	var txnAndSessionID *api.TransactionID
-	if txnID != nil {
-		txnAndSessionID = &api.TransactionID{
-			TransactionID: *txnID,
-			SessionID:     device.SessionID,
-		}
-	}
-
 	// pass the new event to the roomserver and receive the correct event ID
 	// event ID in case of duplicate transaction is discarded
 	startedSubmittingEvent := time.Now()
@@ -236,7 +301,7 @@ func SendServerNotice(
 		false,
 	); err != nil {
 		util.GetLogger(ctx).WithError(err).Error("SendEvents failed")
-		return jsonerror.InternalServerError()
+		return internalServerError()
 	}
 	util.GetLogger(ctx).WithFields(logrus.Fields{
 		"event_id":     e.EventID(),
@@ -245,21 +310,12 @@ func SendServerNotice(
 	}).Info("Sent event to roomserver")
 	timeToSubmitEvent := time.Since(startedSubmittingEvent)
 
-	res := util.JSONResponse{
-		Code: http.StatusOK,
-		JSON: sendEventResponse{e.EventID()},
-	}
-	// Add response to transactionsCache
-	if txnID != nil {
-		txnCache.AddTransaction(device.AccessToken, *txnID, &res)
-	}
-
 	// Take a note of how long it took to generate the event vs submit
 	// it to the roomserver.
 	sendEventDuration.With(prometheus.Labels{"action": "build"}).Observe(float64(timeToGenerateEvent.Milliseconds()))
 	sendEventDuration.With(prometheus.Labels{"action": "submit"}).Observe(float64(timeToSubmitEvent.Milliseconds()))
 
-	return res
+	return e, nil
 }
 
 func (r sendServerNoticeRequest) valid() (ok bool) {
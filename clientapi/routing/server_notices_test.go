@@ -1,7 +1,18 @@
 package routing
 
 import (
+	"context"
+	"sync"
 	"testing"
+
+	"github.com/matrix-org/dendrite/appservice"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func Test_sendServerNoticeRequest_validate(t *testing.T) {
@@ -81,3 +92,64 @@ func Test_sendServerNoticeRequest_validate(t *testing.T) {
 		})
 	}
 }
+
+func Test_sendServerNotice_concurrent(t *testing.T) {
+	alice := test.NewUser(t)
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		// SetFederationAPI starts the room event input consumer
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, nil, rsAPI, nil)
+		asAPI := appservice.NewInternalAPI(base, userAPI, rsAPI)
+		rsAPI.SetAppserviceAPI(asAPI)
+
+		localpart, _, err := gomatrixserverlib.SplitID('@', alice.ID)
+		if err != nil {
+			t.Fatalf("failed to split user ID: %s", err)
+		}
+		if err = userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+			AccountType: uapi.AccountTypeUser,
+			Localpart:   localpart,
+		}, &uapi.PerformAccountCreationResponse{}); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+
+		senderDevice, err := getSenderDevice(ctx, userAPI, &base.Cfg.ClientAPI)
+		if err != nil {
+			t.Fatalf("failed to get the sender device: %s", err)
+		}
+
+		// Send several notices at once to a user who doesn't have a server
+		// notices room yet. Only one room should be created for all of them.
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				content := map[string]interface{}{"msgtype": "m.text", "body": "Hello world!"}
+				if _, resErr := sendServerNotice(
+					ctx, alice.ID, content, &base.Cfg.Global.ServerNotices, &base.Cfg.ClientAPI,
+					userAPI, rsAPI, asAPI, senderDevice, nil,
+				); resErr != nil {
+					t.Errorf("failed to send server notice: %+v", resErr.JSON)
+				}
+			}()
+		}
+		wg.Wait()
+
+		res := &api.QueryRoomsForUserResponse{}
+		if err = rsAPI.QueryRoomsForUser(ctx, &api.QueryRoomsForUserRequest{
+			UserID:         alice.ID,
+			WantMembership: "invite",
+		}, res); err != nil {
+			t.Fatalf("failed to query rooms for user: %s", err)
+		}
+		if len(res.RoomIDs) != 1 {
+			t.Fatalf("expected exactly one server notices room, got %d: %v", len(res.RoomIDs), res.RoomIDs)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
+	"github.com/matrix-org/util"
+)
+
+// spamForbidden returns the response for an action which a spam checker
+// module didn't allow, using the reason given by the module if there is one.
+func spamForbidden(res spamcheck.Result, defaultMsg string) util.JSONResponse {
+	msg := res.Reason
+	if msg == "" {
+		msg = defaultMsg
+	}
+	return util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden(msg),
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	rsstorage "github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/setup/base"
+)
+
+const usage = `Usage: %s
+
+Compacts the roomserver state tables. State blocks with identical contents are
+merged, and state snapshots and state blocks which are no longer referenced are
+deleted once they have been unreferenced for at least -grace-period. Unreferenced
+state which is still within the grace period is marked, and will be deleted by a
+later run.
+
+If Dendrite is stopped, the grace period can be left at 0 so that everything is
+compacted in one run. Otherwise, set it to longer than it takes to process an
+event, or use the /_dendrite/admin/compactState admin API instead. When using
+SQLite, always stop Dendrite before running this.
+
+The space used by deleted rows is reused by the database, but it may need to be
+vacuumed before the files on disk get smaller.
+
+Example:
+
+	./compact-state --config dendrite.yaml -grace-period 1h
+
+Arguments:
+
+`
+
+var gracePeriod = flag.Duration("grace-period", 0, "How long state must have been unreferenced before it is deleted")
+
+func main() {
+	name := os.Args[0]
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, usage, name)
+		flag.PrintDefaults()
+	}
+	cfg := setup.ParseFlags(true)
+	b := base.NewBaseDendrite(cfg, "CompactState", base.DisableMetrics)
+	defer b.Close() // nolint: errcheck
+
+	db, err := rsstorage.Open(b, &cfg.RoomServer.Database, b.Caches)
+	if err != nil {
+		logrus.WithError(err).Fatalln("Failed to connect to the roomserver database")
+	}
+
+	start := time.Now()
+	report, err := db.CompactState(context.Background(), *gracePeriod)
+	if report != nil {
+		logrus.Infof("Found %d duplicate state blocks, rewrote %d snapshots", report.DuplicateBlocks, report.SnapshotsRewritten)
+		logrus.Infof("Marked %d snapshots and %d state blocks as unreferenced", report.SnapshotsMarked, report.BlocksMarked)
+		logrus.Infof("Deleted %d snapshots and %d state blocks, reclaiming about %d bytes", report.SnapshotsDeleted, report.BlocksDeleted, report.BytesReclaimed)
+	}
+	if err != nil {
+		logrus.WithError(err).Fatalln("Failed to compact the roomserver state")
+	}
+	logrus.Infof("Compaction finished in %s", time.Since(start))
+}
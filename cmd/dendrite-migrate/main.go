@@ -0,0 +1,400 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+
+	asstorage "github.com/matrix-org/dendrite/appservice/storage"
+	fedstorage "github.com/matrix-org/dendrite/federationapi/storage"
+	fedpostgres "github.com/matrix-org/dendrite/federationapi/storage/postgres/deltas"
+	fedsqlite3 "github.com/matrix-org/dendrite/federationapi/storage/sqlite3/deltas"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	keystorage "github.com/matrix-org/dendrite/keyserver/storage"
+	keypostgres "github.com/matrix-org/dendrite/keyserver/storage/postgres/deltas"
+	keysqlite3 "github.com/matrix-org/dendrite/keyserver/storage/sqlite3/deltas"
+	mediastorage "github.com/matrix-org/dendrite/mediaapi/storage"
+	rsstorage "github.com/matrix-org/dendrite/roomserver/storage"
+	rspostgres "github.com/matrix-org/dendrite/roomserver/storage/postgres/deltas"
+	rssqlite3 "github.com/matrix-org/dendrite/roomserver/storage/sqlite3/deltas"
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/setup/base"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/mscs/msc2836"
+	syncstorage "github.com/matrix-org/dendrite/syncapi/storage"
+	syncpostgres "github.com/matrix-org/dendrite/syncapi/storage/postgres/deltas"
+	syncsqlite3 "github.com/matrix-org/dendrite/syncapi/storage/sqlite3/deltas"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	userstorage "github.com/matrix-org/dendrite/userapi/storage"
+	userpostgres "github.com/matrix-org/dendrite/userapi/storage/postgres/deltas"
+	usersqlite3 "github.com/matrix-org/dendrite/userapi/storage/sqlite3/deltas"
+)
+
+const usage = `Usage: %s [options] <command> [arguments]
+
+Shows, executes and rolls back the database migrations of each component.
+Stop Dendrite before executing or rolling back migrations.
+
+Commands:
+
+	status
+		Show which migrations have been executed.
+	up
+		Create the tables and execute any pending migrations, as Dendrite
+		does when it starts. With -dry-run, the pending migrations are
+		executed in a transaction which is rolled back instead, and the
+		SQL statements are printed.
+	down <component> <version>
+		Roll back the migrations of the component which were written
+		after the given version, newest first, so that the database can
+		be used by the Dendrite version which wrote that migration. Use
+		"initial" as the version to roll back all migrations. With
+		-dry-run, nothing is changed and the SQL statements are printed.
+	from-sqlite <config>
+		Copy all data from the SQLite databases of the given config file
+		into the PostgreSQL databases of --config, keeping all IDs and
+		stream positions. The tables are created and migrated in both
+		first. The PostgreSQL databases must be empty.
+
+Example:
+
+	%s --config dendrite.yaml down userapi "userapi: add account type"
+	%s --config dendrite-postgres.yaml from-sqlite dendrite.yaml
+
+Options:
+
+`
+
+// initialVersion can be given to the down command to roll back all
+// migrations.
+const initialVersion = "initial"
+
+var (
+	componentName = flag.String("component", "", "Only use the database of this component")
+	dryRun        = flag.Bool("dry-run", false, "Roll back the changes afterwards and print the SQL statements")
+)
+
+// component is a component with its own database migrations.
+type component struct {
+	name     string
+	database func(cfg *config.Dendrite) *config.DatabaseOptions
+	// The migrations for each database engine, if the component has any.
+	postgres []sqlutil.Migration
+	sqlite3  []sqlutil.Migration
+	// open opens the component's storage, which creates the tables and
+	// executes the migrations.
+	open func(b *base.BaseDendrite) error
+}
+
+func (c *component) migrations(opts *config.DatabaseOptions) []sqlutil.Migration {
+	if opts.ConnectionString.IsSQLite() {
+		return c.sqlite3
+	}
+	return c.postgres
+}
+
+var components = []*component{
+	{
+		name:     "federationapi",
+		database: func(cfg *config.Dendrite) *config.DatabaseOptions { return &cfg.FederationAPI.Database },
+		postgres: fedpostgres.Migrations,
+		sqlite3:  fedsqlite3.Migrations,
+		open:     openFederationAPI,
+	},
+	{
+		name:     "keyserver",
+		database: func(cfg *config.Dendrite) *config.DatabaseOptions { return &cfg.KeyServer.Database },
+		postgres: keypostgres.Migrations,
+		sqlite3:  keysqlite3.Migrations,
+		open:     openKeyServer,
+	},
+	{
+		name:     "roomserver",
+		database: func(cfg *config.Dendrite) *config.DatabaseOptions { return &cfg.RoomServer.Database },
+		postgres: rspostgres.Migrations,
+		sqlite3:  rssqlite3.Migrations,
+		open:     openRoomServer,
+	},
+	{
+		name:     "syncapi",
+		database: func(cfg *config.Dendrite) *config.DatabaseOptions { return &cfg.SyncAPI.Database },
+		postgres: syncpostgres.Migrations,
+		sqlite3:  syncsqlite3.Migrations,
+		open:     openSyncAPI,
+	},
+	{
+		name:     "userapi",
+		database: func(cfg *config.Dendrite) *config.DatabaseOptions { return &cfg.UserAPI.AccountDatabase },
+		postgres: userpostgres.Migrations,
+		sqlite3:  usersqlite3.Migrations,
+		open:     openUserAPI,
+	},
+	{
+		name:     "mediaapi",
+		database: func(cfg *config.Dendrite) *config.DatabaseOptions { return &cfg.MediaAPI.Database },
+		open:     openMediaAPI,
+	},
+	{
+		name:     "appservice",
+		database: func(cfg *config.Dendrite) *config.DatabaseOptions { return &cfg.AppServiceAPI.Database },
+		open:     openAppService,
+	},
+	{
+		name:     "mscs",
+		database: func(cfg *config.Dendrite) *config.DatabaseOptions { return &cfg.MSCs.Database },
+		open:     openMSCs,
+	},
+}
+
+func main() {
+	name := os.Args[0]
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, usage, name, name, name)
+		flag.PrintDefaults()
+	}
+	cfg := setup.ParseFlags(true)
+	args := flag.Args()
+
+	var err error
+	ctx := context.Background()
+	switch {
+	case len(args) == 1 && args[0] == "status":
+		err = status(ctx, os.Stdout, cfg, selectComponents(*componentName))
+	case len(args) == 1 && args[0] == "up" && *dryRun:
+		err = upDryRun(ctx, os.Stdout, cfg, selectComponents(*componentName))
+	case len(args) == 1 && args[0] == "up":
+		b := base.NewBaseDendrite(cfg, "Migrate", base.DisableMetrics)
+		defer b.Close() // nolint: errcheck
+		err = up(b, selectComponents(*componentName))
+		if err == nil {
+			err = status(ctx, os.Stdout, cfg, selectComponents(*componentName))
+		}
+	case len(args) == 3 && args[0] == "down":
+		err = down(ctx, os.Stdout, cfg, selectComponents(args[1])[0], args[2], *dryRun)
+	case len(args) == 2 && args[0] == "from-sqlite":
+		var sourceCfg *config.Dendrite
+		if sourceCfg, err = config.Load(args[1], true); err != nil {
+			logrus.WithError(err).Fatalf("Failed to load %s", args[1])
+		}
+		source := base.NewBaseDendrite(sourceCfg, "Migrate", base.DisableMetrics)
+		defer source.Close() // nolint: errcheck
+		target := base.NewBaseDendrite(cfg, "Migrate", base.DisableMetrics)
+		defer target.Close() // nolint: errcheck
+		err = fromSQLite(ctx, os.Stdout, source, target, selectComponents(*componentName))
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to migrate")
+	}
+}
+
+// selectComponents returns the component with the given name, or all
+// components if the name is empty.
+func selectComponents(name string) []*component {
+	if name == "" {
+		return components
+	}
+	for _, c := range components {
+		if c.name == name {
+			return []*component{c}
+		}
+	}
+	logrus.Fatalf("Unknown component %q", name)
+	return nil
+}
+
+// withMigrations returns the components which have database migrations.
+func withMigrations(components []*component) []*component {
+	var result []*component
+	for _, c := range components {
+		if c.postgres != nil || c.sqlite3 != nil {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// migrator opens the database of the component and returns a migrator with
+// its migrations.
+func migrator(cfg *config.Dendrite, c *component) (*sqlutil.Migrator, error) {
+	opts := c.database(cfg)
+	if opts.ConnectionString == "" {
+		opts = &cfg.Global.DatabaseOptions
+	}
+	db, err := sqlutil.OpenRecordable(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the %s database: %w", c.name, err)
+	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(c.migrations(opts)...)
+	return m, nil
+}
+
+func status(ctx context.Context, w io.Writer, cfg *config.Dendrite, components []*component) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "COMPONENT\tMIGRATION\tSTATUS\tREVERSIBLE")
+	for _, c := range withMigrations(components) {
+		m, err := migrator(cfg, c)
+		if err != nil {
+			return err
+		}
+		migrations, err := m.Status(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get the status of the %s migrations: %w", c.name, err)
+		}
+		for _, migration := range migrations {
+			state := "pending"
+			if migration.Executed {
+				state = fmt.Sprintf("executed at %s by %s", migration.ExecutedAt, migration.DendriteVersion)
+			}
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%v\n", c.name, migration.Version, state, migration.Reversible)
+		}
+	}
+	return tw.Flush()
+}
+
+func up(b *base.BaseDendrite, components []*component) error {
+	for _, c := range components {
+		if err := c.open(b); err != nil {
+			return fmt.Errorf("failed to migrate the %s database: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+func upDryRun(ctx context.Context, w io.Writer, cfg *config.Dendrite, components []*component) error {
+	for _, c := range withMigrations(components) {
+		m, err := migrator(cfg, c)
+		if err != nil {
+			return err
+		}
+		migrations, err := m.Status(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get the status of the %s migrations: %w", c.name, err)
+		}
+		for _, migration := range migrations {
+			if !migration.Executed {
+				_, _ = fmt.Fprintf(w, "-- %s: executing %q\n", c.name, migration.Version)
+			}
+		}
+		m.DryRun = true
+		if err = m.Up(sqlutil.WithStatementRecorder(ctx, printStatement(w))); err != nil {
+			return fmt.Errorf("failed to migrate the %s database: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+func down(ctx context.Context, w io.Writer, cfg *config.Dendrite, c *component, version string, dryRun bool) error {
+	if len(withMigrations([]*component{c})) == 0 {
+		return fmt.Errorf("%s has no migrations", c.name)
+	}
+	m, err := migrator(cfg, c)
+	if err != nil {
+		return err
+	}
+	if version == initialVersion {
+		version = ""
+	}
+	migrations, err := m.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the status of the %s migrations: %w", c.name, err)
+	}
+	rolledBack := 0
+	for i := len(migrations) - 1; i >= 0 && migrations[i].Version != version; i-- {
+		if migrations[i].Executed {
+			_, _ = fmt.Fprintf(w, "-- %s: rolling back %q\n", c.name, migrations[i].Version)
+			rolledBack++
+		}
+	}
+	if rolledBack == 0 {
+		_, _ = fmt.Fprintf(w, "-- %s: nothing to roll back\n", c.name)
+	}
+	m.DryRun = dryRun
+	if dryRun {
+		ctx = sqlutil.WithStatementRecorder(ctx, printStatement(w))
+	}
+	if err = m.DownTo(ctx, version); err != nil {
+		return fmt.Errorf("failed to roll back the %s database: %w", c.name, err)
+	}
+	return nil
+}
+
+func printStatement(w io.Writer) sqlutil.StatementRecorder {
+	return func(query string, args []driver.NamedValue) {
+		_, _ = fmt.Fprintln(w, query)
+		for _, arg := range args {
+			_, _ = fmt.Fprintf(w, "-- $%d = %v\n", arg.Ordinal, arg.Value)
+		}
+	}
+}
+
+func openFederationAPI(b *base.BaseDendrite) error {
+	_, err := fedstorage.NewDatabase(b, &b.Cfg.FederationAPI.Database, b.Caches, b.Cfg.Global.ServerName)
+	return err
+}
+
+func openKeyServer(b *base.BaseDendrite) error {
+	_, err := keystorage.NewDatabase(b, &b.Cfg.KeyServer.Database)
+	return err
+}
+
+func openRoomServer(b *base.BaseDendrite) error {
+	_, err := rsstorage.Open(b, &b.Cfg.RoomServer.Database, b.Caches)
+	return err
+}
+
+func openSyncAPI(b *base.BaseDendrite) error {
+	_, err := syncstorage.NewSyncServerDatasource(b, &b.Cfg.SyncAPI.Database)
+	return err
+}
+
+func openMediaAPI(b *base.BaseDendrite) error {
+	_, err := mediastorage.NewMediaAPIDatasource(b, &b.Cfg.MediaAPI.Database)
+	return err
+}
+
+func openAppService(b *base.BaseDendrite) error {
+	_, err := asstorage.NewDatabase(b, &b.Cfg.AppServiceAPI.Database)
+	return err
+}
+
+func openMSCs(b *base.BaseDendrite) error {
+	_, err := msc2836.NewDatabase(b, &b.Cfg.MSCs.Database)
+	return err
+}
+
+func openUserAPI(b *base.BaseDendrite) error {
+	_, err := userstorage.NewUserAPIDatabase(
+		b,
+		&b.Cfg.UserAPI.AccountDatabase,
+		b.Cfg.Global.ServerName,
+		b.Cfg.UserAPI.BCryptCost,
+		b.Cfg.UserAPI.OpenIDTokenLifetimeMS,
+		userapi.DefaultLoginTokenLifetime,
+		b.Cfg.UserAPI.Matrix.ServerNotices.LocalPart,
+	)
+	return err
+}
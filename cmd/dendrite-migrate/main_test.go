@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+)
+
+func TestDownAndUp(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		b, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+		ctx := context.Background()
+
+		// Each component can be rolled back as far as its latest migration
+		// which can't be rolled back, which stays executed along with the
+		// migrations before it.
+		targets := map[string]string{}
+		irreversible := map[string]int{}
+		last := map[string]int{}
+		for _, c := range withMigrations(components) {
+			m, err := migrator(b.Cfg, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			migrations, err := m.Status(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			targets[c.name], irreversible[c.name] = initialVersion, -1
+			last[c.name] = len(migrations) - 1
+			for i, migration := range migrations {
+				if !migration.Reversible {
+					targets[c.name], irreversible[c.name] = migration.Version, i
+				}
+			}
+		}
+
+		assertExecuted := func(want bool) {
+			t.Helper()
+			for _, c := range withMigrations(components) {
+				m, err := migrator(b.Cfg, c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				migrations, err := m.Status(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, migration := range migrations {
+					if wantExecuted := want || i <= irreversible[c.name]; migration.Executed != wantExecuted {
+						t.Fatalf("%s: expected executed to be %v for %q", c.name, wantExecuted, migration.Version)
+					}
+				}
+			}
+		}
+
+		if err := up(b, components); err != nil {
+			t.Fatalf("failed to create the databases: %s", err)
+		}
+		assertExecuted(true)
+
+		// Rolling back past a migration which can't be rolled back is refused
+		// without changing anything.
+		for _, c := range withMigrations(components) {
+			if targets[c.name] == initialVersion {
+				continue
+			}
+			var out bytes.Buffer
+			if err := down(ctx, &out, b.Cfg, c, initialVersion, false); err == nil {
+				t.Fatalf("%s: expected rolling back past %q to fail", c.name, targets[c.name])
+			}
+		}
+		assertExecuted(true)
+
+		// A dry run prints the statements but doesn't change anything.
+		for _, c := range withMigrations(components) {
+			var out bytes.Buffer
+			if err := down(ctx, &out, b.Cfg, c, targets[c.name], true); err != nil {
+				t.Fatalf("%s: failed to roll back in a dry run: %s", c.name, err)
+			}
+			if irreversible[c.name] == last[c.name] {
+				if !strings.Contains(out.String(), "nothing to roll back") {
+					t.Fatalf("%s: expected nothing to be rolled back, got:\n%s", c.name, out.String())
+				}
+			} else if !strings.Contains(out.String(), "DELETE FROM db_migrations") {
+				t.Fatalf("%s: expected statements to be printed, got:\n%s", c.name, out.String())
+			}
+		}
+		assertExecuted(true)
+
+		for _, c := range withMigrations(components) {
+			var out bytes.Buffer
+			if err := down(ctx, &out, b.Cfg, c, targets[c.name], false); err != nil {
+				t.Fatalf("%s: failed to roll back: %s", c.name, err)
+			}
+		}
+		assertExecuted(false)
+
+		// The databases can be upgraded again after rolling back.
+		if err := up(b, components); err != nil {
+			t.Fatalf("failed to upgrade the databases again: %s", err)
+		}
+		assertExecuted(true)
+	})
+}
@@ -0,0 +1,690 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/base"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// copyProgressInterval is how often the progress of copying a table is
+// logged, in rows.
+const copyProgressInterval = 10000
+
+// migrationsTable is where each database records its executed migrations,
+// which aren't copied as the PostgreSQL databases record their own.
+const migrationsTable = "db_migrations"
+
+// seededTables are created with rows in them, which are also in the SQLite
+// databases, so they are replaced rather than needing to be empty.
+var seededTables = map[string]bool{
+	"roomserver_event_types":      true,
+	"roomserver_event_state_keys": true,
+}
+
+// sqliteOnlyTables only exist in SQLite databases, where they take the place
+// of PostgreSQL sequences. They are read by sqliteCounters instead of being
+// copied.
+var sqliteOnlyTables = map[string]bool{
+	"sqlite_sequence":     true,
+	"syncapi_stream_id":   true,
+	"appservice_counters": true,
+}
+
+// syncAPIStreamSequences maps the streams in the SQLite syncapi_stream_id
+// table to the PostgreSQL sequences which are used for them instead.
+var syncAPIStreamSequences = map[string]string{
+	"global":       "syncapi_stream_id",
+	"accountdata":  "syncapi_stream_id",
+	"invite":       "syncapi_stream_id",
+	"receipt":      "syncapi_receipt_id",
+	"presence":     "syncapi_presence_id",
+	"notification": "syncapi_notification_data_id_seq",
+}
+
+var nextvalRegexp = regexp.MustCompile(`^nextval\('([^']+)'(::regclass)?\)$`)
+
+// databasePair is a PostgreSQL database and the SQLite databases whose data
+// is copied into it. With a global database pool, the databases of all
+// components are copied into the same PostgreSQL database.
+type databasePair struct {
+	postgres *config.DatabaseOptions
+	sqlite   []*config.DatabaseOptions
+	// The components which use the databases, for logging.
+	components []string
+}
+
+// targetColumn is a column of a table in the PostgreSQL database.
+type targetColumn struct {
+	name     string
+	dataType string
+	udtName  string
+}
+
+// copiedTable is the number of rows which were copied for a table.
+type copiedTable struct {
+	table  string
+	source *config.DatabaseOptions
+	target *config.DatabaseOptions
+	rows   int64
+}
+
+// fromSQLite copies all of the data in the SQLite databases of the source
+// configuration into the PostgreSQL databases of the target configuration.
+// The tables are created and migrated in both first, by opening the storage
+// of every component. The PostgreSQL databases must not contain any data.
+func fromSQLite(ctx context.Context, w io.Writer, source, target *base.BaseDendrite, components []*component) error {
+	pairs, err := pairDatabases(source.Cfg, target.Cfg, components)
+	if err != nil {
+		return err
+	}
+	logrus.Info("Creating and migrating the tables in the SQLite databases")
+	if err = up(source, components); err != nil {
+		return err
+	}
+	logrus.Info("Creating and migrating the tables in the PostgreSQL databases")
+	if err = up(target, components); err != nil {
+		return err
+	}
+
+	var copied []copiedTable
+	for _, pair := range pairs {
+		tables, err := copyDatabases(ctx, pair)
+		if err != nil {
+			return fmt.Errorf("failed to copy the %v databases: %w", pair.components, err)
+		}
+		copied = append(copied, tables...)
+	}
+	return verifyCopy(ctx, w, copied)
+}
+
+// pairDatabases works out which SQLite databases are copied into which
+// PostgreSQL databases.
+func pairDatabases(source, target *config.Dendrite, components []*component) ([]*databasePair, error) {
+	var pairs []*databasePair
+	byTarget := map[config.DataSource]*databasePair{}
+	for _, c := range components {
+		sourceOpts, targetOpts := c.database(source), c.database(target)
+		if sourceOpts.ConnectionString == "" {
+			sourceOpts = &source.Global.DatabaseOptions
+		}
+		if targetOpts.ConnectionString == "" {
+			targetOpts = &target.Global.DatabaseOptions
+		}
+		if !sourceOpts.ConnectionString.IsSQLite() {
+			return nil, fmt.Errorf("the %s database to copy from isn't a SQLite database", c.name)
+		}
+		if !targetOpts.ConnectionString.IsPostgres() {
+			return nil, fmt.Errorf("the %s database to copy into isn't a PostgreSQL database", c.name)
+		}
+		pair, ok := byTarget[targetOpts.ConnectionString]
+		if !ok {
+			pair = &databasePair{postgres: targetOpts}
+			byTarget[targetOpts.ConnectionString] = pair
+			pairs = append(pairs, pair)
+		}
+		pair.components = append(pair.components, c.name)
+		duplicate := false
+		for _, opts := range pair.sqlite {
+			duplicate = duplicate || opts.ConnectionString == sourceOpts.ConnectionString
+		}
+		if !duplicate {
+			pair.sqlite = append(pair.sqlite, sourceOpts)
+		}
+	}
+	return pairs, nil
+}
+
+// copyDatabases copies the SQLite databases of the pair into its PostgreSQL
+// database and advances its sequences past the copied rows, in a single
+// transaction so that nothing is copied if anything fails.
+func copyDatabases(ctx context.Context, pair *databasePair) (copied []copiedTable, err error) {
+	db, err := sqlutil.Open(pair.postgres, sqlutil.NewDummyWriter())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the PostgreSQL database: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, db, "failed to close the PostgreSQL database")
+
+	err = sqlutil.WithTransaction(db, func(txn *sql.Tx) error {
+		targetTables, err := selectTargetColumns(ctx, txn)
+		if err != nil {
+			return err
+		}
+		counters := map[string]int64{}
+		copiedFrom := map[string]config.DataSource{}
+		for _, opts := range pair.sqlite {
+			tables, err := copyDatabase(ctx, opts, txn, targetTables, counters)
+			if err != nil {
+				return err
+			}
+			for _, table := range tables {
+				if other, ok := copiedFrom[table.table]; ok {
+					return fmt.Errorf("table %s is in both %s and %s", table.table, other, opts.ConnectionString)
+				}
+				copiedFrom[table.table] = opts.ConnectionString
+				table.target = pair.postgres
+				copied = append(copied, table)
+			}
+		}
+		return updateSequences(ctx, txn, counters)
+	})
+	return copied, err
+}
+
+// copyDatabase copies all tables of a SQLite database which also exist in
+// the PostgreSQL database, and adds the values of its counters to counters.
+func copyDatabase(
+	ctx context.Context, opts *config.DatabaseOptions, txn *sql.Tx,
+	targetTables map[string][]targetColumn, counters map[string]int64,
+) ([]copiedTable, error) {
+	db, err := sqlutil.Open(opts, sqlutil.NewExclusiveWriter())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", opts.ConnectionString, err)
+	}
+	defer internal.CloseAndLogIfError(ctx, db, "failed to close the SQLite database")
+
+	tables, err := selectSourceTables(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	var copied []copiedTable
+	for _, table := range tables {
+		columns, ok := targetTables[table]
+		switch {
+		case ok:
+		case sqliteOnlyTables[table]:
+			continue
+		default:
+			logrus.Warnf("Not copying table %s from %s, which doesn't exist in PostgreSQL", table, opts.ConnectionString)
+			continue
+		}
+		rows, err := copyTable(ctx, db, txn, table, columns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy table %s: %w", table, err)
+		}
+		copied = append(copied, copiedTable{table: table, source: opts, rows: rows})
+	}
+	return copied, sqliteCounters(ctx, db, txn, counters)
+}
+
+// copyTable copies the rows of a table, keeping the values of all columns,
+// including the numeric IDs.
+func copyTable(ctx context.Context, db *sql.DB, txn *sql.Tx, table string, columns []targetColumn) (int64, error) {
+	var nonEmpty bool
+	if err := txn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM "+pq.QuoteIdentifier(table)+")").Scan(&nonEmpty); err != nil {
+		return 0, err
+	}
+	if nonEmpty {
+		if !seededTables[table] {
+			return 0, fmt.Errorf("the table already contains rows, the PostgreSQL database must be empty")
+		}
+		if _, err := txn.ExecContext(ctx, "DELETE FROM "+pq.QuoteIdentifier(table)); err != nil {
+			return 0, err
+		}
+	}
+
+	sourceColumns, primaryKey, err := selectSourceColumns(ctx, db, table)
+	if err != nil {
+		return 0, err
+	}
+	var copiedColumns []targetColumn
+	var names, placeholders string
+	for _, column := range columns {
+		if !sourceColumns[column.name] {
+			continue
+		}
+		if len(copiedColumns) > 0 {
+			names += ", "
+			placeholders += ", "
+		}
+		copiedColumns = append(copiedColumns, column)
+		names += pq.QuoteIdentifier(column.name)
+		placeholders += "$" + strconv.Itoa(len(copiedColumns))
+	}
+	if len(copiedColumns) == 0 {
+		return 0, fmt.Errorf("no columns in common")
+	}
+
+	var total int64
+	if err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+pq.QuoteIdentifier(table)).Scan(&total); err != nil {
+		return 0, err
+	}
+	stmt, err := txn.PrepareContext(ctx, "INSERT INTO "+pq.QuoteIdentifier(table)+" ("+names+") VALUES ("+placeholders+")")
+	if err != nil {
+		return 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "copyTable: stmt.close() failed")
+	rows, err := db.QueryContext(ctx, "SELECT "+names+" FROM "+pq.QuoteIdentifier(table)+" ORDER BY "+sourceOrder(primaryKey))
+	if err != nil {
+		return 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "copyTable: rows.close() failed")
+
+	values := make([]interface{}, len(copiedColumns))
+	pointers := make([]interface{}, len(copiedColumns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	var copied int64
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return copied, err
+		}
+		for i, column := range copiedColumns {
+			if values[i], err = convertValue(values[i], column); err != nil {
+				return copied, fmt.Errorf("column %s: %w", column.name, err)
+			}
+		}
+		if _, err = stmt.ExecContext(ctx, values...); err != nil {
+			return copied, err
+		}
+		copied++
+		if copied%copyProgressInterval == 0 {
+			logrus.Infof("Copied %d of %d rows of %s", copied, total, table)
+		}
+	}
+	logrus.Infof("Copied %d rows of %s", copied, table)
+	return copied, rows.Err()
+}
+
+// convertValue converts a value from a SQLite database to the type of the
+// column in the PostgreSQL database, where SQLite stores it differently.
+func convertValue(value interface{}, column targetColumn) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	switch column.dataType {
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case int64:
+			return v != 0, nil
+		case string:
+			return strconv.ParseBool(v)
+		case []byte:
+			return strconv.ParseBool(string(v))
+		}
+	case "smallint", "integer", "bigint":
+		if v, ok := value.(bool); ok {
+			if v {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+	case "bytea":
+		if v, ok := value.(string); ok {
+			return []byte(v), nil
+		}
+	case "ARRAY":
+		// SQLite stores arrays as JSON.
+		var data []byte
+		switch v := value.(type) {
+		case string:
+			data = []byte(v)
+		case []byte:
+			data = v
+		default:
+			return nil, fmt.Errorf("unexpected %T for an array", value)
+		}
+		if len(data) == 0 {
+			return nil, nil
+		}
+		switch column.udtName {
+		case "_int8", "_int4", "_int2":
+			var array pq.Int64Array
+			if err := json.Unmarshal(data, &array); err != nil {
+				return nil, err
+			}
+			return array, nil
+		case "_text", "_varchar":
+			var array pq.StringArray
+			if err := json.Unmarshal(data, &array); err != nil {
+				return nil, err
+			}
+			return array, nil
+		default:
+			return nil, fmt.Errorf("unsupported array type %s", column.udtName)
+		}
+	}
+	// The SQLite driver returns BLOBs as []byte, which would be inserted as
+	// bytea rather than as text.
+	if v, ok := value.([]byte); ok && column.dataType != "bytea" {
+		return string(v), nil
+	}
+	return value, nil
+}
+
+// sqliteCounters reads the counters which SQLite databases use instead of
+// sequences, and adds them to counters by the name of the sequence which
+// PostgreSQL uses instead. Each counter is the last value which was used.
+func sqliteCounters(ctx context.Context, db *sql.DB, txn *sql.Tx, counters map[string]int64) error {
+	tables, err := selectSourceTables(ctx, db)
+	if err != nil {
+		return err
+	}
+	exists := map[string]bool{}
+	for _, table := range tables {
+		exists[table] = true
+	}
+	addCounter := func(sequence string, value int64) {
+		if value > counters[sequence] {
+			counters[sequence] = value
+		}
+	}
+
+	// SQLite keeps the last value of every AUTOINCREMENT column, even if
+	// rows with higher values were deleted since.
+	var tableSequences map[string]string
+	if tableSequences, err = selectTableSequences(ctx, txn); err != nil {
+		return err
+	}
+	if err = forEachCounter(ctx, db, exists["sqlite_sequence"], "SELECT name, seq FROM sqlite_sequence", func(table string, value int64) {
+		if sequence, ok := tableSequences[table]; ok {
+			addCounter(sequence, value)
+		}
+	}); err != nil {
+		return err
+	}
+	if err = forEachCounter(ctx, db, exists["syncapi_stream_id"], "SELECT stream_name, stream_id FROM syncapi_stream_id", func(stream string, value int64) {
+		if sequence, ok := syncAPIStreamSequences[stream]; ok {
+			addCounter(sequence, value)
+		}
+	}); err != nil {
+		return err
+	}
+	// The appservice counter is the next value which will be used.
+	return forEachCounter(ctx, db, exists["appservice_counters"], "SELECT name, last_id FROM appservice_counters", func(name string, value int64) {
+		if name == "txn_id" {
+			addCounter("txn_id_counter", value-1)
+		}
+	})
+}
+
+func forEachCounter(ctx context.Context, db *sql.DB, exists bool, query string, fn func(name string, value int64)) error {
+	if !exists {
+		return nil
+	}
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "forEachCounter: rows.close() failed")
+	for rows.Next() {
+		var name string
+		var value sql.NullInt64
+		if err = rows.Scan(&name, &value); err != nil {
+			return err
+		}
+		fn(name, value.Int64)
+	}
+	return rows.Err()
+}
+
+// updateSequences advances every sequence past the highest value in the
+// columns which use it and the counters of the SQLite databases, so that
+// new rows don't reuse IDs or stream positions. Sequences are never moved
+// backwards, as some start at a high value on purpose.
+func updateSequences(ctx context.Context, txn *sql.Tx, counters map[string]int64) error {
+	columns, err := selectSequenceColumns(ctx, txn)
+	if err != nil {
+		return err
+	}
+	values := map[string]int64{}
+	for sequence, value := range counters {
+		values[sequence] = value
+	}
+	for sequence, tableColumns := range columns {
+		for _, tableColumn := range tableColumns {
+			var max int64
+			if err = txn.QueryRowContext(ctx,
+				"SELECT COALESCE(MAX("+pq.QuoteIdentifier(tableColumn[1])+"), 0) FROM "+pq.QuoteIdentifier(tableColumn[0]),
+			).Scan(&max); err != nil {
+				return err
+			}
+			if max > values[sequence] {
+				values[sequence] = max
+			}
+		}
+	}
+
+	sequences := make([]string, 0, len(values))
+	for sequence := range values {
+		sequences = append(sequences, sequence)
+	}
+	sort.Strings(sequences)
+	for _, sequence := range sequences {
+		var lastValue int64
+		var isCalled bool
+		if err = txn.QueryRowContext(ctx, "SELECT last_value, is_called FROM "+sequence).Scan(&lastValue, &isCalled); err != nil {
+			return fmt.Errorf("failed to read sequence %s: %w", sequence, err)
+		}
+		if !isCalled {
+			lastValue--
+		}
+		if values[sequence] <= lastValue {
+			continue
+		}
+		if _, err = txn.ExecContext(ctx, "SELECT setval($1::regclass, $2)", sequence, values[sequence]); err != nil {
+			return fmt.Errorf("failed to update sequence %s: %w", sequence, err)
+		}
+		logrus.Infof("Set sequence %s to %d", sequence, values[sequence])
+	}
+	return nil
+}
+
+// verifyCopy compares the number of rows in every copied table.
+func verifyCopy(ctx context.Context, w io.Writer, copied []copiedTable) error {
+	dbs := map[config.DataSource]*sql.DB{}
+	openDB := func(opts *config.DatabaseOptions, writer sqlutil.Writer) (*sql.DB, error) {
+		if db, ok := dbs[opts.ConnectionString]; ok {
+			return db, nil
+		}
+		db, err := sqlutil.Open(opts, writer)
+		if err != nil {
+			return nil, err
+		}
+		dbs[opts.ConnectionString] = db
+		return db, nil
+	}
+	defer func() {
+		for _, db := range dbs {
+			internal.CloseAndLogIfError(ctx, db, "failed to close database")
+		}
+	}()
+	count := func(db *sql.DB, table string) (rows int64, err error) {
+		err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+pq.QuoteIdentifier(table)).Scan(&rows)
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "TABLE\tSQLITE\tPOSTGRES\tCOPIED")
+	var mismatched []string
+	for _, table := range copied {
+		source, err := openDB(table.source, sqlutil.NewExclusiveWriter())
+		if err != nil {
+			return err
+		}
+		target, err := openDB(table.target, sqlutil.NewDummyWriter())
+		if err != nil {
+			return err
+		}
+		sourceRows, err := count(source, table.table)
+		if err != nil {
+			return err
+		}
+		targetRows, err := count(target, table.table)
+		if err != nil {
+			return err
+		}
+		if sourceRows != targetRows || sourceRows != table.rows {
+			mismatched = append(mismatched, table.table)
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", table.table, sourceRows, targetRows, table.rows)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(mismatched) > 0 {
+		return fmt.Errorf("the number of rows doesn't match for %v", mismatched)
+	}
+	return nil
+}
+
+func selectSourceTables(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectSourceTables: rows.close() failed")
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		if table != migrationsTable {
+			tables = append(tables, table)
+		}
+	}
+	return tables, rows.Err()
+}
+
+// selectSourceColumns returns the columns of a table in a SQLite database,
+// and the columns of its primary key in order.
+func selectSourceColumns(ctx context.Context, db *sql.DB, table string) (map[string]bool, []string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, pk FROM pragma_table_info($1) ORDER BY pk", table)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectSourceColumns: rows.close() failed")
+	columns := map[string]bool{}
+	var primaryKey []string
+	for rows.Next() {
+		var column string
+		var pk int
+		if err = rows.Scan(&column, &pk); err != nil {
+			return nil, nil, err
+		}
+		columns[column] = true
+		if pk > 0 {
+			primaryKey = append(primaryKey, column)
+		}
+	}
+	return columns, primaryKey, rows.Err()
+}
+
+// sourceOrder returns the ORDER BY clause which copies the rows of a table
+// in a stable order. Tables created WITHOUT ROWID have no rowid, but must
+// have a primary key.
+func sourceOrder(primaryKey []string) string {
+	if len(primaryKey) == 0 {
+		return "rowid"
+	}
+	quoted := make([]string, len(primaryKey))
+	for i, column := range primaryKey {
+		quoted[i] = pq.QuoteIdentifier(column)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func selectTargetColumns(ctx context.Context, txn *sql.Tx) (map[string][]targetColumn, error) {
+	rows, err := txn.QueryContext(ctx, ""+
+		"SELECT table_name, column_name, data_type, udt_name FROM information_schema.columns"+
+		" WHERE table_schema = current_schema() ORDER BY table_name, ordinal_position",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectTargetColumns: rows.close() failed")
+	tables := map[string][]targetColumn{}
+	for rows.Next() {
+		var table string
+		var column targetColumn
+		if err = rows.Scan(&table, &column.name, &column.dataType, &column.udtName); err != nil {
+			return nil, err
+		}
+		if table != migrationsTable {
+			tables[table] = append(tables[table], column)
+		}
+	}
+	return tables, rows.Err()
+}
+
+// selectSequenceColumns returns the table and column names of the columns
+// which default to the next value of each sequence.
+func selectSequenceColumns(ctx context.Context, txn *sql.Tx) (map[string][][2]string, error) {
+	rows, err := txn.QueryContext(ctx, ""+
+		"SELECT table_name, column_name, column_default FROM information_schema.columns"+
+		" WHERE table_schema = current_schema() AND column_default LIKE 'nextval(%'",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectSequenceColumns: rows.close() failed")
+	columns := map[string][][2]string{}
+	for rows.Next() {
+		var table, column, columnDefault string
+		if err = rows.Scan(&table, &column, &columnDefault); err != nil {
+			return nil, err
+		}
+		if sequence := defaultSequence(columnDefault); sequence != "" {
+			columns[sequence] = append(columns[sequence], [2]string{table, column})
+		}
+	}
+	return columns, rows.Err()
+}
+
+// selectTableSequences returns the sequence which each table uses for new
+// rows, if any.
+func selectTableSequences(ctx context.Context, txn *sql.Tx) (map[string]string, error) {
+	columns, err := selectSequenceColumns(ctx, txn)
+	if err != nil {
+		return nil, err
+	}
+	tables := map[string]string{}
+	for sequence, tableColumns := range columns {
+		for _, tableColumn := range tableColumns {
+			tables[tableColumn[0]] = sequence
+		}
+	}
+	return tables, nil
+}
+
+// defaultSequence returns the name of the sequence in a column default like
+// "nextval('name'::regclass)", or an empty string.
+func defaultSequence(columnDefault string) string {
+	match := nextvalRegexp.FindStringSubmatch(columnDefault)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/base"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi/api"
+	userstorage "github.com/matrix-org/dendrite/userapi/storage"
+)
+
+func TestConvertValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		column targetColumn
+		want   interface{}
+	}{
+		{"null", nil, targetColumn{dataType: "boolean"}, nil},
+		{"integer boolean", int64(1), targetColumn{dataType: "boolean"}, true},
+		{"text boolean", "false", targetColumn{dataType: "boolean"}, false},
+		{"boolean integer", true, targetColumn{dataType: "smallint"}, int64(1)},
+		{"text bytea", "hash", targetColumn{dataType: "bytea"}, []byte("hash")},
+		{"blob text", []byte("text"), targetColumn{dataType: "text"}, "text"},
+		{"blob bytea", []byte("hash"), targetColumn{dataType: "bytea"}, []byte("hash")},
+		{"integer array", "[1,2,3]", targetColumn{dataType: "ARRAY", udtName: "_int8"}, pq.Int64Array{1, 2, 3}},
+		{"empty integer array", "[]", targetColumn{dataType: "ARRAY", udtName: "_int8"}, pq.Int64Array{}},
+		{"text array", []byte(`["a","b"]`), targetColumn{dataType: "ARRAY", udtName: "_text"}, pq.StringArray{"a", "b"}},
+		{"null text array", "null", targetColumn{dataType: "ARRAY", udtName: "_text"}, pq.StringArray(nil)},
+		{"empty text", "", targetColumn{dataType: "ARRAY", udtName: "_text"}, nil},
+		{"integer", int64(5), targetColumn{dataType: "bigint"}, int64(5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convertValue(tt.value, tt.column)
+			if err != nil {
+				t.Fatalf("convertValue() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("convertValue() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := convertValue("{1,2}", targetColumn{dataType: "ARRAY", udtName: "_int8"}); err == nil {
+		t.Fatalf("expected an error for an array which isn't JSON")
+	}
+}
+
+func TestDefaultSequence(t *testing.T) {
+	tests := map[string]string{
+		"nextval('syncapi_stream_id'::regclass)": "syncapi_stream_id",
+		"nextval('public.some_seq'::regclass)":   "public.some_seq",
+		"0":                                      "",
+		"'{}'::bigint[]":                         "",
+		"nextval('device_session_id_seq')":       "device_session_id_seq",
+		"nextval('a'::regclass) + nextval('b')":  "",
+		"nextval('\"Quoted_Seq\"'::regclass)":    "\"Quoted_Seq\"",
+	}
+	for columnDefault, want := range tests {
+		if got := defaultSequence(columnDefault); got != want {
+			t.Errorf("defaultSequence(%q) = %q, want %q", columnDefault, got, want)
+		}
+	}
+}
+
+func TestSourceOrder(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(&config.DatabaseOptions{ConnectionString: "file::memory:"}, sqlutil.NewExclusiveWriter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() // nolint: errcheck
+	if _, err = db.ExecContext(ctx, ""+
+		"CREATE TABLE without_rowid (a TEXT, b INTEGER, c TEXT, PRIMARY KEY (b, a)) WITHOUT ROWID;"+
+		"INSERT INTO without_rowid VALUES ('y', 2, 'third'), ('x', 2, 'second'), ('z', 1, 'first');"+
+		"CREATE TABLE with_rowid (c TEXT);"+
+		"INSERT INTO with_rowid VALUES ('first'), ('second'), ('third');",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"without_rowid", "with_rowid"} {
+		columns, primaryKey, err := selectSourceColumns(ctx, db, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !columns["c"] {
+			t.Fatalf("expected %s to have column c, got %v", table, columns)
+		}
+		rows, err := db.QueryContext(ctx, "SELECT c FROM "+table+" ORDER BY "+sourceOrder(primaryKey))
+		if err != nil {
+			t.Fatalf("failed to select the rows of %s in order: %s", table, err)
+		}
+		var got []string
+		for rows.Next() {
+			var c string
+			if err = rows.Scan(&c); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, c)
+		}
+		_ = rows.Close()
+		if want := []string{"first", "second", "third"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected the rows of %s in the order %v, got %v", table, want, got)
+		}
+	}
+}
+
+func TestFromSQLite(t *testing.T) {
+	ctx := context.Background()
+	source, closeSource := testrig.CreateBaseDendrite(t, test.DBTypeSQLite)
+	defer closeSource()
+	// Skipped if there's no PostgreSQL database to copy into.
+	target, closeTarget := testrig.CreateBaseDendrite(t, test.DBTypePostgres)
+	defer closeTarget()
+
+	openUserDB := func(t *testing.T, b *base.BaseDendrite) userstorage.Database {
+		db, err := userstorage.NewUserAPIDatabase(b, &b.Cfg.UserAPI.AccountDatabase, b.Cfg.Global.ServerName, 4, 0, api.DefaultLoginTokenLifetime, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	sourceDB := openUserDB(t, source)
+	if _, err := sourceDB.CreateAccount(ctx, "alice", "password", "", api.AccountTypeUser); err != nil {
+		t.Fatal(err)
+	}
+	device, err := sourceDB.CreateDevice(ctx, "alice", nil, "token", nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err = fromSQLite(ctx, &out, source, target, components); err != nil {
+		t.Fatalf("failed to copy the databases: %s\n%s", err, out.String())
+	}
+	for _, table := range []string{"account_accounts", "device_devices", "roomserver_event_types", "syncapi_output_room_events"} {
+		if !strings.Contains(out.String(), table) {
+			t.Fatalf("expected %s to be copied, got:\n%s", table, out.String())
+		}
+	}
+
+	targetDB := openUserDB(t, target)
+	if _, err = targetDB.GetAccountByLocalpart(ctx, "alice"); err != nil {
+		t.Fatalf("expected the account to be copied: %s", err)
+	}
+	newDevice, err := targetDB.CreateDevice(ctx, "alice", nil, "token2", nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newDevice.SessionID <= device.SessionID {
+		t.Fatalf("expected the session ID sequence to be advanced past %d, got %d", device.SessionID, newDevice.SessionID)
+	}
+
+	// The PostgreSQL databases must be empty.
+	if err = fromSQLite(ctx, &out, source, target, components); err == nil {
+		t.Fatalf("expected copying into a database which isn't empty to fail")
+	}
+}
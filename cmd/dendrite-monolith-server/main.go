@@ -78,6 +78,7 @@ func main() {
 	rsAPI := rsImpl
 	if base.UseHTTPAPIs {
 		roomserver.AddInternalRoutes(base.InternalAPIMux, rsImpl)
+		base.ServeInternalAPIOverNATS(basepkg.RoomServerInternalAPI, &cfg.RoomServer.InternalAPI)
 		rsAPI = base.RoomserverHTTPClient()
 	}
 	if traceInternal {
@@ -92,6 +93,7 @@ func main() {
 	fsImplAPI := fsAPI
 	if base.UseHTTPAPIs {
 		federationapi.AddInternalRoutes(base.InternalAPIMux, fsAPI)
+		base.ServeInternalAPIOverNATS(basepkg.FederationAPIInternalAPI, &cfg.FederationAPI.InternalAPI)
 		fsAPI = base.FederationAPIHTTPClient()
 	}
 	keyRing := fsAPI.KeyRing()
@@ -100,6 +102,7 @@ func main() {
 	keyAPI := keyImpl
 	if base.UseHTTPAPIs {
 		keyserver.AddInternalRoutes(base.InternalAPIMux, keyAPI)
+		base.ServeInternalAPIOverNATS(basepkg.KeyServerInternalAPI, &cfg.KeyServer.InternalAPI)
 		keyAPI = base.KeyServerHTTPClient()
 	}
 
@@ -108,6 +111,7 @@ func main() {
 	userAPI := userImpl
 	if base.UseHTTPAPIs {
 		userapi.AddInternalRoutes(base.InternalAPIMux, userAPI)
+		base.ServeInternalAPIOverNATS(basepkg.UserAPIInternalAPI, &cfg.UserAPI.InternalAPI)
 		userAPI = base.UserAPIClient()
 	}
 	if traceInternal {
@@ -122,6 +126,7 @@ func main() {
 	asAPI := appservice.NewInternalAPI(base, userImpl, rsAPI)
 	if base.UseHTTPAPIs {
 		appservice.AddInternalRoutes(base.InternalAPIMux, asAPI)
+		base.ServeInternalAPIOverNATS(basepkg.AppServiceInternalAPI, &cfg.AppServiceAPI.InternalAPI)
 		asAPI = base.AppserviceHTTPClient()
 	}
 
@@ -27,6 +27,7 @@ func Appservice(base *base.BaseDendrite, cfg *config.Dendrite) {
 
 	intAPI := appservice.NewInternalAPI(base, userAPI, rsAPI)
 	appservice.AddInternalRoutes(base.InternalAPIMux, intAPI)
+	base.ServeInternalAPIOverNATS(basepkg.AppServiceInternalAPI, &base.Cfg.AppServiceAPI.InternalAPI)
 
 	base.SetupAndServeHTTP(
 		base.Cfg.AppServiceAPI.InternalAPI.Listen, // internal listener
@@ -35,6 +35,7 @@ func FederationAPI(base *basepkg.BaseDendrite, cfg *config.Dendrite) {
 	)
 
 	federationapi.AddInternalRoutes(base.InternalAPIMux, fsAPI)
+	base.ServeInternalAPIOverNATS(basepkg.FederationAPIInternalAPI, &base.Cfg.FederationAPI.InternalAPI)
 
 	base.SetupAndServeHTTP(
 		base.Cfg.FederationAPI.InternalAPI.Listen,
@@ -26,6 +26,7 @@ func KeyServer(base *basepkg.BaseDendrite, cfg *config.Dendrite) {
 	intAPI.SetUserAPI(base.UserAPIClient())
 
 	keyserver.AddInternalRoutes(base.InternalAPIMux, intAPI)
+	base.ServeInternalAPIOverNATS(basepkg.KeyServerInternalAPI, &base.Cfg.KeyServer.InternalAPI)
 
 	base.SetupAndServeHTTP(
 		base.Cfg.KeyServer.InternalAPI.Listen, // internal listener
@@ -28,6 +28,7 @@ func UserAPI(base *basepkg.BaseDendrite, cfg *config.Dendrite) {
 	)
 
 	userapi.AddInternalRoutes(base.InternalAPIMux, userAPI)
+	base.ServeInternalAPIOverNATS(basepkg.UserAPIInternalAPI, &base.Cfg.UserAPI.InternalAPI)
 
 	base.SetupAndServeHTTP(
 		base.Cfg.UserAPI.InternalAPI.Listen, // internal listener
@@ -0,0 +1,194 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/roomserver/fsck"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	rsstorage "github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/setup/base"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+)
+
+const usage = `Usage: %s
+
+Checks the events and state of rooms for inconsistencies. For every event, the
+auth events must be in the roomserver database, the prev events must be in the
+database or recorded as missing, and the stored state before the event must
+match the state calculated from the prev events. The forward extremities of the
+room must be the events which aren't referenced by any other event, and the
+current state of the room in the sync API must match the roomserver.
+
+With -repair, the forward extremities and current state of a room are
+recalculated in the roomserver if they are wrong, and the current state of the
+room is rebuilt in the sync API if it doesn't match. Other problems are only
+reported. The other components aren't told about repairs made by this tool, so
+use the /_dendrite/admin/fsck/{roomID} and /_dendrite/admin/fsckSyncAPI/{roomID}
+admin APIs instead to repair a room while Dendrite is running. When using SQLite, always stop Dendrite before running
+this.
+
+Exits with status 1 if any problems weren't repaired.
+
+Example:
+
+	./fsck --config dendrite.yaml -room '!abc:example.com' -repair
+
+Arguments:
+
+`
+
+var (
+	roomIDs = flag.String("room", "", "A comma separated list of room IDs to check, or empty for all rooms")
+	repair  = flag.Bool("repair", false, "Repair the forward extremities and current state of rooms if they are wrong")
+)
+
+func main() {
+	name := os.Args[0]
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, usage, name)
+		flag.PrintDefaults()
+	}
+	cfg := setup.ParseFlags(true)
+	b := base.NewBaseDendrite(cfg, "Fsck", base.DisableMetrics)
+	defer b.Close() // nolint: errcheck
+
+	rsDB, err := rsstorage.Open(b, &cfg.RoomServer.Database, b.Caches)
+	if err != nil {
+		logrus.WithError(err).Fatalln("Failed to connect to the roomserver database")
+	}
+	syncDB, err := storage.NewSyncServerDatasource(b, &cfg.SyncAPI.Database)
+	if err != nil {
+		logrus.WithError(err).Fatalln("Failed to connect to the sync API database")
+	}
+
+	ctx := context.Background()
+	var rooms []string
+	for _, roomID := range strings.Split(*roomIDs, ",") {
+		if roomID = strings.TrimSpace(roomID); roomID != "" {
+			rooms = append(rooms, roomID)
+		}
+	}
+	if len(rooms) == 0 {
+		if rooms, err = rsDB.GetKnownRooms(ctx); err != nil {
+			logrus.WithError(err).Fatalln("Failed to get the known rooms")
+		}
+	}
+
+	checker := &fsck.Checker{DB: rsDB}
+	unrepaired := 0
+	for _, roomID := range rooms {
+		logger := logrus.WithField("room_id", roomID)
+		report, err := checker.CheckRoom(ctx, roomID, *repair)
+		if err == fsck.ErrUnknownRoom {
+			logger.Warn("Room is not known")
+			continue
+		} else if err == fsck.ErrRoomChanged {
+			logger.Warn("Room changed while it was being checked, so it wasn't repaired")
+			unrepaired++
+			continue
+		} else if err != nil {
+			logger.WithError(err).Fatalln("Failed to check room")
+		}
+		if err = checkSyncAPIState(ctx, rsDB, syncDB, report, *repair); err != nil {
+			logger.WithError(err).Fatalln("Failed to check sync API state")
+		}
+		for _, problem := range report.Problems {
+			if !problem.Repaired {
+				unrepaired++
+			}
+			logger.WithFields(logrus.Fields{
+				"check":    problem.Check,
+				"event_id": problem.EventID,
+				"repaired": problem.Repaired,
+			}).Warn(problem.Detail)
+		}
+		logger.Infof(
+			"Checked %d events and %d states, found %d missing prev events and %d problems",
+			report.EventsChecked, report.StatesChecked, report.MissingPrevEvents, len(report.Problems),
+		)
+	}
+	if unrepaired > 0 {
+		logrus.Errorf("Found %d problems which weren't repaired", unrepaired)
+		os.Exit(1)
+	}
+}
+
+// checkSyncAPIState compares the current state of the room in the sync API
+// to the roomserver, rebuilding it in the sync API if it doesn't match and
+// repair is true.
+func checkSyncAPIState(
+	ctx context.Context, rsDB rsstorage.Database, syncDB storage.Database, report *types.RoomCheckReport, repair bool,
+) error {
+	info, err := rsDB.RoomInfo(ctx, report.RoomID)
+	if err != nil {
+		return fmt.Errorf("rsDB.RoomInfo: %w", err)
+	}
+	_, stateNID, _, err := rsDB.LatestEventIDs(ctx, info.RoomNID)
+	if err != nil {
+		return fmt.Errorf("rsDB.LatestEventIDs: %w", err)
+	}
+	stateRes := state.NewStateResolution(rsDB, info)
+	entries, err := stateRes.LoadStateAtSnapshot(ctx, stateNID)
+	if err != nil {
+		return fmt.Errorf("stateRes.LoadStateAtSnapshot: %w", err)
+	}
+	eventNIDs := make([]types.EventNID, len(entries))
+	for i, entry := range entries {
+		eventNIDs[i] = entry.EventNID
+	}
+	events, err := rsDB.Events(ctx, eventNIDs)
+	if err != nil {
+		return fmt.Errorf("rsDB.Events: %w", err)
+	}
+	roomserverState := make([]*gomatrixserverlib.HeaderedEvent, len(events))
+	roomserverEventIDs := make([]string, len(events))
+	for i, ev := range events {
+		roomserverState[i] = ev.Headered(info.RoomVersion)
+		roomserverEventIDs[i] = ev.EventID()
+	}
+
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	syncState, err := syncDB.CurrentState(ctx, report.RoomID, &stateFilter, nil)
+	if err != nil {
+		return fmt.Errorf("syncDB.CurrentState: %w", err)
+	}
+	syncEventIDs := make([]string, len(syncState))
+	for i, ev := range syncState {
+		syncEventIDs[i] = ev.EventID()
+	}
+
+	problems := len(report.Problems)
+	if report.CheckSyncAPIState(roomserverEventIDs, syncEventIDs) || !repair {
+		return nil
+	}
+	if err = syncDB.RebuildRoomState(ctx, report.RoomID, roomserverState); err != nil {
+		return fmt.Errorf("syncDB.RebuildRoomState: %w", err)
+	}
+	for i := problems; i < len(report.Problems); i++ {
+		report.Problems[i].Repaired = true
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	rsstorage "github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/setup/base"
+	"github.com/matrix-org/dendrite/syncapi/rebuild"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+)
+
+const usage = `Usage: %s
+
+Rebuilds the sync API database from the roomserver database. Events, current
+state, memberships and pending invites are written for every room, or only for
+the rooms given with -room. Events which the sync API already has are left
+alone. Progress is saved as rooms are rebuilt, so an interrupted rebuild will
+carry on from where it stopped unless -restart is given.
+
+When using SQLite, stop Dendrite before running this, or use the
+/_dendrite/admin/rebuildSyncAPI admin API instead. Users will not be notified
+about rebuilt rooms until Dendrite is restarted.
+
+Example:
+
+	./rebuild-syncapi --config dendrite.yaml -room '!abc:example.com' -events-per-second 500
+
+Arguments:
+
+`
+
+var (
+	roomIDs         = flag.String("room", "", "A comma separated list of room IDs to rebuild, or empty for all rooms")
+	eventsPerSecond = flag.Int("events-per-second", 0, "The maximum number of events to write per second, or 0 for no limit")
+	restart         = flag.Bool("restart", false, "Ignore the progress of previous rebuilds and start from the beginning")
+)
+
+func main() {
+	name := os.Args[0]
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, usage, name)
+		flag.PrintDefaults()
+	}
+	cfg := setup.ParseFlags(true)
+	b := base.NewBaseDendrite(cfg, "RebuildSyncAPI", base.DisableMetrics)
+	defer b.Close() // nolint: errcheck
+
+	rsDB, err := rsstorage.Open(b, &cfg.RoomServer.Database, b.Caches)
+	if err != nil {
+		logrus.WithError(err).Fatalln("Failed to connect to the roomserver database")
+	}
+	syncDB, err := storage.NewSyncServerDatasource(b, &cfg.SyncAPI.Database)
+	if err != nil {
+		logrus.WithError(err).Fatalln("Failed to connect to the sync API database")
+	}
+
+	opts := rebuild.Options{
+		EventsPerSecond: *eventsPerSecond,
+		Restart:         *restart,
+	}
+	for _, roomID := range strings.Split(*roomIDs, ",") {
+		if roomID = strings.TrimSpace(roomID); roomID != "" {
+			opts.RoomIDs = append(opts.RoomIDs, roomID)
+		}
+	}
+
+	rebuilder := rebuild.NewRebuilder(syncDB, &roomserverDB{rsDB}, cfg.Global.ServerName, nil)
+	err = rebuilder.Run(context.Background(), opts)
+	status := rebuilder.Status()
+	logrus.Infof("Rebuilt %d of %d rooms, wrote %d events", status.RoomsDone, status.RoomsTotal, status.EventsWritten)
+	if err != nil {
+		logrus.WithError(err).Fatalln("Failed to rebuild the sync API")
+	}
+}
+
+// roomserverDB implements rebuild.RoomserverAPI by reading the roomserver
+// database directly, so that the roomserver doesn't need to be running.
+type roomserverDB struct {
+	db rsstorage.Database
+}
+
+func (r *roomserverDB) QueryKnownRooms(ctx context.Context, req *api.QueryKnownRoomsRequest, res *api.QueryKnownRoomsResponse) error {
+	roomIDs, err := r.db.GetKnownRooms(ctx)
+	if err != nil {
+		return err
+	}
+	res.RoomIDs = roomIDs
+	return nil
+}
+
+func (r *roomserverDB) QueryRoomEvents(ctx context.Context, req *api.QueryRoomEventsRequest, res *api.QueryRoomEventsResponse) error {
+	info, err := r.db.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	res.Position = req.After
+	if info == nil || info.IsStub() {
+		return nil
+	}
+	res.RoomExists = true
+	events, err := r.db.RoomEventsAfter(ctx, info, types.EventNID(req.After), req.Limit)
+	if err != nil {
+		return err
+	}
+	res.Events = make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		res.Events = append(res.Events, ev.Headered(info.RoomVersion))
+		res.Position = int64(ev.EventNID)
+	}
+	return nil
+}
+
+func (r *roomserverDB) QueryLatestEventsAndState(ctx context.Context, req *api.QueryLatestEventsAndStateRequest, res *api.QueryLatestEventsAndStateResponse) error {
+	info, err := r.db.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if info == nil || info.IsStub() {
+		return nil
+	}
+	res.RoomExists = true
+	res.RoomVersion = info.RoomVersion
+
+	var snapshotNID types.StateSnapshotNID
+	res.LatestEvents, snapshotNID, res.Depth, err = r.db.LatestEventIDs(ctx, info.RoomNID)
+	if err != nil {
+		return err
+	}
+	stateRes := state.NewStateResolution(r.db, info)
+	entries, err := stateRes.LoadStateAtSnapshot(ctx, snapshotNID)
+	if err != nil {
+		return err
+	}
+	eventNIDs := make([]types.EventNID, 0, len(entries))
+	for _, entry := range entries {
+		eventNIDs = append(eventNIDs, entry.EventNID)
+	}
+	events, err := r.db.Events(ctx, eventNIDs)
+	if err != nil {
+		return err
+	}
+	res.StateEvents = make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		res.StateEvents = append(res.StateEvents, ev.Headered(info.RoomVersion))
+	}
+	return nil
+}
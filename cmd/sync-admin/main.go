@@ -0,0 +1,137 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: %s [options] <command> [arguments]
+
+Inspects and repairs the sync state of a Dendrite homeserver using the
+admin API. The access token must belong to an admin user, and can also be
+given in the DENDRITE_ACCESS_TOKEN environment variable.
+
+Commands:
+
+	state <user ID> <device ID>
+		Show the current sync stream positions, the last since token
+		used by the device and its pending send-to-device messages.
+	resync <user ID> <device ID>
+		Force the device to do a complete sync on its next request.
+	rebuild-room-state <room ID>
+		Rebuild the sync API's current state for a room from the roomserver.
+
+Example:
+
+	%s -url https://matrix.example.com -access-token xxx state @alice:example.com ABCDEFGH
+
+Options:
+
+`
+
+var (
+	serverURL         = flag.String("url", "http://localhost:8008", "The base URL of the homeserver")
+	accessToken       = flag.String("access-token", os.Getenv("DENDRITE_ACCESS_TOKEN"), "An access token for an admin user")
+	invalidateFilters = flag.Bool("invalidate-filters", false, "With resync, also delete the user's filters")
+)
+
+func main() {
+	name := os.Args[0]
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, usage, name, name)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 || *accessToken == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var method, path string
+	var body interface{}
+	switch {
+	case args[0] == "state" && len(args) == 3:
+		method = http.MethodGet
+		path = "/_dendrite/admin/syncState/" + url.PathEscape(args[1]) + "/" + url.PathEscape(args[2])
+	case args[0] == "resync" && len(args) == 3:
+		method = http.MethodPost
+		path = "/_dendrite/admin/resync/" + url.PathEscape(args[1]) + "/" + url.PathEscape(args[2])
+		body = map[string]bool{"invalidate_filters": *invalidateFilters}
+	case args[0] == "rebuild-room-state" && len(args) == 2:
+		method = http.MethodPost
+		path = "/_dendrite/admin/rebuildRoomState/" + url.PathEscape(args[1])
+		body = struct{}{}
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err := call(method, strings.TrimSuffix(*serverURL, "/")+path, body); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func call(method, target string, body interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, target, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*accessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint:errcheck
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if err = json.Indent(&out, resBody, "", "  "); err != nil {
+		out.Reset()
+		out.Write(resBody)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", res.Status, out.String())
+	}
+	fmt.Println(out.String())
+	return nil
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/matrix-org/dendrite/federationapi/types"
@@ -10,6 +11,16 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
+// SyncFederationAPI is the subset of the federation API used by the sync API.
+type SyncFederationAPI interface {
+	KeyRing() *gomatrixserverlib.KeyRing
+	// Unlike QueryJoinedHostsInRoom, this function returns a de-duplicated slice
+	// containing only the server names (without information for membership events).
+	// The response will include this server if they are joined to the room.
+	QueryJoinedHostServerNamesInRoom(ctx context.Context, request *QueryJoinedHostServerNamesInRoomRequest, response *QueryJoinedHostServerNamesInRoomResponse) error
+	TimestampToEvent(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, direction string) (res RespTimestampToEvent, err error)
+}
+
 // FederationInternalAPI is used to query information from the federation sender.
 type FederationInternalAPI interface {
 	gomatrixserverlib.FederatedStateClient
@@ -17,6 +28,7 @@ type FederationInternalAPI interface {
 	gomatrixserverlib.KeyDatabase
 	ClientFederationAPI
 	RoomserverFederationAPI
+	SyncFederationAPI
 
 	QueryServerKeys(ctx context.Context, request *QueryServerKeysRequest, response *QueryServerKeysResponse) error
 	LookupServerKeys(ctx context.Context, s gomatrixserverlib.ServerName, keyRequests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp) ([]gomatrixserverlib.ServerKeys, error)
@@ -101,6 +113,17 @@ type FederationClient interface {
 	LookupState(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string, roomVersion gomatrixserverlib.RoomVersion) (res gomatrixserverlib.RespState, err error)
 	LookupStateIDs(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string) (res gomatrixserverlib.RespStateIDs, err error)
 	LookupMissingEvents(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, missing gomatrixserverlib.MissingEvents, roomVersion gomatrixserverlib.RoomVersion) (res gomatrixserverlib.RespMissingEvents, err error)
+
+	// DoRequestAndParseResponse performs a pre-signed federation request, for endpoints
+	// which gomatrixserverlib doesn't have a dedicated function for yet.
+	DoRequestAndParseResponse(ctx context.Context, req *http.Request, result interface{}) error
+}
+
+// RespTimestampToEvent is the response to a /timestamp_to_event request, both
+// on the client and the federation API.
+type RespTimestampToEvent struct {
+	EventID        string                      `json:"event_id"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
 }
 
 // FederationClientError is returned from FederationClient methods in the event of a problem.
@@ -18,10 +18,12 @@ import (
 	"context"
 	"encoding/json"
 	"strconv"
+	"time"
 
 	"github.com/matrix-org/dendrite/federationapi/queue"
 	"github.com/matrix-org/dendrite/federationapi/storage"
 	fedTypes "github.com/matrix-org/dendrite/federationapi/types"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/setup/process"
@@ -31,6 +33,10 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// presenceResendInterval is how often an update which doesn't change a
+// user's presence or status message will be sent to other servers.
+const presenceResendInterval = time.Minute
+
 // OutputReceiptConsumer consumes events that originate in the clientapi.
 type OutputPresenceConsumer struct {
 	ctx                     context.Context
@@ -38,9 +44,17 @@ type OutputPresenceConsumer struct {
 	durable                 string
 	db                      storage.Database
 	queues                  *queue.OutgoingQueues
+	rsAPI                   roomserverAPI.FederationRoomserverAPI
 	ServerName              gomatrixserverlib.ServerName
 	topic                   string
 	outboundPresenceEnabled bool
+	sent                    map[string]sentPresence // user ID -> last sent presence
+	sentPruned              time.Time               // when expired entries were last removed from sent
+}
+
+type sentPresence struct {
+	content fedTypes.PresenceContent
+	sentAt  time.Time
 }
 
 // NewOutputPresenceConsumer creates a new OutputPresenceConsumer. Call Start() to begin consuming events.
@@ -50,16 +64,19 @@ func NewOutputPresenceConsumer(
 	js nats.JetStreamContext,
 	queues *queue.OutgoingQueues,
 	store storage.Database,
+	rsAPI roomserverAPI.FederationRoomserverAPI,
 ) *OutputPresenceConsumer {
 	return &OutputPresenceConsumer{
 		ctx:                     process.Context(),
 		jetstream:               js,
 		queues:                  queues,
 		db:                      store,
+		rsAPI:                   rsAPI,
 		ServerName:              cfg.Matrix.ServerName,
 		durable:                 cfg.Matrix.JetStream.Durable("FederationAPIPresenceConsumer"),
 		topic:                   cfg.Matrix.JetStream.Prefixed(jetstream.OutputPresenceEvent),
 		outboundPresenceEnabled: cfg.Matrix.Presence.EnableOutbound,
+		sent:                    map[string]sentPresence{},
 	}
 }
 
@@ -95,7 +112,44 @@ func (t *OutputPresenceConsumer) onMessage(ctx context.Context, msg *nats.Msg) b
 		return true
 	}
 
-	joined, err := t.db.GetAllJoinedHosts(ctx)
+	var statusMsg *string = nil
+	if data, ok := msg.Header["status_msg"]; ok && len(data) > 0 {
+		status := msg.Header.Get("status_msg")
+		statusMsg = &status
+	}
+
+	presenceID, _ := types.PresenceFromString(presence)
+	p := types.PresenceInternal{Presence: presenceID, LastActiveTS: gomatrixserverlib.Timestamp(ts)}
+	presenceContent := fedTypes.PresenceContent{
+		CurrentlyActive: p.CurrentlyActive(),
+		LastActiveAgo:   p.LastActiveAgo(),
+		Presence:        presence,
+		StatusMsg:       statusMsg,
+		UserID:          userID,
+	}
+
+	// Only send updates which don't change anything that other servers
+	// can see every so often. This is the only consumer of messages on
+	// this stream, so there's no need to lock.
+	t.pruneSent(time.Now())
+	if last, ok := t.sent[userID]; ok && time.Since(last.sentAt) < presenceResendInterval {
+		if samePresence(last.content, presenceContent) {
+			return true
+		}
+	}
+
+	// Only send presence to servers which share a room with the user, as
+	// they are the only ones allowed to see it.
+	var queryRes roomserverAPI.QueryRoomsForUserResponse
+	err = t.rsAPI.QueryRoomsForUser(ctx, &roomserverAPI.QueryRoomsForUserRequest{
+		UserID:         userID,
+		WantMembership: "join",
+	}, &queryRes)
+	if err != nil {
+		log.WithError(err).Error("failed to calculate joined rooms for user")
+		return true
+	}
+	joined, err := t.db.GetJoinedHostsForRooms(ctx, queryRes.RoomIDs, true)
 	if err != nil {
 		log.WithError(err).Error("failed to get joined hosts")
 		return true
@@ -104,24 +158,8 @@ func (t *OutputPresenceConsumer) onMessage(ctx context.Context, msg *nats.Msg) b
 		return true
 	}
 
-	var statusMsg *string = nil
-	if data, ok := msg.Header["status_msg"]; ok && len(data) > 0 {
-		status := msg.Header.Get("status_msg")
-		statusMsg = &status
-	}
-
-	p := types.PresenceInternal{LastActiveTS: gomatrixserverlib.Timestamp(ts)}
-
 	content := fedTypes.Presence{
-		Push: []fedTypes.PresenceContent{
-			{
-				CurrentlyActive: p.CurrentlyActive(),
-				LastActiveAgo:   p.LastActiveAgo(),
-				Presence:        presence,
-				StatusMsg:       statusMsg,
-				UserID:          userID,
-			},
-		},
+		Push: []fedTypes.PresenceContent{presenceContent},
 	}
 
 	edu := &gomatrixserverlib.EDU{
@@ -138,6 +176,34 @@ func (t *OutputPresenceConsumer) onMessage(ctx context.Context, msg *nats.Msg) b
 		log.WithError(err).Error("failed to send EDU")
 		return false
 	}
+	t.sent[userID] = sentPresence{content: presenceContent, sentAt: time.Now()}
 
 	return true
 }
+
+// pruneSent forgets the updates which were sent longer ago than the resend
+// interval, as they no longer stop anything from being sent. This is done at
+// most once per interval, so that it doesn't happen for every message.
+func (t *OutputPresenceConsumer) pruneSent(now time.Time) {
+	if now.Sub(t.sentPruned) < presenceResendInterval {
+		return
+	}
+	for userID, last := range t.sent {
+		if now.Sub(last.sentAt) >= presenceResendInterval {
+			delete(t.sent, userID)
+		}
+	}
+	t.sentPruned = now
+}
+
+// samePresence returns whether two presence updates look the same to
+// other servers, ignoring how long ago the user was last active.
+func samePresence(a, b fedTypes.PresenceContent) bool {
+	if a.Presence != b.Presence || a.CurrentlyActive != b.CurrentlyActive {
+		return false
+	}
+	if a.StatusMsg == nil || b.StatusMsg == nil {
+		return a.StatusMsg == b.StatusMsg
+	}
+	return *a.StatusMsg == *b.StatusMsg
+}
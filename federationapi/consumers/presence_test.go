@@ -0,0 +1,49 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPruneSent(t *testing.T) {
+	now := time.Now()
+	consumer := &OutputPresenceConsumer{
+		sent: map[string]sentPresence{
+			"@old:test":    {sentAt: now.Add(-presenceResendInterval * 2)},
+			"@recent:test": {sentAt: now.Add(-presenceResendInterval / 2)},
+		},
+	}
+
+	consumer.pruneSent(now)
+	if _, ok := consumer.sent["@old:test"]; ok {
+		t.Errorf("expected an update sent before the resend interval to be pruned")
+	}
+	if _, ok := consumer.sent["@recent:test"]; !ok {
+		t.Errorf("expected an update sent within the resend interval to be kept")
+	}
+
+	// Pruning again within the interval does nothing, even though the
+	// remaining entry has expired by then.
+	consumer.pruneSent(now.Add(presenceResendInterval / 2))
+	if len(consumer.sent) != 1 {
+		t.Errorf("expected nothing to be pruned within the interval, got %d entries", len(consumer.sent))
+	}
+	consumer.pruneSent(now.Add(presenceResendInterval))
+	if len(consumer.sent) != 0 {
+		t.Errorf("expected all expired updates to be pruned, got %d entries", len(consumer.sent))
+	}
+}
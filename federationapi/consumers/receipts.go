@@ -74,10 +74,11 @@ func (t *OutputReceiptConsumer) Start() error {
 // events topic from the client api.
 func (t *OutputReceiptConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
 	receipt := syncTypes.OutputReceiptEvent{
-		UserID:  msg.Header.Get(jetstream.UserID),
-		RoomID:  msg.Header.Get(jetstream.RoomID),
-		EventID: msg.Header.Get(jetstream.EventID),
-		Type:    msg.Header.Get("type"),
+		UserID:   msg.Header.Get(jetstream.UserID),
+		RoomID:   msg.Header.Get(jetstream.RoomID),
+		EventID:  msg.Header.Get(jetstream.EventID),
+		Type:     msg.Header.Get("type"),
+		ThreadID: msg.Header.Get("thread_id"),
 	}
 
 	// only send receipt events which originated from us
@@ -116,7 +117,8 @@ func (t *OutputReceiptConsumer) onMessage(ctx context.Context, msg *nats.Msg) bo
 		User: map[string]fedTypes.FederationReceiptData{
 			receipt.UserID: {
 				Data: fedTypes.ReceiptTS{
-					TS: receipt.Timestamp,
+					TS:       receipt.Timestamp,
+					ThreadID: receipt.ThreadID,
 				},
 				EventIDs: []string{receipt.EventID},
 			},
@@ -85,6 +85,7 @@ func AddPublicRoutes(
 		base.PublicFederationAPIMux,
 		base.PublicKeyAPIMux,
 		base.PublicWellKnownAPIMux,
+		base.ProcessContext,
 		cfg,
 		rsAPI, f, keyRing,
 		federation, userAPI, keyAPI, mscCfg,
@@ -164,7 +165,7 @@ func NewInternalAPI(
 	}
 
 	presenceConsumer := consumers.NewOutputPresenceConsumer(
-		base.ProcessContext, cfg, js, queues, federationDB,
+		base.ProcessContext, cfg, js, queues, federationDB, rsAPI,
 	)
 	if err = presenceConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start presence consumer")
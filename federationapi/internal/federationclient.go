@@ -2,8 +2,12 @@ package internal
 
 import (
 	"context"
+	"fmt"
+	"net/url"
 	"time"
 
+	"github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -178,3 +182,42 @@ func (a *FederationInternalAPI) MSC2946Spaces(
 	}
 	return ires.(gomatrixserverlib.MSC2946SpacesResponse), nil
 }
+
+func (a *FederationInternalAPI) TimestampToEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, direction string,
+) (res api.RespTimestampToEvent, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	ires, err := a.doRequestIfNotBlacklisted(s, func() (interface{}, error) {
+		query := url.Values{}
+		query.Set("ts", fmt.Sprintf("%d", ts))
+		query.Set("dir", direction)
+		var res api.RespTimestampToEvent
+		err := a.doFederationRequest(ctx, s, "/_matrix/federation/v1/timestamp_to_event/"+url.PathEscape(roomID)+"?"+query.Encode(), &res)
+		if gerr, ok := err.(gomatrix.HTTPError); ok && gerr.Code == 404 {
+			// fallback to unstable endpoint
+			err = a.doFederationRequest(ctx, s, "/_matrix/federation/unstable/org.matrix.msc3030/timestamp_to_event/"+url.PathEscape(roomID)+"?"+query.Encode(), &res)
+		}
+		return res, err
+	})
+	if err != nil {
+		return res, err
+	}
+	return ires.(api.RespTimestampToEvent), nil
+}
+
+// doFederationRequest signs and performs a GET request for a federation endpoint
+// which the gomatrixserverlib federation client doesn't know about yet.
+func (a *FederationInternalAPI) doFederationRequest(
+	ctx context.Context, s gomatrixserverlib.ServerName, requestURI string, res interface{},
+) error {
+	fedReq := gomatrixserverlib.NewFederationRequest("GET", s, requestURI)
+	if err := fedReq.Sign(a.cfg.Matrix.ServerName, a.cfg.Matrix.KeyID, a.cfg.Matrix.PrivateKey); err != nil {
+		return err
+	}
+	req, err := fedReq.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	return a.federation.DoRequestAndParseResponse(ctx, req, res)
+}
@@ -7,9 +7,30 @@ import (
 	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
+var keyFetchDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "key_fetch_duration_milliseconds",
+		Help:      "How long it takes to fetch server keys which we don't already have",
+		Buckets: []float64{ // milliseconds
+			10, 25, 50, 75, 100, 250, 500,
+			1000, 2000, 3000, 4000, 5000, 10000, 20000, 30000,
+		},
+	},
+	// fetcher is the name of the key fetcher, e.g. "DirectKeyFetcher" or
+	// "perspective server matrix.org", and outcome is whether the fetch worked.
+	[]string{"fetcher", "outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(keyFetchDuration)
+}
+
 func (s *FederationInternalAPI) KeyRing() *gomatrixserverlib.KeyRing {
 	// Return a keyring that forces requests to be proxied through the
 	// below functions. That way we can enforce things like validity
@@ -194,7 +215,15 @@ func (s *FederationInternalAPI) handleFetcherKeys(
 	defer fetcherCancel()
 
 	// Try to fetch the keys.
+	started := time.Now()
 	fetcherResults, err := fetcher.FetchKeys(fetcherCtx, requests)
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	keyFetchDuration.WithLabelValues(fetcher.FetcherName(), outcome).Observe(
+		float64(time.Since(started).Milliseconds()),
+	)
 	if err != nil {
 		return fmt.Errorf("fetcher.FetchKeys: %w", err)
 	}
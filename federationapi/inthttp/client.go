@@ -37,6 +37,7 @@ const (
 	FederationAPIEventRelationshipsPath  = "/federationapi/client/msc2836eventRelationships"
 	FederationAPISpacesSummaryPath       = "/federationapi/client/msc2946spacesSummary"
 	FederationAPIGetEventAuthPath        = "/federationapi/client/getEventAuth"
+	FederationAPITimestampToEventPath    = "/federationapi/client/timestampToEvent"
 
 	FederationAPIInputPublicKeyPath = "/federationapi/inputPublicKey"
 	FederationAPIQueryPublicKeyPath = "/federationapi/queryPublicKey"
@@ -512,6 +513,39 @@ func (h *httpFederationInternalAPI) MSC2836EventRelationships(
 	return response.Res, nil
 }
 
+type timestampToEvent struct {
+	S         gomatrixserverlib.ServerName
+	RoomID    string
+	TS        gomatrixserverlib.Timestamp
+	Direction string
+	Res       api.RespTimestampToEvent
+	Err       *api.FederationClientError
+}
+
+func (h *httpFederationInternalAPI) TimestampToEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, direction string,
+) (res api.RespTimestampToEvent, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "TimestampToEvent")
+	defer span.Finish()
+
+	request := timestampToEvent{
+		S:         s,
+		RoomID:    roomID,
+		TS:        ts,
+		Direction: direction,
+	}
+	var response timestampToEvent
+	apiURL := h.federationAPIURL + FederationAPITimestampToEventPath
+	err = httputil.PostJSON(ctx, span, h.httpClient, apiURL, &request, &response)
+	if err != nil {
+		return res, err
+	}
+	if response.Err != nil {
+		return res, response.Err
+	}
+	return response.Res, nil
+}
+
 type spacesReq struct {
 	S             gomatrixserverlib.ServerName
 	SuggestedOnly bool
@@ -43,7 +43,7 @@ type SyncAPIProducer struct {
 
 func (p *SyncAPIProducer) SendReceipt(
 	ctx context.Context,
-	userID, roomID, eventID, receiptType string, timestamp gomatrixserverlib.Timestamp,
+	userID, roomID, eventID, receiptType, threadID string, timestamp gomatrixserverlib.Timestamp,
 ) error {
 	m := &nats.Msg{
 		Subject: p.TopicReceiptEvent,
@@ -54,8 +54,12 @@ func (p *SyncAPIProducer) SendReceipt(
 	m.Header.Set(jetstream.EventID, eventID)
 	m.Header.Set("type", receiptType)
 	m.Header.Set("timestamp", fmt.Sprintf("%d", timestamp))
+	if threadID != "" {
+		m.Header.Set("thread_id", threadID)
+	}
 
 	log.WithFields(log.Fields{}).Tracef("Producing to topic '%s'", p.TopicReceiptEvent)
+	jetstream.InjectSpan(ctx, m)
 	_, err := p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
@@ -124,6 +128,7 @@ func (p *SyncAPIProducer) SendToDevice(
 		m.Header.Set("sender", sender)
 		m.Header.Set(jetstream.UserID, userID)
 
+		jetstream.InjectSpan(ctx, m)
 		if _, err = p.JetStream.PublishMsg(m, nats.Context(ctx)); err != nil {
 			log.WithError(err).Error("sendToDevice failed t.Producer.SendMessage")
 			return err
@@ -143,6 +148,7 @@ func (p *SyncAPIProducer) SendTyping(
 	m.Header.Set(jetstream.RoomID, roomID)
 	m.Header.Set("typing", strconv.FormatBool(typing))
 	m.Header.Set("timeout_ms", strconv.Itoa(int(timeoutMS)))
+	jetstream.InjectSpan(ctx, m)
 	_, err := p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
@@ -160,6 +166,7 @@ func (p *SyncAPIProducer) SendPresence(
 
 	m.Header.Set("last_active_ts", strconv.Itoa(int(lastActiveTS)))
 	log.Tracef("Sending presence to syncAPI: %+v", m.Header)
+	jetstream.InjectSpan(ctx, m)
 	_, err := p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
@@ -175,6 +182,7 @@ func (p *SyncAPIProducer) SendDeviceListUpdate(
 	}
 
 	log.Debugf("Sending device list update: %+v", m.Header)
+	jetstream.InjectSpan(ctx, m)
 	_, err = p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
@@ -17,7 +17,9 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -419,7 +421,9 @@ func (oq *destinationQueue) nextTransaction(
 	// to a 400-ish error
 	ctx, cancel := context.WithTimeout(oq.process.Context(), time.Minute*5)
 	defer cancel()
+	started := time.Now()
 	_, err := oq.client.SendTransaction(ctx, t)
+	observeTransaction(oq.destination, started, err)
 	switch err.(type) {
 	case nil:
 		// Clean up the transaction in the database.
@@ -452,3 +456,24 @@ func (oq *destinationQueue) nextTransaction(
 		return false, 0, 0, err
 	}
 }
+
+// observeTransaction updates the metrics for a transaction which was sent
+// to the destination, including the reason that it failed if it did.
+func observeTransaction(destination gomatrixserverlib.ServerName, started time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+		code := "network"
+		var httpErr gomatrix.HTTPError
+		switch {
+		case errors.As(err, &httpErr):
+			code = strconv.Itoa(httpErr.Code)
+		case errors.Is(err, context.DeadlineExceeded):
+			code = "timeout"
+		}
+		destinationTransactionErrors.WithLabelValues(string(destination), code).Inc()
+	}
+	destinationTransactionDuration.WithLabelValues(string(destination), outcome).Observe(
+		float64(time.Since(started).Milliseconds()),
+	)
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestObserveTransaction(t *testing.T) {
+	destination := gomatrixserverlib.ServerName("observe.test")
+	started := time.Now().Add(-time.Second)
+
+	observeTransaction(destination, started, nil)
+	observeTransaction(destination, started, gomatrix.HTTPError{Code: 502})
+	observeTransaction(destination, started, fmt.Errorf("send: %w", context.DeadlineExceeded))
+	observeTransaction(destination, started, errors.New("connection refused"))
+	observeTransaction(destination, started, errors.New("connection reset"))
+
+	for code, want := range map[string]float64{"502": 1, "timeout": 1, "network": 2} {
+		got := testutil.ToFloat64(destinationTransactionErrors.WithLabelValues(string(destination), code))
+		if got != want {
+			t.Errorf("expected %v errors with code %q, got %v", want, code, got)
+		}
+	}
+	if got := testutil.CollectAndCount(destinationTransactionErrors); got != 3 {
+		t.Errorf("expected 3 error series, got %d", got)
+	}
+
+	for outcome, want := range map[string]uint64{"success": 1, "failure": 4} {
+		observer := destinationTransactionDuration.WithLabelValues(string(destination), outcome)
+		count, sum := histogram(t, observer)
+		if count != want {
+			t.Errorf("expected %d %s durations, got %d", want, outcome, count)
+		}
+		if sum < float64(want)*1000 {
+			t.Errorf("expected %s durations of at least 1000ms each, got a total of %vms", outcome, sum)
+		}
+	}
+}
+
+func histogram(t *testing.T, observer prometheus.Observer) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := observer.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
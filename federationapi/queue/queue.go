@@ -52,7 +52,8 @@ type OutgoingQueues struct {
 func init() {
 	prometheus.MustRegister(
 		destinationQueueTotal, destinationQueueRunning,
-		destinationQueueBackingOff,
+		destinationQueueBackingOff, destinationTransactionDuration,
+		destinationTransactionErrors,
 	)
 }
 
@@ -80,6 +81,34 @@ var destinationQueueBackingOff = prometheus.NewGauge(
 	},
 )
 
+var destinationTransactionDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "destination_transaction_duration_milliseconds",
+		Help:      "How long it takes to send a transaction to a destination",
+		Buckets: []float64{ // milliseconds
+			10, 25, 50, 75, 100, 250, 500,
+			1000, 2000, 3000, 4000, 5000, 10000,
+			20000, 30000, 60000, 120000, 300000,
+		},
+	},
+	// outcome is whether the destination accepted the transaction.
+	[]string{"destination", "outcome"},
+)
+
+var destinationTransactionErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "destination_transaction_errors_total",
+		Help:      "How many transactions failed to send to a destination",
+	},
+	// code is the HTTP status code returned by the destination, or "timeout"
+	// or "network" if the destination didn't respond.
+	[]string{"destination", "code"},
+)
+
 // NewOutgoingQueues makes a new OutgoingQueues
 func NewOutgoingQueues(
 	db storage.Database,
@@ -21,7 +21,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/getsentry/sentry-go"
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
@@ -33,6 +32,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -50,6 +50,7 @@ import (
 // nolint: gocyclo
 func Setup(
 	fedMux, keyMux, wkMux *mux.Router,
+	process *process.ProcessContext,
 	cfg *config.FederationAPI,
 	rsAPI roomserverAPI.FederationRoomserverAPI,
 	fsAPI *fedInternal.FederationInternalAPI,
@@ -73,6 +74,12 @@ func Setup(
 		FsAPI: fsAPI,
 	}
 
+	var sendLimiter, makeJoinLimiter *httputil.TokenBucketLimiter
+	if cfg.RateLimiting.Enabled {
+		sendLimiter = httputil.NewTokenBucketLimiter(process, cfg.RateLimiting.Send)
+		makeJoinLimiter = httputil.NewTokenBucketLimiter(process, cfg.RateLimiting.MakeJoin)
+	}
+
 	localKeys := httputil.MakeExternalAPI("localkeys", func(req *http.Request) util.JSONResponse {
 		return LocalKeys(cfg)
 	})
@@ -129,6 +136,7 @@ func Setup(
 			return Send(
 				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
 				cfg, rsAPI, keyAPI, keys, federation, mu, servers, producer,
+				sendLimiter,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
@@ -296,6 +304,11 @@ func Setup(
 	v1fedmux.Handle("/make_join/{roomID}/{userID}", MakeFedAPI(
 		"federation_make_join", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			if !isRateLimitExempt(cfg, request.Origin()) {
+				if r := makeJoinLimiter.Limit(string(request.Origin()), 1); r != nil {
+					return *r
+				}
+			}
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
 					Code: http.StatusForbidden,
@@ -531,43 +544,7 @@ func MakeFedAPI(
 	wakeup *FederationWakeups,
 	f func(*http.Request, *gomatrixserverlib.FederationRequest, map[string]string) util.JSONResponse,
 ) http.Handler {
-	h := func(req *http.Request) util.JSONResponse {
-		fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
-			req, time.Now(), serverName, keyRing,
-		)
-		if fedReq == nil {
-			return errResp
-		}
-		// add the user to Sentry, if enabled
-		hub := sentry.GetHubFromContext(req.Context())
-		if hub != nil {
-			hub.Scope().SetTag("origin", string(fedReq.Origin()))
-			hub.Scope().SetTag("uri", fedReq.RequestURI())
-		}
-		defer func() {
-			if r := recover(); r != nil {
-				if hub != nil {
-					hub.CaptureException(fmt.Errorf("%s panicked", req.URL.Path))
-				}
-				// re-panic to return the 500
-				panic(r)
-			}
-		}()
-		go wakeup.Wakeup(req.Context(), fedReq.Origin())
-		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
-		if err != nil {
-			return util.MatrixErrorResponse(400, "M_UNRECOGNISED", "badly encoded query params")
-		}
-
-		jsonRes := f(req, fedReq, vars)
-		// do not log 4xx as errors as they are client fails, not server fails
-		if hub != nil && jsonRes.Code >= 500 {
-			hub.Scope().SetExtra("response", jsonRes)
-			hub.CaptureException(fmt.Errorf("%s returned HTTP %d", req.URL.Path, jsonRes.Code))
-		}
-		return jsonRes
-	}
-	return httputil.MakeExternalAPI(metricsName, h)
+	return httputil.MakeFedAPI(metricsName, serverName, keyRing, wakeup.Wakeup, f)
 }
 
 type FederationWakeups struct {
@@ -586,3 +563,14 @@ func (f *FederationWakeups) Wakeup(ctx context.Context, origin gomatrixserverlib
 	f.FsAPI.MarkServersAlive([]gomatrixserverlib.ServerName{origin})
 	f.origins.Store(origin, time.Now())
 }
+
+// isRateLimitExempt returns true if the server is exempt from federation
+// rate limits.
+func isRateLimitExempt(cfg *config.FederationAPI, origin gomatrixserverlib.ServerName) bool {
+	for _, server := range cfg.RateLimiting.ExemptServers {
+		if server == origin {
+			return true
+		}
+	}
+	return false
+}
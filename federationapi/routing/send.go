@@ -17,6 +17,7 @@ package routing
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
@@ -27,6 +28,7 @@ import (
 	"github.com/matrix-org/dendrite/federationapi/producers"
 	"github.com/matrix-org/dendrite/federationapi/types"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/httputil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -76,6 +78,10 @@ var (
 
 var inFlightTxnsPerOrigin sync.Map // transaction ID -> chan util.JSONResponse
 
+// queueFullRetryAfter is how long we ask other servers to wait before they
+// send a transaction again when a room has too many events queued for input.
+const queueFullRetryAfter = time.Second * 30
+
 // Send implements /_matrix/federation/v1/send/{txnID}
 func Send(
 	httpReq *http.Request,
@@ -89,6 +95,7 @@ func Send(
 	mu *internal.MutexByRoom,
 	servers federationAPI.ServersInRoomProvider,
 	producer *producers.SyncAPIProducer,
+	limiter *httputil.TokenBucketLimiter,
 ) util.JSONResponse {
 	// First we should check if this origin has already submitted this
 	// txn ID to us. If they have and the txnIDs map contains an entry,
@@ -152,6 +159,17 @@ func Send(
 			JSON: jsonerror.BadJSON("max 50 pdus / 100 edus"),
 		}
 	}
+	// Each PDU takes a token from the origin's bucket, so that a server which
+	// sends us lots of small transactions is limited in the same way as one
+	// which sends us a few large ones. If the origin is over the limit then
+	// none of the transaction is processed, and the 429 tells the origin to
+	// send all of it again later.
+	if len(txnEvents.PDUs) > 0 && !isRateLimitExempt(cfg, request.Origin()) {
+		if res := limiter.Limit(string(request.Origin()), len(txnEvents.PDUs)); res != nil {
+			ch <- *res
+			return *res
+		}
+	}
 
 	// TODO: Really we should have a function to convert FederationRequest to txnReq
 	t.PDUs = txnEvents.PDUs
@@ -165,6 +183,7 @@ func Send(
 	resp, jsonErr := t.processTransaction(httpReq.Context())
 	if jsonErr != nil {
 		util.GetLogger(httpReq.Context()).WithField("jsonErr", jsonErr).Error("t.processTransaction failed")
+		ch <- *jsonErr
 		return *jsonErr
 	}
 
@@ -205,13 +224,6 @@ type txnFederationClient interface {
 }
 
 func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.RespSend, *util.JSONResponse) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		t.processEDUs(ctx)
-	}()
-
 	results := make(map[string]gomatrixserverlib.PDUResult)
 	roomVersions := make(map[string]gomatrixserverlib.RoomVersion)
 	getRoomVersion := func(roomID string) gomatrixserverlib.RoomVersion {
@@ -228,6 +240,7 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 		return verRes.RoomVersion
 	}
 
+	events := make([]*gomatrixserverlib.HeaderedEvent, 0, len(t.PDUs))
 	for _, pdu := range t.PDUs {
 		pduCountTotal.WithLabelValues("total").Inc()
 		var header struct {
@@ -274,34 +287,51 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 			}
 			continue
 		}
+		events = append(events, event.Headered(roomVersion))
+	}
 
-		// pass the event to the roomserver which will do auth checks
-		// If the event fail auth checks, gmsl.NotAllowed error will be returned which we be silently
-		// discarded by the caller of this function
-		if err = api.SendEvents(
+	// Pass the events to the roomserver which will do auth checks. If an
+	// event fails auth checks, gmsl.NotAllowed error will be returned which
+	// we be silently discarded by the caller of this function. The events
+	// are sent together, so that the roomserver refuses all of them if the
+	// input queue for any of their rooms is full. Then we ask the origin to
+	// send the whole transaction again later, without having processed any
+	// of it, rather than dropping the events.
+	if len(events) > 0 {
+		if err := api.SendEvents(
 			ctx,
 			t.rsAPI,
 			api.KindNew,
-			[]*gomatrixserverlib.HeaderedEvent{
-				event.Headered(roomVersion),
-			},
+			events,
 			t.Origin,
 			api.DoNotSendToOtherServers,
 			nil,
 			true,
 		); err != nil {
-			util.GetLogger(ctx).WithError(err).Errorf("Transaction: Couldn't submit event %q to input queue: %s", event.EventID(), err)
-			results[event.EventID()] = gomatrixserverlib.PDUResult{
-				Error: err.Error(),
+			if errors.Is(err, api.ErrQueueFull) {
+				util.GetLogger(ctx).WithError(err).Warn("Transaction: Input queue is full")
+				return nil, &util.JSONResponse{
+					Code: http.StatusTooManyRequests,
+					JSON: jsonerror.LimitExceeded("Too many events are waiting to be processed for this room", queueFullRetryAfter.Milliseconds()),
+				}
 			}
-			continue
+			util.GetLogger(ctx).WithError(err).Errorf("Transaction: Couldn't submit %d events to input queue: %s", len(events), err)
+			for _, event := range events {
+				results[event.EventID()] = gomatrixserverlib.PDUResult{
+					Error: err.Error(),
+				}
+			}
+			events = nil
 		}
-
+	}
+	for _, event := range events {
 		results[event.EventID()] = gomatrixserverlib.PDUResult{}
 		pduCountTotal.WithLabelValues("success").Inc()
 	}
 
-	wg.Wait()
+	// The EDUs are only processed once we know that we won't ask the
+	// origin to send the transaction again.
+	t.processEDUs(ctx)
 	return &gomatrixserverlib.RespSend{PDUs: results}, nil
 }
 
@@ -379,7 +409,7 @@ func (t *txnReq) processEDUs(ctx context.Context) {
 						util.GetLogger(ctx).Debugf("Dropping receipt event where sender domain (%q) doesn't match origin (%q)", domain, t.Origin)
 						continue
 					}
-					if err := t.processReceiptEvent(ctx, userID, roomID, "m.read", mread.Data.TS, mread.EventIDs); err != nil {
+					if err := t.processReceiptEvent(ctx, userID, roomID, "m.read", mread.Data.ThreadID, mread.Data.TS, mread.EventIDs); err != nil {
 						util.GetLogger(ctx).WithError(err).WithFields(logrus.Fields{
 							"sender":  t.Origin,
 							"user_id": userID,
@@ -467,7 +497,7 @@ func (t *txnReq) processSigningKeyUpdate(ctx context.Context, e gomatrixserverli
 
 // processReceiptEvent sends receipt events to JetStream
 func (t *txnReq) processReceiptEvent(ctx context.Context,
-	userID, roomID, receiptType string,
+	userID, roomID, receiptType, threadID string,
 	timestamp gomatrixserverlib.Timestamp,
 	eventIDs []string,
 ) error {
@@ -480,7 +510,7 @@ func (t *txnReq) processReceiptEvent(ctx context.Context,
 	}
 	// store every event
 	for _, eventID := range eventIDs {
-		if err := t.producer.SendReceipt(ctx, userID, roomID, eventID, receiptType, timestamp); err != nil {
+		if err := t.producer.SendReceipt(ctx, userID, roomID, eventID, receiptType, threadID, timestamp); err != nil {
 			return fmt.Errorf("unable to set receipt event: %w", err)
 		}
 	}
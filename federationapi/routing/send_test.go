@@ -2,13 +2,20 @@ package routing
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -55,6 +62,7 @@ func init() {
 type testRoomserverAPI struct {
 	api.RoomserverInternalAPITrace
 	inputRoomEvents           []api.InputRoomEvent
+	queueFull                 map[string]bool // event IDs whose rooms have full input queues
 	queryStateAfterEvents     func(*api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse
 	queryEventsByID           func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse
 	queryLatestEventsAndState func(*api.QueryLatestEventsAndStateRequest) api.QueryLatestEventsAndStateResponse
@@ -65,6 +73,13 @@ func (t *testRoomserverAPI) InputRoomEvents(
 	request *api.InputRoomEventsRequest,
 	response *api.InputRoomEventsResponse,
 ) {
+	for _, ire := range request.InputRoomEvents {
+		if t.queueFull[ire.Event.EventID()] {
+			response.ErrMsg = api.ErrQueueFull.Error()
+			response.QueueFull = true
+			return
+		}
+	}
 	t.inputRoomEvents = append(t.inputRoomEvents, request.InputRoomEvents...)
 	for _, ire := range request.InputRoomEvents {
 		fmt.Println("InputRoomEvents: ", ire.Event.EventID())
@@ -266,6 +281,72 @@ func TestBasicTransaction(t *testing.T) {
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
 }
 
+// The purpose of this test is to check that if the roomserver's input queue is full for the
+// room of any event in a transaction, the origin is asked to send the whole transaction again
+// later, and none of it is processed.
+func TestTransactionQueueFull(t *testing.T) {
+	rsAPI := &testRoomserverAPI{queueFull: map[string]bool{
+		testEvents[len(testEvents)-1].EventID(): true,
+	}}
+	pdus := []json.RawMessage{
+		testData[len(testData)-2], // a message event
+		testData[len(testData)-1], // another message event
+	}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	res, jsonRes := txn.processTransaction(context.Background())
+	if res != nil || jsonRes == nil {
+		t.Fatalf("expected the transaction to be refused, got %+v", res)
+	}
+	if jsonRes.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected HTTP %d, got %d", http.StatusTooManyRequests, jsonRes.Code)
+	}
+	if resErr, ok := jsonRes.JSON.(*jsonerror.LimitExceededError); !ok || resErr.RetryAfterMS != queueFullRetryAfter.Milliseconds() {
+		t.Fatalf("expected M_LIMIT_EXCEEDED with retry_after_ms, got %+v", jsonRes.JSON)
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
+
+// The purpose of this test is to check that if the origin has sent too many PDUs too quickly,
+// the whole transaction is refused with a 429 so that the origin sends it again later, and
+// none of it is sent to the roomserver.
+func TestTransactionPDUsLimited(t *testing.T) {
+	processCtx := process.NewProcessContext()
+	t.Cleanup(processCtx.ShutdownDendrite)
+	limiter := httputil.NewTokenBucketLimiter(processCtx, config.RateLimit{PerSecond: 1, Burst: 1})
+	// Use up the origin's only token.
+	if ok, _ := limiter.Take(string(testOrigin), 1); !ok {
+		t.Fatalf("expected to be able to take a token")
+	}
+
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	txnID := gomatrixserverlib.TransactionID("limited")
+	request := gomatrixserverlib.NewFederationRequest(http.MethodPut, testDestination, "/_matrix/federation/v1/send/"+string(txnID))
+	if err = request.SetContent(map[string]interface{}{
+		"pdus": []json.RawMessage{testData[len(testData)-1]}, // a message event
+	}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	if err = request.Sign(testOrigin, "ed25519:auto", priv); err != nil {
+		t.Fatalf("failed to sign request: %s", err)
+	}
+
+	cfg := &config.FederationAPI{Matrix: &config.Global{}}
+	cfg.Matrix.ServerName = testDestination
+	rsAPI := &testRoomserverAPI{}
+	httpReq := httptest.NewRequest(http.MethodPut, "/_matrix/federation/v1/send/"+string(txnID), nil)
+	res := Send(httpReq, &request, txnID, cfg, rsAPI, nil, nil, nil, nil, nil, nil, limiter)
+	if res.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected HTTP %d, got %d", http.StatusTooManyRequests, res.Code)
+	}
+	if resErr, ok := res.JSON.(*jsonerror.LimitExceededError); !ok || resErr.RetryAfterMS <= 0 {
+		t.Fatalf("expected M_LIMIT_EXCEEDED with retry_after_ms, got %+v", res.JSON)
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
+
 // The purpose of this test is to check that if the event received fails auth checks the event is still sent to the roomserver
 // as it does the auth check.
 func TestTransactionFailAuthChecks(t *testing.T) {
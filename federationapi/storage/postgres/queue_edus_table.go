@@ -97,12 +97,7 @@ func NewPostgresQueueEDUsTable(db *sql.DB) (s *queueEDUsStatements, err error) {
 	}
 
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(
-		sqlutil.Migration{
-			Version: "federationapi: add expiresat column",
-			Up:      deltas.UpAddexpiresat,
-		},
-	)
+	m.AddMigrations(deltas.AddexpiresatMigration)
 	if err := m.Up(context.Background()); err != nil {
 		return s, err
 	}
@@ -83,10 +83,7 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions,
 		return nil, err
 	}
 	m := sqlutil.NewMigrator(d.db)
-	m.AddMigrations(sqlutil.Migration{
-		Version: "federationsender: drop federationsender_rooms",
-		Up:      deltas.UpRemoveRoomsTable,
-	})
+	m.AddMigrations(deltas.RemoveRoomsTableMigration)
 	err = m.Up(base.Context())
 	if err != nil {
 		return nil, err
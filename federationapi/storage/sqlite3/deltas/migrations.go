@@ -0,0 +1,41 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import "github.com/matrix-org/dendrite/internal/sqlutil"
+
+var (
+	// The dropped table can't be restored, so this can't be rolled back.
+	RemoveRoomsTableMigration = sqlutil.Migration{
+		Version: "federationsender: drop federationsender_rooms",
+		Up:      UpRemoveRoomsTable,
+	}
+	AddexpiresatMigration = sqlutil.Migration{
+		Version: "federationapi: add expiresat column",
+		Up:      UpAddexpiresat,
+		Down:    DownAddexpiresat,
+	}
+	// The dropped table can't be restored, so this can't be rolled back.
+	DropQueueEDUsOldMigration = sqlutil.Migration{
+		Version: "federationapi: drop federationsender_queue_edus_old",
+		Up:      UpDropQueueEDUsOld,
+	}
+)
+
+var Migrations = []sqlutil.Migration{
+	RemoveRoomsTableMigration,
+	AddexpiresatMigration,
+	DropQueueEDUsOldMigration,
+}
@@ -98,12 +98,7 @@ func NewSQLiteQueueEDUsTable(db *sql.DB) (s *queueEDUsStatements, err error) {
 	}
 
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(
-		sqlutil.Migration{
-			Version: "federationapi: add expiresat column",
-			Up:      deltas.UpAddexpiresat,
-		},
-	)
+	m.AddMigrations(deltas.AddexpiresatMigration, deltas.DropQueueEDUsOldMigration)
 	if err := m.Up(context.Background()); err != nil {
 		return s, err
 	}
@@ -65,6 +65,8 @@ type FederationReceiptData struct {
 
 type ReceiptTS struct {
 	TS gomatrixserverlib.Timestamp `json:"ts"`
+	// ThreadID is the MSC3771 thread which the receipt applies to, if any.
+	ThreadID string `json:"thread_id,omitempty"`
 }
 
 type Presence struct {
@@ -0,0 +1,86 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// RoomMembers is the list of local joined member events of a room, as
+// used when evaluating push rules.
+type RoomMembers []gomatrixserverlib.ClientEvent
+
+func (m RoomMembers) CacheCost() int {
+	cost := 0
+	for _, ev := range m {
+		cost += len(ev.EventID) + len(ev.Sender) + len(ev.Content) + 64
+		if ev.StateKey != nil {
+			cost += len(*ev.StateKey)
+		}
+	}
+	return cost
+}
+
+// PushCache contains the subset of functions needed for caching the
+// push rules of local users and the room state that the push rules are
+// evaluated against.
+type PushCache interface {
+	GetPushRules(userID string) (*pushrules.CompiledRuleSet, bool)
+	StorePushRules(userID string, rules *pushrules.CompiledRuleSet)
+	InvalidatePushRules(userID string)
+	GetPushRoomMembers(roomID string) (RoomMembers, bool)
+	StorePushRoomMembers(roomID string, members RoomMembers)
+	InvalidatePushRoomMembers(roomID string)
+	GetPushPowerLevels(roomID string) (*gomatrixserverlib.PowerLevelContent, bool)
+	StorePushPowerLevels(roomID string, plc *gomatrixserverlib.PowerLevelContent)
+	InvalidatePushPowerLevels(roomID string)
+}
+
+func (c Caches) GetPushRules(userID string) (*pushrules.CompiledRuleSet, bool) {
+	return c.PushRules.Get(userID)
+}
+
+func (c Caches) StorePushRules(userID string, rules *pushrules.CompiledRuleSet) {
+	c.PushRules.Set(userID, rules)
+}
+
+func (c Caches) InvalidatePushRules(userID string) {
+	c.PushRules.Unset(userID)
+}
+
+func (c Caches) GetPushRoomMembers(roomID string) (RoomMembers, bool) {
+	return c.PushRoomMembers.Get(roomID)
+}
+
+func (c Caches) StorePushRoomMembers(roomID string, members RoomMembers) {
+	c.PushRoomMembers.Set(roomID, members)
+}
+
+func (c Caches) InvalidatePushRoomMembers(roomID string) {
+	c.PushRoomMembers.Unset(roomID)
+}
+
+func (c Caches) GetPushPowerLevels(roomID string) (*gomatrixserverlib.PowerLevelContent, bool) {
+	return c.PushPowerLevels.Get(roomID)
+}
+
+func (c Caches) StorePushPowerLevels(roomID string, plc *gomatrixserverlib.PowerLevelContent) {
+	c.PushPowerLevels.Set(roomID, plc)
+}
+
+func (c Caches) InvalidatePushPowerLevels(roomID string) {
+	c.PushPowerLevels.Unset(roomID)
+}
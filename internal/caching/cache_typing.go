@@ -108,20 +108,40 @@ func (t *EDUCache) AddTypingUser(
 				t.timeoutCallback(userID, roomID, latestSyncPosition)
 			}
 		})
-		return t.addUser(userID, roomID, timer)
+		return t.addUser(userID, roomID, timer, 0)
 	}
 	return t.GetLatestSyncPosition()
 }
 
-// addUser with mutex lock & replace the previous timer.
+// AddTypingUserAtPosition sets an user as typing in a room, like
+// AddTypingUser, but gives the update the typing sync position pos rather
+// than the next one. This is for when the positions are shared between more
+// than one sync API instance, which must all make the same updates at the
+// same positions. For the same reason, the user isn't removed when their
+// typing times out: onTimeout is called instead, and should arrange for
+// RemoveUserAtPosition to be called on every instance.
+// Returns the latest sync position for typing after update.
+func (t *EDUCache) AddTypingUserAtPosition(
+	userID, roomID string, expire *time.Time, pos int64, onTimeout func(),
+) int64 {
+	expireTime := getExpireTime(expire)
+	until := time.Until(expireTime)
+	if until < 0 {
+		until = 0
+	}
+	return t.addUser(userID, roomID, time.AfterFunc(until, onTimeout), pos)
+}
+
+// addUser with mutex lock & replace the previous timer. If pos is 0 then
+// the next typing sync position is used.
 // Returns the latest typing sync position after update.
 func (t *EDUCache) addUser(
-	userID, roomID string, expiryTimer *time.Timer,
+	userID, roomID string, expiryTimer *time.Timer, pos int64,
 ) int64 {
 	t.Lock()
 	defer t.Unlock()
 
-	t.latestSyncPosition++
+	t._advance(pos)
 
 	if t.data[roomID] == nil {
 		t.data[roomID] = t.newRoomData()
@@ -148,28 +168,60 @@ func (t *EDUCache) addUser(
 // RemoveUser with mutex lock & stop the timer.
 // Returns the latest sync position for typing after update.
 func (t *EDUCache) RemoveUser(userID, roomID string) int64 {
+	return t.removeUser(userID, roomID, 0)
+}
+
+// RemoveUserAtPosition removes an user from typing in a room, like
+// RemoveUser, but gives the update the typing sync position pos rather than
+// the next one. See AddTypingUserAtPosition.
+// Returns the latest sync position for typing after update.
+func (t *EDUCache) RemoveUserAtPosition(userID, roomID string, pos int64) int64 {
+	return t.removeUser(userID, roomID, pos)
+}
+
+// removeUser with mutex lock & stop the timer. If pos is 0 then the next
+// typing sync position is used.
+func (t *EDUCache) removeUser(userID, roomID string, pos int64) int64 {
 	t.Lock()
 	defer t.Unlock()
 
+	// A shared position is used up even if there is nothing to remove, so
+	// that the latest position is the same on every instance.
 	roomData, ok := t.data[roomID]
 	if !ok {
+		if pos != 0 {
+			t._advance(pos)
+		}
 		return t.latestSyncPosition
 	}
 
 	timer, ok := roomData.userSet[userID]
 	if !ok {
+		if pos != 0 {
+			t._advance(pos)
+		}
 		return t.latestSyncPosition
 	}
 
 	timer.Stop()
 	delete(roomData.userSet, userID)
 
-	t.latestSyncPosition++
+	t._advance(pos)
 	t.data[roomID].syncPosition = t.latestSyncPosition
 
 	return t.latestSyncPosition
 }
 
+// _advance moves the latest sync position on to pos, or on to the next
+// position if pos is 0. The lock must be held.
+func (t *EDUCache) _advance(pos int64) {
+	if pos == 0 {
+		t.latestSyncPosition++
+	} else if pos > t.latestSyncPosition {
+		t.latestSyncPosition = pos
+	}
+}
+
 func (t *EDUCache) GetLatestSyncPosition() int64 {
 	t.Lock()
 	defer t.Unlock()
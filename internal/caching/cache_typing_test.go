@@ -101,3 +101,37 @@ func testRemoveUser(t *testing.T, tCache *EDUCache) {
 		}
 	}
 }
+
+func TestEDUCacheAtPosition(t *testing.T) {
+	tCache := NewTypingCache()
+	timedOut := make(chan struct{})
+	expire := time.Now().Add(time.Millisecond * 50)
+
+	if pos := tCache.AddTypingUserAtPosition("user1", "room1", &expire, 5, func() { close(timedOut) }); pos != 5 {
+		t.Fatalf("expected position 5, got %d", pos)
+	}
+	if _, updated := tCache.GetTypingUsersIfUpdatedAfter("room1", 4); !updated {
+		t.Fatalf("expected room1 to be updated after position 4")
+	}
+
+	// The user isn't removed when their typing times out, only when told to.
+	select {
+	case <-timedOut:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the timeout")
+	}
+	if users := tCache.GetTypingUsers("room1"); len(users) != 1 {
+		t.Fatalf("expected user1 to still be typing, got %v", users)
+	}
+	if pos := tCache.RemoveUserAtPosition("user1", "room1", 9); pos != 9 {
+		t.Fatalf("expected position 9, got %d", pos)
+	}
+	if users, updated := tCache.GetTypingUsersIfUpdatedAfter("room1", 8); !updated || len(users) != 0 {
+		t.Fatalf("expected room1 to be updated with no users typing, got %v", users)
+	}
+
+	// Positions are used up even if nobody was removed.
+	if pos := tCache.RemoveUserAtPosition("user2", "room2", 12); pos != 12 {
+		t.Fatalf("expected position 12, got %d", pos)
+	}
+}
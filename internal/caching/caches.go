@@ -15,10 +15,35 @@
 package caching
 
 import (
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/nats-io/nats.go"
+
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
+// The names of the caches, as used in the cache config and in metrics.
+const (
+	RoomVersionsCacheName        = "room_versions"
+	ServerKeysCacheName          = "server_keys"
+	RoomServerRoomNIDsCacheName  = "roomserver_room_nids"
+	RoomServerRoomIDsCacheName   = "roomserver_room_ids"
+	RoomServerEventsCacheName    = "roomserver_events"
+	RoomServerStateKeysCacheName = "roomserver_state_keys"
+	FederationPDUsCacheName      = "federation_pdus"
+	FederationEDUsCacheName      = "federation_edus"
+	SpaceSummaryRoomsCacheName   = "space_summary_rooms"
+	LazyLoadingCacheName         = "lazy_loading"
+	PushRulesCacheName           = "push_rules"
+	PushRoomMembersCacheName     = "push_room_members"
+	PushPowerLevelsCacheName     = "push_power_levels"
+)
+
 // Caches contains a set of references to caches. They may be
 // different implementations as long as they satisfy the Cache
 // interface.
@@ -33,6 +58,185 @@ type Caches struct {
 	FederationEDUs      Cache[int64, *gomatrixserverlib.EDU]                   // queue NID -> EDU
 	SpaceSummaryRooms   Cache[string, gomatrixserverlib.MSC2946SpacesResponse] // room ID -> space response
 	LazyLoading         Cache[lazyLoadingCacheKey, string]                     // composite key -> event ID
+	PushRules           Cache[string, *pushrules.CompiledRuleSet]              // user ID -> compiled push rules
+	PushRoomMembers     Cache[string, RoomMembers]                             // room ID -> local joined member events
+	PushPowerLevels     Cache[string, *gomatrixserverlib.PowerLevelContent]    // room ID -> power levels
+
+	invalidator *invalidator
+}
+
+// StartInvalidation starts sending and receiving invalidations for the
+// shared caches which are kept in memory, so that processes don't keep using
+// entries which were changed by another process. This must be used when the
+// components are run in separate processes without a shared cache backend.
+func (c *Caches) StartInvalidation(nc *nats.Conn, subject string) error {
+	if c == nil || c.invalidator == nil {
+		return nil
+	}
+	return c.invalidator.start(nc, subject)
+}
+
+// cacheSpec describes a cache to be built by NewCaches.
+type cacheSpec struct {
+	name   string
+	prefix byte
+	// Whether entries can be changed or removed once they are set.
+	mutable bool
+	// Whether the cache is useful to more than one component, in which case
+	// it is stored in the shared backend when there is one.
+	shared bool
+	// If set, entries never live longer than this, whatever the config.
+	maxAgeLimit time.Duration
+}
+
+var cacheSpecs = map[string]cacheSpec{
+	RoomVersionsCacheName:        {name: RoomVersionsCacheName, prefix: roomVersionsCache, shared: true},
+	ServerKeysCacheName:          {name: ServerKeysCacheName, prefix: serverKeysCache, mutable: true, shared: true},
+	RoomServerRoomNIDsCacheName:  {name: RoomServerRoomNIDsCacheName, prefix: roomNIDsCache, shared: true},
+	RoomServerRoomIDsCacheName:   {name: RoomServerRoomIDsCacheName, prefix: roomIDsCache, shared: true},
+	RoomServerEventsCacheName:    {name: RoomServerEventsCacheName, prefix: roomEventsCache, shared: true},
+	RoomServerStateKeysCacheName: {name: RoomServerStateKeysCacheName, prefix: eventStateKeyCache, shared: true},
+	FederationPDUsCacheName:      {name: FederationPDUsCacheName, prefix: federationPDUsCache, mutable: true, maxAgeLimit: time.Hour / 2},
+	FederationEDUsCacheName:      {name: FederationEDUsCacheName, prefix: federationEDUsCache, mutable: true, maxAgeLimit: time.Hour / 2},
+	SpaceSummaryRoomsCacheName:   {name: SpaceSummaryRoomsCacheName, prefix: spaceSummaryRoomsCache, mutable: true, shared: true},
+	LazyLoadingCacheName:         {name: LazyLoadingCacheName, prefix: lazyLoadingCache, mutable: true},
+	PushRulesCacheName:           {name: PushRulesCacheName, prefix: pushRulesCache, mutable: true},
+	PushRoomMembersCacheName:     {name: PushRoomMembersCacheName, prefix: pushRoomMembersCache, mutable: true, maxAgeLimit: time.Minute * 5},
+	PushPowerLevelsCacheName:     {name: PushPowerLevelsCacheName, prefix: pushPowerLevelsCache, mutable: true, maxAgeLimit: time.Minute * 5},
+}
+
+// NewCaches creates the caches using the configured backend. With the
+// "ristretto" backend, all caches are kept in memory. With the "redis"
+// backend, the caches which are useful to more than one component are
+// stored on the Redis server, so that they are shared between processes.
+// Immutable entries are also kept in memory, in front of Redis.
+func NewCaches(cfg *config.Cache, enablePrometheus bool) (*Caches, error) {
+	for name := range cfg.Caches {
+		if _, ok := cacheSpecs[name]; !ok {
+			return nil, fmt.Errorf("unknown cache %q", name)
+		}
+	}
+	b := &cacheBuilder{
+		cfg:              cfg,
+		enablePrometheus: enablePrometheus,
+		invalidator:      newInvalidator(),
+	}
+	var err error
+	if b.ristretto, err = newRistretto(cfg.EstimatedMaxSize, enablePrometheus); err != nil {
+		return nil, err
+	}
+	if cfg.Backend == config.CacheBackendRedis {
+		if b.redis, err = newRedisClient(&cfg.Redis); err != nil {
+			return nil, err
+		}
+	}
+	caches := &Caches{
+		RoomVersions:        newCache[string, gomatrixserverlib.RoomVersion](b, RoomVersionsCacheName),
+		ServerKeys:          newCache[string, gomatrixserverlib.PublicKeyLookupResult](b, ServerKeysCacheName),
+		RoomServerRoomNIDs:  newCache[string, types.RoomNID](b, RoomServerRoomNIDsCacheName),
+		RoomServerRoomIDs:   newCache[types.RoomNID, string](b, RoomServerRoomIDsCacheName),
+		RoomServerEvents:    wrapCache(b, RoomServerEventsCacheName, newCostedPartition[int64, *gomatrixserverlib.Event](b, RoomServerEventsCacheName), encodeEvent, decodeEvent),
+		RoomServerStateKeys: newCache[types.EventStateKeyNID, string](b, RoomServerStateKeysCacheName),
+		FederationPDUs:      newCostedCache[int64, *gomatrixserverlib.HeaderedEvent](b, FederationPDUsCacheName),
+		FederationEDUs:      newCostedCache[int64, *gomatrixserverlib.EDU](b, FederationEDUsCacheName),
+		SpaceSummaryRooms:   newCache[string, gomatrixserverlib.MSC2946SpacesResponse](b, SpaceSummaryRoomsCacheName),
+		LazyLoading:         newCache[lazyLoadingCacheKey, string](b, LazyLoadingCacheName),
+		PushRules:           newCostedCache[string, *pushrules.CompiledRuleSet](b, PushRulesCacheName),
+		PushRoomMembers:     newCostedCache[string, RoomMembers](b, PushRoomMembersCacheName),
+		PushPowerLevels:     newCache[string, *gomatrixserverlib.PowerLevelContent](b, PushPowerLevelsCacheName),
+		invalidator:         b.invalidator,
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return caches, nil
+}
+
+type cacheBuilder struct {
+	cfg              *config.Cache
+	enablePrometheus bool
+	ristretto        *ristretto.Cache
+	redis            *redisClient
+	invalidator      *invalidator
+	// The first error from building a cache, if any.
+	err error
+}
+
+func (b *cacheBuilder) maxAge(spec cacheSpec) time.Duration {
+	maxAge := b.cfg.MaxAge
+	if options := b.cfg.Caches[spec.name]; options.MaxAge > 0 {
+		maxAge = options.MaxAge
+	}
+	if spec.maxAgeLimit > 0 {
+		maxAge = lesserOf(spec.maxAgeLimit, maxAge)
+	}
+	return maxAge
+}
+
+func newCache[K keyable, V any](b *cacheBuilder, name string) Cache[K, V] {
+	return wrapCache[K, V](b, name, newPartition[K, V](b, name), nil, nil)
+}
+
+func newCostedCache[K keyable, V costable](b *cacheBuilder, name string) Cache[K, V] {
+	return wrapCache[K, V](b, name, newCostedPartition[K, V](b, name), nil, nil)
+}
+
+func newCostedPartition[K keyable, V costable](b *cacheBuilder, name string) Cache[K, V] {
+	return &RistrettoCostedCachePartition[K, V]{newPartition[K, V](b, name)}
+}
+
+// newPartition creates the in-memory part of a cache, which uses its own
+// ristretto cache if it has its own size in the config.
+func newPartition[K keyable, V any](b *cacheBuilder, name string) *RistrettoCachePartition[K, V] {
+	spec := cacheSpecs[name]
+	cache := b.ristretto
+	if size := b.cfg.Caches[name].EstimatedMaxSize; size > 0 {
+		var err error
+		if cache, err = newRistretto(size, false); err != nil && b.err == nil {
+			b.err = fmt.Errorf("cache %q: %w", name, err)
+		}
+	}
+	return &RistrettoCachePartition[K, V]{
+		cache:   cache,
+		Prefix:  spec.prefix,
+		Mutable: spec.mutable,
+		MaxAge:  b.maxAge(spec),
+	}
+}
+
+// wrapCache puts the in-memory part of a cache together with the shared
+// backend, invalidation and metrics, as needed.
+func wrapCache[K keyable, V any](
+	b *cacheBuilder, name string, local Cache[K, V],
+	encode func(V) ([]byte, error), decode func([]byte) (V, error),
+) Cache[K, V] {
+	spec := cacheSpecs[name]
+	cache := local
+	switch {
+	case spec.shared && b.redis != nil:
+		shared := &RedisCachePartition[K, V]{
+			client: b.redis,
+			Name:   name,
+			MaxAge: b.maxAge(spec),
+			encode: encode,
+			decode: decode,
+		}
+		if spec.mutable {
+			// Other processes can change the entries, so they can't be
+			// kept in memory too.
+			cache = shared
+		} else {
+			cache = &TieredCache[K, V]{Local: local, Shared: shared}
+		}
+	case spec.shared && spec.mutable:
+		if c, ok := any(local).(Cache[string, V]); ok {
+			cache = any(newInvalidatingCache(name, c, b.invalidator)).(Cache[K, V])
+		}
+	}
+	if b.enablePrometheus {
+		cache = newInstrumentedCache(name, cache)
+	}
+	return cache
 }
 
 // Cache is the interface that an implementation must satisfy.
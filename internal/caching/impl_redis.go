@@ -0,0 +1,285 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// RedisCachePartition stores the entries of a cache on a Redis server, so
+// that they are shared between processes. The values are stored as JSON.
+type RedisCachePartition[K keyable, V any] struct {
+	client *redisClient
+	Name   string
+	MaxAge time.Duration
+	// If set, used instead of JSON to store the values.
+	encode func(V) ([]byte, error)
+	decode func([]byte) (V, error)
+}
+
+func (c *RedisCachePartition[K, V]) key(key K) string {
+	return fmt.Sprintf("%s%s:%v", c.client.cfg.KeyPrefix, c.Name, key)
+}
+
+func (c *RedisCachePartition[K, V]) Get(key K) (value V, ok bool) {
+	data, err := c.client.get(c.key(key))
+	if err != nil {
+		logrus.WithError(err).WithField("cache", c.Name).Warn("Failed to get cache entry from Redis")
+		return value, false
+	}
+	if data == nil {
+		return value, false
+	}
+	if c.decode != nil {
+		value, err = c.decode(data)
+	} else {
+		err = json.Unmarshal(data, &value)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("cache", c.Name).Warn("Failed to decode cache entry from Redis")
+		var empty V
+		return empty, false
+	}
+	return value, true
+}
+
+func (c *RedisCachePartition[K, V]) Set(key K, value V) {
+	var data []byte
+	var err error
+	if c.encode != nil {
+		data, err = c.encode(value)
+	} else {
+		data, err = json.Marshal(value)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("cache", c.Name).Warn("Failed to encode cache entry for Redis")
+		return
+	}
+	if err = c.client.set(c.key(key), data, c.MaxAge); err != nil {
+		logrus.WithError(err).WithField("cache", c.Name).Warn("Failed to set cache entry in Redis")
+	}
+}
+
+func (c *RedisCachePartition[K, V]) Unset(key K) {
+	if err := c.client.del(c.key(key)); err != nil {
+		logrus.WithError(err).WithField("cache", c.Name).Warn("Failed to unset cache entry in Redis")
+	}
+}
+
+// encodeEvent and decodeEvent store events with their room version, which
+// is needed to parse them again.
+func encodeEvent(event *gomatrixserverlib.Event) ([]byte, error) {
+	return json.Marshal(event.Headered(event.Version()))
+}
+
+func decodeEvent(data []byte) (*gomatrixserverlib.Event, error) {
+	var event gomatrixserverlib.HeaderedEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	return event.Unwrap(), nil
+}
+
+// redisError is an error returned by the Redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisClient is a minimal client for the Redis protocol, supporting only
+// the commands needed for caching. Connections are reused.
+type redisClient struct {
+	cfg   *config.RedisCache
+	conns chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newRedisClient(cfg *config.RedisCache) (*redisClient, error) {
+	c := &redisClient{
+		cfg:   cfg,
+		conns: make(chan *redisConn, cfg.PoolSize),
+	}
+	if _, err := c.do("PING"); err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis at %s: %w", cfg.Address, err)
+	}
+	return c, nil
+}
+
+func (c *redisClient) get(key string) ([]byte, error) {
+	reply, err := c.do("GET", key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to GET: %v", reply)
+	}
+	return data, nil
+}
+
+func (c *redisClient) set(key string, value []byte, maxAge time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if maxAge > 0 {
+		args = append(args, "PX", strconv.FormatInt(maxAge.Milliseconds(), 10))
+	}
+	_, err := c.do(args...)
+	return err
+}
+
+func (c *redisClient) del(key string) error {
+	_, err := c.do("DEL", key)
+	return err
+}
+
+// do sends a command to the server and returns the reply, which is nil, an
+// int64, a []byte for strings or a []interface{} for arrays.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-c.conns:
+	default:
+		var err error
+		if conn, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := conn.do(c.cfg.Timeout, args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// The connection may be in an unknown state, so don't reuse it.
+		_ = conn.Close()
+		return nil, err
+	}
+	select {
+	case c.conns <- conn:
+	default:
+		_ = conn.Close()
+	}
+	return reply, err
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	netConn, err := net.DialTimeout("tcp", c.cfg.Address, c.cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{
+		Conn: netConn,
+		r:    bufio.NewReader(netConn),
+		w:    bufio.NewWriter(netConn),
+	}
+	if c.cfg.Password != "" {
+		if _, err = conn.do(c.cfg.Timeout, "AUTH", c.cfg.Password); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if c.cfg.Database != 0 {
+		if _, err = conn.do(c.cfg.Timeout, "SELECT", strconv.Itoa(c.cfg.Database)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if err := writeRedisCommand(c.w, args...); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.r)
+}
+
+// writeRedisCommand writes a command as an array of bulk strings.
+func writeRedisCommand(w *bufio.Writer, args ...string) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRedisReply reads a reply from the server. Errors sent by the server
+// are returned as a redisError.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, count)
+		for i := range replies {
+			if replies[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	default:
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeRedis is an in-memory server which speaks enough of the Redis
+// protocol for the cache.
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	data     map[string][]byte
+	expiry   map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{
+		listener: listener,
+		data:     map[string][]byte{},
+		expiry:   map[string]time.Time{},
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close() // nolint: errcheck
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		command, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		parts := command.([]interface{})
+		args := make([]string, len(parts))
+		for i, part := range parts {
+			args[i] = string(part.([]byte))
+		}
+		_, _ = w.WriteString(s.handle(args))
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedis) handle(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		data, ok := s.data[args[1]]
+		if expiry, ok := s.expiry[args[1]]; ok && time.Now().After(expiry) {
+			delete(s.data, args[1])
+			delete(s.expiry, args[1])
+			data = nil
+		}
+		if !ok || data == nil {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(data), data)
+	case "SET":
+		s.data[args[1]] = []byte(args[2])
+		delete(s.expiry, args[1])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			s.expiry[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		_, ok := s.data[args[1]]
+		delete(s.data, args[1])
+		delete(s.expiry, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func redisCacheConfig(address string) *config.Cache {
+	cfg := &config.Cache{}
+	cfg.Defaults(false)
+	cfg.Backend = config.CacheBackendRedis
+	cfg.Redis.Address = address
+	return cfg
+}
+
+func TestRedisCachesAreShared(t *testing.T) {
+	server := newFakeRedis(t)
+	cfg := redisCacheConfig(server.listener.Addr().String())
+	first, err := NewCaches(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewCaches(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Immutable caches
+	first.RoomServerRoomNIDs.Set("!room:test", types.RoomNID(5))
+	if nid, ok := second.RoomServerRoomNIDs.Get("!room:test"); !ok || nid != 5 {
+		t.Fatalf("expected room NID 5 from the other cache, got %d (%v)", nid, ok)
+	}
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON(
+		[]byte(`{"type":"m.room.create","state_key":"","sender":"@alice:test","room_id":"!room:test","event_id":"$create:test","content":{"creator":"@alice:test"}}`),
+		false, gomatrixserverlib.RoomVersionV1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.RoomServerEvents.Set(1, ev)
+	if got, ok := second.RoomServerEvents.Get(1); !ok || got.EventID() != ev.EventID() {
+		t.Fatalf("expected event %s from the other cache, got %v (%v)", ev.EventID(), got, ok)
+	}
+
+	// Mutable caches
+	keys := gomatrixserverlib.PublicKeyLookupResult{ValidUntilTS: 10}
+	first.ServerKeys.Set("test", keys)
+	if got, ok := second.ServerKeys.Get("test"); !ok || got.ValidUntilTS != 10 {
+		t.Fatalf("expected server keys from the other cache, got %v (%v)", got, ok)
+	}
+	second.ServerKeys.Unset("test")
+	if _, ok := first.ServerKeys.Get("test"); ok {
+		t.Fatalf("expected server keys to be removed by the other cache")
+	}
+}
+
+func TestRedisCacheMaxAge(t *testing.T) {
+	server := newFakeRedis(t)
+	cfg := redisCacheConfig(server.listener.Addr().String())
+	cfg.Caches = map[string]config.CacheOptions{
+		ServerKeysCacheName: {MaxAge: time.Millisecond * 50},
+	}
+	caches, err := NewCaches(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caches.ServerKeys.Set("test", gomatrixserverlib.PublicKeyLookupResult{})
+	if _, ok := caches.ServerKeys.Get("test"); !ok {
+		t.Fatalf("expected server keys to be cached")
+	}
+	time.Sleep(time.Millisecond * 100)
+	if _, ok := caches.ServerKeys.Get("test"); ok {
+		t.Fatalf("expected server keys to expire")
+	}
+}
+
+func TestUnknownCacheName(t *testing.T) {
+	cfg := &config.Cache{}
+	cfg.Defaults(false)
+	cfg.Caches = map[string]config.CacheOptions{"unknown": {}}
+	if _, err := NewCaches(cfg, false); err == nil {
+		t.Fatalf("expected an error for an unknown cache")
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	server, err := natsserver.NewServer(&natsserver.Options{
+		Host:   "127.0.0.1",
+		Port:   -1,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Start()
+	defer server.Shutdown()
+	if !server.ReadyForConnections(time.Second * 5) {
+		t.Fatal("NATS server not ready")
+	}
+
+	cfg := &config.Cache{}
+	cfg.Defaults(false)
+	var caches [2]*Caches
+	for i := range caches {
+		nc, err := nats.Connect(server.ClientURL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nc.Close()
+		if caches[i], err = NewCaches(cfg, false); err != nil {
+			t.Fatal(err)
+		}
+		if err = caches[i].StartInvalidation(nc, "CacheInvalidation"); err != nil {
+			t.Fatal(err)
+		}
+		if err = nc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setAndWait := func(c *Caches, validUntil gomatrixserverlib.Timestamp) {
+		c.ServerKeys.Set("test", gomatrixserverlib.PublicKeyLookupResult{ValidUntilTS: validUntil})
+		// ristretto sets entries asynchronously
+		for i := 0; i < 100; i++ {
+			if _, ok := c.ServerKeys.Get("test"); ok {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatalf("entry was not set")
+	}
+	setAndWait(caches[0], 10)
+	// Let the second cache receive the invalidation for the first entry
+	// before it sets its own.
+	time.Sleep(time.Millisecond * 100)
+	setAndWait(caches[1], 20)
+
+	// The second cache changed the entry, so the first cache must drop it.
+	for i := 0; i < 100; i++ {
+		if _, ok := caches[0].ServerKeys.Get("test"); !ok {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if _, ok := caches[0].ServerKeys.Get("test"); ok {
+		t.Fatalf("expected entry to be invalidated")
+	}
+	if got, ok := caches[1].ServerKeys.Get("test"); !ok || got.ValidUntilTS != 20 {
+		t.Fatalf("expected entry to be kept by the cache which set it, got %v (%v)", got, ok)
+	}
+}
@@ -22,9 +22,7 @@ import (
 
 	"github.com/dgraph-io/ristretto"
 	"github.com/dgraph-io/ristretto/z"
-	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
-	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -40,9 +38,26 @@ const (
 	spaceSummaryRoomsCache
 	lazyLoadingCache
 	eventStateKeyCache
+	pushRulesCache
+	pushRoomMembersCache
+	pushPowerLevelsCache
 )
 
+// NewRistrettoCache creates caches which are all stored in memory, sharing
+// one space of the given size.
 func NewRistrettoCache(maxCost config.DataUnit, maxAge time.Duration, enablePrometheus bool) *Caches {
+	caches, err := NewCaches(&config.Cache{
+		EstimatedMaxSize: maxCost,
+		MaxAge:           maxAge,
+		Backend:          config.CacheBackendRistretto,
+	}, enablePrometheus)
+	if err != nil {
+		panic(err)
+	}
+	return caches
+}
+
+func newRistretto(maxCost config.DataUnit, enablePrometheus bool) (*ristretto.Cache, error) {
 	cache, err := ristretto.NewCache(&ristretto.Config{
 		NumCounters: int64((maxCost / 1024) * 10), // 10 counters per 1KB data, affects bloom filter size
 		BufferItems: 64,                           // recommended by the ristretto godocs as a sane buffer size value
@@ -53,7 +68,7 @@ func NewRistrettoCache(maxCost config.DataUnit, maxAge time.Duration, enableProm
 		},
 	})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	if enablePrometheus {
 		promauto.NewGaugeFunc(prometheus.GaugeOpts{
@@ -71,69 +86,7 @@ func NewRistrettoCache(maxCost config.DataUnit, maxAge time.Duration, enableProm
 			return float64(cache.Metrics.CostAdded() - cache.Metrics.CostEvicted())
 		})
 	}
-	return &Caches{
-		RoomVersions: &RistrettoCachePartition[string, gomatrixserverlib.RoomVersion]{ // room ID -> room version
-			cache:  cache,
-			Prefix: roomVersionsCache,
-			MaxAge: maxAge,
-		},
-		ServerKeys: &RistrettoCachePartition[string, gomatrixserverlib.PublicKeyLookupResult]{ // server name -> server keys
-			cache:   cache,
-			Prefix:  serverKeysCache,
-			Mutable: true,
-			MaxAge:  maxAge,
-		},
-		RoomServerRoomNIDs: &RistrettoCachePartition[string, types.RoomNID]{ // room ID -> room NID
-			cache:  cache,
-			Prefix: roomNIDsCache,
-			MaxAge: maxAge,
-		},
-		RoomServerRoomIDs: &RistrettoCachePartition[types.RoomNID, string]{ // room NID -> room ID
-			cache:  cache,
-			Prefix: roomIDsCache,
-			MaxAge: maxAge,
-		},
-		RoomServerEvents: &RistrettoCostedCachePartition[int64, *gomatrixserverlib.Event]{ // event NID -> event
-			&RistrettoCachePartition[int64, *gomatrixserverlib.Event]{
-				cache:  cache,
-				Prefix: roomEventsCache,
-				MaxAge: maxAge,
-			},
-		},
-		RoomServerStateKeys: &RistrettoCachePartition[types.EventStateKeyNID, string]{ // event NID -> event state key
-			cache:  cache,
-			Prefix: eventStateKeyCache,
-			MaxAge: maxAge,
-		},
-		FederationPDUs: &RistrettoCostedCachePartition[int64, *gomatrixserverlib.HeaderedEvent]{ // queue NID -> PDU
-			&RistrettoCachePartition[int64, *gomatrixserverlib.HeaderedEvent]{
-				cache:   cache,
-				Prefix:  federationPDUsCache,
-				Mutable: true,
-				MaxAge:  lesserOf(time.Hour/2, maxAge),
-			},
-		},
-		FederationEDUs: &RistrettoCostedCachePartition[int64, *gomatrixserverlib.EDU]{ // queue NID -> EDU
-			&RistrettoCachePartition[int64, *gomatrixserverlib.EDU]{
-				cache:   cache,
-				Prefix:  federationEDUsCache,
-				Mutable: true,
-				MaxAge:  lesserOf(time.Hour/2, maxAge),
-			},
-		},
-		SpaceSummaryRooms: &RistrettoCachePartition[string, gomatrixserverlib.MSC2946SpacesResponse]{ // room ID -> space response
-			cache:   cache,
-			Prefix:  spaceSummaryRoomsCache,
-			Mutable: true,
-			MaxAge:  maxAge,
-		},
-		LazyLoading: &RistrettoCachePartition[lazyLoadingCacheKey, string]{ // composite key -> event ID
-			cache:   cache,
-			Prefix:  lazyLoadingCache,
-			Mutable: true,
-			MaxAge:  maxAge,
-		},
-	}
+	return cache, nil
 }
 
 type RistrettoCostedCachePartition[k keyable, v costable] struct {
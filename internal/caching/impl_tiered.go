@@ -0,0 +1,99 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TieredCache keeps entries in a local cache in front of a shared one, so
+// that entries which are used often don't have to be fetched from the shared
+// cache every time. It must only be used for immutable entries, since other
+// processes can't remove entries from the local cache.
+type TieredCache[K keyable, V any] struct {
+	Local  Cache[K, V]
+	Shared Cache[K, V]
+}
+
+func (c *TieredCache[K, V]) Get(key K) (value V, ok bool) {
+	if value, ok = c.Local.Get(key); ok {
+		return
+	}
+	if value, ok = c.Shared.Get(key); ok {
+		c.Local.Set(key, value)
+	}
+	return
+}
+
+func (c *TieredCache[K, V]) Set(key K, value V) {
+	c.Local.Set(key, value)
+	c.Shared.Set(key, value)
+}
+
+func (c *TieredCache[K, V]) Unset(key K) {
+	c.Local.Unset(key)
+	c.Shared.Unset(key)
+}
+
+var (
+	cacheHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "caching",
+			Name:      "hits_total",
+			Help:      "The number of cache lookups which found an entry",
+		},
+		[]string{"cache"},
+	)
+	cacheMisses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "caching",
+			Name:      "misses_total",
+			Help:      "The number of cache lookups which didn't find an entry",
+		},
+		[]string{"cache"},
+	)
+	registerCacheMetrics sync.Once
+)
+
+// InstrumentedCache counts the hits and misses of a cache.
+type InstrumentedCache[K keyable, V any] struct {
+	Cache[K, V]
+	hits   prometheus.Counter
+	misses prometheus.Counter
+}
+
+func newInstrumentedCache[K keyable, V any](name string, cache Cache[K, V]) *InstrumentedCache[K, V] {
+	registerCacheMetrics.Do(func() {
+		prometheus.MustRegister(cacheHits, cacheMisses)
+	})
+	return &InstrumentedCache[K, V]{
+		Cache:  cache,
+		hits:   cacheHits.WithLabelValues(name),
+		misses: cacheMisses.WithLabelValues(name),
+	}
+}
+
+func (c *InstrumentedCache[K, V]) Get(key K) (value V, ok bool) {
+	if value, ok = c.Cache.Get(key); ok {
+		c.hits.Inc()
+	} else {
+		c.misses.Inc()
+	}
+	return
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/matrix-org/util"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// cacheInvalidation is sent to the other processes when an entry in a cache
+// is changed or removed, so that they remove it from their caches too.
+type cacheInvalidation struct {
+	// The process which sent the invalidation, so that it can ignore it.
+	Origin string `json:"origin"`
+	Cache  string `json:"cache"`
+	Key    string `json:"key"`
+}
+
+// invalidator sends and receives invalidations for the mutable caches which
+// are shared between components but kept in memory, so that components in
+// other processes don't keep using entries which have changed.
+type invalidator struct {
+	origin  string
+	mu      sync.RWMutex
+	nc      *nats.Conn
+	subject string
+	// Functions which remove an entry from each cache, by cache name.
+	unset map[string]func(key string)
+}
+
+func newInvalidator() *invalidator {
+	return &invalidator{
+		origin: util.RandomString(16),
+		unset:  map[string]func(key string){},
+	}
+}
+
+func (i *invalidator) start(nc *nats.Conn, subject string) error {
+	if _, err := nc.Subscribe(subject, i.onMessage); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.nc, i.subject = nc, subject
+	return nil
+}
+
+func (i *invalidator) publish(cache, key string) {
+	i.mu.RLock()
+	nc, subject := i.nc, i.subject
+	i.mu.RUnlock()
+	if nc == nil {
+		return
+	}
+	data, err := json.Marshal(cacheInvalidation{
+		Origin: i.origin,
+		Cache:  cache,
+		Key:    key,
+	})
+	if err == nil {
+		err = nc.Publish(subject, data)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("cache", cache).Warn("Failed to send cache invalidation")
+	}
+}
+
+func (i *invalidator) onMessage(msg *nats.Msg) {
+	var invalidation cacheInvalidation
+	if err := json.Unmarshal(msg.Data, &invalidation); err != nil {
+		logrus.WithError(err).Warn("Failed to parse cache invalidation")
+		return
+	}
+	if invalidation.Origin == i.origin {
+		return
+	}
+	if unset, ok := i.unset[invalidation.Cache]; ok {
+		unset(invalidation.Key)
+	}
+}
+
+// InvalidatingCache tells the other processes to remove an entry from their
+// caches when it is changed or removed in this one.
+type InvalidatingCache[V any] struct {
+	Cache[string, V]
+	name        string
+	invalidator *invalidator
+}
+
+func newInvalidatingCache[V any](name string, cache Cache[string, V], invalidator *invalidator) *InvalidatingCache[V] {
+	invalidator.unset[name] = cache.Unset
+	return &InvalidatingCache[V]{
+		Cache:       cache,
+		name:        name,
+		invalidator: invalidator,
+	}
+}
+
+func (c *InvalidatingCache[V]) Set(key string, value V) {
+	c.Cache.Set(key, value)
+	c.invalidator.publish(c.name, key)
+}
+
+func (c *InvalidatingCache[V]) Unset(key string) {
+	c.Cache.Unset(key)
+	c.invalidator.publish(c.name, key)
+}
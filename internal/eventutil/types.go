@@ -32,6 +32,7 @@ type AccountData struct {
 	Type         string              `json:"type"`
 	ReadMarker   *ReadMarkerJSON     `json:"read_marker,omitempty"`   // optional
 	IgnoredUsers *types.IgnoredUsers `json:"ignored_users,omitempty"` // optional
+	Deleted      bool                `json:"deleted,omitempty"`       // true if the account data was removed
 }
 
 type ReadMarkerJSON struct {
@@ -53,6 +54,18 @@ type NotificationData struct {
 	// UnreadNotificationCount is the total number of unread
 	// notifications.
 	UnreadNotificationCount int `json:"unread_notification_count"`
+
+	// Threads holds the MSC3773 statistics for each thread in the
+	// room which has unread notifications, keyed by the thread root
+	// event ID. The counts above include the threads.
+	Threads map[string]ThreadNotificationData `json:"threads,omitempty"`
+}
+
+// ThreadNotificationData contains statistics about the notifications
+// in a thread.
+type ThreadNotificationData struct {
+	UnreadHighlightCount    int `json:"unread_highlight_count"`
+	UnreadNotificationCount int `json:"unread_notification_count"`
 }
 
 // ProfileResponse is a struct containing all known user profile data
@@ -13,7 +13,8 @@
 // limitations under the License.
 
 // Package hooks exposes places in Dendrite where custom code can be executed, useful for MSCs.
-// Hooks can only be run in monolith mode.
+// Hooks can only be run in monolith mode. Modules which need to reject events or other
+// actions should use the spamcheck package instead.
 package hooks
 
 import "sync"
@@ -15,6 +15,7 @@
 package httputil
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -22,10 +23,13 @@ import (
 	"net/http/httputil"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
@@ -33,6 +37,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	otbridge "go.opentelemetry.io/otel/bridge/opentracing"
 )
 
 // BasicAuth is used for authorization on /metrics handlers
@@ -53,8 +58,11 @@ func MakeAuthAPI(
 			logger.Debugf("VerifyUserFromRequest %s -> HTTP %d", req.RemoteAddr, err.Code)
 			return *err
 		}
-		// add the user ID to the logger
+		// add the user ID to the logger and the tracing span
 		logger = logger.WithField("user_id", device.UserID)
+		if span := opentracing.SpanFromContext(req.Context()); span != nil {
+			span.SetTag("user_id", device.UserID)
+		}
 		req = req.WithContext(util.ContextWithLogger(req.Context(), logger))
 		// add the user to Sentry, if enabled
 		hub := sentry.GetHubFromContext(req.Context())
@@ -83,6 +91,57 @@ func MakeAuthAPI(
 	return MakeExternalAPI(metricsName, h)
 }
 
+// MakeFedAPI makes an http.Handler that checks matrix federation authentication.
+// If wakeup isn't nil then it is called with the origin of each request, e.g.
+// to mark the origin as alive.
+func MakeFedAPI(
+	metricsName string,
+	serverName gomatrixserverlib.ServerName,
+	keyRing gomatrixserverlib.JSONVerifier,
+	wakeup func(ctx context.Context, origin gomatrixserverlib.ServerName),
+	f func(*http.Request, *gomatrixserverlib.FederationRequest, map[string]string) util.JSONResponse,
+) http.Handler {
+	h := func(req *http.Request) util.JSONResponse {
+		fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+			req, time.Now(), serverName, keyRing,
+		)
+		if fedReq == nil {
+			return errResp
+		}
+		// add the user to Sentry, if enabled
+		hub := sentry.GetHubFromContext(req.Context())
+		if hub != nil {
+			hub.Scope().SetTag("origin", string(fedReq.Origin()))
+			hub.Scope().SetTag("uri", fedReq.RequestURI())
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				if hub != nil {
+					hub.CaptureException(fmt.Errorf("%s panicked", req.URL.Path))
+				}
+				// re-panic to return the 500
+				panic(r)
+			}
+		}()
+		if wakeup != nil {
+			go wakeup(req.Context(), fedReq.Origin())
+		}
+		vars, err := URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.MatrixErrorResponse(400, "M_UNRECOGNISED", "badly encoded query params")
+		}
+
+		jsonRes := f(req, fedReq, vars)
+		// do not log 4xx as errors as they are client fails, not server fails
+		if hub != nil && jsonRes.Code >= 500 {
+			hub.Scope().SetExtra("response", jsonRes)
+			hub.CaptureException(fmt.Errorf("%s returned HTTP %d", req.URL.Path, jsonRes.Code))
+		}
+		return jsonRes
+	}
+	return MakeExternalAPI(metricsName, h)
+}
+
 // MakeExternalAPI turns a util.JSONRequestHandler function into an http.Handler.
 // This is used for APIs that are called from the internet.
 func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse) http.Handler {
@@ -135,16 +194,59 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 			}
 		}
 
-		span := opentracing.StartSpan(metricsName)
+		span := startServerSpan(metricsName, req, false)
 		defer span.Finish()
 		req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
-		h.ServeHTTP(nextWriter, req)
-
+		spanWriter := &spanResponseWriter{ResponseWriter: nextWriter, span: span}
+		h.ServeHTTP(spanWriter, req)
 	}
 
 	return http.HandlerFunc(withSpan)
 }
 
+// startServerSpan starts a tracing span for handling an HTTP request. If
+// the request is trusted, i.e. it came from another Dendrite component, and
+// carries a tracing context in its headers then the span continues that
+// trace. Otherwise the span starts a new trace, so that clients and other
+// servers can't decide which of our traces are sampled. The tracing context
+// of an untrusted request is only linked to, which the OpenTelemetry tracer
+// supports without it affecting sampling.
+func startServerSpan(operationName string, req *http.Request, trusted bool) opentracing.Span {
+	tracer := opentracing.GlobalTracer()
+	carrier := opentracing.HTTPHeadersCarrier(req.Header)
+	opts := []opentracing.StartSpanOption{ext.SpanKindRPCServer}
+	if _, linkable := tracer.(*otbridge.BridgeTracer); trusted || linkable {
+		if clientContext, err := tracer.Extract(opentracing.HTTPHeaders, carrier); err == nil {
+			if trusted {
+				// Set the RPC context.
+				opts = append(opts, opentracing.ChildOf(clientContext))
+			} else {
+				opts = append(opts, opentracing.FollowsFrom(clientContext))
+			}
+		}
+	}
+	span := tracer.StartSpan(operationName, opts...)
+	ext.HTTPMethod.Set(span, req.Method)
+	// Only the path, as the query may contain access tokens.
+	ext.HTTPUrl.Set(span, req.URL.Path)
+	return span
+}
+
+// spanResponseWriter records the status code of a response on the tracing
+// span of the request.
+type spanResponseWriter struct {
+	http.ResponseWriter
+	span opentracing.Span
+}
+
+func (w *spanResponseWriter) WriteHeader(code int) {
+	ext.HTTPStatusCode.Set(w.span, uint16(code))
+	if code >= 500 {
+		ext.Error.Set(w.span, true)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
 // MakeHTMLAPI adds Span metrics to the HTML Handler function
 // This is used to serve HTML alongside JSON error messages
 func MakeHTMLAPI(metricsName string, f func(http.ResponseWriter, *http.Request) *util.JSONResponse) http.Handler {
@@ -180,20 +282,10 @@ func MakeHTMLAPI(metricsName string, f func(http.ResponseWriter, *http.Request)
 func MakeInternalAPI(metricsName string, f func(*http.Request) util.JSONResponse) http.Handler {
 	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
-		carrier := opentracing.HTTPHeadersCarrier(req.Header)
-		tracer := opentracing.GlobalTracer()
-		clientContext, err := tracer.Extract(opentracing.HTTPHeaders, carrier)
-		var span opentracing.Span
-		if err == nil {
-			// Default to a span without RPC context.
-			span = tracer.StartSpan(metricsName)
-		} else {
-			// Set the RPC context.
-			span = tracer.StartSpan(metricsName, ext.RPCServerOption(clientContext))
-		}
+		span := startServerSpan(metricsName, req, true)
 		defer span.Finish()
 		req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
-		h.ServeHTTP(w, req)
+		h.ServeHTTP(&spanResponseWriter{ResponseWriter: w, span: span}, req)
 	}
 
 	return promhttp.InstrumentHandlerCounter(
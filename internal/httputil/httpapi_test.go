@@ -18,6 +18,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	otbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestWrapHandlerInBasicAuth(t *testing.T) {
@@ -107,3 +113,32 @@ func TestWrapHandlerInBasicAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestStartServerSpan(t *testing.T) {
+	// Nothing is sampled unless a trusted caller asks for it.
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.NeverSample())),
+	)
+	bridge, _ := otbridge.NewTracerPair(provider.Tracer("test"))
+	bridge.SetTextMapPropagator(propagation.TraceContext{})
+	previous := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(bridge)
+	t.Cleanup(func() { opentracing.SetGlobalTracer(previous) })
+
+	const remoteTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	for _, trusted := range []bool{true, false} {
+		exporter.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set("traceparent", "00-"+remoteTraceID+"-00f067aa0ba902b7-01")
+		startServerSpan("test", req, trusted).Finish()
+		spans := exporter.GetSpans()
+		switch {
+		case trusted && (len(spans) != 1 || spans[0].SpanContext.TraceID().String() != remoteTraceID):
+			t.Fatalf("expected a trusted request to continue the sampled trace, got %v", spans)
+		case !trusted && len(spans) != 0:
+			t.Fatalf("expected an untrusted request not to be able to force sampling, got %d spans", len(spans))
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// Headers which carry the parts of HTTP requests and responses to internal
+// APIs which aren't headers already when they are sent over NATS.
+const (
+	natsPathHeader     = "Dendrite-Path"
+	natsDeadlineHeader = "Dendrite-Deadline"
+	natsStatusHeader   = "Dendrite-Status"
+)
+
+// NATSTransport is a http.RoundTripper which sends requests to internal APIs
+// over NATS request-reply instead of HTTP, so that the internal API clients
+// can use either. The host of the request URL is the name of the component,
+// e.g. "nats://roomserver". All instances of a component share a queue
+// group, so NATS balances the requests between them, and a request fails
+// straight away if there aren't any running.
+type NATSTransport struct {
+	nc            *nats.Conn
+	subjectPrefix string
+}
+
+// NewNATSTransport returns a transport which sends requests on subjects
+// starting with the given prefix.
+func NewNATSTransport(nc *nats.Conn, subjectPrefix string) *NATSTransport {
+	return &NATSTransport{
+		nc:            nc,
+		subjectPrefix: subjectPrefix,
+	}
+}
+
+// InternalAPISubject returns the subject which the internal API of the
+// component is served on.
+func InternalAPISubject(subjectPrefix, component string) string {
+	return subjectPrefix + "." + component
+}
+
+// RoundTrip implements http.RoundTripper. The headers of the request, which
+// include the tracing span, and the deadline of its context are sent along
+// with the body.
+func (t *NATSTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	msg := nats.NewMsg(InternalAPISubject(t.subjectPrefix, req.URL.Host))
+	for name, values := range req.Header {
+		msg.Header[name] = values
+	}
+	msg.Header.Set(natsPathHeader, req.URL.RequestURI())
+	if deadline, ok := req.Context().Deadline(); ok {
+		msg.Header.Set(natsDeadlineHeader, deadline.Format(time.RFC3339Nano))
+	}
+	if req.Body != nil {
+		data, err := io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		msg.Data = data
+	}
+
+	reply, err := t.nc.RequestMsgWithContext(req.Context(), msg)
+	if errors.Is(err, nats.ErrNoResponders) {
+		return nil, fmt.Errorf("no instances of %s are serving requests over NATS", req.URL.Host)
+	} else if err != nil {
+		return nil, err
+	}
+	status, err := strconv.Atoi(reply.Header.Get(natsStatusHeader))
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply from %s: %w", req.URL.Host, err)
+	}
+	header := http.Header(reply.Header)
+	header.Del(natsStatusHeader)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(reply.Data)),
+		ContentLength: int64(len(reply.Data)),
+		Request:       req,
+	}, nil
+}
+
+// ServeNATS serves requests to the internal API of a component which are
+// sent by a NATSTransport, by passing them to the handler as if they had
+// been received over HTTP. Requests are handled concurrently and are
+// cancelled when ctx is done.
+func ServeNATS(ctx context.Context, nc *nats.Conn, subjectPrefix, component string, handler http.Handler) (*nats.Subscription, error) {
+	subject := InternalAPISubject(subjectPrefix, component)
+	return nc.QueueSubscribe(subject, subject, func(msg *nats.Msg) {
+		go serveNATSMsg(ctx, msg, handler)
+	})
+}
+
+func serveNATSMsg(ctx context.Context, msg *nats.Msg, handler http.Handler) {
+	var cancel context.CancelFunc
+	if deadline, err := time.Parse(time.RFC3339Nano, msg.Header.Get(natsDeadlineHeader)); err == nil {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	w := &natsResponseWriter{header: http.Header{}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, msg.Header.Get(natsPathHeader), bytes.NewReader(msg.Data))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+	} else {
+		for name, values := range msg.Header {
+			if name != natsPathHeader && name != natsDeadlineHeader {
+				req.Header[name] = values
+			}
+		}
+		handler.ServeHTTP(w, req)
+	}
+
+	reply := nats.NewMsg(msg.Reply)
+	reply.Header = nats.Header(w.header)
+	reply.Header.Set(natsStatusHeader, strconv.Itoa(w.statusCode()))
+	reply.Data = w.body.Bytes()
+	if err = msg.RespondMsg(reply); err != nil {
+		logrus.WithError(err).WithField("path", msg.Header.Get(natsPathHeader)).Error("Failed to reply to internal API request over NATS")
+		// Let the caller know rather than leaving it to time out, e.g. if
+		// the response is larger than the maximum NATS payload.
+		reply = nats.NewMsg(msg.Reply)
+		reply.Header.Set(natsStatusHeader, strconv.Itoa(http.StatusInternalServerError))
+		reply.Data, _ = json.Marshal(map[string]string{"message": err.Error()})
+		_ = msg.RespondMsg(reply)
+	}
+}
+
+// natsResponseWriter collects the response to a request received over NATS.
+type natsResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *natsResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *natsResponseWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *natsResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *natsResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
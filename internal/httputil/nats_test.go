@@ -0,0 +1,140 @@
+package httputil
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/opentracing/opentracing-go"
+)
+
+func startNATS(t *testing.T) *natsserver.Server {
+	server, err := natsserver.NewServer(&natsserver.Options{
+		Host:   "127.0.0.1",
+		Port:   -1,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Start()
+	t.Cleanup(server.Shutdown)
+	if !server.ReadyForConnections(time.Second * 5) {
+		t.Fatal("NATS server not ready")
+	}
+	return server
+}
+
+func connectNATS(t *testing.T, server *natsserver.Server) *nats.Conn {
+	nc, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func TestNATSTransport(t *testing.T) {
+	server := startNATS(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type echo struct {
+		Instance    int    `json:"instance"`
+		Body        string `json:"body"`
+		Header      string `json:"header"`
+		HasDeadline bool   `json:"has_deadline"`
+	}
+	var mu sync.Mutex
+	served := map[int]int{}
+	for i := 0; i < 2; i++ {
+		instance := i
+		mux := http.NewServeMux()
+		mux.HandleFunc(InternalPathPrefix+"test/echo", func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			served[instance]++
+			mu.Unlock()
+			var body string
+			_ = json.NewDecoder(req.Body).Decode(&body)
+			_, hasDeadline := req.Context().Deadline()
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(echo{
+				Instance:    instance,
+				Body:        body,
+				Header:      req.Header.Get("X-Test"),
+				HasDeadline: hasDeadline,
+			})
+		})
+		mux.HandleFunc(InternalPathPrefix+"test/fail", func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"message":"it failed"}`))
+		})
+		nc := connectNATS(t, server)
+		if _, err := ServeNATS(ctx, nc, "Test.InternalAPI", "test", mux); err != nil {
+			t.Fatal(err)
+		}
+		if err := nc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := &http.Client{
+		Timeout:   time.Second * 5,
+		Transport: NewNATSTransport(connectNATS(t, server), "Test.InternalAPI"),
+	}
+	span := opentracing.StartSpan("test")
+	defer span.Finish()
+
+	for i := 0; i < 20; i++ {
+		var response echo
+		if err := PostJSON(ctx, span, client, "nats://test/test/echo", "hello", &response); err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		if response.Body != "hello" {
+			t.Fatalf("expected the request body to be echoed, got %q", response.Body)
+		}
+		if !response.HasDeadline {
+			t.Fatalf("expected the deadline to be sent with the request")
+		}
+	}
+	mu.Lock()
+	if served[0] == 0 || served[1] == 0 {
+		t.Fatalf("expected requests to be balanced between both instances, got %v", served)
+	}
+	mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodPost, "nats://test"+InternalPathPrefix+"test/echo", strings.NewReader(`"headers"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Test", "value")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close() // nolint: errcheck
+	var response echo
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/json" || response.Header != "value" {
+		t.Fatalf("expected the headers to be sent both ways, got %d %v %+v", res.StatusCode, res.Header, response)
+	}
+
+	err = PostJSON(ctx, span, client, "nats://test/test/fail", "hello", &response)
+	if err == nil || !strings.Contains(err.Error(), "500") || !strings.Contains(err.Error(), "it failed") {
+		t.Fatalf("expected the error to be returned, got %v", err)
+	}
+
+	err = PostJSON(ctx, span, client, "nats://missing/test/echo", "hello", &response)
+	if err == nil || !strings.Contains(err.Error(), "no instances of missing") {
+		t.Fatalf("expected an error as nothing serves the component, got %v", err)
+	}
+}
@@ -1,16 +1,33 @@
 package httputil
 
 import (
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/util"
 )
 
+// RateLimitAction is an action which has its own rate limit, configured in
+// the client_api.rate_limiting section.
+type RateLimitAction string
+
+const (
+	RateLimitLoginAddress RateLimitAction = "login_address"
+	RateLimitLoginAccount RateLimitAction = "login_account"
+	RateLimitRegistration RateLimitAction = "registration"
+	RateLimitMessage      RateLimitAction = "message"
+	RateLimitJoin         RateLimitAction = "join"
+	RateLimitInvite       RateLimitAction = "invite"
+	RateLimitMediaUpload  RateLimitAction = "media_upload"
+)
+
 type RateLimits struct {
 	limits           map[string]chan struct{}
 	limitsMutex      sync.RWMutex
@@ -19,32 +36,61 @@ type RateLimits struct {
 	requestThreshold int64
 	cooloffDuration  time.Duration
 	exemptUserIDs    map[string]struct{}
+	realIPHeader     string
+	trustedProxies   []*net.IPNet
+	actions          map[RateLimitAction]*TokenBucketLimiter
 }
 
-func NewRateLimits(cfg *config.RateLimiting) *RateLimits {
+func NewRateLimits(process *process.ProcessContext, cfg *config.RateLimiting) *RateLimits {
 	l := &RateLimits{
 		limits:           make(map[string]chan struct{}),
 		enabled:          cfg.Enabled,
 		requestThreshold: cfg.Threshold,
 		cooloffDuration:  time.Duration(cfg.CooloffMS) * time.Millisecond,
 		exemptUserIDs:    map[string]struct{}{},
+		realIPHeader:     cfg.RealIPHeader,
+		actions:          map[RateLimitAction]*TokenBucketLimiter{},
 	}
 	for _, userID := range cfg.ExemptUserIDs {
 		l.exemptUserIDs[userID] = struct{}{}
 	}
+	for _, proxy := range cfg.TrustedProxies {
+		if network, err := config.ParseTrustedProxy(proxy); err == nil {
+			l.trustedProxies = append(l.trustedProxies, network)
+		}
+	}
 	if l.enabled {
-		go l.clean()
+		for action, limit := range map[RateLimitAction]config.RateLimit{
+			RateLimitLoginAddress: cfg.LoginAddress,
+			RateLimitLoginAccount: cfg.LoginAccount,
+			RateLimitRegistration: cfg.Registration,
+			RateLimitMessage:      cfg.Message,
+			RateLimitJoin:         cfg.Join,
+			RateLimitInvite:       cfg.Invite,
+			RateLimitMediaUpload:  cfg.MediaUpload,
+		} {
+			l.actions[action] = NewTokenBucketLimiter(process, limit)
+		}
+	}
+	if l.enabled {
+		go l.clean(process)
 	}
 	return l
 }
 
-func (l *RateLimits) clean() {
+func (l *RateLimits) clean(process *process.ProcessContext) {
+	ticker := time.NewTicker(time.Second * 30)
+	defer ticker.Stop()
 	for {
 		// On a 30 second interval, we'll take an exclusive write
 		// lock of the entire map and see if any of the channels are
 		// empty. If they are then we will close and delete them,
 		// freeing up memory.
-		time.Sleep(time.Second * 30)
+		select {
+		case <-process.Context().Done():
+			return
+		case <-ticker.C:
+		}
 		l.cleanMutex.Lock()
 		l.limitsMutex.Lock()
 		for k, c := range l.limits {
@@ -71,28 +117,14 @@ func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSON
 	l.cleanMutex.RLock()
 	defer l.cleanMutex.RUnlock()
 
-	// First of all, work out if X-Forwarded-For was sent to us. If not
-	// then we'll just use the IP address of the caller.
 	var caller string
 	if device != nil {
-		switch device.AccountType {
-		case userapi.AccountTypeAdmin:
-			return nil // don't rate-limit server administrators
-		case userapi.AccountTypeAppService:
-			return nil // don't rate-limit appservice users
-		default:
-			if _, ok := l.exemptUserIDs[device.UserID]; ok {
-				// If the user is exempt from rate limiting then do nothing.
-				return nil
-			}
-			caller = device.UserID + device.ID
+		if l.isExempt(device) {
+			return nil
 		}
+		caller = device.UserID + device.ID
 	} else {
-		if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-			caller = forwardedFor
-		} else {
-			caller = req.RemoteAddr
-		}
+		caller = l.callerAddress(req)
 	}
 
 	// Look up the caller's channel, if they have one.
@@ -130,3 +162,95 @@ func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSON
 	}()
 	return nil
 }
+
+// LimitAction applies the rate limit for the given action. Requests from
+// devices are limited per user, and other requests per IP address.
+func (l *RateLimits) LimitAction(req *http.Request, device *userapi.Device, action RateLimitAction) *util.JSONResponse {
+	if !l.enabled {
+		return nil
+	}
+	if device != nil {
+		if l.isExempt(device) {
+			return nil
+		}
+		return l.actions[action].Limit(device.UserID, 1)
+	}
+	return l.actions[action].Limit(l.callerAddress(req), 1)
+}
+
+// LimitActionByKey applies the rate limit for the given action to an explicit
+// key, e.g. the account that a failed login attempt was for.
+func (l *RateLimits) LimitActionByKey(action RateLimitAction, key string) *util.JSONResponse {
+	if !l.enabled {
+		return nil
+	}
+	if _, ok := l.exemptUserIDs[key]; ok {
+		return nil
+	}
+	return l.actions[action].Limit(key, 1)
+}
+
+// CheckActionByKey returns the response that LimitActionByKey would, but
+// without counting the action, so that only some outcomes of it are limited.
+func (l *RateLimits) CheckActionByKey(action RateLimitAction, key string) *util.JSONResponse {
+	if !l.enabled {
+		return nil
+	}
+	if _, ok := l.exemptUserIDs[key]; ok {
+		return nil
+	}
+	return l.actions[action].CheckLimit(key, 1)
+}
+
+func (l *RateLimits) isExempt(device *userapi.Device) bool {
+	switch device.AccountType {
+	case userapi.AccountTypeAdmin:
+		return true // don't rate-limit server administrators
+	case userapi.AccountTypeAppService:
+		return true // don't rate-limit appservice users
+	default:
+		// If the user is exempt from rate limiting then do nothing.
+		_, ok := l.exemptUserIDs[device.UserID]
+		return ok
+	}
+}
+
+// callerAddress returns the IP address of the caller, without the port, so
+// that opening new connections doesn't get around the limits. The real IP
+// header is only used if the request came from a trusted proxy. Proxies
+// append the address they received the request from to the header, so it is
+// read from the right, skipping any trusted proxies, and the first address
+// left is the caller. Anything to the left of that was sent by the caller.
+func (l *RateLimits) callerAddress(req *http.Request) string {
+	remote := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		remote = host
+	}
+	if l.realIPHeader == "" || !l.isTrustedProxy(net.ParseIP(remote)) {
+		return remote
+	}
+	addresses := strings.Split(req.Header.Get(l.realIPHeader), ",")
+	for i := len(addresses) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(addresses[i]))
+		if ip == nil {
+			break
+		}
+		remote = ip.String()
+		if !l.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return remote
+}
+
+func (l *RateLimits) isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range l.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package httputil
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/util"
+)
+
+// TokenBucketLimiter gives each key, e.g. a user ID, IP address or server
+// name, a bucket of tokens which is refilled at a constant rate. A nil
+// TokenBucketLimiter allows everything.
+type TokenBucketLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	rate    float64 // tokens per second
+	burst   float64
+	now     func() time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewTokenBucketLimiter returns a limiter for the given config, or nil if
+// the limit is disabled. Unused buckets are cleaned up until the process
+// shuts down.
+func NewTokenBucketLimiter(process *process.ProcessContext, cfg config.RateLimit) *TokenBucketLimiter {
+	if cfg.PerSecond <= 0 || cfg.Burst <= 0 {
+		return nil
+	}
+	l := &TokenBucketLimiter{
+		buckets: map[string]*tokenBucket{},
+		rate:    cfg.PerSecond,
+		burst:   float64(cfg.Burst),
+		now:     time.Now,
+	}
+	go l.clean(process)
+	return l
+}
+
+func (l *TokenBucketLimiter) clean(process *process.ProcessContext) {
+	// Buckets which would have refilled completely are the same as buckets
+	// which don't exist, so we can delete them to free up memory.
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-process.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		l.mutex.Lock()
+		now := l.now()
+		for k, b := range l.buckets {
+			if now.Sub(b.updated) > refill {
+				delete(l.buckets, k)
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// Take tries to take n tokens from the bucket for the key. If there aren't
+// enough tokens, no tokens are taken and the time to wait before trying again
+// is returned. Requests for more tokens than the burst size are treated as
+// requests for the whole bucket.
+func (l *TokenBucketLimiter) Take(key string, n int) (bool, time.Duration) {
+	return l.take(key, n, true)
+}
+
+// Check reports whether n tokens could be taken from the bucket for the key,
+// like Take, but without taking them.
+func (l *TokenBucketLimiter) Check(key string, n int) (bool, time.Duration) {
+	return l.take(key, n, false)
+}
+
+func (l *TokenBucketLimiter) take(key string, n int, update bool) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	want := math.Min(float64(n), l.burst)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	tokens := l.burst
+	b, ok := l.buckets[key]
+	if ok {
+		elapsed := now.Sub(b.updated).Seconds()
+		tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+	}
+	if tokens < want {
+		wait := (want - tokens) / l.rate
+		return false, time.Duration(math.Ceil(wait * float64(time.Second)))
+	}
+	if update {
+		if !ok {
+			b = &tokenBucket{}
+			l.buckets[key] = b
+		}
+		b.tokens = tokens - want
+		b.updated = now
+	}
+	return true, 0
+}
+
+// Limit takes n tokens from the bucket for the key, returning a 429 response
+// with the time to wait before retrying if there aren't enough.
+func (l *TokenBucketLimiter) Limit(key string, n int) *util.JSONResponse {
+	return limitResponse(l.Take(key, n))
+}
+
+// CheckLimit is like Limit but doesn't take any tokens.
+func (l *TokenBucketLimiter) CheckLimit(key string, n int) *util.JSONResponse {
+	return limitResponse(l.Check(key, n))
+}
+
+func limitResponse(ok bool, retryAfter time.Duration) *util.JSONResponse {
+	if !ok {
+		return &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("You are sending too many requests too quickly!", retryAfter.Milliseconds()),
+		}
+	}
+	return nil
+}
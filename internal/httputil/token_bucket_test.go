@@ -0,0 +1,227 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	processCtx := process.NewProcessContext()
+	t.Cleanup(processCtx.ShutdownDendrite)
+	now := time.Unix(1000, 0)
+	l := NewTokenBucketLimiter(processCtx, config.RateLimit{PerSecond: 2, Burst: 3})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Take("a", 1); !ok {
+			t.Fatalf("request %d should have been allowed", i)
+		}
+	}
+	ok, retryAfter := l.Take("a", 1)
+	if ok {
+		t.Fatalf("request should have been limited")
+	}
+	if retryAfter != time.Millisecond*500 {
+		t.Fatalf("expected to retry after 500ms, got %s", retryAfter)
+	}
+	// Other keys have their own buckets.
+	if ok, _ = l.Take("b", 1); !ok {
+		t.Fatalf("request for another key should have been allowed")
+	}
+
+	// After a second, two more tokens are available.
+	now = now.Add(time.Second)
+	if ok, _ = l.Take("a", 2); !ok {
+		t.Fatalf("request should have been allowed after refill")
+	}
+	if ok, _ = l.Take("a", 1); ok {
+		t.Fatalf("request should have been limited after refill")
+	}
+
+	// Requests for more than the burst size need a full bucket.
+	now = now.Add(time.Second * 10)
+	if ok, _ = l.Take("a", 10); !ok {
+		t.Fatalf("large request should have been allowed with a full bucket")
+	}
+	if ok, _ = l.Take("a", 1); ok {
+		t.Fatalf("large request should have emptied the bucket")
+	}
+
+	// Checking doesn't take any tokens.
+	now = now.Add(time.Second * 10)
+	for i := 0; i < 5; i++ {
+		if ok, _ = l.Check("a", 3); !ok {
+			t.Fatalf("check %d should have been allowed with a full bucket", i)
+		}
+	}
+	if ok, _ = l.Take("a", 3); !ok {
+		t.Fatalf("request should have been allowed after checks")
+	}
+	if ok, retryAfter = l.Check("a", 1); ok || retryAfter != time.Millisecond*500 {
+		t.Fatalf("check should have been limited with a 500ms retry, got %v %s", ok, retryAfter)
+	}
+
+	var disabled *TokenBucketLimiter
+	if ok, _ = disabled.Take("a", 100); !ok {
+		t.Fatalf("nil limiter should allow everything")
+	}
+	if NewTokenBucketLimiter(processCtx, config.RateLimit{}) != nil {
+		t.Fatalf("limiter with no rate should be disabled")
+	}
+}
+
+func TestRateLimitsCheckActionByKey(t *testing.T) {
+	cfg := &config.RateLimiting{}
+	cfg.Defaults()
+	cfg.LoginAccount = config.RateLimit{PerSecond: 1, Burst: 2}
+	processCtx := process.NewProcessContext()
+	t.Cleanup(processCtx.ShutdownDendrite)
+	l := NewRateLimits(processCtx, cfg)
+
+	// Checking the limit doesn't count towards it.
+	for i := 0; i < 5; i++ {
+		if r := l.CheckActionByKey(RateLimitLoginAccount, "@alice:localhost"); r != nil {
+			t.Fatalf("check %d should have been allowed", i)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if r := l.LimitActionByKey(RateLimitLoginAccount, "@alice:localhost"); r != nil {
+			t.Fatalf("failed login %d should have been allowed", i)
+		}
+	}
+	r := l.CheckActionByKey(RateLimitLoginAccount, "@alice:localhost")
+	if r == nil || r.Code != http.StatusTooManyRequests {
+		t.Fatalf("check should have been limited after the bucket was emptied, got %+v", r)
+	}
+}
+
+func TestRateLimitsLimitAction(t *testing.T) {
+	cfg := &config.RateLimiting{}
+	cfg.Defaults()
+	cfg.Join = config.RateLimit{PerSecond: 1, Burst: 1}
+	cfg.ExemptUserIDs = []string{"@bot:localhost"}
+	processCtx := process.NewProcessContext()
+	t.Cleanup(processCtx.ShutdownDendrite)
+	l := NewRateLimits(processCtx, cfg)
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	alice := &userapi.Device{UserID: "@alice:localhost", ID: "ALICE1"}
+	if r := l.LimitAction(req, alice, RateLimitJoin); r != nil {
+		t.Fatalf("first join should have been allowed")
+	}
+	// A different device for the same user shares the same bucket.
+	alice2 := &userapi.Device{UserID: "@alice:localhost", ID: "ALICE2"}
+	r := l.LimitAction(req, alice2, RateLimitJoin)
+	if r == nil || r.Code != http.StatusTooManyRequests {
+		t.Fatalf("second join should have been limited, got %+v", r)
+	}
+	if e, ok := r.JSON.(*jsonerror.LimitExceededError); !ok || e.RetryAfterMS <= 0 {
+		t.Fatalf("expected retry_after_ms in response, got %+v", r.JSON)
+	}
+
+	bot := &userapi.Device{UserID: "@bot:localhost", ID: "BOT"}
+	admin := &userapi.Device{UserID: "@admin:localhost", ID: "ADMIN", AccountType: userapi.AccountTypeAdmin}
+	for i := 0; i < 5; i++ {
+		if r = l.LimitAction(req, bot, RateLimitJoin); r != nil {
+			t.Fatalf("exempt user should not have been limited")
+		}
+		if r = l.LimitAction(req, admin, RateLimitJoin); r != nil {
+			t.Fatalf("admin should not have been limited")
+		}
+	}
+
+	cfg.Enabled = false
+	if r = NewRateLimits(processCtx, cfg).LimitAction(req, alice, RateLimitJoin); r != nil {
+		t.Fatalf("disabled rate limiting should not limit")
+	}
+}
+
+func TestRateLimitsCallerAddress(t *testing.T) {
+	processCtx := process.NewProcessContext()
+	t.Cleanup(processCtx.ShutdownDendrite)
+	cfg := &config.RateLimiting{}
+	cfg.Defaults()
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 192.0.2.1")
+
+	// Headers sent by the client aren't trusted unless one is configured.
+	if got := NewRateLimits(processCtx, cfg).callerAddress(req); got != "192.0.2.1" {
+		t.Fatalf("expected the remote address, got %q", got)
+	}
+
+	// Or if the request didn't come from a trusted proxy.
+	cfg.RealIPHeader = "X-Forwarded-For"
+	cfg.TrustedProxies = []string{"203.0.113.0/24"}
+	if got := NewRateLimits(processCtx, cfg).callerAddress(req); got != "192.0.2.1" {
+		t.Fatalf("expected the remote address of an untrusted proxy, got %q", got)
+	}
+
+	cfg.TrustedProxies = []string{"192.0.2.1", "203.0.113.0/24"}
+	l := NewRateLimits(processCtx, cfg)
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := l.callerAddress(req); got != "198.51.100.1" {
+		t.Fatalf("expected the forwarded address, got %q", got)
+	}
+	// The client can send its own header with any addresses it likes, which
+	// the proxies then append to, so the leading entries can't be trusted.
+	req.Header.Set("X-Forwarded-For", "10.0.0.1, 198.51.100.1, 203.0.113.5")
+	if got := l.callerAddress(req); got != "198.51.100.1" {
+		t.Fatalf("expected the rightmost untrusted address, got %q", got)
+	}
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, not an address, 203.0.113.5")
+	if got := l.callerAddress(req); got != "203.0.113.5" {
+		t.Fatalf("expected addresses left of an invalid entry to be ignored, got %q", got)
+	}
+	req.Header.Del("X-Forwarded-For")
+	if got := l.callerAddress(req); got != "192.0.2.1" {
+		t.Fatalf("expected the remote address without a header, got %q", got)
+	}
+}
+
+func TestRateLimitsAddressLimits(t *testing.T) {
+	processCtx := process.NewProcessContext()
+	t.Cleanup(processCtx.ShutdownDendrite)
+	cfg := &config.RateLimiting{}
+	cfg.Defaults()
+	cfg.LoginAddress = config.RateLimit{PerSecond: 1, Burst: 1}
+
+	// Without a real IP header, callers are limited by their remote address.
+	l := NewRateLimits(processCtx, cfg)
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	if r := l.LimitAction(req, nil, RateLimitLoginAddress); r != nil {
+		t.Fatalf("first login should have been allowed")
+	}
+	if r := l.LimitAction(req, nil, RateLimitLoginAddress); r == nil {
+		t.Fatalf("second login should have been limited")
+	}
+	other := httptest.NewRequest(http.MethodPost, "/", nil)
+	other.RemoteAddr = "198.51.100.1:1234"
+	if r := l.LimitAction(other, nil, RateLimitLoginAddress); r != nil {
+		t.Fatalf("login from another address should have been allowed")
+	}
+
+	// With one, callers behind a trusted proxy are limited by their real address.
+	cfg.RealIPHeader = "X-Forwarded-For"
+	cfg.TrustedProxies = []string{"192.0.2.1"}
+	l = NewRateLimits(processCtx, cfg)
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	if r := l.LimitAction(req, nil, RateLimitLoginAddress); r != nil {
+		t.Fatalf("first login should have been allowed")
+	}
+	if r := l.LimitAction(req, nil, RateLimitLoginAddress); r == nil {
+		t.Fatalf("second login should have been limited")
+	}
+	req.Header.Set("X-Forwarded-For", "203.0.113.2")
+	if r := l.LimitAction(req, nil, RateLimitLoginAddress); r != nil {
+		t.Fatalf("login from another client behind the proxy should have been allowed")
+	}
+}
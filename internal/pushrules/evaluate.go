@@ -3,6 +3,7 @@ package pushrules
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -11,8 +12,9 @@ import (
 // A RuleSetEvaluator encapsulates context to evaluate an event
 // against a rule set.
 type RuleSetEvaluator struct {
-	ec      EvaluationContext
-	ruleSet []kindAndRules
+	ec       EvaluationContext
+	ruleSet  []kindAndRules
+	patterns map[string]*regexp.Regexp
 }
 
 // An EvaluationContext gives a RuleSetEvaluator access to the
@@ -40,20 +42,94 @@ type kindAndRules struct {
 // NewRuleSetEvaluator creates a new evaluator for the given rule set.
 func NewRuleSetEvaluator(ec EvaluationContext, ruleSet *RuleSet) *RuleSetEvaluator {
 	return &RuleSetEvaluator{
-		ec: ec,
-		ruleSet: []kindAndRules{
-			{OverrideKind, ruleSet.Override},
-			{ContentKind, ruleSet.Content},
-			{RoomKind, ruleSet.Room},
-			{SenderKind, ruleSet.Sender},
-			{UnderrideKind, ruleSet.Underride},
-		},
+		ec:      ec,
+		ruleSet: orderedRules(ruleSet),
+	}
+}
+
+func orderedRules(ruleSet *RuleSet) []kindAndRules {
+	return []kindAndRules{
+		{OverrideKind, ruleSet.Override},
+		{ContentKind, ruleSet.Content},
+		{RoomKind, ruleSet.Room},
+		{SenderKind, ruleSet.Sender},
+		{UnderrideKind, ruleSet.Underride},
+	}
+}
+
+// A CompiledRuleSet is a rule set with all of its glob patterns
+// already converted into regular expressions. It is immutable, so it
+// can be cached and shared until the user changes their rules.
+type CompiledRuleSet struct {
+	ruleSet  []kindAndRules
+	patterns map[string]*regexp.Regexp
+}
+
+// CompileRuleSet compiles the patterns in the given rule set.
+func CompileRuleSet(ruleSet *RuleSet) (*CompiledRuleSet, error) {
+	c := &CompiledRuleSet{
+		ruleSet:  orderedRules(ruleSet),
+		patterns: map[string]*regexp.Regexp{},
+	}
+	for _, rsat := range c.ruleSet {
+		for _, rule := range rsat.Rules {
+			if rsat.Kind == ContentKind {
+				if err := c.compile(rule.Pattern); err != nil {
+					return nil, fmt.Errorf("rule %q: %w", rule.RuleID, err)
+				}
+			}
+			for _, cond := range rule.Conditions {
+				if cond.Kind != EventMatchCondition {
+					continue
+				}
+				if err := c.compile(cond.Pattern); err != nil {
+					return nil, fmt.Errorf("rule %q: %w", rule.RuleID, err)
+				}
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *CompiledRuleSet) compile(pattern string) error {
+	if _, ok := c.patterns[pattern]; ok {
+		return nil
+	}
+	re, err := globToRegexp(pattern)
+	if err != nil {
+		return err
+	}
+	c.patterns[pattern] = re
+	return nil
+}
+
+// CacheCost returns a rough estimate of the memory used by the compiled
+// rule set, for the caches.
+func (c *CompiledRuleSet) CacheCost() int {
+	cost := 0
+	for _, rsat := range c.ruleSet {
+		cost += len(rsat.Rules) * 256
+	}
+	for pattern := range c.patterns {
+		cost += len(pattern) * 16
+	}
+	return cost
+}
+
+// Evaluator returns an evaluator for the compiled rule set using the
+// given context.
+func (c *CompiledRuleSet) Evaluator(ec EvaluationContext) *RuleSetEvaluator {
+	return &RuleSetEvaluator{
+		ec:       ec,
+		ruleSet:  c.ruleSet,
+		patterns: c.patterns,
 	}
 }
 
 // MatchEvent returns the first matching rule. Returns nil if there
 // was no match rule.
 func (rse *RuleSetEvaluator) MatchEvent(event *gomatrixserverlib.Event) (*Rule, error) {
+	m := newEventMatcher(event, rse.patterns)
 	// TODO: server-default rules have lower priority than user rules,
 	// but they are stored together with the user rules. It's a bit
 	// unclear what the specification (11.14.1.4 Predefined rules)
@@ -68,7 +144,7 @@ func (rse *RuleSetEvaluator) MatchEvent(event *gomatrixserverlib.Event) (*Rule,
 				if rule.Default != defRules {
 					continue
 				}
-				ok, err := ruleMatches(rule, rsat.Kind, event, rse.ec)
+				ok, err := m.ruleMatches(rule, rsat.Kind, rse.ec)
 				if err != nil {
 					return nil, err
 				}
@@ -83,7 +159,23 @@ func (rse *RuleSetEvaluator) MatchEvent(event *gomatrixserverlib.Event) (*Rule,
 	return nil, nil
 }
 
+// An eventMatcher matches rules against a single event. The event
+// JSON is only parsed once, however many patterns are checked.
+type eventMatcher struct {
+	event    *gomatrixserverlib.Event
+	patterns map[string]*regexp.Regexp
+	eventMap map[string]interface{}
+}
+
+func newEventMatcher(event *gomatrixserverlib.Event, patterns map[string]*regexp.Regexp) *eventMatcher {
+	return &eventMatcher{event: event, patterns: patterns}
+}
+
 func ruleMatches(rule *Rule, kind Kind, event *gomatrixserverlib.Event, ec EvaluationContext) (bool, error) {
+	return newEventMatcher(event, nil).ruleMatches(rule, kind, ec)
+}
+
+func (m *eventMatcher) ruleMatches(rule *Rule, kind Kind, ec EvaluationContext) (bool, error) {
 	if !rule.Enabled {
 		return false, nil
 	}
@@ -91,7 +183,7 @@ func ruleMatches(rule *Rule, kind Kind, event *gomatrixserverlib.Event, ec Evalu
 	switch kind {
 	case OverrideKind, UnderrideKind:
 		for _, cond := range rule.Conditions {
-			ok, err := conditionMatches(cond, event, ec)
+			ok, err := m.conditionMatches(cond, ec)
 			if err != nil {
 				return false, err
 			}
@@ -104,13 +196,13 @@ func ruleMatches(rule *Rule, kind Kind, event *gomatrixserverlib.Event, ec Evalu
 	case ContentKind:
 		// TODO: "These configure behaviour for (unencrypted) messages
 		// that match certain patterns." - Does that mean "content.body"?
-		return patternMatches("content.body", rule.Pattern, event)
+		return m.patternMatches("content.body", rule.Pattern)
 
 	case RoomKind:
-		return rule.RuleID == event.RoomID(), nil
+		return rule.RuleID == m.event.RoomID(), nil
 
 	case SenderKind:
-		return rule.RuleID == event.Sender(), nil
+		return rule.RuleID == m.event.Sender(), nil
 
 	default:
 		return false, nil
@@ -118,12 +210,16 @@ func ruleMatches(rule *Rule, kind Kind, event *gomatrixserverlib.Event, ec Evalu
 }
 
 func conditionMatches(cond *Condition, event *gomatrixserverlib.Event, ec EvaluationContext) (bool, error) {
+	return newEventMatcher(event, nil).conditionMatches(cond, ec)
+}
+
+func (m *eventMatcher) conditionMatches(cond *Condition, ec EvaluationContext) (bool, error) {
 	switch cond.Kind {
 	case EventMatchCondition:
-		return patternMatches(cond.Key, cond.Pattern, event)
+		return m.patternMatches(cond.Key, cond.Pattern)
 
 	case ContainsDisplayNameCondition:
-		return patternMatches("content.body", ec.UserDisplayName(), event)
+		return m.patternMatches("content.body", ec.UserDisplayName())
 
 	case RoomMemberCountCondition:
 		cmp, err := parseRoomMemberCountCondition(cond.Is)
@@ -137,7 +233,7 @@ func conditionMatches(cond *Condition, event *gomatrixserverlib.Event, ec Evalua
 		return cmp(n), nil
 
 	case SenderNotificationPermissionCondition:
-		return ec.HasPowerLevel(event.Sender(), cond.Key)
+		return ec.HasPowerLevel(m.event.Sender(), cond.Key)
 
 	default:
 		return false, nil
@@ -145,16 +241,24 @@ func conditionMatches(cond *Condition, event *gomatrixserverlib.Event, ec Evalua
 }
 
 func patternMatches(key, pattern string, event *gomatrixserverlib.Event) (bool, error) {
-	re, err := globToRegexp(pattern)
-	if err != nil {
-		return false, err
+	return newEventMatcher(event, nil).patternMatches(key, pattern)
+}
+
+func (m *eventMatcher) patternMatches(key, pattern string) (bool, error) {
+	re, ok := m.patterns[pattern]
+	if !ok {
+		var err error
+		if re, err = globToRegexp(pattern); err != nil {
+			return false, err
+		}
 	}
 
-	var eventMap map[string]interface{}
-	if err = json.Unmarshal(event.JSON(), &eventMap); err != nil {
-		return false, fmt.Errorf("parsing event: %w", err)
+	if m.eventMap == nil {
+		if err := json.Unmarshal(m.event.JSON(), &m.eventMap); err != nil {
+			return false, fmt.Errorf("parsing event: %w", err)
+		}
 	}
-	v, err := lookupMapPath(strings.Split(key, "."), eventMap)
+	v, err := lookupMapPath(strings.Split(key, "."), m.eventMap)
 	if err != nil {
 		// An unknown path is a benign error that shouldn't stop rule
 		// processing. It's just a non-match.
@@ -52,6 +52,63 @@ func TestRuleSetEvaluatorMatchEvent(t *testing.T) {
 	}
 }
 
+func TestCompiledRuleSetMatchEvent(t *testing.T) {
+	contentRule := &Rule{
+		RuleID:  "content",
+		Enabled: true,
+		Pattern: "hello*",
+	}
+	overrideRule := &Rule{
+		RuleID:  "override",
+		Enabled: true,
+		Conditions: []*Condition{
+			{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.message"},
+			{Kind: EventMatchCondition, Key: "content.msgtype", Pattern: "m.notice"},
+		},
+	}
+	ruleSet := &RuleSet{
+		Override: []*Rule{overrideRule},
+		Content:  []*Rule{contentRule},
+	}
+	compiled, err := CompileRuleSet(ruleSet)
+	if err != nil {
+		t.Fatalf("CompileRuleSet failed: %v", err)
+	}
+	if got, want := len(compiled.patterns), 3; got != want {
+		t.Errorf("patterns: got %d, want %d", got, want)
+	}
+
+	tsts := []struct {
+		Name      string
+		EventJSON string
+		Want      *Rule
+	}{
+		{"override", `{"type":"m.room.message","content":{"msgtype":"m.notice","body":"hello world"}}`, overrideRule},
+		{"content", `{"type":"m.room.message","content":{"msgtype":"m.text","body":"hello world"}}`, contentRule},
+		{"none", `{"type":"m.room.message","content":{"msgtype":"m.text","body":"goodbye"}}`, nil},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			ev := mustEventFromJSON(t, tst.EventJSON)
+			got, err := compiled.Evaluator(fakeEvaluationContext{}).MatchEvent(ev)
+			if err != nil {
+				t.Fatalf("MatchEvent failed: %v", err)
+			}
+			if diff := cmp.Diff(tst.Want, got); diff != "" {
+				t.Errorf("MatchEvent rule: +got -want:\n%s", diff)
+			}
+			// The compiled rule set must agree with the uncompiled one.
+			want, err := NewRuleSetEvaluator(fakeEvaluationContext{}, ruleSet).MatchEvent(ev)
+			if err != nil {
+				t.Fatalf("MatchEvent failed: %v", err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("MatchEvent rule: +compiled -uncompiled:\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestRuleMatches(t *testing.T) {
 	emptyRule := Rule{Enabled: true}
 	tsts := []struct {
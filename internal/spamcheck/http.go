@@ -0,0 +1,134 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spamcheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const defaultHTTPTimeout = time.Second * 5
+
+// HTTPChecker is a module which asks an external service for decisions by
+// POSTing JSON to <url>/<check>, e.g. <url>/check_event. The service should
+// respond with a JSON Result. A 404 response allows the action, so that a
+// service only needs to implement the checks that it cares about.
+type HTTPChecker struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPChecker creates an HTTPChecker from the module config.
+func NewHTTPChecker(cfg *config.SpamCheckerModule) (Checker, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("no URL configured")
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultHTTPTimeout
+	}
+	return &HTTPChecker{
+		url:    strings.TrimSuffix(cfg.URL, "/"),
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+type checkEventRequest struct {
+	Event       json.RawMessage               `json:"event"`
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	Origin      gomatrixserverlib.ServerName  `json:"origin,omitempty"`
+}
+
+type userMayInviteRequest struct {
+	InviterUserID string `json:"inviter"`
+	InviteeUserID string `json:"invitee"`
+	RoomID        string `json:"room_id"`
+}
+
+type userMayCreateRoomRequest struct {
+	UserID string `json:"user_id"`
+}
+
+func (h *HTTPChecker) CheckEvent(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, origin gomatrixserverlib.ServerName) (Result, error) {
+	return h.post(ctx, "check_event", checkEventRequest{
+		Event:       event.JSON(),
+		RoomVersion: event.RoomVersion,
+		Origin:      origin,
+	})
+}
+
+func (h *HTTPChecker) UserMayInvite(ctx context.Context, inviterUserID, inviteeUserID, roomID string) (Result, error) {
+	return h.post(ctx, "user_may_invite", userMayInviteRequest{
+		InviterUserID: inviterUserID,
+		InviteeUserID: inviteeUserID,
+		RoomID:        roomID,
+	})
+}
+
+func (h *HTTPChecker) UserMayCreateRoom(ctx context.Context, userID string) (Result, error) {
+	return h.post(ctx, "user_may_create_room", userMayCreateRoomRequest{
+		UserID: userID,
+	})
+}
+
+func (h *HTTPChecker) CheckRegistration(ctx context.Context, req *RegistrationRequest) (Result, error) {
+	return h.post(ctx, "check_registration", req)
+}
+
+func (h *HTTPChecker) CheckMediaUpload(ctx context.Context, req *MediaUploadRequest) (Result, error) {
+	return h.post(ctx, "check_media_upload", req)
+}
+
+func (h *HTTPChecker) post(ctx context.Context, check string, body interface{}) (Result, error) {
+	var res Result
+	data, err := json.Marshal(body)
+	if err != nil {
+		return res, fmt.Errorf("json.Marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url+"/"+check, bytes.NewReader(data))
+	if err != nil {
+		return res, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return res, fmt.Errorf("h.client.Do: %w", err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return Result{Decision: Allow}, nil
+	default:
+		return res, fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, check)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return res, fmt.Errorf("json.Decode: %w", err)
+	}
+	switch res.Decision {
+	case "", Allow, SoftFail, Reject:
+		return res, nil
+	default:
+		return res, fmt.Errorf("unknown decision %q from %s", res.Decision, check)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package spamcheck allows modules to reject or soft-fail events before they
+// are processed by the roomserver, and to block invites, room creation,
+// registrations and media uploads. Modules are loaded from the
+// global.spam_checker section of the config, so unlike hooks they also work
+// in polylith deployments, where each component loads its own modules.
+package spamcheck
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// Decision is the verdict of a spam checker.
+type Decision string
+
+const (
+	// Allow lets the action go ahead.
+	Allow Decision = "allow"
+	// SoftFail stores an event but doesn't add it to the room state or send
+	// it to clients. For actions other than events it behaves like Reject.
+	SoftFail Decision = "soft_fail"
+	// Reject refuses the action. Events from other servers are soft-failed
+	// instead, as other servers may already have accepted them.
+	Reject Decision = "reject"
+)
+
+// Result is returned by a spam checker for every action it is asked about.
+type Result struct {
+	Decision Decision `json:"decision"`
+	// An optional human-readable reason, which may be shown to the user.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Allowed returns true if the action should go ahead. An empty decision is
+// treated as allowing the action.
+func (r Result) Allowed() bool {
+	return r.Decision == "" || r.Decision == Allow
+}
+
+// RegistrationRequest describes an attempt to register a new account.
+type RegistrationRequest struct {
+	Localpart  string `json:"localpart"`
+	IsGuest    bool   `json:"is_guest"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+// MediaUploadRequest describes an attempt by a local user to upload media.
+type MediaUploadRequest struct {
+	UserID      string `json:"user_id"`
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename,omitempty"`
+	Size        int64  `json:"size"`
+}
+
+// Checker is implemented by spam checker modules.
+type Checker interface {
+	// CheckEvent is called for every new event, including events received over
+	// federation, once the roomserver has parsed it and knows it's not a
+	// duplicate. It is called before the event's auth events or missing state
+	// are fetched, so it may see events which then fail the auth checks.
+	CheckEvent(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, origin gomatrixserverlib.ServerName) (Result, error)
+	// UserMayInvite is called for invites sent by or to local users.
+	UserMayInvite(ctx context.Context, inviterUserID, inviteeUserID, roomID string) (Result, error)
+	// UserMayCreateRoom is called when a local user tries to create a room.
+	UserMayCreateRoom(ctx context.Context, userID string) (Result, error)
+	// CheckRegistration is called before a new account is registered.
+	CheckRegistration(ctx context.Context, req *RegistrationRequest) (Result, error)
+	// CheckMediaUpload is called before media uploaded by a local user is stored.
+	CheckMediaUpload(ctx context.Context, req *MediaUploadRequest) (Result, error)
+}
+
+// Constructor creates a module from its config.
+type Constructor func(cfg *config.SpamCheckerModule) (Checker, error)
+
+var (
+	constructors   = map[string]Constructor{}
+	constructorsMu sync.Mutex
+)
+
+func init() {
+	Register("http", NewHTTPChecker)
+}
+
+// Register makes a module type available to the spam_checker config. It is
+// intended to be called from the init function of packages which are compiled
+// into Dendrite, and panics if the module type is already registered.
+func Register(moduleType string, constructor Constructor) {
+	constructorsMu.Lock()
+	defer constructorsMu.Unlock()
+	if _, ok := constructors[moduleType]; ok {
+		panic(fmt.Sprintf("spamcheck: module type %q is already registered", moduleType))
+	}
+	constructors[moduleType] = constructor
+}
+
+type module struct {
+	Checker
+	moduleType string
+	failOpen   bool
+}
+
+// Modules runs a list of spam checkers in order. It implements Checker, and
+// never returns an error: modules which fail are treated as allowing or
+// rejecting the action depending on their fail_open setting. A nil Modules
+// allows everything.
+type Modules struct {
+	modules []module
+}
+
+// New loads the modules listed in the config. An empty config results in
+// a Modules which allows everything.
+func New(cfg *config.SpamChecker) (*Modules, error) {
+	m := &Modules{}
+	for i := range cfg.Modules {
+		moduleCfg := &cfg.Modules[i]
+		constructorsMu.Lock()
+		constructor, ok := constructors[moduleCfg.Type]
+		constructorsMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown spam checker module type %q", moduleCfg.Type)
+		}
+		checker, err := constructor(moduleCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load spam checker module %q: %w", moduleCfg.Type, err)
+		}
+		m.modules = append(m.modules, module{
+			Checker:    checker,
+			moduleType: moduleCfg.Type,
+			failOpen:   moduleCfg.FailOpen,
+		})
+	}
+	return m, nil
+}
+
+// Add appends a module which was created in code rather than from the config.
+func (m *Modules) Add(checker Checker, failOpen bool) {
+	m.modules = append(m.modules, module{
+		Checker:    checker,
+		moduleType: fmt.Sprintf("%T", checker),
+		failOpen:   failOpen,
+	})
+}
+
+func (m *Modules) run(ctx context.Context, check string, fn func(c Checker) (Result, error)) (Result, error) {
+	if m == nil {
+		return Result{Decision: Allow}, nil
+	}
+	for _, mod := range m.modules {
+		res, err := fn(mod.Checker)
+		if err != nil {
+			logger := logrus.WithContext(ctx).WithError(err).WithFields(logrus.Fields{
+				"module": mod.moduleType,
+				"check":  check,
+			})
+			if mod.failOpen {
+				logger.Warn("Spam checker failed, allowing action")
+				continue
+			}
+			logger.Error("Spam checker failed, rejecting action")
+			return Result{Decision: Reject, Reason: "Unable to check for spam"}, nil
+		}
+		if !res.Allowed() {
+			return res, nil
+		}
+	}
+	return Result{Decision: Allow}, nil
+}
+
+func (m *Modules) CheckEvent(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, origin gomatrixserverlib.ServerName) (Result, error) {
+	return m.run(ctx, "check_event", func(c Checker) (Result, error) {
+		return c.CheckEvent(ctx, event, origin)
+	})
+}
+
+func (m *Modules) UserMayInvite(ctx context.Context, inviterUserID, inviteeUserID, roomID string) (Result, error) {
+	return m.run(ctx, "user_may_invite", func(c Checker) (Result, error) {
+		return c.UserMayInvite(ctx, inviterUserID, inviteeUserID, roomID)
+	})
+}
+
+func (m *Modules) UserMayCreateRoom(ctx context.Context, userID string) (Result, error) {
+	return m.run(ctx, "user_may_create_room", func(c Checker) (Result, error) {
+		return c.UserMayCreateRoom(ctx, userID)
+	})
+}
+
+func (m *Modules) CheckRegistration(ctx context.Context, req *RegistrationRequest) (Result, error) {
+	return m.run(ctx, "check_registration", func(c Checker) (Result, error) {
+		return c.CheckRegistration(ctx, req)
+	})
+}
+
+func (m *Modules) CheckMediaUpload(ctx context.Context, req *MediaUploadRequest) (Result, error) {
+	return m.run(ctx, "check_media_upload", func(c Checker) (Result, error) {
+		return c.CheckMediaUpload(ctx, req)
+	})
+}
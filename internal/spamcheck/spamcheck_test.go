@@ -0,0 +1,164 @@
+package spamcheck
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type fakeChecker struct {
+	res Result
+	err error
+}
+
+func (f *fakeChecker) CheckEvent(context.Context, *gomatrixserverlib.HeaderedEvent, gomatrixserverlib.ServerName) (Result, error) {
+	return f.res, f.err
+}
+
+func (f *fakeChecker) UserMayInvite(context.Context, string, string, string) (Result, error) {
+	return f.res, f.err
+}
+
+func (f *fakeChecker) UserMayCreateRoom(context.Context, string) (Result, error) {
+	return f.res, f.err
+}
+
+func (f *fakeChecker) CheckRegistration(context.Context, *RegistrationRequest) (Result, error) {
+	return f.res, f.err
+}
+
+func (f *fakeChecker) CheckMediaUpload(context.Context, *MediaUploadRequest) (Result, error) {
+	return f.res, f.err
+}
+
+func TestModules(t *testing.T) {
+	ctx := context.Background()
+	failing := errors.New("unavailable")
+
+	tests := []struct {
+		name     string
+		checkers []*fakeChecker
+		failOpen bool
+		want     Decision
+	}{
+		{
+			name: "no modules",
+			want: Allow,
+		},
+		{
+			name:     "all allow",
+			checkers: []*fakeChecker{{res: Result{Decision: Allow}}, {}},
+			want:     Allow,
+		},
+		{
+			name:     "first rejection wins",
+			checkers: []*fakeChecker{{res: Result{Decision: Allow}}, {res: Result{Decision: SoftFail}}, {res: Result{Decision: Reject}}},
+			want:     SoftFail,
+		},
+		{
+			name:     "failing module rejects",
+			checkers: []*fakeChecker{{err: failing}},
+			want:     Reject,
+		},
+		{
+			name:     "failing module with fail_open allows",
+			checkers: []*fakeChecker{{err: failing}},
+			failOpen: true,
+			want:     Allow,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(&config.SpamChecker{})
+			if err != nil {
+				t.Fatalf("failed to create modules: %s", err)
+			}
+			for _, c := range tt.checkers {
+				m.Add(c, tt.failOpen)
+			}
+			res, err := m.UserMayCreateRoom(ctx, "@alice:localhost")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if res.Decision != tt.want {
+				t.Errorf("got decision %q, want %q", res.Decision, tt.want)
+			}
+		})
+	}
+
+	var nilModules *Modules
+	if res, _ := nilModules.CheckRegistration(ctx, &RegistrationRequest{}); !res.Allowed() {
+		t.Errorf("nil Modules should allow everything")
+	}
+}
+
+func TestNewUnknownModule(t *testing.T) {
+	_, err := New(&config.SpamChecker{
+		Modules: []config.SpamCheckerModule{{Type: "unknown"}},
+	})
+	if err == nil {
+		t.Fatalf("expected an error for an unknown module type")
+	}
+}
+
+func TestHTTPChecker(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user_may_invite":
+			var req userMayInviteRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if req.InviteeUserID == "@bob:localhost" {
+				_ = json.NewEncoder(w).Encode(Result{Decision: Reject, Reason: "no invites for bob"})
+				return
+			}
+			_ = json.NewEncoder(w).Encode(Result{Decision: Allow})
+		case "/check_registration":
+			_ = json.NewEncoder(w).Encode(Result{Decision: "maybe"})
+		case "/check_media_upload":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	m, err := New(&config.SpamChecker{
+		Modules: []config.SpamCheckerModule{{Type: "http", URL: srv.URL + "/"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create modules: %s", err)
+	}
+	ctx := context.Background()
+
+	res, _ := m.UserMayInvite(ctx, "@alice:localhost", "@bob:localhost", "!room:localhost")
+	if res.Decision != Reject || res.Reason != "no invites for bob" {
+		t.Errorf("expected invite to bob to be rejected, got %+v", res)
+	}
+	res, _ = m.UserMayInvite(ctx, "@alice:localhost", "@charlie:localhost", "!room:localhost")
+	if !res.Allowed() {
+		t.Errorf("expected invite to charlie to be allowed, got %+v", res)
+	}
+	// Checks which the service doesn't implement are allowed.
+	res, _ = m.UserMayCreateRoom(ctx, "@alice:localhost")
+	if !res.Allowed() {
+		t.Errorf("expected unimplemented check to be allowed, got %+v", res)
+	}
+	// Unknown decisions and server errors fail closed.
+	res, _ = m.CheckRegistration(ctx, &RegistrationRequest{Localpart: "alice"})
+	if res.Decision != Reject {
+		t.Errorf("expected unknown decision to be rejected, got %+v", res)
+	}
+	res, _ = m.CheckMediaUpload(ctx, &MediaUploadRequest{UserID: "@alice:localhost"})
+	if res.Decision != Reject {
+		t.Errorf("expected server error to be rejected, got %+v", res)
+	}
+}
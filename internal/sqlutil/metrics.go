@@ -0,0 +1,67 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	passwordRegexp = regexp.MustCompile(`password=\S*\s*`)
+	queryRegexp    = regexp.MustCompile(`\?.*$`)
+)
+
+// RegisterConnectionPoolMetrics exports the statistics of a database
+// connection pool, such as how many connections are open and how long
+// callers have waited for one, to Prometheus. The pool is labelled with
+// the connection string, without any credentials. If more than one pool
+// is opened with the same connection string then only the first one is
+// reported.
+func RegisterConnectionPoolMetrics(db *sql.DB, dbProperties *config.DatabaseOptions) {
+	name := PoolName(dbProperties)
+	err := prometheus.Register(collectors.NewDBStatsCollector(db, name))
+	if err != nil && !errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+		logrus.WithError(err).WithField("db_name", name).Warn("Failed to register database connection pool metrics")
+	}
+}
+
+// PoolName returns the connection string of a database without any
+// credentials or options, so that it can be used to identify the
+// database in logs and metrics.
+func PoolName(dbProperties *config.DatabaseOptions) string {
+	name := string(dbProperties.ConnectionString)
+	if scheme, rest, ok := strings.Cut(name, "://"); ok {
+		if u, err := url.Parse(name); err == nil {
+			return u.Scheme + "://" + u.Host + u.Path
+		}
+		// The URL couldn't be parsed, so drop everything up to the last
+		// "@", as the password may contain "@" too.
+		if i := strings.LastIndex(rest, "@"); i >= 0 {
+			rest = rest[i+1:]
+		}
+		return scheme + "://" + queryRegexp.ReplaceAllLiteralString(rest, "")
+	}
+	name = passwordRegexp.ReplaceAllLiteralString(name, "")
+	return queryRegexp.ReplaceAllLiteralString(name, "")
+}
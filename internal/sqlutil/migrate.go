@@ -36,7 +36,10 @@ const insertVersionSQL = "" +
 	"INSERT INTO db_migrations (version, time, dendrite_version)" +
 	" VALUES ($1, $2, $3)"
 
-const selectDBMigrationsSQL = "SELECT version FROM db_migrations"
+const deleteVersionSQL = "" +
+	"DELETE FROM db_migrations WHERE version = $1"
+
+const selectDBMigrationsSQL = "SELECT version, time, dendrite_version FROM db_migrations"
 
 // Migration defines a migration to be run.
 type Migration struct {
@@ -44,16 +47,48 @@ type Migration struct {
 	Version string
 	// Up defines the function to execute for an upgrade.
 	Up func(ctx context.Context, txn *sql.Tx) error
-	// Down defines the function to execute for a downgrade (not implemented yet).
+	// Down defines the function to execute for a downgrade, or nil if the
+	// migration can't be rolled back.
 	Down func(ctx context.Context, txn *sql.Tx) error
+	// UpWithoutTxn and DownWithoutTxn are used instead of Up and Down for
+	// statements which can't be executed in a transaction, such as CREATE
+	// INDEX CONCURRENTLY. They must be safe to execute more than once, as
+	// the migration is recorded after they have finished.
+	UpWithoutTxn   func(ctx context.Context, db *sql.DB) error
+	DownWithoutTxn func(ctx context.Context, db *sql.DB) error
+}
+
+// MigrationStatus describes whether a migration has been executed.
+type MigrationStatus struct {
+	Version  string
+	Executed bool
+	// When the migration was executed and by which Dendrite version, if it
+	// was executed.
+	ExecutedAt      string
+	DendriteVersion string
+	// Whether the migration can be rolled back.
+	Reversible bool
 }
 
-// Migrator
+// Migrator executes migrations in the order they were added, and rolls them
+// back in the reverse order. The storage packages list their migrations in
+// the order in which they were written, so that later ones can rely on the
+// earlier ones.
 type Migrator struct {
 	db              *sql.DB
 	migrations      []Migration
 	knownMigrations map[string]struct{}
 	mutex           *sync.Mutex
+	// If set, Up and DownTo execute the migrations in a transaction which
+	// is rolled back afterwards rather than committed.
+	DryRun bool
+}
+
+// migrationsQuerier is implemented by both *sql.DB and *sql.Tx, so that the
+// migrations table can be read in the transaction of a dry run.
+type migrationsQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
 }
 
 // NewMigrator creates a new DB migrator.
@@ -81,61 +116,247 @@ func (m *Migrator) AddMigrations(migrations ...Migration) {
 
 // Up executes all migrations in order they were added.
 func (m *Migrator) Up(ctx context.Context) error {
+	return m.withDryRun(ctx, m.up)
+}
+
+func (m *Migrator) up(ctx context.Context, dryRunTxn *sql.Tx) error {
 	var (
 		err             error
 		dendriteVersion = internal.VersionString()
 	)
 	// ensure there is a table for known migrations
-	executedMigrations, err := m.ExecutedMigrations(ctx)
+	executedMigrations, err := m.executedMigrations(ctx, m.querier(dryRunTxn))
 	if err != nil {
 		return fmt.Errorf("unable to create/get migrations: %w", err)
 	}
 
-	return WithTransaction(m.db, func(txn *sql.Tx) error {
+	var pending []Migration
+	for _, migration := range m.migrations {
+		// Skip migration if it was already executed
+		if _, ok := executedMigrations[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+
+	// The migrations are executed in one transaction, except for those which
+	// can't be, which are executed on their own between the others.
+	for len(pending) > 0 {
+		if migration := pending[0]; migration.UpWithoutTxn != nil {
+			if err = m.upWithoutTxn(ctx, migration, dendriteVersion); err != nil {
+				return err
+			}
+			pending = pending[1:]
+			continue
+		}
+		n := 1
+		for n < len(pending) && pending[n].UpWithoutTxn == nil {
+			n++
+		}
+		err = m.withTransaction(dryRunTxn, func(txn *sql.Tx) error {
+			for _, migration := range pending[:n] {
+				now := time.Now().UTC().Format(time.RFC3339)
+				logrus.Debugf("Executing database migration '%s'", migration.Version)
+				err = migration.Up(ctx, txn)
+				if err != nil {
+					return fmt.Errorf("unable to execute migration '%s': %w", migration.Version, err)
+				}
+				_, err = txn.ExecContext(ctx, insertVersionSQL,
+					migration.Version,
+					now,
+					dendriteVersion,
+				)
+				if err != nil {
+					return fmt.Errorf("unable to insert executed migrations: %w", err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		pending = pending[n:]
+	}
+	return nil
+}
+
+func (m *Migrator) upWithoutTxn(ctx context.Context, migration Migration, dendriteVersion string) error {
+	if m.DryRun {
+		return fmt.Errorf("migration '%s' can't be executed in a dry run, as it doesn't use a transaction", migration.Version)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	logrus.Debugf("Executing database migration '%s' outside of a transaction", migration.Version)
+	if err := migration.UpWithoutTxn(ctx, m.db); err != nil {
+		return fmt.Errorf("unable to execute migration '%s': %w", migration.Version, err)
+	}
+	if _, err := m.db.ExecContext(ctx, insertVersionSQL, migration.Version, now, dendriteVersion); err != nil {
+		return fmt.Errorf("unable to insert executed migrations: %w", err)
+	}
+	return nil
+}
+
+// DownTo rolls back all executed migrations which were added after the given
+// version, in the reverse of the order they were added. If version is empty,
+// all executed migrations are rolled back. Nothing is rolled back if any of
+// the migrations can't be.
+func (m *Migrator) DownTo(ctx context.Context, version string) error {
+	return m.withDryRun(ctx, func(ctx context.Context, dryRunTxn *sql.Tx) error {
+		return m.downTo(ctx, dryRunTxn, version)
+	})
+}
+
+func (m *Migrator) downTo(ctx context.Context, dryRunTxn *sql.Tx, version string) error {
+	target := -1
+	if version != "" {
 		for i := range m.migrations {
-			now := time.Now().UTC().Format(time.RFC3339)
-			migration := m.migrations[i]
-			logrus.Debugf("Executing database migration '%s'", migration.Version)
-			// Skip migration if it was already executed
-			if _, ok := executedMigrations[migration.Version]; ok {
-				continue
+			if m.migrations[i].Version == version {
+				target = i
+				break
 			}
-			err = migration.Up(ctx, txn)
-			if err != nil {
-				return fmt.Errorf("unable to execute migration '%s': %w", migration.Version, err)
+		}
+		if target == -1 {
+			return fmt.Errorf("unknown migration '%s'", version)
+		}
+	}
+	executedMigrations, err := m.executedMigrations(ctx, m.querier(dryRunTxn))
+	if err != nil {
+		return fmt.Errorf("unable to create/get migrations: %w", err)
+	}
+
+	var pending []Migration
+	for i := len(m.migrations) - 1; i > target; i-- {
+		migration := m.migrations[i]
+		if _, ok := executedMigrations[migration.Version]; !ok {
+			continue
+		}
+		if migration.Down == nil && migration.DownWithoutTxn == nil {
+			return fmt.Errorf("migration '%s' can't be rolled back", migration.Version)
+		}
+		pending = append(pending, migration)
+	}
+
+	// As with Up, the migrations which can't be rolled back in a transaction
+	// are rolled back on their own between the others.
+	for len(pending) > 0 {
+		if migration := pending[0]; migration.DownWithoutTxn != nil {
+			if err = m.downWithoutTxn(ctx, migration); err != nil {
+				return err
 			}
-			_, err = txn.ExecContext(ctx, insertVersionSQL,
-				migration.Version,
-				now,
-				dendriteVersion,
-			)
-			if err != nil {
-				return fmt.Errorf("unable to insert executed migrations: %w", err)
+			pending = pending[1:]
+			continue
+		}
+		n := 1
+		for n < len(pending) && pending[n].DownWithoutTxn == nil {
+			n++
+		}
+		err = m.withTransaction(dryRunTxn, func(txn *sql.Tx) error {
+			for _, migration := range pending[:n] {
+				logrus.Debugf("Rolling back database migration '%s'", migration.Version)
+				if err = migration.Down(ctx, txn); err != nil {
+					return fmt.Errorf("unable to roll back migration '%s': %w", migration.Version, err)
+				}
+				if _, err = txn.ExecContext(ctx, deleteVersionSQL, migration.Version); err != nil {
+					return fmt.Errorf("unable to delete executed migration: %w", err)
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		return nil
-	})
+		pending = pending[n:]
+	}
+	return nil
+}
+
+func (m *Migrator) downWithoutTxn(ctx context.Context, migration Migration) error {
+	if m.DryRun {
+		return fmt.Errorf("migration '%s' can't be rolled back in a dry run, as it doesn't use a transaction", migration.Version)
+	}
+	logrus.Debugf("Rolling back database migration '%s' outside of a transaction", migration.Version)
+	if err := migration.DownWithoutTxn(ctx, m.db); err != nil {
+		return fmt.Errorf("unable to roll back migration '%s': %w", migration.Version, err)
+	}
+	if _, err := m.db.ExecContext(ctx, deleteVersionSQL, migration.Version); err != nil {
+		return fmt.Errorf("unable to delete executed migration: %w", err)
+	}
+	return nil
+}
+
+// Status returns the status of each migration, in the order they were added.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	executed, err := m.executedMigrations(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		result[i] = executed[migration.Version]
+		result[i].Version = migration.Version
+		result[i].Reversible = migration.Down != nil || migration.DownWithoutTxn != nil
+	}
+	return result, nil
+}
+
+// withDryRun calls fn with a transaction which is rolled back afterwards if
+// this is a dry run, so that nothing is changed, not even the migrations
+// table being created, or with nil otherwise.
+func (m *Migrator) withDryRun(ctx context.Context, fn func(ctx context.Context, dryRunTxn *sql.Tx) error) error {
+	if !m.DryRun {
+		return fn(ctx, nil)
+	}
+	txn, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to begin transaction: %w", err)
+	}
+	defer txn.Rollback() // nolint: errcheck
+	return fn(ctx, txn)
+}
+
+func (m *Migrator) querier(dryRunTxn *sql.Tx) migrationsQuerier {
+	if dryRunTxn != nil {
+		return dryRunTxn
+	}
+	return m.db
+}
+
+func (m *Migrator) withTransaction(dryRunTxn *sql.Tx, fn func(txn *sql.Tx) error) error {
+	if dryRunTxn != nil {
+		return fn(dryRunTxn)
+	}
+	return WithTransaction(m.db, fn)
 }
 
 // ExecutedMigrations returns a map with already executed migrations in addition to creating the
 // migrations table, if it doesn't exist.
 func (m *Migrator) ExecutedMigrations(ctx context.Context) (map[string]struct{}, error) {
-	result := make(map[string]struct{})
-	_, err := m.db.ExecContext(ctx, createDBMigrationsSQL)
+	executed, err := m.executedMigrations(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]struct{}, len(executed))
+	for version := range executed {
+		result[version] = struct{}{}
+	}
+	return result, nil
+}
+
+func (m *Migrator) executedMigrations(ctx context.Context, q migrationsQuerier) (map[string]MigrationStatus, error) {
+	result := make(map[string]MigrationStatus)
+	_, err := q.ExecContext(ctx, createDBMigrationsSQL)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create db_migrations: %w", err)
 	}
-	rows, err := m.db.QueryContext(ctx, selectDBMigrationsSQL)
+	rows, err := q.QueryContext(ctx, selectDBMigrationsSQL)
 	if err != nil {
 		return nil, fmt.Errorf("unable to query db_migrations: %w", err)
 	}
 	defer internal.CloseAndLogIfError(ctx, rows, "ExecutedMigrations: rows.close() failed")
-	var version string
 	for rows.Next() {
-		if err = rows.Scan(&version); err != nil {
+		status := MigrationStatus{Executed: true}
+		if err = rows.Scan(&status.Version, &status.ExecutedAt, &status.DendriteVersion); err != nil {
 			return nil, fmt.Errorf("unable to scan version: %w", err)
 		}
-		result[version] = struct{}{}
+		result[status.Version] = status
 	}
 
 	return result, rows.Err()
@@ -110,3 +110,235 @@ func Test_migrations_Up(t *testing.T) {
 		})
 	}
 }
+
+func Test_migrations_UpDryRun(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		conStr, close := test.PrepareDBConnectionString(t, dbType)
+		defer close()
+		driverName := "sqlite3"
+		if dbType == test.DBTypePostgres {
+			driverName = "postgres"
+		}
+		db, err := sql.Open(driverName, conStr)
+		if err != nil {
+			t.Fatalf("unable to open database: %v", err)
+		}
+		m := sqlutil.NewMigrator(db)
+		m.AddMigrations(dummyMigrations...)
+		m.DryRun = true
+		if err = m.Up(ctx); err != nil {
+			t.Fatalf("Up() dry run error = %v", err)
+		}
+
+		// A dry run on a new database doesn't even create the migrations table.
+		for _, table := range []string{"db_migrations", "dummy"} {
+			if _, err = db.ExecContext(ctx, "SELECT * FROM "+table); err == nil {
+				t.Fatalf("expected %s not to exist after a dry run", table)
+			}
+		}
+	})
+}
+
+func Test_migrations_DownTo(t *testing.T) {
+	reversible := []sqlutil.Migration{
+		{
+			Version: "init",
+			Up: func(ctx context.Context, txn *sql.Tx) error {
+				_, err := txn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS dummy ( test TEXT );")
+				return err
+			},
+			Down: func(ctx context.Context, txn *sql.Tx) error {
+				_, err := txn.ExecContext(ctx, "DROP TABLE dummy;")
+				return err
+			},
+		},
+		{
+			Version: "v2",
+			Up: func(ctx context.Context, txn *sql.Tx) error {
+				_, err := txn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS dummy2 ( test TEXT );")
+				return err
+			},
+			Down: func(ctx context.Context, txn *sql.Tx) error {
+				_, err := txn.ExecContext(ctx, "DROP TABLE dummy2;")
+				return err
+			},
+		},
+		{
+			Version: "v3",
+			Up: func(ctx context.Context, txn *sql.Tx) error {
+				_, err := txn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS dummy3 ( test TEXT );")
+				return err
+			},
+			Down: func(ctx context.Context, txn *sql.Tx) error {
+				_, err := txn.ExecContext(ctx, "DROP TABLE dummy3;")
+				return err
+			},
+		},
+	}
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		conStr, close := test.PrepareDBConnectionString(t, dbType)
+		defer close()
+		driverName := "sqlite3"
+		if dbType == test.DBTypePostgres {
+			driverName = "postgres"
+		}
+		db, err := sql.Open(driverName, conStr)
+		if err != nil {
+			t.Fatalf("unable to open database: %v", err)
+		}
+		m := sqlutil.NewMigrator(db)
+		m.AddMigrations(reversible...)
+		if err = m.Up(ctx); err != nil {
+			t.Fatalf("Up() error = %v", err)
+		}
+
+		executed := func() map[string]struct{} {
+			result, err := m.ExecutedMigrations(ctx)
+			if err != nil {
+				t.Fatalf("unable to get executed migrations: %v", err)
+			}
+			return result
+		}
+
+		// A dry run doesn't change anything.
+		m.DryRun = true
+		if err = m.DownTo(ctx, ""); err != nil {
+			t.Fatalf("DownTo() dry run error = %v", err)
+		}
+		if got := executed(); len(got) != 3 {
+			t.Fatalf("expected all migrations to still be executed after a dry run, got %v", got)
+		}
+		m.DryRun = false
+
+		if err = m.DownTo(ctx, "unknown"); err == nil {
+			t.Fatalf("expected an error for an unknown version")
+		}
+
+		if err = m.DownTo(ctx, "init"); err != nil {
+			t.Fatalf("DownTo() error = %v", err)
+		}
+		want := map[string]struct{}{"init": {}}
+		if got := executed(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected: %+v, got %v", want, got)
+		}
+		if _, err = db.ExecContext(ctx, "SELECT * FROM dummy2"); err == nil {
+			t.Fatalf("expected dummy2 to be dropped")
+		}
+
+		status, err := m.Status(ctx)
+		if err != nil {
+			t.Fatalf("Status() error = %v", err)
+		}
+		if len(status) != 3 || !status[0].Executed || status[1].Executed || status[2].Executed || !status[2].Reversible {
+			t.Fatalf("unexpected status: %+v", status)
+		}
+
+		// Migrations which were rolled back can be executed again.
+		if err = m.Up(ctx); err != nil {
+			t.Fatalf("Up() error = %v", err)
+		}
+		if got := executed(); len(got) != 3 {
+			t.Fatalf("expected all migrations to be executed again, got %v", got)
+		}
+
+		// Nothing is rolled back if a migration can't be.
+		m.AddMigrations(sqlutil.Migration{
+			Version: "irreversible",
+			Up: func(ctx context.Context, txn *sql.Tx) error {
+				return nil
+			},
+		})
+		if err = m.Up(ctx); err != nil {
+			t.Fatalf("Up() error = %v", err)
+		}
+		if err = m.DownTo(ctx, ""); err == nil {
+			t.Fatalf("expected an error for an irreversible migration")
+		}
+		if got := executed(); len(got) != 4 {
+			t.Fatalf("expected nothing to be rolled back, got %v", got)
+		}
+	})
+}
+
+func Test_migrations_WithoutTxn(t *testing.T) {
+	migrations := []sqlutil.Migration{
+		dummyMigrations[0],
+		{
+			Version: "index",
+			UpWithoutTxn: func(ctx context.Context, db *sql.DB) error {
+				_, err := db.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS dummy_test_idx ON dummy (test);")
+				return err
+			},
+			DownWithoutTxn: func(ctx context.Context, db *sql.DB) error {
+				_, err := db.ExecContext(ctx, "DROP INDEX IF EXISTS dummy_test_idx;")
+				return err
+			},
+		},
+		{
+			Version: "v2",
+			Up: func(ctx context.Context, txn *sql.Tx) error {
+				_, err := txn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS dummy2 ( test TEXT );")
+				return err
+			},
+			Down: func(ctx context.Context, txn *sql.Tx) error {
+				_, err := txn.ExecContext(ctx, "DROP TABLE dummy2;")
+				return err
+			},
+		},
+	}
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		conStr, close := test.PrepareDBConnectionString(t, dbType)
+		defer close()
+		driverName := "sqlite3"
+		if dbType == test.DBTypePostgres {
+			driverName = "postgres"
+		}
+		db, err := sql.Open(driverName, conStr)
+		if err != nil {
+			t.Fatalf("unable to open database: %v", err)
+		}
+		m := sqlutil.NewMigrator(db)
+		m.AddMigrations(migrations...)
+
+		executed := func() map[string]struct{} {
+			result, err := m.ExecutedMigrations(ctx)
+			if err != nil {
+				t.Fatalf("unable to get executed migrations: %v", err)
+			}
+			return result
+		}
+
+		// Migrations without a transaction can't be rolled back, so a dry
+		// run fails when it gets to one.
+		m.DryRun = true
+		if err = m.Up(ctx); err == nil {
+			t.Fatalf("expected an error for a dry run of a migration without a transaction")
+		}
+		m.DryRun = false
+
+		if err = m.Up(ctx); err != nil {
+			t.Fatalf("Up() error = %v", err)
+		}
+		want := map[string]struct{}{"init": {}, "index": {}, "v2": {}}
+		if got := executed(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected: %+v, got %v", want, got)
+		}
+
+		if err = m.DownTo(ctx, "init"); err != nil {
+			t.Fatalf("DownTo() error = %v", err)
+		}
+		want = map[string]struct{}{"init": {}}
+		if got := executed(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected: %+v, got %v", want, got)
+		}
+		// The index was dropped, so it can be created again without IF NOT EXISTS.
+		if _, err = db.ExecContext(ctx, "CREATE INDEX dummy_test_idx ON dummy (test);"); err != nil {
+			t.Fatalf("expected the index to be dropped: %v", err)
+		}
+	})
+}
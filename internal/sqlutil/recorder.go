@@ -0,0 +1,68 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/ngrok/sqlmw"
+)
+
+// StatementRecorder is called with each statement which is executed, other
+// than queries.
+type StatementRecorder func(query string, args []driver.NamedValue)
+
+type statementRecorderKey struct{}
+
+// WithStatementRecorder returns a context which makes a database opened by
+// OpenRecordable call the recorder for each statement executed with it, e.g.
+// to show the statements executed by migrations in a dry run.
+func WithStatementRecorder(ctx context.Context, recorder StatementRecorder) context.Context {
+	return context.WithValue(ctx, statementRecorderKey{}, recorder)
+}
+
+// OpenRecordable opens a database like Open, but statements executed with a
+// context from WithStatementRecorder are passed to its recorder.
+func OpenRecordable(dbProperties *config.DatabaseOptions) (*sql.DB, error) {
+	return open(dbProperties, "-recordable")
+}
+
+type recordingInterceptor struct {
+	sqlmw.NullInterceptor
+}
+
+func (in *recordingInterceptor) ConnExecContext(ctx context.Context, conn driver.ExecerContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	result, err := conn.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		// Otherwise the statement is prepared and executed instead, so
+		// it will be recorded by StmtExecContext.
+		record(ctx, query, args)
+	}
+	return result, err
+}
+
+func (in *recordingInterceptor) StmtExecContext(ctx context.Context, stmt driver.StmtExecContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	record(ctx, query, args)
+	return stmt.ExecContext(ctx, args)
+}
+
+func record(ctx context.Context, query string, args []driver.NamedValue) {
+	if recorder, ok := ctx.Value(statementRecorderKey{}).(StatementRecorder); ok {
+		recorder(query, args)
+	}
+}
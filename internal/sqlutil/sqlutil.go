@@ -6,13 +6,25 @@ import (
 	"regexp"
 
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/opentracing/opentracing-go"
 	"github.com/sirupsen/logrus"
 )
 
 // Open opens a database specified by its database driver name and a driver-specific data source name,
 // usually consisting of at least a database name and connection information. Includes tracing driver
-// if DENDRITE_TRACE_SQL=1
+// if DENDRITE_TRACE_SQL=1, or a driver which adds tracing spans for statements if tracing is set up.
 func Open(dbProperties *config.DatabaseOptions, writer Writer) (*sql.DB, error) {
+	driverSuffix := ""
+	if tracingEnabled {
+		// install the wrapped driver
+		driverSuffix = "-trace"
+	} else if opentracing.IsGlobalTracerRegistered() {
+		driverSuffix = "-span"
+	}
+	return open(dbProperties, driverSuffix)
+}
+
+func open(dbProperties *config.DatabaseOptions, driverSuffix string) (*sql.DB, error) {
 	var err error
 	var driverName, dsn string
 	switch {
@@ -28,15 +40,12 @@ func Open(dbProperties *config.DatabaseOptions, writer Writer) (*sql.DB, error)
 	default:
 		return nil, fmt.Errorf("invalid database connection string %q", dbProperties.ConnectionString)
 	}
-	if tracingEnabled {
-		// install the wrapped driver
-		driverName += "-trace"
-	}
+	driverName += driverSuffix
 	db, err := sql.Open(driverName, dsn)
 	if err != nil {
 		return nil, err
 	}
-	if driverName != "sqlite3" {
+	if !dbProperties.ConnectionString.IsSQLite() {
 		logrus.WithFields(logrus.Fields{
 			"MaxOpenConns":    dbProperties.MaxOpenConns(),
 			"MaxIdleConns":    dbProperties.MaxIdleConns(),
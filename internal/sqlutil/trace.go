@@ -27,6 +27,8 @@ import (
 	"time"
 
 	"github.com/ngrok/sqlmw"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/sirupsen/logrus"
 )
 
@@ -80,6 +82,65 @@ func (in *traceInterceptor) RowsNext(c context.Context, rows driver.Rows, dest [
 	return err
 }
 
+// spanInterceptor adds a tracing span for each statement which is executed
+// as part of a trace, i.e. with a context which has a span.
+type spanInterceptor struct {
+	sqlmw.NullInterceptor
+}
+
+func (in *spanInterceptor) ConnExecContext(ctx context.Context, conn driver.ExecerContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	startedAt := time.Now()
+	result, err := conn.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		// Otherwise the statement is prepared and executed instead, so
+		// it will get a span from StmtExecContext.
+		finishSpan(ctx, startedAt, query, err)
+	}
+	return result, err
+}
+
+func (in *spanInterceptor) ConnQueryContext(ctx context.Context, conn driver.QueryerContext, query string, args []driver.NamedValue) (context.Context, driver.Rows, error) {
+	startedAt := time.Now()
+	rows, err := conn.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		finishSpan(ctx, startedAt, query, err)
+	}
+	return ctx, rows, err
+}
+
+func (in *spanInterceptor) StmtExecContext(ctx context.Context, stmt driver.StmtExecContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	startedAt := time.Now()
+	result, err := stmt.ExecContext(ctx, args)
+	finishSpan(ctx, startedAt, query, err)
+	return result, err
+}
+
+func (in *spanInterceptor) StmtQueryContext(ctx context.Context, stmt driver.StmtQueryContext, query string, args []driver.NamedValue) (context.Context, driver.Rows, error) {
+	startedAt := time.Now()
+	rows, err := stmt.QueryContext(ctx, args)
+	finishSpan(ctx, startedAt, query, err)
+	return ctx, rows, err
+}
+
+// finishSpan records a span for a statement, if it was executed as part of
+// a trace. The span is only started once the statement has finished, so that
+// statements which the driver skips don't get one.
+func finishSpan(ctx context.Context, startedAt time.Time, query string, err error) {
+	parent := opentracing.SpanFromContext(ctx)
+	if parent == nil {
+		return
+	}
+	span := opentracing.GlobalTracer().StartSpan(
+		"sql", opentracing.ChildOf(parent.Context()), opentracing.StartTime(startedAt),
+	)
+	ext.DBType.Set(span, "sql")
+	ext.DBStatement.Set(span, strings.TrimSpace(query))
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	span.Finish()
+}
+
 func trackGoID(query string) {
 	thisGoID := goid()
 	if _, ok := goidToWriter.Load(thisGoID); ok {
@@ -26,6 +26,10 @@ import (
 )
 
 func registerDrivers() {
+	sql.Register("postgres-recordable", sqlmw.Driver(&pq.Driver{}, new(recordingInterceptor)))
+	sql.Register("sqlite3-recordable", sqlmw.Driver(&sqlite.SQLiteDriver{}, new(recordingInterceptor)))
+	sql.Register("postgres-span", sqlmw.Driver(&pq.Driver{}, new(spanInterceptor)))
+	sql.Register("sqlite3-span", sqlmw.Driver(&sqlite.SQLiteDriver{}, new(spanInterceptor)))
 	if !tracingEnabled {
 		return
 	}
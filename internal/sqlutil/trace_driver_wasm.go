@@ -25,6 +25,8 @@ import (
 )
 
 func registerDrivers() {
+	sql.Register("sqlite3_js-recordable", sqlmw.Driver(&sqlitejs.SqliteJsDriver{}, new(recordingInterceptor)))
+	sql.Register("sqlite3_js-span", sqlmw.Driver(&sqlitejs.SqliteJsDriver{}, new(spanInterceptor)))
 	if !tracingEnabled {
 		return
 	}
@@ -69,10 +69,7 @@ func NewPostgresCrossSigningSigsTable(db *sql.DB) (tables.CrossSigningSigs, erro
 	}
 
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(sqlutil.Migration{
-		Version: "keyserver: cross signing signature indexes",
-		Up:      deltas.UpFixCrossSigningSignatureIndexes,
-	})
+	m.AddMigrations(deltas.FixCrossSigningSignatureIndexesMigration)
 	if err = m.Up(context.Background()); err != nil {
 		return nil, err
 	}
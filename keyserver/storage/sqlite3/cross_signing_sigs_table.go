@@ -67,10 +67,7 @@ func NewSqliteCrossSigningSigsTable(db *sql.DB) (tables.CrossSigningSigs, error)
 		return nil, err
 	}
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(sqlutil.Migration{
-		Version: "keyserver: cross signing signature indexes",
-		Up:      deltas.UpFixCrossSigningSignatureIndexes,
-	})
+	m.AddMigrations(deltas.FixCrossSigningSignatureIndexesMigration)
 	if err = m.Up(context.Background()); err != nil {
 		return nil, err
 	}
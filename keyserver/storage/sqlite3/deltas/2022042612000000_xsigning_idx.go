@@ -61,8 +61,8 @@ func DownFixCrossSigningSignatureIndexes(ctx context.Context, tx *sql.Tx) error
 
 		DROP TABLE keyserver_cross_signing_sigs;
 		ALTER TABLE keyserver_cross_signing_sigs_tmp RENAME TO keyserver_cross_signing_sigs;
-		
-		DELETE INDEX IF EXISTS keyserver_cross_signing_sigs_idx;
+
+		DROP INDEX IF EXISTS keyserver_cross_signing_sigs_idx;
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to execute downgrade: %w", err)
@@ -0,0 +1,38 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import "github.com/matrix-org/dendrite/internal/sqlutil"
+
+// RefactorKeyChangesMigration only applies to databases from before migrations
+// were tracked, so it is only executed when the old schema is found and isn't
+// listed in Migrations.
+var RefactorKeyChangesMigration = sqlutil.Migration{
+	Version: "keyserver: refactor key changes",
+	Up:      UpRefactorKeyChanges,
+	Down:    DownRefactorKeyChanges,
+}
+
+var (
+	FixCrossSigningSignatureIndexesMigration = sqlutil.Migration{
+		Version: "keyserver: cross signing signature indexes",
+		Up:      UpFixCrossSigningSignatureIndexes,
+		Down:    DownFixCrossSigningSignatureIndexes,
+	}
+)
+
+var Migrations = []sqlutil.Migration{
+	FixCrossSigningSignatureIndexesMigration,
+}
@@ -38,6 +38,7 @@ func AddPublicRoutes(
 	}
 
 	routing.Setup(
-		base.PublicMediaAPIMux, cfg, rateCfg, mediaDB, userAPI, client,
+		base.PublicMediaAPIMux, base.ProcessContext, cfg, rateCfg, mediaDB, userAPI, client,
+		base.SpamChecker,
 	)
 }
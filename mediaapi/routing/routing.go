@@ -21,9 +21,11 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -45,13 +47,15 @@ type configResponse struct {
 // nolint: gocyclo
 func Setup(
 	publicAPIMux *mux.Router,
+	process *process.ProcessContext,
 	cfg *config.MediaAPI,
 	rateLimit *config.RateLimiting,
 	db storage.Database,
 	userAPI userapi.MediaUserAPI,
 	client *gomatrixserverlib.Client,
+	spamChecker spamcheck.Checker,
 ) {
-	rateLimits := httputil.NewRateLimits(rateLimit)
+	rateLimits := httputil.NewRateLimits(process, rateLimit)
 
 	v3mux := publicAPIMux.PathPrefix("/{apiversion:(?:r0|v1|v3)}/").Subrouter()
 
@@ -65,7 +69,10 @@ func Setup(
 			if r := rateLimits.Limit(req, dev); r != nil {
 				return *r
 			}
-			return Upload(req, cfg, dev, db, activeThumbnailGeneration)
+			if r := rateLimits.LimitAction(req, dev, httputil.RateLimitMediaUpload); r != nil {
+				return *r
+			}
+			return Upload(req, cfg, dev, db, activeThumbnailGeneration, spamChecker)
 		},
 	)
 
@@ -27,6 +27,7 @@ import (
 	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
@@ -57,12 +58,33 @@ type uploadResponse struct {
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
 // TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
+func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration, spamChecker spamcheck.Checker) util.JSONResponse {
 	r, resErr := parseAndValidateRequest(req, cfg, dev)
 	if resErr != nil {
 		return *resErr
 	}
 
+	spamRes, err := spamChecker.CheckMediaUpload(req.Context(), &spamcheck.MediaUploadRequest{
+		UserID:      dev.UserID,
+		ContentType: string(r.MediaMetadata.ContentType),
+		Filename:    req.FormValue("filename"),
+		Size:        int64(r.MediaMetadata.FileSizeBytes),
+	})
+	if err != nil {
+		r.Logger.WithError(err).Error("spamChecker.CheckMediaUpload failed")
+		return jsonerror.InternalServerError()
+	}
+	if !spamRes.Allowed() {
+		msg := spamRes.Reason
+		if msg == "" {
+			msg = "This upload has been rejected"
+		}
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(msg),
+		}
+	}
+
 	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
 		return *resErr
 	}
@@ -97,6 +97,12 @@ type SyncRoomserverAPI interface {
 		req *PerformBackfillRequest,
 		res *PerformBackfillResponse,
 	) error
+
+	// QueryKnownRooms returns all of the rooms that the roomserver has events for.
+	QueryKnownRooms(ctx context.Context, req *QueryKnownRoomsRequest, res *QueryKnownRoomsResponse) error
+	// QueryRoomEvents returns the events in a room in the order that they were stored.
+	// This is used to rebuild the sync API.
+	QueryRoomEvents(ctx context.Context, req *QueryRoomEventsRequest, res *QueryRoomEventsResponse) error
 }
 
 type AppserviceRoomserverAPI interface {
@@ -134,6 +140,11 @@ type ClientRoomserverAPI interface {
 	QueryRoomVersionForRoom(ctx context.Context, req *QueryRoomVersionForRoomRequest, res *QueryRoomVersionForRoomResponse) error
 	QueryPublishedRooms(ctx context.Context, req *QueryPublishedRoomsRequest, res *QueryPublishedRoomsResponse) error
 	QueryRoomVersionCapabilities(ctx context.Context, req *QueryRoomVersionCapabilitiesRequest, res *QueryRoomVersionCapabilitiesResponse) error
+	// QueryAdminEventReports returns a page of event reports from the moderation queue.
+	QueryAdminEventReports(ctx context.Context, req *QueryAdminEventReportsRequest, res *QueryAdminEventReportsResponse) error
+	QueryAdminEventReport(ctx context.Context, req *QueryAdminEventReportRequest, res *QueryAdminEventReportResponse) error
+	// QueryAdminInputQueues returns how many input events are waiting to be processed for each room.
+	QueryAdminInputQueues(ctx context.Context, req *QueryAdminInputQueuesRequest, res *QueryAdminInputQueuesResponse) error
 
 	GetRoomIDForAlias(ctx context.Context, req *GetRoomIDForAliasRequest, res *GetRoomIDForAliasResponse) error
 	GetAliasesForRoomID(ctx context.Context, req *GetAliasesForRoomIDRequest, res *GetAliasesForRoomIDResponse) error
@@ -142,6 +153,13 @@ type ClientRoomserverAPI interface {
 	PerformRoomUpgrade(ctx context.Context, req *PerformRoomUpgradeRequest, resp *PerformRoomUpgradeResponse)
 	PerformAdminEvacuateRoom(ctx context.Context, req *PerformAdminEvacuateRoomRequest, res *PerformAdminEvacuateRoomResponse)
 	PerformAdminEvacuateUser(ctx context.Context, req *PerformAdminEvacuateUserRequest, res *PerformAdminEvacuateUserResponse)
+	PerformAdminResolveEventReport(ctx context.Context, req *PerformAdminResolveEventReportRequest, res *PerformAdminResolveEventReportResponse)
+	// PerformAdminCompactState merges duplicate state blocks and deletes unreferenced state
+	PerformAdminCompactState(ctx context.Context, req *PerformAdminCompactStateRequest, res *PerformAdminCompactStateResponse)
+	// PerformAdminCheckRoom checks the events and state of a room for inconsistencies
+	PerformAdminCheckRoom(ctx context.Context, req *PerformAdminCheckRoomRequest, res *PerformAdminCheckRoomResponse)
+	// PerformReportEvent stores a report of an event by a user who can see it
+	PerformReportEvent(ctx context.Context, req *PerformReportEventRequest, res *PerformReportEventResponse)
 	PerformPeek(ctx context.Context, req *PerformPeekRequest, res *PerformPeekResponse)
 	PerformUnpeek(ctx context.Context, req *PerformUnpeekRequest, res *PerformUnpeekResponse)
 	PerformInvite(ctx context.Context, req *PerformInviteRequest, res *PerformInviteResponse) error
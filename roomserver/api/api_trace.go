@@ -122,6 +122,42 @@ func (t *RoomserverInternalAPITrace) PerformAdminEvacuateUser(
 	util.GetLogger(ctx).Infof("PerformAdminEvacuateUser req=%+v res=%+v", js(req), js(res))
 }
 
+func (t *RoomserverInternalAPITrace) PerformAdminResolveEventReport(
+	ctx context.Context,
+	req *PerformAdminResolveEventReportRequest,
+	res *PerformAdminResolveEventReportResponse,
+) {
+	t.Impl.PerformAdminResolveEventReport(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformAdminResolveEventReport req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformAdminCompactState(
+	ctx context.Context,
+	req *PerformAdminCompactStateRequest,
+	res *PerformAdminCompactStateResponse,
+) {
+	t.Impl.PerformAdminCompactState(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformAdminCompactState req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformAdminCheckRoom(
+	ctx context.Context,
+	req *PerformAdminCheckRoomRequest,
+	res *PerformAdminCheckRoomResponse,
+) {
+	t.Impl.PerformAdminCheckRoom(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformAdminCheckRoom req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformReportEvent(
+	ctx context.Context,
+	req *PerformReportEventRequest,
+	res *PerformReportEventResponse,
+) {
+	t.Impl.PerformReportEvent(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformReportEvent req=%+v res=%+v", js(req), js(res))
+}
+
 func (t *RoomserverInternalAPITrace) PerformInboundPeek(
 	ctx context.Context,
 	req *PerformInboundPeekRequest,
@@ -142,6 +178,36 @@ func (t *RoomserverInternalAPITrace) QueryPublishedRooms(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) QueryAdminEventReports(
+	ctx context.Context,
+	req *QueryAdminEventReportsRequest,
+	res *QueryAdminEventReportsResponse,
+) error {
+	err := t.Impl.QueryAdminEventReports(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryAdminEventReports req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) QueryAdminEventReport(
+	ctx context.Context,
+	req *QueryAdminEventReportRequest,
+	res *QueryAdminEventReportResponse,
+) error {
+	err := t.Impl.QueryAdminEventReport(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryAdminEventReport req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) QueryAdminInputQueues(
+	ctx context.Context,
+	req *QueryAdminInputQueuesRequest,
+	res *QueryAdminInputQueuesResponse,
+) error {
+	err := t.Impl.QueryAdminInputQueues(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryAdminInputQueues req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryLatestEventsAndState(
 	ctx context.Context,
 	req *QueryLatestEventsAndStateRequest,
@@ -332,6 +398,20 @@ func (t *RoomserverInternalAPITrace) QueryBulkStateContent(ctx context.Context,
 	return err
 }
 
+// QueryKnownRooms returns all of the rooms that the roomserver has events for.
+func (t *RoomserverInternalAPITrace) QueryKnownRooms(ctx context.Context, req *QueryKnownRoomsRequest, res *QueryKnownRoomsResponse) error {
+	err := t.Impl.QueryKnownRooms(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryKnownRooms req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryRoomEvents returns the events in a room in the order that they were stored.
+func (t *RoomserverInternalAPITrace) QueryRoomEvents(ctx context.Context, req *QueryRoomEventsRequest, res *QueryRoomEventsResponse) error {
+	err := t.Impl.QueryRoomEvents(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRoomEvents req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 // QuerySharedUsers returns a list of users who share at least 1 room in common with the given user.
 func (t *RoomserverInternalAPITrace) QuerySharedUsers(ctx context.Context, req *QuerySharedUsersRequest, res *QuerySharedUsersResponse) error {
 	err := t.Impl.QuerySharedUsers(ctx, req, res)
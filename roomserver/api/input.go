@@ -16,6 +16,7 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -98,16 +99,25 @@ type InputRoomEventsRequest struct {
 	Asynchronous    bool             `json:"async"`
 }
 
+// ErrQueueFull is returned when an event sent to us by another server can't
+// be queued because too many events are already waiting to be processed for
+// the room. The other server should try again later.
+var ErrQueueFull = errors.New("too many events are queued for the room")
+
 // InputRoomEventsResponse is a response to InputRoomEvents
 type InputRoomEventsResponse struct {
 	ErrMsg     string // set if there was any error
 	NotAllowed bool   // true if an event in the input was not allowed.
+	QueueFull  bool   // true if an event couldn't be queued for input.
 }
 
 func (r *InputRoomEventsResponse) Err() error {
 	if r.ErrMsg == "" {
 		return nil
 	}
+	if r.QueueFull {
+		return fmt.Errorf("InputRoomEventsResponse: %w", ErrQueueFull)
+	}
 	if r.NotAllowed {
 		return &gomatrixserverlib.NotAllowed{
 			Message: r.ErrMsg,
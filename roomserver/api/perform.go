@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
@@ -224,6 +225,41 @@ type PerformAdminEvacuateRoomResponse struct {
 	Error    *PerformError
 }
 
+type PerformAdminResolveEventReportRequest struct {
+	ReportID int64  `json:"report_id"`
+	UserID   string `json:"user_id"`
+}
+
+type PerformAdminResolveEventReportResponse struct {
+	Error *PerformError
+}
+
+// PerformAdminCompactStateRequest is a request to PerformAdminCompactState.
+// Unreferenced state is deleted after the grace period configured in
+// room_server.state_compaction.
+type PerformAdminCompactStateRequest struct {
+}
+
+type PerformAdminCompactStateResponse struct {
+	Report *types.StateCompactionReport `json:"report"`
+	// If non-nil, the compaction failed, or one was already running.
+	Error *PerformError
+}
+
+// PerformAdminCheckRoomRequest is a request to PerformAdminCheckRoom.
+type PerformAdminCheckRoomRequest struct {
+	RoomID string `json:"room_id"`
+	// If true, recalculate the forward extremities and current state of
+	// the room if they are wrong.
+	Repair bool `json:"repair"`
+}
+
+type PerformAdminCheckRoomResponse struct {
+	Report *types.RoomCheckReport `json:"report"`
+	// If non-nil, the room doesn't exist or couldn't be checked.
+	Error *PerformError
+}
+
 type PerformAdminEvacuateUserRequest struct {
 	UserID string `json:"user_id"`
 }
@@ -232,3 +268,19 @@ type PerformAdminEvacuateUserResponse struct {
 	Affected []string `json:"affected"`
 	Error    *PerformError
 }
+
+// PerformReportEventRequest is a request to PerformReportEvent
+type PerformReportEventRequest struct {
+	RoomID  string `json:"room_id"`
+	EventID string `json:"event_id"`
+	UserID  string `json:"user_id"`
+	Reason  string `json:"reason"`
+	Score   int64  `json:"score"`
+}
+
+type PerformReportEventResponse struct {
+	// The stored report.
+	Report *types.EventReport `json:"report"`
+	// If non-nil, the report failed. Contains more information why it failed.
+	Error *PerformError
+}
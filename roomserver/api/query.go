@@ -22,6 +22,7 @@ import (
 	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -264,6 +265,50 @@ type QueryPublishedRoomsResponse struct {
 	RoomIDs []string
 }
 
+type QueryAdminEventReportsRequest struct {
+	Filter types.EventReportFilter `json:"filter"`
+	// Return reports older than this report ID, or the newest reports if 0.
+	From  int64 `json:"from"`
+	Limit int   `json:"limit"`
+}
+
+type QueryAdminEventReportsResponse struct {
+	Reports []types.EventReport `json:"reports"`
+	// The total number of reports matching the filter.
+	Total int64 `json:"total"`
+}
+
+type QueryAdminEventReportRequest struct {
+	ReportID int64 `json:"report_id"`
+}
+
+type QueryAdminEventReportResponse struct {
+	// The report, or nil if it doesn't exist.
+	Report *types.EventReport `json:"report"`
+}
+
+type QueryAdminInputQueuesRequest struct {
+	// Return at most this many rooms, or all of them if 0.
+	Limit int `json:"limit"`
+}
+
+type QueryAdminInputQueuesResponse struct {
+	// The rooms which have events waiting to be processed, with the most
+	// events waiting first.
+	Rooms []InputQueue `json:"rooms"`
+	// How many rooms are processing an event, and how many are waiting for
+	// their turn to, by the priority of their next event.
+	Running map[string]int `json:"running"`
+	Waiting map[string]int `json:"waiting"`
+}
+
+// InputQueue is roughly how many input events are waiting to be processed
+// for a room, including the one which is being processed.
+type InputQueue struct {
+	RoomID string `json:"room_id"`
+	Depth  int64  `json:"depth"`
+}
+
 type QueryAuthChainRequest struct {
 	EventIDs []string
 }
@@ -283,6 +328,32 @@ type QuerySharedUsersResponse struct {
 	UserIDsToCount map[string]int
 }
 
+type QueryKnownRoomsRequest struct{}
+
+type QueryKnownRoomsResponse struct {
+	RoomIDs []string `json:"room_ids"`
+}
+
+// QueryRoomEventsRequest is a request to QueryRoomEvents.
+type QueryRoomEventsRequest struct {
+	RoomID string `json:"room_id"`
+	// Only return events after this position, which is taken from a
+	// previous response. Positions are only meaningful to the roomserver.
+	After int64 `json:"after"`
+	// The maximum number of events to return.
+	Limit int `json:"limit"`
+}
+
+// QueryRoomEventsResponse is a response to QueryRoomEvents.
+type QueryRoomEventsResponse struct {
+	RoomExists bool `json:"room_exists"`
+	// The events in the room, in the order that the roomserver stored them.
+	// This will be empty if there are no more events.
+	Events []*gomatrixserverlib.HeaderedEvent `json:"events"`
+	// The position of the last event returned.
+	Position int64 `json:"position"`
+}
+
 type QueryRoomsForUserRequest struct {
 	UserID string
 	// The desired membership of the user. If this is the empty string then no rooms are returned.
@@ -0,0 +1,451 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fsck checks the events and state which the roomserver has stored
+// for a room for inconsistencies, and optionally repairs them.
+package fsck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// The number of events to load from the database at a time.
+const eventsBatchSize = 100
+
+// ErrUnknownRoom is returned when checking a room that the roomserver
+// doesn't have any events for.
+var ErrUnknownRoom = errors.New("the room is not known")
+
+// ErrRoomChanged is returned when repairing a room whose forward extremities
+// changed after it was checked, in which case it needs to be checked again.
+var ErrRoomChanged = errors.New("the room changed while it was being checked")
+
+// OutputProducer sends output events to the other components.
+type OutputProducer interface {
+	ProduceRoomEvents(ctx context.Context, roomID string, updates []api.OutputEvent) error
+}
+
+// Checker checks rooms in the roomserver database.
+type Checker struct {
+	DB storage.Database
+	// If set, then the current state of a room is sent to the other
+	// components after it has been repaired. If not, they will need to be
+	// rebuilt some other way, e.g. with the rebuild-syncapi tool.
+	Producer OutputProducer
+}
+
+// leaf is an event that isn't referenced by any other event.
+type leaf struct {
+	ref      gomatrixserverlib.EventReference
+	eventNID types.EventNID
+	event    *gomatrixserverlib.Event
+}
+
+// CheckRoom checks the events and state of a room:
+//
+//   - the auth events of every event must be in the database;
+//   - the prev events of every event must be in the database, or at least be
+//     recorded as missing in the previous events table;
+//   - the stored state before every event must match the state calculated
+//     from its prev events, if all of them have state;
+//   - the forward extremities of the room must be exactly the events which
+//     aren't referenced by any other event.
+//
+// If repair is true, then the forward extremities and current state of the
+// room are recalculated if they are wrong, and the new current state is sent
+// to the other components. Other problems can't be repaired automatically.
+func (c *Checker) CheckRoom(ctx context.Context, roomID string, repair bool) (*types.RoomCheckReport, error) {
+	info, err := c.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("c.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub() {
+		return nil, ErrUnknownRoom
+	}
+	report := &types.RoomCheckReport{
+		RoomID:   roomID,
+		Problems: []types.RoomCheckProblem{},
+	}
+
+	// The forward extremities are loaded before the events, so that any
+	// events which arrive while checking are noticed before repairing.
+	latestEvents, _, _, err := c.DB.LatestEventIDs(ctx, info.RoomNID)
+	if err != nil {
+		return report, fmt.Errorf("c.DB.LatestEventIDs: %w", err)
+	}
+
+	var leaves []leaf
+	var afterNID types.EventNID
+	for {
+		events, err := c.DB.RoomEventsAfter(ctx, info, afterNID, eventsBatchSize)
+		if err != nil {
+			return report, fmt.Errorf("c.DB.RoomEventsAfter: %w", err)
+		}
+		for _, event := range events {
+			isLeaf, err := c.checkEvent(ctx, info, event, report)
+			if err != nil {
+				return report, fmt.Errorf("c.checkEvent: %w", err)
+			}
+			if isLeaf {
+				leaves = append(leaves, leaf{event.EventReference(), event.EventNID, event.Event})
+			}
+			report.EventsChecked++
+			afterNID = event.EventNID
+		}
+		if len(events) < eventsBatchSize {
+			break
+		}
+	}
+
+	ok, err := c.checkForwardExtremities(ctx, latestEvents, leaves, report)
+	if err != nil {
+		return report, fmt.Errorf("c.checkForwardExtremities: %w", err)
+	}
+	if !ok && repair {
+		if err = c.repairForwardExtremities(ctx, info, leaves, latestEvents); err == ErrRoomChanged {
+			return report, err
+		} else if err != nil {
+			return report, fmt.Errorf("c.repairForwardExtremities: %w", err)
+		}
+		for i := range report.Problems {
+			if report.Problems[i].Check == types.RoomCheckForwardExtremities {
+				report.Problems[i].Repaired = true
+			}
+		}
+	}
+	return report, nil
+}
+
+// checkEvent checks the auth events, prev events and state of an event.
+// Returns true if the event has state, isn't rejected and isn't referenced
+// by any other event, i.e. if it should be a forward extremity.
+func (c *Checker) checkEvent(
+	ctx context.Context, info *types.RoomInfo, event types.Event, report *types.RoomCheckReport,
+) (bool, error) {
+	authEventNIDs, err := c.DB.EventNIDs(ctx, event.AuthEventIDs())
+	if err != nil {
+		return false, fmt.Errorf("c.DB.EventNIDs: %w", err)
+	}
+	for _, authEventID := range event.AuthEventIDs() {
+		if _, ok := authEventNIDs[authEventID]; !ok {
+			report.AddProblem(types.RoomCheckAuthEvents, event.EventID(), "auth event %s is missing", authEventID)
+		}
+	}
+
+	prevEventNIDs, err := c.DB.EventNIDs(ctx, event.PrevEventIDs())
+	if err != nil {
+		return false, fmt.Errorf("c.DB.EventNIDs: %w", err)
+	}
+	for _, prevEvent := range event.PrevEvents() {
+		referenced, err := c.DB.IsEventReferenced(ctx, prevEvent)
+		if err != nil {
+			return false, fmt.Errorf("c.DB.IsEventReferenced: %w", err)
+		}
+		_, ok := prevEventNIDs[prevEvent.EventID]
+		switch {
+		case !referenced:
+			report.AddProblem(types.RoomCheckPrevEvents, event.EventID(), "prev event %s isn't recorded in the previous events table", prevEvent.EventID)
+		case !ok:
+			report.MissingPrevEvents++
+		}
+	}
+
+	stateNID, err := c.DB.SnapshotNIDFromEventID(ctx, event.EventID())
+	if err != nil {
+		return false, fmt.Errorf("c.DB.SnapshotNIDFromEventID: %w", err)
+	}
+	isCreate := event.Type() == gomatrixserverlib.MRoomCreate && event.StateKeyEquals("")
+	if stateNID == 0 && !isCreate {
+		// The event is an outlier, so there is nothing else to check.
+		return false, nil
+	}
+	if stateNID != 0 && len(prevEventNIDs) == len(event.PrevEventIDs()) && len(prevEventNIDs) > 0 {
+		if err = c.checkEventState(ctx, info, event, stateNID, report); err != nil {
+			return false, fmt.Errorf("c.checkEventState: %w", err)
+		}
+	}
+
+	referenced, err := c.DB.IsEventReferenced(ctx, event.EventReference())
+	if err != nil {
+		return false, fmt.Errorf("c.DB.IsEventReferenced: %w", err)
+	}
+	if referenced {
+		return false, nil
+	}
+	stateAtEvent, err := c.DB.StateAtEventIDs(ctx, []string{event.EventID()})
+	if err != nil {
+		return false, fmt.Errorf("c.DB.StateAtEventIDs: %w", err)
+	}
+	return !stateAtEvent[0].IsRejected, nil
+}
+
+// checkEventState compares the stored state before an event to the state
+// calculated from the state after its prev events.
+func (c *Checker) checkEventState(
+	ctx context.Context, info *types.RoomInfo, event types.Event, stateNID types.StateSnapshotNID, report *types.RoomCheckReport,
+) (err error) {
+	// The state resolution panics if the state tables are missing rows,
+	// which is exactly the sort of thing that we are looking for.
+	defer func() {
+		if r := recover(); r != nil {
+			report.AddProblem(types.RoomCheckState, event.EventID(), "failed to load state: %v", r)
+			err = nil
+		}
+	}()
+
+	prevStates, err := c.DB.StateAtEventIDs(ctx, event.PrevEventIDs())
+	if err != nil {
+		if _, ok := err.(types.MissingEventError); ok {
+			// At least one of the prev events is an outlier, so the state
+			// must have come from somewhere else.
+			return nil
+		}
+		return fmt.Errorf("c.DB.StateAtEventIDs: %w", err)
+	}
+	stateRes := state.NewStateResolution(c.DB, info)
+	calculated, err := stateRes.CalculateStateAfterEvents(ctx, prevStates)
+	if err != nil {
+		return fmt.Errorf("stateRes.CalculateStateAfterEvents: %w", err)
+	}
+	stored, err := stateRes.LoadStateAtSnapshot(ctx, stateNID)
+	if err != nil {
+		return fmt.Errorf("stateRes.LoadStateAtSnapshot: %w", err)
+	}
+	report.StatesChecked++
+
+	storedEntries := make(map[types.StateKeyTuple]types.EventNID, len(stored))
+	for _, entry := range stored {
+		storedEntries[entry.StateKeyTuple] = entry.EventNID
+	}
+	differences := 0
+	for _, entry := range calculated {
+		if eventNID, ok := storedEntries[entry.StateKeyTuple]; !ok || eventNID != entry.EventNID {
+			differences++
+		}
+		delete(storedEntries, entry.StateKeyTuple)
+	}
+	differences += len(storedEntries)
+	if differences > 0 {
+		report.AddProblem(
+			types.RoomCheckState, event.EventID(),
+			"stored state snapshot %d differs from the state calculated from the prev events in %d state keys",
+			stateNID, differences,
+		)
+	}
+	return nil
+}
+
+// checkForwardExtremities compares the forward extremities of the room to
+// the leaves found when checking the events. Returns true if they are the
+// same.
+func (c *Checker) checkForwardExtremities(
+	ctx context.Context, latestEvents []gomatrixserverlib.EventReference, leaves []leaf, report *types.RoomCheckReport,
+) (bool, error) {
+	isLeaf := make(map[string]bool, len(leaves))
+	for _, l := range leaves {
+		isLeaf[l.ref.EventID] = true
+	}
+	ok := true
+	for _, latest := range latestEvents {
+		if isLeaf[latest.EventID] {
+			delete(isLeaf, latest.EventID)
+			continue
+		}
+		referenced, err := c.DB.IsEventReferenced(ctx, latest)
+		if err != nil {
+			return false, fmt.Errorf("c.DB.IsEventReferenced: %w", err)
+		}
+		if referenced {
+			report.AddProblem(types.RoomCheckForwardExtremities, latest.EventID, "forward extremity is referenced by another event")
+		} else {
+			report.AddProblem(types.RoomCheckForwardExtremities, latest.EventID, "forward extremity is rejected or has no state")
+		}
+		ok = false
+	}
+	for _, l := range leaves {
+		if isLeaf[l.ref.EventID] {
+			report.AddProblem(types.RoomCheckForwardExtremities, l.ref.EventID, "event isn't referenced by any other event but isn't a forward extremity")
+			ok = false
+		}
+	}
+	if len(leaves) == 0 {
+		report.AddProblem(types.RoomCheckForwardExtremities, "", "no events could be forward extremities")
+		ok = false
+	}
+	return ok, nil
+}
+
+// repairForwardExtremities replaces the forward extremities of the room
+// with the given leaves, recalculates the current state of the room and
+// sends it to the other components. The leaves were found before the room
+// was locked, so if its forward extremities are no longer the ones that
+// were checked then new events have arrived since, and ErrRoomChanged is
+// returned without changing anything.
+func (c *Checker) repairForwardExtremities(
+	ctx context.Context, info *types.RoomInfo, leaves []leaf, checked []gomatrixserverlib.EventReference,
+) (err error) {
+	if len(leaves) == 0 {
+		return fmt.Errorf("no events could be forward extremities")
+	}
+	var succeeded bool
+	updater, err := c.DB.GetRoomUpdater(ctx, info)
+	if err != nil {
+		return fmt.Errorf("c.DB.GetRoomUpdater: %w", err)
+	}
+	defer sqlutil.EndTransactionWithCheck(updater, &succeeded, &err)
+
+	if !sameEventIDs(updater.LatestEvents(), checked) {
+		return ErrRoomChanged
+	}
+
+	eventIDs := make([]string, len(leaves))
+	for i, l := range leaves {
+		eventIDs[i] = l.ref.EventID
+	}
+	statesAtEvents, err := updater.StateAtEventIDs(ctx, eventIDs)
+	if err != nil {
+		return fmt.Errorf("updater.StateAtEventIDs: %w", err)
+	}
+	stateAtEvents := make(map[types.EventNID]types.StateAtEvent, len(statesAtEvents))
+	for _, stateAtEvent := range statesAtEvents {
+		stateAtEvents[stateAtEvent.EventNID] = stateAtEvent
+	}
+	latest := make([]types.StateAtEventAndReference, len(leaves))
+	latestStates := make([]types.StateAtEvent, len(leaves))
+	for i, l := range leaves {
+		latest[i] = types.StateAtEventAndReference{
+			StateAtEvent:   stateAtEvents[l.eventNID],
+			EventReference: l.ref,
+		}
+		latestStates[i] = latest[i].StateAtEvent
+	}
+
+	roomState := state.NewStateResolution(updater, info)
+	stateNID, err := roomState.CalculateAndStoreStateAfterEvents(ctx, latestStates)
+	if err != nil {
+		return fmt.Errorf("roomState.CalculateAndStoreStateAfterEvents: %w", err)
+	}
+
+	// The leaves are in the order that they were stored, so the last one is
+	// the most recent event. Keep the last event sent to the output stream
+	// as it was, unless there wasn't one.
+	mostRecent := leaves[len(leaves)-1]
+	lastEventNIDSent := mostRecent.eventNID
+	if lastEventIDSent := updater.LastEventIDSent(); lastEventIDSent != "" {
+		var eventNIDs map[string]types.EventNID
+		if eventNIDs, err = c.DB.EventNIDs(ctx, []string{lastEventIDSent}); err != nil {
+			return fmt.Errorf("c.DB.EventNIDs: %w", err)
+		}
+		if eventNID, ok := eventNIDs[lastEventIDSent]; ok {
+			lastEventNIDSent = eventNID
+		}
+	}
+
+	// Send the new current state to the other components before updating
+	// the room, as the input API does, so that the room isn't updated if
+	// they can't be told about it.
+	if c.Producer != nil {
+		var update *api.OutputEvent
+		update, err = c.currentStateUpdate(ctx, updater, &roomState, info, mostRecent.event, eventIDs, stateNID)
+		if err != nil {
+			return fmt.Errorf("c.currentStateUpdate: %w", err)
+		}
+		if err = c.Producer.ProduceRoomEvents(ctx, mostRecent.event.RoomID(), []api.OutputEvent{*update}); err != nil {
+			return fmt.Errorf("c.Producer.ProduceRoomEvents: %w", err)
+		}
+	}
+	if err = updater.SetLatestEvents(info.RoomNID, latest, lastEventNIDSent, stateNID); err != nil {
+		return fmt.Errorf("updater.SetLatestEvents: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"room_id":    mostRecent.event.RoomID(),
+		"latest":     eventIDs,
+		"state_nid":  stateNID,
+		"state_sent": c.Producer != nil,
+	}).Warn("Repaired forward extremities")
+	succeeded = true
+	return nil
+}
+
+// currentStateUpdate makes an output event which replaces the current state
+// of the room in the other components with the state at the given snapshot.
+// The most recent event in the room is sent with it, since an output event
+// must have one. The other components will already have the event, so they
+// will only update their state.
+func (c *Checker) currentStateUpdate(
+	ctx context.Context, updater state.StateResolutionStorage, roomState *state.StateResolution,
+	info *types.RoomInfo, event *gomatrixserverlib.Event, latestEventIDs []string, stateNID types.StateSnapshotNID,
+) (*api.OutputEvent, error) {
+	entries, err := roomState.LoadStateAtSnapshot(ctx, stateNID)
+	if err != nil {
+		return nil, fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
+	}
+	eventNIDs := make([]types.EventNID, len(entries))
+	for i, entry := range entries {
+		eventNIDs[i] = entry.EventNID
+	}
+	stateEvents, err := updater.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("updater.Events: %w", err)
+	}
+
+	ore := &api.OutputNewRoomEvent{
+		Event:             event.Headered(info.RoomVersion),
+		RewritesState:     true,
+		LatestEventIDs:    latestEventIDs,
+		HistoryVisibility: gomatrixserverlib.HistoryVisibilityJoined,
+	}
+	for _, stateEvent := range stateEvents {
+		ore.AddsStateEventIDs = append(ore.AddsStateEventIDs, stateEvent.EventID())
+		if stateEvent.Type() == gomatrixserverlib.MRoomHistoryVisibility && stateEvent.StateKeyEquals("") {
+			if historyVisibility, err := stateEvent.HistoryVisibility(); err == nil {
+				ore.HistoryVisibility = historyVisibility
+			}
+		}
+	}
+	return &api.OutputEvent{
+		Type:         api.OutputTypeNewRoomEvent,
+		NewRoomEvent: ore,
+	}, nil
+}
+
+// sameEventIDs returns true if the forward extremities are exactly the
+// events that were checked.
+func sameEventIDs(latest []types.StateAtEventAndReference, checked []gomatrixserverlib.EventReference) bool {
+	if len(latest) != len(checked) {
+		return false
+	}
+	isChecked := make(map[string]bool, len(checked))
+	for _, ref := range checked {
+		isChecked[ref.EventID] = true
+	}
+	for _, l := range latest {
+		if !isChecked[l.EventID] {
+			return false
+		}
+	}
+	return true
+}
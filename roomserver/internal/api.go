@@ -39,6 +39,7 @@ type RoomserverInternalAPI struct {
 	*perform.Forgetter
 	*perform.Upgrader
 	*perform.Admin
+	*perform.Reporter
 	ProcessContext         *process.ProcessContext
 	Base                   *base.BaseDendrite
 	DB                     storage.Database
@@ -119,12 +120,14 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		KeyRing:             keyRing,
 		ACLs:                r.ServerACLs,
 		Queryer:             r.Queryer,
+		SpamChecker:         r.Base.SpamChecker,
 	}
 	r.Inviter = &perform.Inviter{
-		DB:      r.DB,
-		Cfg:     r.Cfg,
-		FSAPI:   r.fsAPI,
-		Inputer: r.Inputer,
+		DB:          r.DB,
+		Cfg:         r.Cfg,
+		FSAPI:       r.fsAPI,
+		Inputer:     r.Inputer,
+		SpamChecker: r.Base.SpamChecker,
 	}
 	r.Joiner = &perform.Joiner{
 		ServerName: r.Cfg.Matrix.ServerName,
@@ -175,6 +178,9 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 	r.Forgetter = &perform.Forgetter{
 		DB: r.DB,
 	}
+	r.Reporter = &perform.Reporter{
+		DB: r.DB,
+	}
 	r.Upgrader = &perform.Upgrader{
 		Cfg:    r.Cfg,
 		URSAPI: r,
@@ -190,6 +196,10 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 	if err := r.Inputer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start roomserver input API")
 	}
+
+	if r.Cfg.StateCompaction.Enabled {
+		r.Admin.StartStateCompaction(r.ProcessContext)
+	}
 }
 
 func (r *RoomserverInternalAPI) SetUserAPI(userAPI userapi.RoomserverUserAPI) {
@@ -213,7 +223,7 @@ func (r *RoomserverInternalAPI) PerformInvite(
 	if len(outputEvents) == 0 {
 		return nil
 	}
-	return r.OutputProducer.ProduceRoomEvents(req.Event.RoomID(), outputEvents)
+	return r.OutputProducer.ProduceRoomEvents(ctx, req.Event.RoomID(), outputEvents)
 }
 
 func (r *RoomserverInternalAPI) PerformLeave(
@@ -229,7 +239,7 @@ func (r *RoomserverInternalAPI) PerformLeave(
 	if len(outputEvents) == 0 {
 		return nil
 	}
-	return r.OutputProducer.ProduceRoomEvents(req.RoomID, outputEvents)
+	return r.OutputProducer.ProduceRoomEvents(ctx, req.RoomID, outputEvents)
 }
 
 func (r *RoomserverInternalAPI) PerformForget(
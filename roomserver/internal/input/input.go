@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -29,13 +30,16 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
 
 	fedapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
 	"github.com/matrix-org/dendrite/roomserver/producers"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/base"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
@@ -77,6 +81,7 @@ type Inputer struct {
 	NATSClient          *nats.Conn
 	JetStream           nats.JetStreamContext
 	Durable             nats.SubOpt
+	SpamChecker         spamcheck.Checker
 	ServerName          gomatrixserverlib.ServerName
 	FSAPI               fedapi.RoomserverFederationAPI
 	KeyRing             gomatrixserverlib.JSONVerifier
@@ -84,6 +89,7 @@ type Inputer struct {
 	InputRoomEventTopic string
 	OutputProducer      *producers.RoomEventProducer
 	workers             sync.Map // room ID -> *worker
+	scheduler           *inputScheduler
 
 	Queryer *query.Queryer
 }
@@ -94,9 +100,18 @@ type worker struct {
 	r            *Inputer
 	roomID       string
 	subscription *nats.Subscription
+	// Roughly how many events are waiting to be processed for the room,
+	// including the one being processed.
+	queued atomic.Int64
 }
 
-func (r *Inputer) startWorkerForRoom(roomID string) {
+// setQueued updates how many events are waiting for the room.
+func (w *worker) setQueued(queued int64) {
+	w.queued.Store(queued)
+	roomserverInputBackpressure.With(prometheus.Labels{"room_id": w.roomID}).Set(float64(queued))
+}
+
+func (r *Inputer) startWorkerForRoom(roomID string) *worker {
 	v, loaded := r.workers.LoadOrStore(roomID, &worker{
 		r:      r,
 		roomID: roomID,
@@ -132,7 +147,7 @@ func (r *Inputer) startWorkerForRoom(roomID string) {
 			},
 		); err != nil {
 			logrus.WithError(err).Errorf("Failed to create consumer for room %q", w.roomID)
-			return
+			return w
 		}
 
 		// Bind to our durable consumer. We want to receive all messages waiting
@@ -147,13 +162,14 @@ func (r *Inputer) startWorkerForRoom(roomID string) {
 		)
 		if err != nil {
 			logrus.WithError(err).Errorf("Failed to subscribe to stream for room %q", w.roomID)
-			return
+			return w
 		}
 
 		// Go and start pulling messages off the queue.
 		w.subscription = sub
 		w.Act(nil, w._next)
 	}
+	return w
 }
 
 // Start creates an ephemeral non-durable consumer on the roomserver
@@ -164,13 +180,19 @@ func (r *Inputer) startWorkerForRoom(roomID string) {
 // own consumer. If we don't, we'll start one.
 func (r *Inputer) Start() error {
 	if r.Base.EnableMetrics {
-		prometheus.MustRegister(roomserverInputBackpressure, processRoomEventDuration)
+		prometheus.MustRegister(
+			roomserverInputBackpressure, roomserverInputLatency, processRoomEventDuration,
+			roomserverInputRunningRooms, roomserverInputWaitingRooms,
+			roomserverInputSchedulingDelay, roomserverInputQueueFull,
+		)
 	}
+	r.scheduler = newInputScheduler(&r.Cfg.Input)
 	_, err := r.JetStream.Subscribe(
 		"", // This is blank because we specified it in BindStream.
 		func(m *nats.Msg) {
 			roomID := m.Header.Get(jetstream.RoomID)
-			r.startWorkerForRoom(roomID)
+			w := r.startWorkerForRoom(roomID)
+			w.setQueued(w.queued.Load() + 1)
 			_ = m.Ack()
 		},
 		nats.HeadersOnly(),
@@ -211,6 +233,8 @@ func (w *worker) _next() {
 		w.Lock()
 		w.subscription = nil
 		w.Unlock()
+		w.queued.Store(0)
+		roomserverInputBackpressure.Delete(prometheus.Labels{"room_id": w.roomID})
 		return
 
 	default:
@@ -238,15 +262,51 @@ func (w *worker) _next() {
 		return
 	}
 
-	roomserverInputBackpressure.With(prometheus.Labels{"room_id": w.roomID}).Inc()
-	defer roomserverInputBackpressure.With(prometheus.Labels{"room_id": w.roomID}).Dec()
+	// The consumer knows exactly how many events are left for the room,
+	// so use that to correct our count.
+	if meta, merr := msg.Metadata(); merr == nil {
+		w.setQueued(int64(meta.NumPending) + 1)
+	}
+	defer func() {
+		if queued := w.queued.Load(); queued > 0 {
+			w.setQueued(queued - 1)
+		}
+	}()
+
+	// Wait for our turn to process the event, so that busy rooms can't stop
+	// other rooms from making progress and so that local events come first.
+	turn := w.waitForTurn(msg, priorityOf(w.r.ServerName, &inputRoomEvent))
+	if turn == nil {
+		return
+	}
+	defer w.r.scheduler.done(turn)
 
 	// Process the room event. If something goes wrong then we'll tell
 	// NATS to terminate the message. We'll store the error result as
 	// a string, because we might want to return that to the caller if
 	// it was a synchronous request.
+	// Continue the trace of whatever sent the event, e.g. the /send request.
+	span, processCtx := jetstream.StartConsumerSpan(w.r.ProcessContext.Context(), msg, "InputRoomEvent")
+	defer span.Finish()
+
+	// The latency is measured from when the event was queued, so that it
+	// includes the time spent waiting behind other events in the room.
+	if meta, merr := msg.Metadata(); merr == nil {
+		defer func() {
+			roomID := ""
+			if w.r.Cfg.Matrix.Metrics.PerRoomInputLatency {
+				roomID = w.roomID
+			}
+			roomserverInputLatency.With(prometheus.Labels{
+				"room_id": roomID,
+				"origin":  string(inputRoomEvent.Origin),
+			}).Observe(float64(time.Since(meta.Timestamp).Milliseconds()))
+		}()
+	}
+
 	var errString string
-	if err = w.r.processRoomEvent(w.r.ProcessContext.Context(), &inputRoomEvent); err != nil {
+	var notAllowed bool
+	if err = w.r.processRoomEvent(processCtx, &inputRoomEvent); err != nil {
 		if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
 			sentry.CaptureException(err)
 		}
@@ -257,6 +317,8 @@ func (w *worker) _next() {
 		}).Warn("Roomserver failed to process async event")
 		_ = msg.Term()
 		errString = err.Error()
+		var rejectedErr types.RejectedError
+		notAllowed = errors.As(err, &rejectedErr)
 	} else {
 		_ = msg.Ack()
 	}
@@ -268,7 +330,15 @@ func (w *worker) _next() {
 	// was no error then we'll return a blank message, which means
 	// that everything was OK.
 	if replyTo := msg.Header.Get("sync"); replyTo != "" {
-		if err = w.r.NATSClient.Publish(replyTo, []byte(errString)); err != nil {
+		reply := &nats.Msg{
+			Subject: replyTo,
+			Header:  nats.Header{},
+			Data:    []byte(errString),
+		}
+		if notAllowed {
+			reply.Header.Set("not_allowed", "true")
+		}
+		if err = w.r.NATSClient.PublishMsg(reply); err != nil {
 			logrus.WithError(err).WithFields(logrus.Fields{
 				"room_id":  w.roomID,
 				"event_id": inputRoomEvent.Event.EventID(),
@@ -278,12 +348,78 @@ func (w *worker) _next() {
 	}
 }
 
+// waitForTurn waits until the scheduler lets the room process an event with
+// the given priority. While waiting, it tells NATS that we are still working
+// on the message so that it isn't delivered again. Returns nil if the
+// roomserver is shutting down.
+func (w *worker) waitForTurn(msg *nats.Msg, p priority) *inputTurn {
+	turn := w.r.scheduler.wait(p)
+	ticker := time.NewTicker(MaximumMissingProcessingTime / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-turn.ready:
+			return turn
+		case <-ticker.C:
+			_ = msg.InProgress()
+		case <-w.r.ProcessContext.Context().Done():
+			w.r.scheduler.done(turn)
+			return nil
+		}
+	}
+}
+
+// queueDepth returns roughly how many events are waiting to be processed
+// for the room.
+func (r *Inputer) queueDepth(roomID string) int64 {
+	if v, ok := r.workers.Load(roomID); ok {
+		return v.(*worker).queued.Load()
+	}
+	return 0
+}
+
+// QueryAdminInputQueues implements api.ClientRoomserverAPI
+func (r *Inputer) QueryAdminInputQueues(
+	ctx context.Context,
+	request *api.QueryAdminInputQueuesRequest,
+	response *api.QueryAdminInputQueuesResponse,
+) error {
+	response.Rooms = []api.InputQueue{}
+	r.workers.Range(func(_, v interface{}) bool {
+		w := v.(*worker)
+		if depth := w.queued.Load(); depth > 0 {
+			response.Rooms = append(response.Rooms, api.InputQueue{
+				RoomID: w.roomID,
+				Depth:  depth,
+			})
+		}
+		return true
+	})
+	sort.Slice(response.Rooms, func(i, j int) bool {
+		if response.Rooms[i].Depth != response.Rooms[j].Depth {
+			return response.Rooms[i].Depth > response.Rooms[j].Depth
+		}
+		return response.Rooms[i].RoomID < response.Rooms[j].RoomID
+	})
+	if request.Limit > 0 && len(response.Rooms) > request.Limit {
+		response.Rooms = response.Rooms[:request.Limit]
+	}
+	if r.scheduler != nil {
+		response.Running, response.Waiting = r.scheduler.status()
+	}
+	return nil
+}
+
 // queueInputRoomEvents queues events into the roomserver input
 // stream in NATS.
 func (r *Inputer) queueInputRoomEvents(
 	ctx context.Context,
 	request *api.InputRoomEventsRequest,
 ) (replySub *nats.Subscription, err error) {
+	if err = r.checkQueueDepths(request); err != nil {
+		return nil, err
+	}
+
 	// If the request is synchronous then we need to create a
 	// temporary inbox to wait for responses on, and then create
 	// a subscription to it. If it's asynchronous then we won't
@@ -316,6 +452,7 @@ func (r *Inputer) queueInputRoomEvents(
 		if replyTo != "" {
 			msg.Header.Set("sync", replyTo)
 		}
+		jetstream.InjectSpan(ctx, msg)
 		msg.Data, err = json.Marshal(e)
 		if err != nil {
 			return nil, fmt.Errorf("json.Marshal: %w", err)
@@ -332,6 +469,30 @@ func (r *Inputer) queueInputRoomEvents(
 	return
 }
 
+// checkQueueDepths refuses events that other servers sent us if any of
+// their rooms are already too far behind. Nobody is waiting for these,
+// unlike synchronous requests. Either all of the events are refused or none
+// of them are, so that the federation API can answer the whole /send
+// transaction with a 429, and the origin sends all of it again later.
+func (r *Inputer) checkQueueDepths(request *api.InputRoomEventsRequest) error {
+	maxDepth := int64(r.Cfg.Input.MaxQueueDepth)
+	if maxDepth <= 0 || !request.Asynchronous {
+		return nil
+	}
+	for i := range request.InputRoomEvents {
+		e := &request.InputRoomEvents[i]
+		if priorityOf(r.ServerName, e) != priorityFederation {
+			continue
+		}
+		roomID := e.Event.RoomID()
+		if depth := r.queueDepth(roomID); depth >= maxDepth {
+			roomserverInputQueueFull.WithLabelValues(string(e.Origin)).Inc()
+			return fmt.Errorf("room %q has %d events queued: %w", roomID, depth, api.ErrQueueFull)
+		}
+	}
+	return nil
+}
+
 // InputRoomEvents implements api.RoomserverInternalAPI
 func (r *Inputer) InputRoomEvents(
 	ctx context.Context,
@@ -342,6 +503,7 @@ func (r *Inputer) InputRoomEvents(
 	replySub, err := r.queueInputRoomEvents(ctx, request)
 	if err != nil {
 		response.ErrMsg = err.Error()
+		response.QueueFull = errors.Is(err, api.ErrQueueFull)
 		return
 	}
 
@@ -364,6 +526,7 @@ func (r *Inputer) InputRoomEvents(
 		}
 		if len(msg.Data) > 0 {
 			response.ErrMsg = string(msg.Data)
+			response.NotAllowed = msg.Header.Get("not_allowed") == "true"
 		}
 	}
 }
@@ -377,3 +540,22 @@ var roomserverInputBackpressure = prometheus.NewGaugeVec(
 	},
 	[]string{"room_id"},
 )
+
+var roomserverInputLatency = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_latency_milliseconds",
+		Help:      "How long it takes from an event being queued for input until it has been processed",
+		Buckets: []float64{ // milliseconds
+			5, 10, 25, 50, 75, 100, 250, 500,
+			1000, 2000, 3000, 4000, 5000, 6000,
+			7000, 8000, 9000, 10000, 15000, 20000,
+			30000, 60000, 120000,
+		},
+	},
+	// The room ID is left empty unless global.metrics.per_room_input_latency
+	// is set, as there would be a histogram for every room the server has
+	// ever seen an event in.
+	[]string{"room_id", "origin"},
+)
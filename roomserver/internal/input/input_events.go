@@ -26,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/internal/hooks"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
@@ -79,6 +80,8 @@ func (r *Inputer) processRoomEvent(
 	span, ctx := opentracing.StartSpanFromContext(ctx, "processRoomEvent")
 	span.SetTag("room_id", input.Event.RoomID())
 	span.SetTag("event_id", input.Event.EventID())
+	span.SetTag("origin", string(input.Origin))
+	span.SetTag("kind", int(input.Kind))
 	defer span.Finish()
 
 	// Measure how long it takes to process this event.
@@ -141,6 +144,31 @@ func (r *Inputer) processRoomEvent(
 		return fmt.Errorf("room %s does not exist for event %s", event.RoomID(), event.EventID())
 	}
 
+	// Give the spam checker modules a chance to reject or soft-fail new
+	// events before we do any more work on them, like fetching their auth
+	// events or missing state. Events from other servers may already be in
+	// the room there, and other events will reference them, so they are only
+	// ever soft-failed.
+	var spamSoftfail bool
+	var spamRejectionErr error
+	if input.Kind == api.KindNew && r.SpamChecker != nil {
+		res, err := r.SpamChecker.CheckEvent(ctx, headered, input.Origin)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to check event for spam")
+		}
+		switch {
+		case res.Decision == spamcheck.SoftFail:
+			logger.WithField("reason", res.Reason).Info("Event soft-failed by spam checker")
+			spamSoftfail = true
+		case res.Decision == spamcheck.Reject && input.Origin != r.ServerName:
+			logger.WithField("reason", res.Reason).Info("Federated event soft-failed instead of rejected by spam checker")
+			spamSoftfail = true
+		case res.Decision == spamcheck.Reject:
+			logger.WithField("reason", res.Reason).Info("Event rejected by spam checker")
+			spamRejectionErr = fmt.Errorf("event rejected by spam checker: %s", res.Reason)
+		}
+	}
+
 	var missingAuth, missingPrev bool
 	serverRes := &fedapi.QueryJoinedHostServerNamesInRoomResponse{}
 	if !isCreateEvent {
@@ -237,6 +265,16 @@ func (r *Inputer) processRoomEvent(
 		}
 	}
 
+	// Apply what the spam checker decided earlier on, unless the event was
+	// already rejected by the auth checks.
+	if spamSoftfail {
+		softfail = true
+	}
+	if spamRejectionErr != nil && !isRejected {
+		isRejected = true
+		rejectionErr = spamRejectionErr
+	}
+
 	// At this point we are checking whether we know all of the prev events, and
 	// if we know the state before the prev events. This is necessary before we
 	// try to do `calculateAndSetState` on the event later, otherwise it will fail
@@ -247,10 +285,11 @@ func (r *Inputer) processRoomEvent(
 	// typical federated room join) then we won't bother trying to fetch prev events
 	// because we may not be allowed to see them and we have no choice but to trust
 	// the state event IDs provided to us in the join instead.
-	if missingPrev && input.Kind == api.KindNew {
+	if missingPrev && input.Kind == api.KindNew && !spamSoftfail && spamRejectionErr == nil {
 		// Don't do this for KindOld events, otherwise old events that we fetch
 		// to satisfy missing prev events/state will end up recursively calling
-		// processRoomEvent.
+		// processRoomEvent. Don't bother for events which the spam checker
+		// refused either, as they won't be part of the room state anyway.
 		if len(serverRes.ServerNames) > 0 {
 			missingState := missingStateReq{
 				origin:     input.Origin,
@@ -379,7 +418,7 @@ func (r *Inputer) processRoomEvent(
 			return fmt.Errorf("r.updateLatestEvents: %w", err)
 		}
 	case api.KindOld:
-		err = r.OutputProducer.ProduceRoomEvents(event.RoomID(), []api.OutputEvent{
+		err = r.OutputProducer.ProduceRoomEvents(ctx, event.RoomID(), []api.OutputEvent{
 			{
 				Type: api.OutputTypeOldRoomEvent,
 				OldRoomEvent: &api.OutputOldRoomEvent{
@@ -398,7 +437,7 @@ func (r *Inputer) processRoomEvent(
 	// so notify downstream components to redact this event - they should have it if they've
 	// been tracking our output log.
 	if redactedEventID != "" {
-		err = r.OutputProducer.ProduceRoomEvents(event.RoomID(), []api.OutputEvent{
+		err = r.OutputProducer.ProduceRoomEvents(ctx, event.RoomID(), []api.OutputEvent{
 			{
 				Type: api.OutputTypeRedactedEvent,
 				RedactedEvent: &api.OutputRedactedEvent{
@@ -0,0 +1,237 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// A priority is the class of an input event, which decides which rooms get
+// to process their next event first when the roomserver is busy. Lower
+// values are more important.
+type priority int
+
+const (
+	// priorityLocal is for events sent by our own users, who are waiting
+	// to see them.
+	priorityLocal priority = iota
+	// priorityFederation is for new events which other servers sent us.
+	priorityFederation
+	// priorityBackfill is for events which fill in the history of a room.
+	priorityBackfill
+	priorityCount
+)
+
+func (p priority) String() string {
+	switch p {
+	case priorityLocal:
+		return "local"
+	case priorityFederation:
+		return "federation"
+	case priorityBackfill:
+		return "backfill"
+	default:
+		return "unknown"
+	}
+}
+
+// priorityOf works out the priority class of an input event.
+func priorityOf(serverName gomatrixserverlib.ServerName, input *api.InputRoomEvent) priority {
+	switch {
+	case input.Kind == api.KindOld:
+		return priorityBackfill
+	case input.Origin == serverName:
+		return priorityLocal
+	default:
+		return priorityFederation
+	}
+}
+
+// inputScheduler limits how many rooms can process input events at the
+// same time. When a room has to wait, it is woken before any rooms with
+// less important events, and after any rooms with equally important events
+// which were already waiting, so that one busy room can't hold up all the
+// others.
+type inputScheduler struct {
+	mu      sync.Mutex
+	total   int                      // the most rooms which can run at once, or 0 if unlimited
+	limits  [priorityCount]int       // the most rooms which can run at once with each priority
+	running [priorityCount]int       // how many rooms are running with each priority
+	waiting [priorityCount]list.List // of *inputTurn, oldest first
+}
+
+// An inputTurn is a room's place in the queue to process its next event.
+type inputTurn struct {
+	priority priority
+	started  time.Time
+	ready    chan struct{} // closed when the room can process the event
+	element  *list.Element // in the waiting list, or nil once it is ready
+}
+
+func newInputScheduler(cfg *config.InputOptions) *inputScheduler {
+	s := &inputScheduler{
+		total: cfg.MaxConcurrentRooms,
+	}
+	s.limits[priorityLocal] = cfg.MaxConcurrentRooms
+	s.limits[priorityFederation] = cfg.MaxConcurrentFederationRooms
+	s.limits[priorityBackfill] = cfg.MaxConcurrentBackfillRooms
+	return s
+}
+
+// _canRun returns whether a room with the given priority can start
+// processing an event now. Rooms with events from other servers can never
+// take the last room which can run, so that events sent by our own users
+// don't have to wait behind them. The lock must be held.
+func (s *inputScheduler) _canRun(p priority) bool {
+	if s.limits[p] > 0 && s.running[p] >= s.limits[p] {
+		return false
+	}
+	if s.total > 0 {
+		running := 0
+		for _, n := range s.running {
+			running += n
+		}
+		if running >= s.total {
+			return false
+		}
+		if p != priorityLocal && s.total > 1 && running-s.running[priorityLocal] >= s.total-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// _start marks a turn as running. The lock must be held.
+func (s *inputScheduler) _start(turn *inputTurn) {
+	s.running[turn.priority]++
+	close(turn.ready)
+	roomserverInputRunningRooms.WithLabelValues(turn.priority.String()).Inc()
+	roomserverInputSchedulingDelay.WithLabelValues(turn.priority.String()).Observe(
+		float64(time.Since(turn.started).Milliseconds()),
+	)
+}
+
+// wait queues up a turn to process an event with the given priority. The
+// caller must wait for the ready channel of the turn to be closed before
+// processing the event, and must then call done. If the caller gives up
+// waiting, it must call done anyway.
+func (s *inputScheduler) wait(p priority) *inputTurn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	turn := &inputTurn{
+		priority: p,
+		started:  time.Now(),
+		ready:    make(chan struct{}),
+	}
+	// Rooms with more important events which are waiting could only be
+	// waiting for limits which apply to us too, or for their own limits,
+	// which don't, so we only need to wait behind rooms with the same
+	// priority.
+	if s.waiting[p].Len() == 0 && s._canRun(p) {
+		s._start(turn)
+		return turn
+	}
+	turn.element = s.waiting[p].PushBack(turn)
+	roomserverInputWaitingRooms.WithLabelValues(p.String()).Inc()
+	return turn
+}
+
+// done gives up a turn, either once the event has been processed or
+// because the caller no longer wants to wait, and lets the next room
+// which is waiting start processing.
+func (s *inputScheduler) done(turn *inputTurn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if turn.element != nil {
+		s.waiting[turn.priority].Remove(turn.element)
+		turn.element = nil
+		roomserverInputWaitingRooms.WithLabelValues(turn.priority.String()).Dec()
+		return
+	}
+	s.running[turn.priority]--
+	roomserverInputRunningRooms.WithLabelValues(turn.priority.String()).Dec()
+	for p := priority(0); p < priorityCount; p++ {
+		for s.waiting[p].Len() > 0 && s._canRun(p) {
+			next := s.waiting[p].Remove(s.waiting[p].Front()).(*inputTurn)
+			next.element = nil
+			roomserverInputWaitingRooms.WithLabelValues(p.String()).Dec()
+			s._start(next)
+		}
+	}
+}
+
+// status returns how many rooms are running and waiting with each priority.
+func (s *inputScheduler) status() (running, waiting map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	running, waiting = map[string]int{}, map[string]int{}
+	for p := priority(0); p < priorityCount; p++ {
+		running[p.String()] = s.running[p]
+		waiting[p.String()] = s.waiting[p].Len()
+	}
+	return
+}
+
+var roomserverInputRunningRooms = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_running_rooms",
+		Help:      "How many rooms are processing an input event with each priority",
+	},
+	[]string{"priority"},
+)
+
+var roomserverInputWaitingRooms = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_waiting_rooms",
+		Help:      "How many rooms are waiting for their turn to process an input event with each priority",
+	},
+	[]string{"priority"},
+)
+
+var roomserverInputSchedulingDelay = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_scheduling_delay_milliseconds",
+		Help:      "How long rooms wait for their turn to process an input event",
+		Buckets: []float64{ // milliseconds
+			1, 5, 10, 25, 50, 75, 100, 250, 500,
+			1000, 2000, 3000, 4000, 5000, 10000, 20000, 30000,
+		},
+	},
+	[]string{"priority"},
+)
+
+var roomserverInputQueueFull = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_queue_full_total",
+		Help:      "How many events were refused because too many events were already queued for the room",
+	},
+	[]string{"origin"},
+)
@@ -0,0 +1,233 @@
+package input
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+)
+
+func isReady(turn *inputTurn) bool {
+	select {
+	case <-turn.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestInputSchedulerPriority(t *testing.T) {
+	s := newInputScheduler(&config.InputOptions{
+		MaxConcurrentRooms: 2,
+	})
+
+	// Hold on to one room for the whole test, so that only one other room
+	// can run at a time.
+	held := s.wait(priorityLocal)
+	running := s.wait(priorityBackfill)
+	if !isReady(held) || !isReady(running) {
+		t.Fatalf("expected the first turns to be ready straight away")
+	}
+	backfill := s.wait(priorityBackfill)
+	federation1 := s.wait(priorityFederation)
+	federation2 := s.wait(priorityFederation)
+	local := s.wait(priorityLocal)
+	for _, turn := range []*inputTurn{backfill, federation1, federation2, local} {
+		if isReady(turn) {
+			t.Fatalf("expected the %s turn to wait", turn.priority)
+		}
+	}
+
+	// Each turn should go in priority order, and in the order they were
+	// queued within the same priority.
+	for _, next := range []*inputTurn{local, federation1, federation2, backfill} {
+		s.done(running)
+		if !isReady(next) {
+			t.Fatalf("expected the %s turn to be ready", next.priority)
+		}
+		running = next
+	}
+	s.done(running)
+	s.done(held)
+
+	if running, waiting := s.status(); running["backfill"] != 0 || waiting["backfill"] != 0 {
+		t.Fatalf("expected nothing to be running or waiting, got %v and %v", running, waiting)
+	}
+}
+
+func TestInputSchedulerLimits(t *testing.T) {
+	s := newInputScheduler(&config.InputOptions{
+		MaxConcurrentRooms:           3,
+		MaxConcurrentFederationRooms: 1,
+	})
+
+	federation1 := s.wait(priorityFederation)
+	federation2 := s.wait(priorityFederation)
+	if !isReady(federation1) || isReady(federation2) {
+		t.Fatalf("expected only one federation turn to be ready")
+	}
+
+	// Local events aren't held up by the federation limit, even though
+	// there is a federation turn waiting.
+	local1 := s.wait(priorityLocal)
+	local2 := s.wait(priorityLocal)
+	if !isReady(local1) || !isReady(local2) {
+		t.Fatalf("expected the local turns to be ready")
+	}
+	running, waiting := s.status()
+	if running["local"] != 2 || running["federation"] != 1 || waiting["federation"] != 1 {
+		t.Fatalf("unexpected status: running %v, waiting %v", running, waiting)
+	}
+
+	// Giving up a waiting turn takes it out of the queue.
+	s.done(federation2)
+	s.done(federation1)
+	federation3 := s.wait(priorityFederation)
+	if !isReady(federation3) {
+		t.Fatalf("expected the federation turn to be ready")
+	}
+	s.done(federation3)
+	s.done(local1)
+	s.done(local2)
+	if running, waiting = s.status(); running["local"] != 0 || running["federation"] != 0 || waiting["federation"] != 0 {
+		t.Fatalf("expected nothing to be running or waiting, got %v and %v", running, waiting)
+	}
+}
+
+func TestInputSchedulerKeepsLocalSlot(t *testing.T) {
+	s := newInputScheduler(&config.InputOptions{
+		MaxConcurrentRooms: 3,
+	})
+
+	// Events from other servers can only take two of the three rooms.
+	federation1 := s.wait(priorityFederation)
+	backfill := s.wait(priorityBackfill)
+	federation2 := s.wait(priorityFederation)
+	if !isReady(federation1) || !isReady(backfill) || isReady(federation2) {
+		t.Fatalf("expected only two turns for events from other servers to be ready")
+	}
+	local := s.wait(priorityLocal)
+	if !isReady(local) {
+		t.Fatalf("expected the local turn to be ready")
+	}
+	s.done(local)
+	if isReady(federation2) {
+		t.Fatalf("expected the federation turn to still wait for the local slot to be kept")
+	}
+	s.done(federation1)
+	if !isReady(federation2) {
+		t.Fatalf("expected the federation turn to be ready")
+	}
+	s.done(federation2)
+	s.done(backfill)
+}
+
+// publishRecorder records the messages which would have been sent to the
+// input queues.
+type publishRecorder struct {
+	nats.JetStreamContext
+	published []*nats.Msg
+}
+
+func (p *publishRecorder) PublishMsg(msg *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	p.published = append(p.published, msg)
+	return &nats.PubAck{}, nil
+}
+
+func TestInputQueueFull(t *testing.T) {
+	alice := test.NewUser(t)
+	busyRoom := test.NewRoom(t, alice)
+	quietRoom := test.NewRoom(t, alice)
+
+	cfg := &config.RoomServer{Matrix: &config.Global{}}
+	cfg.Input.MaxQueueDepth = 2
+	recorder := &publishRecorder{}
+	r := &Inputer{
+		Cfg:        cfg,
+		ServerName: "localhost",
+		JetStream:  recorder,
+	}
+	busy := &worker{r: r, roomID: busyRoom.ID}
+	busy.queued.Store(2)
+	r.workers.Store(busyRoom.ID, busy)
+
+	input := func(room *test.Room, kind api.Kind, origin string) api.InputRoomEvent {
+		return api.InputRoomEvent{
+			Kind:   kind,
+			Event:  room.Events()[len(room.Events())-1],
+			Origin: gomatrixserverlib.ServerName(origin),
+		}
+	}
+	tests := []struct {
+		name      string
+		events    []api.InputRoomEvent
+		queueFull bool
+	}{
+		{
+			name:   "room below the limit",
+			events: []api.InputRoomEvent{input(quietRoom, api.KindNew, "remote")},
+		},
+		{
+			name:   "local events are never refused",
+			events: []api.InputRoomEvent{input(busyRoom, api.KindNew, "localhost")},
+		},
+		{
+			name:   "backfilled events are never refused",
+			events: []api.InputRoomEvent{input(busyRoom, api.KindOld, "remote")},
+		},
+		{
+			name: "events from other servers are all refused if any room is full",
+			events: []api.InputRoomEvent{
+				input(quietRoom, api.KindNew, "remote"),
+				input(busyRoom, api.KindNew, "remote"),
+			},
+			queueFull: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder.published = nil
+			res := &api.InputRoomEventsResponse{}
+			r.InputRoomEvents(context.Background(), &api.InputRoomEventsRequest{
+				InputRoomEvents: tt.events,
+				Asynchronous:    true,
+			}, res)
+			if res.QueueFull != tt.queueFull {
+				t.Fatalf("expected QueueFull to be %v, got %v (%s)", tt.queueFull, res.QueueFull, res.ErrMsg)
+			}
+			if tt.queueFull {
+				if err := res.Err(); !errors.Is(err, api.ErrQueueFull) {
+					t.Fatalf("expected ErrQueueFull, got %v", err)
+				}
+				if len(recorder.published) != 0 {
+					t.Fatalf("expected no events to be queued, got %d", len(recorder.published))
+				}
+			} else if len(recorder.published) != len(tt.events) {
+				t.Fatalf("expected %d events to be queued, got %d", len(tt.events), len(recorder.published))
+			}
+		})
+	}
+}
+
+func TestPriorityOf(t *testing.T) {
+	tests := []struct {
+		input api.InputRoomEvent
+		want  priority
+	}{
+		{api.InputRoomEvent{Kind: api.KindNew, Origin: "localhost"}, priorityLocal},
+		{api.InputRoomEvent{Kind: api.KindOutlier, Origin: "localhost"}, priorityLocal},
+		{api.InputRoomEvent{Kind: api.KindNew, Origin: "remote"}, priorityFederation},
+		{api.InputRoomEvent{Kind: api.KindOld, Origin: "localhost"}, priorityBackfill},
+		{api.InputRoomEvent{Kind: api.KindOld, Origin: "remote"}, priorityBackfill},
+	}
+	for _, tt := range tests {
+		if got := priorityOf("localhost", &tt.input); got != tt.want {
+			t.Errorf("priorityOf(%s from %s): got %s, want %s", tt.input.Kind, tt.input.Origin, got, tt.want)
+		}
+	}
+}
@@ -19,15 +19,19 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/fsck"
 	"github.com/matrix-org/dendrite/roomserver/internal/input"
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
 type Admin struct {
@@ -36,6 +40,8 @@ type Admin struct {
 	Queryer *query.Queryer
 	Inputer *input.Inputer
 	Leaver  *Leaver
+
+	compacting sync.Mutex // held while a state compaction is running
 }
 
 // PerformEvacuateRoom will remove all local users from the given room.
@@ -219,7 +225,7 @@ func (r *Admin) PerformAdminEvacuateUser(
 		if len(outputEvents) == 0 {
 			continue
 		}
-		if err := r.Inputer.OutputProducer.ProduceRoomEvents(roomID, outputEvents); err != nil {
+		if err := r.Inputer.OutputProducer.ProduceRoomEvents(ctx, roomID, outputEvents); err != nil {
 			res.Error = &api.PerformError{
 				Code: api.PerformErrorBadRequest,
 				Msg:  fmt.Sprintf("r.Inputer.WriteOutputEvents: %s", err),
@@ -230,3 +236,109 @@ func (r *Admin) PerformAdminEvacuateUser(
 		res.Affected = append(res.Affected, roomID)
 	}
 }
+
+// PerformAdminResolveEventReport marks a report in the moderation queue as resolved.
+func (r *Admin) PerformAdminResolveEventReport(
+	ctx context.Context,
+	req *api.PerformAdminResolveEventReportRequest,
+	res *api.PerformAdminResolveEventReportResponse,
+) {
+	resolved, err := r.DB.ResolveEventReport(ctx, req.ReportID, req.UserID)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("r.DB.ResolveEventReport: %s", err),
+		}
+		return
+	}
+	if !resolved {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("Report %d does not exist or has already been resolved", req.ReportID),
+		}
+	}
+}
+
+// PerformAdminCompactState merges duplicate state blocks and deletes state
+// which has been unreferenced for longer than the configured grace period.
+// Only one compaction runs at a time.
+func (r *Admin) PerformAdminCompactState(
+	ctx context.Context,
+	req *api.PerformAdminCompactStateRequest,
+	res *api.PerformAdminCompactStateResponse,
+) {
+	if !r.compacting.TryLock() {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNoOperation,
+			Msg:  "A state compaction is already running",
+		}
+		return
+	}
+	defer r.compacting.Unlock()
+
+	start := time.Now()
+	report, err := r.DB.CompactState(ctx, r.Cfg.StateCompaction.GracePeriod)
+	res.Report = report
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("r.DB.CompactState: %s", err),
+		}
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"duration":            time.Since(start),
+		"duplicate_blocks":    report.DuplicateBlocks,
+		"snapshots_rewritten": report.SnapshotsRewritten,
+		"snapshots_deleted":   report.SnapshotsDeleted,
+		"blocks_deleted":      report.BlocksDeleted,
+		"bytes_reclaimed":     report.BytesReclaimed,
+	}).Info("Compacted roomserver state")
+}
+
+// PerformAdminCheckRoom checks the events and state of a room for
+// inconsistencies, and repairs the forward extremities of the room if they
+// are wrong and the request asks for it.
+func (r *Admin) PerformAdminCheckRoom(
+	ctx context.Context,
+	req *api.PerformAdminCheckRoomRequest,
+	res *api.PerformAdminCheckRoomResponse,
+) {
+	checker := &fsck.Checker{
+		DB:       r.DB,
+		Producer: r.Inputer.OutputProducer,
+	}
+	report, err := checker.CheckRoom(ctx, req.RoomID, req.Repair)
+	res.Report = report
+	switch {
+	case err == fsck.ErrUnknownRoom:
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("Room %s is not known", req.RoomID),
+		}
+	case err == fsck.ErrRoomChanged:
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("Room %s changed while it was being checked, so it wasn't repaired, try again", req.RoomID),
+		}
+	case err != nil:
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("checker.CheckRoom: %s", err),
+		}
+	}
+}
+
+// StartStateCompaction runs a state compaction every configured interval
+// until the process shuts down.
+func (r *Admin) StartStateCompaction(process *process.ProcessContext) {
+	var compact func()
+	compact = func() {
+		if process.Context().Err() != nil {
+			return
+		}
+		res := &api.PerformAdminCompactStateResponse{}
+		r.PerformAdminCompactState(process.Context(), &api.PerformAdminCompactStateRequest{}, res)
+		if res.Error != nil {
+			logrus.WithError(res.Error).Error("Failed to compact roomserver state")
+		}
+		time.AfterFunc(r.Cfg.StateCompaction.Interval, compact)
+	}
+	time.AfterFunc(time.Minute, compact)
+}
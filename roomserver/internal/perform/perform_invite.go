@@ -19,6 +19,7 @@ import (
 	"fmt"
 
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/internal/input"
@@ -33,10 +34,11 @@ import (
 )
 
 type Inviter struct {
-	DB      storage.Database
-	Cfg     *config.RoomServer
-	FSAPI   federationAPI.RoomserverFederationAPI
-	Inputer *input.Inputer
+	DB          storage.Database
+	Cfg         *config.RoomServer
+	FSAPI       federationAPI.RoomserverFederationAPI
+	Inputer     *input.Inputer
+	SpamChecker spamcheck.Checker
 }
 
 // nolint:gocyclo
@@ -89,6 +91,25 @@ func (r *Inviter) PerformInvite(
 		"origin_local":     isOriginLocal,
 	}).Debug("processing invite event")
 
+	if r.SpamChecker != nil {
+		spamRes, err := r.SpamChecker.UserMayInvite(ctx, event.Sender(), targetUserID, roomID)
+		if err != nil {
+			return nil, fmt.Errorf("r.SpamChecker.UserMayInvite: %w", err)
+		}
+		if !spamRes.Allowed() {
+			logger.WithField("reason", spamRes.Reason).Info("Invite rejected by spam checker")
+			msg := spamRes.Reason
+			if msg == "" {
+				msg = "This invite has been rejected"
+			}
+			res.Error = &api.PerformError{
+				Code: api.PerformErrorNotAllowed,
+				Msg:  msg,
+			}
+			return nil, nil
+		}
+	}
+
 	inviteState := req.InviteRoomState
 	if len(inviteState) == 0 && info != nil {
 		var is []gomatrixserverlib.InviteV2StrippedState
@@ -0,0 +1,101 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type Reporter struct {
+	DB storage.Database
+}
+
+// PerformReportEvent stores a report of an event in the moderation queue. The
+// reporting user must be joined to the room that the event belongs to.
+func (r *Reporter) PerformReportEvent(
+	ctx context.Context,
+	req *api.PerformReportEventRequest,
+	res *api.PerformReportEventResponse,
+) {
+	// We return the same error whether the event doesn't exist or the user
+	// isn't in the room, so that reports can't be used to probe for events.
+	notFound := &api.PerformError{
+		Code: api.PerformErrorNoRoom,
+		Msg:  fmt.Sprintf("Event %s not found in room %s", req.EventID, req.RoomID),
+	}
+
+	roomInfo, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("r.DB.RoomInfo: %s", err),
+		}
+		return
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		res.Error = notFound
+		return
+	}
+
+	_, stillInRoom, _, err := r.DB.GetMembership(ctx, roomInfo.RoomNID, req.UserID)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("r.DB.GetMembership: %s", err),
+		}
+		return
+	}
+	if !stillInRoom {
+		res.Error = notFound
+		return
+	}
+
+	events, err := r.DB.EventsFromIDs(ctx, []string{req.EventID})
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("r.DB.EventsFromIDs: %s", err),
+		}
+		return
+	}
+	if len(events) == 0 || events[0].Event == nil || events[0].RoomID() != req.RoomID {
+		res.Error = notFound
+		return
+	}
+	event := events[0]
+
+	report := &types.EventReport{
+		RoomID:          req.RoomID,
+		EventID:         req.EventID,
+		ReportingUserID: req.UserID,
+		EventSender:     event.Sender(),
+		Reason:          req.Reason,
+		Score:           req.Score,
+		ReceivedTS:      gomatrixserverlib.AsTimestamp(time.Now()),
+		EventJSON:       event.JSON(),
+	}
+	report.ID, err = r.DB.InsertEventReport(ctx, report)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("r.DB.InsertEventReport: %s", err),
+		}
+		return
+	}
+	res.Report = report
+}
@@ -646,6 +646,33 @@ func (r *Queryer) QueryPublishedRooms(
 	return nil
 }
 
+func (r *Queryer) QueryAdminEventReports(
+	ctx context.Context,
+	req *api.QueryAdminEventReportsRequest,
+	res *api.QueryAdminEventReportsResponse,
+) error {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	reports, total, err := r.DB.EventReports(ctx, &req.Filter, req.From, limit)
+	if err != nil {
+		return err
+	}
+	res.Reports = reports
+	res.Total = total
+	return nil
+}
+
+func (r *Queryer) QueryAdminEventReport(
+	ctx context.Context,
+	req *api.QueryAdminEventReportRequest,
+	res *api.QueryAdminEventReportResponse,
+) (err error) {
+	res.Report, err = r.DB.EventReport(ctx, req.ReportID)
+	return
+}
+
 func (r *Queryer) QueryCurrentState(ctx context.Context, req *api.QueryCurrentStateRequest, res *api.QueryCurrentStateResponse) error {
 	res.StateEvents = make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent)
 	for _, tuple := range req.StateTuples {
@@ -715,6 +742,37 @@ func (r *Queryer) QueryBulkStateContent(ctx context.Context, req *api.QueryBulkS
 	return nil
 }
 
+func (r *Queryer) QueryKnownRooms(ctx context.Context, req *api.QueryKnownRoomsRequest, res *api.QueryKnownRoomsResponse) error {
+	roomIDs, err := r.DB.GetKnownRooms(ctx)
+	if err != nil {
+		return err
+	}
+	res.RoomIDs = roomIDs
+	return nil
+}
+
+func (r *Queryer) QueryRoomEvents(ctx context.Context, req *api.QueryRoomEventsRequest, res *api.QueryRoomEventsResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	res.Position = req.After
+	if info == nil || info.IsStub() {
+		return nil
+	}
+	res.RoomExists = true
+	events, err := r.DB.RoomEventsAfter(ctx, info, types.EventNID(req.After), req.Limit)
+	if err != nil {
+		return err
+	}
+	res.Events = make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		res.Events = append(res.Events, ev.Headered(info.RoomVersion))
+		res.Position = int64(ev.EventNID)
+	}
+	return nil
+}
+
 func (r *Queryer) QuerySharedUsers(ctx context.Context, req *api.QuerySharedUsersRequest, res *api.QuerySharedUsersResponse) error {
 	roomIDs, err := r.DB.GetRoomsByMembership(ctx, req.UserID, "join")
 	if err != nil {
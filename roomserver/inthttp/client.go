@@ -29,18 +29,22 @@ const (
 	RoomserverInputRoomEventsPath = "/roomserver/inputRoomEvents"
 
 	// Perform operations
-	RoomserverPerformInvitePath            = "/roomserver/performInvite"
-	RoomserverPerformPeekPath              = "/roomserver/performPeek"
-	RoomserverPerformUnpeekPath            = "/roomserver/performUnpeek"
-	RoomserverPerformRoomUpgradePath       = "/roomserver/performRoomUpgrade"
-	RoomserverPerformJoinPath              = "/roomserver/performJoin"
-	RoomserverPerformLeavePath             = "/roomserver/performLeave"
-	RoomserverPerformBackfillPath          = "/roomserver/performBackfill"
-	RoomserverPerformPublishPath           = "/roomserver/performPublish"
-	RoomserverPerformInboundPeekPath       = "/roomserver/performInboundPeek"
-	RoomserverPerformForgetPath            = "/roomserver/performForget"
-	RoomserverPerformAdminEvacuateRoomPath = "/roomserver/performAdminEvacuateRoom"
-	RoomserverPerformAdminEvacuateUserPath = "/roomserver/performAdminEvacuateUser"
+	RoomserverPerformInvitePath                  = "/roomserver/performInvite"
+	RoomserverPerformPeekPath                    = "/roomserver/performPeek"
+	RoomserverPerformUnpeekPath                  = "/roomserver/performUnpeek"
+	RoomserverPerformRoomUpgradePath             = "/roomserver/performRoomUpgrade"
+	RoomserverPerformJoinPath                    = "/roomserver/performJoin"
+	RoomserverPerformLeavePath                   = "/roomserver/performLeave"
+	RoomserverPerformBackfillPath                = "/roomserver/performBackfill"
+	RoomserverPerformPublishPath                 = "/roomserver/performPublish"
+	RoomserverPerformInboundPeekPath             = "/roomserver/performInboundPeek"
+	RoomserverPerformForgetPath                  = "/roomserver/performForget"
+	RoomserverPerformAdminEvacuateRoomPath       = "/roomserver/performAdminEvacuateRoom"
+	RoomserverPerformAdminEvacuateUserPath       = "/roomserver/performAdminEvacuateUser"
+	RoomserverPerformAdminResolveEventReportPath = "/roomserver/performAdminResolveEventReport"
+	RoomserverPerformAdminCompactStatePath       = "/roomserver/performAdminCompactState"
+	RoomserverPerformAdminCheckRoomPath          = "/roomserver/performAdminCheckRoom"
+	RoomserverPerformReportEventPath             = "/roomserver/performReportEvent"
 
 	// Query operations
 	RoomserverQueryLatestEventsAndStatePath    = "/roomserver/queryLatestEventsAndState"
@@ -59,10 +63,15 @@ const (
 	RoomserverQueryRoomsForUserPath            = "/roomserver/queryRoomsForUser"
 	RoomserverQueryBulkStateContentPath        = "/roomserver/queryBulkStateContent"
 	RoomserverQuerySharedUsersPath             = "/roomserver/querySharedUsers"
+	RoomserverQueryKnownRoomsPath              = "/roomserver/queryKnownRooms"
+	RoomserverQueryRoomEventsPath              = "/roomserver/queryRoomEvents"
 	RoomserverQueryKnownUsersPath              = "/roomserver/queryKnownUsers"
 	RoomserverQueryServerBannedFromRoomPath    = "/roomserver/queryServerBannedFromRoom"
 	RoomserverQueryAuthChainPath               = "/roomserver/queryAuthChain"
 	RoomserverQueryRestrictedJoinAllowed       = "/roomserver/queryRestrictedJoinAllowed"
+	RoomserverQueryAdminEventReportsPath       = "/roomserver/queryAdminEventReports"
+	RoomserverQueryAdminEventReportPath        = "/roomserver/queryAdminEventReport"
+	RoomserverQueryAdminInputQueuesPath        = "/roomserver/queryAdminInputQueues"
 )
 
 type httpRoomserverInternalAPI struct {
@@ -306,6 +315,74 @@ func (h *httpRoomserverInternalAPI) PerformAdminEvacuateRoom(
 	}
 }
 
+func (h *httpRoomserverInternalAPI) PerformAdminResolveEventReport(
+	ctx context.Context,
+	req *api.PerformAdminResolveEventReportRequest,
+	res *api.PerformAdminResolveEventReportResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformAdminResolveEventReport")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformAdminResolveEventReportPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformAdminCompactState(
+	ctx context.Context,
+	req *api.PerformAdminCompactStateRequest,
+	res *api.PerformAdminCompactStateResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformAdminCompactState")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformAdminCompactStatePath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformAdminCheckRoom(
+	ctx context.Context,
+	req *api.PerformAdminCheckRoomRequest,
+	res *api.PerformAdminCheckRoomResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformAdminCheckRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformAdminCheckRoomPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformReportEvent(
+	ctx context.Context,
+	req *api.PerformReportEventRequest,
+	res *api.PerformReportEventResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformReportEvent")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformReportEventPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
 func (h *httpRoomserverInternalAPI) PerformAdminEvacuateUser(
 	ctx context.Context,
 	req *api.PerformAdminEvacuateUserRequest,
@@ -374,6 +451,42 @@ func (h *httpRoomserverInternalAPI) QueryPublishedRooms(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+func (h *httpRoomserverInternalAPI) QueryAdminEventReports(
+	ctx context.Context,
+	request *api.QueryAdminEventReportsRequest,
+	response *api.QueryAdminEventReportsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAdminEventReports")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryAdminEventReportsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpRoomserverInternalAPI) QueryAdminEventReport(
+	ctx context.Context,
+	request *api.QueryAdminEventReportRequest,
+	response *api.QueryAdminEventReportResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAdminEventReport")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryAdminEventReportPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpRoomserverInternalAPI) QueryAdminInputQueues(
+	ctx context.Context,
+	request *api.QueryAdminInputQueuesRequest,
+	response *api.QueryAdminInputQueuesResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAdminInputQueues")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryAdminInputQueuesPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryMembershipForUser implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryMembershipForUser(
 	ctx context.Context,
@@ -546,6 +659,26 @@ func (h *httpRoomserverInternalAPI) QuerySharedUsers(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 }
 
+func (h *httpRoomserverInternalAPI) QueryKnownRooms(
+	ctx context.Context, req *api.QueryKnownRoomsRequest, res *api.QueryKnownRoomsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryKnownRooms")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryKnownRoomsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryRoomEvents(
+	ctx context.Context, req *api.QueryRoomEventsRequest, res *api.QueryRoomEventsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomEvents")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomEventsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
 func (h *httpRoomserverInternalAPI) QueryKnownUsers(
 	ctx context.Context, req *api.QueryKnownUsersRequest, res *api.QueryKnownUsersResponse,
 ) error {
@@ -140,6 +140,92 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(RoomserverPerformAdminResolveEventReportPath,
+		httputil.MakeInternalAPI("performAdminResolveEventReport", func(req *http.Request) util.JSONResponse {
+			var request api.PerformAdminResolveEventReportRequest
+			var response api.PerformAdminResolveEventReportResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			r.PerformAdminResolveEventReport(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverPerformAdminCompactStatePath,
+		httputil.MakeInternalAPI("performAdminCompactState", func(req *http.Request) util.JSONResponse {
+			var request api.PerformAdminCompactStateRequest
+			var response api.PerformAdminCompactStateResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			r.PerformAdminCompactState(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverPerformAdminCheckRoomPath,
+		httputil.MakeInternalAPI("performAdminCheckRoom", func(req *http.Request) util.JSONResponse {
+			var request api.PerformAdminCheckRoomRequest
+			var response api.PerformAdminCheckRoomResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			r.PerformAdminCheckRoom(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverPerformReportEventPath,
+		httputil.MakeInternalAPI("performReportEvent", func(req *http.Request) util.JSONResponse {
+			var request api.PerformReportEventRequest
+			var response api.PerformReportEventResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			r.PerformReportEvent(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		RoomserverQueryAdminEventReportsPath,
+		httputil.MakeInternalAPI("queryAdminEventReports", func(req *http.Request) util.JSONResponse {
+			var request api.QueryAdminEventReportsRequest
+			var response api.QueryAdminEventReportsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryAdminEventReports(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		RoomserverQueryAdminEventReportPath,
+		httputil.MakeInternalAPI("queryAdminEventReport", func(req *http.Request) util.JSONResponse {
+			var request api.QueryAdminEventReportRequest
+			var response api.QueryAdminEventReportResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryAdminEventReport(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		RoomserverQueryAdminInputQueuesPath,
+		httputil.MakeInternalAPI("queryAdminInputQueues", func(req *http.Request) util.JSONResponse {
+			var request api.QueryAdminInputQueuesRequest
+			var response api.QueryAdminInputQueuesResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryAdminInputQueues(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(
 		RoomserverQueryPublishedRoomsPath,
 		httputil.MakeInternalAPI("queryPublishedRooms", func(req *http.Request) util.JSONResponse {
@@ -444,6 +530,32 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(RoomserverQueryKnownRoomsPath,
+		httputil.MakeInternalAPI("queryKnownRooms", func(req *http.Request) util.JSONResponse {
+			request := api.QueryKnownRoomsRequest{}
+			response := api.QueryKnownRoomsResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryKnownRooms(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryRoomEventsPath,
+		httputil.MakeInternalAPI("queryRoomEvents", func(req *http.Request) util.JSONResponse {
+			request := api.QueryRoomEventsRequest{}
+			response := api.QueryRoomEventsResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryRoomEvents(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(RoomserverQueryKnownUsersPath,
 		httputil.MakeInternalAPI("queryKnownUsers", func(req *http.Request) util.JSONResponse {
 			request := api.QueryKnownUsersRequest{}
@@ -15,6 +15,7 @@
 package producers
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/matrix-org/dendrite/roomserver/acls"
@@ -37,7 +38,7 @@ type RoomEventProducer struct {
 	JetStream nats.JetStreamContext
 }
 
-func (r *RoomEventProducer) ProduceRoomEvents(roomID string, updates []api.OutputEvent) error {
+func (r *RoomEventProducer) ProduceRoomEvents(ctx context.Context, roomID string, updates []api.OutputEvent) error {
 	var err error
 	for _, update := range updates {
 		msg := &nats.Msg{
@@ -45,6 +46,7 @@ func (r *RoomEventProducer) ProduceRoomEvents(roomID string, updates []api.Outpu
 			Header:  nats.Header{},
 		}
 		msg.Header.Set(jetstream.RoomID, roomID)
+		jetstream.InjectSpan(ctx, msg)
 		msg.Data, err = json.Marshal(update)
 		if err != nil {
 			return err
@@ -2,11 +2,14 @@ package roomserver_test
 
 import (
 	"context"
+	"net/http"
 	"testing"
 
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/base"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/dendrite/test/testrig"
@@ -67,3 +70,310 @@ func Test_SharedUsers(t *testing.T) {
 		}
 	})
 }
+
+func Test_ReportEvent(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	reportedEvent := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "spam",
+	})
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, _, close := mustCreateDatabase(t, dbType)
+		defer close()
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		// SetFederationAPI starts the room event input consumer
+		rsAPI.SetFederationAPI(nil, nil)
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		// Bob isn't in the room, so can't report the event
+		res := &api.PerformReportEventResponse{}
+		rsAPI.PerformReportEvent(ctx, &api.PerformReportEventRequest{
+			RoomID: room.ID, EventID: reportedEvent.EventID(), UserID: bob.ID,
+		}, res)
+		if res.Error == nil || res.Error.Code != api.PerformErrorNoRoom {
+			t.Fatalf("expected report from non-member to fail, got %+v", res.Error)
+		}
+
+		// Alice reporting an unknown event should fail in the same way
+		res = &api.PerformReportEventResponse{}
+		rsAPI.PerformReportEvent(ctx, &api.PerformReportEventRequest{
+			RoomID: room.ID, EventID: "$doesnotexist", UserID: alice.ID,
+		}, res)
+		if res.Error == nil || res.Error.Code != api.PerformErrorNoRoom {
+			t.Fatalf("expected report of unknown event to fail, got %+v", res.Error)
+		}
+
+		res = &api.PerformReportEventResponse{}
+		rsAPI.PerformReportEvent(ctx, &api.PerformReportEventRequest{
+			RoomID: room.ID, EventID: reportedEvent.EventID(), UserID: alice.ID, Reason: "spam", Score: -100,
+		}, res)
+		if res.Error != nil {
+			t.Fatalf("failed to report event: %v", res.Error)
+		}
+
+		queryRes := &api.QueryAdminEventReportsResponse{}
+		if err := rsAPI.QueryAdminEventReports(ctx, &api.QueryAdminEventReportsRequest{}, queryRes); err != nil {
+			t.Fatalf("failed to query event reports: %v", err)
+		}
+		if queryRes.Total != 1 || len(queryRes.Reports) != 1 {
+			t.Fatalf("expected one report, got %+v", queryRes)
+		}
+		report := queryRes.Reports[0]
+		if report.ID != res.Report.ID || report.EventSender != alice.ID || report.Reason != "spam" || len(report.EventJSON) == 0 {
+			t.Fatalf("unexpected report: %+v", report)
+		}
+
+		resolveRes := &api.PerformAdminResolveEventReportResponse{}
+		rsAPI.PerformAdminResolveEventReport(ctx, &api.PerformAdminResolveEventReportRequest{ReportID: report.ID, UserID: alice.ID}, resolveRes)
+		if resolveRes.Error != nil {
+			t.Fatalf("failed to resolve report: %v", resolveRes.Error)
+		}
+		if err := rsAPI.QueryAdminEventReports(ctx, &api.QueryAdminEventReportsRequest{}, queryRes); err != nil {
+			t.Fatalf("failed to query event reports: %v", err)
+		}
+		if queryRes.Total != 0 {
+			t.Fatalf("expected resolved report to be hidden, got %+v", queryRes)
+		}
+
+		// Resolving it again, or resolving a report which doesn't exist, is
+		// a bad request rather than an internal error.
+		for _, reportID := range []int64{report.ID, report.ID + 100} {
+			resolveRes = &api.PerformAdminResolveEventReportResponse{}
+			rsAPI.PerformAdminResolveEventReport(ctx, &api.PerformAdminResolveEventReportRequest{ReportID: reportID, UserID: alice.ID}, resolveRes)
+			if resolveRes.Error == nil || resolveRes.Error.JSONResponse().Code != http.StatusBadRequest {
+				t.Fatalf("expected resolving report %d to be a bad request, got %+v", reportID, resolveRes.Error)
+			}
+		}
+	})
+}
+
+func Test_CompactState(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, alice, "m.room.topic", map[string]interface{}{"topic": "first"}, test.WithStateKey(""))
+	room.CreateAndInsert(t, alice, "m.room.topic", map[string]interface{}{"topic": "second"}, test.WithStateKey(""))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+		// Delete unreferenced state straight away, rather than on the next run.
+		base.Cfg.RoomServer.StateCompaction.GracePeriod = 0
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		// SetFederationAPI starts the room event input consumer
+		rsAPI.SetFederationAPI(nil, nil)
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		db, err := storage.Open(base, &base.Cfg.RoomServer.Database, base.Caches)
+		if err != nil {
+			t.Fatalf("failed to create Database: %v", err)
+		}
+
+		// Store some state which nothing refers to.
+		roomInfo, err := db.RoomInfo(ctx, room.ID)
+		if err != nil || roomInfo == nil {
+			t.Fatalf("failed to get room info: %v", err)
+		}
+		unreferenced, err := db.AddState(ctx, roomInfo.RoomNID, nil, []types.StateEntry{{
+			StateKeyTuple: types.StateKeyTuple{EventTypeNID: 999, EventStateKeyNID: 999},
+			EventNID:      999999,
+		}})
+		if err != nil {
+			t.Fatalf("failed to add state: %v", err)
+		}
+
+		res := &api.PerformAdminCompactStateResponse{}
+		rsAPI.PerformAdminCompactState(ctx, &api.PerformAdminCompactStateRequest{}, res)
+		if res.Error != nil {
+			t.Fatalf("failed to compact state: %v", res.Error)
+		}
+		if res.Report.SnapshotsDeleted < 1 || res.Report.BlocksDeleted < 1 || res.Report.BytesReclaimed <= 0 {
+			t.Fatalf("expected unreferenced state to be deleted, got %+v", res.Report)
+		}
+		if _, err = db.StateBlockNIDs(ctx, []types.StateSnapshotNID{unreferenced}); err == nil {
+			t.Fatalf("expected snapshot %d to be deleted", unreferenced)
+		}
+
+		// The state of the room must be unaffected.
+		stateRes := &api.QueryLatestEventsAndStateResponse{}
+		if err = rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{RoomID: room.ID}, stateRes); err != nil {
+			t.Fatalf("failed to query state: %v", err)
+		}
+		if len(stateRes.StateEvents) != len(room.CurrentState()) {
+			t.Fatalf("got %d state events, want %d", len(stateRes.StateEvents), len(room.CurrentState()))
+		}
+
+		// Nothing is left to do on a second run.
+		res = &api.PerformAdminCompactStateResponse{}
+		rsAPI.PerformAdminCompactState(ctx, &api.PerformAdminCompactStateRequest{}, res)
+		if res.Error != nil {
+			t.Fatalf("failed to compact state: %v", res.Error)
+		}
+		if res.Report.SnapshotsDeleted != 0 || res.Report.BlocksDeleted != 0 {
+			t.Fatalf("expected nothing to be deleted, got %+v", res.Report)
+		}
+	})
+}
+
+func Test_CheckRoom(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, alice, "m.room.topic", map[string]interface{}{"topic": "first"}, test.WithStateKey(""))
+	room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		// SetFederationAPI starts the room event input consumer
+		rsAPI.SetFederationAPI(nil, nil)
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		db, err := storage.Open(base, &base.Cfg.RoomServer.Database, base.Caches)
+		if err != nil {
+			t.Fatalf("failed to create Database: %v", err)
+		}
+
+		checkRoom := func(repair bool) *types.RoomCheckReport {
+			t.Helper()
+			res := &api.PerformAdminCheckRoomResponse{}
+			rsAPI.PerformAdminCheckRoom(ctx, &api.PerformAdminCheckRoomRequest{RoomID: room.ID, Repair: repair}, res)
+			if res.Error != nil {
+				t.Fatalf("failed to check room: %v", res.Error)
+			}
+			return res.Report
+		}
+
+		// A room which was built normally is consistent.
+		report := checkRoom(false)
+		if report.EventsChecked != int64(len(room.Events())) {
+			t.Fatalf("checked %d events, want %d", report.EventsChecked, len(room.Events()))
+		}
+		if report.StatesChecked == 0 || len(report.Problems) != 0 {
+			t.Fatalf("expected states to be checked without problems, got %+v", report)
+		}
+
+		// Make the create event the only forward extremity.
+		roomInfo, err := db.RoomInfo(ctx, room.ID)
+		if err != nil || roomInfo == nil {
+			t.Fatalf("failed to get room info: %v", err)
+		}
+		create := room.Events()[0]
+		stateAtCreate, err := db.StateAtEventIDs(ctx, []string{create.EventID()})
+		if err != nil {
+			t.Fatalf("failed to get state at create event: %v", err)
+		}
+		updater, err := db.GetRoomUpdater(ctx, roomInfo)
+		if err != nil {
+			t.Fatalf("failed to get room updater: %v", err)
+		}
+		if err = updater.SetLatestEvents(roomInfo.RoomNID, []types.StateAtEventAndReference{{
+			StateAtEvent:   stateAtCreate[0],
+			EventReference: create.EventReference(),
+		}}, stateAtCreate[0].EventNID, roomInfo.StateSnapshotNID()); err != nil {
+			t.Fatalf("failed to set latest events: %v", err)
+		}
+		if err = updater.Commit(); err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+
+		report = checkRoom(false)
+		if len(report.Problems) != 2 {
+			t.Fatalf("expected 2 problems, got %+v", report.Problems)
+		}
+		for _, problem := range report.Problems {
+			if problem.Check != types.RoomCheckForwardExtremities || problem.Repaired {
+				t.Fatalf("unexpected problem %+v", problem)
+			}
+		}
+
+		report = checkRoom(true)
+		for _, problem := range report.Problems {
+			if !problem.Repaired {
+				t.Fatalf("expected problem to be repaired: %+v", problem)
+			}
+		}
+		latest, _, _, err := db.LatestEventIDs(ctx, roomInfo.RoomNID)
+		if err != nil {
+			t.Fatalf("failed to get latest events: %v", err)
+		}
+		lastEvent := room.Events()[len(room.Events())-1]
+		if len(latest) != 1 || latest[0].EventID != lastEvent.EventID() {
+			t.Fatalf("expected %s to be the only forward extremity, got %+v", lastEvent.EventID(), latest)
+		}
+		if report = checkRoom(false); len(report.Problems) != 0 {
+			t.Fatalf("expected no problems after repair, got %+v", report.Problems)
+		}
+	})
+}
+
+// rejectMessages is a spam checker which rejects every message event.
+type rejectMessages struct {
+	spamcheck.Checker
+}
+
+func (rejectMessages) CheckEvent(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, origin gomatrixserverlib.ServerName) (spamcheck.Result, error) {
+	if event.Type() == "m.room.message" {
+		return spamcheck.Result{Decision: spamcheck.Reject, Reason: "spam"}, nil
+	}
+	return spamcheck.Result{Decision: spamcheck.Allow}, nil
+}
+
+func Test_SpamCheckerRejectsOnlyLocalEvents(t *testing.T) {
+	alice := test.NewUser(t)
+	localRoom := test.NewRoom(t, alice)
+	localMsg := localRoom.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "spam"})
+	federatedRoom := test.NewRoom(t, alice)
+	federatedMsg := federatedRoom.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "spam"})
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+		base.SpamChecker.Add(rejectMessages{}, false)
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		// SetFederationAPI starts the room event input consumer
+		rsAPI.SetFederationAPI(nil, nil)
+		for _, room := range []*test.Room{localRoom, federatedRoom} {
+			events := room.Events()
+			if err := api.SendEvents(ctx, rsAPI, api.KindNew, events[:len(events)-1], "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+
+		// Messages from local users are rejected, so the client is told.
+		err := api.SendEvents(ctx, rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{localMsg}, "test", "test", nil, false)
+		if err == nil {
+			t.Fatalf("expected the local message to be rejected")
+		}
+
+		// Messages from other servers are soft-failed instead, so they are
+		// accepted but don't become part of the room here.
+		err = api.SendEvents(ctx, rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{federatedMsg}, "remote", api.DoNotSendToOtherServers, nil, false)
+		if err != nil {
+			t.Fatalf("expected the federated message to be soft-failed, got %v", err)
+		}
+		res := &api.QueryLatestEventsAndStateResponse{}
+		if err = rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{RoomID: federatedRoom.ID}, res); err != nil {
+			t.Fatalf("failed to query latest events: %v", err)
+		}
+		for _, latest := range res.LatestEvents {
+			if latest.EventID == federatedMsg.EventID() {
+				t.Fatalf("expected the federated message not to be a forward extremity")
+			}
+		}
+	})
+}
@@ -580,10 +580,75 @@ func (c *calculateStateMetrics) stop(stateNID types.StateSnapshotNID, err error)
 	return stateNID, err
 }
 
+var stateResolutionDurations = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "state_resolution_duration_milliseconds",
+		Help:      "How long it takes to resolve conflicts in the room state",
+		Buckets: []float64{ // milliseconds
+			1, 5, 10, 25, 50, 75, 100, 200, 300, 400, 500,
+			1000, 2000, 3000, 4000, 5000, 6000,
+			7000, 8000, 9000, 10000, 15000, 20000, 30000,
+		},
+	},
+	// algorithm is the state resolution algorithm of the room version, either
+	// "v1" or "v2", and outcome is whether the conflicts were resolved.
+	[]string{"algorithm", "outcome"},
+)
+
+var stateResolutionStateLength = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "state_resolution_state_length",
+		Help:      "The number of state entries given to state resolution",
+		Buckets:   prometheus.ExponentialBuckets(8, 2, 14), // 8 to 65536
+	},
+	[]string{"algorithm", "outcome"},
+)
+
+var stateResolutionConflictLength = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "state_resolution_conflict_length",
+		Help:      "The number of conflicted state entries given to state resolution",
+		Buckets:   prometheus.ExponentialBuckets(2, 2, 14), // 2 to 16384
+	},
+	[]string{"algorithm", "outcome"},
+)
+
+type stateResolutionMetrics struct {
+	algorithm      string
+	startTime      time.Time
+	stateLength    int
+	conflictLength int
+}
+
+func (m *stateResolutionMetrics) stop(entries []types.StateEntry, err error) ([]types.StateEntry, error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	stateResolutionDurations.WithLabelValues(m.algorithm, outcome).Observe(
+		float64(time.Since(m.startTime).Milliseconds()),
+	)
+	stateResolutionStateLength.WithLabelValues(m.algorithm, outcome).Observe(
+		float64(m.stateLength),
+	)
+	stateResolutionConflictLength.WithLabelValues(m.algorithm, outcome).Observe(
+		float64(m.conflictLength),
+	)
+	return entries, err
+}
+
 func init() {
 	prometheus.MustRegister(
 		calculateStateDurations, calculateStatePrevEventLength,
 		calculateStateFullStateLength, calculateStateConflictLength,
+		stateResolutionDurations, stateResolutionStateLength,
+		stateResolutionConflictLength,
 	)
 }
 
@@ -673,6 +738,27 @@ func (v *StateResolution) CalculateAndStoreStateAfterEvents(
 	return stateNID, nil
 }
 
+// CalculateStateAfterEvents finds the room state after the given events,
+// without storing it in the database. Returns a list of state entries sorted
+// by state key.
+func (v *StateResolution) CalculateStateAfterEvents(
+	ctx context.Context,
+	prevStates []types.StateAtEvent,
+) ([]types.StateEntry, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "StateResolution.CalculateStateAfterEvents")
+	defer span.Finish()
+
+	if len(prevStates) == 0 {
+		return nil, nil
+	}
+	state, _, _, err := v.calculateStateAfterManyEvents(ctx, v.roomInfo.RoomVersion, prevStates)
+	if err != nil {
+		return nil, fmt.Errorf("v.calculateStateAfterManyEvents: %w", err)
+	}
+	sort.Sort(stateEntrySorter(state))
+	return state, nil
+}
+
 // maxStateBlockNIDs is the maximum number of state data blocks to use to encode a snapshot of room state.
 // Increasing this number means that we can encode more of the state changes as simple deltas which means that
 // we need fewer entries in the state data table. However making this number bigger will increase the size of
@@ -772,11 +858,18 @@ func (v *StateResolution) resolveConflicts(
 	if err != nil {
 		return nil, err
 	}
+	metrics := stateResolutionMetrics{
+		startTime:      time.Now(),
+		stateLength:    len(notConflicted) + len(conflicted),
+		conflictLength: len(conflicted),
+	}
 	switch stateResAlgo {
 	case gomatrixserverlib.StateResV1:
-		return v.resolveConflictsV1(ctx, notConflicted, conflicted)
+		metrics.algorithm = "v1"
+		return metrics.stop(v.resolveConflictsV1(ctx, notConflicted, conflicted))
 	case gomatrixserverlib.StateResV2:
-		return v.resolveConflictsV2(ctx, notConflicted, conflicted)
+		metrics.algorithm = "v2"
+		return metrics.stop(v.resolveConflictsV2(ctx, notConflicted, conflicted))
 	}
 	return nil, fmt.Errorf("unsupported state resolution algorithm %v", stateResAlgo)
 }
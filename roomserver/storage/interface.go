@@ -16,6 +16,7 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
@@ -39,6 +40,9 @@ type Database interface {
 	MissingAuthPrevEvents(
 		ctx context.Context, e *gomatrixserverlib.Event,
 	) (missingAuth, missingPrev []string, err error)
+	// IsEventReferenced returns true if any event in the database refers to the
+	// given event as one of its prev events.
+	IsEventReferenced(ctx context.Context, eventReference gomatrixserverlib.EventReference) (bool, error)
 
 	// Look up the state of a room at each event for a list of string event IDs.
 	// Returns an error if there is an error talking to the database.
@@ -69,6 +73,9 @@ type Database interface {
 	// Look up the Events for a list of numeric event IDs.
 	// Returns a sorted list of events.
 	Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error)
+	// Look up up to limit events in a room after the given numeric event ID, in the order
+	// that they were stored. Events without state, or which were rejected, are skipped.
+	RoomEventsAfter(ctx context.Context, roomInfo *types.RoomInfo, afterNID types.EventNID, limit int) ([]types.Event, error)
 	// Look up snapshot NID for an event ID string
 	SnapshotNIDFromEventID(ctx context.Context, eventID string) (types.StateSnapshotNID, error)
 	// Stores a matrix room event in the database. Returns the room NID, the state snapshot and the redacted event ID if any, or an error.
@@ -141,6 +148,14 @@ type Database interface {
 	GetPublishedRooms(ctx context.Context) ([]string, error)
 	// Returns whether a given room is published or not.
 	GetPublishedRoom(ctx context.Context, roomID string) (bool, error)
+	// Store a new event report from a local user, returning the ID of the report.
+	InsertEventReport(ctx context.Context, report *types.EventReport) (int64, error)
+	// Returns event reports matching the filter, newest first, along with the total number of matching reports.
+	EventReports(ctx context.Context, filter *types.EventReportFilter, from int64, limit int) ([]types.EventReport, int64, error)
+	// Returns the event report with the given ID, or nil if it doesn't exist.
+	EventReport(ctx context.Context, reportID int64) (*types.EventReport, error)
+	// Marks an event report as resolved. Returns false if the report doesn't exist or was already resolved.
+	ResolveEventReport(ctx context.Context, reportID int64, resolvedBy string) (bool, error)
 
 	// TODO: factor out - from currentstateserver
 
@@ -164,6 +179,9 @@ type Database interface {
 	GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]string, error)
 	// GetKnownRooms returns a list of all rooms we know about.
 	GetKnownRooms(ctx context.Context) ([]string, error)
+	// CompactState merges state blocks with identical contents, then deletes state snapshots and
+	// state blocks which have been unreferenced for at least gracePeriod.
+	CompactState(ctx context.Context, gracePeriod time.Duration) (*types.StateCompactionReport, error)
 	// ForgetRoom sets a flag in the membership table, that the user wishes to forget a specific room
 	ForgetRoom(ctx context.Context, userID, roomID string, forget bool) error
 
@@ -0,0 +1,45 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpStateGCMarks(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE roomserver_state_snapshots ADD COLUMN IF NOT EXISTS gc_marked_at BIGINT;
+ALTER TABLE roomserver_state_block ADD COLUMN IF NOT EXISTS gc_marked_at BIGINT;
+CREATE INDEX IF NOT EXISTS roomserver_state_snapshots_gc_marked_at_idx ON roomserver_state_snapshots (gc_marked_at) WHERE gc_marked_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS roomserver_state_block_gc_marked_at_idx ON roomserver_state_block (gc_marked_at) WHERE gc_marked_at IS NOT NULL;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownStateGCMarks(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+DROP INDEX IF EXISTS roomserver_state_snapshots_gc_marked_at_idx;
+DROP INDEX IF EXISTS roomserver_state_block_gc_marked_at_idx;
+ALTER TABLE roomserver_state_snapshots DROP COLUMN IF EXISTS gc_marked_at;
+ALTER TABLE roomserver_state_block DROP COLUMN IF EXISTS gc_marked_at;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
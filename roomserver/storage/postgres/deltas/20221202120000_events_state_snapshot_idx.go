@@ -0,0 +1,57 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpEventsStateSnapshotIndex adds the index which state compaction uses to
+// find snapshots which aren't referenced by any event. The events table can
+// be very large, so the index is built concurrently rather than locking the
+// table against writes while it is built, which can't be done in a
+// transaction.
+func UpEventsStateSnapshotIndex(ctx context.Context, db *sql.DB) error {
+	// If building the index failed part way through, it is left behind but
+	// marked as invalid, and has to be dropped before trying again.
+	var valid bool
+	err := db.QueryRowContext(ctx, `
+SELECT indisvalid FROM pg_index
+WHERE indexrelid = to_regclass('roomserver_events_state_snapshot_nid_idx');`).Scan(&valid)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return fmt.Errorf("failed to check for an existing index: %w", err)
+	case !valid:
+		if _, err = db.ExecContext(ctx, `DROP INDEX CONCURRENTLY IF EXISTS roomserver_events_state_snapshot_nid_idx;`); err != nil {
+			return fmt.Errorf("failed to drop invalid index: %w", err)
+		}
+	}
+	_, err = db.ExecContext(ctx, `CREATE INDEX CONCURRENTLY IF NOT EXISTS roomserver_events_state_snapshot_nid_idx ON roomserver_events (state_snapshot_nid);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownEventsStateSnapshotIndex(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `DROP INDEX CONCURRENTLY IF EXISTS roomserver_events_state_snapshot_nid_idx;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import "github.com/matrix-org/dendrite/internal/sqlutil"
+
+// StateBlocksRefactorMigration only applies to databases from before migrations
+// were tracked, so it is only executed when the old schema is found and isn't
+// listed in Migrations.
+var StateBlocksRefactorMigration = sqlutil.Migration{
+	Version: "roomserver: state blocks refactor",
+	Up:      UpStateBlocksRefactor,
+}
+
+var (
+	AddForgottenColumnMigration = sqlutil.Migration{
+		Version: "roomserver: add forgotten column",
+		Up:      UpAddForgottenColumn,
+		Down:    DownAddForgottenColumn,
+	}
+	StateGCMarksMigration = sqlutil.Migration{
+		Version: "roomserver: state compaction marks",
+		Up:      UpStateGCMarks,
+		Down:    DownStateGCMarks,
+	}
+	EventsStateSnapshotIndexMigration = sqlutil.Migration{
+		Version:        "roomserver: index events by state snapshot",
+		UpWithoutTxn:   UpEventsStateSnapshotIndex,
+		DownWithoutTxn: DownEventsStateSnapshotIndex,
+	}
+)
+
+var Migrations = []sqlutil.Migration{
+	AddForgottenColumnMigration,
+	StateGCMarksMigration,
+	EventsStateSnapshotIndexMigration,
+}
@@ -136,6 +136,13 @@ const selectMaxEventDepthSQL = "" +
 const selectRoomNIDsForEventNIDsSQL = "" +
 	"SELECT event_nid, room_nid FROM roomserver_events WHERE event_nid = ANY($1)"
 
+// Events which we don't have the state for, or which were rejected, are never
+// sent to the output stream so are left out.
+const selectRoomEventNIDsAfterSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1 AND event_nid > $2" +
+	" AND state_snapshot_nid != 0 AND is_rejected = FALSE" +
+	" ORDER BY event_nid ASC LIMIT $3"
+
 type eventStatements struct {
 	insertEventStmt                        *sql.Stmt
 	selectEventStmt                        *sql.Stmt
@@ -149,6 +156,7 @@ type eventStatements struct {
 	bulkSelectStateAtEventAndReferenceStmt *sql.Stmt
 	bulkSelectEventReferenceStmt           *sql.Stmt
 	bulkSelectEventIDStmt                  *sql.Stmt
+	selectRoomEventNIDsAfterStmt           *sql.Stmt
 	bulkSelectEventNIDStmt                 *sql.Stmt
 	bulkSelectUnsentEventNIDStmt           *sql.Stmt
 	selectMaxEventDepthStmt                *sql.Stmt
@@ -176,6 +184,7 @@ func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectStateAtEventAndReferenceStmt, bulkSelectStateAtEventAndReferenceSQL},
 		{&s.bulkSelectEventReferenceStmt, bulkSelectEventReferenceSQL},
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
+		{&s.selectRoomEventNIDsAfterStmt, selectRoomEventNIDsAfterSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		{&s.bulkSelectUnsentEventNIDStmt, bulkSelectUnsentEventNIDSQL},
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
@@ -533,6 +542,25 @@ func (s *eventStatements) SelectRoomNIDsForEventNIDs(
 	return result, nil
 }
 
+func (s *eventStatements) SelectRoomEventNIDsAfter(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, afterNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomEventNIDsAfterStmt).QueryContext(ctx, roomNID, afterNID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomEventNIDsAfter: rows.close() failed")
+	var eventNIDs []types.EventNID
+	var eventNID types.EventNID
+	for rows.Next() {
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+	return eventNIDs, rows.Err()
+}
+
 func eventNIDsAsArray(eventNIDs []types.EventNID) pq.Int64Array {
 	nids := make([]int64, len(eventNIDs))
 	for i := range eventNIDs {
@@ -178,10 +178,7 @@ func CreateMembershipTable(db *sql.DB) error {
 		return err
 	}
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(sqlutil.Migration{
-		Version: "roomserver: add forgotten column",
-		Up:      deltas.UpAddForgottenColumn,
-	})
+	m.AddMigrations(deltas.AddForgottenColumnMigration)
 	return m.Up(context.Background())
 }
 
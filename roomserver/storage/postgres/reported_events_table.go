@@ -0,0 +1,182 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const reportedEventsSchema = `
+-- Stores events which have been reported by local users for moderation
+CREATE TABLE IF NOT EXISTS roomserver_reported_events (
+    -- The ID of the report
+    id BIGSERIAL PRIMARY KEY,
+    -- The room and event which were reported
+    room_id TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    -- The local user who made the report
+    reporting_user_id TEXT NOT NULL,
+    -- The sender of the reported event
+    event_sender TEXT NOT NULL,
+    -- The reason and score given by the reporting user
+    reason TEXT NOT NULL DEFAULT '',
+    score BIGINT NOT NULL DEFAULT 0,
+    -- When the report was received
+    received_ts BIGINT NOT NULL,
+    -- A snapshot of the event JSON at the time of the report
+    event_json TEXT NOT NULL DEFAULT '',
+    -- The admin who resolved the report, or the empty string if unresolved
+    resolved_by TEXT NOT NULL DEFAULT '',
+    resolved_ts BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS roomserver_reported_events_room_id_idx ON roomserver_reported_events(room_id);
+`
+
+const insertReportedEventSQL = "" +
+	"INSERT INTO roomserver_reported_events" +
+	" (room_id, event_id, reporting_user_id, event_sender, reason, score, received_ts, event_json)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	" RETURNING id"
+
+const reportedEventsFilterSQL = "" +
+	" WHERE ($1::TEXT = '' OR room_id = $1)" +
+	" AND ($2::TEXT = '' OR reporting_user_id = $2)" +
+	" AND ($3::BOOLEAN OR resolved_by = '')"
+
+const selectReportedEventsSQL = "" +
+	"SELECT id, room_id, event_id, reporting_user_id, event_sender, reason, score, received_ts, event_json, resolved_by, resolved_ts" +
+	" FROM roomserver_reported_events" + reportedEventsFilterSQL +
+	" AND ($4::BIGINT = 0 OR id < $4)" +
+	" ORDER BY id DESC LIMIT $5"
+
+const selectReportedEventsCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_reported_events" + reportedEventsFilterSQL
+
+const selectReportedEventSQL = "" +
+	"SELECT id, room_id, event_id, reporting_user_id, event_sender, reason, score, received_ts, event_json, resolved_by, resolved_ts" +
+	" FROM roomserver_reported_events WHERE id = $1"
+
+const updateReportedEventResolvedSQL = "" +
+	"UPDATE roomserver_reported_events SET resolved_by = $1, resolved_ts = $2" +
+	" WHERE id = $3 AND resolved_by = ''"
+
+type reportedEventsStatements struct {
+	insertReportedEventStmt         *sql.Stmt
+	selectReportedEventsStmt        *sql.Stmt
+	selectReportedEventsCountStmt   *sql.Stmt
+	selectReportedEventStmt         *sql.Stmt
+	updateReportedEventResolvedStmt *sql.Stmt
+}
+
+func CreateReportedEventsTable(db *sql.DB) error {
+	_, err := db.Exec(reportedEventsSchema)
+	return err
+}
+
+func PrepareReportedEventsTable(db *sql.DB) (tables.ReportedEvents, error) {
+	s := &reportedEventsStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertReportedEventStmt, insertReportedEventSQL},
+		{&s.selectReportedEventsStmt, selectReportedEventsSQL},
+		{&s.selectReportedEventsCountStmt, selectReportedEventsCountSQL},
+		{&s.selectReportedEventStmt, selectReportedEventSQL},
+		{&s.updateReportedEventResolvedStmt, updateReportedEventResolvedSQL},
+	}.Prepare(db)
+}
+
+func (s *reportedEventsStatements) InsertReportedEvent(
+	ctx context.Context, txn *sql.Tx, report *types.EventReport,
+) (reportID int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.insertReportedEventStmt)
+	err = stmt.QueryRowContext(
+		ctx, report.RoomID, report.EventID, report.ReportingUserID, report.EventSender,
+		report.Reason, report.Score, report.ReceivedTS, string(report.EventJSON),
+	).Scan(&reportID)
+	return
+}
+
+func (s *reportedEventsStatements) SelectReportedEvents(
+	ctx context.Context, txn *sql.Tx, filter *types.EventReportFilter, from int64, limit int,
+) ([]types.EventReport, int64, error) {
+	var total int64
+	stmt := sqlutil.TxStmt(txn, s.selectReportedEventsCountStmt)
+	err := stmt.QueryRowContext(ctx, filter.RoomID, filter.ReportingUserID, filter.IncludeResolved).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stmt = sqlutil.TxStmt(txn, s.selectReportedEventsStmt)
+	rows, err := stmt.QueryContext(ctx, filter.RoomID, filter.ReportingUserID, filter.IncludeResolved, from, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectReportedEventsStmt: rows.close() failed")
+
+	var reports []types.EventReport
+	for rows.Next() {
+		report, err := scanReportedEvent(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		reports = append(reports, *report)
+	}
+	return reports, total, rows.Err()
+}
+
+func (s *reportedEventsStatements) SelectReportedEvent(
+	ctx context.Context, txn *sql.Tx, reportID int64,
+) (*types.EventReport, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectReportedEventStmt)
+	report, err := scanReportedEvent(stmt.QueryRowContext(ctx, reportID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return report, err
+}
+
+func (s *reportedEventsStatements) UpdateReportedEventResolved(
+	ctx context.Context, txn *sql.Tx, reportID int64, resolvedBy string, resolvedTS gomatrixserverlib.Timestamp,
+) (bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.updateReportedEventResolvedStmt)
+	res, err := stmt.ExecContext(ctx, resolvedBy, resolvedTS, reportID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func scanReportedEvent(row interface{ Scan(...interface{}) error }) (*types.EventReport, error) {
+	var report types.EventReport
+	var eventJSON string
+	if err := row.Scan(
+		&report.ID, &report.RoomID, &report.EventID, &report.ReportingUserID, &report.EventSender,
+		&report.Reason, &report.Score, &report.ReceivedTS, &eventJSON, &report.ResolvedByUserID, &report.ResolvedTS,
+	); err != nil {
+		return nil, err
+	}
+	if eventJSON != "" {
+		report.EventJSON = []byte(eventJSON)
+	}
+	return &report, nil
+}
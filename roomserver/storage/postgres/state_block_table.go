@@ -47,27 +47,72 @@ CREATE TABLE IF NOT EXISTS roomserver_state_block (
 	-- this column is cheap and fits within the maximum index size.
 	state_block_hash BYTEA UNIQUE,
 	-- The event NIDs contained within the state block.
-	event_nids bigint[] NOT NULL
+	event_nids bigint[] NOT NULL,
+	-- When the state block was found to be unreferenced by state compaction,
+	-- or NULL if it is referenced or hasn't been checked yet.
+	gc_marked_at BIGINT
 );
 `
 
 // Insert a new state block. If we conflict on the hash column then
 // we must perform an update so that the RETURNING statement returns the
 // ID of the row that we conflicted with, so that we can then refer to
-// the original block.
+// the original block. The update also clears any compaction mark, so
+// that a reused block isn't deleted.
 const insertStateDataSQL = "" +
 	"INSERT INTO roomserver_state_block (state_block_hash, event_nids)" +
 	" VALUES ($1, $2)" +
-	" ON CONFLICT (state_block_hash) DO UPDATE SET event_nids=$2" +
+	" ON CONFLICT (state_block_hash) DO UPDATE SET event_nids=$2, gc_marked_at=NULL" +
 	" RETURNING state_block_nid"
 
 const bulkSelectStateBlockEntriesSQL = "" +
 	"SELECT state_block_nid, event_nids" +
 	" FROM roomserver_state_block WHERE state_block_nid = ANY($1) ORDER BY state_block_nid ASC"
 
+const selectStateBlocksAfterSQL = "" +
+	"SELECT state_block_nid, event_nids FROM roomserver_state_block" +
+	" WHERE state_block_nid > $1 ORDER BY state_block_nid ASC LIMIT $2"
+
+const unmarkStateBlocksSQL = "" +
+	"UPDATE roomserver_state_block SET gc_marked_at = NULL WHERE state_block_nid = ANY($1)"
+
+// The state block NIDs which are referenced by any snapshot.
+const referencedStateBlocksSQL = "" +
+	"SELECT UNNEST(state_block_nids) AS state_block_nid FROM roomserver_state_snapshots"
+
+const unmarkReferencedStateBlocksSQL = "" +
+	"UPDATE roomserver_state_block AS b SET gc_marked_at = NULL" +
+	" WHERE gc_marked_at IS NOT NULL" +
+	" AND EXISTS (SELECT 1 FROM (" + referencedStateBlocksSQL + ") AS r WHERE r.state_block_nid = b.state_block_nid)"
+
+const markUnreferencedStateBlocksSQL = "" +
+	"UPDATE roomserver_state_block AS b SET gc_marked_at = $1" +
+	" WHERE gc_marked_at IS NULL" +
+	" AND NOT EXISTS (SELECT 1 FROM (" + referencedStateBlocksSQL + ") AS r WHERE r.state_block_nid = b.state_block_nid)"
+
+// Deletes marked state blocks which are still unreferenced. State blocks
+// which are locked, e.g. because they are being reused by BulkInsertStateData,
+// are skipped.
+const deleteMarkedStateBlocksSQL = "" +
+	"WITH deleted AS (" +
+	" DELETE FROM roomserver_state_block WHERE state_block_nid IN (" +
+	"  SELECT state_block_nid FROM roomserver_state_block AS b" +
+	"  WHERE gc_marked_at <= $1" +
+	"  AND NOT EXISTS (SELECT 1 FROM (" + referencedStateBlocksSQL + ") AS r WHERE r.state_block_nid = b.state_block_nid)" +
+	"  ORDER BY state_block_nid ASC LIMIT $2 FOR UPDATE OF b SKIP LOCKED" +
+	" ) AND gc_marked_at <= $1" +
+	" RETURNING pg_column_size(roomserver_state_block.*) AS size" +
+	")" +
+	" SELECT COUNT(*), COALESCE(SUM(size), 0) FROM deleted"
+
 type stateBlockStatements struct {
 	insertStateDataStmt             *sql.Stmt
 	bulkSelectStateBlockEntriesStmt *sql.Stmt
+	selectStateBlocksAfterStmt      *sql.Stmt
+	unmarkStateBlocksStmt           *sql.Stmt
+	unmarkReferencedStateBlocksStmt *sql.Stmt
+	markUnreferencedStateBlocksStmt *sql.Stmt
+	deleteMarkedStateBlocksStmt     *sql.Stmt
 }
 
 func CreateStateBlockTable(db *sql.DB) error {
@@ -81,6 +126,11 @@ func PrepareStateBlockTable(db *sql.DB) (tables.StateBlock, error) {
 	return s, sqlutil.StatementList{
 		{&s.insertStateDataStmt, insertStateDataSQL},
 		{&s.bulkSelectStateBlockEntriesStmt, bulkSelectStateBlockEntriesSQL},
+		{&s.selectStateBlocksAfterStmt, selectStateBlocksAfterSQL},
+		{&s.unmarkStateBlocksStmt, unmarkStateBlocksSQL},
+		{&s.unmarkReferencedStateBlocksStmt, unmarkReferencedStateBlocksSQL},
+		{&s.markUnreferencedStateBlocksStmt, markUnreferencedStateBlocksSQL},
+		{&s.deleteMarkedStateBlocksStmt, deleteMarkedStateBlocksSQL},
 	}.Prepare(db)
 }
 
@@ -133,6 +183,63 @@ func (s *stateBlockStatements) BulkSelectStateBlockEntries(
 	return results, err
 }
 
+func (s *stateBlockStatements) SelectStateBlocksAfter(
+	ctx context.Context, txn *sql.Tx, afterNID types.StateBlockNID, limit int,
+) ([]types.StateBlockNID, [][]types.EventNID, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectStateBlocksAfterStmt)
+	rows, err := stmt.QueryContext(ctx, afterNID, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStateBlocksAfter: rows.close() failed")
+
+	var stateBlockNIDs []types.StateBlockNID
+	var eventNIDs [][]types.EventNID
+	var stateBlockNID types.StateBlockNID
+	var result pq.Int64Array
+	for rows.Next() {
+		if err = rows.Scan(&stateBlockNID, &result); err != nil {
+			return nil, nil, err
+		}
+		r := make([]types.EventNID, len(result))
+		for x := range result {
+			r[x] = types.EventNID(result[x])
+		}
+		stateBlockNIDs = append(stateBlockNIDs, stateBlockNID)
+		eventNIDs = append(eventNIDs, r)
+	}
+	return stateBlockNIDs, eventNIDs, rows.Err()
+}
+
+func (s *stateBlockStatements) UnmarkStateBlocks(
+	ctx context.Context, txn *sql.Tx, stateBlockNIDs types.StateBlockNIDs,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.unmarkStateBlocksStmt)
+	_, err := stmt.ExecContext(ctx, stateBlockNIDsAsArray(stateBlockNIDs))
+	return err
+}
+
+func (s *stateBlockStatements) MarkUnreferencedStateBlocks(
+	ctx context.Context, txn *sql.Tx, markedAt int64,
+) (int64, error) {
+	if _, err := sqlutil.TxStmt(txn, s.unmarkReferencedStateBlocksStmt).ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	res, err := sqlutil.TxStmt(txn, s.markUnreferencedStateBlocksStmt).ExecContext(ctx, markedAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *stateBlockStatements) DeleteMarkedStateBlocks(
+	ctx context.Context, txn *sql.Tx, markedUntil int64, limit int,
+) (count, size int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteMarkedStateBlocksStmt)
+	err = stmt.QueryRowContext(ctx, markedUntil, limit).Scan(&count, &size)
+	return
+}
+
 func stateBlockNIDsAsArray(stateBlockNIDs []types.StateBlockNID) pq.Int64Array {
 	nids := make([]int64, len(stateBlockNIDs))
 	for i := range stateBlockNIDs {
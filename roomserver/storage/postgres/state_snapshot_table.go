@@ -21,6 +21,7 @@ import (
 	"fmt"
 
 	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -49,7 +50,10 @@ CREATE TABLE IF NOT EXISTS roomserver_state_snapshots (
 	-- The room NID that the snapshot belongs to.
 	room_nid bigint NOT NULL,
 	-- The state blocks contained within this snapshot.
-	state_block_nids bigint[] NOT NULL
+	state_block_nids bigint[] NOT NULL,
+	-- When the snapshot was found to be unreferenced by state compaction, or
+	-- NULL if it is referenced or hasn't been checked yet.
+	gc_marked_at BIGINT
 );
 `
 
@@ -60,9 +64,10 @@ CREATE TABLE IF NOT EXISTS roomserver_state_snapshots (
 const insertStateSQL = "" +
 	"INSERT INTO roomserver_state_snapshots (state_snapshot_hash, room_nid, state_block_nids)" +
 	" VALUES ($1, $2, $3)" +
-	" ON CONFLICT (state_snapshot_hash) DO UPDATE SET room_nid=$2" +
+	" ON CONFLICT (state_snapshot_hash) DO UPDATE SET room_nid=$2, gc_marked_at=NULL" +
 	// Performing an update, above, ensures that the RETURNING statement
-	// below will always return a valid state snapshot ID
+	// below will always return a valid state snapshot ID. It also clears
+	// any compaction mark, so that a reused snapshot isn't deleted.
 	" RETURNING state_snapshot_nid"
 
 // Bulk state data NID lookup.
@@ -97,10 +102,51 @@ const bulkSelectStateForHistoryVisibilitySQL = `
 	  AND (event_type_nid = 7 OR event_state_key LIKE '%:' || $2);
 `
 
+const selectStateSnapshotsAfterSQL = "" +
+	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
+	" WHERE state_snapshot_nid > $1 ORDER BY state_snapshot_nid ASC LIMIT $2"
+
+// Replaces the state blocks of a snapshot, unless they were changed in the
+// meantime or another snapshot already has the new state blocks.
+const updateStateBlockNIDsSQL = "" +
+	"UPDATE roomserver_state_snapshots SET state_snapshot_hash = $1, state_block_nids = $2" +
+	" WHERE state_snapshot_nid = $3 AND state_block_nids = $4" +
+	" AND NOT EXISTS (SELECT 1 FROM roomserver_state_snapshots WHERE state_snapshot_hash = $1)"
+
+const stateSnapshotUnreferencedSQL = "" +
+	"NOT EXISTS (SELECT 1 FROM roomserver_events WHERE roomserver_events.state_snapshot_nid = s.state_snapshot_nid)" +
+	" AND NOT EXISTS (SELECT 1 FROM roomserver_rooms WHERE roomserver_rooms.state_snapshot_nid = s.state_snapshot_nid)"
+
+const unmarkReferencedStateSnapshotsSQL = "" +
+	"UPDATE roomserver_state_snapshots AS s SET gc_marked_at = NULL" +
+	" WHERE gc_marked_at IS NOT NULL AND NOT (" + stateSnapshotUnreferencedSQL + ")"
+
+const markUnreferencedStateSnapshotsSQL = "" +
+	"UPDATE roomserver_state_snapshots AS s SET gc_marked_at = $1" +
+	" WHERE gc_marked_at IS NULL AND " + stateSnapshotUnreferencedSQL
+
+// Deletes marked snapshots which are still unreferenced. Snapshots which are
+// locked, e.g. because they are being reused by InsertState, are skipped.
+const deleteMarkedStateSnapshotsSQL = "" +
+	"WITH deleted AS (" +
+	" DELETE FROM roomserver_state_snapshots WHERE state_snapshot_nid IN (" +
+	"  SELECT state_snapshot_nid FROM roomserver_state_snapshots AS s" +
+	"  WHERE gc_marked_at <= $1 AND " + stateSnapshotUnreferencedSQL +
+	"  ORDER BY state_snapshot_nid ASC LIMIT $2 FOR UPDATE SKIP LOCKED" +
+	" ) AND gc_marked_at <= $1" +
+	" RETURNING pg_column_size(roomserver_state_snapshots.*) AS size" +
+	")" +
+	" SELECT COUNT(*), COALESCE(SUM(size), 0) FROM deleted"
+
 type stateSnapshotStatements struct {
 	insertStateStmt                         *sql.Stmt
 	bulkSelectStateBlockNIDsStmt            *sql.Stmt
 	bulkSelectStateForHistoryVisibilityStmt *sql.Stmt
+	selectStateSnapshotsAfterStmt           *sql.Stmt
+	updateStateBlockNIDsStmt                *sql.Stmt
+	unmarkReferencedStateSnapshotsStmt      *sql.Stmt
+	markUnreferencedStateSnapshotsStmt      *sql.Stmt
+	deleteMarkedStateSnapshotsStmt          *sql.Stmt
 }
 
 func CreateStateSnapshotTable(db *sql.DB) error {
@@ -115,6 +161,11 @@ func PrepareStateSnapshotTable(db *sql.DB) (tables.StateSnapshot, error) {
 		{&s.insertStateStmt, insertStateSQL},
 		{&s.bulkSelectStateBlockNIDsStmt, bulkSelectStateBlockNIDsSQL},
 		{&s.bulkSelectStateForHistoryVisibilityStmt, bulkSelectStateForHistoryVisibilitySQL},
+		{&s.selectStateSnapshotsAfterStmt, selectStateSnapshotsAfterSQL},
+		{&s.updateStateBlockNIDsStmt, updateStateBlockNIDsSQL},
+		{&s.unmarkReferencedStateSnapshotsStmt, unmarkReferencedStateSnapshotsSQL},
+		{&s.markUnreferencedStateSnapshotsStmt, markUnreferencedStateSnapshotsSQL},
+		{&s.deleteMarkedStateSnapshotsStmt, deleteMarkedStateSnapshotsSQL},
 	}.Prepare(db)
 }
 
@@ -183,3 +234,63 @@ func (s *stateSnapshotStatements) BulkSelectStateForHistoryVisibility(
 	}
 	return results, rows.Err()
 }
+
+func (s *stateSnapshotStatements) SelectStateSnapshotsAfter(
+	ctx context.Context, txn *sql.Tx, afterNID types.StateSnapshotNID, limit int,
+) ([]types.StateBlockNIDList, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectStateSnapshotsAfterStmt)
+	rows, err := stmt.QueryContext(ctx, afterNID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStateSnapshotsAfter: rows.close() failed")
+	var results []types.StateBlockNIDList
+	var stateBlockNIDs pq.Int64Array
+	for rows.Next() {
+		var result types.StateBlockNIDList
+		if err = rows.Scan(&result.StateSnapshotNID, &stateBlockNIDs); err != nil {
+			return nil, err
+		}
+		result.StateBlockNIDs = make([]types.StateBlockNID, len(stateBlockNIDs))
+		for k := range stateBlockNIDs {
+			result.StateBlockNIDs[k] = types.StateBlockNID(stateBlockNIDs[k])
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *stateSnapshotStatements) UpdateStateBlockNIDs(
+	ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID, oldStateBlockNIDs, newStateBlockNIDs types.StateBlockNIDs,
+) (bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.updateStateBlockNIDsStmt)
+	res, err := stmt.ExecContext(
+		ctx, newStateBlockNIDs.Hash(), stateBlockNIDsAsArray(newStateBlockNIDs), stateNID, stateBlockNIDsAsArray(oldStateBlockNIDs),
+	)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func (s *stateSnapshotStatements) MarkUnreferencedStateSnapshots(
+	ctx context.Context, txn *sql.Tx, markedAt int64,
+) (int64, error) {
+	if _, err := sqlutil.TxStmt(txn, s.unmarkReferencedStateSnapshotsStmt).ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	res, err := sqlutil.TxStmt(txn, s.markUnreferencedStateSnapshotsStmt).ExecContext(ctx, markedAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *stateSnapshotStatements) DeleteMarkedStateSnapshots(
+	ctx context.Context, txn *sql.Tx, markedUntil int64, limit int,
+) (count, size int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteMarkedStateSnapshotsStmt)
+	err = stmt.QueryRowContext(ctx, markedUntil, limit).Scan(&count, &size)
+	return
+}
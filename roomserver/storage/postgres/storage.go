@@ -59,10 +59,7 @@ func Open(base *base.BaseDendrite, dbProperties *config.DatabaseOptions, cache c
 	err = db.QueryRow("SELECT event_nid FROM roomserver_state_block LIMIT 1;").Scan(&eventNID)
 	if err == nil {
 		m := sqlutil.NewMigrator(db)
-		m.AddMigrations(sqlutil.Migration{
-			Version: "roomserver: state blocks refactor",
-			Up:      deltas.UpStateBlocksRefactor,
-		})
+		m.AddMigrations(deltas.StateBlocksRefactorMigration)
 		if err = m.Up(base.Context()); err != nil {
 			return nil, err
 		}
@@ -78,6 +75,14 @@ func Open(base *base.BaseDendrite, dbProperties *config.DatabaseOptions, cache c
 		}
 	}
 
+	// The state blocks refactor above recreates the state tables, so the
+	// compaction columns can only be added once it has run.
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(deltas.StateGCMarksMigration, deltas.EventsStateSnapshotIndexMigration)
+	if err = m.Up(base.Context()); err != nil {
+		return nil, err
+	}
+
 	// Then prepare the statements. Now that the migrations have run, any columns referred
 	// to in the database code should now exist.
 	if err = d.prepare(db, writer, cache); err != nil {
@@ -127,6 +132,9 @@ func (d *Database) create(db *sql.DB) error {
 	if err := CreateRedactionsTable(db); err != nil {
 		return err
 	}
+	if err := CreateReportedEventsTable(db); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -184,6 +192,10 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 	if err != nil {
 		return err
 	}
+	reportedEvents, err := PrepareReportedEventsTable(db)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                  db,
 		Cache:               cache,
@@ -201,6 +213,7 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 		MembershipTable:     membership,
 		PublishedTable:      published,
 		RedactionsTable:     redactions,
+		ReportedEventsTable: reportedEvents,
 	}
 	return nil
 }
@@ -0,0 +1,209 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/sirupsen/logrus"
+)
+
+// The number of rows to read, or delete, at a time when compacting state.
+// Deletions are done in separate transactions so that the input API isn't
+// blocked for too long.
+const stateCompactionBatchSize = 1000
+
+// CompactState removes state which is no longer needed, so that the state
+// tables don't grow forever:
+//
+//  1. State blocks with identical contents are merged, by changing snapshots
+//     which refer to a duplicate block to refer to the earliest copy instead.
+//  2. Snapshots which aren't referenced by any event or room are marked with
+//     the current time, and marked snapshots which are still unreferenced once
+//     the grace period has passed are deleted.
+//  3. The same is then done for state blocks which aren't referenced by any
+//     snapshot.
+//
+// New state isn't referenced until the event it belongs to has been stored,
+// which is why there is a grace period. Reusing a snapshot or block clears
+// its mark, and deletions recheck that rows are still unreferenced, so it is
+// safe to run this while the input API is processing events.
+func (d *Database) CompactState(
+	ctx context.Context, gracePeriod time.Duration,
+) (*types.StateCompactionReport, error) {
+	report := &types.StateCompactionReport{}
+	if err := d.mergeDuplicateStateBlocks(ctx, report); err != nil {
+		return report, fmt.Errorf("d.mergeDuplicateStateBlocks: %w", err)
+	}
+
+	markedAt := time.Now().UnixMilli()
+	markedUntil := markedAt - gracePeriod.Milliseconds()
+	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		var err error
+		report.SnapshotsMarked, err = d.StateSnapshotTable.MarkUnreferencedStateSnapshots(ctx, txn, markedAt)
+		return err
+	})
+	if err != nil {
+		return report, fmt.Errorf("d.StateSnapshotTable.MarkUnreferencedStateSnapshots: %w", err)
+	}
+	for {
+		var count, size int64
+		err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+			var err error
+			count, size, err = d.StateSnapshotTable.DeleteMarkedStateSnapshots(ctx, txn, markedUntil, stateCompactionBatchSize)
+			return err
+		})
+		if err != nil {
+			return report, fmt.Errorf("d.StateSnapshotTable.DeleteMarkedStateSnapshots: %w", err)
+		}
+		report.SnapshotsDeleted += count
+		report.BytesReclaimed += size
+		if count < stateCompactionBatchSize {
+			break
+		}
+	}
+
+	// Mark the state blocks after deleting snapshots, so that blocks which
+	// were only referenced by deleted snapshots are marked too.
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		var err error
+		report.BlocksMarked, err = d.StateBlockTable.MarkUnreferencedStateBlocks(ctx, txn, markedAt)
+		return err
+	})
+	if err != nil {
+		return report, fmt.Errorf("d.StateBlockTable.MarkUnreferencedStateBlocks: %w", err)
+	}
+	for {
+		var count, size int64
+		err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+			var err error
+			count, size, err = d.StateBlockTable.DeleteMarkedStateBlocks(ctx, txn, markedUntil, stateCompactionBatchSize)
+			return err
+		})
+		if err != nil {
+			return report, fmt.Errorf("d.StateBlockTable.DeleteMarkedStateBlocks: %w", err)
+		}
+		report.BlocksDeleted += count
+		report.BytesReclaimed += size
+		if count < stateCompactionBatchSize {
+			break
+		}
+	}
+	return report, nil
+}
+
+// mergeDuplicateStateBlocks finds state blocks containing the same events as
+// an earlier state block, and changes the snapshots which refer to them to
+// refer to the earlier block instead. The duplicates are then unreferenced,
+// so they will be deleted by the garbage collection.
+func (d *Database) mergeDuplicateStateBlocks(
+	ctx context.Context, report *types.StateCompactionReport,
+) error {
+	// The events in a block are sorted by state key when they are stored, but
+	// older blocks were sorted by event NID, so sort them the same way before
+	// comparing them.
+	earliest := map[string]types.StateBlockNID{}
+	duplicates := map[types.StateBlockNID]types.StateBlockNID{}
+	var afterBlockNID types.StateBlockNID
+	for {
+		stateBlockNIDs, eventNIDs, err := d.StateBlockTable.SelectStateBlocksAfter(ctx, nil, afterBlockNID, stateCompactionBatchSize)
+		if err != nil {
+			return fmt.Errorf("d.StateBlockTable.SelectStateBlocksAfter: %w", err)
+		}
+		for i, stateBlockNID := range stateBlockNIDs {
+			entries := types.EventNIDs(eventNIDs[i])
+			sort.Sort(entries)
+			key := string(entries.Hash())
+			if earliestNID, ok := earliest[key]; ok {
+				duplicates[stateBlockNID] = earliestNID
+			} else {
+				earliest[key] = stateBlockNID
+			}
+		}
+		if len(stateBlockNIDs) < stateCompactionBatchSize {
+			break
+		}
+		afterBlockNID = stateBlockNIDs[len(stateBlockNIDs)-1]
+	}
+	report.DuplicateBlocks = int64(len(duplicates))
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	var afterSnapshotNID types.StateSnapshotNID
+	for {
+		snapshots, err := d.StateSnapshotTable.SelectStateSnapshotsAfter(ctx, nil, afterSnapshotNID, stateCompactionBatchSize)
+		if err != nil {
+			return fmt.Errorf("d.StateSnapshotTable.SelectStateSnapshotsAfter: %w", err)
+		}
+		for _, snapshot := range snapshots {
+			merged, ok := mergedStateBlockNIDs(snapshot.StateBlockNIDs, duplicates)
+			if !ok {
+				continue
+			}
+			err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+				updated, err := d.StateSnapshotTable.UpdateStateBlockNIDs(ctx, txn, snapshot.StateSnapshotNID, snapshot.StateBlockNIDs, merged)
+				if err != nil || !updated {
+					return err
+				}
+				report.SnapshotsRewritten++
+				// The earlier blocks may have been marked as unreferenced, so make
+				// sure that they aren't deleted now that this snapshot uses them.
+				return d.StateBlockTable.UnmarkStateBlocks(ctx, txn, merged)
+			})
+			switch {
+			case sqlutil.IsUniqueConstraintViolationErr(err):
+				// Another snapshot with the same blocks was stored in the meantime,
+				// so leave this one alone.
+				logrus.WithField("state_snapshot_nid", snapshot.StateSnapshotNID).Debug("Not merging state blocks of snapshot")
+			case err != nil:
+				return fmt.Errorf("d.StateSnapshotTable.UpdateStateBlockNIDs: %w", err)
+			}
+		}
+		if len(snapshots) < stateCompactionBatchSize {
+			break
+		}
+		afterSnapshotNID = snapshots[len(snapshots)-1].StateSnapshotNID
+	}
+	return nil
+}
+
+// mergedStateBlockNIDs replaces any duplicate state blocks in the list with
+// the earlier copy. Returns false if nothing would change, or if the result
+// isn't in ascending order. When blocks contain entries for the same state
+// key, the later block in the list wins, and InsertState always stores the
+// blocks in ascending order, so reordering them could change the state.
+func mergedStateBlockNIDs(
+	stateBlockNIDs types.StateBlockNIDs, duplicates map[types.StateBlockNID]types.StateBlockNID,
+) (types.StateBlockNIDs, bool) {
+	merged := make(types.StateBlockNIDs, len(stateBlockNIDs))
+	changed := false
+	for i, stateBlockNID := range stateBlockNIDs {
+		if earliestNID, ok := duplicates[stateBlockNID]; ok {
+			stateBlockNID, changed = earliestNID, true
+		}
+		if i > 0 && merged[i-1] >= stateBlockNID {
+			return nil, false
+		}
+		merged[i] = stateBlockNID
+	}
+	return merged, changed
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -42,6 +43,7 @@ type Database struct {
 	MembershipTable     tables.Membership
 	PublishedTable      tables.Published
 	RedactionsTable     tables.Redactions
+	ReportedEventsTable tables.ReportedEvents
 	GetRoomUpdaterFn    func(ctx context.Context, roomInfo *types.RoomInfo) (*RoomUpdater, error)
 }
 
@@ -455,6 +457,19 @@ func (d *Database) Events(
 	return d.events(ctx, nil, eventNIDs)
 }
 
+func (d *Database) RoomEventsAfter(
+	ctx context.Context, roomInfo *types.RoomInfo, afterNID types.EventNID, limit int,
+) ([]types.Event, error) {
+	eventNIDs, err := d.EventsTable.SelectRoomEventNIDsAfter(ctx, nil, roomInfo.RoomNID, afterNID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("d.EventsTable.SelectRoomEventNIDsAfter: %w", err)
+	}
+	if len(eventNIDs) == 0 {
+		return nil, nil
+	}
+	return d.events(ctx, nil, eventNIDs)
+}
+
 func (d *Database) events(
 	ctx context.Context, txn *sql.Tx, inputEventNIDs types.EventNIDs,
 ) ([]types.Event, error) {
@@ -721,6 +736,32 @@ func (d *Database) GetPublishedRooms(ctx context.Context) ([]string, error) {
 	return d.PublishedTable.SelectAllPublishedRooms(ctx, nil, true)
 }
 
+func (d *Database) InsertEventReport(ctx context.Context, report *types.EventReport) (reportID int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		reportID, err = d.ReportedEventsTable.InsertReportedEvent(ctx, txn, report)
+		return err
+	})
+	return
+}
+
+func (d *Database) EventReports(
+	ctx context.Context, filter *types.EventReportFilter, from int64, limit int,
+) ([]types.EventReport, int64, error) {
+	return d.ReportedEventsTable.SelectReportedEvents(ctx, nil, filter, from, limit)
+}
+
+func (d *Database) EventReport(ctx context.Context, reportID int64) (*types.EventReport, error) {
+	return d.ReportedEventsTable.SelectReportedEvent(ctx, nil, reportID)
+}
+
+func (d *Database) ResolveEventReport(ctx context.Context, reportID int64, resolvedBy string) (resolved bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		resolved, err = d.ReportedEventsTable.UpdateReportedEventResolved(ctx, txn, reportID, resolvedBy, gomatrixserverlib.AsTimestamp(time.Now()))
+		return err
+	})
+	return
+}
+
 func (d *Database) MissingAuthPrevEvents(
 	ctx context.Context, e *gomatrixserverlib.Event,
 ) (missingAuth, missingPrev []string, err error) {
@@ -744,6 +785,21 @@ func (d *Database) MissingAuthPrevEvents(
 	return
 }
 
+// IsEventReferenced returns true if any event in the database refers to the
+// given event as one of its prev events.
+func (d *Database) IsEventReferenced(
+	ctx context.Context, eventReference gomatrixserverlib.EventReference,
+) (bool, error) {
+	err := d.PrevEventsTable.SelectPreviousEventExists(ctx, nil, eventReference.EventID, eventReference.EventSHA256)
+	if err == nil {
+		return true, nil
+	}
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return false, fmt.Errorf("d.PrevEventsTable.SelectPreviousEventExists: %w", err)
+}
+
 func (d *Database) assignRoomNID(
 	ctx context.Context, roomID string, roomVersion gomatrixserverlib.RoomVersion,
 ) (types.RoomNID, error) {
@@ -0,0 +1,75 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpStateGCMarks(ctx context.Context, tx *sql.Tx) error {
+	for _, table := range []string{"roomserver_state_snapshots", "roomserver_state_block"} {
+		// SQLite doesn't have "if exists", so check if the column exists. If the query doesn't return an error, it already exists.
+		rows, err := tx.QueryContext(ctx, "SELECT gc_marked_at FROM "+table+" LIMIT 1")
+		if err == nil {
+			if err = rows.Close(); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN gc_marked_at INTEGER;"); err != nil {
+			return fmt.Errorf("failed to execute upgrade: %w", err)
+		}
+	}
+	_, err := tx.ExecContext(ctx, `
+CREATE INDEX IF NOT EXISTS roomserver_state_snapshots_gc_marked_at_idx ON roomserver_state_snapshots (gc_marked_at) WHERE gc_marked_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS roomserver_state_block_gc_marked_at_idx ON roomserver_state_block (gc_marked_at) WHERE gc_marked_at IS NOT NULL;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownStateGCMarks(ctx context.Context, tx *sql.Tx) error {
+	// SQLite can't drop the columns if they are preceded by comments in the
+	// table schemas, so the tables have to be recreated instead.
+	_, err := tx.ExecContext(ctx, `
+DROP INDEX IF EXISTS roomserver_state_snapshots_gc_marked_at_idx;
+DROP INDEX IF EXISTS roomserver_state_block_gc_marked_at_idx;
+ALTER TABLE roomserver_state_snapshots RENAME TO roomserver_state_snapshots_tmp;
+CREATE TABLE roomserver_state_snapshots (
+	state_snapshot_nid INTEGER PRIMARY KEY AUTOINCREMENT,
+	state_snapshot_hash BLOB UNIQUE,
+	room_nid INTEGER NOT NULL,
+	state_block_nids TEXT NOT NULL DEFAULT '[]'
+);
+INSERT INTO roomserver_state_snapshots (state_snapshot_nid, state_snapshot_hash, room_nid, state_block_nids)
+	SELECT state_snapshot_nid, state_snapshot_hash, room_nid, state_block_nids FROM roomserver_state_snapshots_tmp;
+DROP TABLE roomserver_state_snapshots_tmp;
+ALTER TABLE roomserver_state_block RENAME TO roomserver_state_block_tmp;
+CREATE TABLE roomserver_state_block (
+	state_block_nid INTEGER PRIMARY KEY AUTOINCREMENT,
+	state_block_hash BLOB UNIQUE,
+	event_nids TEXT NOT NULL DEFAULT '[]'
+);
+INSERT INTO roomserver_state_block (state_block_nid, state_block_hash, event_nids)
+	SELECT state_block_nid, state_block_hash, event_nids FROM roomserver_state_block_tmp;
+DROP TABLE roomserver_state_block_tmp;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -44,6 +44,9 @@ const eventsSchema = `
 	auth_event_nids TEXT NOT NULL DEFAULT '[]',
 	is_rejected BOOLEAN NOT NULL DEFAULT FALSE
   );
+
+  -- Used by state compaction to find snapshots which aren't referenced by any event.
+  CREATE INDEX IF NOT EXISTS roomserver_events_state_snapshot_nid_idx ON roomserver_events (state_snapshot_nid);
 `
 
 const insertEventSQL = `
@@ -109,6 +112,13 @@ const selectMaxEventDepthSQL = "" +
 const selectRoomNIDsForEventNIDsSQL = "" +
 	"SELECT event_nid, room_nid FROM roomserver_events WHERE event_nid IN ($1)"
 
+// Events which we don't have the state for, or which were rejected, are never
+// sent to the output stream so are left out.
+const selectRoomEventNIDsAfterSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1 AND event_nid > $2" +
+	" AND state_snapshot_nid != 0 AND is_rejected = 0" +
+	" ORDER BY event_nid ASC LIMIT $3"
+
 type eventStatements struct {
 	db                                     *sql.DB
 	insertEventStmt                        *sql.Stmt
@@ -122,6 +132,7 @@ type eventStatements struct {
 	bulkSelectStateAtEventAndReferenceStmt *sql.Stmt
 	bulkSelectEventReferenceStmt           *sql.Stmt
 	bulkSelectEventIDStmt                  *sql.Stmt
+	selectRoomEventNIDsAfterStmt           *sql.Stmt
 	//bulkSelectEventNIDStmt               *sql.Stmt
 	//bulkSelectUnsentEventNIDStmt         *sql.Stmt
 	//selectRoomNIDsForEventNIDsStmt       *sql.Stmt
@@ -149,6 +160,7 @@ func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectStateAtEventAndReferenceStmt, bulkSelectStateAtEventAndReferenceSQL},
 		{&s.bulkSelectEventReferenceStmt, bulkSelectEventReferenceSQL},
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
+		{&s.selectRoomEventNIDsAfterStmt, selectRoomEventNIDsAfterSQL},
 		//{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		//{&s.bulkSelectUnsentEventNIDStmt, bulkSelectUnsentEventNIDSQL},
 		//{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
@@ -614,3 +626,22 @@ func eventNIDsAsArray(eventNIDs []types.EventNID) string {
 	b, _ := json.Marshal(eventNIDs)
 	return string(b)
 }
+
+func (s *eventStatements) SelectRoomEventNIDsAfter(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, afterNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomEventNIDsAfterStmt).QueryContext(ctx, roomNID, afterNID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomEventNIDsAfter: rows.close() failed")
+	var eventNIDs []types.EventNID
+	var eventNID types.EventNID
+	for rows.Next() {
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+	return eventNIDs, rows.Err()
+}
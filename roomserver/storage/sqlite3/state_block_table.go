@@ -38,18 +38,22 @@ const stateDataSchema = `
 	-- this column is cheap and fits within the maximum index size.
 	state_block_hash BLOB UNIQUE,
 	-- The event NIDs contained within the state block, encoded as JSON.
-    event_nids TEXT NOT NULL DEFAULT '[]'
+    event_nids TEXT NOT NULL DEFAULT '[]',
+	-- When the state block was found to be unreferenced by state compaction,
+	-- or NULL if it is referenced or hasn't been checked yet.
+	gc_marked_at INTEGER
   );
 `
 
 // Insert a new state block. If we conflict on the hash column then
 // we must perform an update so that the RETURNING statement returns the
 // ID of the row that we conflicted with, so that we can then refer to
-// the original block.
+// the original block. The update also clears any compaction mark, so
+// that a reused block isn't deleted.
 const insertStateDataSQL = `
 	INSERT INTO roomserver_state_block (state_block_hash, event_nids)
 		VALUES ($1, $2)
-		ON CONFLICT (state_block_hash) DO UPDATE SET event_nids=$2
+		ON CONFLICT (state_block_hash) DO UPDATE SET event_nids=$2, gc_marked_at=NULL
 		RETURNING state_block_nid
 `
 
@@ -57,10 +61,41 @@ const bulkSelectStateBlockEntriesSQL = "" +
 	"SELECT state_block_nid, event_nids" +
 	" FROM roomserver_state_block WHERE state_block_nid IN ($1) ORDER BY state_block_nid ASC"
 
+const selectStateBlocksAfterSQL = "" +
+	"SELECT state_block_nid, event_nids FROM roomserver_state_block" +
+	" WHERE state_block_nid > $1 ORDER BY state_block_nid ASC LIMIT $2"
+
+const unmarkStateBlocksSQL = "" +
+	"UPDATE roomserver_state_block SET gc_marked_at = NULL WHERE state_block_nid IN ($1)"
+
+// The state block NIDs which are referenced by any snapshot.
+const referencedStateBlocksSQL = "" +
+	"SELECT value FROM roomserver_state_snapshots, json_each(roomserver_state_snapshots.state_block_nids)"
+
+const unmarkReferencedStateBlocksSQL = "" +
+	"UPDATE roomserver_state_block SET gc_marked_at = NULL" +
+	" WHERE gc_marked_at IS NOT NULL AND state_block_nid IN (" + referencedStateBlocksSQL + ")"
+
+const markUnreferencedStateBlocksSQL = "" +
+	"UPDATE roomserver_state_block SET gc_marked_at = $1" +
+	" WHERE gc_marked_at IS NULL AND state_block_nid NOT IN (" + referencedStateBlocksSQL + ")"
+
+const deleteMarkedStateBlocksSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid IN (" +
+	" SELECT state_block_nid FROM roomserver_state_block" +
+	" WHERE gc_marked_at <= $1 AND state_block_nid NOT IN (" + referencedStateBlocksSQL + ")" +
+	" ORDER BY state_block_nid ASC LIMIT $2" +
+	")" +
+	" RETURNING length(state_block_hash) + length(event_nids)"
+
 type stateBlockStatements struct {
 	db                              *sql.DB
 	insertStateDataStmt             *sql.Stmt
 	bulkSelectStateBlockEntriesStmt *sql.Stmt
+	selectStateBlocksAfterStmt      *sql.Stmt
+	unmarkReferencedStateBlocksStmt *sql.Stmt
+	markUnreferencedStateBlocksStmt *sql.Stmt
+	deleteMarkedStateBlocksStmt     *sql.Stmt
 }
 
 func CreateStateBlockTable(db *sql.DB) error {
@@ -76,6 +111,10 @@ func PrepareStateBlockTable(db *sql.DB) (tables.StateBlock, error) {
 	return s, sqlutil.StatementList{
 		{&s.insertStateDataStmt, insertStateDataSQL},
 		{&s.bulkSelectStateBlockEntriesStmt, bulkSelectStateBlockEntriesSQL},
+		{&s.selectStateBlocksAfterStmt, selectStateBlocksAfterSQL},
+		{&s.unmarkReferencedStateBlocksStmt, unmarkReferencedStateBlocksSQL},
+		{&s.markUnreferencedStateBlocksStmt, markUnreferencedStateBlocksSQL},
+		{&s.deleteMarkedStateBlocksStmt, deleteMarkedStateBlocksSQL},
 	}.Prepare(db)
 }
 
@@ -141,3 +180,81 @@ func (s *stateBlockStatements) BulkSelectStateBlockEntries(
 	}
 	return results, err
 }
+
+func (s *stateBlockStatements) SelectStateBlocksAfter(
+	ctx context.Context, txn *sql.Tx, afterNID types.StateBlockNID, limit int,
+) ([]types.StateBlockNID, [][]types.EventNID, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectStateBlocksAfterStmt)
+	rows, err := stmt.QueryContext(ctx, afterNID, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStateBlocksAfter: rows.close() failed")
+
+	var stateBlockNIDs []types.StateBlockNID
+	var eventNIDs [][]types.EventNID
+	var stateBlockNID types.StateBlockNID
+	var result json.RawMessage
+	for rows.Next() {
+		if err = rows.Scan(&stateBlockNID, &result); err != nil {
+			return nil, nil, err
+		}
+		var r []types.EventNID
+		if err = json.Unmarshal(result, &r); err != nil {
+			return nil, nil, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+		stateBlockNIDs = append(stateBlockNIDs, stateBlockNID)
+		eventNIDs = append(eventNIDs, r)
+	}
+	return stateBlockNIDs, eventNIDs, rows.Err()
+}
+
+func (s *stateBlockStatements) UnmarkStateBlocks(
+	ctx context.Context, txn *sql.Tx, stateBlockNIDs types.StateBlockNIDs,
+) error {
+	params := make([]interface{}, len(stateBlockNIDs))
+	for i := range stateBlockNIDs {
+		params[i] = int64(stateBlockNIDs[i])
+	}
+	query := strings.Replace(unmarkStateBlocksSQL, "($1)", sqlutil.QueryVariadic(len(params)), 1)
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close() // nolint:errcheck
+	_, err = sqlutil.TxStmt(txn, stmt).ExecContext(ctx, params...)
+	return err
+}
+
+func (s *stateBlockStatements) MarkUnreferencedStateBlocks(
+	ctx context.Context, txn *sql.Tx, markedAt int64,
+) (int64, error) {
+	if _, err := sqlutil.TxStmt(txn, s.unmarkReferencedStateBlocksStmt).ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	res, err := sqlutil.TxStmt(txn, s.markUnreferencedStateBlocksStmt).ExecContext(ctx, markedAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *stateBlockStatements) DeleteMarkedStateBlocks(
+	ctx context.Context, txn *sql.Tx, markedUntil int64, limit int,
+) (count, size int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteMarkedStateBlocksStmt)
+	rows, err := stmt.QueryContext(ctx, markedUntil, limit)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "deleteMarkedStateBlocks: rows.close() failed")
+	var rowSize int64
+	for rows.Next() {
+		if err = rows.Scan(&rowSize); err != nil {
+			return 0, 0, err
+		}
+		count++
+		size += rowSize
+	}
+	return count, size, rows.Err()
+}
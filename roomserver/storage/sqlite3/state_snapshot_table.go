@@ -40,18 +40,22 @@ const stateSnapshotSchema = `
 	-- The room NID that the snapshot belongs to.
     room_nid INTEGER NOT NULL,
 	-- The state blocks contained within this snapshot, encoded as JSON.
-    state_block_nids TEXT NOT NULL DEFAULT '[]'
+    state_block_nids TEXT NOT NULL DEFAULT '[]',
+	-- When the snapshot was found to be unreferenced by state compaction, or
+	-- NULL if it is referenced or hasn't been checked yet.
+	gc_marked_at INTEGER
   );
 `
 
 // Insert a new state snapshot. If we conflict on the hash column then
 // we must perform an update so that the RETURNING statement returns the
 // ID of the row that we conflicted with, so that we can then refer to
-// the original snapshot.
+// the original snapshot. The update also clears any compaction mark, so
+// that a reused snapshot isn't deleted.
 const insertStateSQL = `
 	INSERT INTO roomserver_state_snapshots (state_snapshot_hash, room_nid, state_block_nids)
 	  VALUES ($1, $2, $3)
-	  ON CONFLICT (state_snapshot_hash) DO UPDATE SET room_nid=$2
+	  ON CONFLICT (state_snapshot_hash) DO UPDATE SET room_nid=$2, gc_marked_at=NULL
 	  RETURNING state_snapshot_nid
 `
 
@@ -62,10 +66,46 @@ const bulkSelectStateBlockNIDsSQL = "" +
 	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
 	" WHERE state_snapshot_nid IN ($1) ORDER BY state_snapshot_nid ASC"
 
+const selectStateSnapshotsAfterSQL = "" +
+	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
+	" WHERE state_snapshot_nid > $1 ORDER BY state_snapshot_nid ASC LIMIT $2"
+
+// Replaces the state blocks of a snapshot, unless they were changed in the
+// meantime or another snapshot already has the new state blocks.
+const updateStateBlockNIDsSQL = "" +
+	"UPDATE roomserver_state_snapshots SET state_snapshot_hash = $1, state_block_nids = $2" +
+	" WHERE state_snapshot_nid = $3 AND state_block_nids = $4" +
+	" AND NOT EXISTS (SELECT 1 FROM roomserver_state_snapshots WHERE state_snapshot_hash = $1)"
+
+const stateSnapshotUnreferencedSQL = "" +
+	"NOT EXISTS (SELECT 1 FROM roomserver_events WHERE roomserver_events.state_snapshot_nid = roomserver_state_snapshots.state_snapshot_nid)" +
+	" AND NOT EXISTS (SELECT 1 FROM roomserver_rooms WHERE roomserver_rooms.state_snapshot_nid = roomserver_state_snapshots.state_snapshot_nid)"
+
+const unmarkReferencedStateSnapshotsSQL = "" +
+	"UPDATE roomserver_state_snapshots SET gc_marked_at = NULL" +
+	" WHERE gc_marked_at IS NOT NULL AND NOT (" + stateSnapshotUnreferencedSQL + ")"
+
+const markUnreferencedStateSnapshotsSQL = "" +
+	"UPDATE roomserver_state_snapshots SET gc_marked_at = $1" +
+	" WHERE gc_marked_at IS NULL AND " + stateSnapshotUnreferencedSQL
+
+const deleteMarkedStateSnapshotsSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE state_snapshot_nid IN (" +
+	" SELECT state_snapshot_nid FROM roomserver_state_snapshots" +
+	" WHERE gc_marked_at <= $1 AND " + stateSnapshotUnreferencedSQL +
+	" ORDER BY state_snapshot_nid ASC LIMIT $2" +
+	")" +
+	" RETURNING length(state_snapshot_hash) + length(state_block_nids)"
+
 type stateSnapshotStatements struct {
-	db                           *sql.DB
-	insertStateStmt              *sql.Stmt
-	bulkSelectStateBlockNIDsStmt *sql.Stmt
+	db                                 *sql.DB
+	insertStateStmt                    *sql.Stmt
+	bulkSelectStateBlockNIDsStmt       *sql.Stmt
+	selectStateSnapshotsAfterStmt      *sql.Stmt
+	updateStateBlockNIDsStmt           *sql.Stmt
+	unmarkReferencedStateSnapshotsStmt *sql.Stmt
+	markUnreferencedStateSnapshotsStmt *sql.Stmt
+	deleteMarkedStateSnapshotsStmt     *sql.Stmt
 }
 
 func CreateStateSnapshotTable(db *sql.DB) error {
@@ -81,6 +121,11 @@ func PrepareStateSnapshotTable(db *sql.DB) (tables.StateSnapshot, error) {
 	return s, sqlutil.StatementList{
 		{&s.insertStateStmt, insertStateSQL},
 		{&s.bulkSelectStateBlockNIDsStmt, bulkSelectStateBlockNIDsSQL},
+		{&s.selectStateSnapshotsAfterStmt, selectStateSnapshotsAfterSQL},
+		{&s.updateStateBlockNIDsStmt, updateStateBlockNIDsSQL},
+		{&s.unmarkReferencedStateSnapshotsStmt, unmarkReferencedStateSnapshotsSQL},
+		{&s.markUnreferencedStateSnapshotsStmt, markUnreferencedStateSnapshotsSQL},
+		{&s.deleteMarkedStateSnapshotsStmt, deleteMarkedStateSnapshotsSQL},
 	}.Prepare(db)
 }
 
@@ -146,3 +191,80 @@ func (s *stateSnapshotStatements) BulkSelectStateForHistoryVisibility(
 ) ([]types.EventNID, error) {
 	return nil, tables.OptimisationNotSupportedError
 }
+
+func (s *stateSnapshotStatements) SelectStateSnapshotsAfter(
+	ctx context.Context, txn *sql.Tx, afterNID types.StateSnapshotNID, limit int,
+) ([]types.StateBlockNIDList, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectStateSnapshotsAfterStmt)
+	rows, err := stmt.QueryContext(ctx, afterNID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStateSnapshotsAfter: rows.close() failed")
+	var results []types.StateBlockNIDList
+	var stateBlockNIDsJSON string
+	for rows.Next() {
+		var result types.StateBlockNIDList
+		if err = rows.Scan(&result.StateSnapshotNID, &stateBlockNIDsJSON); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(stateBlockNIDsJSON), &result.StateBlockNIDs); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *stateSnapshotStatements) UpdateStateBlockNIDs(
+	ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID, oldStateBlockNIDs, newStateBlockNIDs types.StateBlockNIDs,
+) (bool, error) {
+	oldJSON, err := json.Marshal(oldStateBlockNIDs)
+	if err != nil {
+		return false, err
+	}
+	newJSON, err := json.Marshal(newStateBlockNIDs)
+	if err != nil {
+		return false, err
+	}
+	stmt := sqlutil.TxStmt(txn, s.updateStateBlockNIDsStmt)
+	res, err := stmt.ExecContext(ctx, newStateBlockNIDs.Hash(), string(newJSON), stateNID, string(oldJSON))
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func (s *stateSnapshotStatements) MarkUnreferencedStateSnapshots(
+	ctx context.Context, txn *sql.Tx, markedAt int64,
+) (int64, error) {
+	if _, err := sqlutil.TxStmt(txn, s.unmarkReferencedStateSnapshotsStmt).ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	res, err := sqlutil.TxStmt(txn, s.markUnreferencedStateSnapshotsStmt).ExecContext(ctx, markedAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *stateSnapshotStatements) DeleteMarkedStateSnapshots(
+	ctx context.Context, txn *sql.Tx, markedUntil int64, limit int,
+) (count, size int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteMarkedStateSnapshotsStmt)
+	rows, err := stmt.QueryContext(ctx, markedUntil, limit)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "deleteMarkedStateSnapshots: rows.close() failed")
+	var rowSize int64
+	for rows.Next() {
+		if err = rows.Scan(&rowSize); err != nil {
+			return 0, 0, err
+		}
+		count++
+		size += rowSize
+	}
+	return count, size, rows.Err()
+}
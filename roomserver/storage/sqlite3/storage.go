@@ -68,15 +68,20 @@ func Open(base *base.BaseDendrite, dbProperties *config.DatabaseOptions, cache c
 	err = db.QueryRow("SELECT event_nid FROM roomserver_state_block LIMIT 1;").Scan(&eventNID)
 	if err == nil {
 		m := sqlutil.NewMigrator(db)
-		m.AddMigrations(sqlutil.Migration{
-			Version: "roomserver: state blocks refactor",
-			Up:      deltas.UpStateBlocksRefactor,
-		})
+		m.AddMigrations(deltas.StateBlocksRefactorMigration)
 		if err = m.Up(base.Context()); err != nil {
 			return nil, err
 		}
 	}
 
+	// The state blocks refactor above recreates the state tables, so the
+	// compaction columns can only be added once it has run.
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(deltas.StateGCMarksMigration)
+	if err = m.Up(base.Context()); err != nil {
+		return nil, err
+	}
+
 	// Then prepare the statements. Now that the migrations have run, any columns referred
 	// to in the database code should now exist.
 	if err = d.prepare(db, writer, cache); err != nil {
@@ -126,6 +131,9 @@ func (d *Database) create(db *sql.DB) error {
 	if err := CreateRedactionsTable(db); err != nil {
 		return err
 	}
+	if err := CreateReportedEventsTable(db); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -183,6 +191,10 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 	if err != nil {
 		return err
 	}
+	reportedEvents, err := PrepareReportedEventsTable(db)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                  db,
 		Cache:               cache,
@@ -200,6 +212,7 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 		MembershipTable:     membership,
 		PublishedTable:      published,
 		RedactionsTable:     redactions,
+		ReportedEventsTable: reportedEvents,
 		GetRoomUpdaterFn:    d.GetRoomUpdater,
 	}
 	return nil
@@ -66,6 +66,9 @@ type Events interface {
 	BulkSelectUnsentEventNID(ctx context.Context, txn *sql.Tx, eventIDs []string) (map[string]types.EventNID, error)
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDsForEventNIDs(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (roomNIDs map[types.EventNID]types.RoomNID, err error)
+	// SelectRoomEventNIDsAfter returns up to limit numeric IDs of events in the room after the given
+	// numeric ID, in ascending order. Only events which are part of the room's event graph are included.
+	SelectRoomEventNIDsAfter(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, afterNID types.EventNID, limit int) ([]types.EventNID, error)
 }
 
 type Rooms interface {
@@ -88,12 +91,35 @@ type StateSnapshot interface {
 	// which users are in a room faster than having to load the entire room state. In the
 	// case of SQLite, this will return tables.OptimisationNotSupportedError.
 	BulkSelectStateForHistoryVisibility(ctx context.Context, txn *sql.Tx, stateSnapshotNID types.StateSnapshotNID, domain string) ([]types.EventNID, error)
+	// SelectStateSnapshotsAfter returns up to limit snapshots with a NID greater than afterNID, in NID order.
+	SelectStateSnapshotsAfter(ctx context.Context, txn *sql.Tx, afterNID types.StateSnapshotNID, limit int) ([]types.StateBlockNIDList, error)
+	// UpdateStateBlockNIDs replaces the state blocks of a snapshot, as long as they haven't changed from
+	// oldStateBlockNIDs and no other snapshot already has the new state blocks. Returns whether it was updated.
+	UpdateStateBlockNIDs(ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID, oldStateBlockNIDs, newStateBlockNIDs types.StateBlockNIDs) (bool, error)
+	// MarkUnreferencedStateSnapshots records the given time against snapshots which aren't referenced
+	// by any event or room and haven't been marked already, and clears the mark from snapshots which
+	// are referenced again. Returns the number of newly marked snapshots.
+	MarkUnreferencedStateSnapshots(ctx context.Context, txn *sql.Tx, markedAt int64) (int64, error)
+	// DeleteMarkedStateSnapshots deletes up to limit snapshots which were marked at or before markedUntil
+	// and are still unreferenced. Returns the number of snapshots deleted and their approximate size in bytes.
+	DeleteMarkedStateSnapshots(ctx context.Context, txn *sql.Tx, markedUntil int64, limit int) (count, size int64, err error)
 }
 
 type StateBlock interface {
 	BulkInsertStateData(ctx context.Context, txn *sql.Tx, entries types.StateEntries) (types.StateBlockNID, error)
 	BulkSelectStateBlockEntries(ctx context.Context, txn *sql.Tx, stateBlockNIDs types.StateBlockNIDs) ([][]types.EventNID, error)
 	//BulkSelectFilteredStateBlockEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID, stateKeyTuples []types.StateKeyTuple) ([]types.StateEntryList, error)
+	// SelectStateBlocksAfter returns up to limit state blocks with a NID greater than afterNID, in NID order.
+	SelectStateBlocksAfter(ctx context.Context, txn *sql.Tx, afterNID types.StateBlockNID, limit int) ([]types.StateBlockNID, [][]types.EventNID, error)
+	// UnmarkStateBlocks clears the garbage collection mark from the given state blocks.
+	UnmarkStateBlocks(ctx context.Context, txn *sql.Tx, stateBlockNIDs types.StateBlockNIDs) error
+	// MarkUnreferencedStateBlocks records the given time against state blocks which aren't referenced
+	// by any snapshot and haven't been marked already, and clears the mark from state blocks which are
+	// referenced again. Returns the number of newly marked state blocks.
+	MarkUnreferencedStateBlocks(ctx context.Context, txn *sql.Tx, markedAt int64) (int64, error)
+	// DeleteMarkedStateBlocks deletes up to limit state blocks which were marked at or before markedUntil
+	// and are still unreferenced. Returns the number of blocks deleted and their approximate size in bytes.
+	DeleteMarkedStateBlocks(ctx context.Context, txn *sql.Tx, markedUntil int64, limit int) (count, size int64, err error)
 }
 
 type RoomAliases interface {
@@ -170,6 +196,20 @@ type Redactions interface {
 	MarkRedactionValidated(ctx context.Context, txn *sql.Tx, redactionEventID string, validated bool) error
 }
 
+type ReportedEvents interface {
+	// InsertReportedEvent stores a new event report and returns its ID.
+	InsertReportedEvent(ctx context.Context, txn *sql.Tx, report *types.EventReport) (int64, error)
+	// SelectReportedEvents returns up to limit reports matching the filter, newest
+	// first, starting below the report ID "from" (or from the newest report if 0),
+	// along with the total number of matching reports.
+	SelectReportedEvents(ctx context.Context, txn *sql.Tx, filter *types.EventReportFilter, from int64, limit int) ([]types.EventReport, int64, error)
+	// SelectReportedEvent returns the report with the given ID, or nil if there is no match.
+	SelectReportedEvent(ctx context.Context, txn *sql.Tx, reportID int64) (*types.EventReport, error)
+	// UpdateReportedEventResolved marks an unresolved report as resolved. Returns
+	// false if the report doesn't exist or was already resolved.
+	UpdateReportedEventResolved(ctx context.Context, txn *sql.Tx, reportID int64, resolvedBy string, resolvedTS gomatrixserverlib.Timestamp) (bool, error)
+}
+
 // StrippedEvent represents a stripped event for returning extracted content values.
 type StrippedEvent struct {
 	RoomID       string
@@ -0,0 +1,128 @@
+package tables_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCreateReportedEventsTable(t *testing.T, dbType test.DBType) (tab tables.ReportedEvents, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreateReportedEventsTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PrepareReportedEventsTable(db)
+	case test.DBTypeSQLite:
+		err = sqlite3.CreateReportedEventsTable(db)
+		assert.NoError(t, err)
+		tab, err = sqlite3.PrepareReportedEventsTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestReportedEventsTable(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room1 := test.NewRoom(t, alice)
+	room2 := test.NewRoom(t, alice)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateReportedEventsTable(t, dbType)
+		defer close()
+
+		// Report every event in both rooms, alternating the reporting user
+		var reportIDs []int64
+		for i, ev := range append(room1.Events(), room2.Events()...) {
+			reporter := alice.ID
+			if i%2 == 1 {
+				reporter = bob.ID
+			}
+			reportID, err := tab.InsertReportedEvent(ctx, nil, &types.EventReport{
+				RoomID:          ev.RoomID(),
+				EventID:         ev.EventID(),
+				ReportingUserID: reporter,
+				EventSender:     ev.Sender(),
+				Reason:          "spam",
+				Score:           -100,
+				ReceivedTS:      gomatrixserverlib.Timestamp(i + 1),
+				EventJSON:       ev.JSON(),
+			})
+			assert.NoError(t, err)
+			reportIDs = append(reportIDs, reportID)
+		}
+		total := int64(len(reportIDs))
+
+		// the report should round-trip
+		report, err := tab.SelectReportedEvent(ctx, nil, reportIDs[0])
+		assert.NoError(t, err)
+		assert.Equal(t, room1.Events()[0].EventID(), report.EventID)
+		assert.Equal(t, alice.ID, report.ReportingUserID)
+		assert.Equal(t, int64(-100), report.Score)
+		assert.Equal(t, string(room1.Events()[0].JSON()), string(report.EventJSON))
+		assert.False(t, report.Resolved())
+
+		// unknown reports should return nil
+		report, err = tab.SelectReportedEvent(ctx, nil, 1<<40)
+		assert.NoError(t, err)
+		assert.Nil(t, report)
+
+		// listing returns the newest reports first
+		reports, count, err := tab.SelectReportedEvents(ctx, nil, &types.EventReportFilter{}, 0, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, total, count)
+		assert.Equal(t, 3, len(reports))
+		assert.Equal(t, reportIDs[len(reportIDs)-1], reports[0].ID)
+
+		// paginate from the last report we saw
+		reports, _, err = tab.SelectReportedEvents(ctx, nil, &types.EventReportFilter{}, reports[2].ID, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, len(reportIDs)-3, len(reports))
+
+		// filter by room and reporting user
+		reports, count, err = tab.SelectReportedEvents(ctx, nil, &types.EventReportFilter{RoomID: room2.ID, ReportingUserID: bob.ID}, 0, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(reports)), count)
+		for _, r := range reports {
+			assert.Equal(t, room2.ID, r.RoomID)
+			assert.Equal(t, bob.ID, r.ReportingUserID)
+		}
+
+		// resolving a report hides it from the queue unless resolved reports are requested
+		resolved, err := tab.UpdateReportedEventResolved(ctx, nil, reportIDs[0], alice.ID, 1234)
+		assert.NoError(t, err)
+		assert.True(t, resolved)
+		resolved, err = tab.UpdateReportedEventResolved(ctx, nil, reportIDs[0], alice.ID, 1234)
+		assert.NoError(t, err)
+		assert.False(t, resolved, "report was resolved twice")
+
+		_, count, err = tab.SelectReportedEvents(ctx, nil, &types.EventReportFilter{}, 0, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, total-1, count)
+		_, count, err = tab.SelectReportedEvents(ctx, nil, &types.EventReportFilter{IncludeResolved: true}, 0, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, total, count)
+
+		report, err = tab.SelectReportedEvent(ctx, nil, reportIDs[0])
+		assert.NoError(t, err)
+		assert.True(t, report.Resolved())
+		assert.Equal(t, gomatrixserverlib.Timestamp(1234), report.ResolvedTS)
+	})
+}
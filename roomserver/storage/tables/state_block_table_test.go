@@ -23,10 +23,15 @@ func mustCreateStateBlockTable(t *testing.T, dbType test.DBType) (tab tables.Sta
 	assert.NoError(t, err)
 	switch dbType {
 	case test.DBTypePostgres:
+		// state compaction looks for state blocks referenced by snapshots
+		err = postgres.CreateStateSnapshotTable(db)
+		assert.NoError(t, err)
 		err = postgres.CreateStateBlockTable(db)
 		assert.NoError(t, err)
 		tab, err = postgres.PrepareStateBlockTable(db)
 	case test.DBTypeSQLite:
+		err = sqlite3.CreateStateSnapshotTable(db)
+		assert.NoError(t, err)
 		err = sqlite3.CreateStateBlockTable(db)
 		assert.NoError(t, err)
 		tab, err = sqlite3.PrepareStateBlockTable(db)
@@ -31,11 +31,19 @@ func mustCreateStateSnapshotTable(t *testing.T, dbType test.DBType) (tab tables.
 		assert.NoError(t, err)
 		err = postgres.CreateStateBlockTable(db)
 		assert.NoError(t, err)
+		// state compaction looks for snapshots referenced by rooms
+		err = postgres.CreateRoomsTable(db)
+		assert.NoError(t, err)
 		// ... and then the snapshot table itself
 		err = postgres.CreateStateSnapshotTable(db)
 		assert.NoError(t, err)
 		tab, err = postgres.PrepareStateSnapshotTable(db)
 	case test.DBTypeSQLite:
+		// state compaction looks for snapshots referenced by events and rooms
+		err = sqlite3.CreateEventsTable(db)
+		assert.NoError(t, err)
+		err = sqlite3.CreateRoomsTable(db)
+		assert.NoError(t, err)
 		err = sqlite3.CreateStateSnapshotTable(db)
 		assert.NoError(t, err)
 		tab, err = sqlite3.PrepareStateSnapshotTable(db)
@@ -85,6 +93,29 @@ func TestStateSnapshotTable(t *testing.T) {
 		_, err = tab.BulkSelectStateBlockNIDs(ctx, nil, []types.StateSnapshotNID{2})
 		assert.Error(t, err)
 
+		// replace the state blocks of the first snapshot, as state compaction does
+		merged := types.StateBlockNIDs{1000, 1001}
+		updated, err := tab.UpdateStateBlockNIDs(ctx, nil, 1, stateBlockNIDs, merged)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+		// ... but not if they have changed in the meantime
+		updated, err = tab.UpdateStateBlockNIDs(ctx, nil, 1, stateBlockNIDs, types.StateBlockNIDs{1002})
+		assert.NoError(t, err)
+		assert.False(t, updated)
+		// ... or if another snapshot already has the same state blocks
+		updated, err = tab.UpdateStateBlockNIDs(ctx, nil, 3, stateBlockNIDs2, merged)
+		assert.NoError(t, err)
+		assert.False(t, updated)
+
+		snapshots, err := tab.SelectStateSnapshotsAfter(ctx, nil, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(snapshots))
+		assert.Equal(t, merged, types.StateBlockNIDs(snapshots[0].StateBlockNIDs))
+		assert.Equal(t, stateBlockNIDs2, types.StateBlockNIDs(snapshots[1].StateBlockNIDs))
+		snapshots, err = tab.SelectStateSnapshotsAfter(ctx, nil, 1, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(snapshots))
+
 		// create a second snapshot
 		for i := 0; i < 65555; i++ {
 			stateBlockNIDs2 = append(stateBlockNIDs2, types.StateBlockNID(i))
@@ -17,6 +17,7 @@ package types
 
 import (
 	"encoding/json"
+	"fmt"
 	"sort"
 	"strings"
 	"sync"
@@ -323,3 +324,126 @@ func (r *RoomInfo) CopyFrom(r2 *RoomInfo) {
 	r.stateSnapshotNID = r2.stateSnapshotNID
 	r.isStub = r2.isStub
 }
+
+// EventReport is a report of an event made by a local user, as stored in the
+// moderation queue.
+type EventReport struct {
+	ID               int64                       `json:"id"`
+	RoomID           string                      `json:"room_id"`
+	EventID          string                      `json:"event_id"`
+	ReportingUserID  string                      `json:"user_id"`
+	EventSender      string                      `json:"sender"`
+	Reason           string                      `json:"reason,omitempty"`
+	Score            int64                       `json:"score"`
+	ReceivedTS       gomatrixserverlib.Timestamp `json:"received_ts"`
+	EventJSON        json.RawMessage             `json:"event_json,omitempty"`
+	ResolvedByUserID string                      `json:"resolved_by,omitempty"`
+	ResolvedTS       gomatrixserverlib.Timestamp `json:"resolved_ts,omitempty"`
+}
+
+// Resolved returns true if a moderator has marked the report as resolved.
+func (r *EventReport) Resolved() bool {
+	return r.ResolvedByUserID != ""
+}
+
+// EventReportFilter restricts which reports are returned when listing the
+// moderation queue. Empty fields match everything.
+type EventReportFilter struct {
+	RoomID          string `json:"room_id,omitempty"`
+	ReportingUserID string `json:"user_id,omitempty"`
+	// IncludeResolved also returns reports which have already been resolved.
+	IncludeResolved bool `json:"include_resolved,omitempty"`
+}
+
+// StateCompactionReport describes the work done by a state compaction.
+type StateCompactionReport struct {
+	// The number of state blocks whose contents were identical to an
+	// earlier state block.
+	DuplicateBlocks int64 `json:"duplicate_blocks"`
+	// The number of snapshots which were changed to refer to the earlier
+	// copy of a duplicate state block.
+	SnapshotsRewritten int64 `json:"snapshots_rewritten"`
+	// The number of newly unreferenced snapshots and state blocks, which
+	// will be deleted by a later compaction if they are still unreferenced
+	// once the grace period has passed.
+	SnapshotsMarked int64 `json:"snapshots_marked"`
+	BlocksMarked    int64 `json:"blocks_marked"`
+	// The number of snapshots and state blocks deleted.
+	SnapshotsDeleted int64 `json:"snapshots_deleted"`
+	BlocksDeleted    int64 `json:"blocks_deleted"`
+	// The approximate size of the deleted rows. The database may need to
+	// be vacuumed before the space is returned to the operating system.
+	BytesReclaimed int64 `json:"bytes_reclaimed"`
+}
+
+// The checks made by the room integrity checker, used in RoomCheckProblem.
+const (
+	RoomCheckAuthEvents         = "auth_events"
+	RoomCheckPrevEvents         = "prev_events"
+	RoomCheckState              = "state"
+	RoomCheckForwardExtremities = "forward_extremities"
+	RoomCheckSyncAPIState       = "syncapi_state"
+)
+
+// RoomCheckProblem describes an inconsistency found in a room by the room
+// integrity checker.
+type RoomCheckProblem struct {
+	// Which check found the problem, e.g. RoomCheckAuthEvents.
+	Check string `json:"check"`
+	// The event that the problem concerns, if any.
+	EventID string `json:"event_id,omitempty"`
+	Detail  string `json:"detail"`
+	// True if the problem was repaired.
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+// RoomCheckReport describes the results of checking a room.
+type RoomCheckReport struct {
+	RoomID string `json:"room_id"`
+	// The number of events checked.
+	EventsChecked int64 `json:"events_checked"`
+	// The number of events whose state was recalculated from their prev
+	// events and compared to the stored state.
+	StatesChecked int64 `json:"states_checked"`
+	// The number of prev events which we don't have, but which are known
+	// to be missing because they are referenced by an event we do have.
+	// These are gaps in the room DAG, which are normal when we joined the
+	// room over federation or failed to fetch missing events.
+	MissingPrevEvents int64              `json:"missing_prev_events"`
+	Problems          []RoomCheckProblem `json:"problems"`
+}
+
+// AddProblem adds a problem to the report.
+func (r *RoomCheckReport) AddProblem(check, eventID, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, RoomCheckProblem{
+		Check:   check,
+		EventID: eventID,
+		Detail:  fmt.Sprintf(format, args...),
+	})
+}
+
+// CheckSyncAPIState compares the current state event IDs of the room in the
+// roomserver with those in the sync API, and adds a problem to the report for
+// each difference. Returns true if they are the same.
+func (r *RoomCheckReport) CheckSyncAPIState(roomserverEventIDs, syncAPIEventIDs []string) bool {
+	inSyncAPI := make(map[string]bool, len(syncAPIEventIDs))
+	for _, eventID := range syncAPIEventIDs {
+		inSyncAPI[eventID] = true
+	}
+	same := true
+	for _, eventID := range roomserverEventIDs {
+		if inSyncAPI[eventID] {
+			delete(inSyncAPI, eventID)
+			continue
+		}
+		r.AddProblem(RoomCheckSyncAPIState, eventID, "state event is missing from the sync API current state")
+		same = false
+	}
+	for _, eventID := range syncAPIEventIDs {
+		if inSyncAPI[eventID] {
+			r.AddProblem(RoomCheckSyncAPIState, eventID, "sync API current state has an event which isn't in the roomserver current state")
+			same = false
+		}
+	}
+	return same
+}
@@ -33,6 +33,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -84,6 +85,7 @@ type BaseDendrite struct {
 	Cfg                    *config.Dendrite
 	Caches                 *caching.Caches
 	DNSCache               *gomatrixserverlib.DNSCache
+	SpamChecker            *spamcheck.Modules
 	Database               *sql.DB
 	DatabaseWriter         sqlutil.Writer
 	EnableMetrics          bool
@@ -94,6 +96,16 @@ const NoListener = ""
 const HTTPServerTimeout = time.Minute * 5
 const HTTPClientTimeout = time.Second * 30
 
+// The names of the components whose internal APIs can be served over NATS,
+// which are used in the subjects.
+const (
+	AppServiceInternalAPI    = "appservice"
+	FederationAPIInternalAPI = "federationapi"
+	KeyServerInternalAPI     = "keyserver"
+	RoomServerInternalAPI    = "roomserver"
+	UserAPIInternalAPI       = "userapi"
+)
+
 type BaseDendriteOptions int
 
 const (
@@ -174,6 +186,11 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, options ...Base
 		)
 	}
 
+	spamChecker, err := spamcheck.New(&cfg.Global.SpamChecker)
+	if err != nil {
+		logrus.WithError(err).Panic("Failed to load spam checker modules")
+	}
+
 	apiClient := http.Client{
 		Timeout: time.Minute * 10,
 		Transport: &http2.Transport{
@@ -207,9 +224,17 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, options ...Base
 		if db, err = sqlutil.Open(&cfg.Global.DatabaseOptions, writer); err != nil {
 			logrus.WithError(err).Panic("Failed to set up global database connections")
 		}
+		if enableMetrics {
+			sqlutil.RegisterConnectionPoolMetrics(db, &cfg.Global.DatabaseOptions)
+		}
 		logrus.Debug("Using global database connection pool")
 	}
 
+	caches, err := caching.NewCaches(&cfg.Global.Cache, enableMetrics)
+	if err != nil {
+		logrus.WithError(err).Panic("Failed to set up caches")
+	}
+
 	// Ideally we would only use SkipClean on routes which we know can allow '/' but due to
 	// https://github.com/gorilla/mux/issues/460 we have to attach this at the top router.
 	// When used in conjunction with UseEncodedPath() we get the behaviour we want when parsing
@@ -222,14 +247,15 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, options ...Base
 	// are not inadvertently reading paths without cleaning, else this could introduce a
 	// directory traversal attack e.g /../../../etc/passwd
 
-	return &BaseDendrite{
+	b := &BaseDendrite{
 		ProcessContext:         process.NewProcessContext(),
 		componentName:          componentName,
 		UseHTTPAPIs:            useHTTPAPIs,
 		tracerCloser:           closer,
 		Cfg:                    cfg,
-		Caches:                 caching.NewRistrettoCache(cfg.Global.Cache.EstimatedMaxSize, cfg.Global.Cache.MaxAge, enableMetrics),
+		Caches:                 caches,
 		DNSCache:               dnsCache,
+		SpamChecker:            spamChecker,
 		PublicClientAPIMux:     mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicClientPathPrefix).Subrouter().UseEncodedPath(),
 		PublicFederationAPIMux: mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicFederationPathPrefix).Subrouter().UseEncodedPath(),
 		PublicKeyAPIMux:        mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicKeyPathPrefix).Subrouter().UseEncodedPath(),
@@ -238,12 +264,23 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, options ...Base
 		InternalAPIMux:         mux.NewRouter().SkipClean(true).PathPrefix(httputil.InternalPathPrefix).Subrouter().UseEncodedPath(),
 		DendriteAdminMux:       mux.NewRouter().SkipClean(true).PathPrefix(httputil.DendriteAdminPathPrefix).Subrouter().UseEncodedPath(),
 		SynapseAdminMux:        mux.NewRouter().SkipClean(true).PathPrefix(httputil.SynapseAdminPathPrefix).Subrouter().UseEncodedPath(),
-		NATS:                   &jetstream.NATSInstance{},
+		NATS:                   &jetstream.NATSInstance{EnableMetrics: enableMetrics},
 		apiHttpClient:          &apiClient,
 		Database:               db,     // set if monolith with global connection pool only
 		DatabaseWriter:         writer, // set if monolith with global connection pool only
 		EnableMetrics:          enableMetrics,
 	}
+
+	// In polylith deployments, other processes may change entries in the
+	// shared caches which are kept in memory, so they need to tell us.
+	if !isMonolith && cfg.Global.Cache.Backend != config.CacheBackendRedis {
+		_, nc := b.NATS.Prepare(b.ProcessContext, &cfg.Global.JetStream)
+		if err = caches.StartInvalidation(nc, cfg.Global.JetStream.Prefixed(jetstream.CacheInvalidation)); err != nil {
+			logrus.WithError(err).Panic("Failed to start cache invalidation")
+		}
+	}
+
+	return b
 }
 
 // Close implements io.Closer
@@ -264,6 +301,9 @@ func (b *BaseDendrite) DatabaseConnection(dbProperties *config.DatabaseOptions,
 	if dbProperties.ConnectionString != "" || b == nil {
 		// Open a new database connection using the supplied config.
 		db, err := sqlutil.Open(dbProperties, writer)
+		if err == nil && b != nil && b.EnableMetrics {
+			sqlutil.RegisterConnectionPoolMetrics(db, dbProperties)
+		}
 		return db, writer, err
 	}
 	if b.Database != nil && b.DatabaseWriter != nil {
@@ -274,9 +314,39 @@ func (b *BaseDendrite) DatabaseConnection(dbProperties *config.DatabaseOptions,
 	return nil, nil, fmt.Errorf("no database connections configured")
 }
 
+// internalAPIClient returns the URL and the HTTP client to use for sending
+// requests to the internal API of a component, which sends them over NATS
+// if the component is configured to use it.
+func (b *BaseDendrite) internalAPIClient(component string, opts *config.InternalAPIOptions) (string, *http.Client) {
+	if !opts.UseNATS() {
+		return string(opts.Connect), b.apiHttpClient
+	}
+	_, nc := b.NATS.Prepare(b.ProcessContext, &b.Cfg.Global.JetStream)
+	return "nats://" + component, &http.Client{
+		Timeout:   b.apiHttpClient.Timeout,
+		Transport: httputil.NewNATSTransport(nc, b.Cfg.Global.JetStream.Prefixed(jetstream.InternalAPI)),
+	}
+}
+
+// ServeInternalAPIOverNATS serves the internal API of a component, whose
+// routes must have been added to the InternalAPIMux, over NATS if the
+// component is configured to use it. It is served over HTTP too.
+func (b *BaseDendrite) ServeInternalAPIOverNATS(component string, opts *config.InternalAPIOptions) {
+	if !opts.UseNATS() {
+		return
+	}
+	_, nc := b.NATS.Prepare(b.ProcessContext, &b.Cfg.Global.JetStream)
+	subjectPrefix := b.Cfg.Global.JetStream.Prefixed(jetstream.InternalAPI)
+	if _, err := httputil.ServeNATS(b.ProcessContext.Context(), nc, subjectPrefix, component, b.InternalAPIMux); err != nil {
+		logrus.WithError(err).Panicf("Failed to serve the %s internal API over NATS", component)
+	}
+	logrus.Infof("Serving the %s internal API over NATS", component)
+}
+
 // AppserviceHTTPClient returns the AppServiceInternalAPI for hitting the appservice component over HTTP.
 func (b *BaseDendrite) AppserviceHTTPClient() appserviceAPI.AppServiceInternalAPI {
-	a, err := asinthttp.NewAppserviceClient(b.Cfg.AppServiceURL(), b.apiHttpClient)
+	url, client := b.internalAPIClient(AppServiceInternalAPI, &b.Cfg.AppServiceAPI.InternalAPI)
+	a, err := asinthttp.NewAppserviceClient(url, client)
 	if err != nil {
 		logrus.WithError(err).Panic("CreateHTTPAppServiceAPIs failed")
 	}
@@ -285,7 +355,8 @@ func (b *BaseDendrite) AppserviceHTTPClient() appserviceAPI.AppServiceInternalAP
 
 // RoomserverHTTPClient returns RoomserverInternalAPI for hitting the roomserver over HTTP.
 func (b *BaseDendrite) RoomserverHTTPClient() roomserverAPI.RoomserverInternalAPI {
-	rsAPI, err := rsinthttp.NewRoomserverClient(b.Cfg.RoomServerURL(), b.apiHttpClient, b.Caches)
+	url, client := b.internalAPIClient(RoomServerInternalAPI, &b.Cfg.RoomServer.InternalAPI)
+	rsAPI, err := rsinthttp.NewRoomserverClient(url, client, b.Caches)
 	if err != nil {
 		logrus.WithError(err).Panic("RoomserverHTTPClient failed", b.apiHttpClient)
 	}
@@ -294,7 +365,8 @@ func (b *BaseDendrite) RoomserverHTTPClient() roomserverAPI.RoomserverInternalAP
 
 // UserAPIClient returns UserInternalAPI for hitting the userapi over HTTP.
 func (b *BaseDendrite) UserAPIClient() userapi.UserInternalAPI {
-	userAPI, err := userapiinthttp.NewUserAPIClient(b.Cfg.UserAPIURL(), b.apiHttpClient)
+	url, client := b.internalAPIClient(UserAPIInternalAPI, &b.Cfg.UserAPI.InternalAPI)
+	userAPI, err := userapiinthttp.NewUserAPIClient(url, client)
 	if err != nil {
 		logrus.WithError(err).Panic("UserAPIClient failed", b.apiHttpClient)
 	}
@@ -304,7 +376,8 @@ func (b *BaseDendrite) UserAPIClient() userapi.UserInternalAPI {
 // FederationAPIHTTPClient returns FederationInternalAPI for hitting
 // the federation API server over HTTP
 func (b *BaseDendrite) FederationAPIHTTPClient() federationAPI.FederationInternalAPI {
-	f, err := federationIntHTTP.NewFederationAPIClient(b.Cfg.FederationAPIURL(), b.apiHttpClient, b.Caches)
+	url, client := b.internalAPIClient(FederationAPIInternalAPI, &b.Cfg.FederationAPI.InternalAPI)
+	f, err := federationIntHTTP.NewFederationAPIClient(url, client, b.Caches)
 	if err != nil {
 		logrus.WithError(err).Panic("FederationAPIHTTPClient failed", b.apiHttpClient)
 	}
@@ -313,7 +386,8 @@ func (b *BaseDendrite) FederationAPIHTTPClient() federationAPI.FederationInterna
 
 // KeyServerHTTPClient returns KeyInternalAPI for hitting the key server over HTTP
 func (b *BaseDendrite) KeyServerHTTPClient() keyserverAPI.KeyInternalAPI {
-	f, err := keyinthttp.NewKeyServerClient(b.Cfg.KeyServerURL(), b.apiHttpClient)
+	url, client := b.internalAPIClient(KeyServerInternalAPI, &b.Cfg.KeyServer.InternalAPI)
+	f, err := keyinthttp.NewKeyServerClient(url, client)
 	if err != nil {
 		logrus.WithError(err).Panic("KeyServerHTTPClient failed", b.apiHttpClient)
 	}
@@ -71,6 +71,9 @@ type Dendrite struct {
 		Enabled bool `yaml:"enabled"`
 		// The config for the jaeger opentracing reporter.
 		Jaeger jaegerconfig.Configuration `yaml:"jaeger"`
+		// The config for exporting traces with OpenTelemetry over OTLP,
+		// which is used instead of jaeger if an endpoint is set.
+		OTLP OTLPTracing `yaml:"otlp"`
 	} `yaml:"tracing"`
 
 	// The config for logging informations. Each hook will be added to logrus.
@@ -116,6 +119,31 @@ type Derived struct {
 type InternalAPIOptions struct {
 	Listen  HTTPAddress `yaml:"listen"`
 	Connect HTTPAddress `yaml:"connect"`
+	// How other components send requests to the internal API, either over
+	// HTTP to the connect address or over NATS, which balances requests
+	// between all running instances of the component. Defaults to HTTP.
+	Transport InternalAPITransport `yaml:"transport"`
+}
+
+// InternalAPITransport is how requests are sent to an internal API.
+type InternalAPITransport string
+
+const (
+	InternalAPITransportHTTP InternalAPITransport = "http"
+	InternalAPITransportNATS InternalAPITransport = "nats"
+)
+
+// UseNATS returns true if requests are sent to the internal API over NATS.
+func (c *InternalAPIOptions) UseNATS() bool {
+	return c.Transport == InternalAPITransportNATS
+}
+
+func (c *InternalAPIOptions) verifyTransport(configErrs *ConfigErrors, key string) {
+	switch c.Transport {
+	case "", InternalAPITransportHTTP, InternalAPITransportNATS:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key, c.Transport))
+	}
 }
 
 type ExternalAPIOptions struct {
@@ -306,6 +334,7 @@ func (c *Dendrite) Defaults(generate bool) {
 	c.UserAPI.Defaults(generate)
 	c.AppServiceAPI.Defaults(generate)
 	c.MSCs.Defaults(generate)
+	c.Tracing.OTLP.Defaults()
 
 	c.Wiring()
 }
@@ -322,6 +351,7 @@ func (c *Dendrite) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	} {
 		c.Verify(configErrs, isMonolith)
 	}
+	c.Tracing.OTLP.Verify(configErrs)
 }
 
 func (c *Dendrite) Wiring() {
@@ -532,6 +562,9 @@ func (config *Dendrite) SetupTracing(serviceName string) (closer io.Closer, err
 	if !config.Tracing.Enabled {
 		return io.NopCloser(bytes.NewReader([]byte{})), nil
 	}
+	if config.Tracing.OTLP.Endpoint != "" {
+		return config.Tracing.OTLP.InitGlobalTracer(serviceName)
+	}
 	return config.Tracing.Jaeger.InitGlobalTracer(
 		serviceName,
 		jaegerconfig.Logger(logrusLogger{logrus.StandardLogger()}),
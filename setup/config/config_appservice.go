@@ -20,6 +20,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
@@ -38,6 +39,10 @@ type AppServiceAPI struct {
 	DisableTLSValidation bool `yaml:"disable_tls_validation"`
 
 	ConfigFiles []string `yaml:"config_files"`
+
+	// Webhooks which are sent a feed of room events, receipts and account data
+	// updates, for integrations which don't need a full application service.
+	Webhooks []Webhook `yaml:"webhooks"`
 }
 
 func (c *AppServiceAPI) Defaults(generate bool) {
@@ -53,11 +58,80 @@ func (c *AppServiceAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "app_service_api.database.connection_string", string(c.Database.ConnectionString))
 	}
+	ids := map[string]struct{}{}
+	for i := range c.Webhooks {
+		c.Webhooks[i].Verify(configErrs, fmt.Sprintf("app_service_api.webhooks[%d]", i))
+		if _, ok := ids[c.Webhooks[i].ID]; ok {
+			configErrs.Add(fmt.Sprintf("duplicate webhook ID %q in app_service_api.webhooks", c.Webhooks[i].ID))
+		}
+		ids[c.Webhooks[i].ID] = struct{}{}
+	}
 	if isMonolith { // polylith required configs below
 		return
 	}
 	checkURL(configErrs, "app_service_api.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "app_service_api.internal_api.connect", string(c.InternalAPI.Connect))
+	c.InternalAPI.verifyTransport(configErrs, "app_service_api.internal_api.transport")
+}
+
+// The streams which can be sent to webhooks.
+const (
+	WebhookStreamRoomEvents  = "room_events"
+	WebhookStreamReceipts    = "receipts"
+	WebhookStreamAccountData = "account_data"
+)
+
+// Webhook is an HTTP endpoint which is sent a feed of events.
+type Webhook struct {
+	// A unique ID for the webhook. This is used to name the durable JetStream
+	// consumers, so changing it will cause any undelivered events to be lost.
+	ID string `yaml:"id"`
+	// The URL to POST events to.
+	URL string `yaml:"url"`
+	// If set, requests are signed with an HMAC-SHA256 of the body using this
+	// secret, in the X-Dendrite-Signature-256 header.
+	Secret string `yaml:"secret"`
+	// The streams to send, any of room_events, receipts and account_data.
+	// Defaults to room_events only.
+	Streams []string `yaml:"streams"`
+	// If set, only send events for these room IDs.
+	Rooms []string `yaml:"rooms"`
+	// If set, only send events from these user IDs. For receipts and account
+	// data this is the user who the receipt or account data belongs to.
+	Senders []string `yaml:"senders"`
+	// If set, only send events of these types. A trailing * matches any type
+	// with that prefix, e.g. m.room.*.
+	Types []string `yaml:"types"`
+	// How long to wait for the endpoint to respond to each request.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *Webhook) Verify(configErrs *ConfigErrors, key string) {
+	checkNotEmpty(configErrs, key+".id", c.ID)
+	checkURL(configErrs, key+".url", c.URL)
+	for _, stream := range c.Streams {
+		switch stream {
+		case WebhookStreamRoomEvents, WebhookStreamReceipts, WebhookStreamAccountData:
+		default:
+			configErrs.Add(fmt.Sprintf("invalid stream %q for config key %q", stream, key+".streams"))
+		}
+	}
+	if c.Timeout < 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", key+".timeout", c.Timeout))
+	}
+}
+
+// WantsStream returns true if the webhook should be sent the given stream.
+func (c *Webhook) WantsStream(stream string) bool {
+	if len(c.Streams) == 0 {
+		return stream == WebhookStreamRoomEvents
+	}
+	for _, s := range c.Streams {
+		if s == stream {
+			return true
+		}
+	}
+	return false
 }
 
 // ApplicationServiceNamespace is the namespace that a specific application
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"time"
 )
 
@@ -48,6 +49,9 @@ type ClientAPI struct {
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
 
+	// Event reporting options
+	EventReports EventReports `yaml:"event_reports"`
+
 	MSCs *MSCs `yaml:"mscs"`
 }
 
@@ -69,6 +73,9 @@ func (c *ClientAPI) Defaults(generate bool) {
 func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	c.TURN.Verify(configErrs)
 	c.RateLimiting.Verify(configErrs)
+	if len(c.EventReports.NotifyUserIDs) > 0 && (c.Matrix == nil || !c.Matrix.ServerNotices.Enabled) {
+		configErrs.Add("client_api.event_reports.notify_user_ids requires global.server_notices to be enabled")
+	}
 	if c.RecaptchaEnabled {
 		checkNotEmpty(configErrs, "client_api.recaptcha_public_key", c.RecaptchaPublicKey)
 		checkNotEmpty(configErrs, "client_api.recaptcha_private_key", c.RecaptchaPrivateKey)
@@ -138,17 +145,99 @@ type RateLimiting struct {
 	// A list of users that are exempt from rate limiting, i.e. if you want
 	// to run Mjolnir or other bots.
 	ExemptUserIDs []string `yaml:"exempt_user_ids"`
+
+	// The HTTP header which contains the real IP address of the client, if
+	// Dendrite is running behind a reverse proxy. Login attempts and
+	// registrations are limited per IP address, so this should be set if
+	// there is a proxy, since otherwise every client shares its address.
+	RealIPHeader string `yaml:"real_ip_header"`
+
+	// The IP addresses or CIDR ranges of the reverse proxies which are
+	// trusted to set the real IP header. The header is ignored on requests
+	// from anywhere else, so that clients can't pick their own address.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// Limits for specific actions, which apply in addition to the threshold
+	// above. Login attempts are limited per IP address and failed login
+	// attempts per account, registrations per IP address and everything else
+	// per user.
+	LoginAddress RateLimit `yaml:"login_address"`
+	LoginAccount RateLimit `yaml:"login_account"`
+	Registration RateLimit `yaml:"registration"`
+	Message      RateLimit `yaml:"message"`
+	Join         RateLimit `yaml:"join"`
+	Invite       RateLimit `yaml:"invite"`
+	MediaUpload  RateLimit `yaml:"media_upload"`
 }
 
 func (r *RateLimiting) Verify(configErrs *ConfigErrors) {
 	if r.Enabled {
 		checkPositive(configErrs, "client_api.rate_limiting.threshold", r.Threshold)
 		checkPositive(configErrs, "client_api.rate_limiting.cooloff_ms", r.CooloffMS)
+		r.LoginAddress.Verify(configErrs, "client_api.rate_limiting.login_address")
+		r.LoginAccount.Verify(configErrs, "client_api.rate_limiting.login_account")
+		r.Registration.Verify(configErrs, "client_api.rate_limiting.registration")
+		r.Message.Verify(configErrs, "client_api.rate_limiting.message")
+		r.Join.Verify(configErrs, "client_api.rate_limiting.join")
+		r.Invite.Verify(configErrs, "client_api.rate_limiting.invite")
+		r.MediaUpload.Verify(configErrs, "client_api.rate_limiting.media_upload")
+		if r.RealIPHeader != "" && len(r.TrustedProxies) == 0 {
+			configErrs.Add("client_api.rate_limiting.trusted_proxies must be set when real_ip_header is set")
+		}
+		for _, proxy := range r.TrustedProxies {
+			if _, err := ParseTrustedProxy(proxy); err != nil {
+				configErrs.Add(fmt.Sprintf("invalid IP address or CIDR range for config key %q: %s", "client_api.rate_limiting.trusted_proxies", proxy))
+			}
+		}
+	}
+}
+
+// ParseTrustedProxy parses a trusted proxy, which is either an IP address or
+// a CIDR range.
+func ParseTrustedProxy(proxy string) (*net.IPNet, error) {
+	if ip := net.ParseIP(proxy); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
 	}
+	_, network, err := net.ParseCIDR(proxy)
+	return network, err
 }
 
 func (r *RateLimiting) Defaults() {
 	r.Enabled = true
 	r.Threshold = 5
 	r.CooloffMS = 500
+	r.LoginAddress = RateLimit{PerSecond: 0.17, Burst: 3}
+	r.LoginAccount = RateLimit{PerSecond: 0.17, Burst: 3}
+	r.Registration = RateLimit{PerSecond: 0.17, Burst: 3}
+	r.Message = RateLimit{PerSecond: 0.2, Burst: 10}
+	r.Join = RateLimit{PerSecond: 0.1, Burst: 10}
+	r.Invite = RateLimit{PerSecond: 0.2, Burst: 10}
+	r.MediaUpload = RateLimit{PerSecond: 1, Burst: 10}
+}
+
+// RateLimit configures a token bucket, which holds up to Burst tokens and is
+// refilled at PerSecond tokens per second. Each request takes a token, and is
+// rejected if the bucket is empty. A PerSecond of 0 disables the limit.
+type RateLimit struct {
+	PerSecond float64 `yaml:"per_second"`
+	Burst     int64   `yaml:"burst"`
+}
+
+func (r *RateLimit) Verify(configErrs *ConfigErrors, key string) {
+	if r.PerSecond < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %v", key+".per_second", r.PerSecond))
+	}
+	if r.PerSecond > 0 {
+		checkPositive(configErrs, key+".burst", r.Burst)
+	}
+}
+
+type EventReports struct {
+	// A list of local users who will be sent a server notice whenever a
+	// user reports an event, i.e. the moderators of this server.
+	NotifyUserIDs []string `yaml:"notify_user_ids"`
 }
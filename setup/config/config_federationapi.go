@@ -28,6 +28,9 @@ type FederationAPI struct {
 
 	// Should we prefer direct key fetches over perspective ones?
 	PreferDirectFetch bool `yaml:"prefer_direct_fetch"`
+
+	// Rate limits for inbound federation requests, per remote server.
+	RateLimiting FederationRateLimiting `yaml:"rate_limiting"`
 }
 
 func (c *FederationAPI) Defaults(generate bool) {
@@ -37,6 +40,7 @@ func (c *FederationAPI) Defaults(generate bool) {
 	c.FederationMaxRetries = 16
 	c.DisableTLSValidation = false
 	c.Database.Defaults(10)
+	c.RateLimiting.Defaults()
 	if generate {
 		c.Database.ConnectionString = "file:federationapi.db"
 	}
@@ -46,12 +50,41 @@ func (c *FederationAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "federation_api.database.connection_string", string(c.Database.ConnectionString))
 	}
+	c.RateLimiting.Verify(configErrs)
 	if isMonolith { // polylith required configs below
 		return
 	}
 	checkURL(configErrs, "federation_api.external_api.listen", string(c.ExternalAPI.Listen))
 	checkURL(configErrs, "federation_api.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "federation_api.internal_api.connect", string(c.InternalAPI.Connect))
+	c.InternalAPI.verifyTransport(configErrs, "federation_api.internal_api.transport")
+}
+
+type FederationRateLimiting struct {
+	// Is rate limiting enabled or disabled?
+	Enabled bool `yaml:"enabled"`
+
+	// The number of PDUs that each server can send us in /send transactions.
+	Send RateLimit `yaml:"send"`
+
+	// The number of /make_join requests that each server can make.
+	MakeJoin RateLimit `yaml:"make_join"`
+
+	// A list of servers that are exempt from rate limiting.
+	ExemptServers []gomatrixserverlib.ServerName `yaml:"exempt_servers"`
+}
+
+func (r *FederationRateLimiting) Defaults() {
+	r.Enabled = true
+	r.Send = RateLimit{PerSecond: 50, Burst: 200}
+	r.MakeJoin = RateLimit{PerSecond: 1, Burst: 10}
+}
+
+func (r *FederationRateLimiting) Verify(configErrs *ConfigErrors) {
+	if r.Enabled {
+		r.Send.Verify(configErrs, "federation_api.rate_limiting.send")
+		r.MakeJoin.Verify(configErrs, "federation_api.rate_limiting.make_join")
+	}
 }
 
 // The config for setting a proxy to use for server->server requests
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"math/rand"
 	"strconv"
 	"strings"
@@ -79,6 +80,10 @@ type Global struct {
 	// ReportStats configures opt-in phone-home statistics reporting.
 	ReportStats ReportStats `yaml:"report_stats"`
 
+	// SpamChecker configures modules which can reject events, invites,
+	// room creation, registrations and media uploads.
+	SpamChecker SpamChecker `yaml:"spam_checker"`
+
 	// Configuration for the caches.
 	Cache Cache `yaml:"cache"`
 }
@@ -99,6 +104,7 @@ func (c *Global) Defaults(generate bool) {
 	c.ServerNotices.Defaults(generate)
 	c.ReportStats.Defaults()
 	c.Cache.Defaults(generate)
+	c.Presence.Defaults()
 }
 
 func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -111,7 +117,9 @@ func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	c.DNSCache.Verify(configErrs, isMonolith)
 	c.ServerNotices.Verify(configErrs, isMonolith)
 	c.ReportStats.Verify(configErrs, isMonolith)
+	c.SpamChecker.Verify(configErrs, isMonolith)
 	c.Cache.Verify(configErrs, isMonolith)
+	c.Presence.Verify(configErrs, isMonolith)
 }
 
 type OldVerifyKeys struct {
@@ -140,6 +148,9 @@ type Metrics struct {
 		Username string `yaml:"username"`
 		Password string `yaml:"password"`
 	} `yaml:"basic_auth"`
+	// Whether to label the roomserver input latency by room ID as well as by
+	// origin. This creates a histogram for every room which receives events.
+	PerRoomInputLatency bool `yaml:"per_room_input_latency"`
 }
 
 func (c *Metrics) Defaults(generate bool) {
@@ -178,18 +189,73 @@ func (c *ServerNotices) Defaults(generate bool) {
 
 func (c *ServerNotices) Verify(errors *ConfigErrors, isMonolith bool) {}
 
+// The cache backends which can be used in Cache.Backend.
+const (
+	CacheBackendRistretto = "ristretto"
+	CacheBackendRedis     = "redis"
+)
+
 type Cache struct {
 	EstimatedMaxSize DataUnit      `yaml:"max_size_estimated"`
 	MaxAge           time.Duration `yaml:"max_age"`
+	// The cache backend to use, either "ristretto" for an in-process cache,
+	// or "redis" to share caches between processes using a Redis server.
+	Backend string     `yaml:"backend"`
+	Redis   RedisCache `yaml:"redis"`
+	// Options for individual caches, by cache name, which override the
+	// options above.
+	Caches map[string]CacheOptions `yaml:"caches"`
+}
+
+// RedisCache configures the connection to a Redis server, or any other
+// server which speaks the Redis protocol.
+type RedisCache struct {
+	// The address of the server, e.g. localhost:6379.
+	Address  string `yaml:"address"`
+	Password string `yaml:"password"`
+	Database int    `yaml:"database"`
+	// A prefix for all keys, so that the server can be shared with other
+	// applications or Dendrite instances.
+	KeyPrefix string `yaml:"key_prefix"`
+	// The maximum number of idle connections to keep open.
+	PoolSize int `yaml:"pool_size"`
+	// How long to wait for the server before treating an entry as missing.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// CacheOptions overrides the cache options for an individual cache. Zero
+// values mean that the global option is used.
+type CacheOptions struct {
+	// If set, the cache gets its own space of this size in memory, rather
+	// than sharing the global one. Ignored for caches stored in Redis.
+	EstimatedMaxSize DataUnit      `yaml:"max_size_estimated"`
+	MaxAge           time.Duration `yaml:"max_age"`
 }
 
 func (c *Cache) Defaults(generate bool) {
 	c.EstimatedMaxSize = 1024 * 1024 * 1024 // 1GB
 	c.MaxAge = time.Hour
+	c.Backend = CacheBackendRistretto
+	c.Redis.KeyPrefix = "dendrite:"
+	c.Redis.PoolSize = 16
+	c.Redis.Timeout = time.Second
 }
 
 func (c *Cache) Verify(errors *ConfigErrors, isMonolith bool) {
 	checkPositive(errors, "max_size_estimated", int64(c.EstimatedMaxSize))
+	switch c.Backend {
+	case CacheBackendRistretto:
+	case CacheBackendRedis:
+		checkNotEmpty(errors, "global.cache.redis.address", c.Redis.Address)
+		checkPositive(errors, "global.cache.redis.pool_size", int64(c.Redis.PoolSize))
+		checkPositive(errors, "global.cache.redis.timeout", int64(c.Redis.Timeout))
+	default:
+		errors.Add(fmt.Sprintf("invalid value for config key %q: %q", "global.cache.backend", c.Backend))
+	}
+	for name, options := range c.Caches {
+		checkPositive(errors, "global.cache.caches."+name+".max_size_estimated", int64(options.EstimatedMaxSize))
+		checkPositive(errors, "global.cache.caches."+name+".max_age", int64(options.MaxAge))
+	}
 }
 
 // ReportStats configures opt-in phone-home statistics reporting.
@@ -285,12 +351,69 @@ func (c *DNSCacheOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkPositive(configErrs, "cache_lifetime", int64(c.CacheLifetime))
 }
 
+// SpamChecker defines the spam checker modules to load. Every module is
+// consulted in order, and the first one which doesn't allow an action wins.
+type SpamChecker struct {
+	Modules []SpamCheckerModule `yaml:"modules"`
+}
+
+func (c *SpamChecker) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	for i := range c.Modules {
+		c.Modules[i].Verify(configErrs, fmt.Sprintf("global.spam_checker.modules[%d]", i))
+	}
+}
+
+type SpamCheckerModule struct {
+	// The type of the module, e.g. "http". Other module types can be
+	// registered by code which is compiled into Dendrite.
+	Type string `yaml:"type"`
+	// The base URL of the checker, for "http" modules
+	URL string `yaml:"url"`
+	// How long to wait for the module to make a decision before giving up
+	Timeout time.Duration `yaml:"timeout"`
+	// Whether to allow actions if the module returns an error or times out,
+	// rather than rejecting them
+	FailOpen bool `yaml:"fail_open"`
+	// Module-specific options
+	Options map[string]interface{} `yaml:"options"`
+}
+
+func (c *SpamCheckerModule) Verify(configErrs *ConfigErrors, key string) {
+	checkNotEmpty(configErrs, key+".type", c.Type)
+	if c.Type == "http" {
+		checkURL(configErrs, key+".url", c.URL)
+	}
+	if c.Timeout < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".timeout", c.Timeout))
+	}
+}
+
 // PresenceOptions defines possible configurations for presence events.
 type PresenceOptions struct {
 	// Whether inbound presence events are allowed
 	EnableInbound bool `yaml:"enable_inbound"`
 	// Whether outbound presence events are allowed
 	EnableOutbound bool `yaml:"enable_outbound"`
+	// How long a local user can go without doing anything before they
+	// are marked as unavailable
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// How long a local user can go without syncing before they are
+	// marked as offline
+	OfflineTimeout time.Duration `yaml:"offline_timeout"`
+}
+
+func (c *PresenceOptions) Defaults() {
+	c.IdleTimeout = 5 * time.Minute
+	c.OfflineTimeout = 5 * time.Minute
+}
+
+func (c *PresenceOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.IdleTimeout <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "global.presence.idle_timeout", c.IdleTimeout))
+	}
+	if c.OfflineTimeout <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "global.presence.offline_timeout", c.OfflineTimeout))
+	}
 }
 
 type DataUnit int64
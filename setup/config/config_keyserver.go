@@ -26,4 +26,5 @@ func (c *KeyServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	}
 	checkURL(configErrs, "key_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "key_server.internal_api.connect", string(c.InternalAPI.Connect))
+	c.InternalAPI.verifyTransport(configErrs, "key_server.internal_api.transport")
 }
@@ -1,17 +1,30 @@
 package config
 
+import (
+	"fmt"
+	"time"
+)
+
 type RoomServer struct {
 	Matrix *Global `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// Periodic garbage collection of unreferenced state snapshots and blocks.
+	StateCompaction StateCompaction `yaml:"state_compaction"`
+
+	// How the processing of input events is scheduled between rooms.
+	Input InputOptions `yaml:"input"`
 }
 
 func (c *RoomServer) Defaults(generate bool) {
 	c.InternalAPI.Listen = "http://localhost:7770"
 	c.InternalAPI.Connect = "http://localhost:7770"
 	c.Database.Defaults(10)
+	c.StateCompaction.Defaults()
+	c.Input.Defaults()
 	if generate {
 		c.Database.ConnectionString = "file:roomserver.db"
 	}
@@ -21,9 +34,91 @@ func (c *RoomServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "room_server.database.connection_string", string(c.Database.ConnectionString))
 	}
+	c.StateCompaction.Verify(configErrs)
+	c.Input.Verify(configErrs)
 	if isMonolith { // polylith required configs below
 		return
 	}
 	checkURL(configErrs, "room_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "room_server.internal_ap.connect", string(c.InternalAPI.Connect))
+	c.InternalAPI.verifyTransport(configErrs, "room_server.internal_api.transport")
+}
+
+// StateCompaction configures the background job which deletes state
+// snapshots and state blocks that are no longer referenced, and merges
+// state blocks with identical contents.
+type StateCompaction struct {
+	Enabled bool `yaml:"enabled"`
+	// How often to run the compaction.
+	Interval time.Duration `yaml:"interval"`
+	// How long state must have been unreferenced before it is deleted.
+	// This must be longer than it takes to process an incoming event, as
+	// newly stored state isn't referenced until the event is stored.
+	GracePeriod time.Duration `yaml:"grace_period"`
+}
+
+func (c *StateCompaction) Defaults() {
+	c.Interval = 24 * time.Hour
+	c.GracePeriod = time.Hour
+}
+
+func (c *StateCompaction) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	if c.Interval <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "room_server.state_compaction.interval", c.Interval))
+	}
+	if c.GracePeriod < time.Minute {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s (must be at least 1m)", "room_server.state_compaction.grace_period", c.GracePeriod))
+	}
+}
+
+// InputOptions configures how many rooms can process input events at the
+// same time. When more rooms than that have events waiting, events sent by
+// local users are processed first, then new events from other servers, then
+// backfilled events.
+type InputOptions struct {
+	// The most rooms which can process events at the same time, or 0 for
+	// no limit. One of them is always kept for events sent by local users.
+	MaxConcurrentRooms int `yaml:"max_concurrent_rooms"`
+	// The most rooms which can process events from other servers at the same
+	// time, so that there is always room left for local events, or 0 for no
+	// limit other than max_concurrent_rooms.
+	MaxConcurrentFederationRooms int `yaml:"max_concurrent_federation_rooms"`
+	// The most rooms which can process backfilled events at the same time,
+	// or 0 for no limit other than max_concurrent_rooms.
+	MaxConcurrentBackfillRooms int `yaml:"max_concurrent_backfill_rooms"`
+	// The most events which can be queued for a room before new events sent
+	// to us by other servers are refused, telling them to try again later,
+	// or 0 for no limit. Events sent by local users are never refused.
+	MaxQueueDepth int `yaml:"max_queue_depth"`
+}
+
+// Defaults leaves every limit off, so that rooms are processed as they were
+// before the limits were added unless they are configured.
+func (c *InputOptions) Defaults() {
+	c.MaxConcurrentRooms = 0
+	c.MaxConcurrentFederationRooms = 0
+	c.MaxConcurrentBackfillRooms = 0
+	c.MaxQueueDepth = 0
+}
+
+func (c *InputOptions) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "room_server.input.max_concurrent_rooms", int64(c.MaxConcurrentRooms))
+	checkPositive(configErrs, "room_server.input.max_concurrent_federation_rooms", int64(c.MaxConcurrentFederationRooms))
+	checkPositive(configErrs, "room_server.input.max_concurrent_backfill_rooms", int64(c.MaxConcurrentBackfillRooms))
+	checkPositive(configErrs, "room_server.input.max_queue_depth", int64(c.MaxQueueDepth))
+	if c.MaxConcurrentRooms == 0 {
+		return
+	}
+	if c.MaxConcurrentRooms < 2 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be 0 or at least 2)", "room_server.input.max_concurrent_rooms", c.MaxConcurrentRooms))
+	}
+	if c.MaxConcurrentFederationRooms > c.MaxConcurrentRooms {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must not be more than max_concurrent_rooms)", "room_server.input.max_concurrent_federation_rooms", c.MaxConcurrentFederationRooms))
+	}
+	if c.MaxConcurrentBackfillRooms > c.MaxConcurrentRooms {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must not be more than max_concurrent_rooms)", "room_server.input.max_concurrent_backfill_rooms", c.MaxConcurrentBackfillRooms))
+	}
 }
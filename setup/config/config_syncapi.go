@@ -9,6 +9,11 @@ type SyncAPI struct {
 	Database DatabaseOptions `yaml:"database"`
 
 	RealIPHeader string `yaml:"real_ip_header"`
+
+	// Whether more than one instance of the sync API is run against the same
+	// database. The instances elect one of them to consume new data into the
+	// database and tell each other about it. Requires PostgreSQL.
+	MultipleInstances bool `yaml:"multiple_instances"`
 }
 
 func (c *SyncAPI) Defaults(generate bool) {
@@ -25,6 +30,15 @@ func (c *SyncAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "sync_api.database", string(c.Database.ConnectionString))
 	}
+	if c.MultipleInstances {
+		connectionString := c.Database.ConnectionString
+		if connectionString == "" {
+			connectionString = c.Matrix.DatabaseOptions.ConnectionString
+		}
+		if connectionString.IsSQLite() {
+			configErrs.Add("sync_api.multiple_instances requires a PostgreSQL database")
+		}
+	}
 	if isMonolith { // polylith required configs below
 		return
 	}
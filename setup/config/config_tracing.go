@@ -0,0 +1,94 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel"
+	otbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+)
+
+// OTLPTracing configures exporting traces to an OpenTelemetry collector
+// over OTLP/HTTP.
+type OTLPTracing struct {
+	// The URL of the collector, e.g. http://localhost:4318. Traces are sent
+	// to the /v1/traces path unless the URL has a path of its own.
+	Endpoint string `yaml:"endpoint"`
+	// Headers to send with each export, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+	// The fraction of traces to sample, from 0 to 1. Traces which are
+	// continued from another component or server are sampled if they
+	// were sampled there. Defaults to 1, i.e. every trace.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+func (c *OTLPTracing) Defaults() {
+	c.SampleRatio = 1
+}
+
+func (c *OTLPTracing) Verify(configErrs *ConfigErrors) {
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %v", "tracing.otlp.sample_ratio", c.SampleRatio))
+	}
+}
+
+// InitGlobalTracer sets up an OpenTelemetry tracer provider which exports
+// to the collector, and sets a bridge to it as the global opentracing tracer,
+// which all of the tracing spans in Dendrite are created with. Trace contexts
+// are propagated with W3C trace context headers. The returned closer flushes
+// any spans which haven't been exported yet.
+func (c *OTLPTracing) InitGlobalTracer(serviceName string) (io.Closer, error) {
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracing.otlp.endpoint: %w", err)
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(endpoint.Host),
+		otlptracehttp.WithHeaders(c.Headers),
+	}
+	switch endpoint.Scheme {
+	case "http":
+		opts = append(opts, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return nil, fmt.Errorf("invalid tracing.otlp.endpoint: unsupported scheme %q", endpoint.Scheme)
+	}
+	if endpoint.Path != "" && endpoint.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(endpoint.Path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("otlptracehttp.New: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName),
+		)),
+	)
+	propagator := propagation.TraceContext{}
+	bridge, wrapperProvider := otbridge.NewTracerPair(provider.Tracer("github.com/matrix-org/dendrite"))
+	bridge.SetTextMapPropagator(propagator)
+	otel.SetTracerProvider(wrapperProvider)
+	otel.SetTextMapPropagator(propagator)
+	opentracing.SetGlobalTracer(bridge)
+	return &otlpCloser{provider}, nil
+}
+
+type otlpCloser struct {
+	provider *sdktrace.TracerProvider
+}
+
+func (c *otlpCloser) Close() error {
+	return c.provider.Shutdown(context.Background())
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"go.opentelemetry.io/otel"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPTracing(t *testing.T) {
+	// An in-process collector which keeps the spans it receives.
+	var mu sync.Mutex
+	var spans []*tracepb.Span
+	var serviceNames []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("failed to read export: %s", err)
+			return
+		}
+		var export coltracepb.ExportTraceServiceRequest
+		if err = proto.Unmarshal(body, &export); err != nil {
+			t.Errorf("failed to parse export: %s", err)
+			return
+		}
+		mu.Lock()
+		for _, resourceSpans := range export.ResourceSpans {
+			for _, attr := range resourceSpans.Resource.Attributes {
+				if attr.Key == "service.name" {
+					serviceNames = append(serviceNames, attr.Value.GetStringValue())
+				}
+			}
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				spans = append(spans, scopeSpans.Spans...)
+			}
+		}
+		mu.Unlock()
+		response, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(response)
+	}))
+	defer collector.Close()
+
+	// Setting up tracing replaces the global tracers, so put them back
+	// afterwards.
+	previousTracer := opentracing.GlobalTracer()
+	previousProvider := otel.GetTracerProvider()
+	previousPropagator := otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		opentracing.SetGlobalTracer(previousTracer)
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	cfg := &Dendrite{}
+	cfg.Tracing.Enabled = true
+	cfg.Tracing.OTLP.Defaults()
+	cfg.Tracing.OTLP.Endpoint = collector.URL
+	closer, err := cfg.SetupTracing("DendriteTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A span in one component which makes a request to another, which
+	// continues the trace from the request headers.
+	tracer := opentracing.GlobalTracer()
+	parent := tracer.StartSpan("client")
+	header := http.Header{}
+	if err = tracer.Inject(parent.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header)); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("traceparent") == "" {
+		t.Fatalf("expected a W3C traceparent header, got %v", header)
+	}
+	clientContext, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := tracer.StartSpan("server", ext.RPCServerOption(clientContext))
+	child.SetTag("room_id", "!test:localhost")
+	child.Finish()
+	parent.Finish()
+
+	// Closing flushes the spans to the collector.
+	if err = closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans to be exported, got %d", len(spans))
+	}
+	byName := map[string]*tracepb.Span{}
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	client, server := byName["client"], byName["server"]
+	if client == nil || server == nil {
+		t.Fatalf("expected client and server spans, got %v", byName)
+	}
+	if hex.EncodeToString(server.TraceId) != hex.EncodeToString(client.TraceId) {
+		t.Fatalf("expected the spans to be in the same trace")
+	}
+	if hex.EncodeToString(server.ParentSpanId) != hex.EncodeToString(client.SpanId) {
+		t.Fatalf("expected the server span to be a child of the client span")
+	}
+	if server.Kind != tracepb.Span_SPAN_KIND_SERVER {
+		t.Fatalf("expected the server span to have the server kind, got %s", server.Kind)
+	}
+	if len(serviceNames) == 0 || serviceNames[0] != "DendriteTest" {
+		t.Fatalf("expected the service name to be exported, got %v", serviceNames)
+	}
+}
+
+func TestOTLPTracingSampleRatio(t *testing.T) {
+	cfg := &OTLPTracing{}
+	cfg.Defaults()
+	if cfg.SampleRatio != 1 {
+		t.Fatalf("expected every trace to be sampled by default, got %v", cfg.SampleRatio)
+	}
+	for ratio, valid := range map[float64]bool{0: true, 0.5: true, 1: true, -0.1: false, 1.1: false} {
+		cfg.SampleRatio = ratio
+		var configErrs ConfigErrors
+		cfg.Verify(&configErrs)
+		if valid != (len(configErrs) == 0) {
+			t.Errorf("sample ratio %v: got errors %v", ratio, configErrs)
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package config
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 type UserAPI struct {
 	Matrix *Global `yaml:"-"`
@@ -19,6 +24,9 @@ type UserAPI struct {
 	// The Account database stores the login details and account information
 	// for local users. It is accessed by the UserAPI.
 	AccountDatabase DatabaseOptions `yaml:"account_database"`
+
+	// Email notifications, for users who set up an email pusher.
+	EmailNotifications EmailNotifications `yaml:"email_notifications"`
 }
 
 const DefaultOpenIDTokenLifetimeMS = 3600000 // 60 minutes
@@ -29,6 +37,7 @@ func (c *UserAPI) Defaults(generate bool) {
 	c.BCryptCost = bcrypt.DefaultCost
 	c.OpenIDTokenLifetimeMS = DefaultOpenIDTokenLifetimeMS
 	c.AccountDatabase.Defaults(10)
+	c.EmailNotifications.Defaults()
 	if generate {
 		c.AccountDatabase.ConnectionString = "file:userapi_accounts.db"
 	}
@@ -39,9 +48,66 @@ func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	}
+	c.EmailNotifications.Verify(configErrs)
 	if isMonolith { // polylith required configs below
 		return
 	}
 	checkURL(configErrs, "user_api.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "user_api.internal_api.connect", string(c.InternalAPI.Connect))
+	c.InternalAPI.verifyTransport(configErrs, "user_api.internal_api.transport")
+}
+
+// EmailNotifications configures the digest emails sent to users with
+// email pushers, summarising the messages they haven't read yet.
+type EmailNotifications struct {
+	Enabled bool `yaml:"enabled"`
+	// The SMTP server to send emails through, as host:port. STARTTLS is
+	// used if the server supports it.
+	SMTPServer string `yaml:"smtp_server"`
+	// The credentials for the SMTP server, if it requires them.
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+	// The address that emails are sent from.
+	From string `yaml:"from"`
+	// The name of the service, used in email subjects and bodies.
+	AppName string `yaml:"app_name"`
+	// The public base URL of the client API, used for unsubscribe links,
+	// e.g. https://matrix.example.com.
+	PublicBaseURL string `yaml:"public_base_url"`
+	// The secret used to authenticate unsubscribe links. Changing it makes
+	// the links in all emails sent so far stop working.
+	UnsubscribeSecret string `yaml:"unsubscribe_secret"`
+	// The URL that room IDs are appended to for links to rooms.
+	ClientURL string `yaml:"client_url"`
+	// A directory containing notif_mail.html and notif_mail.txt templates
+	// to use instead of the built-in ones.
+	TemplateDir Path `yaml:"template_dir"`
+	// How old a notification must be before it is emailed, giving the
+	// user a chance to read it on another device first.
+	NotificationDelay time.Duration `yaml:"notification_delay"`
+	// The minimum time between two emails to the same address.
+	ThrottleInterval time.Duration `yaml:"throttle_interval"`
+}
+
+func (c *EmailNotifications) Defaults() {
+	c.AppName = "Matrix"
+	c.ClientURL = "https://matrix.to/#/"
+	c.NotificationDelay = 10 * time.Minute
+	c.ThrottleInterval = time.Hour
+}
+
+func (c *EmailNotifications) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "user_api.email_notifications.smtp_server", c.SMTPServer)
+	checkNotEmpty(configErrs, "user_api.email_notifications.from", c.From)
+	checkURL(configErrs, "user_api.email_notifications.public_base_url", c.PublicBaseURL)
+	checkNotEmpty(configErrs, "user_api.email_notifications.unsubscribe_secret", c.UnsubscribeSecret)
+	if c.NotificationDelay < 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "user_api.email_notifications.notification_delay", c.NotificationDelay))
+	}
+	if c.ThrottleInterval < 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "user_api.email_notifications.throttle_interval", c.ThrottleInterval))
+	}
 }
@@ -80,7 +80,10 @@ func JetStreamConsumer(
 				sentry.CaptureException(err)
 				continue
 			}
-			if f(ctx, msg) {
+			span, msgCtx := StartConsumerSpan(ctx, msg, durable)
+			ok := f(msgCtx, msg)
+			span.Finish()
+			if ok {
 				if err = msg.AckSync(nats.Context(ctx)); err != nil {
 					logrus.WithContext(ctx).WithField("subject", subj).Warn(fmt.Errorf("msg.AckSync: %w", err))
 					sentry.CaptureException(err)
@@ -95,3 +98,32 @@ func JetStreamConsumer(
 	}()
 	return nil
 }
+
+// JetStreamEphemeralConsumer consumes messages from subj with an ordered
+// consumer which only exists for as long as the process does. Unlike the
+// durable consumers created by JetStreamConsumer, which share the messages
+// between all of the processes which consume them, every process which
+// calls this receives every message which is sent after it subscribes.
+func JetStreamEphemeralConsumer(
+	ctx context.Context, js nats.JetStreamContext, subj string,
+	f func(ctx context.Context, msg *nats.Msg),
+	opts ...nats.SubOpt,
+) error {
+	opts = append([]nats.SubOpt{nats.OrderedConsumer(), nats.DeliverNew()}, opts...)
+	sub, err := js.Subscribe(subj, func(msg *nats.Msg) {
+		span, msgCtx := StartConsumerSpan(ctx, msg, subj)
+		defer span.Finish()
+		f(msgCtx, msg)
+	}, opts...)
+	if err != nil {
+		sentry.CaptureException(err)
+		return fmt.Errorf("nats.Subscribe: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		if err := sub.Unsubscribe(); err != nil {
+			logrus.WithContext(ctx).Warnf("Failed to unsubscribe from %q", subj)
+		}
+	}()
+	return nil
+}
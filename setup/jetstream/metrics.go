@@ -0,0 +1,82 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jetstream
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// consumerMetricsInterval is how often the consumers are asked how many
+// messages are waiting for them.
+const consumerMetricsInterval = time.Second * 30
+
+var consumerPending = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "jetstream",
+		Name:      "consumer_pending",
+		Help:      "How many messages are waiting to be delivered to a durable consumer",
+	},
+	[]string{"durable"},
+)
+
+var registerConsumerMetrics sync.Once
+
+// startConsumerMetrics registers the consumer metrics, and keeps them up to
+// date until the process shuts down. They are polled rather than updated
+// when a message is fetched, as a consumer which is stuck doesn't fetch
+// anything.
+func startConsumerMetrics(process *process.ProcessContext, js nats.JetStreamContext, cfg *config.JetStream) {
+	registerConsumerMetrics.Do(func() {
+		prometheus.MustRegister(consumerPending)
+	})
+	go func() {
+		ticker := time.NewTicker(consumerMetricsInterval)
+		defer ticker.Stop()
+		for {
+			observeConsumers(js, cfg)
+			select {
+			case <-process.WaitForShutdown():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// observeConsumers updates how far behind the stream each durable consumer
+// of the streams is.
+func observeConsumers(js nats.JetStreamContext, cfg *config.JetStream) {
+	for _, stream := range streams { // streams are defined in streams.go
+		for info := range js.ConsumersInfo(cfg.Prefixed(stream.Name)) {
+			// Ephemeral consumers, like the ordered ones, have no durable
+			// name and are only around for as long as their process is.
+			if info.Config.Durable == "" {
+				continue
+			}
+			// The durable names are given to JetStreamConsumer without the
+			// suffix for pull consumers.
+			durable := strings.TrimSuffix(info.Config.Durable, "Pull")
+			consumerPending.WithLabelValues(durable).Set(float64(info.NumPending))
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jetstream
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveConsumers(t *testing.T) {
+	processCtx := process.NewProcessContext()
+	t.Cleanup(func() {
+		processCtx.ShutdownDendrite()
+		processCtx.WaitForComponentsToFinish()
+	})
+	global := &config.Global{}
+	cfg := &global.JetStream
+	cfg.Matrix = global
+	cfg.StoragePath = config.Path(t.TempDir())
+	cfg.TopicPrefix = "TestObserveConsumers"
+	cfg.InMemory = true
+	cfg.NoLog = true
+	js, _ := (&NATSInstance{}).Prepare(processCtx, cfg)
+
+	durable := cfg.Durable("TestObserveConsumers")
+	pending := func() float64 {
+		return testutil.ToFloat64(consumerPending.WithLabelValues(durable))
+	}
+	subj := cfg.Prefixed(OutputRoomEvent)
+	if _, err := js.PullSubscribe(subj, durable+"Pull"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing has been fetched by the consumer, as it would be if it was
+	// stuck, but the messages waiting for it are still reported.
+	for i := 0; i < 3; i++ {
+		if _, err := js.Publish(subj, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	observeConsumers(js, cfg)
+	if got := pending(); got != 3 {
+		t.Fatalf("expected 3 pending messages, got %v", got)
+	}
+}
@@ -19,6 +19,9 @@ import (
 
 type NATSInstance struct {
 	*natsserver.Server
+	// EnableMetrics reports how far behind the durable consumers are.
+	EnableMetrics  bool
+	metricsStarted bool
 }
 
 var natsLock sync.Mutex
@@ -35,7 +38,9 @@ func (s *NATSInstance) Prepare(process *process.ProcessContext, cfg *config.JetS
 	defer natsLock.Unlock()
 	// check if we need an in-process NATS Server
 	if len(cfg.Addresses) != 0 {
-		return setupNATS(process, cfg, nil)
+		js, nc := setupNATS(process, cfg, nil)
+		s.startMetrics(process, js, cfg)
+		return js, nc
 	}
 	if s.Server == nil {
 		var err error
@@ -71,7 +76,19 @@ func (s *NATSInstance) Prepare(process *process.ProcessContext, cfg *config.JetS
 	if err != nil {
 		logrus.Fatalln("Failed to create NATS client")
 	}
-	return setupNATS(process, cfg, nc)
+	js, nc := setupNATS(process, cfg, nc)
+	s.startMetrics(process, js, cfg)
+	return js, nc
+}
+
+// startMetrics starts polling the consumers for metrics, the first time
+// that NATS is prepared. The caller must hold natsLock.
+func (s *NATSInstance) startMetrics(process *process.ProcessContext, js natsclient.JetStreamContext, cfg *config.JetStream) {
+	if !s.EnableMetrics || s.metricsStarted {
+		return
+	}
+	s.metricsStarted = true
+	startConsumerMetrics(process, js, cfg)
 }
 
 func setupNATS(process *process.ProcessContext, cfg *config.JetStream, nc *natsclient.Conn) (natsclient.JetStreamContext, *natsclient.Conn) {
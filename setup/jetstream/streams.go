@@ -28,6 +28,9 @@ var (
 	OutputReadUpdate        = "OutputReadUpdate"
 	RequestPresence         = "GetPresence"
 	OutputPresenceEvent     = "OutputPresenceEvent"
+	OutputSyncUpdate        = "OutputSyncUpdate"
+	CacheInvalidation       = "CacheInvalidation" // not a stream
+	InternalAPI             = "InternalAPI"       // not a stream
 )
 
 var safeCharacters = regexp.MustCompile("[^A-Za-z0-9$]+")
@@ -103,4 +106,10 @@ var streams = []*nats.StreamConfig{
 		Storage:   nats.MemoryStorage,
 		MaxAge:    time.Minute * 5,
 	},
+	{
+		Name:      OutputSyncUpdate,
+		Retention: nats.InterestPolicy,
+		Storage:   nats.MemoryStorage,
+		MaxAge:    time.Second * 60,
+	},
 }
@@ -0,0 +1,57 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jetstream
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nats-io/nats.go"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// InjectSpan adds the tracing span in ctx, if there is one, to the headers
+// of msg, so that the trace can be continued by whatever consumes it.
+func InjectSpan(ctx context.Context, msg *nats.Msg) {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	carrier := opentracing.HTTPHeadersCarrier(http.Header(msg.Header))
+	_ = opentracing.GlobalTracer().Inject(span.Context(), opentracing.HTTPHeaders, carrier)
+}
+
+// StartConsumerSpan starts a tracing span for consuming msg, as a child of
+// the span which the message was published in, if it has one. Only Dendrite
+// components publish to our streams, so the tracing context in the headers
+// can be trusted to continue the trace and its sampling decision. The span
+// must be finished once the message has been processed.
+func StartConsumerSpan(ctx context.Context, msg *nats.Msg, operationName string) (opentracing.Span, context.Context) {
+	tracer := opentracing.GlobalTracer()
+	opts := []opentracing.StartSpanOption{
+		ext.SpanKindConsumer,
+		opentracing.Tag{Key: "messaging.destination", Value: msg.Subject},
+	}
+	carrier := opentracing.HTTPHeadersCarrier(http.Header(msg.Header))
+	if producerContext, err := tracer.Extract(opentracing.HTTPHeaders, carrier); err == nil {
+		opts = append(opts, opentracing.ChildOf(producerContext))
+	}
+	span := tracer.StartSpan(operationName, opts...)
+	return span, opentracing.ContextWithSpan(ctx, span)
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jetstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/opentracing/opentracing-go"
+	otbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStartConsumerSpan(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+	)
+	bridge, _ := otbridge.NewTracerPair(provider.Tracer("test"))
+	bridge.SetTextMapPropagator(propagation.TraceContext{})
+	previous := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(bridge)
+	t.Cleanup(func() { opentracing.SetGlobalTracer(previous) })
+
+	producer, ctx := opentracing.StartSpanFromContext(context.Background(), "producer")
+	msg := nats.NewMsg("test")
+	InjectSpan(ctx, msg)
+	producer.Finish()
+
+	consumer, _ := StartConsumerSpan(context.Background(), msg, "consumer")
+	consumer.Finish()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	producerSpan, consumerSpan := spans[0], spans[1]
+	if consumerSpan.SpanContext.TraceID() != producerSpan.SpanContext.TraceID() {
+		t.Fatalf("expected the consumer span to be in trace %s, got %s", producerSpan.SpanContext.TraceID(), consumerSpan.SpanContext.TraceID())
+	}
+	if consumerSpan.Parent.SpanID() != producerSpan.SpanContext.SpanID() {
+		t.Fatalf("expected the consumer span to have parent %s, got %s", producerSpan.SpanContext.SpanID(), consumerSpan.Parent.SpanID())
+	}
+}
@@ -14,7 +14,7 @@ type ProcessContext struct {
 	wg       *sync.WaitGroup    // used to wait for components to shutdown
 	ctx      context.Context    // cancelled when Stop is called
 	shutdown context.CancelFunc // shut down Dendrite
-	degraded atomic.Bool
+	degraded *atomic.Bool
 }
 
 func NewProcessContext() *ProcessContext {
@@ -23,6 +23,7 @@ func NewProcessContext() *ProcessContext {
 		ctx:      ctx,
 		shutdown: shutdown,
 		wg:       &sync.WaitGroup{},
+		degraded: atomic.NewBool(false),
 	}
 }
 
@@ -30,6 +31,19 @@ func (b *ProcessContext) Context() context.Context {
 	return context.WithValue(b.ctx, "scope", "process") // nolint:staticcheck
 }
 
+// Child returns a process context for components which may need to stop
+// before the rest of Dendrite shuts down. It is done when this process
+// context is done, or when the returned function is called.
+func (b *ProcessContext) Child() (*ProcessContext, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(b.ctx)
+	return &ProcessContext{
+		ctx:      ctx,
+		shutdown: b.shutdown,
+		wg:       b.wg,
+		degraded: b.degraded,
+	}, cancel
+}
+
 func (b *ProcessContext) ComponentStarted() {
 	b.wg.Add(1)
 }
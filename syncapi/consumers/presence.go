@@ -30,6 +30,12 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// An ActivityTracker is told when users do something, like sending an
+// event or a read receipt, which counts as activity for their presence.
+type ActivityTracker interface {
+	MarkActive(userID string, ts gomatrixserverlib.Timestamp)
+}
+
 // OutputTypingEventConsumer consumes events that originated in the EDU server.
 type PresenceConsumer struct {
 	ctx           context.Context
@@ -74,8 +80,9 @@ func NewPresenceConsumer(
 
 // Start consuming typing events.
 func (s *PresenceConsumer) Start() error {
-	// Normal NATS subscription, used by Request/Reply
-	_, err := s.nats.Subscribe(s.requestTopic, func(msg *nats.Msg) {
+	// Normal NATS subscription, used by Request/Reply. It is a queue
+	// subscription so that only one sync API instance replies.
+	sub, err := s.nats.QueueSubscribe(s.requestTopic, s.durable, func(msg *nats.Msg) {
 		userID := msg.Header.Get(jetstream.UserID)
 		presence, err := s.db.GetPresence(context.Background(), userID)
 		m := &nats.Msg{
@@ -124,6 +131,12 @@ func (s *PresenceConsumer) Start() error {
 	if err != nil {
 		return err
 	}
+	go func() {
+		<-s.ctx.Done()
+		if err := sub.Unsubscribe(); err != nil {
+			logrus.WithError(err).Warnf("Failed to unsubscribe from %q", s.requestTopic)
+		}
+	}()
 	if !s.cfg.Matrix.Presence.EnableInbound && !s.cfg.Matrix.Presence.EnableOutbound {
 		return nil
 	}
@@ -45,6 +45,7 @@ type OutputReceiptEventConsumer struct {
 	notifier   *notifier.Notifier
 	serverName gomatrixserverlib.ServerName
 	producer   *producers.UserAPIReadProducer
+	activity   ActivityTracker
 }
 
 // NewOutputReceiptEventConsumer creates a new OutputReceiptEventConsumer.
@@ -57,6 +58,7 @@ func NewOutputReceiptEventConsumer(
 	notifier *notifier.Notifier,
 	stream types.StreamProvider,
 	producer *producers.UserAPIReadProducer,
+	activity ActivityTracker,
 ) *OutputReceiptEventConsumer {
 	return &OutputReceiptEventConsumer{
 		ctx:        process.Context(),
@@ -68,6 +70,7 @@ func NewOutputReceiptEventConsumer(
 		stream:     stream,
 		serverName: cfg.Matrix.ServerName,
 		producer:   producer,
+		activity:   activity,
 	}
 }
 
@@ -81,10 +84,11 @@ func (s *OutputReceiptEventConsumer) Start() error {
 
 func (s *OutputReceiptEventConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
 	output := types.OutputReceiptEvent{
-		UserID:  msg.Header.Get(jetstream.UserID),
-		RoomID:  msg.Header.Get(jetstream.RoomID),
-		EventID: msg.Header.Get(jetstream.EventID),
-		Type:    msg.Header.Get("type"),
+		UserID:   msg.Header.Get(jetstream.UserID),
+		RoomID:   msg.Header.Get(jetstream.RoomID),
+		EventID:  msg.Header.Get(jetstream.EventID),
+		Type:     msg.Header.Get("type"),
+		ThreadID: msg.Header.Get("thread_id"),
 	}
 
 	timestamp, err := strconv.ParseUint(msg.Header.Get("timestamp"), 10, 64)
@@ -103,6 +107,7 @@ func (s *OutputReceiptEventConsumer) onMessage(ctx context.Context, msg *nats.Ms
 		output.Type,
 		output.UserID,
 		output.EventID,
+		output.ThreadID,
 		output.Timestamp,
 	)
 	if err != nil {
@@ -121,6 +126,7 @@ func (s *OutputReceiptEventConsumer) onMessage(ctx context.Context, msg *nats.Ms
 
 	s.stream.Advance(streamPos)
 	s.notifier.OnNewReceipt(output.RoomID, types.StreamingToken{ReceiptPosition: streamPos})
+	s.activity.MarkActive(output.UserID, output.Timestamp)
 
 	return true
 }
@@ -143,7 +149,7 @@ func (s *OutputReceiptEventConsumer) sendReadUpdate(ctx context.Context, output
 		}
 	}
 	if readPos > 0 {
-		if err := s.producer.SendReadUpdate(output.UserID, output.RoomID, readPos, 0); err != nil {
+		if err := s.producer.SendReadUpdate(output.UserID, output.RoomID, output.ThreadID, readPos, 0); err != nil {
 			return fmt.Errorf("s.producer.SendReadUpdate: %w", err)
 		}
 	}
@@ -47,6 +47,7 @@ type OutputRoomEventConsumer struct {
 	inviteStream types.StreamProvider
 	notifier     *notifier.Notifier
 	producer     *producers.UserAPIStreamEventProducer
+	activity     ActivityTracker
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
@@ -60,6 +61,7 @@ func NewOutputRoomEventConsumer(
 	inviteStream types.StreamProvider,
 	rsAPI api.SyncRoomserverAPI,
 	producer *producers.UserAPIStreamEventProducer,
+	activity ActivityTracker,
 ) *OutputRoomEventConsumer {
 	return &OutputRoomEventConsumer{
 		ctx:          process.Context(),
@@ -73,6 +75,7 @@ func NewOutputRoomEventConsumer(
 		inviteStream: inviteStream,
 		rsAPI:        rsAPI,
 		producer:     producer,
+		activity:     activity,
 	}
 }
 
@@ -268,6 +271,7 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 
 	s.pduStream.Advance(pduPos)
 	s.notifier.OnNewEvent(ev, ev.RoomID(), nil, types.StreamingToken{PDUPosition: pduPos})
+	s.activity.MarkActive(ev.Sender(), ev.OriginServerTS())
 
 	return nil
 }
@@ -16,6 +16,7 @@ package consumers
 
 import (
 	"context"
+	"fmt"
 	"strconv"
 	"time"
 
@@ -32,6 +33,7 @@ import (
 // OutputTypingEventConsumer consumes events that originated in the EDU server.
 type OutputTypingEventConsumer struct {
 	ctx       context.Context
+	cfg       *config.SyncAPI
 	jetstream nats.JetStreamContext
 	durable   string
 	topic     string
@@ -52,6 +54,7 @@ func NewOutputTypingEventConsumer(
 ) *OutputTypingEventConsumer {
 	return &OutputTypingEventConsumer{
 		ctx:       process.Context(),
+		cfg:       cfg,
 		jetstream: js,
 		topic:     cfg.Matrix.JetStream.Prefixed(jetstream.OutputTypingEvent),
 		durable:   cfg.Matrix.JetStream.Durable("SyncAPITypingConsumer"),
@@ -63,6 +66,25 @@ func NewOutputTypingEventConsumer(
 
 // Start consuming typing events.
 func (s *OutputTypingEventConsumer) Start() error {
+	// Typing notifications are only kept in memory, so when there is more
+	// than one sync API instance, every instance needs to see all of them.
+	// The instances share typing positions by using the sequence numbers of
+	// the typing events in the stream, so start from the latest one.
+	if s.cfg.MultipleInstances {
+		info, err := s.jetstream.StreamInfo(s.topic)
+		if err != nil {
+			return fmt.Errorf("s.jetstream.StreamInfo: %w", err)
+		}
+		latest := types.StreamPosition(info.State.LastSeq)
+		s.stream.Advance(latest)
+		s.notifier.OnNewTyping("", types.StreamingToken{TypingPosition: latest})
+		return jetstream.JetStreamEphemeralConsumer(
+			s.ctx, s.jetstream, s.topic,
+			func(ctx context.Context, msg *nats.Msg) {
+				s.onMessage(ctx, msg)
+			},
+		)
+	}
 	return jetstream.JetStreamConsumer(
 		s.ctx, s.jetstream, s.topic, s.durable, s.onMessage,
 		nats.DeliverAll(), nats.ManualAck(),
@@ -91,7 +113,13 @@ func (s *OutputTypingEventConsumer) onMessage(ctx context.Context, msg *nats.Msg
 	}).Debug("syncapi received EDU data from client api")
 
 	var typingPos types.StreamPosition
-	if typing {
+	if s.cfg.MultipleInstances {
+		typingPos, err = s.updateShared(msg, userID, roomID, typing, timeout)
+		if err != nil {
+			log.WithError(err).Errorf("output log: typing metadata failure")
+			return true
+		}
+	} else if typing {
 		expiry := time.Now().Add(time.Duration(timeout) * time.Millisecond)
 		typingPos = types.StreamPosition(
 			s.eduCache.AddTypingUser(userID, roomID, &expiry),
@@ -107,3 +135,43 @@ func (s *OutputTypingEventConsumer) onMessage(ctx context.Context, msg *nats.Msg
 
 	return true
 }
+
+// updateShared updates the typing cache when there is more than one sync API
+// instance, using the sequence number of the typing event in the stream as
+// its typing position so that every instance gives it the same position.
+// When a user's typing times out, the timeout is sent to the stream for
+// every instance to apply at the same position. Each instance sends it, so
+// that it still happens if an instance goes away, and the message ID lets
+// the stream drop the duplicates.
+func (s *OutputTypingEventConsumer) updateShared(
+	msg *nats.Msg, userID, roomID string, typing bool, timeout int,
+) (types.StreamPosition, error) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return 0, err
+	}
+	pos := int64(meta.Sequence.Stream)
+	if !typing {
+		return types.StreamPosition(s.eduCache.RemoveUserAtPosition(userID, roomID, pos)), nil
+	}
+	expiry := meta.Timestamp.Add(time.Duration(timeout) * time.Millisecond)
+	return types.StreamPosition(s.eduCache.AddTypingUserAtPosition(
+		userID, roomID, &expiry, pos,
+		func() { s.sendTimeout(userID, roomID, pos) },
+	)), nil
+}
+
+func (s *OutputTypingEventConsumer) sendTimeout(userID, roomID string, pos int64) {
+	m := nats.NewMsg(s.topic)
+	m.Header.Set(jetstream.UserID, userID)
+	m.Header.Set(jetstream.RoomID, roomID)
+	m.Header.Set("typing", "false")
+	m.Header.Set("timeout_ms", "0")
+	m.Header.Set(nats.MsgIdHdr, fmt.Sprintf("typing-timeout-%d", pos))
+	if _, err := s.jetstream.PublishMsg(m, nats.Context(s.ctx)); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"room_id": roomID,
+			"user_id": userID,
+		}).Error("Failed to send typing timeout")
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// EventFormatFederation is the event_format which asks for events to be
+// returned exactly as they were received over federation.
+const EventFormatFederation = "federation"
+
+// SyncEventPaths are the locations of events in a /sync response. A "*" path
+// element matches every key of an object, e.g. every room ID.
+var SyncEventPaths = [][]string{
+	{"account_data", "events"},
+	{"presence", "events"},
+	{"rooms", "join", "*", "timeline", "events"},
+	{"rooms", "join", "*", "state", "events"},
+	{"rooms", "join", "*", "ephemeral", "events"},
+	{"rooms", "join", "*", "account_data", "events"},
+	{"rooms", "peek", "*", "timeline", "events"},
+	{"rooms", "peek", "*", "state", "events"},
+	{"rooms", "peek", "*", "ephemeral", "events"},
+	{"rooms", "peek", "*", "account_data", "events"},
+	{"rooms", "leave", "*", "timeline", "events"},
+	{"rooms", "leave", "*", "state", "events"},
+}
+
+// PDULookup returns the events with the given event IDs, for rewriting
+// events into the federation format. Events which aren't returned are left
+// in the client format.
+type PDULookup func(ctx context.Context, eventIDs []string) ([]*gomatrixserverlib.HeaderedEvent, error)
+
+// FormatEvents applies the event_fields and event_format options of a filter
+// to the events found at the given paths of a response. If neither option is
+// set then the response is returned untouched, otherwise the rewritten JSON
+// is returned as a json.RawMessage.
+func FormatEvents(
+	ctx context.Context, res interface{}, paths [][]string,
+	eventFields []string, eventFormat string, lookup PDULookup,
+) (interface{}, error) {
+	federation := eventFormat == EventFormatFederation && lookup != nil
+	if len(eventFields) == 0 && !federation {
+		return res, nil
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	var root interface{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err = decoder.Decode(&root); err != nil {
+		return nil, fmt.Errorf("decoder.Decode: %w", err)
+	}
+
+	// Gather up all of the events first, so that the federation format only
+	// needs a single lookup.
+	var events []map[string]interface{}
+	for _, path := range paths {
+		walkEvents(root, path, func(event map[string]interface{}) {
+			events = append(events, event)
+		})
+	}
+
+	if federation {
+		eventIDs := make([]string, 0, len(events))
+		for _, event := range events {
+			if eventID, ok := event["event_id"].(string); ok {
+				eventIDs = append(eventIDs, eventID)
+			}
+		}
+		pdus, err := lookup(ctx, eventIDs)
+		if err != nil {
+			return nil, fmt.Errorf("lookup: %w", err)
+		}
+		byID := make(map[string]*gomatrixserverlib.HeaderedEvent, len(pdus))
+		for _, pdu := range pdus {
+			byID[pdu.EventID()] = pdu
+		}
+		for _, event := range events {
+			eventID, _ := event["event_id"].(string)
+			pdu, ok := byID[eventID]
+			if !ok {
+				continue
+			}
+			var fedEvent map[string]interface{}
+			decoder = json.NewDecoder(bytes.NewReader(pdu.JSON()))
+			decoder.UseNumber()
+			if err = decoder.Decode(&fedEvent); err != nil {
+				return nil, fmt.Errorf("decoder.Decode: %w", err)
+			}
+			replaceMap(event, fedEvent)
+		}
+	}
+
+	if len(eventFields) > 0 {
+		fields := make([][]string, 0, len(eventFields))
+		for _, field := range eventFields {
+			fields = append(fields, splitEventField(field))
+		}
+		for _, event := range events {
+			replaceMap(event, projectEvent(event, fields))
+		}
+	}
+
+	b, err = json.Marshal(root)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	return json.RawMessage(b), nil
+}
+
+// walkEvents calls fn for each event object found at the path in v. The
+// path can either end at an array of events or at a single event.
+func walkEvents(v interface{}, path []string, fn func(map[string]interface{})) {
+	if len(path) == 0 {
+		switch e := v.(type) {
+		case []interface{}:
+			for _, item := range e {
+				if event, ok := item.(map[string]interface{}); ok {
+					fn(event)
+				}
+			}
+		case map[string]interface{}:
+			fn(e)
+		}
+		return
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if path[0] == "*" {
+		for _, child := range obj {
+			walkEvents(child, path[1:], fn)
+		}
+		return
+	}
+	if child, ok := obj[path[0]]; ok {
+		walkEvents(child, path[1:], fn)
+	}
+}
+
+// replaceMap replaces the contents of dst with src in place, so that the
+// event stays in the same position in the response.
+func replaceMap(dst, src map[string]interface{}) {
+	for k := range dst {
+		delete(dst, k)
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+}
+
+// splitEventField splits an event_fields entry on unescaped dots. A
+// backslash escapes a literal dot or backslash, as per the spec.
+func splitEventField(field string) []string {
+	var parts []string
+	var current strings.Builder
+	for i := 0; i < len(field); i++ {
+		switch c := field[i]; {
+		case c == '\\' && i+1 < len(field) && (field[i+1] == '.' || field[i+1] == '\\'):
+			current.WriteByte(field[i+1])
+			i++
+		case c == '.':
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	return append(parts, current.String())
+}
+
+// projectEvent returns a copy of the event containing only the given fields.
+// Fields which don't exist in the event are skipped.
+func projectEvent(event map[string]interface{}, fields [][]string) map[string]interface{} {
+	projected := make(map[string]interface{})
+	for _, field := range fields {
+		var v interface{} = event
+		found := true
+		for _, part := range field {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				found = false
+				break
+			}
+			if v, ok = obj[part]; !ok {
+				found = false
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		dst := projected
+		for _, part := range field[:len(field)-1] {
+			next, ok := dst[part].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				dst[part] = next
+			}
+			dst = next
+		}
+		dst[field[len(field)-1]] = v
+	}
+	return projected
+}
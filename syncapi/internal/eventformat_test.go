@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestFormatEventsEventFields(t *testing.T) {
+	res := map[string]interface{}{
+		"rooms": map[string]interface{}{
+			"join": map[string]interface{}{
+				"!room:test": map[string]interface{}{
+					"timeline": map[string]interface{}{
+						"events": []interface{}{
+							map[string]interface{}{
+								"type":     "m.room.message",
+								"event_id": "$event",
+								"sender":   "@alice:test",
+								"content": map[string]interface{}{
+									"body":    "hello",
+									"msgtype": "m.text",
+									"big":     json.Number("12345678901234567890"),
+								},
+								"unsigned": map[string]interface{}{"age": 10},
+							},
+						},
+						"limited": false,
+					},
+				},
+			},
+		},
+		"next_batch": "s1",
+	}
+	got, err := FormatEvents(context.Background(), res, SyncEventPaths, []string{"type", "content.body", "content.big", "missing.field"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"next_batch":"s1","rooms":{"join":{"!room:test":{"timeline":{"events":[{"content":{"big":12345678901234567890,"body":"hello"},"type":"m.room.message"}],"limited":false}}}}}`
+	if string(got.(json.RawMessage)) != want {
+		t.Fatalf("got %s\nwant %s", got, want)
+	}
+}
+
+func TestFormatEventsUnchanged(t *testing.T) {
+	res := map[string]string{"next_batch": "s1"}
+	got, err := FormatEvents(context.Background(), res, SyncEventPaths, nil, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.(map[string]string); !ok {
+		t.Fatalf("expected the response to be returned untouched, got %T", got)
+	}
+}
+
+func TestSplitEventField(t *testing.T) {
+	for field, want := range map[string][]string{
+		"content.body":              {"content", "body"},
+		`content.m\.relates_to.key`: {"content", "m.relates_to", "key"},
+		`content.back\\slash`:       {"content", `back\slash`},
+		"type":                      {"type"},
+	} {
+		got := splitEventField(field)
+		if len(got) != len(want) {
+			t.Fatalf("splitEventField(%q) = %q, want %q", field, got, want)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("splitEventField(%q) = %q, want %q", field, got, want)
+			}
+		}
+	}
+}
+
+func TestFormatEventsFederation(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	ev := room.Events()[0]
+	res := map[string]interface{}{
+		"chunk": gomatrixserverlib.HeaderedToClientEvents(room.Events()[:1], gomatrixserverlib.FormatAll),
+	}
+	lookup := func(ctx context.Context, eventIDs []string) ([]*gomatrixserverlib.HeaderedEvent, error) {
+		if len(eventIDs) != 1 || eventIDs[0] != ev.EventID() {
+			t.Fatalf("unexpected lookup for %v", eventIDs)
+		}
+		return []*gomatrixserverlib.HeaderedEvent{ev}, nil
+	}
+	got, err := FormatEvents(context.Background(), res, [][]string{{"chunk"}}, []string{"type", "signatures"}, EventFormatFederation, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Chunk []map[string]json.RawMessage `json:"chunk"`
+	}
+	if err = json.Unmarshal(got.(json.RawMessage), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Chunk) != 1 || len(out.Chunk[0]) != 2 || out.Chunk[0]["signatures"] == nil {
+		t.Fatalf("expected the federation event with only type and signatures, got %s", got)
+	}
+}
@@ -47,6 +47,9 @@ type Notifier struct {
 	lastCleanUpTime time.Time
 	// This map is reused to prevent allocations and GC pressure in SharedUsers.
 	_sharedUserMap map[string]struct{}
+	// Called with every update, if set, so that it can be sent to the other
+	// sync API instances.
+	onUpdate func(Update)
 }
 
 // NewNotifier creates a new notifier set to the given sync position.
@@ -85,6 +88,14 @@ func (n *Notifier) SetCurrentPosition(currPos types.StreamingToken) {
 func (n *Notifier) OnNewEvent(
 	ev *gomatrixserverlib.HeaderedEvent, roomID string, userIDs []string,
 	posUpdate types.StreamingToken,
+) {
+	n.replicate(Update{Type: UpdateEvent, Event: ev, RoomID: roomID, UserIDs: userIDs, Position: posUpdate})
+	n.onNewEvent(ev, roomID, userIDs, posUpdate)
+}
+
+func (n *Notifier) onNewEvent(
+	ev *gomatrixserverlib.HeaderedEvent, roomID string, userIDs []string,
+	posUpdate types.StreamingToken,
 ) {
 	// update the current position then notify relevant /sync streams.
 	// This needs to be done PRIOR to waking up users as they will read this value.
@@ -138,6 +149,13 @@ func (n *Notifier) OnNewEvent(
 
 func (n *Notifier) OnNewAccountData(
 	userID string, posUpdate types.StreamingToken,
+) {
+	n.replicate(Update{Type: UpdateAccountData, UserID: userID, Position: posUpdate})
+	n.onNewAccountData(userID, posUpdate)
+}
+
+func (n *Notifier) onNewAccountData(
+	userID string, posUpdate types.StreamingToken,
 ) {
 	n.lock.Lock()
 	defer n.lock.Unlock()
@@ -149,6 +167,14 @@ func (n *Notifier) OnNewAccountData(
 func (n *Notifier) OnNewPeek(
 	roomID, userID, deviceID string,
 	posUpdate types.StreamingToken,
+) {
+	n.replicate(Update{Type: UpdatePeek, RoomID: roomID, UserID: userID, DeviceID: deviceID, Position: posUpdate})
+	n.onNewPeek(roomID, userID, deviceID, posUpdate)
+}
+
+func (n *Notifier) onNewPeek(
+	roomID, userID, deviceID string,
+	posUpdate types.StreamingToken,
 ) {
 	n.lock.Lock()
 	defer n.lock.Unlock()
@@ -163,6 +189,14 @@ func (n *Notifier) OnNewPeek(
 func (n *Notifier) OnRetirePeek(
 	roomID, userID, deviceID string,
 	posUpdate types.StreamingToken,
+) {
+	n.replicate(Update{Type: UpdateRetirePeek, RoomID: roomID, UserID: userID, DeviceID: deviceID, Position: posUpdate})
+	n.onRetirePeek(roomID, userID, deviceID, posUpdate)
+}
+
+func (n *Notifier) onRetirePeek(
+	roomID, userID, deviceID string,
+	posUpdate types.StreamingToken,
 ) {
 	n.lock.Lock()
 	defer n.lock.Unlock()
@@ -177,6 +211,14 @@ func (n *Notifier) OnRetirePeek(
 func (n *Notifier) OnNewSendToDevice(
 	userID string, deviceIDs []string,
 	posUpdate types.StreamingToken,
+) {
+	n.replicate(Update{Type: UpdateSendToDevice, UserID: userID, DeviceIDs: deviceIDs, Position: posUpdate})
+	n.onNewSendToDevice(userID, deviceIDs, posUpdate)
+}
+
+func (n *Notifier) onNewSendToDevice(
+	userID string, deviceIDs []string,
+	posUpdate types.StreamingToken,
 ) {
 	n.lock.Lock()
 	defer n.lock.Unlock()
@@ -201,6 +243,14 @@ func (n *Notifier) OnNewTyping(
 func (n *Notifier) OnNewReceipt(
 	roomID string,
 	posUpdate types.StreamingToken,
+) {
+	n.replicate(Update{Type: UpdateReceipt, RoomID: roomID, Position: posUpdate})
+	n.onNewReceipt(roomID, posUpdate)
+}
+
+func (n *Notifier) onNewReceipt(
+	roomID string,
+	posUpdate types.StreamingToken,
 ) {
 	n.lock.Lock()
 	defer n.lock.Unlock()
@@ -211,6 +261,13 @@ func (n *Notifier) OnNewReceipt(
 
 func (n *Notifier) OnNewKeyChange(
 	posUpdate types.StreamingToken, wakeUserID, keyChangeUserID string,
+) {
+	n.replicate(Update{Type: UpdateKeyChange, UserID: wakeUserID, Position: posUpdate})
+	n.onNewKeyChange(posUpdate, wakeUserID, keyChangeUserID)
+}
+
+func (n *Notifier) onNewKeyChange(
+	posUpdate types.StreamingToken, wakeUserID, keyChangeUserID string,
 ) {
 	n.lock.Lock()
 	defer n.lock.Unlock()
@@ -221,6 +278,13 @@ func (n *Notifier) OnNewKeyChange(
 
 func (n *Notifier) OnNewInvite(
 	posUpdate types.StreamingToken, wakeUserID string,
+) {
+	n.replicate(Update{Type: UpdateInvite, UserID: wakeUserID, Position: posUpdate})
+	n.onNewInvite(posUpdate, wakeUserID)
+}
+
+func (n *Notifier) onNewInvite(
+	posUpdate types.StreamingToken, wakeUserID string,
 ) {
 	n.lock.Lock()
 	defer n.lock.Unlock()
@@ -232,6 +296,14 @@ func (n *Notifier) OnNewInvite(
 func (n *Notifier) OnNewNotificationData(
 	userID string,
 	posUpdate types.StreamingToken,
+) {
+	n.replicate(Update{Type: UpdateNotificationData, UserID: userID, Position: posUpdate})
+	n.onNewNotificationData(userID, posUpdate)
+}
+
+func (n *Notifier) onNewNotificationData(
+	userID string,
+	posUpdate types.StreamingToken,
 ) {
 	n.lock.Lock()
 	defer n.lock.Unlock()
@@ -242,6 +314,13 @@ func (n *Notifier) OnNewNotificationData(
 
 func (n *Notifier) OnNewPresence(
 	posUpdate types.StreamingToken, userID string,
+) {
+	n.replicate(Update{Type: UpdatePresence, UserID: userID, Position: posUpdate})
+	n.onNewPresence(posUpdate, userID)
+}
+
+func (n *Notifier) onNewPresence(
+	posUpdate types.StreamingToken, userID string,
 ) {
 	n.lock.Lock()
 	defer n.lock.Unlock()
@@ -314,6 +393,22 @@ func (n *Notifier) GetListener(req types.SyncRequest) UserDeviceStreamListener {
 	return n._fetchUserDeviceStream(req.Device.UserID, req.Device.ID, true).GetListener(req.Context)
 }
 
+// Listeners returns the number of user device streams which the notifier
+// is keeping track of, and the number of listeners which are waiting on
+// them to be woken up. Used for metrics.
+func (n *Notifier) Listeners() (streams, waiting int) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	for _, byUser := range n.userDeviceStreams {
+		for _, stream := range byUser {
+			streams++
+			waiting += int(stream.NumWaiting())
+		}
+	}
+	return
+}
+
 // Load the membership states required to notify users correctly.
 func (n *Notifier) Load(ctx context.Context, db storage.Database) error {
 	n.lock.Lock()
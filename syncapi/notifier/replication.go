@@ -0,0 +1,94 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifier
+
+import (
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// UpdateType is the notifier method which an Update was passed to.
+type UpdateType string
+
+const (
+	UpdateEvent            UpdateType = "event"
+	UpdateAccountData      UpdateType = "account_data"
+	UpdatePeek             UpdateType = "peek"
+	UpdateRetirePeek       UpdateType = "retire_peek"
+	UpdateSendToDevice     UpdateType = "send_to_device"
+	UpdateReceipt          UpdateType = "receipt"
+	UpdateKeyChange        UpdateType = "key_change"
+	UpdateInvite           UpdateType = "invite"
+	UpdateNotificationData UpdateType = "notification_data"
+	UpdatePresence         UpdateType = "presence"
+)
+
+// Update is a call to one of the OnNew... methods of a notifier, which is
+// sent to the notifiers of the other sync API instances when there is more
+// than one, so that they wake up their own listeners. Typing notifications
+// aren't sent, as every instance keeps track of them itself.
+type Update struct {
+	Type      UpdateType                       `json:"type"`
+	Event     *gomatrixserverlib.HeaderedEvent `json:"event,omitempty"`
+	RoomID    string                           `json:"room_id,omitempty"`
+	UserID    string                           `json:"user_id,omitempty"`
+	DeviceID  string                           `json:"device_id,omitempty"`
+	UserIDs   []string                         `json:"user_ids,omitempty"`
+	DeviceIDs []string                         `json:"device_ids,omitempty"`
+	Position  types.StreamingToken             `json:"position"`
+}
+
+// SetUpdateHandler sets a function which is called with every update to
+// the notifier, other than those which are applied with Apply. It must be
+// called before the notifier is used.
+func (n *Notifier) SetUpdateHandler(f func(Update)) {
+	n.onUpdate = f
+}
+
+func (n *Notifier) replicate(u Update) {
+	if n.onUpdate != nil {
+		n.onUpdate(u)
+	}
+}
+
+// Apply applies an update from another sync API instance, without passing
+// it to the update handler.
+func (n *Notifier) Apply(u Update) {
+	switch u.Type {
+	case UpdateEvent:
+		n.onNewEvent(u.Event, u.RoomID, u.UserIDs, u.Position)
+	case UpdateAccountData:
+		n.onNewAccountData(u.UserID, u.Position)
+	case UpdatePeek:
+		n.onNewPeek(u.RoomID, u.UserID, u.DeviceID, u.Position)
+	case UpdateRetirePeek:
+		n.onRetirePeek(u.RoomID, u.UserID, u.DeviceID, u.Position)
+	case UpdateSendToDevice:
+		n.onNewSendToDevice(u.UserID, u.DeviceIDs, u.Position)
+	case UpdateReceipt:
+		n.onNewReceipt(u.RoomID, u.Position)
+	case UpdateKeyChange:
+		n.onNewKeyChange(u.Position, u.UserID, "")
+	case UpdateInvite:
+		n.onNewInvite(u.Position, u.UserID)
+	case UpdateNotificationData:
+		n.onNewNotificationData(u.UserID, u.Position)
+	case UpdatePresence:
+		n.onNewPresence(u.Position, u.UserID)
+	default:
+		log.WithField("type", u.Type).Warn("Notifier.Apply: ignoring unknown update type")
+	}
+}
@@ -30,7 +30,7 @@ type UserAPIReadProducer struct {
 }
 
 // SendData sends account data to the user API server
-func (p *UserAPIReadProducer) SendReadUpdate(userID, roomID string, readPos, fullyReadPos types.StreamPosition) error {
+func (p *UserAPIReadProducer) SendReadUpdate(userID, roomID, threadID string, readPos, fullyReadPos types.StreamPosition) error {
 	m := &nats.Msg{
 		Subject: p.Topic,
 		Header:  nats.Header{},
@@ -43,6 +43,7 @@ func (p *UserAPIReadProducer) SendReadUpdate(userID, roomID string, readPos, ful
 		RoomID:    roomID,
 		Read:      readPos,
 		FullyRead: fullyReadPos,
+		ThreadID:  threadID,
 	}
 	var err error
 	m.Data, err = json.Marshal(data)
@@ -55,6 +56,7 @@ func (p *UserAPIReadProducer) SendReadUpdate(userID, roomID string, readPos, ful
 		"room_id":        roomID,
 		"read_pos":       readPos,
 		"fully_read_pos": fullyReadPos,
+		"thread_id":      threadID,
 	}).Tracef("Producing to topic '%s'", p.Topic)
 
 	_, err = p.JetStream.PublishMsg(m)
@@ -0,0 +1,408 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rebuild reconstructs the sync API database from the roomserver,
+// for when the sync API's copy of rooms has been lost or has gone wrong.
+package rebuild
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// DefaultBatchSize is the number of events fetched from the roomserver at once.
+const DefaultBatchSize = 100
+
+// ErrRunning is returned when trying to start a rebuild while one is running.
+var ErrRunning = errors.New("a rebuild is already running")
+
+// RoomserverAPI is the part of the roomserver API needed to rebuild rooms.
+type RoomserverAPI interface {
+	QueryKnownRooms(ctx context.Context, req *roomserverAPI.QueryKnownRoomsRequest, res *roomserverAPI.QueryKnownRoomsResponse) error
+	QueryRoomEvents(ctx context.Context, req *roomserverAPI.QueryRoomEventsRequest, res *roomserverAPI.QueryRoomEventsResponse) error
+	QueryLatestEventsAndState(ctx context.Context, req *roomserverAPI.QueryLatestEventsAndStateRequest, res *roomserverAPI.QueryLatestEventsAndStateResponse) error
+}
+
+// Options controls a rebuild.
+type Options struct {
+	// The rooms to rebuild. If empty then all rooms known to the roomserver are rebuilt.
+	RoomIDs []string `json:"room_ids,omitempty"`
+	// The maximum number of events to write per second, or 0 for no limit.
+	EventsPerSecond int `json:"events_per_second,omitempty"`
+	// Forget the progress of previous rebuilds and start from the beginning.
+	Restart bool `json:"restart,omitempty"`
+}
+
+// Status is the progress of the current or most recent rebuild.
+type Status struct {
+	Running       bool                        `json:"running"`
+	StartedAt     gomatrixserverlib.Timestamp `json:"started_at,omitempty"`
+	FinishedAt    gomatrixserverlib.Timestamp `json:"finished_at,omitempty"`
+	RoomsTotal    int                         `json:"rooms_total"`
+	RoomsDone     int                         `json:"rooms_done"`
+	EventsWritten int64                       `json:"events_written"`
+	CurrentRoom   string                      `json:"current_room,omitempty"`
+	Error         string                      `json:"error,omitempty"`
+}
+
+// A Rebuilder writes the events, current state, memberships and pending
+// invites of rooms from the roomserver into the sync API database. Events
+// which the sync API already has are left alone, so a rebuild can be run
+// against a live sync API. Progress is stored in the sync API database, so
+// an interrupted rebuild carries on from where it stopped.
+type Rebuilder struct {
+	db         storage.Database
+	rsAPI      RoomserverAPI
+	serverName gomatrixserverlib.ServerName
+	onRoom     func(ctx context.Context, roomID string) error
+	batchSize  int
+
+	mu     sync.Mutex
+	status Status // protected by mu
+}
+
+// NewRebuilder creates a rebuilder. If onRoom isn't nil then it is called after each room has been rebuilt, so
+// that a running sync API can notify users about the room.
+func NewRebuilder(
+	db storage.Database, rsAPI RoomserverAPI, serverName gomatrixserverlib.ServerName,
+	onRoom func(ctx context.Context, roomID string) error,
+) *Rebuilder {
+	return &Rebuilder{
+		db:         db,
+		rsAPI:      rsAPI,
+		serverName: serverName,
+		onRoom:     onRoom,
+		batchSize:  DefaultBatchSize,
+	}
+}
+
+// Status returns the progress of the current or most recent rebuild.
+func (r *Rebuilder) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// Start runs a rebuild in the background, which stops when the context is
+// done. It returns ErrRunning if a rebuild is already running.
+func (r *Rebuilder) Start(ctx context.Context, opts Options) error {
+	if err := r.begin(); err != nil {
+		return err
+	}
+	go func() {
+		if err := r.run(ctx, opts); err != nil {
+			logrus.WithError(err).Error("Failed to rebuild the sync API")
+		}
+	}()
+	return nil
+}
+
+// Run runs a rebuild and waits for it to finish.
+func (r *Rebuilder) Run(ctx context.Context, opts Options) error {
+	if err := r.begin(); err != nil {
+		return err
+	}
+	return r.run(ctx, opts)
+}
+
+func (r *Rebuilder) begin() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status.Running {
+		return ErrRunning
+	}
+	r.status = Status{
+		Running:   true,
+		StartedAt: gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+	return nil
+}
+
+func (r *Rebuilder) run(ctx context.Context, opts Options) (err error) {
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.status.Running = false
+		r.status.CurrentRoom = ""
+		r.status.FinishedAt = gomatrixserverlib.AsTimestamp(time.Now())
+		if err != nil {
+			r.status.Error = err.Error()
+		}
+	}()
+
+	if opts.Restart {
+		if err = r.db.ResetRebuildProgress(ctx); err != nil {
+			return fmt.Errorf("r.db.ResetRebuildProgress: %w", err)
+		}
+	}
+	roomIDs := opts.RoomIDs
+	if len(roomIDs) == 0 {
+		res := &roomserverAPI.QueryKnownRoomsResponse{}
+		if err = r.rsAPI.QueryKnownRooms(ctx, &roomserverAPI.QueryKnownRoomsRequest{}, res); err != nil {
+			return fmt.Errorf("r.rsAPI.QueryKnownRooms: %w", err)
+		}
+		roomIDs = res.RoomIDs
+	}
+	r.mu.Lock()
+	r.status.RoomsTotal = len(roomIDs)
+	r.mu.Unlock()
+
+	limiter := newRateLimiter(opts.EventsPerSecond)
+	for _, roomID := range roomIDs {
+		r.mu.Lock()
+		r.status.CurrentRoom = roomID
+		r.mu.Unlock()
+		if err = r.rebuildRoom(ctx, roomID, limiter); err != nil {
+			return fmt.Errorf("failed to rebuild room %s: %w", roomID, err)
+		}
+		r.mu.Lock()
+		r.status.RoomsDone++
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+func (r *Rebuilder) rebuildRoom(ctx context.Context, roomID string, limiter *rateLimiter) error {
+	position, completed, err := r.db.GetRebuildProgress(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("r.db.GetRebuildProgress: %w", err)
+	}
+	if completed {
+		return nil
+	}
+	logger := logrus.WithField("room_id", roomID)
+	logger.WithField("position", position).Info("Rebuilding room in the sync API")
+
+	// Start from whatever state the sync API already has for the room, so
+	// that state events replace the right events as they are written.
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	current, err := r.db.CurrentState(ctx, roomID, &stateFilter, nil)
+	if err != nil {
+		return fmt.Errorf("r.db.CurrentState: %w", err)
+	}
+	state := newRoomState(current)
+
+	var written int
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		res := &roomserverAPI.QueryRoomEventsResponse{}
+		if err = r.rsAPI.QueryRoomEvents(ctx, &roomserverAPI.QueryRoomEventsRequest{
+			RoomID: roomID,
+			After:  position,
+			Limit:  r.batchSize,
+		}, res); err != nil {
+			return fmt.Errorf("r.rsAPI.QueryRoomEvents: %w", err)
+		}
+		if !res.RoomExists {
+			logger.Warn("Room doesn't exist in the roomserver, skipping")
+			return r.db.SetRebuildProgress(ctx, roomID, position, true)
+		}
+		if len(res.Events) == 0 {
+			break
+		}
+		if written, err = r.writeEvents(ctx, res.Events, state); err != nil {
+			return err
+		}
+		position = res.Position
+		if err = r.db.SetRebuildProgress(ctx, roomID, position, false); err != nil {
+			return fmt.Errorf("r.db.SetRebuildProgress: %w", err)
+		}
+		r.mu.Lock()
+		r.status.EventsWritten += int64(written)
+		r.mu.Unlock()
+		if err = limiter.wait(ctx, written); err != nil {
+			return err
+		}
+	}
+
+	// Writing the events in order only approximates the state of the room,
+	// as it doesn't take state resolution into account, so finish by taking
+	// the current state from the roomserver.
+	stateRes := &roomserverAPI.QueryLatestEventsAndStateResponse{}
+	if err = r.rsAPI.QueryLatestEventsAndState(ctx, &roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+	}, stateRes); err != nil {
+		return fmt.Errorf("r.rsAPI.QueryLatestEventsAndState: %w", err)
+	}
+	if err = r.db.RebuildRoomState(ctx, roomID, stateRes.StateEvents); err != nil {
+		return fmt.Errorf("r.db.RebuildRoomState: %w", err)
+	}
+	if err = r.addInvites(ctx, stateRes.StateEvents); err != nil {
+		return err
+	}
+
+	if err = r.db.SetRebuildProgress(ctx, roomID, position, true); err != nil {
+		return fmt.Errorf("r.db.SetRebuildProgress: %w", err)
+	}
+	if r.onRoom != nil {
+		if err = r.onRoom(ctx, roomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEvents writes the events which the sync API doesn't already have,
+// returning how many were written.
+func (r *Rebuilder) writeEvents(ctx context.Context, events []*gomatrixserverlib.HeaderedEvent, state *roomState) (int, error) {
+	eventIDs := make([]string, 0, len(events))
+	for _, ev := range events {
+		eventIDs = append(eventIDs, ev.EventID())
+	}
+	existing, err := r.db.Events(ctx, eventIDs)
+	if err != nil {
+		return 0, fmt.Errorf("r.db.Events: %w", err)
+	}
+	known := make(map[string]struct{}, len(existing))
+	for _, ev := range existing {
+		known[ev.EventID()] = struct{}{}
+	}
+
+	written := 0
+	for _, ev := range events {
+		var addStateEvents []*gomatrixserverlib.HeaderedEvent
+		var addStateEventIDs, removeStateEventIDs []string
+		if ev.StateKey() != nil {
+			addStateEvents = []*gomatrixserverlib.HeaderedEvent{ev}
+			addStateEventIDs = []string{ev.EventID()}
+			if replaced := state.replace(ev); replaced != "" {
+				removeStateEventIDs = []string{replaced}
+			}
+		}
+		if _, ok := known[ev.EventID()]; ok {
+			continue
+		}
+		if _, err = r.db.WriteEvent(
+			ctx, ev, addStateEvents, addStateEventIDs, removeStateEventIDs, nil, false, state.historyVisibility,
+		); err != nil {
+			return written, fmt.Errorf("r.db.WriteEvent: %w", err)
+		}
+		state.updateHistoryVisibility(ev)
+		written++
+	}
+	return written, nil
+}
+
+// addInvites adds the invites for local users which are still pending in
+// the room's current state.
+func (r *Rebuilder) addInvites(ctx context.Context, stateEvents []*gomatrixserverlib.HeaderedEvent) error {
+	for _, ev := range stateEvents {
+		if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+			continue
+		}
+		if membership, err := ev.Membership(); err != nil || membership != gomatrixserverlib.Invite {
+			continue
+		}
+		_, domain, err := gomatrixserverlib.SplitID('@', *ev.StateKey())
+		if err != nil || domain != r.serverName {
+			continue
+		}
+		latest, err := r.db.MaxStreamPositionForInvites(ctx)
+		if err != nil {
+			return fmt.Errorf("r.db.MaxStreamPositionForInvites: %w", err)
+		}
+		invites, _, err := r.db.InviteEventsInRange(ctx, *ev.StateKey(), types.Range{From: 0, To: latest})
+		if err != nil {
+			return fmt.Errorf("r.db.InviteEventsInRange: %w", err)
+		}
+		if invite, ok := invites[ev.RoomID()]; ok && invite.EventID() == ev.EventID() {
+			continue
+		}
+		if _, err = r.db.AddInviteEvent(ctx, ev); err != nil {
+			return fmt.Errorf("r.db.AddInviteEvent: %w", err)
+		}
+	}
+	return nil
+}
+
+// roomState tracks the state of a room as its events are written in order.
+type roomState struct {
+	events            map[gomatrixserverlib.StateKeyTuple]string
+	historyVisibility gomatrixserverlib.HistoryVisibility
+}
+
+func newRoomState(current []*gomatrixserverlib.HeaderedEvent) *roomState {
+	s := &roomState{
+		events:            make(map[gomatrixserverlib.StateKeyTuple]string, len(current)),
+		historyVisibility: gomatrixserverlib.HistoryVisibilityShared,
+	}
+	for _, ev := range current {
+		s.replace(ev)
+		s.updateHistoryVisibility(ev)
+	}
+	return s
+}
+
+// replace sets the event as the current state for its type and state key,
+// returning the ID of the event that it replaced, if any.
+func (s *roomState) replace(ev *gomatrixserverlib.HeaderedEvent) string {
+	tuple := gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}
+	replaced := s.events[tuple]
+	s.events[tuple] = ev.EventID()
+	if replaced == ev.EventID() {
+		return ""
+	}
+	return replaced
+}
+
+func (s *roomState) updateHistoryVisibility(ev *gomatrixserverlib.HeaderedEvent) {
+	if ev.Type() != gomatrixserverlib.MRoomHistoryVisibility || !ev.StateKeyEquals("") {
+		return
+	}
+	if hisVis, err := ev.HistoryVisibility(); err == nil {
+		s.historyVisibility = hisVis
+	}
+}
+
+// rateLimiter limits the number of events written per second.
+type rateLimiter struct {
+	perSecond int
+	start     time.Time
+	count     int
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	return &rateLimiter{perSecond: perSecond, start: time.Now()}
+}
+
+// wait records that n events were written, waiting if that goes over the limit.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l.perSecond <= 0 {
+		return nil
+	}
+	l.count += n
+	due := l.start.Add(time.Duration(l.count) * time.Second / time.Duration(l.perSecond))
+	wait := time.Until(due)
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
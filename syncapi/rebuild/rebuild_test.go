@@ -0,0 +1,194 @@
+package rebuild
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/test"
+)
+
+var ctx = context.Background()
+
+// fakeRoomserver serves the events of test rooms, using the index of each
+// event in the room as its position.
+type fakeRoomserver struct {
+	rooms map[string]*test.Room
+}
+
+func (f *fakeRoomserver) QueryKnownRooms(ctx context.Context, req *roomserverAPI.QueryKnownRoomsRequest, res *roomserverAPI.QueryKnownRoomsResponse) error {
+	for roomID := range f.rooms {
+		res.RoomIDs = append(res.RoomIDs, roomID)
+	}
+	return nil
+}
+
+func (f *fakeRoomserver) QueryRoomEvents(ctx context.Context, req *roomserverAPI.QueryRoomEventsRequest, res *roomserverAPI.QueryRoomEventsResponse) error {
+	res.Position = req.After
+	room, ok := f.rooms[req.RoomID]
+	if !ok {
+		return nil
+	}
+	res.RoomExists = true
+	events := room.Events()
+	for i := int(req.After); i < len(events) && len(res.Events) < req.Limit; i++ {
+		res.Events = append(res.Events, events[i])
+		res.Position = int64(i + 1)
+	}
+	return nil
+}
+
+func (f *fakeRoomserver) QueryLatestEventsAndState(ctx context.Context, req *roomserverAPI.QueryLatestEventsAndStateRequest, res *roomserverAPI.QueryLatestEventsAndStateResponse) error {
+	room, ok := f.rooms[req.RoomID]
+	if !ok {
+		return nil
+	}
+	res.RoomExists = true
+	res.StateEvents = room.CurrentState()
+	return nil
+}
+
+func mustCreateDatabase(t *testing.T, dbType test.DBType) (storage.Database, func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := storage.NewSyncServerDatasource(nil, &config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	})
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	return db, close
+}
+
+func TestRebuild(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+
+		alice := test.NewUser(t)
+		bob := test.NewUser(t)
+		room := test.NewRoom(t, alice)
+		room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+		room.CreateAndInsert(t, alice, "m.room.topic", map[string]interface{}{"topic": "first"}, test.WithStateKey(""))
+		topic := room.CreateAndInsert(t, alice, "m.room.topic", map[string]interface{}{"topic": "second"}, test.WithStateKey(""))
+		invite := room.CreateAndInsert(t, alice, "m.room.member", map[string]interface{}{"membership": "invite"}, test.WithStateKey(bob.ID))
+
+		// The sync API already has the first few events of the room.
+		for _, ev := range room.Events()[:3] {
+			if _, err := db.WriteEvent(
+				ctx, ev, []*gomatrixserverlib.HeaderedEvent{ev}, []string{ev.EventID()}, nil, nil, false, gomatrixserverlib.HistoryVisibilityShared,
+			); err != nil {
+				t.Fatalf("WriteEvent returned %s", err)
+			}
+		}
+
+		rsAPI := &fakeRoomserver{rooms: map[string]*test.Room{room.ID: room}}
+		r := NewRebuilder(db, rsAPI, "test", nil)
+		r.batchSize = 2
+		if err := r.Run(ctx, Options{}); err != nil {
+			t.Fatalf("Run returned %s", err)
+		}
+		status := r.Status()
+		if status.Running || status.RoomsTotal != 1 || status.RoomsDone != 1 || status.Error != "" {
+			t.Fatalf("unexpected status %+v", status)
+		}
+		if want := int64(len(room.Events()) - 3); status.EventsWritten != want {
+			t.Fatalf("wrote %d events, want %d", status.EventsWritten, want)
+		}
+
+		eventIDs := make([]string, 0, len(room.Events()))
+		for _, ev := range room.Events() {
+			eventIDs = append(eventIDs, ev.EventID())
+		}
+		events, err := db.Events(ctx, eventIDs)
+		if err != nil {
+			t.Fatalf("Events returned %s", err)
+		}
+		if len(events) != len(eventIDs) {
+			t.Fatalf("got %d events, want %d", len(events), len(eventIDs))
+		}
+
+		stateFilter := gomatrixserverlib.DefaultStateFilter()
+		state, err := db.CurrentState(ctx, room.ID, &stateFilter, nil)
+		if err != nil {
+			t.Fatalf("CurrentState returned %s", err)
+		}
+		if len(state) != len(room.CurrentState()) {
+			t.Fatalf("got %d state events, want %d", len(state), len(room.CurrentState()))
+		}
+		ev, err := db.GetStateEvent(ctx, room.ID, "m.room.topic", "")
+		if err != nil || ev == nil || ev.EventID() != topic.EventID() {
+			t.Fatalf("got topic %v (err %v), want %s", ev, err, topic.EventID())
+		}
+
+		latest, err := db.MaxStreamPositionForInvites(ctx)
+		if err != nil {
+			t.Fatalf("MaxStreamPositionForInvites returned %s", err)
+		}
+		invites, _, err := db.InviteEventsInRange(ctx, bob.ID, types.Range{From: 0, To: latest})
+		if err != nil {
+			t.Fatalf("InviteEventsInRange returned %s", err)
+		}
+		if got, ok := invites[room.ID]; !ok || got.EventID() != invite.EventID() {
+			t.Fatalf("invite for bob not found: %v", invites)
+		}
+
+		// The room is complete, so running again does nothing until restarted.
+		room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "later"})
+		if err = r.Run(ctx, Options{RoomIDs: []string{room.ID}}); err != nil {
+			t.Fatalf("Run returned %s", err)
+		}
+		if status = r.Status(); status.EventsWritten != 0 {
+			t.Fatalf("wrote %d events for a completed room", status.EventsWritten)
+		}
+		if err = r.Run(ctx, Options{RoomIDs: []string{room.ID}, Restart: true}); err != nil {
+			t.Fatalf("Run returned %s", err)
+		}
+		if status = r.Status(); status.EventsWritten != 1 {
+			t.Fatalf("wrote %d events after restarting, want 1", status.EventsWritten)
+		}
+	})
+}
+
+func TestRebuildResumes(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+
+		alice := test.NewUser(t)
+		room := test.NewRoom(t, alice)
+		rsAPI := &fakeRoomserver{rooms: map[string]*test.Room{room.ID: room}}
+
+		// Pretend that an earlier rebuild stopped after writing two events.
+		for _, ev := range room.Events()[:2] {
+			if _, err := db.WriteEvent(
+				ctx, ev, []*gomatrixserverlib.HeaderedEvent{ev}, []string{ev.EventID()}, nil, nil, false, gomatrixserverlib.HistoryVisibilityShared,
+			); err != nil {
+				t.Fatalf("WriteEvent returned %s", err)
+			}
+		}
+		if err := db.SetRebuildProgress(ctx, room.ID, 2, false); err != nil {
+			t.Fatalf("SetRebuildProgress returned %s", err)
+		}
+
+		r := NewRebuilder(db, rsAPI, "test", nil)
+		if err := r.Run(ctx, Options{}); err != nil {
+			t.Fatalf("Run returned %s", err)
+		}
+		if want := int64(len(room.Events()) - 2); r.Status().EventsWritten != want {
+			t.Fatalf("wrote %d events, want %d", r.Status().EventsWritten, want)
+		}
+		position, completed, err := db.GetRebuildProgress(ctx, room.ID)
+		if err != nil {
+			t.Fatalf("GetRebuildProgress returned %s", err)
+		}
+		if !completed || position != int64(len(room.Events())) {
+			t.Fatalf("got progress %d (completed %v), want %d (completed)", position, completed, len(room.Events()))
+		}
+	})
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// LeaseDuration is how long the elected instance stays elected for without
+// renewing its lease, i.e. how long it takes for another instance to take
+// over when it goes away without giving the lease up.
+const LeaseDuration = time.Second * 15
+
+const leaderKey = "leader"
+
+// Election tracks whether this instance is elected to write to the database,
+// for the parts of the sync API which write to it outside of the consumers.
+type Election struct {
+	mu      sync.RWMutex
+	process *process.ProcessContext // protected by mu
+}
+
+// Elect sets the process context of the instance while it is elected, or
+// nil once it isn't.
+func (e *Election) Elect(process *process.ProcessContext) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.process = process
+}
+
+// Elected returns the process context of the instance while it is elected,
+// which is done once the instance stops being elected, or nil if it isn't
+// elected.
+func (e *Election) Elected() *process.ProcessContext {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.process
+}
+
+// Campaign for the instance to be elected, by holding a lease in a NATS
+// key-value bucket which expires unless it is renewed. onElected is called
+// once the instance has been elected. If the instance fails to renew its
+// lease before it could have expired, onDeposed is called, as another
+// instance may have been elected in the meantime, and the instance carries
+// on campaigning to be elected again. The lease is given up when ctx is
+// done. The bucket is kept in memory, as the lease is only meaningful while
+// the instances are running.
+func Campaign(
+	ctx context.Context, js nats.JetStreamContext, bucket, instance string,
+	lease time.Duration, onElected, onDeposed func(),
+) error {
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  bucket,
+			History: 1,
+			TTL:     lease,
+			Storage: nats.MemoryStorage,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get key-value bucket %q: %w", bucket, err)
+	}
+	go campaign(ctx, kv, instance, lease, onElected, onDeposed)
+	return nil
+}
+
+func campaign(
+	ctx context.Context, kv nats.KeyValue, instance string,
+	lease time.Duration, onElected, onDeposed func(),
+) {
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	var revision uint64
+	var renewed time.Time
+	for {
+		if revision == 0 {
+			// The key only exists while another instance holds the lease.
+			if rev, err := kv.Create(leaderKey, []byte(instance)); err == nil {
+				revision, renewed = rev, time.Now()
+				logrus.WithField("instance", instance).Info("This sync API instance has been elected to write to the database")
+				onElected()
+			}
+		} else if rev, err := kv.Update(leaderKey, []byte(instance), revision); err == nil {
+			revision, renewed = rev, time.Now()
+		} else if time.Since(renewed) >= lease*2/3 {
+			// Give up before the lease could have expired, rather than
+			// risk two instances writing to the database at once.
+			logrus.WithError(err).WithField("instance", instance).Error("This sync API instance failed to renew its lease")
+			revision = 0
+			onDeposed()
+		}
+		select {
+		case <-ctx.Done():
+			// Only delete the key if it is still ours, as another instance
+			// may have been elected since we last renewed the lease.
+			if revision != 0 {
+				_ = kv.Delete(leaderKey, nats.LastRevision(revision))
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
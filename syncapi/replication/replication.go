@@ -0,0 +1,165 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replication lets more than one sync API instance run against the
+// same database. One instance is elected to consume new data into the
+// database, and every instance sends the updates to its notifier to the
+// others, so that they can wake up their own /sync requests. The instances
+// also tell each other when local users sync or do something, so that the
+// presence of a user doesn't depend on which instance they are syncing with.
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/streams"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// replicatedUpdate is a notifier or presence update sent to the other
+// instances.
+type replicatedUpdate struct {
+	// The instance which sent the update, so that it can ignore it.
+	Origin   string          `json:"origin"`
+	Presence *presenceUpdate `json:"presence,omitempty"`
+	notifier.Update
+}
+
+// presenceUpdate tells the other instances that a local user synced or did
+// something.
+type presenceUpdate struct {
+	UserID   string                      `json:"user_id"`
+	SyncedTS gomatrixserverlib.Timestamp `json:"synced_ts,omitempty"`
+	ActiveTS gomatrixserverlib.Timestamp `json:"active_ts,omitempty"`
+}
+
+// PresenceTracker tracks the presence of the local users who are syncing,
+// and is told about what they do on the other instances.
+type PresenceTracker interface {
+	SyncedElsewhere(userID string, ts gomatrixserverlib.Timestamp)
+	ActiveElsewhere(userID string, ts gomatrixserverlib.Timestamp)
+}
+
+// Replicator sends the updates to the notifier of this instance to the
+// other instances and applies theirs.
+type Replicator struct {
+	// A random ID for this instance.
+	Instance string
+	js       nats.JetStreamContext
+	topic    string
+	notifier *notifier.Notifier
+	streams  *streams.Streams
+	presence atomic.Value // PresenceTracker
+}
+
+// NewReplicator creates a new Replicator, and sets it as the update handler
+// of the notifier. Call Start() to begin applying updates from the other
+// instances.
+func NewReplicator(
+	js nats.JetStreamContext, topic string,
+	notifier *notifier.Notifier, streams *streams.Streams,
+) *Replicator {
+	r := &Replicator{
+		Instance: util.RandomString(16),
+		js:       js,
+		topic:    topic,
+		notifier: notifier,
+		streams:  streams,
+	}
+	notifier.SetUpdateHandler(r.publish)
+	return r
+}
+
+// Start applying the updates from the other instances, with an ephemeral
+// consumer so that every instance receives all of them.
+func (r *Replicator) Start(ctx context.Context) error {
+	return jetstream.JetStreamEphemeralConsumer(ctx, r.js, r.topic, r.onMessage)
+}
+
+// SetPresenceTracker sets the tracker which is told about the presence
+// updates from the other instances.
+func (r *Replicator) SetPresenceTracker(t PresenceTracker) {
+	r.presence.Store(t)
+}
+
+// PublishSync tells the other instances that a local user synced with
+// this instance.
+func (r *Replicator) PublishSync(userID string, ts gomatrixserverlib.Timestamp) {
+	r.publishPresence(&presenceUpdate{UserID: userID, SyncedTS: ts})
+}
+
+// PublishActivity tells the other instances that a local user did
+// something, like sending an event.
+func (r *Replicator) PublishActivity(userID string, ts gomatrixserverlib.Timestamp) {
+	r.publishPresence(&presenceUpdate{UserID: userID, ActiveTS: ts})
+}
+
+func (r *Replicator) publish(u notifier.Update) {
+	data, err := json.Marshal(replicatedUpdate{
+		Origin: r.Instance,
+		Update: u,
+	})
+	if err == nil {
+		_, err = r.js.Publish(r.topic, data)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("type", u.Type).Error("Failed to send notifier update to the other sync API instances")
+	}
+}
+
+func (r *Replicator) publishPresence(p *presenceUpdate) {
+	data, err := json.Marshal(replicatedUpdate{
+		Origin:   r.Instance,
+		Presence: p,
+	})
+	if err == nil {
+		_, err = r.js.Publish(r.topic, data)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("user_id", p.UserID).Error("Failed to send presence update to the other sync API instances")
+	}
+}
+
+func (r *Replicator) onMessage(ctx context.Context, msg *nats.Msg) {
+	var u replicatedUpdate
+	if err := json.Unmarshal(msg.Data, &u); err != nil {
+		logrus.WithError(err).Error("Failed to parse notifier update from another sync API instance")
+		return
+	}
+	if u.Origin == r.Instance {
+		return
+	}
+	if u.Presence != nil {
+		if t, ok := r.presence.Load().(PresenceTracker); ok {
+			if u.Presence.SyncedTS != 0 {
+				t.SyncedElsewhere(u.Presence.UserID, u.Presence.SyncedTS)
+			}
+			if u.Presence.ActiveTS != 0 {
+				t.ActiveElsewhere(u.Presence.UserID, u.Presence.ActiveTS)
+			}
+		}
+		return
+	}
+	// The streams need to know about the new positions before any /sync
+	// requests are woken up, as they read them.
+	r.streams.Advance(u.Position)
+	r.notifier.Apply(u.Update)
+}
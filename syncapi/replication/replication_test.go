@@ -0,0 +1,169 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/streams"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+func newStreams() *streams.Streams {
+	return &streams.Streams{
+		PDUStreamProvider:              &streams.PDUStreamProvider{},
+		TypingStreamProvider:           &streams.TypingStreamProvider{},
+		ReceiptStreamProvider:          &streams.ReceiptStreamProvider{},
+		InviteStreamProvider:           &streams.InviteStreamProvider{},
+		SendToDeviceStreamProvider:     &streams.SendToDeviceStreamProvider{},
+		AccountDataStreamProvider:      &streams.AccountDataStreamProvider{},
+		DeviceListStreamProvider:       &streams.DeviceListStreamProvider{},
+		NotificationDataStreamProvider: &streams.NotificationDataStreamProvider{},
+		PresenceStreamProvider:         &streams.PresenceStreamProvider{},
+	}
+}
+
+func waitForPosition(t *testing.T, n *notifier.Notifier, userID, deviceID string, since types.StreamingToken) types.StreamingToken {
+	t.Helper()
+	listener := n.GetListener(types.SyncRequest{
+		Device:  &userapi.Device{UserID: userID, ID: deviceID},
+		Since:   since,
+		Log:     util.GetLogger(context.TODO()),
+		Context: context.TODO(),
+	})
+	defer listener.Close()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s to be woken up", userID)
+	case <-listener.GetNotifyChannel(since):
+	}
+	return listener.GetSyncPosition()
+}
+
+func TestReplicator(t *testing.T) {
+	base, close := testrig.CreateBaseDendrite(t, test.DBTypeSQLite)
+	defer close()
+	base.Cfg.Global.JetStream.StoragePath = config.Path(t.TempDir())
+	js, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	topic := base.Cfg.Global.JetStream.Prefixed(jetstream.OutputSyncUpdate)
+
+	notifiers := make([]*notifier.Notifier, 2)
+	syncStreams := make([]*streams.Streams, 2)
+	for i := range notifiers {
+		notifiers[i] = notifier.NewNotifier()
+		syncStreams[i] = newStreams()
+		if err := NewReplicator(js, topic, notifiers[i], syncStreams[i]).Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var joinEvent gomatrixserverlib.HeaderedEvent
+	if err := json.Unmarshal([]byte(`{
+		"_room_version": "1",
+		"type": "m.room.member",
+		"state_key": "@bob:localhost",
+		"content": {"membership": "join"},
+		"sender": "@bob:localhost",
+		"room_id": "!test:localhost",
+		"origin": "localhost",
+		"origin_server_ts": 12345,
+		"event_id": "$bobJoinEvent:localhost"
+	}`), &joinEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	// The join should wake bob up on the other instance, and let it know
+	// that bob is in the room.
+	done := make(chan types.StreamingToken)
+	go func() {
+		done <- waitForPosition(t, notifiers[1], "@bob:localhost", "bobdevice", types.StreamingToken{})
+	}()
+	time.Sleep(time.Millisecond * 100)
+	notifiers[0].OnNewEvent(&joinEvent, "", nil, types.StreamingToken{PDUPosition: 5})
+	if pos := <-done; pos.PDUPosition != 5 {
+		t.Fatalf("expected PDU position 5, got %s", pos.String())
+	}
+	if got := syncStreams[1].PDUStreamProvider.LatestPosition(ctx); got != 5 {
+		t.Fatalf("expected the PDU stream to be advanced to 5, got %d", got)
+	}
+	if users := notifiers[1].JoinedUsers("!test:localhost"); len(users) != 1 || users[0] != "@bob:localhost" {
+		t.Fatalf("expected bob to be joined on the other instance, got %v", users)
+	}
+
+	// Updates go both ways.
+	go func() {
+		done <- waitForPosition(t, notifiers[0], "@bob:localhost", "bobdevice", types.StreamingToken{PDUPosition: 5})
+	}()
+	time.Sleep(time.Millisecond * 100)
+	notifiers[1].OnNewAccountData("@bob:localhost", types.StreamingToken{AccountDataPosition: 3})
+	if pos := <-done; pos.AccountDataPosition != 3 {
+		t.Fatalf("expected account data position 3, got %s", pos.String())
+	}
+	if got := syncStreams[0].AccountDataStreamProvider.LatestPosition(ctx); got != 3 {
+		t.Fatalf("expected the account data stream to be advanced to 3, got %d", got)
+	}
+	// The instance which sent the update doesn't apply it again.
+	if got := syncStreams[1].AccountDataStreamProvider.LatestPosition(ctx); got != 0 {
+		t.Fatalf("expected the update not to be applied by its sender, got %d", got)
+	}
+}
+
+func TestCampaign(t *testing.T) {
+	base, close := testrig.CreateBaseDendrite(t, test.DBTypeSQLite)
+	defer close()
+	base.Cfg.Global.JetStream.StoragePath = config.Path(t.TempDir())
+	js, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	bucket := base.Cfg.Global.JetStream.Prefixed("SyncAPILeaderTest")
+	lease := time.Millisecond * 600
+
+	var elected [2]int32
+	cancels := make([]context.CancelFunc, 2)
+	for i := range cancels {
+		i := i
+		var ctx context.Context
+		ctx, cancels[i] = context.WithCancel(context.Background())
+		defer cancels[i]()
+		err := Campaign(ctx, js, bucket, "instance"+string(rune('A'+i)), lease,
+			func() { atomic.StoreInt32(&elected[i], 1) },
+			func() { t.Errorf("instance %d was deposed", i) },
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			waitFor(t, func() bool { return atomic.LoadInt32(&elected[0]) == 1 })
+		}
+	}
+
+	// The first instance keeps renewing its lease, so the second one isn't
+	// elected until the first one gives it up.
+	time.Sleep(lease * 2)
+	if atomic.LoadInt32(&elected[1]) == 1 {
+		t.Fatalf("expected only one instance to be elected")
+	}
+	cancels[0]()
+	waitFor(t, func() bool { return atomic.LoadInt32(&elected[1]) == 1 })
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); {
+		if f() {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("timed out")
+}
@@ -0,0 +1,396 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	rstypes "github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/syncapi/rebuild"
+	"github.com/matrix-org/dendrite/syncapi/replication"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// streamPositions is a types.StreamingToken broken out into its components.
+type streamPositions struct {
+	Token            string               `json:"token"`
+	PDU              types.StreamPosition `json:"pdu"`
+	Typing           types.StreamPosition `json:"typing"`
+	Receipt          types.StreamPosition `json:"receipt"`
+	SendToDevice     types.StreamPosition `json:"send_to_device"`
+	Invite           types.StreamPosition `json:"invite"`
+	AccountData      types.StreamPosition `json:"account_data"`
+	DeviceList       types.StreamPosition `json:"device_list"`
+	NotificationData types.StreamPosition `json:"notification_data"`
+	Presence         types.StreamPosition `json:"presence"`
+}
+
+func newStreamPositions(t types.StreamingToken) *streamPositions {
+	return &streamPositions{
+		Token:            t.String(),
+		PDU:              t.PDUPosition,
+		Typing:           t.TypingPosition,
+		Receipt:          t.ReceiptPosition,
+		SendToDevice:     t.SendToDevicePosition,
+		Invite:           t.InvitePosition,
+		AccountData:      t.AccountDataPosition,
+		DeviceList:       t.DeviceListPosition,
+		NotificationData: t.NotificationDataPosition,
+		Presence:         t.PresencePosition,
+	}
+}
+
+type adminSyncStateResponse struct {
+	CurrentPosition *streamPositions `json:"current_position"`
+	// LastSince is the since token of the last /sync request that the device
+	// made, if it has synced since the sync API was started.
+	LastSince       *streamPositions            `json:"last_since,omitempty"`
+	LastSyncTS      gomatrixserverlib.Timestamp `json:"last_sync_ts,omitempty"`
+	PendingToDevice int                         `json:"pending_to_device"`
+	ResyncPending   bool                        `json:"resync_pending"`
+}
+
+type adminForceResyncRequest struct {
+	InvalidateFilters bool `json:"invalidate_filters"`
+}
+
+// notElected is returned by the admin endpoints which write to the sync API
+// database when this instance isn't the one elected to write to it.
+func notElected() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusServiceUnavailable,
+		JSON: jsonerror.Unknown("This sync API instance isn't elected to write to the database, try another instance."),
+	}
+}
+
+// adminLocalUser checks that the request was made by an admin and returns the
+// user and device IDs from the path, which must be for a local user.
+func adminLocalUser(req *http.Request, device *userapi.Device, cfg *config.SyncAPI) (localpart, userID, deviceID string, resErr *util.JSONResponse) {
+	if device.AccountType != userapi.AccountTypeAdmin {
+		return "", "", "", &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This API can only be used by admin users."),
+		}
+	}
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		errRes := util.ErrorResponse(err)
+		return "", "", "", &errRes
+	}
+	userID, deviceID = vars["userID"], vars["deviceID"]
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return "", "", "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Invalid user ID."),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return "", "", "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("User ID must belong to this server."),
+		}
+	}
+	return localpart, userID, deviceID, nil
+}
+
+// AdminSyncState implements GET /_dendrite/admin/syncState/{userID}/{deviceID}
+func AdminSyncState(
+	req *http.Request, device *userapi.Device, srp *sync.RequestPool, syncDB storage.Database, cfg *config.SyncAPI,
+) util.JSONResponse {
+	_, userID, deviceID, resErr := adminLocalUser(req, device, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+
+	resyncPending, err := srp.ResyncPending(req.Context(), userID, deviceID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("srp.ResyncPending failed")
+		return jsonerror.InternalServerError()
+	}
+	current := srp.Notifier.CurrentPosition()
+	res := adminSyncStateResponse{
+		CurrentPosition: newStreamPositions(current),
+		ResyncPending:   resyncPending,
+	}
+
+	// Send-to-device messages are only cleaned up when the device syncs
+	// again, so anything up to the last since token has been delivered.
+	var from types.StreamPosition
+	if last, ok := srp.LastSync(userID, deviceID); ok {
+		res.LastSince = newStreamPositions(last.Since)
+		res.LastSyncTS = gomatrixserverlib.AsTimestamp(last.Time)
+		from = last.Since.SendToDevicePosition
+	}
+	_, events, err := syncDB.SendToDeviceUpdatesForSync(req.Context(), userID, deviceID, from, current.SendToDevicePosition)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.SendToDeviceUpdatesForSync failed")
+		return jsonerror.InternalServerError()
+	}
+	res.PendingToDevice = len(events)
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminForceResync implements POST /_dendrite/admin/resync/{userID}/{deviceID}
+func AdminForceResync(
+	req *http.Request, device *userapi.Device, srp *sync.RequestPool, syncDB storage.Database, cfg *config.SyncAPI,
+) util.JSONResponse {
+	localpart, userID, deviceID, resErr := adminLocalUser(req, device, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	var r adminForceResyncRequest
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+	}
+
+	if r.InvalidateFilters {
+		if err := syncDB.DeleteFilters(req.Context(), localpart); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("syncDB.DeleteFilters failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	if err := srp.ForceResync(req.Context(), userID, deviceID); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("srp.ForceResync failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminRebuildRoomState implements POST /_dendrite/admin/rebuildRoomState/{roomID}
+func AdminRebuildRoomState(
+	req *http.Request, device *userapi.Device, srp *sync.RequestPool, syncDB storage.Database, rsAPI roomserverAPI.SyncRoomserverAPI,
+	election *replication.Election,
+) util.JSONResponse {
+	if device.AccountType != userapi.AccountTypeAdmin {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This API can only be used by admin users."),
+		}
+	}
+	elected := election.Elected()
+	if elected == nil {
+		return notElected()
+	}
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	roomID := vars["roomID"]
+
+	stateRes := &roomserverAPI.QueryLatestEventsAndStateResponse{}
+	if err = rsAPI.QueryLatestEventsAndState(req.Context(), &roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+	}, stateRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryLatestEventsAndState failed")
+		return jsonerror.InternalServerError()
+	}
+	if !stateRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The room does not exist."),
+		}
+	}
+
+	if err = rebuildRoomState(req, elected, srp, syncDB, roomID, stateRes.StateEvents); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rebuildRoomState failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"state_events": len(stateRes.StateEvents),
+		},
+	}
+}
+
+// AdminCheckSyncAPIRoom implements /_dendrite/admin/fsckSyncAPI/{roomID}. The
+// current state of the room in the sync API is compared to the roomserver, and
+// a POST with a "repair" body also rebuilds it if they don't match. The events
+// and state in the roomserver are checked by /_dendrite/admin/fsck/{roomID}.
+func AdminCheckSyncAPIRoom(
+	req *http.Request, device *userapi.Device, srp *sync.RequestPool, syncDB storage.Database, rsAPI roomserverAPI.SyncRoomserverAPI,
+	election *replication.Election,
+) util.JSONResponse {
+	if device.AccountType != userapi.AccountTypeAdmin {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This API can only be used by admin users."),
+		}
+	}
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	var body struct {
+		Repair bool `json:"repair"`
+	}
+	if req.Method == http.MethodPost && req.ContentLength != 0 {
+		if err = json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+	}
+	roomID := vars["roomID"]
+	elected := election.Elected()
+	if body.Repair && elected == nil {
+		return notElected()
+	}
+
+	stateRes := &roomserverAPI.QueryLatestEventsAndStateResponse{}
+	if err = rsAPI.QueryLatestEventsAndState(req.Context(), &roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+	}, stateRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryLatestEventsAndState failed")
+		return jsonerror.InternalServerError()
+	}
+	if !stateRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The room does not exist."),
+		}
+	}
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	syncState, err := syncDB.CurrentState(req.Context(), roomID, &stateFilter, nil)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.CurrentState failed")
+		return jsonerror.InternalServerError()
+	}
+	roomserverEventIDs := make([]string, len(stateRes.StateEvents))
+	for i, ev := range stateRes.StateEvents {
+		roomserverEventIDs[i] = ev.EventID()
+	}
+	syncEventIDs := make([]string, len(syncState))
+	for i, ev := range syncState {
+		syncEventIDs[i] = ev.EventID()
+	}
+	report := &rstypes.RoomCheckReport{RoomID: roomID}
+	if !report.CheckSyncAPIState(roomserverEventIDs, syncEventIDs) && body.Repair {
+		if err = rebuildRoomState(req, elected, srp, syncDB, roomID, stateRes.StateEvents); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rebuildRoomState failed")
+			return jsonerror.InternalServerError()
+		}
+		for i := range report.Problems {
+			report.Problems[i].Repaired = true
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: report,
+	}
+}
+
+// AdminRebuildSyncAPI implements /_dendrite/admin/rebuildSyncAPI. A GET returns
+// the progress of the current or last rebuild, and a POST starts a new one on
+// the elected instance, which stops if the instance stops being elected.
+func AdminRebuildSyncAPI(
+	req *http.Request, device *userapi.Device, rebuilder *rebuild.Rebuilder, election *replication.Election,
+) util.JSONResponse {
+	if device.AccountType != userapi.AccountTypeAdmin {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This API can only be used by admin users."),
+		}
+	}
+	if req.Method == http.MethodGet {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: rebuilder.Status(),
+		}
+	}
+
+	elected := election.Elected()
+	if elected == nil {
+		return notElected()
+	}
+
+	var opts rebuild.Options
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&opts); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+	}
+	if err := rebuilder.Start(elected.Context(), opts); err == rebuild.ErrRunning {
+		return util.JSONResponse{
+			Code: http.StatusConflict,
+			JSON: jsonerror.Unknown(err.Error()),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rebuilder.Start failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusAccepted,
+		JSON: rebuilder.Status(),
+	}
+}
+
+// rebuildRoomState replaces the current state of the room in the sync API with
+// the state from the roomserver. The write is made with the context of the
+// elected instance, so that it is abandoned if the instance stops being
+// elected.
+func rebuildRoomState(
+	req *http.Request, elected *process.ProcessContext, srp *sync.RequestPool, syncDB storage.Database,
+	roomID string, stateEvents []*gomatrixserverlib.HeaderedEvent,
+) error {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-elected.Context().Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := syncDB.RebuildRoomState(ctx, roomID, stateEvents); err != nil {
+		return fmt.Errorf("syncDB.RebuildRoomState: %w", err)
+	}
+	return srp.Notifier.LoadRooms(ctx, syncDB, []string{roomID})
+}
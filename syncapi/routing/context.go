@@ -25,12 +25,14 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/caching"
 	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 type ContextRespsonse struct {
@@ -156,12 +158,23 @@ func Context(
 		response.End = end.String()
 		response.Start = start.String()
 	}
+	eventFields, eventFormat := parseEventFormat(req)
+	res, err := internal.FormatEvents(ctx, response, contextEventPaths, eventFields, eventFormat, syncDB.Events)
+	if err != nil {
+		logrus.WithError(err).Error("unable to format events")
+		return jsonerror.InternalServerError()
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: response,
+		JSON: res,
 	}
 }
 
+// contextEventPaths are the locations of events in a /context response.
+var contextEventPaths = [][]string{
+	{"event"}, {"events_before"}, {"events_after"}, {"state"},
+}
+
 func getStartEnd(ctx context.Context, syncDB storage.Database, startEvents, endEvents []*gomatrixserverlib.HeaderedEvent) (start, end types.TopologyToken, err error) {
 	if len(startEvents) > 0 {
 		start, err = syncDB.EventPositionInTopology(ctx, startEvents[0].EventID())
@@ -238,3 +251,18 @@ func parseRoomEventFilter(req *http.Request) (*gomatrixserverlib.RoomEventFilter
 
 	return filter, nil
 }
+
+// parseEventFormat returns the event_fields and event_format options from
+// the filter in the request, if any. These aren't part of a RoomEventFilter
+// but we honour them so that clients get the same events from /messages and
+// /context as they do from /sync.
+func parseEventFormat(req *http.Request) (eventFields []string, eventFormat string) {
+	f := req.URL.Query().Get("filter")
+	if f == "" {
+		return nil, ""
+	}
+	for _, field := range gjson.Get(f, "event_fields").Array() {
+		eventFields = append(eventFields, field.Str)
+	}
+	return eventFields, gjson.Get(f, "event_format").Str
+}
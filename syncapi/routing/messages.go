@@ -28,6 +28,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -171,8 +172,6 @@ func OnIncomingMessagesRequest(
 		wasToProvided = false
 	}
 
-	// TODO: Implement filtering (#587)
-
 	// Check the room ID's format.
 	if _, _, err = gomatrixserverlib.SplitID('!', roomID); err != nil {
 		return util.JSONResponse{
@@ -227,12 +226,23 @@ func OnIncomingMessagesRequest(
 	}
 
 	// Respond with the events.
+	eventFields, eventFormat := parseEventFormat(req)
+	formatted, err := internal.FormatEvents(req.Context(), res, messagesEventPaths, eventFields, eventFormat, db.Events)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("internal.FormatEvents failed")
+		return jsonerror.InternalServerError()
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: res,
+		JSON: formatted,
 	}
 }
 
+// messagesEventPaths are the locations of events in a /messages response.
+var messagesEventPaths = [][]string{
+	{"chunk"}, {"state"},
+}
+
 // applyLazyLoadMembers loads membership events for users returned in Chunk, if the filter has
 // LazyLoadMembers enabled.
 func (m *messagesResp) applyLazyLoadMembers(
@@ -480,6 +490,7 @@ func (r *messagesReq) handleEmptyEventsSlice() (
 		if err != nil {
 			return
 		}
+		events = r.filterBackfilledEvents(events)
 	} else {
 		// If not, it means the slice was empty because we reached the room's
 		// creation, so return an empty slice.
@@ -529,6 +540,7 @@ func (r *messagesReq) handleNonEmptyEventsSlice(streamEvents []types.StreamEvent
 		if err != nil {
 			return
 		}
+		pdus = r.filterBackfilledEvents(pdus)
 
 		// Append the PDUs to the list to send back to the client.
 		events = append(events, pdus...)
@@ -541,6 +553,18 @@ func (r *messagesReq) handleNonEmptyEventsSlice(streamEvents []types.StreamEvent
 	return
 }
 
+// filterBackfilledEvents applies the request filter to events which came
+// from a remote server, since they didn't go through the database filters.
+func (r *messagesReq) filterBackfilledEvents(events []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.HeaderedEvent {
+	filtered := events[:0]
+	for _, ev := range events {
+		if types.RoomEventAllowed(r.filter, ev) {
+			filtered = append(filtered, ev)
+		}
+	}
+	return filtered
+}
+
 type eventsByDepth []*gomatrixserverlib.HeaderedEvent
 
 func (e eventsByDepth) Len() int {
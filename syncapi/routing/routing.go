@@ -18,10 +18,13 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/rebuild"
+	"github.com/matrix-org/dendrite/syncapi/replication"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -35,19 +38,28 @@ import (
 // applied:
 // nolint: gocyclo
 func Setup(
-	csMux *mux.Router, srp *sync.RequestPool, syncDB storage.Database,
+	csMux, fedMux, dendriteAdminRouter *mux.Router, srp *sync.RequestPool, syncDB storage.Database,
 	userAPI userapi.SyncUserAPI,
 	rsAPI api.SyncRoomserverAPI,
+	fsAPI federationAPI.SyncFederationAPI,
 	cfg *config.SyncAPI,
 	lazyLoadCache caching.LazyLoadCache,
+	rebuilder *rebuild.Rebuilder,
+	election *replication.Election,
 ) {
 	v3mux := csMux.PathPrefix("/{apiversion:(?:r0|v3)}/").Subrouter()
+	v1mux := csMux.PathPrefix("/{apiversion:(?:v1|unstable/org.matrix.msc3030)}/").Subrouter()
+	v1fedmux := fedMux.PathPrefix("/{apiversion:(?:v1|unstable/org.matrix.msc3030)}/").Subrouter()
 
 	// TODO: Add AS support for all handlers below.
 	v3mux.Handle("/sync", httputil.MakeAuthAPI("sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		return srp.OnIncomingSyncRequest(req, device)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
+	csMux.Handle("/unstable/org.matrix.msc3575/sync", httputil.MakeAuthAPI("sliding_sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return srp.OnIncomingSlidingSyncRequest(req, device)
+	})).Methods(http.MethodPost, http.MethodOptions)
+
 	v3mux.Handle("/rooms/{roomID}/messages", httputil.MakeAuthAPI("room_messages", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
@@ -56,6 +68,22 @@ func Setup(
 		return OnIncomingMessagesRequest(req, syncDB, vars["roomID"], device, rsAPI, cfg, srp, lazyLoadCache)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
+	v3mux.Handle("/initialSync", httputil.MakeAuthAPI("initial_sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return srp.OnIncomingInitialSyncRequest(req, device)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	v3mux.Handle("/rooms/{roomID}/initialSync", httputil.MakeAuthAPI("rooms_initial_sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return srp.OnIncomingRoomInitialSyncRequest(req, device, vars["roomID"])
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	v3mux.Handle("/events", httputil.MakeAuthAPI("events", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return srp.OnIncomingEventsRequest(req, device)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
 	v3mux.Handle("/user/{userId}/filter",
 		httputil.MakeAuthAPI("put_filter", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -95,4 +123,50 @@ func Setup(
 			)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
+
+	v1mux.Handle("/rooms/{roomID}/timestamp_to_event",
+		httputil.MakeAuthAPI("timestamp_to_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return TimestampToEvent(req, device, rsAPI, fsAPI, syncDB, cfg, vars["roomID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v1fedmux.Handle("/timestamp_to_event/{roomID}",
+		httputil.MakeFedAPI("federation_timestamp_to_event", cfg.Matrix.ServerName, fsAPI.KeyRing(), nil, func(req *http.Request, fedReq *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			return FederationTimestampToEvent(req, fedReq, syncDB, vars["roomID"])
+		}),
+	).Methods(http.MethodGet)
+
+	dendriteAdminRouter.Handle("/admin/syncState/{userID}/{deviceID}",
+		httputil.MakeAuthAPI("admin_sync_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminSyncState(req, device, srp, syncDB, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/resync/{userID}/{deviceID}",
+		httputil.MakeAuthAPI("admin_force_resync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminForceResync(req, device, srp, syncDB, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rebuildRoomState/{roomID}",
+		httputil.MakeAuthAPI("admin_rebuild_room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminRebuildRoomState(req, device, srp, syncDB, rsAPI, election)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/fsckSyncAPI/{roomID}",
+		httputil.MakeAuthAPI("admin_check_sync_api_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminCheckSyncAPIRoom(req, device, srp, syncDB, rsAPI, election)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rebuildSyncAPI",
+		httputil.MakeAuthAPI("admin_rebuild_sync_api", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminRebuildSyncAPI(req, device, rebuilder, election)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 }
@@ -0,0 +1,348 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	directionForward  = "f"
+	directionBackward = "b"
+)
+
+// parseTimestampToEventRequest parses the "ts" and "dir" query parameters of
+// a /timestamp_to_event request.
+func parseTimestampToEventRequest(req *http.Request) (gomatrixserverlib.Timestamp, string, *util.JSONResponse) {
+	tsStr := req.URL.Query().Get("ts")
+	if tsStr == "" {
+		return 0, "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("Missing ts query parameter"),
+		}
+	}
+	ts, err := strconv.ParseUint(tsStr, 10, 64)
+	if err != nil {
+		return 0, "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("ts must be a timestamp in milliseconds"),
+		}
+	}
+	dir := req.URL.Query().Get("dir")
+	if dir != directionForward && dir != directionBackward {
+		return 0, "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("dir must be one of 'f' or 'b'"),
+		}
+	}
+	return gomatrixserverlib.Timestamp(ts), dir, nil
+}
+
+// TimestampToEvent implements GET /rooms/{roomID}/timestamp_to_event, which returns
+// the event closest to the given timestamp in the given direction. If the local DAG
+// doesn't cover the requested time, other servers in the room are asked, and the
+// event they return is backfilled so that it can be used with /context and /messages.
+func TimestampToEvent(
+	req *http.Request, device *userapi.Device,
+	rsAPI roomserver.SyncRoomserverAPI,
+	fsAPI federationAPI.SyncFederationAPI,
+	syncDB storage.Database,
+	cfg *config.SyncAPI,
+	roomID string,
+) util.JSONResponse {
+	ts, dir, errRes := parseTimestampToEventRequest(req)
+	if errRes != nil {
+		return *errRes
+	}
+
+	ctx := req.Context()
+	membershipRes := roomserver.QueryMembershipForUserResponse{}
+	membershipReq := roomserver.QueryMembershipForUserRequest{UserID: device.UserID, RoomID: roomID}
+	if err := rsAPI.QueryMembershipForUser(ctx, &membershipReq, &membershipRes); err != nil {
+		logrus.WithError(err).Error("unable to query membership")
+		return jsonerror.InternalServerError()
+	}
+	if !membershipRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("room does not exist"),
+		}
+	}
+	if membershipRes.Membership != gomatrixserverlib.Join {
+		worldReadable, err := isWorldReadable(ctx, syncDB, roomID)
+		if err != nil {
+			logrus.WithError(err).Error("unable to get history visibility")
+			return jsonerror.InternalServerError()
+		}
+		if !worldReadable {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("User is not allowed to query events in this room"),
+			}
+		}
+	}
+
+	eventID, eventTS, err := syncDB.EventIDAtTimestamp(ctx, roomID, ts, dir == directionForward)
+	found := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		logrus.WithError(err).WithField("room_id", roomID).Error("unable to find event at timestamp")
+		return jsonerror.InternalServerError()
+	}
+
+	// If we don't know of any event in the requested direction, or the event we found
+	// is next to a gap in our copy of the DAG, there may be a closer event which we
+	// haven't backfilled yet, so ask the other servers in the room.
+	askFederation := !found
+	if found {
+		backwardExtremities, err := syncDB.BackwardExtremitiesForRoom(ctx, roomID)
+		if err != nil {
+			logrus.WithError(err).WithField("room_id", roomID).Error("unable to get backward extremities")
+			return jsonerror.InternalServerError()
+		}
+		_, askFederation = backwardExtremities[eventID]
+	}
+	if askFederation {
+		if res, ok := timestampToEventFromFederation(ctx, fsAPI, roomID, ts, dir); ok {
+			if !found || closerToTimestamp(ts, res.OriginServerTS, eventTS) {
+				// Only use the event if we have it, otherwise clients can't do
+				// anything with it.
+				if err = backfillEvent(ctx, rsAPI, syncDB, cfg.Matrix.ServerName, roomID, res.EventID); err != nil {
+					logrus.WithError(err).WithFields(logrus.Fields{
+						"room_id":  roomID,
+						"event_id": res.EventID,
+					}).Warn("unable to backfill event at timestamp")
+				} else {
+					eventID, eventTS, found = res.EventID, res.OriginServerTS, true
+				}
+			}
+		}
+	}
+
+	if !found {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Unable to find event from %d in direction %s", ts, dir)),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: federationAPI.RespTimestampToEvent{
+			EventID:        eventID,
+			OriginServerTS: eventTS,
+		},
+	}
+}
+
+// FederationTimestampToEvent implements GET /_matrix/federation/v1/timestamp_to_event/{roomID}
+// for remote servers. Only events we have locally are considered.
+func FederationTimestampToEvent(
+	req *http.Request, fedReq *gomatrixserverlib.FederationRequest,
+	syncDB storage.Database,
+	roomID string,
+) util.JSONResponse {
+	ts, dir, errRes := parseTimestampToEventRequest(req)
+	if errRes != nil {
+		return *errRes
+	}
+
+	ctx := req.Context()
+	joined, err := syncDB.AllJoinedUsersInRoom(ctx, []string{roomID})
+	if err != nil {
+		logrus.WithError(err).Error("unable to get joined users")
+		return jsonerror.InternalServerError()
+	}
+	if !serverInRoom(fedReq.Origin(), joined[roomID]) {
+		worldReadable, err := isWorldReadable(ctx, syncDB, roomID)
+		if err != nil {
+			logrus.WithError(err).Error("unable to get history visibility")
+			return jsonerror.InternalServerError()
+		}
+		if !worldReadable {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("Server is not in the room"),
+			}
+		}
+	}
+
+	eventID, eventTS, err := syncDB.EventIDAtTimestamp(ctx, roomID, ts, dir == directionForward)
+	switch {
+	case err == sql.ErrNoRows:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Unable to find event from %d in direction %s", ts, dir)),
+		}
+	case err != nil:
+		logrus.WithError(err).WithField("room_id", roomID).Error("unable to find event at timestamp")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: federationAPI.RespTimestampToEvent{
+			EventID:        eventID,
+			OriginServerTS: eventTS,
+		},
+	}
+}
+
+// timestampToEventFromFederation asks the servers in the room for the event closest
+// to the given timestamp, returning the first successful answer.
+func timestampToEventFromFederation(
+	ctx context.Context, fsAPI federationAPI.SyncFederationAPI,
+	roomID string, ts gomatrixserverlib.Timestamp, dir string,
+) (federationAPI.RespTimestampToEvent, bool) {
+	serversReq := federationAPI.QueryJoinedHostServerNamesInRoomRequest{RoomID: roomID, ExcludeSelf: true}
+	serversRes := federationAPI.QueryJoinedHostServerNamesInRoomResponse{}
+	if err := fsAPI.QueryJoinedHostServerNamesInRoom(ctx, &serversReq, &serversRes); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Error("unable to query joined servers")
+		return federationAPI.RespTimestampToEvent{}, false
+	}
+	for _, serverName := range serversRes.ServerNames {
+		res, err := fsAPI.TimestampToEvent(ctx, serverName, roomID, ts, dir)
+		if err != nil {
+			logrus.WithError(err).WithField("server_name", serverName).Debug("failed to get event at timestamp over federation")
+			continue
+		}
+		return res, true
+	}
+	return federationAPI.RespTimestampToEvent{}, false
+}
+
+// backfillEvent makes sure that we have the given event, by backfilling from it
+// through the roomserver if we don't, and storing the backfilled events in the
+// same way as /messages does.
+func backfillEvent(
+	ctx context.Context, rsAPI roomserver.SyncRoomserverAPI, syncDB storage.Database,
+	serverName gomatrixserverlib.ServerName, roomID, eventID string,
+) error {
+	events, err := syncDB.Events(ctx, []string{eventID})
+	if err != nil {
+		return fmt.Errorf("syncDB.Events: %w", err)
+	}
+	if len(events) > 0 {
+		return nil
+	}
+	var res roomserver.PerformBackfillResponse
+	if err = rsAPI.PerformBackfill(ctx, &roomserver.PerformBackfillRequest{
+		RoomID: roomID,
+		// Backfilling from an event returns the event itself as well as the
+		// events before it.
+		BackwardsExtremities: map[string][]string{eventID: {eventID}},
+		Limit:                1,
+		ServerName:           serverName,
+	}, &res); err != nil {
+		return fmt.Errorf("rsAPI.PerformBackfill: %w", err)
+	}
+	// Store the events lowest depth first, see messagesReq.backfill.
+	sort.Sort(eventsByDepth(res.Events))
+	backfilled := false
+	for _, ev := range res.Events {
+		hisVis, err := historyVisibilityAt(ctx, rsAPI, ev)
+		if err != nil {
+			return err
+		}
+		if _, err = syncDB.WriteEvent(
+			ctx, ev, []*gomatrixserverlib.HeaderedEvent{}, []string{}, []string{},
+			nil, true, hisVis,
+		); err != nil {
+			return fmt.Errorf("syncDB.WriteEvent: %w", err)
+		}
+		backfilled = backfilled || ev.EventID() == eventID
+	}
+	if !backfilled {
+		return fmt.Errorf("event was not backfilled")
+	}
+	return nil
+}
+
+// historyVisibilityAt asks the roomserver for the history visibility of the
+// room before the event, in the same way as the roomserver works it out for
+// new events. If the state before the event isn't known then the most
+// restrictive visibility is used.
+func historyVisibilityAt(
+	ctx context.Context, rsAPI roomserver.SyncRoomserverAPI, ev *gomatrixserverlib.HeaderedEvent,
+) (gomatrixserverlib.HistoryVisibility, error) {
+	hisVis := gomatrixserverlib.HistoryVisibilityJoined
+	if len(ev.PrevEventIDs()) == 0 {
+		return hisVis, nil
+	}
+	var res roomserver.QueryStateAfterEventsResponse
+	if err := rsAPI.QueryStateAfterEvents(ctx, &roomserver.QueryStateAfterEventsRequest{
+		RoomID:       ev.RoomID(),
+		PrevEventIDs: ev.PrevEventIDs(),
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+		},
+	}, &res); err != nil {
+		return "", fmt.Errorf("rsAPI.QueryStateAfterEvents: %w", err)
+	}
+	for _, stateEv := range res.StateEvents {
+		if !stateEv.StateKeyEquals("") || stateEv.Type() != gomatrixserverlib.MRoomHistoryVisibility {
+			continue
+		}
+		if v, err := stateEv.HistoryVisibility(); err == nil {
+			hisVis = v
+		}
+	}
+	return hisVis, nil
+}
+
+// closerToTimestamp returns true if candidate is closer to ts than current.
+func closerToTimestamp(ts, candidate, current gomatrixserverlib.Timestamp) bool {
+	distance := func(a, b gomatrixserverlib.Timestamp) gomatrixserverlib.Timestamp {
+		if a > b {
+			return a - b
+		}
+		return b - a
+	}
+	return distance(ts, candidate) < distance(ts, current)
+}
+
+func isWorldReadable(ctx context.Context, syncDB storage.Database, roomID string) (bool, error) {
+	ev, err := syncDB.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomHistoryVisibility, "")
+	if err != nil || ev == nil {
+		return false, err
+	}
+	hisVis, err := ev.HistoryVisibility()
+	if err != nil {
+		return false, nil
+	}
+	return hisVis == gomatrixserverlib.WorldReadable, nil
+}
+
+func serverInRoom(serverName gomatrixserverlib.ServerName, userIDs []string) bool {
+	for _, userID := range userIDs {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err == nil && domain == serverName {
+			return true
+		}
+	}
+	return false
+}
@@ -40,6 +40,8 @@ type Database interface {
 	GetStateDeltasForFullStateSync(ctx context.Context, device *userapi.Device, r types.Range, userID string, stateFilter *gomatrixserverlib.StateFilter) ([]types.StateDelta, []string, error)
 	GetStateDeltas(ctx context.Context, device *userapi.Device, r types.Range, userID string, stateFilter *gomatrixserverlib.StateFilter) ([]types.StateDelta, []string, error)
 	RoomIDsWithMembership(ctx context.Context, userID string, membership string) ([]string, error)
+	// MaxStreamPositionsForRooms returns the stream position of the latest event in each of the given rooms.
+	MaxStreamPositionsForRooms(ctx context.Context, roomIDs []string) (map[string]types.StreamPosition, error)
 	MembershipCount(ctx context.Context, roomID, membership string, pos types.StreamPosition) (int, error)
 	GetRoomHeroes(ctx context.Context, roomID, userID string, memberships []string) ([]string, error)
 
@@ -75,6 +77,11 @@ type Database interface {
 	// PurgeRoomState completely purges room state from the sync API. This is done when
 	// receiving an output event that completely resets the state.
 	PurgeRoomState(ctx context.Context, roomID string) error
+	// RebuildRoomState replaces the current state of a room with the given state events,
+	// which would usually have been fetched from the roomserver. Any events which the
+	// sync API has not seen before are stored so that they can be served, but are not
+	// sent down /sync.
+	RebuildRoomState(ctx context.Context, roomID string, stateEvents []*gomatrixserverlib.HeaderedEvent) error
 	// GetStateEvent returns the Matrix state event of a given type for a given room with a given state key
 	// If no event could be found, returns nil
 	// If there was an issue during the retrieval, returns an error
@@ -118,6 +125,9 @@ type Database interface {
 	EventPositionInTopology(ctx context.Context, eventID string) (types.TopologyToken, error)
 	// BackwardExtremitiesForRoom returns a map of backwards extremity event ID to a list of its prev_events.
 	BackwardExtremitiesForRoom(ctx context.Context, roomID string) (backwardExtremities map[string][]string, err error)
+	// EventIDAtTimestamp returns the ID and timestamp of the event closest to the given timestamp in the
+	// given direction. Returns sql.ErrNoRows if we don't know of any such event.
+	EventIDAtTimestamp(ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp, forward bool) (string, gomatrixserverlib.Timestamp, error)
 	// MaxTopologicalPosition returns the highest topological position for a given room.
 	MaxTopologicalPosition(ctx context.Context, roomID string) (types.TopologyToken, error)
 	// StreamEventsToEvents converts streamEvent to Event. If device is non-nil and
@@ -135,20 +145,25 @@ type Database interface {
 	// GetFilter looks up the filter associated with a given local user and filter ID
 	// and populates the target filter. Otherwise returns an error if no such filter exists
 	// or if there was an error talking to the database.
-	GetFilter(ctx context.Context, target *gomatrixserverlib.Filter, localpart string, filterID string) error
+	GetFilter(ctx context.Context, target *types.Filter, localpart string, filterID string) error
 	// PutFilter puts the passed filter into the database.
 	// Returns the filterID as a string. Otherwise returns an error if something
 	// goes wrong.
-	PutFilter(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (string, error)
+	PutFilter(ctx context.Context, localpart string, filter *types.Filter) (string, error)
+	// DeleteFilters removes all of the filters for a local user, so that subsequent
+	// syncs using their old filter IDs fall back to the default filter.
+	DeleteFilters(ctx context.Context, localpart string) error
 	// RedactEvent wipes an event in the database and sets the unsigned.redacted_because key to the redaction event
 	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error
-	// StoreReceipt stores new receipt events
-	StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
+	// StoreReceipt stores new receipt events. The thread ID is empty for
+	// receipts which apply to the whole room.
+	StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId, threadID string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
 	// GetRoomReceipts gets all receipts for a given roomID
 	GetRoomReceipts(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) ([]types.OutputReceiptEvent, error)
 
-	// UpsertRoomUnreadNotificationCounts updates the notification statistics about a (user, room) key.
-	UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int) (types.StreamPosition, error)
+	// UpsertRoomUnreadNotificationCounts updates the notification statistics about a (user, room) key,
+	// including the statistics of each thread in the room.
+	UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int, threads map[string]eventutil.ThreadNotificationData) (types.StreamPosition, error)
 
 	// GetUserUnreadNotificationCounts returns statistics per room a user is interested in.
 	GetUserUnreadNotificationCounts(ctx context.Context, userID string, from, to types.StreamPosition) (map[string]*eventutil.NotificationData, error)
@@ -161,6 +176,28 @@ type Database interface {
 
 	IgnoresForUser(ctx context.Context, userID string) (*types.IgnoredUsers, error)
 	UpdateIgnoresForUser(ctx context.Context, userID string, ignores *types.IgnoredUsers) error
+
+	// GetRebuildProgress returns how far a room has got when rebuilding the sync API
+	// from the roomserver. The position is 0 if the room hasn't been started.
+	GetRebuildProgress(ctx context.Context, roomID string) (position int64, completed bool, err error)
+	// SetRebuildProgress records how far a room has got when rebuilding.
+	SetRebuildProgress(ctx context.Context, roomID string, position int64, completed bool) error
+	// ResetRebuildProgress forgets the progress of all rooms, so that the next
+	// rebuild starts from the beginning.
+	ResetRebuildProgress(ctx context.Context) error
+
+	// ForceResync makes the next /sync request from a device ignore its since
+	// token. ts is when the resync was forced.
+	ForceResync(ctx context.Context, userID, deviceID string, ts gomatrixserverlib.Timestamp) error
+	// ResyncPending returns true if the device has been forced to resync but
+	// hasn't synced since.
+	ResyncPending(ctx context.Context, userID, deviceID string) (bool, error)
+	// ConsumeForcedResync returns true, and forgets the resync, if the device
+	// has been forced to resync.
+	ConsumeForcedResync(ctx context.Context, userID, deviceID string) (bool, error)
+	// PruneForcedResyncs drops the resyncs which were forced before the given
+	// time, so that resyncs for devices which never sync again are not kept.
+	PruneForcedResyncs(ctx context.Context, before gomatrixserverlib.Timestamp) error
 }
 
 type Presence interface {
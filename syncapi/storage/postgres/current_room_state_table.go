@@ -136,10 +136,7 @@ func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, erro
 	}
 
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(sqlutil.Migration{
-		Version: "syncapi: add history visibility column (current_room_state)",
-		Up:      deltas.UpAddHistoryVisibilityColumnCurrentRoomState,
-	})
+	m.AddMigrations(deltas.AddHistoryVisibilityColumnCurrentRoomStateMigration)
 	err = m.Up(context.Background())
 	if err != nil {
 		return nil, err
@@ -0,0 +1,56 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpAddOriginServerTSColumnTopology(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		ALTER TABLE syncapi_output_room_events_topology ADD COLUMN IF NOT EXISTS origin_server_ts BIGINT NOT NULL DEFAULT 0;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	// Populate the timestamps of existing events from the events table, if we have one.
+	var exists bool
+	if err = tx.QueryRowContext(ctx, "SELECT to_regclass('syncapi_output_room_events') IS NOT NULL").Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check for events table: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE syncapi_output_room_events_topology AS t SET origin_server_ts = (e.headered_event_json::jsonb->>'origin_server_ts')::BIGINT
+			FROM syncapi_output_room_events AS e WHERE t.event_id = e.event_id;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddOriginServerTSColumnTopology(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		ALTER TABLE syncapi_output_room_events_topology DROP COLUMN IF EXISTS origin_server_ts;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
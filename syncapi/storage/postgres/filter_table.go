@@ -19,7 +19,9 @@ import (
 	"database/sql"
 	"encoding/json"
 
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -48,10 +50,14 @@ const selectFilterIDByContentSQL = "" +
 const insertFilterSQL = "" +
 	"INSERT INTO syncapi_filter (filter, id, localpart) VALUES ($1, DEFAULT, $2) RETURNING id"
 
+const deleteFiltersSQL = "" +
+	"DELETE FROM syncapi_filter WHERE localpart = $1"
+
 type filterStatements struct {
 	selectFilterStmt            *sql.Stmt
 	selectFilterIDByContentStmt *sql.Stmt
 	insertFilterStmt            *sql.Stmt
+	deleteFiltersStmt           *sql.Stmt
 }
 
 func NewPostgresFilterTable(db *sql.DB) (tables.Filter, error) {
@@ -69,11 +75,14 @@ func NewPostgresFilterTable(db *sql.DB) (tables.Filter, error) {
 	if s.insertFilterStmt, err = db.Prepare(insertFilterSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteFiltersStmt, err = db.Prepare(deleteFiltersSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
 func (s *filterStatements) SelectFilter(
-	ctx context.Context, target *gomatrixserverlib.Filter, localpart string, filterID string,
+	ctx context.Context, target *types.Filter, localpart string, filterID string,
 ) error {
 	// Retrieve filter from database (stored as canonical JSON)
 	var filterData []byte
@@ -90,7 +99,7 @@ func (s *filterStatements) SelectFilter(
 }
 
 func (s *filterStatements) InsertFilter(
-	ctx context.Context, filter *gomatrixserverlib.Filter, localpart string,
+	ctx context.Context, filter *types.Filter, localpart string,
 ) (filterID string, err error) {
 	var existingFilterID string
 
@@ -126,3 +135,10 @@ func (s *filterStatements) InsertFilter(
 		Scan(&filterID)
 	return
 }
+
+func (s *filterStatements) DeleteFilters(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteFiltersStmt).ExecContext(ctx, localpart)
+	return err
+}
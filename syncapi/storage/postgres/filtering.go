@@ -20,6 +20,11 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
+// likeEscaper escapes characters which LIKE would otherwise treat as
+// wildcards, so that only '*' in a filter acts as one. Backslash is the
+// default LIKE escape character in PostgreSQL.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 // filterConvertWildcardToSQL converts wildcards as defined in
 // https://matrix.org/docs/spec/client_server/r0.3.0.html#post-matrix-client-r0-user-userid-filter
 // to SQL wildcards that can be used with LIKE()
@@ -33,7 +38,7 @@ func filterConvertTypeWildcardToSQL(values *[]string) []string {
 	v := *values
 	ret := make([]string, len(v))
 	for i := range v {
-		ret[i] = strings.Replace(v[i], "*", "%", -1)
+		ret[i] = strings.Replace(likeEscaper.Replace(v[i]), "*", "%", -1)
 	}
 	return ret
 }
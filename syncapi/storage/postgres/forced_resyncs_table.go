@@ -0,0 +1,111 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const forcedResyncsSchema = `
+-- Devices which an admin has forced to do a complete sync the next time that
+-- they sync. These are stored in the database so that every sync API instance
+-- sees them, and so that they survive restarts.
+CREATE TABLE IF NOT EXISTS syncapi_forced_resyncs (
+	user_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	-- When the resync was forced, so that resyncs which are never picked up
+	-- can be dropped.
+	forced_ts BIGINT NOT NULL,
+	PRIMARY KEY (user_id, device_id)
+);
+`
+
+const upsertForcedResyncSQL = "" +
+	"INSERT INTO syncapi_forced_resyncs (user_id, device_id, forced_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (user_id, device_id) DO UPDATE SET forced_ts = $3"
+
+const selectForcedResyncSQL = "" +
+	"SELECT 1 FROM syncapi_forced_resyncs WHERE user_id = $1 AND device_id = $2"
+
+const deleteForcedResyncSQL = "" +
+	"DELETE FROM syncapi_forced_resyncs WHERE user_id = $1 AND device_id = $2"
+
+const deleteForcedResyncsBeforeSQL = "" +
+	"DELETE FROM syncapi_forced_resyncs WHERE forced_ts < $1"
+
+type forcedResyncsStatements struct {
+	upsertForcedResyncStmt        *sql.Stmt
+	selectForcedResyncStmt        *sql.Stmt
+	deleteForcedResyncStmt        *sql.Stmt
+	deleteForcedResyncsBeforeStmt *sql.Stmt
+}
+
+func NewPostgresForcedResyncsTable(db *sql.DB) (tables.ForcedResyncs, error) {
+	_, err := db.Exec(forcedResyncsSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &forcedResyncsStatements{}
+	return s, sqlutil.StatementList{
+		{&s.upsertForcedResyncStmt, upsertForcedResyncSQL},
+		{&s.selectForcedResyncStmt, selectForcedResyncSQL},
+		{&s.deleteForcedResyncStmt, deleteForcedResyncSQL},
+		{&s.deleteForcedResyncsBeforeStmt, deleteForcedResyncsBeforeSQL},
+	}.Prepare(db)
+}
+
+func (s *forcedResyncsStatements) UpsertForcedResync(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, ts gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertForcedResyncStmt).ExecContext(ctx, userID, deviceID, ts)
+	return err
+}
+
+func (s *forcedResyncsStatements) SelectForcedResync(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) (bool, error) {
+	var exists int
+	err := sqlutil.TxStmt(txn, s.selectForcedResyncStmt).QueryRowContext(ctx, userID, deviceID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *forcedResyncsStatements) DeleteForcedResync(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) (bool, error) {
+	result, err := sqlutil.TxStmt(txn, s.deleteForcedResyncStmt).ExecContext(ctx, userID, deviceID)
+	if err != nil {
+		return false, err
+	}
+	numAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return numAffected > 0, nil
+}
+
+func (s *forcedResyncsStatements) DeleteForcedResyncsBefore(
+	ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteForcedResyncsBeforeStmt).ExecContext(ctx, before)
+	return err
+}
@@ -17,10 +17,12 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/postgres/deltas"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 )
@@ -30,6 +32,11 @@ func NewPostgresNotificationDataTable(db *sql.DB) (tables.NotificationData, erro
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(deltas.AddNotificationDataThreadCountsMigration)
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	r := &notificationDataStatements{}
 	return r, sqlutil.StatementList{
 		{&r.upsertRoomUnreadCounts, upsertRoomUnreadNotificationCountsSQL},
@@ -51,18 +58,20 @@ CREATE TABLE IF NOT EXISTS syncapi_notification_data (
 	room_id TEXT NOT NULL,
 	notification_count BIGINT NOT NULL DEFAULT 0,
 	highlight_count BIGINT NOT NULL DEFAULT 0,
+	-- The JSON encoded counts of each thread, which are included in the counts above
+	thread_counts TEXT NOT NULL DEFAULT '{}',
 	CONSTRAINT syncapi_notification_data_unique UNIQUE (user_id, room_id)
 );`
 
 const upsertRoomUnreadNotificationCountsSQL = `INSERT INTO syncapi_notification_data
-  (user_id, room_id, notification_count, highlight_count)
-  VALUES ($1, $2, $3, $4)
+  (user_id, room_id, notification_count, highlight_count, thread_counts)
+  VALUES ($1, $2, $3, $4, $5)
   ON CONFLICT (user_id, room_id)
-  DO UPDATE SET id = nextval('syncapi_notification_data_id_seq'), notification_count = $3, highlight_count = $4
+  DO UPDATE SET id = nextval('syncapi_notification_data_id_seq'), notification_count = $3, highlight_count = $4, thread_counts = $5
   RETURNING id`
 
 const selectUserUnreadNotificationCountsSQL = `SELECT
-  id, room_id, notification_count, highlight_count
+  id, room_id, notification_count, highlight_count, thread_counts
   FROM syncapi_notification_data
   WHERE
     user_id = $1 AND
@@ -70,8 +79,14 @@ const selectUserUnreadNotificationCountsSQL = `SELECT
 
 const selectMaxNotificationIDSQL = `SELECT CASE COUNT(*) WHEN 0 THEN 0 ELSE MAX(id) END FROM syncapi_notification_data`
 
-func (r *notificationDataStatements) UpsertRoomUnreadCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int) (pos types.StreamPosition, err error) {
-	err = r.upsertRoomUnreadCounts.QueryRowContext(ctx, userID, roomID, notificationCount, highlightCount).Scan(&pos)
+func (r *notificationDataStatements) UpsertRoomUnreadCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int, threads map[string]eventutil.ThreadNotificationData) (pos types.StreamPosition, err error) {
+	threadCounts := []byte("{}")
+	if len(threads) > 0 {
+		if threadCounts, err = json.Marshal(threads); err != nil {
+			return
+		}
+	}
+	err = r.upsertRoomUnreadCounts.QueryRowContext(ctx, userID, roomID, notificationCount, highlightCount, string(threadCounts)).Scan(&pos)
 	return
 }
 
@@ -87,16 +102,21 @@ func (r *notificationDataStatements) SelectUserUnreadCounts(ctx context.Context,
 		var id types.StreamPosition
 		var roomID string
 		var notificationCount, highlightCount int
+		var threadCounts string
 
-		if err = rows.Scan(&id, &roomID, &notificationCount, &highlightCount); err != nil {
+		if err = rows.Scan(&id, &roomID, &notificationCount, &highlightCount, &threadCounts); err != nil {
 			return nil, err
 		}
 
-		roomCounts[roomID] = &eventutil.NotificationData{
+		data := &eventutil.NotificationData{
 			RoomID:                  roomID,
 			UnreadNotificationCount: notificationCount,
 			UnreadHighlightCount:    highlightCount,
 		}
+		if err = json.Unmarshal([]byte(threadCounts), &data.Threads); err != nil {
+			return nil, err
+		}
+		roomCounts[roomID] = data
 	}
 	return roomCounts, rows.Err()
 }
@@ -105,6 +105,7 @@ const selectRecentEventsSQL = "" +
 	" AND ( $5::text[] IS NULL OR NOT(sender  = ANY($5)) )" +
 	" AND ( $6::text[] IS NULL OR     type LIKE ANY($6)  )" +
 	" AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )" +
+	" AND ( $9::bool   IS NULL OR     contains_url = $9 )" +
 	" ORDER BY id DESC LIMIT $8"
 
 const selectRecentEventsForSyncSQL = "" +
@@ -114,6 +115,7 @@ const selectRecentEventsForSyncSQL = "" +
 	" AND ( $5::text[] IS NULL OR NOT(sender  = ANY($5)) )" +
 	" AND ( $6::text[] IS NULL OR     type LIKE ANY($6)  )" +
 	" AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )" +
+	" AND ( $9::bool   IS NULL OR     contains_url = $9 )" +
 	" ORDER BY id DESC LIMIT $8"
 
 const selectEarlyEventsSQL = "" +
@@ -123,11 +125,17 @@ const selectEarlyEventsSQL = "" +
 	" AND ( $5::text[] IS NULL OR NOT(sender  = ANY($5)) )" +
 	" AND ( $6::text[] IS NULL OR     type LIKE ANY($6)  )" +
 	" AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )" +
+	" AND ( $9::bool   IS NULL OR     contains_url = $9 )" +
 	" ORDER BY id ASC LIMIT $8"
 
 const selectMaxEventIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_output_room_events"
 
+const selectMaxStreamPositionsForRoomsSQL = "" +
+	"SELECT room_id, MAX(id) FROM syncapi_output_room_events" +
+	" WHERE room_id = ANY($1) AND exclude_from_sync = FALSE" +
+	" GROUP BY room_id"
+
 const updateEventJSONSQL = "" +
 	"UPDATE syncapi_output_room_events SET headered_event_json=$1 WHERE event_id=$2"
 
@@ -157,6 +165,7 @@ const selectContextBeforeEventSQL = "" +
 	" AND ( $5::text[] IS NULL OR NOT(sender  = ANY($5)) )" +
 	" AND ( $6::text[] IS NULL OR     type LIKE ANY($6)  )" +
 	" AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )" +
+	" AND ( $8::bool   IS NULL OR     contains_url = $8 )" +
 	" ORDER BY id DESC LIMIT $3"
 
 const selectContextAfterEventSQL = "" +
@@ -165,6 +174,7 @@ const selectContextAfterEventSQL = "" +
 	" AND ( $5::text[] IS NULL OR NOT(sender  = ANY($5)) )" +
 	" AND ( $6::text[] IS NULL OR     type LIKE ANY($6)  )" +
 	" AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )" +
+	" AND ( $8::bool   IS NULL OR     contains_url = $8 )" +
 	" ORDER BY id ASC LIMIT $3"
 
 type outputRoomEventsStatements struct {
@@ -172,6 +182,7 @@ type outputRoomEventsStatements struct {
 	selectEventsStmt              *sql.Stmt
 	selectEventsWitFilterStmt     *sql.Stmt
 	selectMaxEventIDStmt          *sql.Stmt
+	selectMaxStreamPositionsStmt  *sql.Stmt
 	selectRecentEventsStmt        *sql.Stmt
 	selectRecentEventsForSyncStmt *sql.Stmt
 	selectEarlyEventsStmt         *sql.Stmt
@@ -191,10 +202,7 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 	}
 
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(sqlutil.Migration{
-		Version: "syncapi: add history visibility column (output_room_events)",
-		Up:      deltas.UpAddHistoryVisibilityColumnOutputRoomEvents,
-	})
+	m.AddMigrations(deltas.AddHistoryVisibilityColumnOutputRoomEventsMigration)
 	err = m.Up(context.Background())
 	if err != nil {
 		return nil, err
@@ -205,6 +213,7 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.selectEventsStmt, selectEventsSQL},
 		{&s.selectEventsWitFilterStmt, selectEventsWithFilterSQL},
 		{&s.selectMaxEventIDStmt, selectMaxEventIDSQL},
+		{&s.selectMaxStreamPositionsStmt, selectMaxStreamPositionsForRoomsSQL},
 		{&s.selectRecentEventsStmt, selectRecentEventsSQL},
 		{&s.selectRecentEventsForSyncStmt, selectRecentEventsForSyncSQL},
 		{&s.selectEarlyEventsStmt, selectEarlyEventsSQL},
@@ -325,6 +334,29 @@ func (s *outputRoomEventsStatements) SelectMaxEventID(
 	return
 }
 
+// SelectMaxStreamPositionsForRooms returns the stream position of the latest
+// event in each of the given rooms which isn't excluded from sync.
+func (s *outputRoomEventsStatements) SelectMaxStreamPositionsForRooms(
+	ctx context.Context, txn *sql.Tx, roomIDs []string,
+) (map[string]types.StreamPosition, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMaxStreamPositionsStmt)
+	rows, err := stmt.QueryContext(ctx, pq.StringArray(roomIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectMaxStreamPositionsForRooms: rows.close() failed")
+	result := make(map[string]types.StreamPosition, len(roomIDs))
+	var roomID string
+	var pos types.StreamPosition
+	for rows.Next() {
+		if err = rows.Scan(&roomID, &pos); err != nil {
+			return nil, err
+		}
+		result[roomID] = pos
+	}
+	return result, rows.Err()
+}
+
 // InsertEvent into the output_room_events table. addState and removeState are an optional list of state event IDs. Returns the position
 // of the inserted event.
 func (s *outputRoomEventsStatements) InsertEvent(
@@ -394,6 +426,7 @@ func (s *outputRoomEventsStatements) SelectRecentEvents(
 		pq.StringArray(filterConvertTypeWildcardToSQL(eventFilter.Types)),
 		pq.StringArray(filterConvertTypeWildcardToSQL(eventFilter.NotTypes)),
 		eventFilter.Limit+1,
+		eventFilter.ContainsURL,
 	)
 	if err != nil {
 		return nil, false, err
@@ -441,6 +474,7 @@ func (s *outputRoomEventsStatements) SelectEarlyEvents(
 		pq.StringArray(filterConvertTypeWildcardToSQL(eventFilter.Types)),
 		pq.StringArray(filterConvertTypeWildcardToSQL(eventFilter.NotTypes)),
 		eventFilter.Limit,
+		eventFilter.ContainsURL,
 	)
 	if err != nil {
 		return nil, err
@@ -543,6 +577,7 @@ func (s *outputRoomEventsStatements) SelectContextBeforeEvent(
 		pq.StringArray(notSenders),
 		pq.StringArray(filterConvertTypeWildcardToSQL(filter.Types)),
 		pq.StringArray(filterConvertTypeWildcardToSQL(filter.NotTypes)),
+		filter.ContainsURL,
 	)
 	if err != nil {
 		return
@@ -578,6 +613,7 @@ func (s *outputRoomEventsStatements) SelectContextAfterEvent(
 		pq.StringArray(notSenders),
 		pq.StringArray(filterConvertTypeWildcardToSQL(filter.Types)),
 		pq.StringArray(filterConvertTypeWildcardToSQL(filter.NotTypes)),
+		filter.ContainsURL,
 	)
 	if err != nil {
 		return
@@ -20,6 +20,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/postgres/deltas"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -35,15 +36,21 @@ CREATE TABLE IF NOT EXISTS syncapi_output_room_events_topology (
 	topological_position BIGINT NOT NULL,
 	stream_position BIGINT NOT NULL,
     -- The 'room_id' key for the event.
-    room_id TEXT NOT NULL
+    room_id TEXT NOT NULL,
+    -- The 'origin_server_ts' of the event, used for timestamp to event lookups.
+    origin_server_ts BIGINT NOT NULL DEFAULT 0
 );
 -- The topological order will be used in events selection and ordering
 CREATE UNIQUE INDEX IF NOT EXISTS syncapi_event_topological_position_idx ON syncapi_output_room_events_topology(topological_position, stream_position, room_id);
 `
 
+const outputRoomEventsTopologyTimestampIndex = `
+CREATE INDEX IF NOT EXISTS syncapi_event_topology_origin_server_ts_idx ON syncapi_output_room_events_topology(room_id, origin_server_ts);
+`
+
 const insertEventInTopologySQL = "" +
-	"INSERT INTO syncapi_output_room_events_topology (event_id, topological_position, room_id, stream_position)" +
-	" VALUES ($1, $2, $3, $4)" +
+	"INSERT INTO syncapi_output_room_events_topology (event_id, topological_position, room_id, stream_position, origin_server_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
 	" ON CONFLICT (topological_position, stream_position, room_id) DO UPDATE SET event_id = $1" +
 	" RETURNING topological_position"
 
@@ -79,6 +86,16 @@ const selectStreamToTopologicalPositionAscSQL = "" +
 const selectStreamToTopologicalPositionDescSQL = "" +
 	"SELECT topological_position FROM syncapi_output_room_events_topology WHERE room_id = $1 AND stream_position <= $2 ORDER BY topological_position DESC LIMIT 1;"
 
+const selectEventIDAtTimestampForwardSQL = "" +
+	"SELECT event_id, origin_server_ts FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 AND origin_server_ts >= $2" +
+	" ORDER BY origin_server_ts ASC, topological_position ASC, stream_position ASC LIMIT 1"
+
+const selectEventIDAtTimestampBackwardSQL = "" +
+	"SELECT event_id, origin_server_ts FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 AND origin_server_ts <= $2" +
+	" ORDER BY origin_server_ts DESC, topological_position DESC, stream_position DESC LIMIT 1"
+
 type outputRoomEventsTopologyStatements struct {
 	insertEventInTopologyStmt                 *sql.Stmt
 	selectEventIDsInRangeASCStmt              *sql.Stmt
@@ -87,6 +104,8 @@ type outputRoomEventsTopologyStatements struct {
 	selectMaxPositionInTopologyStmt           *sql.Stmt
 	selectStreamToTopologicalPositionAscStmt  *sql.Stmt
 	selectStreamToTopologicalPositionDescStmt *sql.Stmt
+	selectEventIDAtTimestampForwardStmt       *sql.Stmt
+	selectEventIDAtTimestampBackwardStmt      *sql.Stmt
 }
 
 func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
@@ -95,6 +114,16 @@ func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(deltas.AddOriginServerTSColumnTopologyMigration)
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(outputRoomEventsTopologyTimestampIndex); err != nil {
+		return nil, err
+	}
+
 	if s.insertEventInTopologyStmt, err = db.Prepare(insertEventInTopologySQL); err != nil {
 		return nil, err
 	}
@@ -116,6 +145,12 @@ func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
 	if s.selectStreamToTopologicalPositionDescStmt, err = db.Prepare(selectStreamToTopologicalPositionDescSQL); err != nil {
 		return nil, err
 	}
+	if s.selectEventIDAtTimestampForwardStmt, err = db.Prepare(selectEventIDAtTimestampForwardSQL); err != nil {
+		return nil, err
+	}
+	if s.selectEventIDAtTimestampBackwardStmt, err = db.Prepare(selectEventIDAtTimestampBackwardSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -125,7 +160,7 @@ func (s *outputRoomEventsTopologyStatements) InsertEventInTopology(
 	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition,
 ) (topoPos types.StreamPosition, err error) {
 	err = sqlutil.TxStmt(txn, s.insertEventInTopologyStmt).QueryRowContext(
-		ctx, event.EventID(), event.Depth(), event.RoomID(), pos,
+		ctx, event.EventID(), event.Depth(), event.RoomID(), pos, event.OriginServerTS(),
 	).Scan(&topoPos)
 	return
 }
@@ -196,3 +231,17 @@ func (s *outputRoomEventsTopologyStatements) SelectMaxPositionInTopology(
 	err = s.selectMaxPositionInTopologyStmt.QueryRowContext(ctx, roomID).Scan(&pos, &spos)
 	return
 }
+
+// SelectEventIDAtTimestamp returns the ID and timestamp of the event closest to
+// the given timestamp in the given direction. Returns sql.ErrNoRows if there is
+// no such event.
+func (s *outputRoomEventsTopologyStatements) SelectEventIDAtTimestamp(
+	ctx context.Context, txn *sql.Tx, roomID string, ts gomatrixserverlib.Timestamp, forward bool,
+) (eventID string, originServerTS gomatrixserverlib.Timestamp, err error) {
+	stmt := s.selectEventIDAtTimestampBackwardStmt
+	if forward {
+		stmt = s.selectEventIDAtTimestampForwardStmt
+	}
+	err = sqlutil.TxStmt(txn, stmt).QueryRowContext(ctx, roomID, ts).Scan(&eventID, &originServerTS)
+	return
+}
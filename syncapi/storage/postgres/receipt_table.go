@@ -40,22 +40,24 @@ CREATE TABLE IF NOT EXISTS syncapi_receipts (
 	receipt_type TEXT NOT NULL,
 	user_id TEXT NOT NULL,
 	event_id TEXT NOT NULL,
+	-- The MSC3771 thread which the receipt applies to, or empty if it applies to the whole room
+	thread_id TEXT NOT NULL DEFAULT '',
 	receipt_ts BIGINT NOT NULL,
-	CONSTRAINT syncapi_receipts_unique UNIQUE (room_id, receipt_type, user_id)
+	CONSTRAINT syncapi_receipts_unique UNIQUE (room_id, receipt_type, user_id, thread_id)
 );
 CREATE INDEX IF NOT EXISTS syncapi_receipts_room_id ON syncapi_receipts(room_id);
 `
 
 const upsertReceipt = "" +
 	"INSERT INTO syncapi_receipts" +
-	" (room_id, receipt_type, user_id, event_id, receipt_ts)" +
-	" VALUES ($1, $2, $3, $4, $5)" +
-	" ON CONFLICT (room_id, receipt_type, user_id)" +
-	" DO UPDATE SET id = nextval('syncapi_receipt_id'), event_id = $4, receipt_ts = $5" +
+	" (room_id, receipt_type, user_id, event_id, thread_id, receipt_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	" ON CONFLICT (room_id, receipt_type, user_id, thread_id)" +
+	" DO UPDATE SET id = nextval('syncapi_receipt_id'), event_id = $4, receipt_ts = $6" +
 	" RETURNING id"
 
 const selectRoomReceipts = "" +
-	"SELECT id, room_id, receipt_type, user_id, event_id, receipt_ts" +
+	"SELECT id, room_id, receipt_type, user_id, event_id, thread_id, receipt_ts" +
 	" FROM syncapi_receipts" +
 	" WHERE room_id = ANY($1) AND id > $2"
 
@@ -75,10 +77,10 @@ func NewPostgresReceiptsTable(db *sql.DB) (tables.Receipts, error) {
 		return nil, err
 	}
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(sqlutil.Migration{
-		Version: "syncapi: fix sequences",
-		Up:      deltas.UpFixSequences,
-	})
+	m.AddMigrations(
+		deltas.FixSequencesMigration,
+		deltas.AddReceiptThreadIDMigration,
+	)
 	err = m.Up(context.Background())
 	if err != nil {
 		return nil, err
@@ -98,9 +100,9 @@ func NewPostgresReceiptsTable(db *sql.DB) (tables.Receipts, error) {
 	return r, nil
 }
 
-func (r *receiptStatements) UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error) {
+func (r *receiptStatements) UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId, threadID string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error) {
 	stmt := sqlutil.TxStmt(txn, r.upsertReceipt)
-	err = stmt.QueryRowContext(ctx, roomId, receiptType, userId, eventId, timestamp).Scan(&pos)
+	err = stmt.QueryRowContext(ctx, roomId, receiptType, userId, eventId, threadID, timestamp).Scan(&pos)
 	return
 }
 
@@ -115,7 +117,7 @@ func (r *receiptStatements) SelectRoomReceiptsAfter(ctx context.Context, roomIDs
 	for rows.Next() {
 		r := types.OutputReceiptEvent{}
 		var id types.StreamPosition
-		err = rows.Scan(&id, &r.RoomID, &r.Type, &r.UserID, &r.EventID, &r.Timestamp)
+		err = rows.Scan(&id, &r.RoomID, &r.Type, &r.UserID, &r.EventID, &r.ThreadID, &r.Timestamp)
 		if err != nil {
 			return 0, res, fmt.Errorf("unable to scan row to api.Receipts: %w", err)
 		}
@@ -78,10 +78,7 @@ func NewPostgresSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
 		return nil, err
 	}
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(sqlutil.Migration{
-		Version: "syncapi: drop sent_by_token",
-		Up:      deltas.UpRemoveSendToDeviceSentColumn,
-	})
+	m.AddMigrations(deltas.RemoveSendToDeviceSentColumnMigration)
 	err = m.Up(context.Background())
 	if err != nil {
 		return nil, err
@@ -97,6 +97,14 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions)
 	if err != nil {
 		return nil, err
 	}
+	rebuildProgress, err := NewPostgresRebuildProgressTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	forcedResyncs, err := NewPostgresForcedResyncsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Writer:              d.writer,
@@ -114,6 +122,8 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions)
 		NotificationData:    notificationData,
 		Ignores:             ignores,
 		Presence:            presence,
+		RebuildProgress:     rebuildProgress,
+		ForcedResyncs:       forcedResyncs,
 	}
 	return &d, nil
 }
@@ -50,6 +50,8 @@ type Database struct {
 	NotificationData    tables.NotificationData
 	Ignores             tables.Ignores
 	Presence            tables.Presence
+	RebuildProgress     tables.RebuildProgress
+	ForcedResyncs       tables.ForcedResyncs
 }
 
 func (d *Database) readOnlySnapshot(ctx context.Context) (*sql.Tx, error) {
@@ -120,6 +122,10 @@ func (d *Database) RoomIDsWithMembership(ctx context.Context, userID string, mem
 	return d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, nil, userID, membership)
 }
 
+func (d *Database) MaxStreamPositionsForRooms(ctx context.Context, roomIDs []string) (map[string]types.StreamPosition, error) {
+	return d.OutputEvents.SelectMaxStreamPositionsForRooms(ctx, nil, roomIDs)
+}
+
 func (d *Database) MembershipCount(ctx context.Context, roomID, membership string, pos types.StreamPosition) (int, error) {
 	return d.Memberships.SelectMembershipCount(ctx, nil, roomID, membership, pos)
 }
@@ -362,6 +368,59 @@ func (d *Database) PurgeRoomState(
 	})
 }
 
+// RebuildRoomState replaces the current state of a room. Events which are
+// already known keep their existing stream positions, so that state deltas
+// calculated for incremental syncs are still correct.
+func (d *Database) RebuildRoomState(
+	ctx context.Context, roomID string, stateEvents []*gomatrixserverlib.HeaderedEvent,
+) error {
+	historyVisibility := gomatrixserverlib.HistoryVisibilityShared
+	eventIDs := make([]string, 0, len(stateEvents))
+	for _, ev := range stateEvents {
+		eventIDs = append(eventIDs, ev.EventID())
+		if ev.Type() == gomatrixserverlib.MRoomHistoryVisibility && ev.StateKeyEquals("") {
+			if hisVis, err := ev.HistoryVisibility(); err == nil {
+				historyVisibility = hisVis
+			}
+		}
+	}
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		known, err := d.OutputEvents.SelectEvents(ctx, txn, eventIDs, &gomatrixserverlib.RoomEventFilter{Limit: len(eventIDs)}, false)
+		if err != nil {
+			return fmt.Errorf("d.OutputEvents.SelectEvents: %w", err)
+		}
+		positions := make(map[string]types.StreamPosition, len(known))
+		for _, ev := range known {
+			positions[ev.EventID()] = ev.StreamPosition
+		}
+
+		if err = d.CurrentRoomState.DeleteRoomStateForRoom(ctx, txn, roomID); err != nil {
+			return fmt.Errorf("d.CurrentRoomState.DeleteRoomStateForRoom: %w", err)
+		}
+		for _, ev := range stateEvents {
+			if ev.RoomID() != roomID {
+				return fmt.Errorf("state event %q is not in room %q", ev.EventID(), roomID)
+			}
+			ev.Visibility = historyVisibility
+			pos, ok := positions[ev.EventID()]
+			if !ok {
+				pos, err = d.OutputEvents.InsertEvent(ctx, txn, ev, nil, nil, nil, true, historyVisibility)
+				if err != nil {
+					return fmt.Errorf("d.OutputEvents.InsertEvent: %w", err)
+				}
+				if _, err = d.Topology.InsertEventInTopology(ctx, txn, ev, pos); err != nil {
+					return fmt.Errorf("d.Topology.InsertEventInTopology: %w", err)
+				}
+			}
+			topoPos := types.StreamPosition(ev.Depth())
+			if err = d.updateRoomState(ctx, txn, nil, []*gomatrixserverlib.HeaderedEvent{ev}, pos, topoPos); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (d *Database) WriteEvent(
 	ctx context.Context,
 	ev *gomatrixserverlib.HeaderedEvent,
@@ -483,6 +542,12 @@ func (d *Database) BackwardExtremitiesForRoom(
 	return d.BackwardExtremities.SelectBackwardExtremitiesForRoom(ctx, roomID)
 }
 
+func (d *Database) EventIDAtTimestamp(
+	ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp, forward bool,
+) (string, gomatrixserverlib.Timestamp, error) {
+	return d.Topology.SelectEventIDAtTimestamp(ctx, nil, roomID, ts, forward)
+}
+
 func (d *Database) MaxTopologicalPosition(
 	ctx context.Context, roomID string,
 ) (types.TopologyToken, error) {
@@ -524,13 +589,13 @@ func (d *Database) StreamToTopologicalPosition(
 }
 
 func (d *Database) GetFilter(
-	ctx context.Context, target *gomatrixserverlib.Filter, localpart string, filterID string,
+	ctx context.Context, target *types.Filter, localpart string, filterID string,
 ) error {
 	return d.Filter.SelectFilter(ctx, target, localpart, filterID)
 }
 
 func (d *Database) PutFilter(
-	ctx context.Context, localpart string, filter *gomatrixserverlib.Filter,
+	ctx context.Context, localpart string, filter *types.Filter,
 ) (string, error) {
 	var filterID string
 	var err error
@@ -541,6 +606,14 @@ func (d *Database) PutFilter(
 	return filterID, err
 }
 
+func (d *Database) DeleteFilters(
+	ctx context.Context, localpart string,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Filter.DeleteFilters(ctx, txn, localpart)
+	})
+}
+
 func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error {
 	redactedEvents, err := d.Events(ctx, []string{redactedEventID})
 	if err != nil {
@@ -1014,9 +1087,9 @@ func getMembershipFromEvent(ev *gomatrixserverlib.Event, userID string) string {
 }
 
 // StoreReceipt stores user receipts
-func (d *Database) StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error) {
+func (d *Database) StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId, threadID string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error) {
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		pos, err = d.Receipts.UpsertReceipt(ctx, txn, roomId, receiptType, userId, eventId, timestamp)
+		pos, err = d.Receipts.UpsertReceipt(ctx, txn, roomId, receiptType, userId, eventId, threadID, timestamp)
 		return err
 	})
 	return
@@ -1027,9 +1100,9 @@ func (d *Database) GetRoomReceipts(ctx context.Context, roomIDs []string, stream
 	return receipts, err
 }
 
-func (d *Database) UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int) (pos types.StreamPosition, err error) {
+func (d *Database) UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int, threads map[string]eventutil.ThreadNotificationData) (pos types.StreamPosition, err error) {
 	err = d.Writer.Do(nil, nil, func(_ *sql.Tx) error {
-		pos, err = d.NotificationData.UpsertRoomUnreadCounts(ctx, userID, roomID, notificationCount, highlightCount)
+		pos, err = d.NotificationData.UpsertRoomUnreadCounts(ctx, userID, roomID, notificationCount, highlightCount, threads)
 		return err
 	})
 	return
@@ -1073,3 +1146,52 @@ func (s *Database) PresenceAfter(ctx context.Context, after types.StreamPosition
 func (s *Database) MaxStreamPositionForPresence(ctx context.Context) (types.StreamPosition, error) {
 	return s.Presence.GetMaxPresenceID(ctx, nil)
 }
+
+func (d *Database) GetRebuildProgress(ctx context.Context, roomID string) (position int64, completed bool, err error) {
+	return d.RebuildProgress.SelectRebuildProgress(ctx, nil, roomID)
+}
+
+func (d *Database) SetRebuildProgress(ctx context.Context, roomID string, position int64, completed bool) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.RebuildProgress.UpsertRebuildProgress(ctx, txn, roomID, position, completed)
+	})
+}
+
+func (d *Database) ResetRebuildProgress(ctx context.Context) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.RebuildProgress.DeleteRebuildProgress(ctx, txn)
+	})
+}
+
+func (d *Database) ForceResync(ctx context.Context, userID, deviceID string, ts gomatrixserverlib.Timestamp) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.ForcedResyncs.UpsertForcedResync(ctx, txn, userID, deviceID, ts)
+	})
+}
+
+func (d *Database) ResyncPending(ctx context.Context, userID, deviceID string) (bool, error) {
+	return d.ForcedResyncs.SelectForcedResync(ctx, nil, userID, deviceID)
+}
+
+func (d *Database) ConsumeForcedResync(ctx context.Context, userID, deviceID string) (bool, error) {
+	// Check first without the writer, since almost every device that syncs
+	// won't have been forced to resync.
+	pending, err := d.ForcedResyncs.SelectForcedResync(ctx, nil, userID, deviceID)
+	if err != nil || !pending {
+		return false, err
+	}
+	// Only report the resync if this request was the one which deleted it, so
+	// that it is only forced once even if the device syncs with several
+	// instances at the same time.
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		pending, err = d.ForcedResyncs.DeleteForcedResync(ctx, txn, userID, deviceID)
+		return err
+	})
+	return pending, err
+}
+
+func (d *Database) PruneForcedResyncs(ctx context.Context, before gomatrixserverlib.Timestamp) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.ForcedResyncs.DeleteForcedResyncsBefore(ctx, txn, before)
+	})
+}
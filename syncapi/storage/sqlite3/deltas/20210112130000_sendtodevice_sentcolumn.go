@@ -52,11 +52,11 @@ func DownRemoveSendToDeviceSentColumn(ctx context.Context, tx *sql.Tx) error {
 			content TEXT NOT NULL,
 			sent_by_token TEXT
 		);
-		INSERT INTO syncapi_send_to_device SELECT id, user_id, device_id, content FROM syncapi_send_to_device_backup;
+		INSERT INTO syncapi_send_to_device (id, user_id, device_id, content) SELECT id, user_id, device_id, content FROM syncapi_send_to_device_backup;
 		DROP TABLE syncapi_send_to_device_backup;
 	`)
 	if err != nil {
-		return fmt.Errorf("failed to execute upgrade: %w", err)
+		return fmt.Errorf("failed to execute downgrade: %w", err)
 	}
 	return nil
 }
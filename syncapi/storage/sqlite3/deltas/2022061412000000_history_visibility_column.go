@@ -54,25 +54,18 @@ func UpAddHistoryVisibilityColumnCurrentRoomState(ctx context.Context, tx *sql.T
 	return nil
 }
 
-func DownAddHistoryVisibilityColumn(ctx context.Context, tx *sql.Tx) error {
-	// SQLite doesn't have "if exists", so check if the column exists.
-	_, err := tx.QueryContext(ctx, "SELECT history_visibility FROM syncapi_output_room_events LIMIT 1")
-	if err != nil {
-		// The column probably doesn't exist
-		return nil
-	}
-	_, err = tx.ExecContext(ctx, `
+func DownAddHistoryVisibilityColumnOutputRoomEvents(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
 		ALTER TABLE syncapi_output_room_events DROP COLUMN history_visibility;
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to execute downgrade: %w", err)
 	}
-	_, err = tx.QueryContext(ctx, "SELECT history_visibility FROM syncapi_current_room_state LIMIT 1")
-	if err != nil {
-		// The column probably doesn't exist
-		return nil
-	}
-	_, err = tx.ExecContext(ctx, `
+	return nil
+}
+
+func DownAddHistoryVisibilityColumnCurrentRoomState(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
 		ALTER TABLE syncapi_current_room_state DROP COLUMN history_visibility;
 	`)
 	if err != nil {
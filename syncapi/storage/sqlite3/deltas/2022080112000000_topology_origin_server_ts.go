@@ -0,0 +1,52 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpAddOriginServerTSColumnTopology(ctx context.Context, tx *sql.Tx) error {
+	// SQLite doesn't have "if exists", so check if the column exists. If the query doesn't return an error, it already exists.
+	// Required for unit tests, as otherwise a duplicate column error will show up.
+	_, err := tx.QueryContext(ctx, "SELECT origin_server_ts FROM syncapi_output_room_events_topology LIMIT 1")
+	if err == nil {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, `
+		ALTER TABLE syncapi_output_room_events_topology ADD COLUMN origin_server_ts BIGINT NOT NULL DEFAULT 0;
+		UPDATE syncapi_output_room_events_topology SET origin_server_ts = COALESCE((
+			SELECT json_extract(headered_event_json, '$.origin_server_ts') FROM syncapi_output_room_events
+			WHERE syncapi_output_room_events.event_id = syncapi_output_room_events_topology.event_id
+		), 0);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddOriginServerTSColumnTopology(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		DROP INDEX IF EXISTS syncapi_event_topology_origin_server_ts_idx;
+		ALTER TABLE syncapi_output_room_events_topology DROP COLUMN origin_server_ts;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
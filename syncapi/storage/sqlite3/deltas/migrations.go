@@ -0,0 +1,65 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import "github.com/matrix-org/dendrite/internal/sqlutil"
+
+var (
+	FixSequencesMigration = sqlutil.Migration{
+		Version: "syncapi: fix sequences",
+		Up:      UpFixSequences,
+		Down:    DownFixSequences,
+	}
+	RemoveSendToDeviceSentColumnMigration = sqlutil.Migration{
+		Version: "syncapi: drop sent_by_token",
+		Up:      UpRemoveSendToDeviceSentColumn,
+		Down:    DownRemoveSendToDeviceSentColumn,
+	}
+	AddHistoryVisibilityColumnOutputRoomEventsMigration = sqlutil.Migration{
+		Version: "syncapi: add history visibility column (output_room_events)",
+		Up:      UpAddHistoryVisibilityColumnOutputRoomEvents,
+		Down:    DownAddHistoryVisibilityColumnOutputRoomEvents,
+	}
+	AddHistoryVisibilityColumnCurrentRoomStateMigration = sqlutil.Migration{
+		Version: "syncapi: add history visibility column (current_room_state)",
+		Up:      UpAddHistoryVisibilityColumnCurrentRoomState,
+		Down:    DownAddHistoryVisibilityColumnCurrentRoomState,
+	}
+	AddOriginServerTSColumnTopologyMigration = sqlutil.Migration{
+		Version: "syncapi: add origin_server_ts column (output_room_events_topology)",
+		Up:      UpAddOriginServerTSColumnTopology,
+		Down:    DownAddOriginServerTSColumnTopology,
+	}
+	AddReceiptThreadIDMigration = sqlutil.Migration{
+		Version: "syncapi: add receipt thread ID",
+		Up:      UpAddReceiptThreadID,
+		Down:    DownAddReceiptThreadID,
+	}
+	AddNotificationDataThreadCountsMigration = sqlutil.Migration{
+		Version: "syncapi: add notification data thread counts",
+		Up:      UpAddNotificationDataThreadCounts,
+		Down:    DownAddNotificationDataThreadCounts,
+	}
+)
+
+var Migrations = []sqlutil.Migration{
+	FixSequencesMigration,
+	RemoveSendToDeviceSentColumnMigration,
+	AddHistoryVisibilityColumnOutputRoomEventsMigration,
+	AddHistoryVisibilityColumnCurrentRoomStateMigration,
+	AddOriginServerTSColumnTopologyMigration,
+	AddReceiptThreadIDMigration,
+	AddNotificationDataThreadCountsMigration,
+}
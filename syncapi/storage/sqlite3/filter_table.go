@@ -20,7 +20,9 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -49,11 +51,15 @@ const selectFilterIDByContentSQL = "" +
 const insertFilterSQL = "" +
 	"INSERT INTO syncapi_filter (filter, localpart) VALUES ($1, $2)"
 
+const deleteFiltersSQL = "" +
+	"DELETE FROM syncapi_filter WHERE localpart = $1"
+
 type filterStatements struct {
 	db                          *sql.DB
 	selectFilterStmt            *sql.Stmt
 	selectFilterIDByContentStmt *sql.Stmt
 	insertFilterStmt            *sql.Stmt
+	deleteFiltersStmt           *sql.Stmt
 }
 
 func NewSqliteFilterTable(db *sql.DB) (tables.Filter, error) {
@@ -73,11 +79,14 @@ func NewSqliteFilterTable(db *sql.DB) (tables.Filter, error) {
 	if s.insertFilterStmt, err = db.Prepare(insertFilterSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteFiltersStmt, err = db.Prepare(deleteFiltersSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
 func (s *filterStatements) SelectFilter(
-	ctx context.Context, target *gomatrixserverlib.Filter, localpart string, filterID string,
+	ctx context.Context, target *types.Filter, localpart string, filterID string,
 ) error {
 	// Retrieve filter from database (stored as canonical JSON)
 	var filterData []byte
@@ -94,7 +103,7 @@ func (s *filterStatements) SelectFilter(
 }
 
 func (s *filterStatements) InsertFilter(
-	ctx context.Context, filter *gomatrixserverlib.Filter, localpart string,
+	ctx context.Context, filter *types.Filter, localpart string,
 ) (filterID string, err error) {
 	var existingFilterID string
 
@@ -137,3 +146,10 @@ func (s *filterStatements) InsertFilter(
 	filterID = fmt.Sprintf("%d", rowid)
 	return
 }
+
+func (s *filterStatements) DeleteFilters(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteFiltersStmt).ExecContext(ctx, localpart)
+	return err
+}
@@ -3,6 +3,7 @@ package sqlite3
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 )
@@ -51,20 +52,18 @@ func prepareWithFilters(
 	}
 	if types != nil {
 		if count := len(*types); count > 0 {
-			query += " AND type IN " + sqlutil.QueryVariadicOffset(count, offset)
-			for _, v := range *types {
-				params, offset = append(params, v), offset+1
-			}
+			var clause string
+			clause, params, offset = filterTypeClause(*types, params, offset)
+			query += " AND " + clause
 		} else {
 			query += ` AND type = ""`
 		}
 	}
 	if nottypes != nil {
 		if count := len(*nottypes); count > 0 {
-			query += " AND type NOT IN " + sqlutil.QueryVariadicOffset(count, offset)
-			for _, v := range *nottypes {
-				params, offset = append(params, v), offset+1
-			}
+			var clause string
+			clause, params, offset = filterTypeClause(*nottypes, params, offset)
+			query += " AND NOT " + clause
 		} else {
 			query += ` AND type NOT = ""`
 		}
@@ -99,3 +98,32 @@ func prepareWithFilters(
 	}
 	return stmt, params, nil
 }
+
+// filterTypeClause builds a bracketed SQL clause matching any of the given
+// event types. Types containing the '*' wildcard described in the client
+// filter spec are matched with GLOB, with any other GLOB metacharacters
+// escaped, while plain types use a straight IN comparison.
+func filterTypeClause(types []string, params []interface{}, offset int) (string, []interface{}, int) {
+	var exact, clauses []string
+	for _, v := range types {
+		if !strings.Contains(v, "*") {
+			exact = append(exact, v)
+			continue
+		}
+		params, offset = append(params, filterConvertTypeWildcardToGlob(v)), offset+1
+		clauses = append(clauses, fmt.Sprintf("type GLOB $%d", offset))
+	}
+	if count := len(exact); count > 0 {
+		clauses = append(clauses, "type IN "+sqlutil.QueryVariadicOffset(count, offset))
+		for _, v := range exact {
+			params, offset = append(params, v), offset+1
+		}
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", params, offset
+}
+
+// filterConvertTypeWildcardToGlob escapes the GLOB metacharacters '?' and
+// '[' so that only '*' acts as a wildcard.
+func filterConvertTypeWildcardToGlob(value string) string {
+	return strings.NewReplacer("[", "[[]", "?", "[?]").Replace(value)
+}
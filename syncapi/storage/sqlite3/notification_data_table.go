@@ -17,10 +17,12 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3/deltas"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 )
@@ -30,6 +32,11 @@ func NewSqliteNotificationDataTable(db *sql.DB, streamID *StreamIDStatements) (t
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(deltas.AddNotificationDataThreadCountsMigration)
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	r := &notificationDataStatements{
 		streamIDStatements: streamID,
 	}
@@ -54,17 +61,19 @@ CREATE TABLE IF NOT EXISTS syncapi_notification_data (
 	room_id TEXT NOT NULL,
 	notification_count BIGINT NOT NULL DEFAULT 0,
 	highlight_count BIGINT NOT NULL DEFAULT 0,
+	-- The JSON encoded counts of each thread, which are included in the counts above
+	thread_counts TEXT NOT NULL DEFAULT '{}',
 	CONSTRAINT syncapi_notifications_unique UNIQUE (user_id, room_id)
 );`
 
 const upsertRoomUnreadNotificationCountsSQL = `INSERT INTO syncapi_notification_data
-  (user_id, room_id, notification_count, highlight_count)
-  VALUES ($1, $2, $3, $4)
+  (user_id, room_id, notification_count, highlight_count, thread_counts)
+  VALUES ($1, $2, $3, $4, $5)
   ON CONFLICT (user_id, room_id)
-  DO UPDATE SET id = $5, notification_count = $6, highlight_count = $7`
+  DO UPDATE SET id = $6, notification_count = $7, highlight_count = $8, thread_counts = $9`
 
 const selectUserUnreadNotificationCountsSQL = `SELECT
-  id, room_id, notification_count, highlight_count
+  id, room_id, notification_count, highlight_count, thread_counts
   FROM syncapi_notification_data
   WHERE
     user_id = $1 AND
@@ -72,12 +81,18 @@ const selectUserUnreadNotificationCountsSQL = `SELECT
 
 const selectMaxNotificationIDSQL = `SELECT CASE COUNT(*) WHEN 0 THEN 0 ELSE MAX(id) END FROM syncapi_notification_data`
 
-func (r *notificationDataStatements) UpsertRoomUnreadCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int) (pos types.StreamPosition, err error) {
+func (r *notificationDataStatements) UpsertRoomUnreadCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int, threads map[string]eventutil.ThreadNotificationData) (pos types.StreamPosition, err error) {
+	threadCounts := []byte("{}")
+	if len(threads) > 0 {
+		if threadCounts, err = json.Marshal(threads); err != nil {
+			return
+		}
+	}
 	pos, err = r.streamIDStatements.nextNotificationID(ctx, nil)
 	if err != nil {
 		return
 	}
-	_, err = r.upsertRoomUnreadCounts.ExecContext(ctx, userID, roomID, notificationCount, highlightCount, pos, notificationCount, highlightCount)
+	_, err = r.upsertRoomUnreadCounts.ExecContext(ctx, userID, roomID, notificationCount, highlightCount, string(threadCounts), pos, notificationCount, highlightCount, string(threadCounts))
 	return
 }
 
@@ -93,16 +108,21 @@ func (r *notificationDataStatements) SelectUserUnreadCounts(ctx context.Context,
 		var id types.StreamPosition
 		var roomID string
 		var notificationCount, highlightCount int
+		var threadCounts string
 
-		if err = rows.Scan(&id, &roomID, &notificationCount, &highlightCount); err != nil {
+		if err = rows.Scan(&id, &roomID, &notificationCount, &highlightCount, &threadCounts); err != nil {
 			return nil, err
 		}
 
-		roomCounts[roomID] = &eventutil.NotificationData{
+		data := &eventutil.NotificationData{
 			RoomID:                  roomID,
 			UnreadNotificationCount: notificationCount,
 			UnreadHighlightCount:    highlightCount,
 		}
+		if err = json.Unmarshal([]byte(threadCounts), &data.Threads); err != nil {
+			return nil, err
+		}
+		roomCounts[roomID] = data
 	}
 	return roomCounts, rows.Err()
 }
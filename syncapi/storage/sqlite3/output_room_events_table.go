@@ -88,6 +88,11 @@ const selectEarlyEventsSQL = "" +
 const selectMaxEventIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_output_room_events"
 
+const selectMaxStreamPositionsForRoomsSQL = "" +
+	"SELECT room_id, MAX(id) FROM syncapi_output_room_events" +
+	" WHERE room_id IN ($1) AND exclude_from_sync = FALSE" +
+	" GROUP BY room_id"
+
 const updateEventJSONSQL = "" +
 	"UPDATE syncapi_output_room_events SET headered_event_json=$1 WHERE event_id=$2"
 
@@ -139,10 +144,7 @@ func NewSqliteEventsTable(db *sql.DB, streamID *StreamIDStatements) (tables.Even
 	}
 
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(sqlutil.Migration{
-		Version: "syncapi: add history visibility column (output_room_events)",
-		Up:      deltas.UpAddHistoryVisibilityColumnOutputRoomEvents,
-	})
+	m.AddMigrations(deltas.AddHistoryVisibilityColumnOutputRoomEventsMigration)
 	err = m.Up(context.Background())
 	if err != nil {
 		return nil, err
@@ -280,6 +282,41 @@ func (s *outputRoomEventsStatements) SelectMaxEventID(
 	return
 }
 
+// SelectMaxStreamPositionsForRooms returns the stream position of the latest
+// event in each of the given rooms which isn't excluded from sync.
+func (s *outputRoomEventsStatements) SelectMaxStreamPositionsForRooms(
+	ctx context.Context, txn *sql.Tx, roomIDs []string,
+) (map[string]types.StreamPosition, error) {
+	result := make(map[string]types.StreamPosition, len(roomIDs))
+	if len(roomIDs) == 0 {
+		return result, nil
+	}
+	selectSQL := strings.Replace(selectMaxStreamPositionsForRoomsSQL, "($1)", sqlutil.QueryVariadic(len(roomIDs)), 1)
+	params := make([]interface{}, len(roomIDs))
+	for i := range roomIDs {
+		params[i] = roomIDs[i]
+	}
+	stmt, err := s.db.Prepare(selectSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "SelectMaxStreamPositionsForRooms: stmt.close() failed")
+	rows, err := sqlutil.TxStmt(txn, stmt).QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectMaxStreamPositionsForRooms: rows.close() failed")
+	var roomID string
+	var pos types.StreamPosition
+	for rows.Next() {
+		if err = rows.Scan(&roomID, &pos); err != nil {
+			return nil, err
+		}
+		result[roomID] = pos
+	}
+	return result, rows.Err()
+}
+
 // InsertEvent into the output_room_events table. addState and removeState are an optional list of state event IDs. Returns the position
 // of the inserted event.
 func (s *outputRoomEventsStatements) InsertEvent(
@@ -19,6 +19,7 @@ import (
 	"database/sql"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3/deltas"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -31,6 +32,7 @@ CREATE TABLE IF NOT EXISTS syncapi_output_room_events_topology (
   topological_position BIGINT NOT NULL,
   stream_position BIGINT NOT NULL,
   room_id TEXT NOT NULL,
+  origin_server_ts BIGINT NOT NULL DEFAULT 0,
 
 	UNIQUE(topological_position, room_id, stream_position)
 );
@@ -38,9 +40,13 @@ CREATE TABLE IF NOT EXISTS syncapi_output_room_events_topology (
 -- CREATE UNIQUE INDEX IF NOT EXISTS syncapi_event_topological_position_idx ON syncapi_output_room_events_topology(topological_position, stream_position, room_id);
 `
 
+const outputRoomEventsTopologyTimestampIndex = `
+CREATE INDEX IF NOT EXISTS syncapi_event_topology_origin_server_ts_idx ON syncapi_output_room_events_topology(room_id, origin_server_ts);
+`
+
 const insertEventInTopologySQL = "" +
-	"INSERT INTO syncapi_output_room_events_topology (event_id, topological_position, room_id, stream_position)" +
-	" VALUES ($1, $2, $3, $4)" +
+	"INSERT INTO syncapi_output_room_events_topology (event_id, topological_position, room_id, stream_position, origin_server_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
 	" ON CONFLICT DO NOTHING"
 
 const selectEventIDsInRangeASCSQL = "" +
@@ -71,6 +77,16 @@ const selectStreamToTopologicalPositionAscSQL = "" +
 const selectStreamToTopologicalPositionDescSQL = "" +
 	"SELECT topological_position FROM syncapi_output_room_events_topology WHERE room_id = $1 AND stream_position <= $2 ORDER BY topological_position DESC LIMIT 1;"
 
+const selectEventIDAtTimestampForwardSQL = "" +
+	"SELECT event_id, origin_server_ts FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 AND origin_server_ts >= $2" +
+	" ORDER BY origin_server_ts ASC, topological_position ASC, stream_position ASC LIMIT 1"
+
+const selectEventIDAtTimestampBackwardSQL = "" +
+	"SELECT event_id, origin_server_ts FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 AND origin_server_ts <= $2" +
+	" ORDER BY origin_server_ts DESC, topological_position DESC, stream_position DESC LIMIT 1"
+
 type outputRoomEventsTopologyStatements struct {
 	db                                        *sql.DB
 	insertEventInTopologyStmt                 *sql.Stmt
@@ -80,6 +96,8 @@ type outputRoomEventsTopologyStatements struct {
 	selectMaxPositionInTopologyStmt           *sql.Stmt
 	selectStreamToTopologicalPositionAscStmt  *sql.Stmt
 	selectStreamToTopologicalPositionDescStmt *sql.Stmt
+	selectEventIDAtTimestampForwardStmt       *sql.Stmt
+	selectEventIDAtTimestampBackwardStmt      *sql.Stmt
 }
 
 func NewSqliteTopologyTable(db *sql.DB) (tables.Topology, error) {
@@ -90,6 +108,16 @@ func NewSqliteTopologyTable(db *sql.DB) (tables.Topology, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(deltas.AddOriginServerTSColumnTopologyMigration)
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(outputRoomEventsTopologyTimestampIndex); err != nil {
+		return nil, err
+	}
+
 	if s.insertEventInTopologyStmt, err = db.Prepare(insertEventInTopologySQL); err != nil {
 		return nil, err
 	}
@@ -111,6 +139,12 @@ func NewSqliteTopologyTable(db *sql.DB) (tables.Topology, error) {
 	if s.selectStreamToTopologicalPositionDescStmt, err = db.Prepare(selectStreamToTopologicalPositionDescSQL); err != nil {
 		return nil, err
 	}
+	if s.selectEventIDAtTimestampForwardStmt, err = db.Prepare(selectEventIDAtTimestampForwardSQL); err != nil {
+		return nil, err
+	}
+	if s.selectEventIDAtTimestampBackwardStmt, err = db.Prepare(selectEventIDAtTimestampBackwardSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -120,7 +154,7 @@ func (s *outputRoomEventsTopologyStatements) InsertEventInTopology(
 	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition,
 ) (types.StreamPosition, error) {
 	_, err := sqlutil.TxStmt(txn, s.insertEventInTopologyStmt).ExecContext(
-		ctx, event.EventID(), event.Depth(), event.RoomID(), pos,
+		ctx, event.EventID(), event.Depth(), event.RoomID(), pos, event.OriginServerTS(),
 	)
 	return types.StreamPosition(event.Depth()), err
 }
@@ -190,3 +224,17 @@ func (s *outputRoomEventsTopologyStatements) SelectMaxPositionInTopology(
 	err = stmt.QueryRowContext(ctx, roomID).Scan(&pos, &spos)
 	return
 }
+
+// SelectEventIDAtTimestamp returns the ID and timestamp of the event closest to
+// the given timestamp in the given direction. Returns sql.ErrNoRows if there is
+// no such event.
+func (s *outputRoomEventsTopologyStatements) SelectEventIDAtTimestamp(
+	ctx context.Context, txn *sql.Tx, roomID string, ts gomatrixserverlib.Timestamp, forward bool,
+) (eventID string, originServerTS gomatrixserverlib.Timestamp, err error) {
+	stmt := s.selectEventIDAtTimestampBackwardStmt
+	if forward {
+		stmt = s.selectEventIDAtTimestampForwardStmt
+	}
+	err = sqlutil.TxStmt(txn, stmt).QueryRowContext(ctx, roomID, ts).Scan(&eventID, &originServerTS)
+	return
+}
@@ -164,7 +164,12 @@ func (p *presenceStatements) GetPresenceAfter(
 ) (presences map[string]*types.PresenceInternal, err error) {
 	presences = make(map[string]*types.PresenceInternal)
 	stmt := sqlutil.TxStmt(txn, p.selectPresenceAfterStmt)
-	afterTS := gomatrixserverlib.AsTimestamp(time.Now().Add(time.Minute * -5))
+	// Only recently active users are included in a complete sync, but an
+	// incremental sync must see every change, e.g. a user going idle.
+	var afterTS gomatrixserverlib.Timestamp
+	if after == 0 {
+		afterTS = gomatrixserverlib.AsTimestamp(time.Now().Add(time.Minute * -5))
+	}
 	rows, err := stmt.QueryContext(ctx, after, afterTS, filter.Limit)
 	if err != nil {
 		return nil, err
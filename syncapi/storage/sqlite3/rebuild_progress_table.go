@@ -0,0 +1,87 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+)
+
+const rebuildProgressSchema = `
+-- Tracks how far the sync API has got when rebuilding rooms from the roomserver.
+CREATE TABLE IF NOT EXISTS syncapi_rebuild_progress (
+	room_id TEXT NOT NULL PRIMARY KEY,
+	-- The roomserver position of the last event which was written for the room.
+	position BIGINT NOT NULL,
+	-- Whether the room has been completely rebuilt.
+	completed BOOLEAN NOT NULL DEFAULT FALSE
+);
+`
+
+const selectRebuildProgressSQL = "" +
+	"SELECT position, completed FROM syncapi_rebuild_progress WHERE room_id = $1"
+
+const upsertRebuildProgressSQL = "" +
+	"INSERT INTO syncapi_rebuild_progress (room_id, position, completed) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (room_id) DO UPDATE SET position = $2, completed = $3"
+
+const deleteRebuildProgressSQL = "" +
+	"DELETE FROM syncapi_rebuild_progress"
+
+type rebuildProgressStatements struct {
+	selectRebuildProgressStmt *sql.Stmt
+	upsertRebuildProgressStmt *sql.Stmt
+	deleteRebuildProgressStmt *sql.Stmt
+}
+
+func NewSqliteRebuildProgressTable(db *sql.DB) (tables.RebuildProgress, error) {
+	_, err := db.Exec(rebuildProgressSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &rebuildProgressStatements{}
+	return s, sqlutil.StatementList{
+		{&s.selectRebuildProgressStmt, selectRebuildProgressSQL},
+		{&s.upsertRebuildProgressStmt, upsertRebuildProgressSQL},
+		{&s.deleteRebuildProgressStmt, deleteRebuildProgressSQL},
+	}.Prepare(db)
+}
+
+func (s *rebuildProgressStatements) SelectRebuildProgress(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (position int64, completed bool, err error) {
+	err = sqlutil.TxStmt(txn, s.selectRebuildProgressStmt).QueryRowContext(ctx, roomID).Scan(&position, &completed)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return
+}
+
+func (s *rebuildProgressStatements) UpsertRebuildProgress(
+	ctx context.Context, txn *sql.Tx, roomID string, position int64, completed bool,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertRebuildProgressStmt).ExecContext(ctx, roomID, position, completed)
+	return err
+}
+
+func (s *rebuildProgressStatements) DeleteRebuildProgress(
+	ctx context.Context, txn *sql.Tx,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteRebuildProgressStmt).ExecContext(ctx)
+	return err
+}
@@ -37,21 +37,23 @@ CREATE TABLE IF NOT EXISTS syncapi_receipts (
 	receipt_type TEXT NOT NULL,
 	user_id TEXT NOT NULL,
 	event_id TEXT NOT NULL,
+	-- The MSC3771 thread which the receipt applies to, or empty if it applies to the whole room
+	thread_id TEXT NOT NULL DEFAULT '',
 	receipt_ts BIGINT NOT NULL,
-	CONSTRAINT syncapi_receipts_unique UNIQUE (room_id, receipt_type, user_id)
+	CONSTRAINT syncapi_receipts_unique UNIQUE (room_id, receipt_type, user_id, thread_id)
 );
 CREATE INDEX IF NOT EXISTS syncapi_receipts_room_id_idx ON syncapi_receipts(room_id);
 `
 
 const upsertReceipt = "" +
 	"INSERT INTO syncapi_receipts" +
-	" (id, room_id, receipt_type, user_id, event_id, receipt_ts)" +
-	" VALUES ($1, $2, $3, $4, $5, $6)" +
-	" ON CONFLICT (room_id, receipt_type, user_id)" +
-	" DO UPDATE SET id = $7, event_id = $8, receipt_ts = $9"
+	" (id, room_id, receipt_type, user_id, event_id, thread_id, receipt_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7)" +
+	" ON CONFLICT (room_id, receipt_type, user_id, thread_id)" +
+	" DO UPDATE SET id = $8, event_id = $9, receipt_ts = $10"
 
 const selectRoomReceipts = "" +
-	"SELECT id, room_id, receipt_type, user_id, event_id, receipt_ts" +
+	"SELECT id, room_id, receipt_type, user_id, event_id, thread_id, receipt_ts" +
 	" FROM syncapi_receipts" +
 	" WHERE id > $1 and room_id in ($2)"
 
@@ -72,10 +74,10 @@ func NewSqliteReceiptsTable(db *sql.DB, streamID *StreamIDStatements) (tables.Re
 		return nil, err
 	}
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(sqlutil.Migration{
-		Version: "syncapi: fix sequences",
-		Up:      deltas.UpFixSequences,
-	})
+	m.AddMigrations(
+		deltas.FixSequencesMigration,
+		deltas.AddReceiptThreadIDMigration,
+	)
 	err = m.Up(context.Background())
 	if err != nil {
 		return nil, err
@@ -97,13 +99,13 @@ func NewSqliteReceiptsTable(db *sql.DB, streamID *StreamIDStatements) (tables.Re
 }
 
 // UpsertReceipt creates new user receipts
-func (r *receiptStatements) UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error) {
+func (r *receiptStatements) UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId, threadID string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error) {
 	pos, err = r.streamIDStatements.nextReceiptID(ctx, txn)
 	if err != nil {
 		return
 	}
 	stmt := sqlutil.TxStmt(txn, r.upsertReceipt)
-	_, err = stmt.ExecContext(ctx, pos, roomId, receiptType, userId, eventId, timestamp, pos, eventId, timestamp)
+	_, err = stmt.ExecContext(ctx, pos, roomId, receiptType, userId, eventId, threadID, timestamp, pos, eventId, timestamp)
 	return
 }
 
@@ -125,7 +127,7 @@ func (r *receiptStatements) SelectRoomReceiptsAfter(ctx context.Context, roomIDs
 	for rows.Next() {
 		r := types.OutputReceiptEvent{}
 		var id types.StreamPosition
-		err = rows.Scan(&id, &r.RoomID, &r.Type, &r.UserID, &r.EventID, &r.Timestamp)
+		err = rows.Scan(&id, &r.RoomID, &r.Type, &r.UserID, &r.EventID, &r.ThreadID, &r.Timestamp)
 		if err != nil {
 			return 0, res, fmt.Errorf("unable to scan row to api.Receipts: %w", err)
 		}
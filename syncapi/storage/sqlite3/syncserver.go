@@ -107,6 +107,14 @@ func (d *SyncServerDatasource) prepare() (err error) {
 	if err != nil {
 		return err
 	}
+	rebuildProgress, err := NewSqliteRebuildProgressTable(d.db)
+	if err != nil {
+		return err
+	}
+	forcedResyncs, err := NewSqliteForcedResyncsTable(d.db)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Writer:              d.writer,
@@ -124,6 +132,8 @@ func (d *SyncServerDatasource) prepare() (err error) {
 		NotificationData:    notificationData,
 		Ignores:             ignores,
 		Presence:            presence,
+		RebuildProgress:     rebuildProgress,
+		ForcedResyncs:       forcedResyncs,
 	}
 	return nil
 }
@@ -57,6 +57,180 @@ func TestWriteEvents(t *testing.T) {
 	})
 }
 
+func TestMaxStreamPositionsForRooms(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+		alice := test.NewUser(t)
+		r1 := test.NewRoom(t, alice)
+		r2 := test.NewRoom(t, alice)
+		r1Positions := MustWriteEvents(t, db, r1.Events())
+		r2Positions := MustWriteEvents(t, db, r2.Events())
+
+		positions, err := db.MaxStreamPositionsForRooms(ctx, []string{r1.ID, r2.ID, "!unknown:localhost"})
+		if err != nil {
+			t.Fatalf("MaxStreamPositionsForRooms returned %s", err)
+		}
+		want := map[string]types.StreamPosition{
+			r1.ID: r1Positions[len(r1Positions)-1],
+			r2.ID: r2Positions[len(r2Positions)-1],
+		}
+		if !reflect.DeepEqual(positions, want) {
+			t.Errorf("got positions %v, want %v", positions, want)
+		}
+	})
+}
+
+func TestRebuildRoomState(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+		alice := test.NewUser(t)
+		r := test.NewRoom(t, alice)
+		positions := MustWriteEvents(t, db, r.Events())
+
+		// The topic is in the roomserver's state but the sync API never saw it.
+		topic := r.CreateAndInsert(t, alice, "m.room.topic", map[string]interface{}{"topic": "rebuilt"}, test.WithStateKey(""))
+		if err := db.PurgeRoomState(ctx, r.ID); err != nil {
+			t.Fatalf("PurgeRoomState returned %s", err)
+		}
+		if err := db.RebuildRoomState(ctx, r.ID, r.CurrentState()); err != nil {
+			t.Fatalf("RebuildRoomState returned %s", err)
+		}
+
+		state, err := db.CurrentState(ctx, r.ID, &gomatrixserverlib.StateFilter{Limit: 100}, nil)
+		if err != nil {
+			t.Fatalf("CurrentState returned %s", err)
+		}
+		if len(state) != len(r.CurrentState()) {
+			t.Fatalf("got %d state events, want %d", len(state), len(r.CurrentState()))
+		}
+		ev, err := db.GetStateEvent(ctx, r.ID, "m.room.topic", "")
+		if err != nil || ev == nil || ev.EventID() != topic.EventID() {
+			t.Fatalf("topic wasn't added to the current state: %v %v", ev, err)
+		}
+
+		// The new event must not be sent down /sync, and events which were
+		// already known must keep their positions.
+		latest, err := db.MaxStreamPositionForPDUs(ctx)
+		if err != nil {
+			t.Fatalf("MaxStreamPositionForPDUs returned %s", err)
+		}
+		recent, _, err := db.RecentEvents(ctx, r.ID, types.Range{From: 0, To: latest}, &gomatrixserverlib.RoomEventFilter{Limit: 100}, true, true)
+		if err != nil {
+			t.Fatalf("RecentEvents returned %s", err)
+		}
+		if len(recent) != len(positions) {
+			t.Fatalf("got %d sync events, want %d", len(recent), len(positions))
+		}
+		for i := range recent {
+			if recent[i].StreamPosition != positions[i] {
+				t.Errorf("event %s moved from position %d to %d", recent[i].EventID(), positions[i], recent[i].StreamPosition)
+			}
+		}
+	})
+}
+
+func TestDeleteFilters(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+		filter := types.DefaultFilter()
+		filter.Room.Timeline.Limit = 5
+		aliceID, err := db.PutFilter(ctx, "alice", &filter)
+		if err != nil {
+			t.Fatalf("PutFilter returned %s", err)
+		}
+		bobID, err := db.PutFilter(ctx, "bob", &filter)
+		if err != nil {
+			t.Fatalf("PutFilter returned %s", err)
+		}
+
+		if err = db.DeleteFilters(ctx, "alice"); err != nil {
+			t.Fatalf("DeleteFilters returned %s", err)
+		}
+		var got types.Filter
+		if err = db.GetFilter(ctx, &got, "alice", aliceID); err == nil {
+			t.Errorf("alice's filter wasn't deleted")
+		}
+		if err = db.GetFilter(ctx, &got, "bob", bobID); err != nil {
+			t.Errorf("bob's filter was deleted: %s", err)
+		}
+	})
+}
+
+func TestForcedResyncs(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+		if err := db.ForceResync(ctx, "@alice:test", "ALICEDEVICE", 1000); err != nil {
+			t.Fatalf("ForceResync returned %s", err)
+		}
+		if err := db.ForceResync(ctx, "@alice:test", "OTHERDEVICE", 1000); err != nil {
+			t.Fatalf("ForceResync returned %s", err)
+		}
+		// Forcing a resync again just updates when it was forced.
+		if err := db.ForceResync(ctx, "@alice:test", "ALICEDEVICE", 3000); err != nil {
+			t.Fatalf("ForceResync returned %s", err)
+		}
+		if pending, err := db.ResyncPending(ctx, "@alice:test", "ALICEDEVICE"); err != nil || !pending {
+			t.Fatalf("expected a pending resync, got %v (%v)", pending, err)
+		}
+
+		if resync, err := db.ConsumeForcedResync(ctx, "@alice:test", "ALICEDEVICE"); err != nil || !resync {
+			t.Fatalf("expected the resync to be consumed, got %v (%v)", resync, err)
+		}
+		if resync, err := db.ConsumeForcedResync(ctx, "@alice:test", "ALICEDEVICE"); err != nil || resync {
+			t.Fatalf("expected the resync to only be consumed once, got %v (%v)", resync, err)
+		}
+		if pending, err := db.ResyncPending(ctx, "@alice:test", "OTHERDEVICE"); err != nil || !pending {
+			t.Fatalf("expected the other device to still have a pending resync, got %v (%v)", pending, err)
+		}
+
+		if err := db.ForceResync(ctx, "@alice:test", "ALICEDEVICE", 3000); err != nil {
+			t.Fatalf("ForceResync returned %s", err)
+		}
+		if err := db.PruneForcedResyncs(ctx, 2000); err != nil {
+			t.Fatalf("PruneForcedResyncs returned %s", err)
+		}
+		if pending, err := db.ResyncPending(ctx, "@alice:test", "OTHERDEVICE"); err != nil || pending {
+			t.Fatalf("expected an old resync to be pruned, got %v (%v)", pending, err)
+		}
+		if pending, err := db.ResyncPending(ctx, "@alice:test", "ALICEDEVICE"); err != nil || !pending {
+			t.Fatalf("expected a recent resync not to be pruned, got %v (%v)", pending, err)
+		}
+	})
+}
+
+func TestThreadedReceipts(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+		alice := test.NewUser(t)
+		room := test.NewRoom(t, alice)
+
+		// Receipts in different threads don't replace each other.
+		for i, threadID := range []string{"", "main", "$thread", "$thread"} {
+			_, err := db.StoreReceipt(ctx, room.ID, "m.read", alice.ID, fmt.Sprintf("$event%d", i), threadID, gomatrixserverlib.Timestamp(i))
+			if err != nil {
+				t.Fatalf("StoreReceipt returned %s", err)
+			}
+		}
+		receipts, err := db.GetRoomReceipts(ctx, []string{room.ID}, 0)
+		if err != nil {
+			t.Fatalf("GetRoomReceipts returned %s", err)
+		}
+		got := map[string]string{}
+		for _, receipt := range receipts {
+			got[receipt.ThreadID] = receipt.EventID
+		}
+		want := map[string]string{"": "$event0", "main": "$event1", "$thread": "$event3"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got receipts %v, want %v", got, want)
+		}
+	})
+}
+
 // These tests assert basic functionality of RecentEvents for PDUs
 func TestRecentEventsPDU(t *testing.T) {
 	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
@@ -160,6 +334,128 @@ func TestRecentEventsPDU(t *testing.T) {
 	})
 }
 
+// The purpose of this test is to make sure that the filter options behave the same way
+// for /sync, /messages and /context on every database backend.
+func TestRoomEventFilters(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+		alice := test.NewUser(t)
+		bob := test.NewUser(t)
+		r := test.NewRoom(t, alice)
+		bobJoin := r.CreateAndInsert(t, bob, "m.room.member", map[string]interface{}{"membership": "join"}, test.WithStateKey(bob.ID))
+		createEvents := r.Events()
+		text := r.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hi"})
+		image := r.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "pic", "url": "mxc://localhost/abc"})
+		underscore := r.CreateAndInsert(t, bob, "com_example", map[string]interface{}{})
+		lookalike := r.CreateAndInsert(t, bob, "comXexample", map[string]interface{}{})
+		events := r.Events()
+		MustWriteEvents(t, db, events)
+		withoutImage := append(append([]*gomatrixserverlib.HeaderedEvent{}, createEvents...), text, underscore, lookalike)
+
+		boolPtr := func(b bool) *bool { return &b }
+		testCases := []struct {
+			Name       string
+			Filter     gomatrixserverlib.RoomEventFilter
+			WantEvents []*gomatrixserverlib.HeaderedEvent
+		}{
+			{
+				Name:       "contains_url true",
+				Filter:     gomatrixserverlib.RoomEventFilter{ContainsURL: boolPtr(true)},
+				WantEvents: []*gomatrixserverlib.HeaderedEvent{image},
+			},
+			{
+				Name:       "contains_url false",
+				Filter:     gomatrixserverlib.RoomEventFilter{ContainsURL: boolPtr(false)},
+				WantEvents: withoutImage,
+			},
+			{
+				Name:       "types with SQL wildcard characters",
+				Filter:     gomatrixserverlib.RoomEventFilter{Types: &[]string{"com_example"}},
+				WantEvents: []*gomatrixserverlib.HeaderedEvent{underscore},
+			},
+			{
+				Name:       "types with wildcard",
+				Filter:     gomatrixserverlib.RoomEventFilter{Types: &[]string{"com*", "m.room.message"}},
+				WantEvents: []*gomatrixserverlib.HeaderedEvent{text, image, underscore, lookalike},
+			},
+			{
+				Name:       "not_types with wildcard",
+				Filter:     gomatrixserverlib.RoomEventFilter{NotTypes: &[]string{"m.room.*"}},
+				WantEvents: []*gomatrixserverlib.HeaderedEvent{underscore, lookalike},
+			},
+			{
+				Name:       "senders",
+				Filter:     gomatrixserverlib.RoomEventFilter{Senders: &[]string{bob.ID}},
+				WantEvents: []*gomatrixserverlib.HeaderedEvent{bobJoin, underscore, lookalike},
+			},
+			{
+				Name: "not_senders and types",
+				Filter: gomatrixserverlib.RoomEventFilter{
+					NotSenders: &[]string{bob.ID},
+					Types:      &[]string{"m.room.message"},
+				},
+				WantEvents: []*gomatrixserverlib.HeaderedEvent{text, image},
+			},
+		}
+
+		latest, err := db.MaxStreamPositionForPDUs(ctx)
+		if err != nil {
+			t.Fatalf("failed to get MaxStreamPositionForPDUs: %s", err)
+		}
+		maxTopo, err := db.MaxTopologicalPosition(ctx, r.ID)
+		if err != nil {
+			t.Fatalf("failed to get MaxTopologicalPosition: %s", err)
+		}
+		createID, _, err := db.SelectContextEvent(ctx, r.ID, events[0].EventID())
+		if err != nil {
+			t.Fatalf("failed to get SelectContextEvent: %s", err)
+		}
+
+		for _, tc := range testCases {
+			filter := tc.Filter
+			filter.Limit = 100
+			t.Run(tc.Name, func(t *testing.T) {
+				// The Go filtering used for backfilled events should agree with the database.
+				var matched []*gomatrixserverlib.HeaderedEvent
+				for _, ev := range events {
+					if types.RoomEventAllowed(&filter, ev) {
+						matched = append(matched, ev)
+					}
+				}
+				test.AssertEventsEqual(t, matched, tc.WantEvents)
+
+				// /sync
+				streamEvents, _, err := db.RecentEvents(ctx, r.ID, types.Range{From: 0, To: latest}, &filter, true, true)
+				if err != nil {
+					t.Fatalf("RecentEvents returned %s", err)
+				}
+				test.AssertEventsEqual(t, db.StreamEventsToEvents(nil, streamEvents), tc.WantEvents)
+
+				// /messages
+				streamEvents, err = db.GetEventsInTopologicalRange(ctx, &types.TopologyToken{}, &maxTopo, r.ID, &filter, false)
+				if err != nil {
+					t.Fatalf("GetEventsInTopologicalRange returned %s", err)
+				}
+				test.AssertEventsEqual(t, db.StreamEventsToEvents(nil, streamEvents), tc.WantEvents)
+
+				// /context, starting from the create event
+				_, after, err := db.SelectContextAfterEvent(ctx, createID, r.ID, &filter)
+				if err != nil {
+					t.Fatalf("SelectContextAfterEvent returned %s", err)
+				}
+				var wantAfter []*gomatrixserverlib.HeaderedEvent
+				for _, ev := range tc.WantEvents {
+					if ev.EventID() != events[0].EventID() {
+						wantAfter = append(wantAfter, ev)
+					}
+				}
+				test.AssertEventsEqual(t, after, wantAfter)
+			})
+		}
+	})
+}
+
 // The purpose of this test is to ensure that backfill does indeed go backwards, using a topology token
 func TestGetEventsInRangeWithTopologyToken(t *testing.T) {
 	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
@@ -53,6 +53,9 @@ type Peeks interface {
 type Events interface {
 	SelectStateInRange(ctx context.Context, txn *sql.Tx, r types.Range, stateFilter *gomatrixserverlib.StateFilter, roomIDs []string) (map[string]map[string]bool, map[string]types.StreamEvent, error)
 	SelectMaxEventID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+	// SelectMaxStreamPositionsForRooms returns the stream position of the latest event in each of the given rooms.
+	// Rooms without any events are not included in the result.
+	SelectMaxStreamPositionsForRooms(ctx context.Context, txn *sql.Tx, roomIDs []string) (map[string]types.StreamPosition, error)
 	InsertEvent(
 		ctx context.Context, txn *sql.Tx,
 		event *gomatrixserverlib.HeaderedEvent,
@@ -94,6 +97,9 @@ type Topology interface {
 	SelectMaxPositionInTopology(ctx context.Context, txn *sql.Tx, roomID string) (depth types.StreamPosition, spos types.StreamPosition, err error)
 	// SelectStreamToTopologicalPosition converts a stream position to a topological position by finding the nearest topological position in the room.
 	SelectStreamToTopologicalPosition(ctx context.Context, txn *sql.Tx, roomID string, streamPos types.StreamPosition, forward bool) (topoPos types.StreamPosition, err error)
+	// SelectEventIDAtTimestamp returns the event closest to the given timestamp, looking forwards or backwards in time.
+	// Returns sql.ErrNoRows if there is no event in that direction.
+	SelectEventIDAtTimestamp(ctx context.Context, txn *sql.Tx, roomID string, ts gomatrixserverlib.Timestamp, forward bool) (eventID string, originServerTS gomatrixserverlib.Timestamp, err error)
 }
 
 type CurrentRoomState interface {
@@ -171,12 +177,14 @@ type SendToDevice interface {
 }
 
 type Filter interface {
-	SelectFilter(ctx context.Context, target *gomatrixserverlib.Filter, localpart string, filterID string) error
-	InsertFilter(ctx context.Context, filter *gomatrixserverlib.Filter, localpart string) (filterID string, err error)
+	SelectFilter(ctx context.Context, target *types.Filter, localpart string, filterID string) error
+	InsertFilter(ctx context.Context, filter *types.Filter, localpart string) (filterID string, err error)
+	// DeleteFilters removes all of the filters for a local user.
+	DeleteFilters(ctx context.Context, txn *sql.Tx, localpart string) error
 }
 
 type Receipts interface {
-	UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
+	UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId, threadID string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
 	SelectRoomReceiptsAfter(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []types.OutputReceiptEvent, error)
 	SelectMaxReceiptID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
@@ -188,11 +196,28 @@ type Memberships interface {
 }
 
 type NotificationData interface {
-	UpsertRoomUnreadCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int) (types.StreamPosition, error)
+	UpsertRoomUnreadCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int, threads map[string]eventutil.ThreadNotificationData) (types.StreamPosition, error)
 	SelectUserUnreadCounts(ctx context.Context, userID string, fromExcl, toIncl types.StreamPosition) (map[string]*eventutil.NotificationData, error)
 	SelectMaxID(ctx context.Context) (int64, error)
 }
 
+// RebuildProgress tracks how far each room has got when rebuilding the sync API
+// from the roomserver, so that an interrupted rebuild can be resumed.
+type RebuildProgress interface {
+	SelectRebuildProgress(ctx context.Context, txn *sql.Tx, roomID string) (position int64, completed bool, err error)
+	UpsertRebuildProgress(ctx context.Context, txn *sql.Tx, roomID string, position int64, completed bool) error
+	DeleteRebuildProgress(ctx context.Context, txn *sql.Tx) error
+}
+
+// ForcedResyncs stores the devices which an admin has forced to do a complete
+// sync the next time that they sync.
+type ForcedResyncs interface {
+	UpsertForcedResync(ctx context.Context, txn *sql.Tx, userID, deviceID string, ts gomatrixserverlib.Timestamp) error
+	SelectForcedResync(ctx context.Context, txn *sql.Tx, userID, deviceID string) (bool, error)
+	DeleteForcedResync(ctx context.Context, txn *sql.Tx, userID, deviceID string) (deleted bool, err error)
+	DeleteForcedResyncsBefore(ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp) error
+}
+
 type Ignores interface {
 	SelectIgnores(ctx context.Context, userID string) (*types.IgnoredUsers, error)
 	UpsertIgnores(ctx context.Context, userID string, ignores *types.IgnoredUsers) error
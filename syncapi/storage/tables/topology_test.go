@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -13,6 +14,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func newTopologyTable(t *testing.T, dbType test.DBType) (tables.Topology, *sql.DB, func()) {
@@ -89,3 +91,64 @@ func TestTopologyTable(t *testing.T) {
 		}
 	})
 }
+
+func TestTopologyTableEventIDAtTimestamp(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	// Create events one minute apart, starting well after the room creation events.
+	start := time.Now().Add(time.Hour)
+	var msgs []*gomatrixserverlib.HeaderedEvent
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{
+			"body": fmt.Sprintf("message %d", i),
+		}, test.WithTimestamp(start.Add(time.Duration(i)*time.Minute))))
+	}
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, db, close := newTopologyTable(t, dbType)
+		defer close()
+		err := sqlutil.WithTransaction(db, func(txn *sql.Tx) error {
+			for i, ev := range room.Events() {
+				if _, err := tab.InsertEventInTopology(ctx, txn, ev, types.StreamPosition(i)); err != nil {
+					return fmt.Errorf("failed to InsertEventInTopology: %s", err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		testCases := []struct {
+			name    string
+			ts      time.Time
+			forward bool
+			wantID  string
+		}{
+			{name: "exact forward", ts: start, forward: true, wantID: msgs[0].EventID()},
+			{name: "exact backward", ts: start.Add(time.Minute), forward: false, wantID: msgs[1].EventID()},
+			{name: "between forward", ts: start.Add(90 * time.Second), forward: true, wantID: msgs[2].EventID()},
+			{name: "between backward", ts: start.Add(90 * time.Second), forward: false, wantID: msgs[1].EventID()},
+			{name: "after last backward", ts: start.Add(time.Hour), forward: false, wantID: msgs[2].EventID()},
+			{name: "after last forward", ts: start.Add(time.Hour), forward: true},
+		}
+		for _, tc := range testCases {
+			eventID, ts, err := tab.SelectEventIDAtTimestamp(ctx, nil, room.ID, gomatrixserverlib.AsTimestamp(tc.ts), tc.forward)
+			if tc.wantID == "" {
+				if err != sql.ErrNoRows {
+					t.Fatalf("%s: expected sql.ErrNoRows, got event %q (err %v)", tc.name, eventID, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: failed to SelectEventIDAtTimestamp: %s", tc.name, err)
+			}
+			if eventID != tc.wantID {
+				t.Fatalf("%s: got event %s want %s", tc.name, eventID, tc.wantID)
+			}
+			if tc.forward && ts < gomatrixserverlib.AsTimestamp(tc.ts) || !tc.forward && ts > gomatrixserverlib.AsTimestamp(tc.ts) {
+				t.Fatalf("%s: returned timestamp %d is in the wrong direction", tc.name, ts)
+			}
+		}
+	})
+}
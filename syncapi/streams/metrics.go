@@ -0,0 +1,80 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var streamProviderDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "stream_provider_duration_milliseconds",
+		Help:      "How long it takes a stream provider to add its updates to a sync response",
+		Buckets: []float64{ // milliseconds
+			1, 5, 10, 25, 50, 75, 100, 250, 500,
+			1000, 2000, 3000, 4000, 5000, 10000, 20000,
+		},
+	},
+	// stream is the name of the stream provider, and type is "initial" for
+	// a complete sync or "incremental" otherwise.
+	[]string{"stream", "type"},
+)
+
+func init() {
+	prometheus.MustRegister(streamProviderDuration)
+}
+
+// timedStreamProvider records how long the stream provider that it wraps
+// takes to build each part of a sync response.
+type timedStreamProvider struct {
+	types.StreamProvider
+	name string
+}
+
+func withTiming(name string, provider types.StreamProvider) types.StreamProvider {
+	return &timedStreamProvider{
+		StreamProvider: provider,
+		name:           name,
+	}
+}
+
+func (p *timedStreamProvider) observe(syncType string, started time.Time) {
+	streamProviderDuration.WithLabelValues(p.name, syncType).Observe(
+		float64(time.Since(started).Milliseconds()),
+	)
+}
+
+func (p *timedStreamProvider) CompleteSync(
+	ctx context.Context,
+	req *types.SyncRequest,
+) types.StreamPosition {
+	defer p.observe("initial", time.Now())
+	return p.StreamProvider.CompleteSync(ctx, req)
+}
+
+func (p *timedStreamProvider) IncrementalSync(
+	ctx context.Context,
+	req *types.SyncRequest,
+	from, to types.StreamPosition,
+) types.StreamPosition {
+	defer p.observe("incremental", time.Now())
+	return p.StreamProvider.IncrementalSync(ctx, req, from, to)
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// slowStreamProvider takes a known amount of time to add its updates.
+type slowStreamProvider struct {
+	types.StreamProvider
+	delay time.Duration
+}
+
+func (p *slowStreamProvider) CompleteSync(ctx context.Context, req *types.SyncRequest) types.StreamPosition {
+	time.Sleep(p.delay)
+	return 10
+}
+
+func (p *slowStreamProvider) IncrementalSync(ctx context.Context, req *types.SyncRequest, from, to types.StreamPosition) types.StreamPosition {
+	time.Sleep(p.delay)
+	return to
+}
+
+func TestTimedStreamProvider(t *testing.T) {
+	delay := time.Millisecond * 20
+	provider := withTiming("TestTimedStreamProvider", &slowStreamProvider{delay: delay})
+
+	if pos := provider.CompleteSync(context.Background(), &types.SyncRequest{}); pos != 10 {
+		t.Fatalf("expected the wrapped provider's position 10, got %d", pos)
+	}
+	for i := 0; i < 2; i++ {
+		if pos := provider.IncrementalSync(context.Background(), &types.SyncRequest{}, 10, 12); pos != 12 {
+			t.Fatalf("expected the wrapped provider's position 12, got %d", pos)
+		}
+	}
+
+	for syncType, want := range map[string]uint64{"initial": 1, "incremental": 2} {
+		var m dto.Metric
+		observer := streamProviderDuration.WithLabelValues("TestTimedStreamProvider", syncType)
+		if err := observer.(prometheus.Metric).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.GetHistogram().GetSampleCount(); got != want {
+			t.Errorf("expected %d %s syncs to be recorded, got %d", want, syncType, got)
+		}
+		if got := m.GetHistogram().GetSampleSum(); got < float64(want)*float64(delay.Milliseconds()) {
+			t.Errorf("expected %s syncs to take at least %s each, got a total of %vms", syncType, delay, got)
+		}
+	}
+}
@@ -2,12 +2,17 @@ package streams
 
 import (
 	"context"
+	"encoding/json"
 
 	"github.com/matrix-org/dendrite/syncapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
+// deletedAccountData is the content sent to clients for account data
+// which has been deleted.
+var deletedAccountData = json.RawMessage("{}")
+
 type AccountDataStreamProvider struct {
 	StreamProvider
 	userAPI userapi.SyncUserAPI
@@ -43,13 +48,48 @@ func (p *AccountDataStreamProvider) IncrementalSync(
 		To:   to,
 	}
 
-	dataTypes, pos, err := p.DB.GetAccountDataInRange(
+	// Global and room account data have their own filters, so we need to
+	// query for them separately.
+	globalDataTypes, pos, err := p.DB.GetAccountDataInRange(
 		ctx, req.Device.UserID, r, &req.Filter.AccountData,
 	)
 	if err != nil {
 		req.Log.WithError(err).Error("p.DB.GetAccountDataInRange failed")
 		return from
 	}
+	roomFilter := &req.Filter.Room.AccountData
+	roomDataTypes, roomPos, err := p.DB.GetAccountDataInRange(
+		ctx, req.Device.UserID, r, &gomatrixserverlib.EventFilter{
+			Limit:      roomFilter.Limit,
+			NotSenders: roomFilter.NotSenders,
+			NotTypes:   roomFilter.NotTypes,
+			Senders:    roomFilter.Senders,
+			Types:      roomFilter.Types,
+		},
+	)
+	if err != nil {
+		req.Log.WithError(err).Error("p.DB.GetAccountDataInRange failed")
+		return from
+	}
+	// If either query hit its limit then we need to pick up from the lower
+	// position next time, even if that means resending some account data.
+	if roomPos < pos {
+		pos = roomPos
+	}
+
+	dataTypes := map[string][]string{}
+	if global, ok := globalDataTypes[""]; ok {
+		dataTypes[""] = global
+	}
+	for roomID, roomData := range roomDataTypes {
+		if roomID == "" || !req.Filter.AllowsRoom(roomID) {
+			continue
+		}
+		if !types.RoomAllowed(roomFilter.Rooms, roomFilter.NotRooms, roomID) {
+			continue
+		}
+		dataTypes[roomID] = roomData
+	}
 
 	// Iterate over the rooms
 	for roomID, dataTypes := range dataTypes {
@@ -72,8 +112,16 @@ func (p *AccountDataStreamProvider) IncrementalSync(
 				req.Log.WithError(err).Error("p.userAPI.QueryAccountData failed")
 				continue
 			}
+			// Account data which has changed in this range but no longer
+			// exists has been deleted. Clients are told about that with
+			// empty content (MSC3391), but there's nothing to tell them in
+			// a complete sync.
 			if roomID == "" {
-				if globalData, ok := dataRes.GlobalAccountData[dataType]; ok {
+				globalData, ok := dataRes.GlobalAccountData[dataType]
+				if !ok && from > 0 {
+					globalData, ok = deletedAccountData, true
+				}
+				if ok {
 					req.Response.AccountData.Events = append(
 						req.Response.AccountData.Events,
 						gomatrixserverlib.ClientEvent{
@@ -83,7 +131,11 @@ func (p *AccountDataStreamProvider) IncrementalSync(
 					)
 				}
 			} else {
-				if roomData, ok := dataRes.RoomAccountData[roomID][dataType]; ok {
+				roomData, ok := dataRes.RoomAccountData[roomID][dataType]
+				if !ok && from > 0 {
+					roomData, ok = deletedAccountData, true
+				}
+				if ok {
 					joinData := *types.NewJoinResponse()
 					if existing, ok := req.Response.Rooms.Join[roomID]; ok {
 						joinData = existing
@@ -54,6 +54,9 @@ func (p *InviteStreamProvider) IncrementalSync(
 	}
 
 	for roomID, inviteEvent := range invites {
+		if !req.Filter.AllowsRoom(roomID) {
+			continue
+		}
 		// skip ignored user events
 		if _, ok := req.IgnoredUsers.List[inviteEvent.Sender()]; ok {
 			continue
@@ -63,6 +66,9 @@ func (p *InviteStreamProvider) IncrementalSync(
 	}
 
 	for roomID := range retiredInvites {
+		if !req.Filter.AllowsRoom(roomID) {
+			continue
+		}
 		if _, ok := req.Response.Rooms.Join[roomID]; !ok {
 			lr := types.NewLeaveResponse()
 			h := sha256.Sum256(append([]byte(roomID), []byte(strconv.FormatInt(int64(to), 10))...))
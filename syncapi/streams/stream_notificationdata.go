@@ -49,6 +49,20 @@ func (p *NotificationDataStreamProvider) IncrementalSync(
 
 		jr.UnreadNotifications.HighlightCount = counts.UnreadHighlightCount
 		jr.UnreadNotifications.NotificationCount = counts.UnreadNotificationCount
+
+		// If the client asked for MSC3773 thread counts then the room
+		// counts only cover the main timeline.
+		if req.Filter.UnreadThreadNotifications {
+			jr.UnreadThreadNotifications = make(map[string]types.UnreadNotifications, len(counts.Threads))
+			for threadID, thread := range counts.Threads {
+				jr.UnreadThreadNotifications[threadID] = types.UnreadNotifications{
+					HighlightCount:    thread.UnreadHighlightCount,
+					NotificationCount: thread.UnreadNotificationCount,
+				}
+				jr.UnreadNotifications.HighlightCount -= thread.UnreadHighlightCount
+				jr.UnreadNotifications.NotificationCount -= thread.UnreadNotificationCount
+			}
+		}
 		req.Response.Rooms.Join[roomID] = jr
 	}
 	return to
@@ -96,6 +96,7 @@ func (p *PDUStreamProvider) CompleteSync(
 		req.Log.WithError(err).Error("p.DB.RoomIDsWithMembership failed")
 		return from
 	}
+	joinedRoomIDs = filterRoomIDs(&req.Filter, joinedRoomIDs)
 
 	stateFilter := req.Filter.Room.State
 	eventFilter := req.Filter.Room.Timeline
@@ -146,7 +147,7 @@ func (p *PDUStreamProvider) CompleteSync(
 		return from
 	}
 	for _, peek := range peeks {
-		if !peek.Deleted {
+		if !peek.Deleted && req.Filter.AllowsRoom(peek.RoomID) {
 			var jr *types.JoinResponse
 			jr, err = p.getJoinResponseForCompleteSync(
 				ctx, peek.RoomID, r, &stateFilter, &eventFilter, req.WantFullState, req.Device,
@@ -159,6 +160,10 @@ func (p *PDUStreamProvider) CompleteSync(
 		}
 	}
 
+	if req.Filter.Room.IncludeLeave {
+		p.addLeftRoomsForCompleteSync(ctx, req, &stateFilter, &eventFilter)
+	}
+
 	return to
 }
 
@@ -192,7 +197,7 @@ func (p *PDUStreamProvider) IncrementalSync(
 		}
 	}
 
-	for _, roomID := range joinedRooms {
+	for _, roomID := range filterRoomIDs(&req.Filter, joinedRooms) {
 		req.Rooms[roomID] = gomatrixserverlib.Join
 	}
 
@@ -206,6 +211,9 @@ func (p *PDUStreamProvider) IncrementalSync(
 
 	newPos = from
 	for _, delta := range stateDeltas {
+		if !req.Filter.AllowsRoom(delta.RoomID) {
+			continue
+		}
 		var pos types.StreamPosition
 		if pos, err = p.addRoomDeltaToResponse(ctx, req.Device, r, delta, &eventFilter, &stateFilter, req.Response); err != nil {
 			req.Log.WithError(err).Error("d.addRoomDeltaToResponse failed")
@@ -241,15 +249,23 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 		// This is all "okay" assuming history_visibility == "shared" which it is by default.
 		r.To = delta.MembershipPos
 	}
-	recentStreamEvents, limited, err := p.DB.RecentEvents(
-		ctx, delta.RoomID, r,
-		eventFilter, true, true,
-	)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return r.To, nil
+	var recentStreamEvents []types.StreamEvent
+	var limited bool
+	var err error
+	if types.RoomAllowed(eventFilter.Rooms, eventFilter.NotRooms, delta.RoomID) {
+		recentStreamEvents, limited, err = p.DB.RecentEvents(
+			ctx, delta.RoomID, r,
+			eventFilter, true, true,
+		)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return r.To, nil
+			}
+			return r.From, fmt.Errorf("p.DB.RecentEvents: %w", err)
 		}
-		return r.From, fmt.Errorf("p.DB.RecentEvents: %w", err)
+	}
+	if !types.RoomAllowed(stateFilter.Rooms, stateFilter.NotRooms, delta.RoomID) {
+		delta.StateEvents = nil
 	}
 	recentEvents := p.DB.StreamEventsToEvents(device, recentStreamEvents)
 	delta.StateEvents = removeDuplicates(delta.StateEvents, recentEvents) // roll back
@@ -394,14 +410,18 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	jr = types.NewJoinResponse()
 	// TODO: When filters are added, we may need to call this multiple times to get enough events.
 	//       See: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L316
-	recentStreamEvents, limited, err := p.DB.RecentEvents(
-		ctx, roomID, r, eventFilter, true, true,
-	)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return jr, nil
+	var recentStreamEvents []types.StreamEvent
+	var limited bool
+	if types.RoomAllowed(eventFilter.Rooms, eventFilter.NotRooms, roomID) {
+		recentStreamEvents, limited, err = p.DB.RecentEvents(
+			ctx, roomID, r, eventFilter, true, true,
+		)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return jr, nil
+			}
+			return
 		}
-		return
 	}
 
 	// TODO FIXME: We don't fully implement history visibility yet. To avoid leaking events which the
@@ -445,9 +465,12 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 		}
 	}
 
-	stateEvents, err := p.DB.CurrentState(ctx, roomID, stateFilter, excludingEventIDs)
-	if err != nil {
-		return
+	var stateEvents []*gomatrixserverlib.HeaderedEvent
+	if types.RoomAllowed(stateFilter.Rooms, stateFilter.NotRooms, roomID) {
+		stateEvents, err = p.DB.CurrentState(ctx, roomID, stateFilter, excludingEventIDs)
+		if err != nil {
+			return
+		}
 	}
 
 	// Retrieve the backward topology position, i.e. the position of the
@@ -573,11 +596,179 @@ func (p *PDUStreamProvider) addIgnoredUsersToFilter(ctx context.Context, req *ty
 		userList = append(userList, userID)
 	}
 	if len(userList) > 0 {
+		// Keep any not_senders from the filter itself. This builds a new
+		// slice so that the filter in the request isn't modified.
+		if eventFilter.NotSenders != nil {
+			userList = append(userList, *eventFilter.NotSenders...)
+		}
 		eventFilter.NotSenders = &userList
 	}
 	return nil
 }
 
+// filterRoomIDs returns the room IDs which are allowed by the rooms and
+// not_rooms lists of the filter.
+func filterRoomIDs(filter *types.Filter, roomIDs []string) []string {
+	if filter.Room.Rooms == nil && filter.Room.NotRooms == nil {
+		return roomIDs
+	}
+	allowed := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if filter.AllowsRoom(roomID) {
+			allowed = append(allowed, roomID)
+		}
+	}
+	return allowed
+}
+
+// addLeftRoomsForCompleteSync adds the rooms that the user has left or been
+// banned from to a complete sync, for filters with include_leave set. Only
+// rooms which the user was joined to are added, and the timeline and state
+// are taken from while they were joined, so that nothing which happened
+// before they joined or after they left is leaked.
+func (p *PDUStreamProvider) addLeftRoomsForCompleteSync(
+	ctx context.Context,
+	req *types.SyncRequest,
+	stateFilter *gomatrixserverlib.StateFilter,
+	eventFilter *gomatrixserverlib.RoomEventFilter,
+) {
+	for _, membership := range []string{gomatrixserverlib.Leave, gomatrixserverlib.Ban} {
+		roomIDs, err := p.DB.RoomIDsWithMembership(ctx, req.Device.UserID, membership)
+		if err != nil {
+			req.Log.WithError(err).Error("p.DB.RoomIDsWithMembership failed")
+			return
+		}
+		for _, roomID := range filterRoomIDs(&req.Filter, roomIDs) {
+			lr, err := p.getLeaveResponseForCompleteSync(ctx, roomID, stateFilter, eventFilter, req.Device)
+			if err != nil {
+				req.Log.WithError(err).WithField("room_id", roomID).Error("p.getLeaveResponseForCompleteSync failed")
+				continue
+			}
+			if lr != nil {
+				req.Response.Rooms.Leave[roomID] = *lr
+			}
+		}
+	}
+}
+
+func (p *PDUStreamProvider) getLeaveResponseForCompleteSync(
+	ctx context.Context,
+	roomID string,
+	stateFilter *gomatrixserverlib.StateFilter,
+	eventFilter *gomatrixserverlib.RoomEventFilter,
+	device *userapi.Device,
+) (*types.LeaveResponse, error) {
+	membershipEvent, err := p.DB.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, device.UserID)
+	if err != nil || membershipEvent == nil {
+		return nil, err
+	}
+	joinEvent, leaveEvent, err := p.lastMembership(ctx, roomID, device.UserID, membershipEvent)
+	if err != nil || joinEvent == nil {
+		return nil, err
+	}
+	_, joinPos, err := p.DB.PositionInTopology(ctx, joinEvent.EventID())
+	if err != nil {
+		return nil, fmt.Errorf("p.DB.PositionInTopology: %w", err)
+	}
+	_, leavePos, err := p.DB.PositionInTopology(ctx, leaveEvent.EventID())
+	if err != nil {
+		return nil, fmt.Errorf("p.DB.PositionInTopology: %w", err)
+	}
+
+	lr := types.NewLeaveResponse()
+	var recentEvents []*gomatrixserverlib.HeaderedEvent
+	if types.RoomAllowed(eventFilter.Rooms, eventFilter.NotRooms, roomID) {
+		// As with joined rooms, we don't show anything from before the user
+		// joined, which is equivalent to history_visibility: joined. The
+		// range doesn't include its lower bound, so start just before the
+		// join so that the join itself is included.
+		r := types.Range{
+			From:      leavePos,
+			To:        joinPos - 1,
+			Backwards: true,
+		}
+		recentStreamEvents, limited, err := p.DB.RecentEvents(ctx, roomID, r, eventFilter, true, true)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("p.DB.RecentEvents: %w", err)
+		}
+		if len(recentStreamEvents) > 0 {
+			prevBatch, err := p.DB.GetBackwardTopologyPos(ctx, recentStreamEvents)
+			if err != nil {
+				return nil, fmt.Errorf("p.DB.GetBackwardTopologyPos: %w", err)
+			}
+			lr.Timeline.PrevBatch = &prevBatch
+		}
+		recentEvents = p.DB.StreamEventsToEvents(device, recentStreamEvents)
+		lr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
+		lr.Timeline.Limited = limited
+	}
+
+	if types.RoomAllowed(stateFilter.Rooms, stateFilter.NotRooms, roomID) {
+		stateRes := &roomserverAPI.QueryStateAfterEventsResponse{}
+		if err = p.rsAPI.QueryStateAfterEvents(ctx, &roomserverAPI.QueryStateAfterEventsRequest{
+			RoomID:       roomID,
+			PrevEventIDs: []string{leaveEvent.EventID()},
+		}, stateRes); err != nil {
+			return nil, fmt.Errorf("p.rsAPI.QueryStateAfterEvents: %w", err)
+		}
+		stateEvents := make([]*gomatrixserverlib.HeaderedEvent, 0, len(stateRes.StateEvents))
+		for _, ev := range stateRes.StateEvents {
+			if types.EventAllowed(stateFilter.Senders, stateFilter.NotSenders, stateFilter.Types, stateFilter.NotTypes, ev.Sender(), ev.Type()) {
+				stateEvents = append(stateEvents, ev)
+			}
+		}
+		stateEvents = removeDuplicates(stateEvents, recentEvents)
+		if stateFilter.Limit > 0 && len(stateEvents) > stateFilter.Limit {
+			stateEvents = stateEvents[:stateFilter.Limit]
+		}
+		lr.State.Events = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync)
+	}
+	return lr, nil
+}
+
+// lastMembership works back from the user's current membership event in the
+// room to find the join event which started the last time that they were
+// joined, and the leave or ban event which ended it. The user may have been
+// invited again since, and rejected the invite, so this is not always the
+// current membership event. Returns a nil join event if the user was never
+// joined to the room.
+func (p *PDUStreamProvider) lastMembership(
+	ctx context.Context, roomID, userID string, membershipEvent *gomatrixserverlib.HeaderedEvent,
+) (joinEvent, leaveEvent *gomatrixserverlib.HeaderedEvent, err error) {
+	leaveEvent = membershipEvent
+	for ev := membershipEvent; ev != nil; {
+		membership, err := ev.Membership()
+		if err != nil {
+			return nil, nil, fmt.Errorf("ev.Membership: %w", err)
+		}
+		switch membership {
+		case gomatrixserverlib.Join:
+			return ev, leaveEvent, nil
+		case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
+			leaveEvent = ev
+		}
+
+		// Find the membership of the user before this event.
+		stateRes := &roomserverAPI.QueryStateAfterEventsResponse{}
+		if err = p.rsAPI.QueryStateAfterEvents(ctx, &roomserverAPI.QueryStateAfterEventsRequest{
+			RoomID:       roomID,
+			PrevEventIDs: ev.PrevEventIDs(),
+			StateToFetch: []gomatrixserverlib.StateKeyTuple{
+				{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+			},
+		}, stateRes); err != nil {
+			return nil, nil, fmt.Errorf("p.rsAPI.QueryStateAfterEvents: %w", err)
+		}
+		ev = nil
+		for _, stateEv := range stateRes.StateEvents {
+			if stateEv.Type() == gomatrixserverlib.MRoomMember && stateEv.StateKeyEquals(userID) {
+				ev = stateEv
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
 func removeDuplicates(stateEvents, recentEvents []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.HeaderedEvent {
 	for _, recentEv := range recentEvents {
 		if recentEv.StateKey() == nil {
@@ -99,6 +99,10 @@ func (p *PresenceStreamProvider) IncrementalSync(
 		if presence == nil {
 			continue
 		}
+		filter := &req.Filter.Presence
+		if !types.EventAllowed(filter.Senders, filter.NotSenders, filter.Types, filter.NotTypes, presence.UserID, gomatrixserverlib.MPresence) {
+			continue
+		}
 		// Ignore users we don't share a room with
 		if req.Device.UserID != presence.UserID && !p.notifier.IsSharedUser(req.Device.UserID, presence.UserID) {
 			continue
@@ -34,9 +34,14 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 	req *types.SyncRequest,
 	from, to types.StreamPosition,
 ) types.StreamPosition {
+	filter := &req.Filter.Room.Ephemeral
+	if !types.EventAllowed(nil, nil, filter.Types, filter.NotTypes, "", gomatrixserverlib.MReceipt) {
+		return to
+	}
+
 	var joinedRooms []string
 	for roomID, membership := range req.Rooms {
-		if membership == gomatrixserverlib.Join {
+		if membership == gomatrixserverlib.Join && types.RoomAllowed(filter.Rooms, filter.NotRooms, roomID) {
 			joinedRooms = append(joinedRooms, roomID)
 		}
 	}
@@ -58,6 +63,9 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 		if _, ok := req.IgnoredUsers.List[receipt.UserID]; ok {
 			continue
 		}
+		if !types.EventAllowed(filter.Senders, filter.NotSenders, nil, nil, receipt.UserID, gomatrixserverlib.MReceipt) {
+			continue
+		}
 		receiptsByRoom[receipt.RoomID] = append(receiptsByRoom[receipt.RoomID], receipt)
 	}
 
@@ -85,7 +93,7 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 					User: make(map[string]ReceiptTS),
 				}
 			}
-			read.User[receipt.UserID] = ReceiptTS{TS: receipt.Timestamp}
+			read.User[receipt.UserID] = ReceiptTS{TS: receipt.Timestamp, ThreadID: receipt.ThreadID}
 			content[receipt.EventID] = read
 		}
 		ev.Content, err = json.Marshal(content)
@@ -106,5 +114,6 @@ type ReceiptMRead struct {
 }
 
 type ReceiptTS struct {
-	TS gomatrixserverlib.Timestamp `json:"ts"`
+	TS       gomatrixserverlib.Timestamp `json:"ts"`
+	ThreadID string                      `json:"thread_id,omitempty"`
 }
@@ -26,11 +26,19 @@ func (p *TypingStreamProvider) IncrementalSync(
 	req *types.SyncRequest,
 	from, to types.StreamPosition,
 ) types.StreamPosition {
+	filter := &req.Filter.Room.Ephemeral
+	if !types.EventAllowed(nil, nil, filter.Types, filter.NotTypes, "", gomatrixserverlib.MTyping) {
+		return to
+	}
+
 	var err error
 	for roomID, membership := range req.Rooms {
 		if membership != gomatrixserverlib.Join {
 			continue
 		}
+		if !types.RoomAllowed(filter.Rooms, filter.NotRooms, roomID) {
+			continue
+		}
 
 		jr := *types.NewJoinResponse()
 		if existing, ok := req.Response.Rooms.Join[roomID]; ok {
@@ -43,7 +51,11 @@ func (p *TypingStreamProvider) IncrementalSync(
 			typingUsers := make([]string, 0, len(users))
 			for i := range users {
 				// skip ignored user events
-				if _, ok := req.IgnoredUsers.List[users[i]]; !ok {
+				if _, ok := req.IgnoredUsers.List[users[i]]; ok {
+					continue
+				}
+				// the typing users are treated as the senders for the filter
+				if types.EventAllowed(filter.Senders, filter.NotSenders, nil, nil, users[i], gomatrixserverlib.MTyping) {
 					typingUsers = append(typingUsers, users[i])
 				}
 			}
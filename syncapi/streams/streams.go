@@ -30,41 +30,41 @@ func NewSyncStreamProviders(
 	eduCache *caching.EDUCache, lazyLoadCache caching.LazyLoadCache, notifier *notifier.Notifier,
 ) *Streams {
 	streams := &Streams{
-		PDUStreamProvider: &PDUStreamProvider{
+		PDUStreamProvider: withTiming("pdu", &PDUStreamProvider{
 			StreamProvider: StreamProvider{DB: d},
 			lazyLoadCache:  lazyLoadCache,
 			rsAPI:          rsAPI,
 			notifier:       notifier,
-		},
-		TypingStreamProvider: &TypingStreamProvider{
+		}),
+		TypingStreamProvider: withTiming("typing", &TypingStreamProvider{
 			StreamProvider: StreamProvider{DB: d},
 			EDUCache:       eduCache,
-		},
-		ReceiptStreamProvider: &ReceiptStreamProvider{
+		}),
+		ReceiptStreamProvider: withTiming("receipt", &ReceiptStreamProvider{
 			StreamProvider: StreamProvider{DB: d},
-		},
-		InviteStreamProvider: &InviteStreamProvider{
+		}),
+		InviteStreamProvider: withTiming("invite", &InviteStreamProvider{
 			StreamProvider: StreamProvider{DB: d},
-		},
-		SendToDeviceStreamProvider: &SendToDeviceStreamProvider{
+		}),
+		SendToDeviceStreamProvider: withTiming("send_to_device", &SendToDeviceStreamProvider{
 			StreamProvider: StreamProvider{DB: d},
-		},
-		AccountDataStreamProvider: &AccountDataStreamProvider{
+		}),
+		AccountDataStreamProvider: withTiming("account_data", &AccountDataStreamProvider{
 			StreamProvider: StreamProvider{DB: d},
 			userAPI:        userAPI,
-		},
-		NotificationDataStreamProvider: &NotificationDataStreamProvider{
+		}),
+		NotificationDataStreamProvider: withTiming("notification_data", &NotificationDataStreamProvider{
 			StreamProvider: StreamProvider{DB: d},
-		},
-		DeviceListStreamProvider: &DeviceListStreamProvider{
+		}),
+		DeviceListStreamProvider: withTiming("device_list", &DeviceListStreamProvider{
 			StreamProvider: StreamProvider{DB: d},
 			rsAPI:          rsAPI,
 			keyAPI:         keyAPI,
-		},
-		PresenceStreamProvider: &PresenceStreamProvider{
+		}),
+		PresenceStreamProvider: withTiming("presence", &PresenceStreamProvider{
 			StreamProvider: StreamProvider{DB: d},
 			notifier:       notifier,
-		},
+		}),
 	}
 
 	streams.PDUStreamProvider.Setup()
@@ -93,3 +93,17 @@ func (s *Streams) Latest(ctx context.Context) types.StreamingToken {
 		PresencePosition:         s.PresenceStreamProvider.LatestPosition(ctx),
 	}
 }
+
+// Advance advances each stream to its position in the token, if that is
+// later than the latest position the stream knows about.
+func (s *Streams) Advance(token types.StreamingToken) {
+	s.PDUStreamProvider.Advance(token.PDUPosition)
+	s.TypingStreamProvider.Advance(token.TypingPosition)
+	s.ReceiptStreamProvider.Advance(token.ReceiptPosition)
+	s.InviteStreamProvider.Advance(token.InvitePosition)
+	s.SendToDeviceStreamProvider.Advance(token.SendToDevicePosition)
+	s.AccountDataStreamProvider.Advance(token.AccountDataPosition)
+	s.NotificationDataStreamProvider.Advance(token.NotificationDataPosition)
+	s.DeviceListStreamProvider.Advance(token.DeviceListPosition)
+	s.PresenceStreamProvider.Advance(token.PresencePosition)
+}
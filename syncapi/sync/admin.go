@@ -0,0 +1,103 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// deviceSyncTimeout is how long the last /sync request of a device, and a
+// resync which was forced on a device, are remembered for. Devices which
+// haven't synced for longer than this are forgotten about, so that the sync
+// state of every device that ever synced isn't kept around forever.
+const deviceSyncTimeout = time.Hour
+
+// DeviceSync is the last /sync request that we saw from a device.
+//
+// This is only known by the sync API instance which handled the request, so
+// in deployments with more than one sync API instance the admin endpoints only
+// see the last sync of devices which sync with the instance that they are sent
+// to. Forced resyncs are stored in the database and are seen by every instance.
+type DeviceSync struct {
+	Since types.StreamingToken
+	Time  time.Time
+}
+
+type deviceKey struct {
+	userID   string
+	deviceID string
+}
+
+// LastSync returns the last /sync request made by a device within the
+// device sync timeout, if there was one.
+func (rp *RequestPool) LastSync(userID, deviceID string) (DeviceSync, bool) {
+	v, ok := rp.deviceSyncs.Load(deviceKey{userID, deviceID})
+	if !ok {
+		return DeviceSync{}, false
+	}
+	return v.(DeviceSync), true
+}
+
+// ForceResync makes the next /sync request from a device ignore its since
+// token, so that the device receives a complete sync. The resync is dropped
+// if the device doesn't sync within the device sync timeout.
+func (rp *RequestPool) ForceResync(ctx context.Context, userID, deviceID string) error {
+	return rp.db.ForceResync(ctx, userID, deviceID, gomatrixserverlib.AsTimestamp(time.Now()))
+}
+
+// ResyncPending returns true if the device has been forced to resync but
+// hasn't synced since.
+func (rp *RequestPool) ResyncPending(ctx context.Context, userID, deviceID string) (bool, error) {
+	return rp.db.ResyncPending(ctx, userID, deviceID)
+}
+
+// startSync records a /sync request from a device and returns true if the
+// device has been forced to resync.
+func (rp *RequestPool) startSync(req *types.SyncRequest) bool {
+	rp.deviceSyncs.Store(deviceKey{req.Device.UserID, req.Device.ID}, DeviceSync{Since: req.Since, Time: time.Now()})
+	resync, err := rp.db.ConsumeForcedResync(req.Context, req.Device.UserID, req.Device.ID)
+	if err != nil {
+		req.Log.WithError(err).Error("rp.db.ConsumeForcedResync failed")
+		return false
+	}
+	return resync
+}
+
+// cleanDeviceSyncs forgets the devices which haven't synced, or been forced
+// to resync, within the device sync timeout.
+func (rp *RequestPool) cleanDeviceSyncs() {
+	for {
+		time.Sleep(time.Minute)
+		rp.pruneDeviceSyncs(time.Now())
+	}
+}
+
+func (rp *RequestPool) pruneDeviceSyncs(now time.Time) {
+	rp.deviceSyncs.Range(func(key, v interface{}) bool {
+		if now.Sub(v.(DeviceSync).Time) > deviceSyncTimeout {
+			rp.deviceSyncs.Delete(key)
+		}
+		return true
+	})
+	before := gomatrixserverlib.AsTimestamp(now.Add(-deviceSyncTimeout))
+	if err := rp.db.PruneForcedResyncs(context.Background(), before); err != nil {
+		logrus.WithError(err).Error("rp.db.PruneForcedResyncs failed")
+	}
+}
@@ -0,0 +1,497 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// The legacy /events and /initialSync APIs were deprecated in favour of
+// /sync, but are still used by some older clients and bridges. They are
+// served from the same stream providers as /sync, and their tokens are
+// ordinary streaming tokens, so a client can pass the end token of an
+// /initialSync to /events.
+
+// legacyEventsTimeout is how long /events waits for events by default.
+// Unlike /sync, it long-polls unless the client asks it not to.
+const legacyEventsTimeout = 30 * time.Second
+
+// legacyEventsTimelineLimit is the most events returned for a room by a
+// single /events request. Clients which fall further behind than this will
+// miss events and should call /initialSync again.
+const legacyEventsTimelineLimit = 500
+
+type legacyPaginationChunk struct {
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	Start string                          `json:"start"`
+	End   string                          `json:"end"`
+}
+
+type legacyRoom struct {
+	RoomID      string                          `json:"room_id"`
+	Membership  string                          `json:"membership"`
+	Invite      *gomatrixserverlib.ClientEvent  `json:"invite,omitempty"`
+	Messages    *legacyPaginationChunk          `json:"messages,omitempty"`
+	State       []gomatrixserverlib.ClientEvent `json:"state"`
+	AccountData []gomatrixserverlib.ClientEvent `json:"account_data"`
+	// Presence is only included by /rooms/{roomID}/initialSync.
+	Presence []gomatrixserverlib.ClientEvent `json:"presence,omitempty"`
+}
+
+type legacyInitialSyncResponse struct {
+	End         string                          `json:"end"`
+	Rooms       []legacyRoom                    `json:"rooms"`
+	Presence    []gomatrixserverlib.ClientEvent `json:"presence"`
+	AccountData []gomatrixserverlib.ClientEvent `json:"account_data"`
+}
+
+// OnIncomingInitialSyncRequest implements the deprecated GET /initialSync.
+func (rp *RequestPool) OnIncomingInitialSyncRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	syncReq, resErr := rp.newLegacySyncRequest(req, device)
+	if resErr != nil {
+		return *resErr
+	}
+	syncReq.Filter.Room.IncludeLeave = req.URL.Query().Get("archived") == "true"
+
+	rp.updateLastSeen(req, device)
+	rp.updatePresence(rp.db, "", device.UserID)
+
+	end := rp.legacyCompleteSync(syncReq)
+	res := legacyInitialSyncResponse{
+		End:         end.String(),
+		Rooms:       legacyRooms(device.UserID, syncReq.Response, end),
+		Presence:    syncReq.Response.Presence.Events,
+		AccountData: syncReq.Response.AccountData.Events,
+	}
+	if res.Presence == nil {
+		res.Presence = []gomatrixserverlib.ClientEvent{}
+	}
+	if res.AccountData == nil {
+		res.AccountData = []gomatrixserverlib.ClientEvent{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// OnIncomingRoomInitialSyncRequest implements the deprecated
+// GET /rooms/{roomID}/initialSync. The messages chunk can be paginated
+// backwards with /rooms/{roomID}/messages from its start token.
+func (rp *RequestPool) OnIncomingRoomInitialSyncRequest(req *http.Request, device *userapi.Device, roomID string) util.JSONResponse {
+	syncReq, resErr := rp.newLegacySyncRequest(req, device)
+	if resErr != nil {
+		return *resErr
+	}
+	syncReq.Filter.Room.Rooms = &[]string{roomID}
+	syncReq.Filter.Room.IncludeLeave = true
+
+	// Left rooms are only included if the user was joined to them, and then
+	// only with what happened while they were joined. Invited rooms aren't
+	// returned, as the user can't see anything in them yet.
+	end := rp.legacyCompleteSync(syncReq)
+	var room *legacyRoom
+	for _, r := range legacyRooms(device.UserID, syncReq.Response, end) {
+		if r.RoomID == roomID && r.Membership != gomatrixserverlib.Invite {
+			r := r
+			room = &r
+			break
+		}
+	}
+	if room == nil {
+		var err error
+		if room, err = rp.legacyWorldReadableRoom(syncReq, roomID, end); err != nil {
+			syncReq.Log.WithError(err).Error("rp.legacyWorldReadableRoom failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	if room == nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+		}
+	}
+
+	// Only include the presence of the room's current members.
+	members := map[string]struct{}{}
+	for _, ev := range room.State {
+		if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil &&
+			gjson.GetBytes(ev.Content, "membership").Str == gomatrixserverlib.Join {
+			members[*ev.StateKey] = struct{}{}
+		}
+	}
+	room.Presence = []gomatrixserverlib.ClientEvent{}
+	for _, ev := range syncReq.Response.Presence.Events {
+		if _, ok := members[ev.Sender]; ok {
+			room.Presence = append(room.Presence, ev)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: room,
+	}
+}
+
+// OnIncomingEventsRequest implements the deprecated GET /events. It returns
+// the events that the user can see which happened after the from token,
+// waiting for some if there aren't any yet. If no from token is given then
+// it starts from now.
+func (rp *RequestPool) OnIncomingEventsRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	syncReq, resErr := rp.newLegacySyncRequest(req, device)
+	if resErr != nil {
+		return *resErr
+	}
+	syncReq.Filter.Room.Timeline.Limit = legacyEventsTimelineLimit
+	if roomID := req.URL.Query().Get("room_id"); roomID != "" {
+		joined, err := rp.db.RoomIDsWithMembership(req.Context(), device.UserID, gomatrixserverlib.Join)
+		if err != nil {
+			syncReq.Log.WithError(err).Error("rp.db.RoomIDsWithMembership failed")
+			return jsonerror.InternalServerError()
+		}
+		isJoined := false
+		for _, joinedRoomID := range joined {
+			isJoined = isJoined || joinedRoomID == roomID
+		}
+		if !isJoined {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You aren't a member of the room."),
+			}
+		}
+		syncReq.Filter.Room.Rooms = &[]string{roomID}
+	} else if device.AccountType == userapi.AccountTypeGuest {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.GuestAccessForbidden("Guests can only call /events for a room."),
+		}
+	}
+	syncReq.Timeout = legacyEventsTimeout
+	if timeout := req.URL.Query().Get("timeout"); timeout != "" {
+		syncReq.Timeout = getTimeout(timeout)
+	}
+	if from := req.URL.Query().Get("from"); from != "" {
+		var err error
+		if syncReq.Since, err = types.NewStreamTokenFromString(from); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("bad 'from' value"),
+			}
+		}
+	} else {
+		syncReq.Since = rp.Notifier.CurrentPosition()
+	}
+	start := syncReq.Since
+
+	activeSyncRequests.Inc()
+	defer activeSyncRequests.Dec()
+
+	rp.updateLastSeen(req, device)
+	rp.updatePresence(rp.db, "", device.UserID)
+
+	for {
+		startTime := time.Now()
+		currentPos := rp.Notifier.CurrentPosition()
+		if !currentPos.IsAfter(syncReq.Since) && syncReq.Timeout > 0 {
+			if !rp.waitForEvents(syncReq) {
+				return legacyEventsResponse(nil, start, syncReq.Since)
+			}
+			currentPos = rp.Notifier.CurrentPosition()
+		}
+
+		end := currentPos
+		syncReq.Response = types.NewResponse()
+		end.PDUPosition = rp.streams.PDUStreamProvider.IncrementalSync(
+			syncReq.Context, syncReq, syncReq.Since.PDUPosition, currentPos.PDUPosition,
+		)
+		end.TypingPosition = rp.streams.TypingStreamProvider.IncrementalSync(
+			syncReq.Context, syncReq, syncReq.Since.TypingPosition, currentPos.TypingPosition,
+		)
+		end.ReceiptPosition = rp.streams.ReceiptStreamProvider.IncrementalSync(
+			syncReq.Context, syncReq, syncReq.Since.ReceiptPosition, currentPos.ReceiptPosition,
+		)
+		end.InvitePosition = rp.streams.InviteStreamProvider.IncrementalSync(
+			syncReq.Context, syncReq, syncReq.Since.InvitePosition, currentPos.InvitePosition,
+		)
+		end.PresencePosition = rp.streams.PresenceStreamProvider.IncrementalSync(
+			syncReq.Context, syncReq, syncReq.Since.PresencePosition, currentPos.PresencePosition,
+		)
+
+		chunk := legacyEventsChunk(device.UserID, syncReq.Response)
+		if len(chunk) == 0 && syncReq.Timeout > 0 {
+			// Something changed which /events doesn't return, like a
+			// send-to-device message, so carry on waiting.
+			syncReq.Since = end
+			syncReq.Timeout -= time.Since(startTime)
+			if syncReq.Timeout < 0 {
+				syncReq.Timeout = 0
+			}
+			continue
+		}
+		return legacyEventsResponse(chunk, start, end)
+	}
+}
+
+// waitForEvents waits for the notifier to wake the request up, returning
+// false if the request timed out or the client gave up first.
+func (rp *RequestPool) waitForEvents(syncReq *types.SyncRequest) bool {
+	waitingSyncRequests.Inc()
+	defer waitingSyncRequests.Dec()
+
+	timer := time.NewTimer(syncReq.Timeout)
+	defer timer.Stop()
+	listener := rp.Notifier.GetListener(*syncReq)
+	defer listener.Close()
+
+	select {
+	case <-syncReq.Context.Done():
+		return false
+	case <-timer.C:
+		return false
+	case <-listener.GetNotifyChannel(syncReq.Since):
+		return true
+	}
+}
+
+func legacyEventsResponse(chunk []gomatrixserverlib.ClientEvent, start, end types.StreamingToken) util.JSONResponse {
+	if chunk == nil {
+		chunk = []gomatrixserverlib.ClientEvent{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: legacyPaginationChunk{
+			Chunk: chunk,
+			Start: start.String(),
+			End:   end.String(),
+		},
+	}
+}
+
+// newLegacySyncRequest returns a /sync request for the legacy APIs, with
+// the timeline limit taken from the limit parameter.
+func (rp *RequestPool) newLegacySyncRequest(req *http.Request, device *userapi.Device) (*types.SyncRequest, *util.JSONResponse) {
+	filter := types.DefaultFilter()
+	filter.AccountData.Limit = math.MaxInt32
+	filter.Room.AccountData.Limit = math.MaxInt32
+	if limit := req.URL.Query().Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 0 {
+			return nil, &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a non-negative integer"),
+			}
+		}
+		filter.Room.Timeline.Limit = l
+	}
+	return &types.SyncRequest{
+		Context: req.Context(),
+		Log: util.GetLogger(req.Context()).WithFields(logrus.Fields{
+			"user_id":   device.UserID,
+			"device_id": device.ID,
+		}),
+		Device:   device,
+		Response: types.NewResponse(),
+		Filter:   filter,
+		Rooms:    make(map[string]string),
+	}, nil
+}
+
+// legacyCompleteSync runs the streams needed for /initialSync, returning
+// the token to pass to /events to get what happened afterwards.
+func (rp *RequestPool) legacyCompleteSync(syncReq *types.SyncRequest) types.StreamingToken {
+	end := rp.Notifier.CurrentPosition()
+	end.PDUPosition = rp.streams.PDUStreamProvider.CompleteSync(syncReq.Context, syncReq)
+	end.InvitePosition = rp.streams.InviteStreamProvider.CompleteSync(syncReq.Context, syncReq)
+	end.AccountDataPosition = rp.streams.AccountDataStreamProvider.CompleteSync(syncReq.Context, syncReq)
+	end.PresencePosition = rp.streams.PresenceStreamProvider.CompleteSync(syncReq.Context, syncReq)
+	return end
+}
+
+// legacyWorldReadableRoom returns the recent events and current state of a
+// room which the user was never joined to, if anyone can read its history.
+// Returns nil if the room isn't world readable.
+func (rp *RequestPool) legacyWorldReadableRoom(syncReq *types.SyncRequest, roomID string, end types.StreamingToken) (*legacyRoom, error) {
+	ctx := syncReq.Context
+	hisVisEvent, err := rp.db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomHistoryVisibility, "")
+	if err != nil || hisVisEvent == nil {
+		return nil, err
+	}
+	if hisVis, err := hisVisEvent.HistoryVisibility(); err != nil || hisVis != gomatrixserverlib.WorldReadable {
+		return nil, nil
+	}
+
+	r := types.Range{
+		From:      end.PDUPosition,
+		To:        0,
+		Backwards: true,
+	}
+	recentStreamEvents, _, err := rp.db.RecentEvents(ctx, roomID, r, &syncReq.Filter.Room.Timeline, true, true)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("rp.db.RecentEvents: %w", err)
+	}
+	var prevBatch *types.TopologyToken
+	if len(recentStreamEvents) > 0 {
+		token, err := rp.db.GetBackwardTopologyPos(ctx, recentStreamEvents)
+		if err != nil {
+			return nil, fmt.Errorf("rp.db.GetBackwardTopologyPos: %w", err)
+		}
+		prevBatch = &token
+	}
+	stateEvents, err := rp.db.CurrentState(ctx, roomID, &syncReq.Filter.Room.State, nil)
+	if err != nil {
+		return nil, fmt.Errorf("rp.db.CurrentState: %w", err)
+	}
+
+	// The user might have a membership in the room even though they were
+	// never joined, e.g. if they rejected an invite.
+	membership := gomatrixserverlib.Leave
+	if ev, err := rp.db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, syncReq.Device.UserID); err == nil && ev != nil {
+		membership, _ = ev.Membership()
+	}
+
+	recentEvents := rp.db.StreamEventsToEvents(syncReq.Device, recentStreamEvents)
+	room := newLegacyRoom(
+		roomID, membership,
+		gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync),
+		gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync),
+		prevBatch, end,
+	)
+	return &room, nil
+}
+
+// legacyRooms converts the rooms in a complete /sync response into the
+// /initialSync format, sorted by room ID.
+func legacyRooms(userID string, res *types.Response, end types.StreamingToken) []legacyRoom {
+	rooms := make([]legacyRoom, 0, len(res.Rooms.Join)+len(res.Rooms.Invite)+len(res.Rooms.Leave))
+	for roomID, jr := range res.Rooms.Join {
+		room := newLegacyRoom(roomID, gomatrixserverlib.Join, jr.State.Events, jr.Timeline.Events, jr.Timeline.PrevBatch, end)
+		room.AccountData = withRoomID(roomID, jr.AccountData.Events)
+		rooms = append(rooms, room)
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		rooms = append(rooms, newLegacyRoom(roomID, gomatrixserverlib.Leave, lr.State.Events, lr.Timeline.Events, lr.Timeline.PrevBatch, end))
+	}
+	for roomID, ir := range res.Rooms.Invite {
+		room := legacyRoom{
+			RoomID:      roomID,
+			Membership:  gomatrixserverlib.Invite,
+			State:       []gomatrixserverlib.ClientEvent{},
+			AccountData: []gomatrixserverlib.ClientEvent{},
+		}
+		for _, raw := range ir.InviteState.Events {
+			var ev gomatrixserverlib.ClientEvent
+			if err := json.Unmarshal(raw, &ev); err != nil {
+				continue
+			}
+			ev.RoomID = roomID
+			if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil && *ev.StateKey == userID {
+				invite := ev
+				room.Invite = &invite
+			}
+			room.State = append(room.State, ev)
+		}
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+	return rooms
+}
+
+// newLegacyRoom returns a room with the given timeline as its messages. The
+// state is the state at the end of the timeline, rather than at the start
+// of it as in /sync.
+func newLegacyRoom(
+	roomID, membership string, state, timeline []gomatrixserverlib.ClientEvent,
+	prevBatch *types.TopologyToken, end types.StreamingToken,
+) legacyRoom {
+	timeline = withRoomID(roomID, timeline)
+	room := legacyRoom{
+		RoomID:      roomID,
+		Membership:  membership,
+		State:       []gomatrixserverlib.ClientEvent{},
+		AccountData: []gomatrixserverlib.ClientEvent{},
+		Messages: &legacyPaginationChunk{
+			Chunk: timeline,
+			Start: end.String(),
+			End:   end.String(),
+		},
+	}
+	if prevBatch != nil {
+		room.Messages.Start = prevBatch.String()
+	}
+
+	indexes := map[gomatrixserverlib.StateKeyTuple]int{}
+	for _, ev := range append(withRoomID(roomID, state), timeline...) {
+		if ev.StateKey == nil {
+			continue
+		}
+		tuple := gomatrixserverlib.StateKeyTuple{EventType: ev.Type, StateKey: *ev.StateKey}
+		if i, ok := indexes[tuple]; ok {
+			room.State[i] = ev
+			continue
+		}
+		indexes[tuple] = len(room.State)
+		room.State = append(room.State, ev)
+	}
+	return room
+}
+
+// legacyEventsChunk flattens an incremental /sync response into the list
+// of events returned by /events, with each room's events in order.
+func legacyEventsChunk(userID string, res *types.Response) []gomatrixserverlib.ClientEvent {
+	var chunk []gomatrixserverlib.ClientEvent
+	for _, room := range legacyRooms(userID, res, types.StreamingToken{}) {
+		switch room.Membership {
+		case gomatrixserverlib.Invite:
+			if room.Invite != nil {
+				chunk = append(chunk, *room.Invite)
+			}
+		default:
+			chunk = append(chunk, room.Messages.Chunk...)
+		}
+		if jr, ok := res.Rooms.Join[room.RoomID]; ok {
+			chunk = append(chunk, withRoomID(room.RoomID, jr.Ephemeral.Events)...)
+		}
+	}
+	return append(chunk, res.Presence.Events...)
+}
+
+// withRoomID returns a copy of the events with the room ID set, which the
+// legacy APIs include but /sync leaves out.
+func withRoomID(roomID string, events []gomatrixserverlib.ClientEvent) []gomatrixserverlib.ClientEvent {
+	withID := make([]gomatrixserverlib.ClientEvent, len(events))
+	for i, ev := range events {
+		ev.RoomID = roomID
+		withID[i] = ev
+	}
+	return withID
+}
@@ -0,0 +1,83 @@
+package sync
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+func stateEvent(eventID, eventType, stateKey string) gomatrixserverlib.ClientEvent {
+	return gomatrixserverlib.ClientEvent{EventID: eventID, Type: eventType, StateKey: &stateKey}
+}
+
+func TestLegacyRooms(t *testing.T) {
+	res := types.NewResponse()
+	jr := types.NewJoinResponse()
+	jr.State.Events = []gomatrixserverlib.ClientEvent{
+		stateEvent("$create", "m.room.create", ""),
+		stateEvent("$topic1", "m.room.topic", ""),
+	}
+	jr.Timeline.Events = []gomatrixserverlib.ClientEvent{
+		{EventID: "$msg", Type: "m.room.message"},
+		stateEvent("$topic2", "m.room.topic", ""),
+	}
+	jr.Timeline.PrevBatch = &types.TopologyToken{Depth: 2, PDUPosition: 5}
+	jr.Ephemeral.Events = []gomatrixserverlib.ClientEvent{{Type: "m.typing"}}
+	res.Rooms.Join["!b:test"] = *jr
+
+	invite := stateEvent("$invite", "m.room.member", "@alice:test")
+	invite.Content = gomatrixserverlib.RawJSON(`{"membership":"invite"}`)
+	rawInvite, _ := json.Marshal(invite)
+	ir := types.InviteResponse{}
+	ir.InviteState.Events = []json.RawMessage{rawInvite}
+	res.Rooms.Invite["!a:test"] = ir
+
+	end := types.StreamingToken{PDUPosition: 10}
+	rooms := legacyRooms("@alice:test", res, end)
+	if len(rooms) != 2 || rooms[0].RoomID != "!a:test" || rooms[1].RoomID != "!b:test" {
+		t.Fatalf("unexpected rooms %+v", rooms)
+	}
+
+	invited := rooms[0]
+	if invited.Membership != gomatrixserverlib.Invite || invited.Invite == nil || invited.Invite.EventID != "$invite" {
+		t.Fatalf("unexpected invited room %+v", invited)
+	}
+	if invited.Invite.RoomID != "!a:test" {
+		t.Errorf("invite has room ID %q", invited.Invite.RoomID)
+	}
+
+	joined := rooms[1]
+	if joined.Messages.Start != jr.Timeline.PrevBatch.String() || joined.Messages.End != end.String() {
+		t.Errorf("unexpected pagination tokens %q %q", joined.Messages.Start, joined.Messages.End)
+	}
+	// The state is the state after the timeline, so the topic is replaced.
+	if len(joined.State) != 2 || joined.State[1].EventID != "$topic2" {
+		t.Errorf("unexpected state %+v", joined.State)
+	}
+	for _, ev := range append(joined.State, joined.Messages.Chunk...) {
+		if ev.RoomID != "!b:test" {
+			t.Errorf("event %s has room ID %q", ev.EventID, ev.RoomID)
+		}
+	}
+	if jr.Timeline.Events[0].RoomID != "" {
+		t.Errorf("the /sync response was modified")
+	}
+
+	chunk := legacyEventsChunk("@alice:test", res)
+	var got []string
+	for _, ev := range chunk {
+		got = append(got, ev.Type+" "+ev.RoomID)
+	}
+	want := []string{"m.room.member !a:test", "m.room.message !b:test", "m.room.topic !b:test", "m.typing !b:test"}
+	if len(got) != len(want) {
+		t.Fatalf("got chunk %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got chunk %v, want %v", got, want)
+		}
+	}
+}
@@ -47,7 +47,7 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 		}
 	}
 	// TODO: read from stored filters too
-	filter := gomatrixserverlib.DefaultFilter()
+	filter := types.DefaultFilter()
 	if since.IsEmpty() {
 		// Send as much account data down for complete syncs as possible
 		// by default, otherwise clients do weird things while waiting
@@ -55,16 +55,38 @@ type RequestPool struct {
 	Notifier *notifier.Notifier
 	producer PresencePublisher
 	consumer PresenceConsumer
+	// The other sync API instances, if there are any.
+	replicator PresenceReplicator
+
+	slidingConns *slidingConns
+
+	deviceSyncs *sync.Map // deviceKey -> DeviceSync
+}
+
+// localPresence is the presence of a local user who is syncing.
+type localPresence struct {
+	presence     types.Presence
+	lastActiveTS gomatrixserverlib.Timestamp // when the user last did something
+	publishedTS  gomatrixserverlib.Timestamp // the last active time we last published
+	lastSync     time.Time                   // when the user last synced with any instance
+	sharedSync   time.Time                   // when we last told the other instances that the user synced
 }
 
 type PresencePublisher interface {
-	SendPresence(userID string, presence types.Presence, statusMsg *string) error
+	SendPresence(userID string, presence types.Presence, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp) error
 }
 
 type PresenceConsumer interface {
 	EmitPresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, ts gomatrixserverlib.Timestamp, fromSync bool)
 }
 
+// PresenceReplicator tells the other sync API instances when local users
+// sync or do something.
+type PresenceReplicator interface {
+	PublishSync(userID string, ts gomatrixserverlib.Timestamp)
+	PublishActivity(userID string, ts gomatrixserverlib.Timestamp)
+}
+
 // NewRequestPool makes a new RequestPool
 func NewRequestPool(
 	db storage.Database, cfg *config.SyncAPI,
@@ -75,7 +97,31 @@ func NewRequestPool(
 ) *RequestPool {
 	if enableMetrics {
 		prometheus.MustRegister(
-			activeSyncRequests, waitingSyncRequests,
+			activeSyncRequests, waitingSyncRequests, syncResponseDuration,
+			prometheus.NewGaugeFunc(
+				prometheus.GaugeOpts{
+					Namespace: "dendrite",
+					Subsystem: "syncapi",
+					Name:      "notifier_streams",
+					Help:      "The number of user device streams which the notifier is keeping track of",
+				},
+				func() float64 {
+					streams, _ := notifier.Listeners()
+					return float64(streams)
+				},
+			),
+			prometheus.NewGaugeFunc(
+				prometheus.GaugeOpts{
+					Namespace: "dendrite",
+					Subsystem: "syncapi",
+					Name:      "notifier_listeners",
+					Help:      "The number of listeners which are waiting to be woken by the notifier",
+				},
+				func() float64 {
+					_, waiting := notifier.Listeners()
+					return float64(waiting)
+				},
+			),
 		)
 	}
 	rp := &RequestPool{
@@ -90,9 +136,15 @@ func NewRequestPool(
 		Notifier: notifier,
 		producer: producer,
 		consumer: consumer,
+		slidingConns: &slidingConns{
+			conns: map[slidingDeviceKey]map[string]*slidingConn{},
+		},
+		deviceSyncs: &sync.Map{},
 	}
 	go rp.cleanLastSeen()
-	go rp.cleanPresence(db, time.Minute*5)
+	go rp.cleanSlidingConns()
+	go rp.cleanDeviceSyncs()
+	go rp.cleanPresence(db, cfg.Matrix.Presence.IdleTimeout, cfg.Matrix.Presence.OfflineTimeout)
 	return rp
 }
 
@@ -106,29 +158,50 @@ func (rp *RequestPool) cleanLastSeen() {
 	}
 }
 
-func (rp *RequestPool) cleanPresence(db storage.Presence, cleanupTime time.Duration) {
+// SetPresenceReplicator shares the presence of local users with the other
+// sync API instances. Every instance which a user syncs with tracks their
+// presence, and hears about their syncs and activity on the others, so
+// that a user isn't marked offline by one instance while they are still
+// syncing with another.
+func (rp *RequestPool) SetPresenceReplicator(r PresenceReplicator) {
+	rp.replicator = r
+}
+
+// cleanPresence marks local users who haven't done anything for the idle
+// timeout as unavailable, and users who haven't synced for the offline
+// timeout as offline, after which they are no longer tracked.
+func (rp *RequestPool) cleanPresence(db storage.Presence, idleTimeout, offlineTimeout time.Duration) {
 	if !rp.cfg.Matrix.Presence.EnableOutbound {
 		return
 	}
 	for {
 		rp.presence.Range(func(key interface{}, v interface{}) bool {
-			p := v.(types.PresenceInternal)
-			if time.Since(p.LastActiveTS.Time()) > cleanupTime {
-				rp.updatePresence(db, types.PresenceUnavailable.String(), p.UserID)
+			p := v.(localPresence)
+			switch {
+			case time.Since(p.lastSync) > offlineTimeout:
+				rp.setPresence(db, key.(string), types.PresenceOffline, p.lastActiveTS)
 				rp.presence.Delete(key)
+			case p.presence == types.PresenceOnline && time.Since(p.lastActiveTS.Time()) > idleTimeout:
+				rp.setPresence(db, key.(string), types.PresenceUnavailable, p.lastActiveTS)
 			}
 			return true
 		})
-		time.Sleep(cleanupTime)
+		time.Sleep(idleTimeout / 5)
 	}
 }
 
-// updatePresence sends presence updates to the SyncAPI and FederationAPI
+// updatePresence is called whenever a local user syncs. Syncing brings an
+// offline user online but doesn't otherwise count as activity, so a user
+// who has gone idle stays unavailable while their client keeps syncing,
+// until they do something or their client explicitly sets them online.
+// A client which starts syncing again after the idle timeout has come
+// back though, so that does count as activity.
 func (rp *RequestPool) updatePresence(db storage.Presence, presence string, userID string) {
 	if !rp.cfg.Matrix.Presence.EnableOutbound {
 		return
 	}
-	if presence == "" {
+	explicit := presence != ""
+	if !explicit {
 		presence = types.PresenceOnline.String()
 	}
 
@@ -137,33 +210,114 @@ func (rp *RequestPool) updatePresence(db storage.Presence, presence string, user
 		return
 	}
 
-	newPresence := types.PresenceInternal{
-		Presence:     presenceID,
-		UserID:       userID,
-		LastActiveTS: gomatrixserverlib.AsTimestamp(time.Now()),
+	now := time.Now()
+	lastActiveTS := gomatrixserverlib.AsTimestamp(now)
+	existing, ok := rp.presence.Load(userID)
+	p, _ := existing.(localPresence)
+	lastSync := p.lastSync
+	p.lastSync = now
+	// Other instances only need to hear often enough that they don't mark
+	// the user offline while they are syncing with this one.
+	if rp.replicator != nil && now.Sub(p.sharedSync) > rp.cfg.Matrix.Presence.OfflineTimeout/4 {
+		p.sharedSync = now
+		rp.replicator.PublishSync(userID, lastActiveTS)
+	}
+	rp.presence.Store(userID, p)
+	if ok {
+		returned := now.Sub(lastSync) > rp.cfg.Matrix.Presence.IdleTimeout
+		// avoid spamming presence updates when syncing
+		if p.presence == presenceID || (!explicit && !returned && p.presence == types.PresenceUnavailable) {
+			return
+		}
+		if presenceID != types.PresenceOnline {
+			lastActiveTS = p.lastActiveTS
+		}
+	}
+	rp.setPresence(db, userID, presenceID, lastActiveTS)
+}
+
+// MarkActive records that a local user did something, like sending an
+// event or a read receipt, bringing them back online if they were idle.
+// Activity by a user who is already online is only published once they
+// would otherwise stop being currently active, so that it doesn't flood
+// other users with presence updates.
+func (rp *RequestPool) MarkActive(userID string, ts gomatrixserverlib.Timestamp) {
+	if !rp.cfg.Matrix.Presence.EnableOutbound {
+		return
+	}
+	// Only the elected instance consumes the events and receipts which
+	// count as activity, so it tells the others about the activity of
+	// local users who might be syncing with them.
+	if rp.replicator != nil {
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil && domain == rp.cfg.Matrix.ServerName {
+			rp.replicator.PublishActivity(userID, ts)
+		}
+	}
+	rp.markActive(userID, ts)
+}
+
+// SyncedElsewhere records that a local user synced with another sync API
+// instance, so that they aren't marked offline by this one.
+func (rp *RequestPool) SyncedElsewhere(userID string, ts gomatrixserverlib.Timestamp) {
+	existing, ok := rp.presence.Load(userID)
+	if !ok { // we only track the presence of users who are syncing with us
+		return
+	}
+	p := existing.(localPresence)
+	if ts.Time().After(p.lastSync) {
+		p.lastSync = ts.Time()
+		rp.presence.Store(userID, p)
+	}
+}
+
+// ActiveElsewhere records activity by a local user which another sync API
+// instance told us about.
+func (rp *RequestPool) ActiveElsewhere(userID string, ts gomatrixserverlib.Timestamp) {
+	if !rp.cfg.Matrix.Presence.EnableOutbound {
+		return
+	}
+	rp.markActive(userID, ts)
+}
+
+func (rp *RequestPool) markActive(userID string, ts gomatrixserverlib.Timestamp) {
+	existing, ok := rp.presence.Load(userID)
+	if !ok { // we only track the presence of users who are syncing
+		return
 	}
+	p := existing.(localPresence)
+	if ts <= p.lastActiveTS {
+		return
+	}
+	if p.presence == types.PresenceOnline && ts.Time().Sub(p.publishedTS.Time()) < types.CurrentlyActiveWindow {
+		p.lastActiveTS = ts
+		rp.presence.Store(userID, p)
+		return
+	}
+	rp.setPresence(rp.db, userID, types.PresenceOnline, ts)
+}
 
+// setPresence sends a presence update for a local user to the SyncAPI and
+// FederationAPI.
+func (rp *RequestPool) setPresence(db storage.Presence, userID string, presence types.Presence, lastActiveTS gomatrixserverlib.Timestamp) {
 	// ensure we also send the current status_msg to federated servers and not nil
+	var statusMsg *string
 	dbPresence, err := db.GetPresence(context.Background(), userID)
 	if err != nil && err != sql.ErrNoRows {
 		return
 	}
 	if dbPresence != nil {
-		newPresence.ClientFields = dbPresence.ClientFields
+		statusMsg = dbPresence.ClientFields.StatusMsg
 	}
-	newPresence.ClientFields.Presence = presenceID.String()
 
-	defer rp.presence.Store(userID, newPresence)
-	// avoid spamming presence updates when syncing
-	existingPresence, ok := rp.presence.LoadOrStore(userID, newPresence)
-	if ok {
-		p := existingPresence.(types.PresenceInternal)
-		if p.ClientFields.Presence == newPresence.ClientFields.Presence {
-			return
-		}
-	}
+	// keep when the user last synced, which is only updated by syncing
+	existing, _ := rp.presence.Load(userID)
+	p, _ := existing.(localPresence)
+	p.presence = presence
+	p.lastActiveTS = lastActiveTS
+	p.publishedTS = lastActiveTS
+	rp.presence.Store(userID, p)
 
-	if err := rp.producer.SendPresence(userID, presenceID, newPresence.ClientFields.StatusMsg); err != nil {
+	if err = rp.producer.SendPresence(userID, presence, statusMsg, lastActiveTS); err != nil {
 		logrus.WithError(err).Error("Unable to publish presence message from sync")
 		return
 	}
@@ -171,8 +325,7 @@ func (rp *RequestPool) updatePresence(db storage.Presence, presence string, user
 	// now synchronously update our view of the world. It's critical we do this before calculating
 	// the /sync response else we may not return presence: online immediately.
 	rp.consumer.EmitPresence(
-		context.Background(), userID, presenceID, newPresence.ClientFields.StatusMsg,
-		gomatrixserverlib.AsTimestamp(time.Now()), true,
+		context.Background(), userID, presence, statusMsg, lastActiveTS, true,
 	)
 }
 
@@ -224,6 +377,24 @@ var waitingSyncRequests = prometheus.NewGauge(
 	},
 )
 
+var syncResponseDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "sync_response_duration_milliseconds",
+		Help:      "How long it takes to respond to a sync request, including any time spent waiting for updates",
+		Buckets: []float64{ // milliseconds
+			5, 10, 25, 50, 75, 100, 250, 500,
+			1000, 2000, 3000, 4000, 5000, 10000,
+			15000, 20000, 30000, 45000, 60000, 120000,
+		},
+	},
+	// type is "initial" for a complete sync or "incremental" otherwise, and
+	// outcome is "updates" if the response was built straight away or after
+	// the notifier woke the request, or "timeout" if the request gave up.
+	[]string{"type", "outcome"},
+)
+
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
 // called in a dedicated goroutine for this request. This function will block the goroutine
 // until a response is ready, or it times out.
@@ -246,6 +417,13 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	activeSyncRequests.Inc()
 	defer activeSyncRequests.Dec()
 
+	syncType, outcome := "incremental", "updates"
+	defer func(started time.Time) {
+		syncResponseDuration.WithLabelValues(syncType, outcome).Observe(
+			float64(time.Since(started).Milliseconds()),
+		)
+	}(time.Now())
+
 	rp.updateLastSeen(req, device)
 	rp.updatePresence(rp.db, req.FormValue("set_presence"), device.UserID)
 
@@ -258,6 +436,17 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 		syncReq.Log.WithError(err).Error("p.DB.CleanSendToDeviceUpdates failed")
 	}
 
+	// If an admin has forced this device to resync then ignore the since
+	// token. This is done after cleaning up send-to-device messages so that
+	// messages which the device has already seen aren't sent again.
+	if rp.startSync(syncReq) {
+		syncReq.Log.Info("Forcing complete sync for device")
+		syncReq.Since = types.StreamingToken{}
+	}
+	if syncReq.Since.IsEmpty() {
+		syncType = "initial"
+	}
+
 	// loop until we get some data
 	for {
 		startTime := time.Now()
@@ -273,6 +462,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 
 			giveup := func() util.JSONResponse {
 				syncReq.Log.Debugln("Responding to sync since client gave up or timeout was reached")
+				outcome = "timeout"
 				syncReq.Response.NextBatch = syncReq.Since
 				// We should always try to include OTKs in sync responses, otherwise clients might upload keys
 				// even if that's not required. See also:
@@ -284,10 +474,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 						syncReq.Log.WithError(err).Warn("failed to get OTK counts")
 					}
 				}
-				return util.JSONResponse{
-					Code: http.StatusOK,
-					JSON: syncReq.Response,
-				}
+				return rp.syncResponse(syncReq)
 			}
 
 			select {
@@ -399,10 +586,24 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 			}
 		}
 
-		return util.JSONResponse{
-			Code: http.StatusOK,
-			JSON: syncReq.Response,
-		}
+		return rp.syncResponse(syncReq)
+	}
+}
+
+// syncResponse builds the final /sync response, applying the event_fields
+// and event_format options from the filter.
+func (rp *RequestPool) syncResponse(syncReq *types.SyncRequest) util.JSONResponse {
+	res, err := internal.FormatEvents(
+		syncReq.Context, syncReq.Response, internal.SyncEventPaths,
+		syncReq.Filter.EventFields, syncReq.Filter.EventFormat, rp.db.Events,
+	)
+	if err != nil {
+		syncReq.Log.WithError(err).Error("internal.FormatEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
 	}
 }
 
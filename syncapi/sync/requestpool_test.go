@@ -7,23 +7,41 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/replication"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/streams"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type dummyPublisher struct {
 	lock  sync.Mutex
 	count int
+	last  types.Presence
 }
 
-func (d *dummyPublisher) SendPresence(userID string, presence types.Presence, statusMsg *string) error {
+func (d *dummyPublisher) SendPresence(userID string, presence types.Presence, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	d.count++
+	d.last = presence
 	return nil
 }
 
-type dummyDB struct{}
+func (d *dummyPublisher) published() (int, types.Presence) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.count, d.last
+}
+
+type dummyDB struct {
+	storage.Database
+}
 
 func (d dummyDB) UpdatePresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp, fromSync bool) (types.StreamPosition, error) {
 	return 0, nil
@@ -41,6 +59,46 @@ func (d dummyDB) MaxStreamPositionForPresence(ctx context.Context) (types.Stream
 	return 0, nil
 }
 
+// resyncDB stores forced resyncs in memory.
+type resyncDB struct {
+	dummyDB
+	lock    sync.Mutex
+	resyncs map[deviceKey]gomatrixserverlib.Timestamp
+}
+
+func (d *resyncDB) ForceResync(ctx context.Context, userID, deviceID string, ts gomatrixserverlib.Timestamp) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.resyncs[deviceKey{userID, deviceID}] = ts
+	return nil
+}
+
+func (d *resyncDB) ResyncPending(ctx context.Context, userID, deviceID string) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, ok := d.resyncs[deviceKey{userID, deviceID}]
+	return ok, nil
+}
+
+func (d *resyncDB) ConsumeForcedResync(ctx context.Context, userID, deviceID string) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, ok := d.resyncs[deviceKey{userID, deviceID}]
+	delete(d.resyncs, deviceKey{userID, deviceID})
+	return ok, nil
+}
+
+func (d *resyncDB) PruneForcedResyncs(ctx context.Context, before gomatrixserverlib.Timestamp) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for key, ts := range d.resyncs {
+		if ts < before {
+			delete(d.resyncs, key)
+		}
+	}
+	return nil
+}
+
 type dummyConsumer struct{}
 
 func (d dummyConsumer) EmitPresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, ts gomatrixserverlib.Timestamp, fromSync bool) {
@@ -96,7 +154,29 @@ func TestRequestPool_updatePresence(t *testing.T) {
 			args: args{
 				userID:   "dummy2",
 				presence: "unavailable",
-				sleep:    time.Millisecond * 150,
+			},
+		},
+		{
+			name: "syncing doesn't bring an unavailable user online",
+			args: args{
+				userID: "dummy2",
+			},
+		},
+		{
+			name:         "explicitly setting online is published dummy2",
+			wantIncrease: true,
+			args: args{
+				userID:   "dummy2",
+				presence: "online",
+			},
+		},
+		{
+			name:         "different presence is published again dummy2",
+			wantIncrease: true,
+			args: args{
+				userID:   "dummy2",
+				presence: "unavailable",
+				sleep:    time.Millisecond * 300,
 			},
 		},
 		{
@@ -120,12 +200,13 @@ func TestRequestPool_updatePresence(t *testing.T) {
 				Presence: config.PresenceOptions{
 					EnableInbound:  true,
 					EnableOutbound: true,
+					IdleTimeout:    time.Millisecond * 100,
 				},
 			},
 		},
 	}
 	db := dummyDB{}
-	go rp.cleanPresence(db, time.Millisecond*50)
+	go rp.cleanPresence(db, time.Millisecond*100, time.Millisecond*100)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			publisher.lock.Lock()
@@ -136,8 +217,224 @@ func TestRequestPool_updatePresence(t *testing.T) {
 			if tt.wantIncrease && publisher.count <= beforeCount {
 				t.Fatalf("expected count to increase: %d <= %d", publisher.count, beforeCount)
 			}
+			if !tt.wantIncrease && publisher.count != beforeCount {
+				t.Fatalf("expected count not to change: %d != %d", publisher.count, beforeCount)
+			}
 			publisher.lock.Unlock()
 			time.Sleep(tt.args.sleep)
 		})
 	}
 }
+
+func TestRequestPool_idlePresence(t *testing.T) {
+	idleTimeout := time.Millisecond * 100
+	offlineTimeout := time.Millisecond * 400
+	publisher := &dummyPublisher{}
+	rp := &RequestPool{
+		db:       dummyDB{},
+		presence: &sync.Map{},
+		producer: publisher,
+		consumer: &dummyConsumer{},
+		cfg: &config.SyncAPI{
+			Matrix: &config.Global{
+				Presence: config.PresenceOptions{
+					EnableOutbound: true,
+					IdleTimeout:    idleTimeout,
+					OfflineTimeout: offlineTimeout,
+				},
+			},
+		},
+	}
+	go rp.cleanPresence(rp.db, idleTimeout, offlineTimeout)
+
+	rp.updatePresence(rp.db, "", "dummy")
+	if count, last := publisher.published(); count != 1 || last != types.PresenceOnline {
+		t.Fatalf("expected the user to come online, got %d updates, last %s", count, last)
+	}
+
+	// Activity which happened within the currently active window of the
+	// last update isn't published.
+	rp.MarkActive("dummy", gomatrixserverlib.AsTimestamp(time.Now()))
+	if count, _ := publisher.published(); count != 1 {
+		t.Fatalf("expected activity not to be published, got %d updates", count)
+	}
+
+	// Syncing continuously shouldn't stop the user going idle or bring
+	// them back online, but activity should.
+	for i := 0; i < 10; i++ {
+		time.Sleep(idleTimeout / 4)
+		rp.updatePresence(rp.db, "", "dummy")
+	}
+	if count, last := publisher.published(); count != 2 || last != types.PresenceUnavailable {
+		t.Fatalf("expected the user to go idle while syncing, got %d updates, last %s", count, last)
+	}
+	rp.MarkActive("dummy", gomatrixserverlib.AsTimestamp(time.Now()))
+	if count, last := publisher.published(); count != 3 || last != types.PresenceOnline {
+		t.Fatalf("expected activity to bring the user online, got %d updates, last %s", count, last)
+	}
+
+	// A client which starts syncing again after the idle timeout has come
+	// back, which brings the user online.
+	time.Sleep(idleTimeout * 2)
+	if count, last := publisher.published(); count != 4 || last != types.PresenceUnavailable {
+		t.Fatalf("expected the user to go idle, got %d updates, last %s", count, last)
+	}
+	rp.updatePresence(rp.db, "", "dummy")
+	if count, last := publisher.published(); count != 5 || last != types.PresenceOnline {
+		t.Fatalf("expected syncing after the idle timeout to bring the user online, got %d updates, last %s", count, last)
+	}
+
+	// Users who stop syncing go offline, and then aren't tracked any more.
+	time.Sleep(offlineTimeout + idleTimeout)
+	if _, last := publisher.published(); last != types.PresenceOffline {
+		t.Fatalf("expected the user to go offline, got %s", last)
+	}
+	if _, ok := rp.presence.Load("dummy"); ok {
+		t.Fatalf("expected an offline user not to be tracked")
+	}
+	count, _ := publisher.published()
+	rp.MarkActive("dummy", gomatrixserverlib.AsTimestamp(time.Now()))
+	rp.MarkActive("other", gomatrixserverlib.AsTimestamp(time.Now()))
+	if got, _ := publisher.published(); got != count {
+		t.Fatalf("expected activity by users who aren't syncing not to be published, got %d updates", got-count)
+	}
+}
+
+func TestRequestPool_multipleInstancesPresence(t *testing.T) {
+	base, close := testrig.CreateBaseDendrite(t, test.DBTypeSQLite)
+	defer close()
+	base.Cfg.Global.JetStream.StoragePath = config.Path(t.TempDir())
+	js, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	topic := base.Cfg.Global.JetStream.Prefixed(jetstream.OutputSyncUpdate)
+
+	idleTimeout := time.Millisecond * 100
+	offlineTimeout := time.Millisecond * 400
+	publishers := make([]*dummyPublisher, 2)
+	pools := make([]*RequestPool, 2)
+	for i := range pools {
+		publishers[i] = &dummyPublisher{}
+		pools[i] = &RequestPool{
+			db:       dummyDB{},
+			presence: &sync.Map{},
+			producer: publishers[i],
+			consumer: &dummyConsumer{},
+			cfg: &config.SyncAPI{
+				Matrix: &config.Global{
+					ServerName: "test",
+					Presence: config.PresenceOptions{
+						EnableOutbound: true,
+						IdleTimeout:    idleTimeout,
+						OfflineTimeout: offlineTimeout,
+					},
+				},
+			},
+		}
+		replicator := replication.NewReplicator(js, topic, notifier.NewNotifier(), &streams.Streams{})
+		if err := replicator.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		pools[i].SetPresenceReplicator(replicator)
+		replicator.SetPresenceTracker(pools[i])
+		go pools[i].cleanPresence(pools[i].db, idleTimeout, offlineTimeout)
+	}
+	first, second := pools[0], pools[1]
+	waitForPresence := func(publisher *dummyPublisher, want types.Presence) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for _, last := publisher.published(); last != want; _, last = publisher.published() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for presence %s, got %s", want, last)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	// The user starts syncing with the first instance, and then moves to the
+	// second one, e.g. because the load balancer sent them there. The first
+	// instance hears that they are still syncing, so doesn't mark them offline.
+	first.updatePresence(first.db, "", "@alice:test")
+	waitForPresence(publishers[0], types.PresenceOnline)
+	for i := 0; i < 10; i++ {
+		second.updatePresence(second.db, "", "@alice:test")
+		time.Sleep(offlineTimeout / 8)
+	}
+	if _, last := publishers[0].published(); last == types.PresenceOffline {
+		t.Fatalf("expected the first instance not to mark a user who is syncing with the second one offline")
+	}
+	if _, ok := first.presence.Load("@alice:test"); !ok {
+		t.Fatalf("expected the first instance to still track the user")
+	}
+
+	// Both instances see the user go idle, and activity which is only seen by
+	// the instance which consumes the events brings them back online on both.
+	waitForPresence(publishers[0], types.PresenceUnavailable)
+	waitForPresence(publishers[1], types.PresenceUnavailable)
+	second.MarkActive("@alice:test", gomatrixserverlib.AsTimestamp(time.Now()))
+	waitForPresence(publishers[1], types.PresenceOnline)
+	waitForPresence(publishers[0], types.PresenceOnline)
+
+	// Once the user stops syncing altogether, they go offline.
+	waitForPresence(publishers[0], types.PresenceOffline)
+	waitForPresence(publishers[1], types.PresenceOffline)
+}
+
+func TestRequestPool_forceResync(t *testing.T) {
+	rp := &RequestPool{
+		db:          &resyncDB{resyncs: map[deviceKey]gomatrixserverlib.Timestamp{}},
+		deviceSyncs: &sync.Map{},
+	}
+	since := types.StreamingToken{PDUPosition: 5, SendToDevicePosition: 2}
+	req := &types.SyncRequest{
+		Context: context.Background(),
+		Device:  &userapi.Device{UserID: "@alice:localhost", ID: "ALICEDEVICE"},
+		Since:   since,
+	}
+	resyncPending := func(deviceID string) bool {
+		pending, err := rp.ResyncPending(context.Background(), "@alice:localhost", deviceID)
+		if err != nil {
+			t.Fatalf("ResyncPending returned %s", err)
+		}
+		return pending
+	}
+
+	if rp.startSync(req) {
+		t.Fatalf("expected no resync before one was forced")
+	}
+	last, ok := rp.LastSync("@alice:localhost", "ALICEDEVICE")
+	if !ok || last.Since != since {
+		t.Fatalf("last sync wasn't recorded, got %+v", last)
+	}
+
+	for _, deviceID := range []string{"OTHERDEVICE", "ALICEDEVICE"} {
+		if err := rp.ForceResync(context.Background(), "@alice:localhost", deviceID); err != nil {
+			t.Fatalf("ForceResync returned %s", err)
+		}
+	}
+	if !resyncPending("ALICEDEVICE") {
+		t.Fatalf("expected a pending resync")
+	}
+	if !rp.startSync(req) {
+		t.Fatalf("expected the device to be forced to resync")
+	}
+	if rp.startSync(req) {
+		t.Fatalf("expected the resync to only be forced once")
+	}
+	if !resyncPending("OTHERDEVICE") {
+		t.Fatalf("expected the other device to still have a pending resync")
+	}
+
+	// Devices which don't sync are eventually forgotten about.
+	rp.pruneDeviceSyncs(time.Now())
+	if _, ok = rp.LastSync("@alice:localhost", "ALICEDEVICE"); !ok {
+		t.Fatalf("expected a recent sync not to be pruned")
+	}
+	rp.pruneDeviceSyncs(time.Now().Add(deviceSyncTimeout + time.Minute))
+	if _, ok = rp.LastSync("@alice:localhost", "ALICEDEVICE"); ok {
+		t.Fatalf("expected an old sync to be pruned")
+	}
+	if resyncPending("OTHERDEVICE") {
+		t.Fatalf("expected an old resync to be pruned")
+	}
+}
@@ -0,0 +1,969 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// slidingConnTimeout is how long a sliding sync connection is kept after the
+// last request on it, after which the client will need to start again.
+const slidingConnTimeout = time.Minute * 30
+
+// slidingMaxHeroes is the number of heroes returned for rooms without a name.
+const slidingMaxHeroes = 5
+
+// NOTSPEC: MSC3575 doesn't limit how many events or rooms a client can ask
+// for, so we clamp the requests to these so that one request can't make us
+// load the whole database.
+const (
+	slidingMaxTimelineLimit = 100
+	slidingMaxRangeSize     = 1000
+)
+
+// NOTSPEC: MSC3575 lets a client open as many connections as it likes, so we
+// only keep this many for each device and drop the least recently used one
+// when a new connection would go over it.
+const slidingMaxConnsPerDevice = 10
+
+type slidingDeviceKey struct {
+	userID   string
+	deviceID string
+}
+
+// slidingConns holds the sliding sync connections for all devices, by
+// connection ID.
+type slidingConns struct {
+	sync.Mutex
+	conns map[slidingDeviceKey]map[string]*slidingConn
+}
+
+// slidingConn is a sliding sync connection. A client which didn't get the
+// response to a request will retry it with the same position, so the state
+// at the previous position is kept until the client uses the next one.
+type slidingConn struct {
+	sync.Mutex
+	lastUsed time.Time // protected by the slidingConns lock
+	slidingConnState
+	prev *slidingConnState
+}
+
+// slidingConnState is the server-side state of a sliding sync connection,
+// i.e. the sticky request parameters and what the client has already been
+// sent.
+type slidingConnState struct {
+	token         types.StreamingToken
+	lists         map[string]types.SlidingList
+	windows       map[string]slidingWindow
+	subscriptions map[string]types.SlidingRoomConfig
+	extensions    types.SlidingExtensionsRequest
+	toDeviceSince string
+	rooms         map[string]slidingRoomState
+}
+
+// slidingWindow is what the client was last sent for a list.
+type slidingWindow struct {
+	count  int
+	ranges [][2]int
+	rooms  [][]string // the room IDs in each range
+}
+
+// slidingRoomState is what the client was last sent for a room.
+type slidingRoomState struct {
+	membership        string
+	position          types.StreamPosition
+	notificationCount int
+	highlightCount    int
+	config            types.SlidingRoomConfig
+}
+
+// slidingRoomInfo is what we need to know about a room to sort and filter
+// lists.
+type slidingRoomInfo struct {
+	roomID            string
+	membership        string
+	position          types.StreamPosition
+	notificationCount int
+	highlightCount    int
+	isDM              bool
+}
+
+func newSlidingConn() *slidingConn {
+	return &slidingConn{
+		slidingConnState: slidingConnState{
+			lists:         map[string]types.SlidingList{},
+			windows:       map[string]slidingWindow{},
+			subscriptions: map[string]types.SlidingRoomConfig{},
+			rooms:         map[string]slidingRoomState{},
+		},
+	}
+}
+
+// clone copies the state, so that changes to the connection don't affect
+// the copy. The values in the maps are replaced rather than modified, so
+// they don't need to be copied.
+func (s *slidingConnState) clone() *slidingConnState {
+	c := *s
+	c.lists = make(map[string]types.SlidingList, len(s.lists))
+	for k, v := range s.lists {
+		c.lists[k] = v
+	}
+	c.windows = make(map[string]slidingWindow, len(s.windows))
+	for k, v := range s.windows {
+		c.windows[k] = v
+	}
+	c.subscriptions = make(map[string]types.SlidingRoomConfig, len(s.subscriptions))
+	for k, v := range s.subscriptions {
+		c.subscriptions[k] = v
+	}
+	c.rooms = make(map[string]slidingRoomState, len(s.rooms))
+	for k, v := range s.rooms {
+		c.rooms[k] = v
+	}
+	return &c
+}
+
+// getSlidingConn returns the connection for the device. If there is no
+// position then this is a new connection, which replaces any existing one
+// with the same ID.
+func (rp *RequestPool) getSlidingConn(device *userapi.Device, connID, pos string) (*slidingConn, bool) {
+	return rp.slidingConns.get(slidingDeviceKey{device.UserID, device.ID}, connID, pos)
+}
+
+func (s *slidingConns) get(key slidingDeviceKey, connID, pos string) (*slidingConn, bool) {
+	s.Lock()
+	defer s.Unlock()
+	conns := s.conns[key]
+	if pos == "" {
+		if conns == nil {
+			conns = map[string]*slidingConn{}
+			s.conns[key] = conns
+		}
+		if _, ok := conns[connID]; !ok && len(conns) >= slidingMaxConnsPerDevice {
+			evictID := ""
+			for id, conn := range conns {
+				if evictID == "" || conn.lastUsed.Before(conns[evictID].lastUsed) {
+					evictID = id
+				}
+			}
+			delete(conns, evictID)
+		}
+		conns[connID] = newSlidingConn()
+	}
+	conn, ok := conns[connID]
+	if ok {
+		conn.lastUsed = time.Now()
+	}
+	return conn, ok
+}
+
+func (rp *RequestPool) cleanSlidingConns() {
+	for {
+		time.Sleep(time.Minute)
+		rp.slidingConns.Lock()
+		for key, conns := range rp.slidingConns.conns {
+			for connID, conn := range conns {
+				if time.Since(conn.lastUsed) > slidingConnTimeout {
+					delete(conns, connID)
+				}
+			}
+			if len(conns) == 0 {
+				delete(rp.slidingConns.conns, key)
+			}
+		}
+		rp.slidingConns.Unlock()
+	}
+}
+
+// update applies the sticky parameters from the request to the connection.
+func (c *slidingConn) update(req *types.SlidingSyncRequest) {
+	for name, list := range req.Lists {
+		if prev, ok := c.lists[name]; ok {
+			if list.Ranges == nil {
+				list.Ranges = prev.Ranges
+			}
+			if list.Sort == nil {
+				list.Sort = prev.Sort
+			}
+			if list.Filters == nil {
+				list.Filters = prev.Filters
+			}
+			if list.RequiredState == nil {
+				list.RequiredState = prev.RequiredState
+			}
+			if list.TimelineLimit == nil {
+				list.TimelineLimit = prev.TimelineLimit
+			}
+		}
+		list.Ranges = clampSlidingRanges(list.Ranges)
+		list.TimelineLimit = clampTimelineLimit(list.TimelineLimit)
+		c.lists[name] = list
+	}
+	for roomID, config := range req.RoomSubscriptions {
+		config.TimelineLimit = clampTimelineLimit(config.TimelineLimit)
+		c.subscriptions[roomID] = config
+	}
+	for _, roomID := range req.UnsubscribeRooms {
+		delete(c.subscriptions, roomID)
+	}
+	ext := req.Extensions
+	if ext.ToDevice != nil {
+		if ext.ToDevice.Enabled != nil {
+			c.extensions.ToDevice = &types.SlidingToDeviceRequest{
+				SlidingExtensionRequest: ext.ToDevice.SlidingExtensionRequest,
+			}
+		}
+		if ext.ToDevice.Since != "" {
+			c.toDeviceSince = ext.ToDevice.Since
+		}
+	}
+	if ext.E2EE != nil && ext.E2EE.Enabled != nil {
+		c.extensions.E2EE = ext.E2EE
+	}
+	if ext.AccountData != nil && ext.AccountData.Enabled != nil {
+		c.extensions.AccountData = ext.AccountData
+	}
+	if ext.Receipts != nil && ext.Receipts.Enabled != nil {
+		c.extensions.Receipts = ext.Receipts
+	}
+	if ext.Typing != nil && ext.Typing.Enabled != nil {
+		c.extensions.Typing = ext.Typing
+	}
+}
+
+func clampTimelineLimit(limit *int) *int {
+	if limit == nil || *limit <= slidingMaxTimelineLimit {
+		return limit
+	}
+	clamped := slidingMaxTimelineLimit
+	return &clamped
+}
+
+// clampSlidingRanges returns the ranges with their starts no less than zero
+// and their sizes no more than slidingMaxRangeSize. The ranges are sent back
+// in the list operations, so the client knows which rooms it was sent.
+func clampSlidingRanges(ranges [][2]int) [][2]int {
+	if ranges == nil {
+		return nil
+	}
+	clamped := make([][2]int, len(ranges))
+	for i, r := range ranges {
+		if r[0] < 0 {
+			r[0] = 0
+		}
+		if r[1]-r[0] >= slidingMaxRangeSize {
+			r[1] = r[0] + slidingMaxRangeSize - 1
+		}
+		clamped[i] = r
+	}
+	return clamped
+}
+
+// OnIncomingSlidingSyncRequest is called when a client makes an MSC3575
+// sliding sync request. Like /sync, this blocks until there is something to
+// send to the client or the timeout is reached.
+func (rp *RequestPool) OnIncomingSlidingSyncRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	var ssReq types.SlidingSyncRequest
+	defer req.Body.Close() // nolint:errcheck
+	if err := json.NewDecoder(req.Body).Decode(&ssReq); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	pos := req.URL.Query().Get("pos")
+	timeout := getTimeout(req.URL.Query().Get("timeout"))
+
+	conn, ok := rp.getSlidingConn(device, ssReq.ConnID, pos)
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnknownPos("Unknown connection, the client should start a new connection"),
+		}
+	}
+	// Only one request can use the connection at a time.
+	conn.Lock()
+	defer conn.Unlock()
+	switch {
+	case pos == "" || pos == conn.token.String():
+	case conn.prev != nil && pos == conn.prev.token.String():
+		// The client didn't get the response to its last request, so go
+		// back to where it was and send it again.
+		conn.slidingConnState = *conn.prev.clone()
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnknownPos("Unknown position, the client should start a new connection"),
+		}
+	}
+	// The client has used this position, so it won't go back to the one
+	// before it.
+	var prev *slidingConnState
+	if pos != "" {
+		prev = conn.slidingConnState.clone()
+	}
+	conn.update(&ssReq)
+
+	activeSyncRequests.Inc()
+	defer activeSyncRequests.Dec()
+
+	rp.updateLastSeen(req, device)
+
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithFields(logrus.Fields{
+		"user_id":   device.UserID,
+		"device_id": device.ID,
+		"conn_id":   ssReq.ConnID,
+		"pos":       pos,
+		"timeout":   timeout,
+	})
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		currentPos := rp.Notifier.CurrentPosition()
+		res, updated, err := rp.processSlidingSync(ctx, logger, device, conn, currentPos)
+		if err != nil {
+			// The connection may have been partly updated, so make the
+			// client start again.
+			conn.token = types.StreamingToken{}
+			conn.prev = nil
+			logger.WithError(err).Error("rp.processSlidingSync failed")
+			return jsonerror.InternalServerError()
+		}
+		res.Pos = conn.token.String()
+		res.TxnID = ssReq.TxnID
+		conn.prev = prev
+		if pos == "" || timeout == 0 || updated {
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: res,
+			}
+		}
+
+		// Nothing has changed for the client, so wait for the notifier to
+		// tell us that something might have.
+		waitingSyncRequests.Inc()
+		listener := rp.Notifier.GetListener(types.SyncRequest{Context: ctx, Device: device})
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		case <-listener.GetNotifyChannel(conn.token):
+			listener.Close()
+			waitingSyncRequests.Dec()
+			continue
+		}
+		listener.Close()
+		waitingSyncRequests.Dec()
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+}
+
+// processSlidingSync builds the response for the connection up to the given
+// position, and updates the connection with what the client has been sent.
+// Returns true if there is anything new for the client.
+func (rp *RequestPool) processSlidingSync(
+	ctx context.Context, logger *logrus.Entry, device *userapi.Device,
+	conn *slidingConn, to types.StreamingToken,
+) (*types.SlidingSyncResponse, bool, error) {
+	res := types.NewSlidingSyncResponse()
+	from := conn.token
+	updated := false
+
+	rooms, err := rp.slidingRoomInfo(ctx, device.UserID, conn, to)
+	if err != nil {
+		return nil, false, err
+	}
+	roomsByID := make(map[string]slidingRoomInfo, len(rooms))
+	for _, room := range rooms {
+		roomsByID[room.roomID] = room
+	}
+
+	// Work out which rooms are in the windows of each list. Lists are
+	// processed in name order so that the merged room configs are stable.
+	listNames := make([]string, 0, len(conn.lists))
+	for name := range conn.lists {
+		listNames = append(listNames, name)
+	}
+	sort.Strings(listNames)
+	visible := map[string]types.SlidingRoomConfig{}
+	for _, name := range listNames {
+		list := conn.lists[name]
+		sorted := filterSlidingRooms(rooms, list.Filters)
+		sortSlidingRooms(sorted, list.Sort)
+		roomIDs := make([]string, len(sorted))
+		for i := range sorted {
+			roomIDs[i] = sorted[i].roomID
+		}
+		prev := conn.windows[name]
+		listRes, window := slidingListOps(roomIDs, list.Ranges, prev)
+		if window.count != prev.count {
+			updated = true
+		}
+		conn.windows[name] = window
+		res.Lists[name] = listRes
+		for _, windowRoomIDs := range window.rooms {
+			for _, roomID := range windowRoomIDs {
+				visible[roomID] = mergeRoomConfig(visible[roomID], list.SlidingRoomConfig)
+			}
+		}
+	}
+	for roomID, config := range conn.subscriptions {
+		if _, ok := roomsByID[roomID]; ok {
+			visible[roomID] = mergeRoomConfig(visible[roomID], config)
+		}
+	}
+
+	// Forget about rooms which the client can no longer see, so that they
+	// are sent in full if they come back into view.
+	for roomID := range conn.rooms {
+		if _, ok := visible[roomID]; !ok {
+			delete(conn.rooms, roomID)
+		}
+	}
+
+	ignores, err := rp.db.IgnoresForUser(ctx, device.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, false, fmt.Errorf("rp.db.IgnoresForUser: %w", err)
+	}
+	if ignores == nil {
+		ignores = &types.IgnoredUsers{}
+	}
+
+	var invites map[string]*gomatrixserverlib.HeaderedEvent
+	var newRooms, knownRooms []string
+	for roomID, config := range visible {
+		info := roomsByID[roomID]
+		if info.membership == gomatrixserverlib.Invite && invites == nil {
+			invites, _, err = rp.db.InviteEventsInRange(ctx, device.UserID, types.Range{To: to.InvitePosition})
+			if err != nil {
+				return nil, false, fmt.Errorf("rp.db.InviteEventsInRange: %w", err)
+			}
+		}
+		// Don't claim to have sent events which are newer than the position
+		// that we are syncing up to.
+		position := info.position
+		if position > to.PDUPosition {
+			position = to.PDUPosition
+		}
+		sent, ok := conn.rooms[roomID]
+		initial := !ok || sent.membership != info.membership || !sameRoomConfig(sent.config, config)
+		if info.membership == gomatrixserverlib.Join {
+			// Only joined rooms have ephemeral events and room account data.
+			if initial {
+				newRooms = append(newRooms, roomID)
+			} else {
+				knownRooms = append(knownRooms, roomID)
+			}
+		}
+		var since types.StreamPosition
+		switch {
+		case initial:
+		case info.position > sent.position:
+			since = sent.position
+		case info.notificationCount != sent.notificationCount || info.highlightCount != sent.highlightCount:
+			res.Rooms[roomID] = types.SlidingRoom{
+				NotificationCount: info.notificationCount,
+				HighlightCount:    info.highlightCount,
+			}
+			sent.notificationCount, sent.highlightCount = info.notificationCount, info.highlightCount
+			conn.rooms[roomID] = sent
+			continue
+		default:
+			continue
+		}
+		room, err := rp.slidingRoom(ctx, device, info, invites[roomID], config, since, to, ignores)
+		if err != nil {
+			return nil, false, fmt.Errorf("rp.slidingRoom: %w", err)
+		}
+		res.Rooms[roomID] = *room
+		conn.rooms[roomID] = slidingRoomState{
+			membership:        info.membership,
+			position:          position,
+			notificationCount: info.notificationCount,
+			highlightCount:    info.highlightCount,
+			config:            config,
+		}
+	}
+
+	toDevicePos := rp.slidingExtensions(ctx, logger, device, conn, res, from, to, newRooms, knownRooms, ignores)
+	to.SendToDevicePosition = toDevicePos
+	conn.token = to
+	return res, updated || res.HasUpdates(), nil
+}
+
+// slidingRoomInfo returns the rooms which the user is joined to or invited
+// to, along with what we need to know to sort and filter them.
+func (rp *RequestPool) slidingRoomInfo(
+	ctx context.Context, userID string, conn *slidingConn, to types.StreamingToken,
+) ([]slidingRoomInfo, error) {
+	var rooms []slidingRoomInfo
+	var roomIDs []string
+	for _, membership := range []string{gomatrixserverlib.Join, gomatrixserverlib.Invite} {
+		membershipRoomIDs, err := rp.db.RoomIDsWithMembership(ctx, userID, membership)
+		if err != nil {
+			return nil, fmt.Errorf("rp.db.RoomIDsWithMembership: %w", err)
+		}
+		for _, roomID := range membershipRoomIDs {
+			rooms = append(rooms, slidingRoomInfo{
+				roomID:     roomID,
+				membership: membership,
+			})
+		}
+		roomIDs = append(roomIDs, membershipRoomIDs...)
+	}
+	positions, err := rp.db.MaxStreamPositionsForRooms(ctx, roomIDs)
+	if err != nil {
+		return nil, fmt.Errorf("rp.db.MaxStreamPositionsForRooms: %w", err)
+	}
+	counts, err := rp.db.GetUserUnreadNotificationCounts(ctx, userID, 0, to.NotificationDataPosition)
+	if err != nil {
+		return nil, fmt.Errorf("rp.db.GetUserUnreadNotificationCounts: %w", err)
+	}
+	var direct map[string]bool
+	for _, list := range conn.lists {
+		if list.Filters != nil && list.Filters.IsDM != nil {
+			if direct, err = rp.directRooms(ctx, userID); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	for i := range rooms {
+		room := &rooms[i]
+		room.position = positions[room.roomID]
+		room.isDM = direct[room.roomID]
+		if c := counts[room.roomID]; c != nil {
+			room.notificationCount = c.UnreadNotificationCount
+			room.highlightCount = c.UnreadHighlightCount
+		}
+	}
+	return rooms, nil
+}
+
+// directRooms returns the room IDs in the user's m.direct account data.
+func (rp *RequestPool) directRooms(ctx context.Context, userID string) (map[string]bool, error) {
+	dataReq := userapi.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: "m.direct",
+	}
+	dataRes := userapi.QueryAccountDataResponse{}
+	if err := rp.userAPI.QueryAccountData(ctx, &dataReq, &dataRes); err != nil {
+		return nil, fmt.Errorf("rp.userAPI.QueryAccountData: %w", err)
+	}
+	direct := map[string]bool{}
+	var content map[string][]string
+	if data, ok := dataRes.GlobalAccountData["m.direct"]; ok {
+		if err := json.Unmarshal(data, &content); err != nil {
+			return direct, nil
+		}
+	}
+	for _, roomIDs := range content {
+		for _, roomID := range roomIDs {
+			direct[roomID] = true
+		}
+	}
+	return direct, nil
+}
+
+// slidingRoom builds the response for a room. If since is zero then the
+// room is sent in full, otherwise only the timeline events after since are
+// sent. If there are too many of those to fill the gap, the room is sent in
+// full instead.
+func (rp *RequestPool) slidingRoom(
+	ctx context.Context, device *userapi.Device, info slidingRoomInfo,
+	invite *gomatrixserverlib.HeaderedEvent, config types.SlidingRoomConfig,
+	since types.StreamPosition, to types.StreamingToken, ignores *types.IgnoredUsers,
+) (*types.SlidingRoom, error) {
+	room := &types.SlidingRoom{
+		Initial:           since == 0,
+		NotificationCount: info.notificationCount,
+		HighlightCount:    info.highlightCount,
+	}
+	if info.membership == gomatrixserverlib.Invite {
+		if invite != nil {
+			room.InviteState = types.NewInviteResponse(invite).InviteState.Events
+		}
+		return room, nil
+	}
+
+	var timeline []*gomatrixserverlib.HeaderedEvent
+	if config.TimelineLimit != nil && *config.TimelineLimit > 0 {
+		eventFilter := gomatrixserverlib.RoomEventFilter{
+			Limit: *config.TimelineLimit,
+		}
+		if len(ignores.List) > 0 {
+			notSenders := make([]string, 0, len(ignores.List))
+			for userID := range ignores.List {
+				notSenders = append(notSenders, userID)
+			}
+			eventFilter.NotSenders = &notSenders
+		}
+		r := types.Range{From: to.PDUPosition, To: 0, Backwards: true}
+		if since > 0 {
+			r = types.Range{From: since, To: to.PDUPosition}
+		}
+		recentStreamEvents, limited, err := rp.db.RecentEvents(ctx, info.roomID, r, &eventFilter, true, true)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("rp.db.RecentEvents: %w", err)
+		}
+		if since > 0 && limited {
+			// There's a gap in the timeline, so we might have missed state
+			// changes. Send the room again in full.
+			return rp.slidingRoom(ctx, device, info, invite, config, 0, to, ignores)
+		}
+		if since == 0 {
+			recentStreamEvents, limited = cutBeforeJoin(recentStreamEvents, device.UserID, limited)
+			if len(recentStreamEvents) > 0 {
+				depth, streamPos, err := rp.db.PositionInTopology(ctx, recentStreamEvents[0].EventID())
+				if err != nil {
+					return nil, fmt.Errorf("rp.db.PositionInTopology: %w", err)
+				}
+				room.PrevBatch = &types.TopologyToken{
+					Depth:       depth,
+					PDUPosition: streamPos,
+				}
+				room.PrevBatch.Decrement()
+			}
+		}
+		room.Limited = limited
+		timeline = rp.db.StreamEventsToEvents(device, recentStreamEvents)
+		room.Timeline = gomatrixserverlib.HeaderedToClientEvents(timeline, gomatrixserverlib.FormatSync)
+	}
+
+	joinedCount, err := rp.db.MembershipCount(ctx, info.roomID, gomatrixserverlib.Join, to.PDUPosition)
+	if err != nil {
+		return nil, fmt.Errorf("rp.db.MembershipCount: %w", err)
+	}
+	invitedCount, err := rp.db.MembershipCount(ctx, info.roomID, gomatrixserverlib.Invite, to.PDUPosition)
+	if err != nil {
+		return nil, fmt.Errorf("rp.db.MembershipCount: %w", err)
+	}
+	room.JoinedCount, room.InvitedCount = &joinedCount, &invitedCount
+
+	if since > 0 {
+		// State changes are in the timeline.
+		return room, nil
+	}
+	requiredState, err := rp.slidingRequiredState(ctx, info.roomID, device.UserID, config.RequiredState, timeline)
+	if err != nil {
+		return nil, err
+	}
+	room.RequiredState = gomatrixserverlib.HeaderedToClientEvents(requiredState, gomatrixserverlib.FormatSync)
+	if err = rp.slidingRoomName(ctx, room, info.roomID, device.UserID); err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// slidingRequiredState returns the current state events which match the
+// required state of the room config.
+func (rp *RequestPool) slidingRequiredState(
+	ctx context.Context, roomID, userID string, required [][2]string,
+	timeline []*gomatrixserverlib.HeaderedEvent,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	if len(required) == 0 {
+		return nil, nil
+	}
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	eventTypes := make([]string, 0, len(required))
+	for _, r := range required {
+		if r[0] == "*" {
+			eventTypes = nil
+			break
+		}
+		eventTypes = append(eventTypes, r[0])
+	}
+	if eventTypes != nil {
+		stateFilter.Types = &eventTypes
+	}
+	stateEvents, err := rp.db.CurrentState(ctx, roomID, &stateFilter, nil)
+	if err != nil {
+		return nil, fmt.Errorf("rp.db.CurrentState: %w", err)
+	}
+	lazy := make(map[string]bool, len(timeline))
+	for _, ev := range timeline {
+		lazy[ev.Sender()] = true
+	}
+	result := stateEvents[:0]
+	for _, ev := range stateEvents {
+		if matchesRequiredState(ev.Type(), *ev.StateKey(), required, userID, lazy) {
+			result = append(result, ev)
+		}
+	}
+	return result, nil
+}
+
+func matchesRequiredState(eventType, stateKey string, required [][2]string, userID string, lazy map[string]bool) bool {
+	for _, r := range required {
+		if r[0] != "*" && r[0] != eventType {
+			continue
+		}
+		switch r[1] {
+		case "*":
+			return true
+		case "$ME":
+			if stateKey == userID {
+				return true
+			}
+		case "$LAZY":
+			if lazy[stateKey] {
+				return true
+			}
+		default:
+			if stateKey == r[1] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// slidingRoomName sets the name of the room from the m.room.name or
+// m.room.canonical_alias state, or the heroes if the room has neither.
+func (rp *RequestPool) slidingRoomName(ctx context.Context, room *types.SlidingRoom, roomID, userID string) error {
+	for _, name := range []struct{ eventType, field string }{
+		{gomatrixserverlib.MRoomName, "name"},
+		{gomatrixserverlib.MRoomCanonicalAlias, "alias"},
+	} {
+		ev, err := rp.db.GetStateEvent(ctx, roomID, name.eventType, "")
+		if err != nil {
+			return fmt.Errorf("rp.db.GetStateEvent: %w", err)
+		}
+		if ev != nil {
+			if room.Name = gjson.GetBytes(ev.Content(), name.field).Str; room.Name != "" {
+				return nil
+			}
+		}
+	}
+	heroes, err := rp.db.GetRoomHeroes(ctx, roomID, userID, []string{gomatrixserverlib.Join, gomatrixserverlib.Invite})
+	if err != nil {
+		return fmt.Errorf("rp.db.GetRoomHeroes: %w", err)
+	}
+	sort.Strings(heroes)
+	if len(heroes) > slidingMaxHeroes {
+		heroes = heroes[:slidingMaxHeroes]
+	}
+	for _, heroID := range heroes {
+		hero := types.SlidingRoomHero{UserID: heroID}
+		ev, err := rp.db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, heroID)
+		if err != nil {
+			return fmt.Errorf("rp.db.GetStateEvent: %w", err)
+		}
+		if ev != nil {
+			hero.DisplayName = gjson.GetBytes(ev.Content(), "displayname").Str
+			hero.AvatarURL = gjson.GetBytes(ev.Content(), "avatar_url").Str
+		}
+		room.Heroes = append(room.Heroes, hero)
+	}
+	return nil
+}
+
+// cutBeforeJoin removes events before the user joined the room.
+// TODO: We don't fully implement history visibility yet, so this is
+// equivalent to history_visibility: joined, as for complete syncs.
+func cutBeforeJoin(events []types.StreamEvent, userID string, limited bool) ([]types.StreamEvent, bool) {
+	for i := len(events) - 1; i >= 0; i-- {
+		ev := events[i]
+		if ev.Type() != gomatrixserverlib.MRoomMember || !ev.StateKeyEquals(userID) {
+			continue
+		}
+		if membership, _ := ev.Membership(); membership != gomatrixserverlib.Join {
+			continue
+		}
+		// The create event happens before the first join, so keep it.
+		if i > 0 && events[i-1].Type() == gomatrixserverlib.MRoomCreate && events[i-1].StateKeyEquals("") {
+			i--
+		}
+		return events[i:], false
+	}
+	return events, limited
+}
+
+// filterSlidingRooms returns the rooms which pass the list filters.
+func filterSlidingRooms(rooms []slidingRoomInfo, filters *types.SlidingListFilters) []slidingRoomInfo {
+	filtered := make([]slidingRoomInfo, 0, len(rooms))
+	for _, room := range rooms {
+		if filters != nil {
+			if filters.IsInvite != nil && *filters.IsInvite != (room.membership == gomatrixserverlib.Invite) {
+				continue
+			}
+			if filters.IsDM != nil && *filters.IsDM != room.isDM {
+				continue
+			}
+		}
+		filtered = append(filtered, room)
+	}
+	return filtered
+}
+
+// notificationLevel ranks invites above rooms with highlights, above rooms
+// with notifications, above everything else.
+func (r *slidingRoomInfo) notificationLevel() int {
+	switch {
+	case r.membership == gomatrixserverlib.Invite:
+		return 3
+	case r.highlightCount > 0:
+		return 2
+	case r.notificationCount > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// sortSlidingRooms sorts the rooms by each of the given orders in turn,
+// falling back to the room ID so that the order is stable. Unknown orders
+// are ignored, and the default is by recency.
+func sortSlidingRooms(rooms []slidingRoomInfo, orders []string) {
+	if len(orders) == 0 {
+		orders = []string{types.SlidingSortByRecency}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		a, b := &rooms[i], &rooms[j]
+		for _, order := range orders {
+			switch order {
+			case types.SlidingSortByRecency:
+				if a.position != b.position {
+					return a.position > b.position
+				}
+			case types.SlidingSortByNotificationLevel:
+				if la, lb := a.notificationLevel(), b.notificationLevel(); la != lb {
+					return la > lb
+				}
+			}
+		}
+		return a.roomID < b.roomID
+	})
+}
+
+// slidingListOps works out which rooms are in each range of a sorted list,
+// and returns SYNC operations for the ranges which have changed since the
+// previous window. Ranges which are no longer requested are invalidated.
+func slidingListOps(roomIDs []string, ranges [][2]int, prev slidingWindow) (types.SlidingListResponse, slidingWindow) {
+	res := types.SlidingListResponse{Count: len(roomIDs)}
+	window := slidingWindow{
+		count:  len(roomIDs),
+		ranges: ranges,
+		rooms:  make([][]string, len(ranges)),
+	}
+	for i, r := range ranges {
+		start, end := r[0], r[1]
+		if start < 0 {
+			start = 0
+		}
+		if end >= len(roomIDs) {
+			end = len(roomIDs) - 1
+		}
+		var windowRoomIDs []string
+		if start <= end {
+			windowRoomIDs = append(windowRoomIDs, roomIDs[start:end+1]...)
+		}
+		window.rooms[i] = windowRoomIDs
+		if i < len(prev.ranges) {
+			if prev.ranges[i] == r && equalStrings(prev.rooms[i], windowRoomIDs) {
+				continue
+			}
+			if prev.ranges[i] != r {
+				res.Ops = append(res.Ops, types.SlidingListOp{
+					Op:    types.SlidingOpInvalidate,
+					Range: prev.ranges[i],
+				})
+			}
+		}
+		res.Ops = append(res.Ops, types.SlidingListOp{
+			Op:      types.SlidingOpSync,
+			Range:   r,
+			RoomIDs: windowRoomIDs,
+		})
+	}
+	for i := len(ranges); i < len(prev.ranges); i++ {
+		res.Ops = append(res.Ops, types.SlidingListOp{
+			Op:    types.SlidingOpInvalidate,
+			Range: prev.ranges[i],
+		})
+	}
+	return res, window
+}
+
+// mergeRoomConfig combines the configs for a room which is in more than one
+// list or subscription, taking the largest timeline limit and all of the
+// required state.
+func mergeRoomConfig(a, b types.SlidingRoomConfig) types.SlidingRoomConfig {
+	merged := types.SlidingRoomConfig{
+		RequiredState: append(append([][2]string{}, a.RequiredState...), b.RequiredState...),
+		TimelineLimit: a.TimelineLimit,
+	}
+	if b.TimelineLimit != nil && (a.TimelineLimit == nil || *b.TimelineLimit > *a.TimelineLimit) {
+		merged.TimelineLimit = b.TimelineLimit
+	}
+	return merged
+}
+
+func sameRoomConfig(a, b types.SlidingRoomConfig) bool {
+	limitA, limitB := 0, 0
+	if a.TimelineLimit != nil {
+		limitA = *a.TimelineLimit
+	}
+	if b.TimelineLimit != nil {
+		limitB = *b.TimelineLimit
+	}
+	if limitA != limitB {
+		return false
+	}
+	setA := make(map[[2]string]struct{}, len(a.RequiredState))
+	for _, r := range a.RequiredState {
+		setA[r] = struct{}{}
+	}
+	setB := make(map[[2]string]struct{}, len(b.RequiredState))
+	for _, r := range b.RequiredState {
+		if _, ok := setA[r]; !ok {
+			return false
+		}
+		setB[r] = struct{}{}
+	}
+	return len(setA) == len(setB)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,194 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"math"
+	"strconv"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// slidingExtensions adds the enabled extensions to the response. The data
+// comes from the /sync stream providers, which are run over the rooms in the
+// response: rooms which are new to the client get everything, and rooms which
+// the client already knows about only get what changed since the previous
+// response. Returns the send-to-device position which the client has been
+// sent up to.
+func (rp *RequestPool) slidingExtensions(
+	ctx context.Context, logger *logrus.Entry, device *userapi.Device,
+	conn *slidingConn, res *types.SlidingSyncResponse,
+	from, to types.StreamingToken, newRooms, knownRooms []string,
+	ignores *types.IgnoredUsers,
+) types.StreamPosition {
+	ext := conn.extensions
+	newConn := from.IsEmpty()
+	newRoomsReq := rp.newExtensionRequest(ctx, logger, device, newRooms, ignores)
+	knownRoomsReq := rp.newExtensionRequest(ctx, logger, device, knownRooms, ignores)
+
+	toDevicePos := from.SendToDevicePosition
+	if ext.ToDevice.IsEnabled() {
+		toDevicePos = rp.slidingToDevice(ctx, logger, device, conn, res, to, ignores)
+	}
+
+	if ext.E2EE.IsEnabled() {
+		req := rp.newExtensionRequest(ctx, logger, device, nil, ignores)
+		if newConn {
+			if err := internal.DeviceOTKCounts(ctx, rp.keyAPI, device.UserID, device.ID, req.Response); err != nil {
+				logger.WithError(err).Warn("failed to get OTK counts")
+			}
+		} else {
+			rp.streams.DeviceListStreamProvider.IncrementalSync(ctx, req, from.DeviceListPosition, to.DeviceListPosition)
+		}
+		e2ee := &types.SlidingE2EEResponse{
+			DeviceOneTimeKeysCount: req.Response.DeviceListsOTKCount,
+		}
+		e2ee.DeviceLists.Changed = req.Response.DeviceLists.Changed
+		e2ee.DeviceLists.Left = req.Response.DeviceLists.Left
+		res.Extensions.E2EE = e2ee
+	}
+
+	if ext.AccountData.IsEnabled() {
+		accountData := &types.SlidingAccountDataResponse{
+			Global: []gomatrixserverlib.ClientEvent{},
+			Rooms:  map[string][]gomatrixserverlib.ClientEvent{},
+		}
+		provider := rp.streams.AccountDataStreamProvider
+		if newConn {
+			// Also includes the global account data.
+			provider.IncrementalSync(ctx, newRoomsReq, 0, to.AccountDataPosition)
+			accountData.Global = newRoomsReq.Response.AccountData.Events
+		} else {
+			if len(newRooms) > 0 {
+				provider.IncrementalSync(ctx, newRoomsReq, 0, to.AccountDataPosition)
+			}
+			provider.IncrementalSync(ctx, knownRoomsReq, from.AccountDataPosition, to.AccountDataPosition)
+			accountData.Global = knownRoomsReq.Response.AccountData.Events
+		}
+		for _, req := range []*types.SyncRequest{newRoomsReq, knownRoomsReq} {
+			for roomID, jr := range req.Response.Rooms.Join {
+				if _, ok := req.Rooms[roomID]; ok && len(jr.AccountData.Events) > 0 {
+					accountData.Rooms[roomID] = jr.AccountData.Events
+				}
+			}
+		}
+		res.Extensions.AccountData = accountData
+	}
+
+	if ext.Receipts.IsEnabled() {
+		provider := rp.streams.ReceiptStreamProvider
+		if len(newRooms) > 0 {
+			provider.IncrementalSync(ctx, newRoomsReq, 0, to.ReceiptPosition)
+		}
+		if len(knownRooms) > 0 {
+			provider.IncrementalSync(ctx, knownRoomsReq, from.ReceiptPosition, to.ReceiptPosition)
+		}
+		res.Extensions.Receipts = &types.SlidingEphemeralResponse{
+			Rooms: ephemeralEvents(gomatrixserverlib.MReceipt, newRoomsReq, knownRoomsReq),
+		}
+	}
+
+	if ext.Typing.IsEnabled() {
+		provider := rp.streams.TypingStreamProvider
+		if len(newRooms) > 0 {
+			provider.IncrementalSync(ctx, newRoomsReq, 0, to.TypingPosition)
+		}
+		if len(knownRooms) > 0 {
+			provider.IncrementalSync(ctx, knownRoomsReq, from.TypingPosition, to.TypingPosition)
+		}
+		res.Extensions.Typing = &types.SlidingEphemeralResponse{
+			Rooms: ephemeralEvents(gomatrixserverlib.MTyping, newRoomsReq, knownRoomsReq),
+		}
+	}
+
+	return toDevicePos
+}
+
+// slidingToDevice adds the send-to-device messages after the since position
+// of the to-device extension. Messages before that position have been seen by
+// the client and are deleted.
+func (rp *RequestPool) slidingToDevice(
+	ctx context.Context, logger *logrus.Entry, device *userapi.Device,
+	conn *slidingConn, res *types.SlidingSyncResponse, to types.StreamingToken,
+	ignores *types.IgnoredUsers,
+) types.StreamPosition {
+	var since types.StreamPosition
+	if conn.toDeviceSince != "" {
+		if i, err := strconv.ParseInt(conn.toDeviceSince, 10, 64); err == nil {
+			since = types.StreamPosition(i)
+		}
+	}
+	if since > 0 {
+		if err := rp.db.CleanSendToDeviceUpdates(ctx, device.UserID, device.ID, since); err != nil {
+			logger.WithError(err).Error("rp.db.CleanSendToDeviceUpdates failed")
+		}
+	}
+	req := rp.newExtensionRequest(ctx, logger, device, nil, ignores)
+	pos := rp.streams.SendToDeviceStreamProvider.IncrementalSync(ctx, req, since, to.SendToDevicePosition)
+	res.Extensions.ToDevice = &types.SlidingToDeviceResponse{
+		NextBatch: strconv.FormatInt(int64(pos), 10),
+		Events:    req.Response.ToDevice.Events,
+	}
+	return pos
+}
+
+// newExtensionRequest returns a /sync request for running stream providers
+// over the given joined rooms.
+func (rp *RequestPool) newExtensionRequest(
+	ctx context.Context, logger *logrus.Entry, device *userapi.Device,
+	roomIDs []string, ignores *types.IgnoredUsers,
+) *types.SyncRequest {
+	filter := types.DefaultFilter()
+	filter.AccountData.Limit = math.MaxInt32
+	filter.Room.AccountData.Limit = math.MaxInt32
+	rooms := make(map[string]string, len(roomIDs))
+	for _, roomID := range roomIDs {
+		rooms[roomID] = gomatrixserverlib.Join
+	}
+	return &types.SyncRequest{
+		Context:      ctx,
+		Log:          logger,
+		Device:       device,
+		Response:     types.NewResponse(),
+		Filter:       filter,
+		Rooms:        rooms,
+		IgnoredUsers: *ignores,
+	}
+}
+
+// ephemeralEvents returns the ephemeral event of the given type for each of
+// the rooms in the requests.
+func ephemeralEvents(eventType string, reqs ...*types.SyncRequest) map[string]gomatrixserverlib.ClientEvent {
+	events := map[string]gomatrixserverlib.ClientEvent{}
+	for _, req := range reqs {
+		for roomID, jr := range req.Response.Rooms.Join {
+			if _, ok := req.Rooms[roomID]; !ok {
+				continue
+			}
+			for _, ev := range jr.Ephemeral.Events {
+				if ev.Type == eventType {
+					events[roomID] = ev
+				}
+			}
+		}
+	}
+	return events
+}
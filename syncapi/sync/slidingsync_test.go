@@ -0,0 +1,170 @@
+package sync
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestSortSlidingRooms(t *testing.T) {
+	rooms := []slidingRoomInfo{
+		{roomID: "!a", membership: gomatrixserverlib.Join, position: 1},
+		{roomID: "!b", membership: gomatrixserverlib.Join, position: 5},
+		{roomID: "!c", membership: gomatrixserverlib.Join, position: 3, notificationCount: 1},
+		{roomID: "!d", membership: gomatrixserverlib.Join, position: 2, highlightCount: 1, notificationCount: 1},
+		{roomID: "!e", membership: gomatrixserverlib.Invite},
+	}
+	tests := []struct {
+		name   string
+		orders []string
+		want   []string
+	}{
+		{
+			name: "default is by recency",
+			want: []string{"!b", "!c", "!d", "!a", "!e"},
+		},
+		{
+			name:   "by notification level then recency",
+			orders: []string{types.SlidingSortByNotificationLevel, types.SlidingSortByRecency},
+			want:   []string{"!e", "!d", "!c", "!b", "!a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sorted := append([]slidingRoomInfo{}, rooms...)
+			sortSlidingRooms(sorted, tt.orders)
+			got := make([]string, len(sorted))
+			for i := range sorted {
+				got[i] = sorted[i].roomID
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlidingListOps(t *testing.T) {
+	roomIDs := []string{"!a", "!b", "!c", "!d"}
+
+	res, window := slidingListOps(roomIDs, [][2]int{{0, 1}, {3, 10}}, slidingWindow{})
+	want := []types.SlidingListOp{
+		{Op: types.SlidingOpSync, Range: [2]int{0, 1}, RoomIDs: []string{"!a", "!b"}},
+		{Op: types.SlidingOpSync, Range: [2]int{3, 10}, RoomIDs: []string{"!d"}},
+	}
+	if res.Count != 4 || !reflect.DeepEqual(res.Ops, want) {
+		t.Fatalf("initial: got %+v want %+v", res, want)
+	}
+
+	// Nothing changed, so no operations.
+	res, window = slidingListOps(roomIDs, [][2]int{{0, 1}, {3, 10}}, window)
+	if len(res.Ops) != 0 {
+		t.Fatalf("unchanged: got %+v want no ops", res.Ops)
+	}
+
+	// A room moves to the top, and the second range is dropped.
+	res, _ = slidingListOps([]string{"!c", "!a", "!b", "!d"}, [][2]int{{0, 1}}, window)
+	want = []types.SlidingListOp{
+		{Op: types.SlidingOpSync, Range: [2]int{0, 1}, RoomIDs: []string{"!c", "!a"}},
+		{Op: types.SlidingOpInvalidate, Range: [2]int{3, 10}},
+	}
+	if !reflect.DeepEqual(res.Ops, want) {
+		t.Fatalf("moved: got %+v want %+v", res.Ops, want)
+	}
+}
+
+func TestSlidingConnClamps(t *testing.T) {
+	small, large := 10, 1000000
+	conn := newSlidingConn()
+	conn.update(&types.SlidingSyncRequest{
+		Lists: map[string]types.SlidingList{
+			"all": {
+				SlidingRoomConfig: types.SlidingRoomConfig{TimelineLimit: &large},
+				Ranges:            [][2]int{{-5, 5}, {10, 1000000}},
+			},
+		},
+		RoomSubscriptions: map[string]types.SlidingRoomConfig{
+			"!a": {TimelineLimit: &small},
+			"!b": {TimelineLimit: &large},
+		},
+	})
+	list := conn.lists["all"]
+	if got := *list.TimelineLimit; got != slidingMaxTimelineLimit {
+		t.Errorf("got list timeline limit %d want %d", got, slidingMaxTimelineLimit)
+	}
+	wantRanges := [][2]int{{0, 5}, {10, 10 + slidingMaxRangeSize - 1}}
+	if !reflect.DeepEqual(list.Ranges, wantRanges) {
+		t.Errorf("got ranges %v want %v", list.Ranges, wantRanges)
+	}
+	if got := *conn.subscriptions["!a"].TimelineLimit; got != small {
+		t.Errorf("got subscription timeline limit %d want %d", got, small)
+	}
+	if got := *conn.subscriptions["!b"].TimelineLimit; got != slidingMaxTimelineLimit {
+		t.Errorf("got subscription timeline limit %d want %d", got, slidingMaxTimelineLimit)
+	}
+}
+
+func TestMatchesRequiredState(t *testing.T) {
+	required := [][2]string{
+		{"m.room.name", ""},
+		{"m.room.member", "$ME"},
+		{"m.room.member", "$LAZY"},
+		{"m.space.child", "*"},
+	}
+	lazy := map[string]bool{"@bob:test": true}
+	tests := []struct {
+		eventType, stateKey string
+		want                bool
+	}{
+		{"m.room.name", "", true},
+		{"m.room.topic", "", false},
+		{"m.room.member", "@alice:test", true},
+		{"m.room.member", "@bob:test", true},
+		{"m.room.member", "@charlie:test", false},
+		{"m.space.child", "!room:test", true},
+	}
+	for _, tt := range tests {
+		if got := matchesRequiredState(tt.eventType, tt.stateKey, required, "@alice:test", lazy); got != tt.want {
+			t.Errorf("%s/%s: got %v want %v", tt.eventType, tt.stateKey, got, tt.want)
+		}
+	}
+}
+
+func TestSlidingConnsPerDeviceLimit(t *testing.T) {
+	conns := &slidingConns{conns: map[slidingDeviceKey]map[string]*slidingConn{}}
+	alice := slidingDeviceKey{"@alice:test", "ALICE"}
+	bob := slidingDeviceKey{"@bob:test", "BOB"}
+	for i := 0; i < slidingMaxConnsPerDevice; i++ {
+		conns.get(alice, fmt.Sprintf("conn%d", i), "")
+	}
+	conns.get(bob, "conn0", "")
+
+	// The least recently used connection is the one dropped for a new one.
+	conns.get(alice, "conn0", "1")
+	conns.conns[alice]["conn1"].lastUsed = time.Now().Add(-time.Minute)
+	conns.get(alice, "new", "")
+	if got := len(conns.conns[alice]); got != slidingMaxConnsPerDevice {
+		t.Fatalf("got %d connections want %d", got, slidingMaxConnsPerDevice)
+	}
+	if _, ok := conns.get(alice, "conn1", "1"); ok {
+		t.Errorf("least recently used connection wasn't dropped")
+	}
+	for _, connID := range []string{"conn0", "new"} {
+		if _, ok := conns.get(alice, connID, "1"); !ok {
+			t.Errorf("connection %q was dropped", connID)
+		}
+	}
+
+	// Starting a connection again with an existing ID doesn't drop another.
+	conns.get(alice, "new", "")
+	if got := len(conns.conns[alice]); got != slidingMaxConnsPerDevice {
+		t.Errorf("got %d connections want %d", got, slidingMaxConnsPerDevice)
+	}
+	if _, ok := conns.get(bob, "conn0", "1"); !ok {
+		t.Errorf("another device's connection was dropped")
+	}
+}
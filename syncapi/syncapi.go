@@ -20,19 +20,24 @@ import (
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/sirupsen/logrus"
 
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/base"
 	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 
 	"github.com/matrix-org/dendrite/syncapi/consumers"
 	"github.com/matrix-org/dendrite/syncapi/notifier"
 	"github.com/matrix-org/dendrite/syncapi/producers"
+	"github.com/matrix-org/dendrite/syncapi/rebuild"
+	"github.com/matrix-org/dendrite/syncapi/replication"
 	"github.com/matrix-org/dendrite/syncapi/routing"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/streams"
 	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
 )
 
 // AddPublicRoutes sets up and registers HTTP handlers for the SyncAPI
@@ -42,6 +47,7 @@ func AddPublicRoutes(
 	userAPI userapi.SyncUserAPI,
 	rsAPI api.SyncRoomserverAPI,
 	keyAPI keyapi.SyncKeyAPI,
+	fsAPI federationAPI.SyncFederationAPI,
 ) {
 	cfg := &base.Cfg.SyncAPI
 
@@ -60,20 +66,36 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to load notifier ")
 	}
 
+	// When there is more than one sync API instance, the instances tell each
+	// other about the updates to their notifiers. This must be set up before
+	// anything else uses the notifier.
+	var replicator *replication.Replicator
+	if cfg.MultipleInstances {
+		replicator = replication.NewReplicator(
+			js, cfg.Matrix.JetStream.Prefixed(jetstream.OutputSyncUpdate), notifier, streams,
+		)
+		if err = replicator.Start(base.ProcessContext.Context()); err != nil {
+			logrus.WithError(err).Panicf("failed to start sync update consumer")
+		}
+	}
+
 	federationPresenceProducer := &producers.FederationAPIPresenceProducer{
 		Topic:     cfg.Matrix.JetStream.Prefixed(jetstream.OutputPresenceEvent),
 		JetStream: js,
 	}
-	presenceConsumer := consumers.NewPresenceConsumer(
-		base.ProcessContext, cfg, js, natsClient, syncDB,
-		notifier, streams.PresenceStreamProvider,
-		userAPI,
-	)
+	newPresenceConsumer := func(process *process.ProcessContext) *consumers.PresenceConsumer {
+		return consumers.NewPresenceConsumer(
+			process, cfg, js, natsClient, syncDB,
+			notifier, streams.PresenceStreamProvider,
+			userAPI,
+		)
+	}
+	presenceConsumer := newPresenceConsumer(base.ProcessContext)
 
 	requestPool := sync.NewRequestPool(syncDB, cfg, userAPI, keyAPI, rsAPI, streams, notifier, federationPresenceProducer, presenceConsumer, base.EnableMetrics)
-
-	if err = presenceConsumer.Start(); err != nil {
-		logrus.WithError(err).Panicf("failed to start presence consumer")
+	if replicator != nil {
+		requestPool.SetPresenceReplicator(replicator)
+		replicator.SetPresenceTracker(requestPool)
 	}
 
 	userAPIStreamEventProducer := &producers.UserAPIStreamEventProducer{
@@ -86,38 +108,8 @@ func AddPublicRoutes(
 		Topic:     cfg.Matrix.JetStream.Prefixed(jetstream.OutputReadUpdate),
 	}
 
-	keyChangeConsumer := consumers.NewOutputKeyChangeEventConsumer(
-		base.ProcessContext, cfg, cfg.Matrix.JetStream.Prefixed(jetstream.OutputKeyChangeEvent),
-		js, rsAPI, syncDB, notifier,
-		streams.DeviceListStreamProvider,
-	)
-	if err = keyChangeConsumer.Start(); err != nil {
-		logrus.WithError(err).Panicf("failed to start key change consumer")
-	}
-
-	roomConsumer := consumers.NewOutputRoomEventConsumer(
-		base.ProcessContext, cfg, js, syncDB, notifier, streams.PDUStreamProvider,
-		streams.InviteStreamProvider, rsAPI, userAPIStreamEventProducer,
-	)
-	if err = roomConsumer.Start(); err != nil {
-		logrus.WithError(err).Panicf("failed to start room server consumer")
-	}
-
-	clientConsumer := consumers.NewOutputClientDataConsumer(
-		base.ProcessContext, cfg, js, syncDB, notifier, streams.AccountDataStreamProvider,
-		userAPIReadUpdateProducer,
-	)
-	if err = clientConsumer.Start(); err != nil {
-		logrus.WithError(err).Panicf("failed to start client data consumer")
-	}
-
-	notificationConsumer := consumers.NewOutputNotificationDataConsumer(
-		base.ProcessContext, cfg, js, syncDB, notifier, streams.NotificationDataStreamProvider,
-	)
-	if err = notificationConsumer.Start(); err != nil {
-		logrus.WithError(err).Panicf("failed to start notification data consumer")
-	}
-
+	// Typing notifications are only kept in memory, so every instance
+	// consumes them.
 	typingConsumer := consumers.NewOutputTypingEventConsumer(
 		base.ProcessContext, cfg, js, eduCache, notifier, streams.TypingStreamProvider,
 	)
@@ -125,23 +117,112 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start typing consumer")
 	}
 
-	sendToDeviceConsumer := consumers.NewOutputSendToDeviceEventConsumer(
-		base.ProcessContext, cfg, js, syncDB, notifier, streams.SendToDeviceStreamProvider,
-	)
-	if err = sendToDeviceConsumer.Start(); err != nil {
-		logrus.WithError(err).Panicf("failed to start send-to-device consumer")
+	// The rest of the consumers write to the database, so only one instance
+	// may run them at a time.
+	startConsumers := func(process *process.ProcessContext) {
+		if err := newPresenceConsumer(process).Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start presence consumer")
+		}
+
+		keyChangeConsumer := consumers.NewOutputKeyChangeEventConsumer(
+			process, cfg, cfg.Matrix.JetStream.Prefixed(jetstream.OutputKeyChangeEvent),
+			js, rsAPI, syncDB, notifier,
+			streams.DeviceListStreamProvider,
+		)
+		if err := keyChangeConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start key change consumer")
+		}
+
+		roomConsumer := consumers.NewOutputRoomEventConsumer(
+			process, cfg, js, syncDB, notifier, streams.PDUStreamProvider,
+			streams.InviteStreamProvider, rsAPI, userAPIStreamEventProducer, requestPool,
+		)
+		if err := roomConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start room server consumer")
+		}
+
+		clientConsumer := consumers.NewOutputClientDataConsumer(
+			process, cfg, js, syncDB, notifier, streams.AccountDataStreamProvider,
+			userAPIReadUpdateProducer,
+		)
+		if err := clientConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start client data consumer")
+		}
+
+		notificationConsumer := consumers.NewOutputNotificationDataConsumer(
+			process, cfg, js, syncDB, notifier, streams.NotificationDataStreamProvider,
+		)
+		if err := notificationConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start notification data consumer")
+		}
+
+		sendToDeviceConsumer := consumers.NewOutputSendToDeviceEventConsumer(
+			process, cfg, js, syncDB, notifier, streams.SendToDeviceStreamProvider,
+		)
+		if err := sendToDeviceConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start send-to-device consumer")
+		}
+
+		receiptConsumer := consumers.NewOutputReceiptEventConsumer(
+			process, cfg, js, syncDB, notifier, streams.ReceiptStreamProvider,
+			userAPIReadUpdateProducer, requestPool,
+		)
+		if err := receiptConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start receipts consumer")
+		}
+	}
+	// When there is more than one instance, the consumers are stopped again
+	// if this instance stops being elected. The admin endpoints which write
+	// to the database are refused by instances which aren't elected.
+	election := &replication.Election{}
+	var stopConsumers context.CancelFunc
+	if !cfg.MultipleInstances {
+		election.Elect(base.ProcessContext)
+		startConsumers(base.ProcessContext)
+	} else if err = replication.Campaign(
+		base.ProcessContext.Context(), js,
+		jetstream.Tokenise(cfg.Matrix.JetStream.Prefixed("SyncAPILeader")), replicator.Instance,
+		replication.LeaseDuration,
+		func() {
+			var elected *process.ProcessContext
+			elected, stopConsumers = base.ProcessContext.Child()
+			election.Elect(elected)
+			startConsumers(elected)
+		},
+		func() {
+			logrus.Warn("This sync API instance is no longer elected, so is stopping writing to the database")
+			election.Elect(nil)
+			stopConsumers()
+		},
+	); err != nil {
+		logrus.WithError(err).Panicf("failed to campaign to write to the sync API database")
 	}
 
-	receiptConsumer := consumers.NewOutputReceiptEventConsumer(
-		base.ProcessContext, cfg, js, syncDB, notifier, streams.ReceiptStreamProvider,
-		userAPIReadUpdateProducer,
+	// Rooms rebuilt from the roomserver may have new events and memberships,
+	// so make sure that the notifier and streams know about them.
+	rebuilder := rebuild.NewRebuilder(
+		syncDB, rsAPI, cfg.Matrix.ServerName,
+		func(ctx context.Context, roomID string) error {
+			pduPos, err := syncDB.MaxStreamPositionForPDUs(ctx)
+			if err != nil {
+				return err
+			}
+			invitePos, err := syncDB.MaxStreamPositionForInvites(ctx)
+			if err != nil {
+				return err
+			}
+			streams.PDUStreamProvider.Advance(pduPos)
+			streams.InviteStreamProvider.Advance(invitePos)
+			if err = notifier.LoadRooms(ctx, syncDB, []string{roomID}); err != nil {
+				return err
+			}
+			notifier.OnNewEvent(nil, roomID, nil, types.StreamingToken{PDUPosition: pduPos, InvitePosition: invitePos})
+			return nil
+		},
 	)
-	if err = receiptConsumer.Start(); err != nil {
-		logrus.WithError(err).Panicf("failed to start receipts consumer")
-	}
 
 	routing.Setup(
-		base.PublicClientAPIMux, requestPool, syncDB, userAPI,
-		rsAPI, cfg, base.Caches,
+		base.PublicClientAPIMux, base.PublicFederationAPIMux, base.DendriteAdminMux, requestPool, syncDB, userAPI,
+		rsAPI, fsAPI, cfg, base.Caches, rebuilder, election,
 	)
 }
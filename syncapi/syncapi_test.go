@@ -4,13 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	fedapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	rsapi "github.com/matrix-org/dendrite/roomserver/api"
@@ -46,6 +50,60 @@ func (s *syncRoomserverAPI) QueryLatestEventsAndState(ctx context.Context, req *
 	return nil // TODO: return state
 }
 
+func (s *syncRoomserverAPI) QueryMembershipForUser(ctx context.Context, req *rsapi.QueryMembershipForUserRequest, res *rsapi.QueryMembershipForUserResponse) error {
+	for _, r := range s.rooms {
+		if r.ID == req.RoomID {
+			res.RoomExists = true
+			res.IsInRoom = true
+			res.HasBeenInRoom = true
+			res.Membership = gomatrixserverlib.Join
+			return nil
+		}
+	}
+	return nil
+}
+
+// QueryStateAfterEvents returns the state after the latest of the given events,
+// assuming that the events of the room are linear.
+func (s *syncRoomserverAPI) QueryStateAfterEvents(ctx context.Context, req *rsapi.QueryStateAfterEventsRequest, res *rsapi.QueryStateAfterEventsResponse) error {
+	for _, room := range s.rooms {
+		if room.ID != req.RoomID {
+			continue
+		}
+		res.RoomExists = true
+		res.RoomVersion = room.Version
+		events := room.Events()
+		last := -1
+		for i, ev := range events {
+			for _, eventID := range req.PrevEventIDs {
+				if ev.EventID() == eventID {
+					last = i
+				}
+			}
+		}
+		if last == -1 {
+			return nil
+		}
+		res.PrevEventsExist = true
+		state := map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+		for _, ev := range events[:last+1] {
+			if ev.StateKey() != nil {
+				state[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+			}
+		}
+		for tuple, ev := range state {
+			wanted := len(req.StateToFetch) == 0
+			for _, want := range req.StateToFetch {
+				wanted = wanted || want == tuple
+			}
+			if wanted {
+				res.StateEvents = append(res.StateEvents, ev)
+			}
+		}
+	}
+	return nil
+}
+
 func (s *syncRoomserverAPI) QuerySharedUsers(ctx context.Context, req *rsapi.QuerySharedUsersRequest, res *rsapi.QuerySharedUsersResponse) error {
 	res.UserIDsToCount = make(map[string]int)
 	return nil
@@ -56,7 +114,16 @@ func (s *syncRoomserverAPI) QueryBulkStateContent(ctx context.Context, req *rsap
 
 type syncUserAPI struct {
 	userapi.SyncUserAPI
-	accounts []userapi.Device
+	accounts    []userapi.Device
+	accountData map[string]json.RawMessage // global account data
+}
+
+func (s *syncUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
+	res.GlobalAccountData = map[string]json.RawMessage{}
+	if data, ok := s.accountData[req.DataType]; ok && req.RoomID == "" {
+		res.GlobalAccountData[req.DataType] = data
+	}
+	return nil
 }
 
 func (s *syncUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse) error {
@@ -84,6 +151,18 @@ func (s *syncKeyAPI) QueryOneTimeKeys(ctx context.Context, req *keyapi.QueryOneT
 
 }
 
+type syncFederationAPI struct {
+	fedapi.SyncFederationAPI
+}
+
+func (s *syncFederationAPI) KeyRing() *gomatrixserverlib.KeyRing {
+	return &gomatrixserverlib.KeyRing{}
+}
+
+func (s *syncFederationAPI) QueryJoinedHostServerNamesInRoom(ctx context.Context, req *fedapi.QueryJoinedHostServerNamesInRoomRequest, res *fedapi.QueryJoinedHostServerNamesInRoomResponse) error {
+	return nil
+}
+
 func TestSyncAPIAccessTokens(t *testing.T) {
 	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
 		testSyncAccessTokens(t, dbType)
@@ -107,7 +186,7 @@ func testSyncAccessTokens(t *testing.T, dbType test.DBType) {
 	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
 	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
 	msgs := toNATSMsgs(t, base, room.Events())
-	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, &syncKeyAPI{})
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, &syncKeyAPI{}, &syncFederationAPI{})
 	testrig.MustPublishMsgs(t, jsctx, msgs...)
 
 	testCases := []struct {
@@ -201,7 +280,7 @@ func testSyncAPICreateRoomSyncEarly(t *testing.T, dbType test.DBType) {
 	// m.room.history_visibility
 	msgs := toNATSMsgs(t, base, room.Events())
 	sinceTokens := make([]string, len(msgs))
-	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, &syncKeyAPI{})
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, &syncKeyAPI{}, &syncFederationAPI{})
 	for i, msg := range msgs {
 		testrig.MustPublishMsgs(t, jsctx, msg)
 		time.Sleep(100 * time.Millisecond)
@@ -285,7 +364,7 @@ func testSyncAPIUpdatePresenceImmediately(t *testing.T, dbType test.DBType) {
 
 	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
 	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
-	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{}, &syncKeyAPI{})
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{}, &syncKeyAPI{}, &syncFederationAPI{})
 	w := httptest.NewRecorder()
 	base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
 		"access_token": alice.AccessToken,
@@ -334,7 +413,7 @@ func testSendToDevice(t *testing.T, dbType test.DBType) {
 	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
 	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
 
-	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{}, &syncKeyAPI{})
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{}, &syncKeyAPI{}, &syncFederationAPI{})
 
 	producer := producers.SyncAPIProducer{
 		TopicSendToDeviceEvent: base.Cfg.Global.JetStream.Prefixed(jetstream.OutputSendToDeviceEvent),
@@ -464,3 +543,562 @@ func toNATSMsgs(t *testing.T, base *base.BaseDendrite, input []*gomatrixserverli
 	}
 	return result
 }
+
+func TestTimestampToEvent(t *testing.T) {
+	test.WithAllDatabases(t, testTimestampToEvent)
+}
+
+func testTimestampToEvent(t *testing.T, dbType test.DBType) {
+	user := test.NewUser(t)
+	room := test.NewRoom(t, user)
+	alice := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      user.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+	start := time.Now().Add(time.Hour)
+	msg1 := room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "1"}, test.WithTimestamp(start))
+	msg2 := room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "2"}, test.WithTimestamp(start.Add(time.Minute)))
+
+	base, close := testrig.CreateBaseDendrite(t, dbType)
+	defer close()
+
+	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+	msgs := toNATSMsgs(t, base, room.Events())
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, &syncKeyAPI{}, &syncFederationAPI{})
+	testrig.MustPublishMsgs(t, jsctx, msgs...)
+
+	// TODO: find a better way
+	time.Sleep(500 * time.Millisecond)
+
+	testCases := []struct {
+		name        string
+		roomID      string
+		ts          time.Time
+		dir         string
+		wantCode    int
+		wantEventID string
+	}{
+		{name: "forward from before", roomID: room.ID, ts: start.Add(-time.Second), dir: "f", wantCode: 200, wantEventID: msg1.EventID()},
+		{name: "backward from between", roomID: room.ID, ts: start.Add(30 * time.Second), dir: "b", wantCode: 200, wantEventID: msg1.EventID()},
+		{name: "forward from between", roomID: room.ID, ts: start.Add(30 * time.Second), dir: "f", wantCode: 200, wantEventID: msg2.EventID()},
+		{name: "forward from after", roomID: room.ID, ts: start.Add(time.Hour), dir: "f", wantCode: 404},
+		{name: "invalid direction", roomID: room.ID, ts: start, dir: "x", wantCode: 400},
+		{name: "unknown room", roomID: "!unknown:test", ts: start, dir: "f", wantCode: 403},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v1/rooms/"+tc.roomID+"/timestamp_to_event", test.WithQueryParams(map[string]string{
+			"access_token": alice.AccessToken,
+			"ts":           fmt.Sprintf("%d", gomatrixserverlib.AsTimestamp(tc.ts)),
+			"dir":          tc.dir,
+		})))
+		if w.Code != tc.wantCode {
+			t.Fatalf("%s: got HTTP %d want %d: %s", tc.name, w.Code, tc.wantCode, w.Body.String())
+		}
+		if tc.wantEventID != "" {
+			if got := gjson.GetBytes(w.Body.Bytes(), "event_id").Str; got != tc.wantEventID {
+				t.Errorf("%s: got event %s want %s", tc.name, got, tc.wantEventID)
+			}
+		}
+	}
+}
+
+func TestSyncAPIFilters(t *testing.T) {
+	test.WithAllDatabases(t, testSyncAPIFilters)
+}
+
+func testSyncAPIFilters(t *testing.T, dbType test.DBType) {
+	user := test.NewUser(t)
+	room := test.NewRoom(t, user)
+	otherRoom := test.NewRoom(t, user)
+	alice := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      user.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	base, close := testrig.CreateBaseDendrite(t, dbType)
+	defer close()
+
+	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room, otherRoom}}, &syncKeyAPI{}, &syncFederationAPI{})
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, base, room.Events())...)
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, base, otherRoom.Events())...)
+	time.Sleep(500 * time.Millisecond)
+
+	filter, err := json.Marshal(map[string]interface{}{
+		"event_fields": []string{"type", "event_id", "content.creator"},
+		"room": map[string]interface{}{
+			"not_rooms": []string{otherRoom.ID},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+		"access_token": alice.AccessToken,
+		"timeout":      "0",
+		"filter":       string(filter),
+	})))
+	if w.Code != 200 {
+		t.Fatalf("got HTTP %d want %d", w.Code, 200)
+	}
+	res := gjson.ParseBytes(w.Body.Bytes())
+	joined := res.Get("rooms.join").Map()
+	if _, ok := joined[room.ID]; !ok || len(joined) != 1 {
+		t.Fatalf("expected only %s to be joined, got %s", room.ID, res.Get("rooms.join").Raw)
+	}
+
+	timeline := joined[room.ID].Get("timeline.events").Array()
+	test.AssertEventIDsEqual(t, func() (ids []string) {
+		for _, ev := range timeline {
+			ids = append(ids, ev.Get("event_id").Str)
+		}
+		return
+	}(), room.Events())
+	for _, ev := range timeline {
+		for key := range ev.Map() {
+			if key != "type" && key != "event_id" && key != "content" {
+				t.Errorf("unexpected field %q in %s", key, ev.Raw)
+			}
+		}
+		if ev.Get("type").Str == gomatrixserverlib.MRoomCreate && ev.Get("content.creator").Str != user.ID {
+			t.Errorf("expected content.creator in %s", ev.Raw)
+		}
+	}
+}
+
+func TestSyncAPIIncludeLeave(t *testing.T) {
+	test.WithAllDatabases(t, testSyncAPIIncludeLeave)
+}
+
+func testSyncAPIIncludeLeave(t *testing.T, dbType test.DBType) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	aliceDev := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      alice.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	// Alice joins and then leaves this room, so she should see it but only
+	// what happened while she was joined.
+	leftRoom := test.NewRoom(t, bob)
+	beforeJoin := leftRoom.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "before join"})
+	var whileJoined []*gomatrixserverlib.HeaderedEvent
+	whileJoined = append(whileJoined,
+		leftRoom.CreateAndInsert(t, alice, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(alice.ID)),
+		leftRoom.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "while joined"}),
+		leftRoom.CreateAndInsert(t, alice, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "leave"}, test.WithStateKey(alice.ID)),
+	)
+	afterLeave := leftRoom.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "after leave"})
+
+	// Alice rejects an invite to this room.
+	rejectedRoom := test.NewRoom(t, bob)
+	rejectedRoom.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "invite"}, test.WithStateKey(alice.ID))
+	rejectedRoom.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "secret"})
+	rejectedRoom.CreateAndInsert(t, alice, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "leave"}, test.WithStateKey(alice.ID))
+
+	// Alice is banned from this room before she ever joined it.
+	bannedRoom := test.NewRoom(t, bob)
+	bannedRoom.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "secret"})
+	bannedRoom.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "ban"}, test.WithStateKey(alice.ID))
+
+	base, close := testrig.CreateBaseDendrite(t, dbType)
+	defer close()
+
+	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+	rooms := []*test.Room{leftRoom, rejectedRoom, bannedRoom}
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev}}, &syncRoomserverAPI{rooms: rooms}, &syncKeyAPI{}, &syncFederationAPI{})
+	for _, room := range rooms {
+		testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, base, room.Events())...)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+		"access_token": aliceDev.AccessToken,
+		"timeout":      "0",
+		"filter":       `{"room":{"include_leave":true}}`,
+	})))
+	if w.Code != 200 {
+		t.Fatalf("got HTTP %d want %d", w.Code, 200)
+	}
+	left := gjson.GetBytes(w.Body.Bytes(), "rooms.leave").Map()
+	for _, room := range []*test.Room{rejectedRoom, bannedRoom} {
+		if _, ok := left[room.ID]; ok {
+			t.Errorf("room %s which was never joined is in the response: %s", room.ID, left[room.ID].Raw)
+		}
+	}
+	lr, ok := left[leftRoom.ID]
+	if !ok {
+		t.Fatalf("left room %s is missing from the response", leftRoom.ID)
+	}
+	var timeline []string
+	for _, ev := range lr.Get("timeline.events").Array() {
+		timeline = append(timeline, ev.Get("event_id").Str)
+	}
+	test.AssertEventIDsEqual(t, timeline, whileJoined)
+	for _, ev := range lr.Get("state.events").Array() {
+		if ev.Get("event_id").Str == afterLeave.EventID() || ev.Get("event_id").Str == beforeJoin.EventID() {
+			t.Errorf("unexpected event in state: %s", ev.Raw)
+		}
+		if ev.Get("type").Str == gomatrixserverlib.MRoomMember && ev.Get("state_key").Str == alice.ID {
+			t.Errorf("membership event of the user should be in the timeline: %s", ev.Raw)
+		}
+	}
+}
+
+func TestRoomInitialSync(t *testing.T) {
+	test.WithAllDatabases(t, testRoomInitialSync)
+}
+
+func testRoomInitialSync(t *testing.T, dbType test.DBType) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	aliceDev := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      alice.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	leftRoom := test.NewRoom(t, bob)
+	leftRoom.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "before join"})
+	join := leftRoom.CreateAndInsert(t, alice, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(alice.ID))
+	leave := leftRoom.CreateAndInsert(t, alice, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "leave"}, test.WithStateKey(alice.ID))
+	leftRoom.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "after leave"})
+
+	rejectedRoom := test.NewRoom(t, bob)
+	rejectedRoom.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "invite"}, test.WithStateKey(alice.ID))
+	rejectedRoom.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "secret"})
+	rejectedRoom.CreateAndInsert(t, alice, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "leave"}, test.WithStateKey(alice.ID))
+
+	publicRoom := test.NewRoom(t, bob)
+	publicRoom.CreateAndInsert(t, bob, gomatrixserverlib.MRoomHistoryVisibility, map[string]interface{}{"history_visibility": "world_readable"}, test.WithStateKey(""))
+	publicRoom.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "public"})
+
+	base, close := testrig.CreateBaseDendrite(t, dbType)
+	defer close()
+
+	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+	rooms := []*test.Room{leftRoom, rejectedRoom, publicRoom}
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev}}, &syncRoomserverAPI{rooms: rooms}, &syncKeyAPI{}, &syncFederationAPI{})
+	for _, room := range rooms {
+		testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, base, room.Events())...)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	testCases := []struct {
+		name       string
+		room       *test.Room
+		wantCode   int
+		wantEvents []*gomatrixserverlib.HeaderedEvent
+	}{
+		{name: "left room", room: leftRoom, wantCode: http.StatusOK, wantEvents: []*gomatrixserverlib.HeaderedEvent{join, leave}},
+		{name: "rejected invite", room: rejectedRoom, wantCode: http.StatusForbidden},
+		{name: "world readable room", room: publicRoom, wantCode: http.StatusOK, wantEvents: publicRoom.Events()},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/rooms/"+tc.room.ID+"/initialSync", test.WithQueryParams(map[string]string{
+			"access_token": aliceDev.AccessToken,
+		})))
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d want %d: %s", tc.name, w.Code, tc.wantCode, w.Body.String())
+			continue
+		}
+		if tc.wantCode != http.StatusOK {
+			continue
+		}
+		var messages []string
+		for _, ev := range gjson.GetBytes(w.Body.Bytes(), "messages.chunk").Array() {
+			messages = append(messages, ev.Get("event_id").Str)
+		}
+		test.AssertEventIDsEqual(t, messages, tc.wantEvents)
+	}
+}
+
+func TestSyncAPIAccountDataDeletion(t *testing.T) {
+	test.WithAllDatabases(t, testSyncAPIAccountDataDeletion)
+}
+
+func testSyncAPIAccountDataDeletion(t *testing.T, dbType test.DBType) {
+	user := test.NewUser(t)
+	room := test.NewRoom(t, user)
+	alice := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      user.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	base, close := testrig.CreateBaseDendrite(t, dbType)
+	defer close()
+
+	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+	userAPI := &syncUserAPI{
+		accounts:    []userapi.Device{alice},
+		accountData: map[string]json.RawMessage{"org.example.data": json.RawMessage(`{"foo":"bar"}`)},
+	}
+	AddPublicRoutes(base, userAPI, &syncRoomserverAPI{rooms: []*test.Room{room}}, &syncKeyAPI{}, &syncFederationAPI{})
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, base, room.Events())...)
+
+	publishAccountData := func(data eventutil.AccountData) {
+		msg := &nats.Msg{
+			Subject: base.Cfg.Global.JetStream.Prefixed(jetstream.OutputClientData),
+			Header:  nats.Header{},
+		}
+		msg.Header.Set(jetstream.UserID, user.ID)
+		var err error
+		if msg.Data, err = json.Marshal(data); err != nil {
+			t.Fatal(err)
+		}
+		testrig.MustPublishMsgs(t, jsctx, msg)
+		time.Sleep(500 * time.Millisecond)
+	}
+	syncAccountData := func(since string) (string, map[string]string) {
+		w := httptest.NewRecorder()
+		base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+			"access_token": alice.AccessToken,
+			"timeout":      "0",
+			"since":        since,
+		})))
+		if w.Code != 200 {
+			t.Fatalf("got HTTP %d want %d", w.Code, 200)
+		}
+		res := gjson.ParseBytes(w.Body.Bytes())
+		contents := map[string]string{}
+		for _, ev := range res.Get("account_data.events").Array() {
+			contents[ev.Get("type").Str] = ev.Get("content").Raw
+		}
+		return res.Get("next_batch").Str, contents
+	}
+
+	publishAccountData(eventutil.AccountData{Type: "org.example.data"})
+	since, contents := syncAccountData("")
+	if got := contents["org.example.data"]; got != `{"foo":"bar"}` {
+		t.Fatalf("expected account data in the initial sync, got %q", got)
+	}
+
+	// Once the account data is deleted, an incremental sync should tell the
+	// client about it with empty content, and a complete sync shouldn't
+	// include it at all.
+	delete(userAPI.accountData, "org.example.data")
+	publishAccountData(eventutil.AccountData{Type: "org.example.data", Deleted: true})
+	_, contents = syncAccountData(since)
+	if got, ok := contents["org.example.data"]; !ok || got != `{}` {
+		t.Errorf("expected deleted account data with empty content, got %q", got)
+	}
+	_, contents = syncAccountData("")
+	if _, ok := contents["org.example.data"]; ok {
+		t.Errorf("expected deleted account data to be missing from a complete sync")
+	}
+}
+
+func TestSlidingSync(t *testing.T) {
+	test.WithAllDatabases(t, testSlidingSync)
+}
+
+func testSlidingSync(t *testing.T, dbType test.DBType) {
+	user := test.NewUser(t)
+	room := test.NewRoom(t, user)
+	alice := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      user.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	base, close := testrig.CreateBaseDendrite(t, dbType)
+	defer close()
+
+	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, &syncKeyAPI{}, &syncFederationAPI{})
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, base, room.Events())...)
+	time.Sleep(500 * time.Millisecond)
+
+	slidingSync := func(pos string, body map[string]interface{}) (int, gjson.Result) {
+		w := httptest.NewRecorder()
+		base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "POST", "/_matrix/client/unstable/org.matrix.msc3575/sync",
+			test.WithJSONBody(t, body),
+			test.WithQueryParams(map[string]string{
+				"access_token": alice.AccessToken,
+				"timeout":      "0",
+				"pos":          pos,
+			}),
+		))
+		return w.Code, gjson.ParseBytes(w.Body.Bytes())
+	}
+
+	// The initial request returns the room with its timeline and the
+	// required state.
+	code, res := slidingSync("", map[string]interface{}{
+		"conn_id": "test",
+		"lists": map[string]interface{}{
+			"all": map[string]interface{}{
+				"ranges":         [][2]int{{0, 10}},
+				"timeline_limit": 1,
+				"required_state": [][2]string{{"m.room.create", ""}},
+			},
+		},
+		"extensions": map[string]interface{}{
+			"to_device": map[string]interface{}{"enabled": true},
+		},
+	})
+	if code != 200 {
+		t.Fatalf("got HTTP %d want 200: %s", code, res.Raw)
+	}
+	if got := res.Get("lists.all.count").Int(); got != 1 {
+		t.Errorf("got list count %d want 1", got)
+	}
+	if got := res.Get("lists.all.ops.0.room_ids.0").Str; got != room.ID {
+		t.Errorf("got room %q in window want %q", got, room.ID)
+	}
+	roomRes := res.Get("rooms").Map()[room.ID]
+	if !roomRes.Get("initial").Bool() {
+		t.Errorf("expected room to be initial: %s", roomRes.Raw)
+	}
+	events := room.Events()
+	if got := roomRes.Get("timeline.#.event_id").Array(); len(got) != 1 || got[0].Str != events[len(events)-1].EventID() {
+		t.Errorf("got timeline %v want the latest event", got)
+	}
+	if got := roomRes.Get("required_state.#.type").Array(); len(got) != 1 || got[0].Str != "m.room.create" {
+		t.Errorf("got required state %v want m.room.create", got)
+	}
+	if !res.Get("extensions.to_device.next_batch").Exists() {
+		t.Errorf("expected to_device extension in response")
+	}
+	pos := res.Get("pos").Str
+
+	// Nothing has changed, so there are no rooms or operations.
+	code, res = slidingSync(pos, map[string]interface{}{"conn_id": "test"})
+	if code != 200 {
+		t.Fatalf("got HTTP %d want 200: %s", code, res.Raw)
+	}
+	if res.Get("rooms").Map()[room.ID].Exists() || res.Get("lists.all.ops").Exists() {
+		t.Errorf("expected no changes: %s", res.Raw)
+	}
+	pos = res.Get("pos").Str
+
+	// A new message is sent down as an incremental update.
+	msg := room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "hello"})
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, base, []*gomatrixserverlib.HeaderedEvent{msg})...)
+	time.Sleep(100 * time.Millisecond)
+	code, res = slidingSync(pos, map[string]interface{}{"conn_id": "test"})
+	if code != 200 {
+		t.Fatalf("got HTTP %d want 200: %s", code, res.Raw)
+	}
+	roomRes = res.Get("rooms").Map()[room.ID]
+	if roomRes.Get("initial").Bool() {
+		t.Errorf("expected room not to be initial: %s", roomRes.Raw)
+	}
+	if got := roomRes.Get("timeline.#.event_id").Array(); len(got) != 1 || got[0].Str != msg.EventID() {
+		t.Errorf("got timeline %v want %s", got, msg.EventID())
+	}
+
+	// If the client didn't get the response, it retries with the same
+	// position and is sent the same update again.
+	code, res = slidingSync(pos, map[string]interface{}{"conn_id": "test"})
+	if code != 200 {
+		t.Fatalf("got HTTP %d want 200 when retrying: %s", code, res.Raw)
+	}
+	roomRes = res.Get("rooms").Map()[room.ID]
+	if got := roomRes.Get("timeline.#.event_id").Array(); len(got) != 1 || got[0].Str != msg.EventID() {
+		t.Errorf("got timeline %v want %s when retrying", got, msg.EventID())
+	}
+
+	// Once the client has used the next position, it can't go back.
+	code, res = slidingSync(res.Get("pos").Str, map[string]interface{}{"conn_id": "test"})
+	if code != 200 {
+		t.Fatalf("got HTTP %d want 200: %s", code, res.Raw)
+	}
+	code, res = slidingSync(pos, map[string]interface{}{"conn_id": "test"})
+	if code != 400 || res.Get("errcode").Str != "M_UNKNOWN_POS" {
+		t.Errorf("got HTTP %d %s want 400 M_UNKNOWN_POS for an old position", code, res.Raw)
+	}
+
+	// Unknown positions are rejected.
+	code, res = slidingSync("unknown", map[string]interface{}{"conn_id": "test"})
+	if code != 400 || res.Get("errcode").Str != "M_UNKNOWN_POS" {
+		t.Errorf("got HTTP %d %s want 400 M_UNKNOWN_POS", code, res.Raw)
+	}
+}
+
+func TestAdminRebuildNotElected(t *testing.T) {
+	user := test.NewUser(t)
+	admin := userapi.Device{
+		ID:          "ADMINID",
+		UserID:      user.ID,
+		AccessToken: "ADMIN_BEARER_TOKEN",
+		AccountType: userapi.AccountTypeAdmin,
+	}
+
+	base, close := testrig.CreateBaseDendrite(t, test.DBTypeSQLite)
+	defer close()
+	base.Cfg.SyncAPI.MultipleInstances = true
+
+	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+	// Another instance already holds the lease, so this one is never elected.
+	bucket := jetstream.Tokenise(base.Cfg.Global.JetStream.Prefixed("SyncAPILeader"))
+	kv, err := jsctx.CreateKeyValue(&nats.KeyValueConfig{
+		Bucket:  bucket,
+		History: 1,
+		Storage: nats.MemoryStorage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jsctx.DeleteKeyValue(bucket) // nolint:errcheck
+	if _, err = kv.Create("leader", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{admin}}, &syncRoomserverAPI{}, &syncKeyAPI{}, &syncFederationAPI{})
+
+	testCases := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{name: "rebuild status", method: "GET", path: "/_dendrite/admin/rebuildSyncAPI", wantCode: http.StatusOK},
+		{name: "start rebuild", method: "POST", path: "/_dendrite/admin/rebuildSyncAPI", wantCode: http.StatusServiceUnavailable},
+		{name: "rebuild room state", method: "POST", path: "/_dendrite/admin/rebuildRoomState/!room:test", wantCode: http.StatusServiceUnavailable},
+		{name: "repair room state", method: "POST", path: "/_dendrite/admin/fsckSyncAPI/!room:test", body: `{"repair":true}`, wantCode: http.StatusServiceUnavailable},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		req := test.NewRequest(t, tc.method, tc.path, test.WithQueryParams(map[string]string{
+			"access_token": admin.AccessToken,
+		}))
+		if tc.body != "" {
+			req.Body = io.NopCloser(strings.NewReader(tc.body))
+			req.ContentLength = int64(len(tc.body))
+		}
+		base.DendriteAdminMux.ServeHTTP(w, req)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d want %d: %s", tc.name, w.Code, tc.wantCode, w.Body.String())
+		}
+	}
+}
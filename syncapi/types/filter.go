@@ -0,0 +1,143 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// unreadThreadNotificationsPath is where the MSC3773 option lives in a filter.
+const unreadThreadNotificationsPath = "room.timeline.unread_thread_notifications"
+
+// Filter is a gomatrixserverlib.Filter along with the filter options which
+// it doesn't support yet.
+type Filter struct {
+	gomatrixserverlib.Filter
+	// UnreadThreadNotifications is true if the client wants MSC3773 unread
+	// notification counts for each thread. The main timeline counts are then
+	// sent separately from the thread counts.
+	UnreadThreadNotifications bool
+}
+
+// DefaultFilter returns the default filter used by the Matrix server if no
+// filter is provided in the request.
+func DefaultFilter() Filter {
+	return Filter{Filter: gomatrixserverlib.DefaultFilter()}
+}
+
+func (f Filter) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(f.Filter)
+	if err != nil || !f.UnreadThreadNotifications {
+		return b, err
+	}
+	return sjson.SetBytes(b, unreadThreadNotificationsPath, true)
+}
+
+func (f *Filter) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &f.Filter); err != nil {
+		return err
+	}
+	f.UnreadThreadNotifications = gjson.GetBytes(b, unreadThreadNotificationsPath).Bool()
+	return nil
+}
+
+// AllowsRoom returns true if the top-level rooms and not_rooms lists of the
+// filter allow the given room.
+func (f *Filter) AllowsRoom(roomID string) bool {
+	return RoomAllowed(f.Room.Rooms, f.Room.NotRooms, roomID)
+}
+
+// RoomAllowed returns true if the room is in rooms, or rooms is nil, and
+// isn't in notRooms.
+func RoomAllowed(rooms, notRooms *[]string, roomID string) bool {
+	if notRooms != nil && containsString(*notRooms, roomID) {
+		return false
+	}
+	return rooms == nil || containsString(*rooms, roomID)
+}
+
+// EventAllowed returns true if an event with the given sender and type is
+// allowed by the senders and types lists of a filter. The types may contain
+// '*' wildcards.
+func EventAllowed(senders, notSenders, types, notTypes *[]string, sender, eventType string) bool {
+	if notSenders != nil && containsString(*notSenders, sender) {
+		return false
+	}
+	if senders != nil && !containsString(*senders, sender) {
+		return false
+	}
+	if notTypes != nil && matchesAnyType(*notTypes, eventType) {
+		return false
+	}
+	return types == nil || matchesAnyType(*types, eventType)
+}
+
+// RoomEventAllowed returns true if the event is allowed by the senders, types
+// and contains_url options of the filter. The rooms lists are left to the
+// caller, since they usually apply to a whole room rather than each event.
+func RoomEventAllowed(filter *gomatrixserverlib.RoomEventFilter, ev *gomatrixserverlib.HeaderedEvent) bool {
+	if !EventAllowed(filter.Senders, filter.NotSenders, filter.Types, filter.NotTypes, ev.Sender(), ev.Type()) {
+		return false
+	}
+	if filter.ContainsURL != nil {
+		// This matches how the contains_url column is populated in storage.
+		return gjson.GetBytes(ev.Content(), "url").Exists() == *filter.ContainsURL
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyType returns true if the event type matches any of the patterns,
+// where '*' matches any sequence of characters.
+func matchesAnyType(patterns []string, eventType string) bool {
+	for _, pattern := range patterns {
+		if matchesType(pattern, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesType(pattern, eventType string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == eventType
+	}
+	if !strings.HasPrefix(eventType, parts[0]) {
+		return false
+	}
+	eventType = eventType[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(eventType, part)
+		if i < 0 {
+			return false
+		}
+		eventType = eventType[i+len(part):]
+	}
+	return strings.HasSuffix(eventType, parts[len(parts)-1])
+}
@@ -68,14 +68,26 @@ type PresenceInternal struct {
 
 // Equals compares p1 with p2.
 func (p1 *PresenceInternal) Equals(p2 *PresenceInternal) bool {
-	return p1.ClientFields.Presence == p2.ClientFields.Presence &&
-		p1.ClientFields.StatusMsg == p2.ClientFields.StatusMsg &&
-		p1.UserID == p2.UserID
+	if p1.ClientFields.Presence != p2.ClientFields.Presence || p1.UserID != p2.UserID {
+		return false
+	}
+	if p1.ClientFields.StatusMsg == nil || p2.ClientFields.StatusMsg == nil {
+		return p1.ClientFields.StatusMsg == p2.ClientFields.StatusMsg
+	}
+	return *p1.ClientFields.StatusMsg == *p2.ClientFields.StatusMsg
 }
 
-// CurrentlyActive returns the current active state.
+// CurrentlyActiveWindow is how recently a user must have done something
+// to be considered currently active.
+const CurrentlyActiveWindow = time.Minute
+
+// CurrentlyActive returns the current active state. Only online users can
+// be currently active.
 func (p *PresenceInternal) CurrentlyActive() bool {
-	return time.Since(p.LastActiveTS.Time()).Minutes() < 5
+	if p.Presence != PresenceOnline {
+		return false
+	}
+	return time.Since(p.LastActiveTS.Time()) < CurrentlyActiveWindow
 }
 
 // LastActiveAgo returns the time since the LastActiveTS in milliseconds.
@@ -14,7 +14,7 @@ type SyncRequest struct {
 	Log           *logrus.Entry
 	Device        *userapi.Device
 	Response      *Response
-	Filter        gomatrixserverlib.Filter
+	Filter        Filter
 	Since         StreamingToken
 	Timeout       time.Duration
 	WantFullState bool
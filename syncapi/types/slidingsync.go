@@ -0,0 +1,199 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Sort orders for sliding sync lists.
+const (
+	SlidingSortByRecency           = "by_recency"
+	SlidingSortByNotificationLevel = "by_notification_level"
+)
+
+// Operations on sliding sync list windows.
+const (
+	SlidingOpSync       = "SYNC"
+	SlidingOpInvalidate = "INVALIDATE"
+)
+
+// SlidingSyncRequest represents an MSC3575 sliding sync request body. Lists,
+// room subscriptions and extensions are sticky: anything which is omitted
+// keeps the value from the previous request on the same connection.
+type SlidingSyncRequest struct {
+	ConnID            string                       `json:"conn_id"`
+	TxnID             string                       `json:"txn_id,omitempty"`
+	Lists             map[string]SlidingList       `json:"lists"`
+	RoomSubscriptions map[string]SlidingRoomConfig `json:"room_subscriptions"`
+	UnsubscribeRooms  []string                     `json:"unsubscribe_rooms"`
+	Extensions        SlidingExtensionsRequest     `json:"extensions"`
+}
+
+// SlidingRoomConfig describes how much of a room the client wants to see.
+// Each required state entry is an event type and state key pair. Either may
+// be "*" to match everything, and the state key may be "$ME" for the syncing
+// user or "$LAZY" for the senders of the timeline events.
+type SlidingRoomConfig struct {
+	RequiredState [][2]string `json:"required_state,omitempty"`
+	TimelineLimit *int        `json:"timeline_limit,omitempty"`
+}
+
+// SlidingList is a sorted list of rooms, of which the client sees the rooms
+// in the given ranges. Ranges are inclusive at both ends.
+type SlidingList struct {
+	SlidingRoomConfig
+	Ranges  [][2]int            `json:"ranges,omitempty"`
+	Sort    []string            `json:"sort,omitempty"`
+	Filters *SlidingListFilters `json:"filters,omitempty"`
+}
+
+// SlidingListFilters restricts which rooms appear in a list.
+type SlidingListFilters struct {
+	IsDM     *bool `json:"is_dm,omitempty"`
+	IsInvite *bool `json:"is_invite,omitempty"`
+}
+
+type SlidingExtensionsRequest struct {
+	ToDevice    *SlidingToDeviceRequest  `json:"to_device,omitempty"`
+	E2EE        *SlidingExtensionRequest `json:"e2ee,omitempty"`
+	AccountData *SlidingExtensionRequest `json:"account_data,omitempty"`
+	Receipts    *SlidingExtensionRequest `json:"receipts,omitempty"`
+	Typing      *SlidingExtensionRequest `json:"typing,omitempty"`
+}
+
+type SlidingExtensionRequest struct {
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+// IsEnabled returns true if the extension is present and enabled.
+func (e *SlidingExtensionRequest) IsEnabled() bool {
+	return e != nil && e.Enabled != nil && *e.Enabled
+}
+
+// SlidingToDeviceRequest enables the to-device extension. Since is the
+// next_batch from the previous to-device extension response, and messages
+// before it are deleted.
+type SlidingToDeviceRequest struct {
+	SlidingExtensionRequest
+	Since string `json:"since,omitempty"`
+}
+
+// SlidingSyncResponse represents an MSC3575 sliding sync response.
+type SlidingSyncResponse struct {
+	Pos        string                         `json:"pos"`
+	TxnID      string                         `json:"txn_id,omitempty"`
+	Lists      map[string]SlidingListResponse `json:"lists"`
+	Rooms      map[string]SlidingRoom         `json:"rooms"`
+	Extensions SlidingExtensionsResponse      `json:"extensions"`
+}
+
+// NewSlidingSyncResponse creates an empty response with initialised maps.
+func NewSlidingSyncResponse() *SlidingSyncResponse {
+	return &SlidingSyncResponse{
+		Lists: map[string]SlidingListResponse{},
+		Rooms: map[string]SlidingRoom{},
+	}
+}
+
+// HasUpdates returns true if there is anything in the response other than
+// list counts.
+func (r *SlidingSyncResponse) HasUpdates() bool {
+	for _, list := range r.Lists {
+		if len(list.Ops) > 0 {
+			return true
+		}
+	}
+	return len(r.Rooms) > 0 || r.Extensions.hasUpdates()
+}
+
+type SlidingListResponse struct {
+	Count int             `json:"count"`
+	Ops   []SlidingListOp `json:"ops,omitempty"`
+}
+
+// SlidingListOp replaces (SYNC) or forgets (INVALIDATE) the rooms in a range
+// of a list.
+type SlidingListOp struct {
+	Op      string   `json:"op"`
+	Range   [2]int   `json:"range"`
+	RoomIDs []string `json:"room_ids,omitempty"`
+}
+
+// SlidingRoom is a room in a sliding sync response. If Initial is true then
+// the client should replace what it knows about the room, otherwise the
+// timeline events follow on from the previous response.
+type SlidingRoom struct {
+	Name              string                          `json:"name,omitempty"`
+	Initial           bool                            `json:"initial,omitempty"`
+	Heroes            []SlidingRoomHero               `json:"heroes,omitempty"`
+	RequiredState     []gomatrixserverlib.ClientEvent `json:"required_state,omitempty"`
+	Timeline          []gomatrixserverlib.ClientEvent `json:"timeline,omitempty"`
+	InviteState       []json.RawMessage               `json:"invite_state,omitempty"`
+	PrevBatch         *TopologyToken                  `json:"prev_batch,omitempty"`
+	Limited           bool                            `json:"limited,omitempty"`
+	JoinedCount       *int                            `json:"joined_count,omitempty"`
+	InvitedCount      *int                            `json:"invited_count,omitempty"`
+	NotificationCount int                             `json:"notification_count"`
+	HighlightCount    int                             `json:"highlight_count"`
+}
+
+type SlidingRoomHero struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type SlidingExtensionsResponse struct {
+	ToDevice    *SlidingToDeviceResponse    `json:"to_device,omitempty"`
+	E2EE        *SlidingE2EEResponse        `json:"e2ee,omitempty"`
+	AccountData *SlidingAccountDataResponse `json:"account_data,omitempty"`
+	Receipts    *SlidingEphemeralResponse   `json:"receipts,omitempty"`
+	Typing      *SlidingEphemeralResponse   `json:"typing,omitempty"`
+}
+
+func (r *SlidingExtensionsResponse) hasUpdates() bool {
+	return (r.ToDevice != nil && len(r.ToDevice.Events) > 0) ||
+		(r.E2EE != nil && (len(r.E2EE.DeviceLists.Changed) > 0 || len(r.E2EE.DeviceLists.Left) > 0)) ||
+		(r.AccountData != nil && (len(r.AccountData.Global) > 0 || len(r.AccountData.Rooms) > 0)) ||
+		(r.Receipts != nil && len(r.Receipts.Rooms) > 0) ||
+		(r.Typing != nil && len(r.Typing.Rooms) > 0)
+}
+
+type SlidingToDeviceResponse struct {
+	NextBatch string                                `json:"next_batch"`
+	Events    []gomatrixserverlib.SendToDeviceEvent `json:"events"`
+}
+
+type SlidingE2EEResponse struct {
+	DeviceLists struct {
+		Changed []string `json:"changed,omitempty"`
+		Left    []string `json:"left,omitempty"`
+	} `json:"device_lists"`
+	DeviceOneTimeKeysCount map[string]int `json:"device_one_time_keys_count"`
+}
+
+type SlidingAccountDataResponse struct {
+	Global []gomatrixserverlib.ClientEvent            `json:"global"`
+	Rooms  map[string][]gomatrixserverlib.ClientEvent `json:"rooms"`
+}
+
+// SlidingEphemeralResponse holds the receipt or typing EDU for each room which
+// has changed.
+type SlidingEphemeralResponse struct {
+	Rooms map[string]gomatrixserverlib.ClientEvent `json:"rooms"`
+}
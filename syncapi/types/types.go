@@ -418,10 +418,15 @@ type JoinResponse struct {
 	AccountData struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
 	} `json:"account_data"`
-	UnreadNotifications struct {
-		HighlightCount    int `json:"highlight_count"`
-		NotificationCount int `json:"notification_count"`
-	} `json:"unread_notifications"`
+	UnreadNotifications       UnreadNotifications            `json:"unread_notifications"`
+	UnreadThreadNotifications map[string]UnreadNotifications `json:"unread_thread_notifications,omitempty"`
+}
+
+// UnreadNotifications holds the unread notification counts of a room, or of a
+// thread in a room.
+type UnreadNotifications struct {
+	HighlightCount    int `json:"highlight_count"`
+	NotificationCount int `json:"notification_count"`
 }
 
 // NewJoinResponse creates an empty response with initialised arrays.
@@ -507,6 +512,8 @@ type ReadUpdate struct {
 	RoomID    string         `json:"room_id"`
 	Read      StreamPosition `json:"read,omitempty"`
 	FullyRead StreamPosition `json:"fully_read,omitempty"`
+	// ThreadID is the thread which the read receipt applies to, if any.
+	ThreadID string `json:"thread_id,omitempty"`
 }
 
 // StreamEvent is the same as gomatrixserverlib.Event but also has the PDU stream position for this event.
@@ -521,6 +528,7 @@ type OutputReceiptEvent struct {
 	RoomID    string                      `json:"room_id"`
 	EventID   string                      `json:"event_id"`
 	Type      string                      `json:"type"`
+	ThreadID  string                      `json:"thread_id,omitempty"`
 	Timestamp gomatrixserverlib.Timestamp `json:"timestamp"`
 }
 
@@ -3,6 +3,7 @@ package types
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -63,3 +64,89 @@ func TestNewInviteResponse(t *testing.T) {
 		t.Fatalf("Invite response didn't contain correct info")
 	}
 }
+
+func TestFilterUnreadThreadNotifications(t *testing.T) {
+	var filter Filter
+	if err := json.Unmarshal([]byte(`{"room":{"timeline":{"limit":5,"unread_thread_notifications":true}}}`), &filter); err != nil {
+		t.Fatal(err)
+	}
+	if !filter.UnreadThreadNotifications || filter.Room.Timeline.Limit != 5 {
+		t.Fatalf("unexpected filter: %+v", filter)
+	}
+
+	// The option must survive being stored and loaded again.
+	b, err := json.Marshal(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Filter
+	if err = json.Unmarshal(b, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.UnreadThreadNotifications || loaded.Room.Timeline.Limit != 5 {
+		t.Fatalf("unexpected filter after round trip: %s", b)
+	}
+
+	b, err = json.Marshal(DefaultFilter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(b, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.UnreadThreadNotifications {
+		t.Fatalf("default filter shouldn't ask for thread notifications: %s", b)
+	}
+}
+
+func TestEventAllowed(t *testing.T) {
+	types := []string{"m.room.*", "*.custom", "org.*.event", "exact"}
+	for eventType, want := range map[string]bool{
+		"m.room.message":      true,
+		"m.room":              false,
+		"com.example.custom":  true,
+		"org.example.event":   true,
+		"org.event":           false,
+		"exact":               true,
+		"exactly":             false,
+		"m.presence":          false,
+		"org.example.event.x": false,
+	} {
+		if got := EventAllowed(nil, nil, &types, nil, "@alice:test", eventType); got != want {
+			t.Errorf("EventAllowed(%q) = %v, want %v", eventType, got, want)
+		}
+	}
+	if EventAllowed(nil, &[]string{"@alice:test"}, nil, nil, "@alice:test", "m.room.message") {
+		t.Errorf("not_senders should exclude the sender")
+	}
+	if EventAllowed(&[]string{"@bob:test"}, nil, nil, nil, "@alice:test", "m.room.message") {
+		t.Errorf("senders should exclude other senders")
+	}
+	if EventAllowed(nil, nil, nil, &types, "@alice:test", "m.room.message") {
+		t.Errorf("not_types should exclude matching wildcard types")
+	}
+	if !RoomAllowed(nil, nil, "!a:test") || RoomAllowed(&[]string{"!b:test"}, nil, "!a:test") || RoomAllowed(nil, &[]string{"!a:test"}, "!a:test") {
+		t.Errorf("unexpected RoomAllowed result")
+	}
+}
+
+func TestPresenceCurrentlyActive(t *testing.T) {
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	old := gomatrixserverlib.AsTimestamp(time.Now().Add(-CurrentlyActiveWindow * 2))
+	tests := []struct {
+		presence     Presence
+		lastActiveTS gomatrixserverlib.Timestamp
+		want         bool
+	}{
+		{PresenceOnline, now, true},
+		{PresenceOnline, old, false},
+		{PresenceUnavailable, now, false},
+		{PresenceOffline, now, false},
+	}
+	for _, tt := range tests {
+		p := PresenceInternal{Presence: tt.presence, LastActiveTS: tt.lastActiveTS}
+		if got := p.CurrentlyActive(); got != tt.want {
+			t.Errorf("%s active at %d: got currently_active %v, want %v", tt.presence, tt.lastActiveTS, got, tt.want)
+		}
+	}
+}
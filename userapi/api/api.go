@@ -99,6 +99,7 @@ type ClientUserAPI interface {
 	SetDisplayName(ctx context.Context, req *PerformUpdateDisplayNameRequest, res *struct{}) error
 	QueryNotifications(ctx context.Context, req *QueryNotificationsRequest, res *QueryNotificationsResponse) error
 	InputAccountData(ctx context.Context, req *InputAccountDataRequest, res *InputAccountDataResponse) error
+	PerformAccountDataDeletion(ctx context.Context, req *PerformAccountDataDeletionRequest, res *struct{}) error
 	PerformKeyBackup(ctx context.Context, req *PerformKeyBackupRequest, res *PerformKeyBackupResponse) error
 	QueryKeyBackup(ctx context.Context, req *QueryKeyBackupRequest, res *QueryKeyBackupResponse)
 
@@ -212,6 +213,13 @@ type InputAccountDataRequest struct {
 type InputAccountDataResponse struct {
 }
 
+// PerformAccountDataDeletionRequest is the request for PerformAccountDataDeletion
+type PerformAccountDataDeletionRequest struct {
+	UserID   string // required: the user to delete account data for
+	RoomID   string // optional: the room that the account data is associated with
+	DataType string // required: the data type of the data
+}
+
 type PerformDeviceUpdateRequest struct {
 	RequestingUserID string
 	DeviceID         string
@@ -566,6 +574,10 @@ type QueryNotificationsResponse struct {
 	Notifications []*Notification `json:"notifications"` // Required.
 }
 
+// MainThreadID is the MSC3771 thread ID of the main timeline, which holds the
+// events which aren't in a thread.
+const MainThreadID = "main"
+
 type Notification struct {
 	Actions    []*pushrules.Action           `json:"actions"`     // Required.
 	Event      gomatrixserverlib.ClientEvent `json:"event"`       // Required.
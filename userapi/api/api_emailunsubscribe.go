@@ -0,0 +1,74 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EmailUnsubscribePath is the path of the client API endpoint which
+// removes an email pusher, linked to from the bottom of each digest email.
+const EmailUnsubscribePath = "/_matrix/client/unstable/org.matrix.dendrite.email/unsubscribe"
+
+// EmailUnsubscribeLinkLifetime is how long an unsubscribe link can be used
+// for. Every digest email has a new link, so only old emails are affected.
+const EmailUnsubscribeLinkLifetime = 30 * 24 * time.Hour
+
+// emailUnsubscribeToken returns the MAC of the fields of an unsubscribe link.
+// The fields are separated by NUL bytes, which none of them can contain.
+func emailUnsubscribeToken(secret, userID, appID, pushKey, expires string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{"email_unsubscribe", userID, appID, pushKey, expires}, "\x00")))
+	return mac.Sum(nil)
+}
+
+// EmailUnsubscribeURL returns a link which removes an email pusher of a
+// user. The link is authenticated with the unsubscribe secret, so it can't
+// be used to remove anyone else's pushers, and expires after
+// EmailUnsubscribeLinkLifetime.
+func EmailUnsubscribeURL(publicBaseURL, secret, userID, appID, pushKey string, now time.Time) string {
+	expires := strconv.FormatInt(now.Add(EmailUnsubscribeLinkLifetime).UnixMilli(), 10)
+	q := url.Values{
+		"user_id": {userID},
+		"app_id":  {appID},
+		"pushkey": {pushKey},
+		"expires": {expires},
+		"token":   {base64.RawURLEncoding.EncodeToString(emailUnsubscribeToken(secret, userID, appID, pushKey, expires))},
+	}
+	return strings.TrimSuffix(publicBaseURL, "/") + EmailUnsubscribePath + "?" + q.Encode()
+}
+
+// VerifyEmailUnsubscribeToken checks the token from the query of an
+// unsubscribe link, and that the link hasn't expired.
+func VerifyEmailUnsubscribeToken(secret string, q url.Values, now time.Time) bool {
+	if secret == "" {
+		return false
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || now.UnixMilli() > expires {
+		return false
+	}
+	token, err := base64.RawURLEncoding.DecodeString(q.Get("token"))
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(token, emailUnsubscribeToken(secret, q.Get("user_id"), q.Get("app_id"), q.Get("pushkey"), q.Get("expires")))
+}
@@ -33,6 +33,11 @@ func (t *UserInternalAPITrace) InputAccountData(ctx context.Context, req *InputA
 	util.GetLogger(ctx).Infof("InputAccountData req=%+v res=%+v", js(req), js(res))
 	return err
 }
+func (t *UserInternalAPITrace) PerformAccountDataDeletion(ctx context.Context, req *PerformAccountDataDeletionRequest, res *struct{}) error {
+	err := t.Impl.PerformAccountDataDeletion(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformAccountDataDeletion req=%+v res=%+v", js(req), js(res))
+	return err
+}
 func (t *UserInternalAPITrace) PerformAccountCreation(ctx context.Context, req *PerformAccountCreationRequest, res *PerformAccountCreationResponse) error {
 	err := t.Impl.PerformAccountCreation(ctx, req, res)
 	util.GetLogger(ctx).Infof("PerformAccountCreation req=%+v res=%+v", js(req), js(res))
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/internal/pushgateway"
 	"github.com/matrix-org/dendrite/internal/pushrules"
@@ -23,6 +24,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/nats-io/nats.go"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 type OutputStreamEventConsumer struct {
@@ -34,7 +36,8 @@ type OutputStreamEventConsumer struct {
 	durable      string
 	db           storage.Database
 	topic        string
-	pgClient     pushgateway.Client
+	pushSender   *util.PushSender
+	caches       caching.PushCache
 	syncProducer *producers.SyncAPI
 }
 
@@ -43,7 +46,8 @@ func NewOutputStreamEventConsumer(
 	cfg *config.UserAPI,
 	js nats.JetStreamContext,
 	store storage.Database,
-	pgClient pushgateway.Client,
+	pushSender *util.PushSender,
+	caches caching.PushCache,
 	userAPI api.UserInternalAPI,
 	rsAPI rsapi.UserRoomserverAPI,
 	syncProducer *producers.SyncAPI,
@@ -55,7 +59,8 @@ func NewOutputStreamEventConsumer(
 		db:           store,
 		durable:      cfg.Matrix.JetStream.Durable("UserAPISyncAPIStreamEventConsumer"),
 		topic:        cfg.Matrix.JetStream.Prefixed(jetstream.OutputStreamEvent),
-		pgClient:     pgClient,
+		pushSender:   pushSender,
+		caches:       caches,
 		userAPI:      userAPI,
 		rsAPI:        rsAPI,
 		syncProducer: syncProducer,
@@ -100,6 +105,15 @@ func (s *OutputStreamEventConsumer) onMessage(ctx context.Context, msg *nats.Msg
 }
 
 func (s *OutputStreamEventConsumer) processMessage(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, pos int64) error {
+	// The cached room state that push rules are evaluated against is
+	// only valid until the state changes.
+	switch event.Type() {
+	case gomatrixserverlib.MRoomMember:
+		s.caches.InvalidatePushRoomMembers(event.RoomID())
+	case gomatrixserverlib.MRoomPowerLevels:
+		s.caches.InvalidatePushPowerLevels(event.RoomID())
+	}
+
 	members, roomSize, err := s.localRoomMembers(ctx, event.RoomID())
 	if err != nil {
 		return fmt.Errorf("s.localRoomMembers: %w", err)
@@ -179,25 +193,31 @@ func newLocalMembership(event *gomatrixserverlib.ClientEvent) (*localMembership,
 }
 
 // localRoomMembers fetches the current local members of a room, and
-// the total number of members.
+// the total number of members. The member events are cached until the
+// membership of the room changes.
 func (s *OutputStreamEventConsumer) localRoomMembers(ctx context.Context, roomID string) ([]*localMembership, int, error) {
-	req := &rsapi.QueryMembershipsForRoomRequest{
-		RoomID:     roomID,
-		JoinedOnly: true,
-		LocalOnly:  true,
-	}
-	var res rsapi.QueryMembershipsForRoomResponse
+	joinEvents, ok := s.caches.GetPushRoomMembers(roomID)
+	if !ok {
+		req := &rsapi.QueryMembershipsForRoomRequest{
+			RoomID:     roomID,
+			JoinedOnly: true,
+			LocalOnly:  true,
+		}
+		var res rsapi.QueryMembershipsForRoomResponse
 
-	// XXX: This could potentially race if the state for the event is not known yet
-	// e.g. the event came over federation but we do not have the full state persisted.
-	if err := s.rsAPI.QueryMembershipsForRoom(ctx, req, &res); err != nil {
-		return nil, 0, err
+		// XXX: This could potentially race if the state for the event is not known yet
+		// e.g. the event came over federation but we do not have the full state persisted.
+		if err := s.rsAPI.QueryMembershipsForRoom(ctx, req, &res); err != nil {
+			return nil, 0, err
+		}
+		joinEvents = res.JoinEvents
+		s.caches.StorePushRoomMembers(roomID, joinEvents)
 	}
 
 	var members []*localMembership
 	var ntotal int
-	for _, event := range res.JoinEvents {
-		member, err := newLocalMembership(&event)
+	for i := range joinEvents {
+		member, err := newLocalMembership(&joinEvents[i])
 		if err != nil {
 			log.WithError(err).Errorf("Parsing MemberContent")
 			continue
@@ -326,7 +346,7 @@ func (s *OutputStreamEventConsumer) notifyLocal(ctx context.Context, event *goma
 		RoomID:     event.RoomID(),
 		TS:         gomatrixserverlib.AsTimestamp(time.Now()),
 	}
-	if err = s.db.InsertNotification(ctx, mem.Localpart, event.EventID(), pos, tweaks, n); err != nil {
+	if err = s.db.InsertNotification(ctx, mem.Localpart, event.EventID(), threadID(event), pos, tweaks, n); err != nil {
 		return err
 	}
 
@@ -348,53 +368,33 @@ func (s *OutputStreamEventConsumer) notifyLocal(ctx context.Context, event *goma
 		"num_unread": userNumUnreadNotifs,
 	}).Tracef("Notifying single member")
 
-	// Push gateways are out of our control, and we cannot risk
-	// looking up the server on a misbehaving push gateway. Each user
-	// receives a goroutine now that all internal API calls have been
-	// made.
-	//
-	// TODO: think about bounding this to one per user, and what
-	// ordering guarantees we must provide.
-	go func() {
-		// This background processing cannot be tied to a request.
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-
-		var rejected []*pushgateway.Device
-		for url, fmts := range devicesByURLAndFormat {
-			for format, devices := range fmts {
-				// TODO: support "email".
-				if !strings.HasPrefix(url, "http") {
-					continue
-				}
-
-				// UNSPEC: the specification suggests there can be
-				// more than one device per request. There is at least
-				// one Sytest that expects one HTTP request per
-				// device, rather than per URL. For now, we must
-				// notify each one separately.
-				for _, dev := range devices {
-					rej, err := s.notifyHTTP(ctx, event, url, format, []*pushgateway.Device{dev}, mem.Localpart, roomName, int(userNumUnreadNotifs))
-					if err != nil {
-						log.WithFields(log.Fields{
-							"event_id":  event.EventID(),
-							"localpart": mem.Localpart,
-						}).WithError(err).Errorf("Unable to notify HTTP pusher")
-						continue
-					}
-					rejected = append(rejected, rej...)
-				}
-			}
+	// Push gateways are out of our control, so the requests are
+	// queued on the push sender rather than being made here.
+	for url, fmts := range devicesByURLAndFormat {
+		// Email pushers are sent digests by the emailer instead.
+		if !strings.HasPrefix(url, "http") {
+			continue
 		}
-
-		if len(rejected) > 0 {
-			s.deleteRejectedPushers(ctx, rejected, mem.Localpart)
+		for format, devices := range fmts {
+			notification := s.notification(event, format, mem.Localpart, roomName, int(userNumUnreadNotifs))
+			s.pushSender.Send(mem.Localpart, url, devices, notification)
 		}
-	}()
+	}
 
 	return nil
 }
 
+// threadID returns the root event ID of the thread which the event is in, or
+// an empty string if the event is in the main timeline. Thread roots are in
+// the main timeline themselves.
+func threadID(event *gomatrixserverlib.HeaderedEvent) string {
+	relatesTo := gjson.GetBytes(event.Content(), `m\.relates_to`)
+	if relatesTo.Get("rel_type").Str != "m.thread" {
+		return ""
+	}
+	return relatesTo.Get("event_id").Str
+}
+
 // evaluatePushRules fetches and evaluates the push rules of a local
 // user. Returns actions (including dont_notify).
 func (s *OutputStreamEventConsumer) evaluatePushRules(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, mem *localMembership, roomSize int) ([]*pushrules.Action, error) {
@@ -420,20 +420,20 @@ func (s *OutputStreamEventConsumer) evaluatePushRules(ctx context.Context, event
 			return nil, fmt.Errorf("user %s is ignored", sender)
 		}
 	}
-	var res api.QueryPushRulesResponse
-	if err = s.userAPI.QueryPushRules(ctx, &api.QueryPushRulesRequest{UserID: mem.UserID}, &res); err != nil {
+	ruleSet, err := s.pushRules(ctx, mem.UserID)
+	if err != nil {
 		return nil, err
 	}
 
 	ec := &ruleSetEvalContext{
 		ctx:      ctx,
 		rsAPI:    s.rsAPI,
+		caches:   s.caches,
 		mem:      mem,
 		roomID:   event.RoomID(),
 		roomSize: roomSize,
 	}
-	eval := pushrules.NewRuleSetEvaluator(ec, &res.RuleSets.Global)
-	rule, err := eval.MatchEvent(event.Event)
+	rule, err := ruleSet.Evaluator(ec).MatchEvent(event.Event)
 	if err != nil {
 		return nil, err
 	}
@@ -453,9 +453,28 @@ func (s *OutputStreamEventConsumer) evaluatePushRules(ctx context.Context, event
 	return rule.Actions, nil
 }
 
+// pushRules returns the compiled global push rules of a local user. The
+// rules are cached until the user changes them.
+func (s *OutputStreamEventConsumer) pushRules(ctx context.Context, userID string) (*pushrules.CompiledRuleSet, error) {
+	if ruleSet, ok := s.caches.GetPushRules(userID); ok {
+		return ruleSet, nil
+	}
+	var res api.QueryPushRulesResponse
+	if err := s.userAPI.QueryPushRules(ctx, &api.QueryPushRulesRequest{UserID: userID}, &res); err != nil {
+		return nil, err
+	}
+	ruleSet, err := pushrules.CompileRuleSet(&res.RuleSets.Global)
+	if err != nil {
+		return nil, err
+	}
+	s.caches.StorePushRules(userID, ruleSet)
+	return ruleSet, nil
+}
+
 type ruleSetEvalContext struct {
 	ctx      context.Context
 	rsAPI    rsapi.UserRoomserverAPI
+	caches   caching.PushCache
 	mem      *localMembership
 	roomID   string
 	roomSize int
@@ -466,6 +485,9 @@ func (rse *ruleSetEvalContext) UserDisplayName() string { return rse.mem.Display
 func (rse *ruleSetEvalContext) RoomMemberCount() (int, error) { return rse.roomSize, nil }
 
 func (rse *ruleSetEvalContext) HasPowerLevel(userID, levelKey string) (bool, error) {
+	if plc, ok := rse.caches.GetPushPowerLevels(rse.roomID); ok {
+		return plc.UserLevel(userID) >= plc.NotificationLevel(levelKey), nil
+	}
 	req := &rsapi.QueryLatestEventsAndStateRequest{
 		RoomID: rse.roomID,
 		StateToFetch: []gomatrixserverlib.StateKeyTuple{
@@ -485,6 +507,7 @@ func (rse *ruleSetEvalContext) HasPowerLevel(userID, levelKey string) (bool, err
 		if err != nil {
 			return false, err
 		}
+		rse.caches.StorePushPowerLevels(rse.roomID, &plc)
 		return plc.UserLevel(userID) >= plc.NotificationLevel(levelKey), nil
 	}
 	return true, nil
@@ -515,91 +538,36 @@ func (s *OutputStreamEventConsumer) localPushDevices(ctx context.Context, localp
 	return devicesByURL, profileTag, nil
 }
 
-// notifyHTTP performs a notificatation to a Push Gateway.
-func (s *OutputStreamEventConsumer) notifyHTTP(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, url, format string, devices []*pushgateway.Device, localpart, roomName string, userNumUnreadNotifs int) ([]*pushgateway.Device, error) {
-	logger := log.WithFields(log.Fields{
-		"event_id":    event.EventID(),
-		"url":         url,
-		"localpart":   localpart,
-		"num_devices": len(devices),
-	})
-
-	var req pushgateway.NotifyRequest
+// notification builds the notification to send to a Push Gateway for
+// an event, in the given format.
+func (s *OutputStreamEventConsumer) notification(event *gomatrixserverlib.HeaderedEvent, format, localpart, roomName string, userNumUnreadNotifs int) pushgateway.Notification {
 	switch format {
 	case "event_id_only":
-		req = pushgateway.NotifyRequest{
-			Notification: pushgateway.Notification{
-				Counts:  &pushgateway.Counts{},
-				Devices: devices,
-				EventID: event.EventID(),
-				RoomID:  event.RoomID(),
-			},
+		return pushgateway.Notification{
+			Counts:  &pushgateway.Counts{},
+			EventID: event.EventID(),
+			RoomID:  event.RoomID(),
 		}
 
 	default:
-		req = pushgateway.NotifyRequest{
-			Notification: pushgateway.Notification{
-				Content: event.Content(),
-				Counts: &pushgateway.Counts{
-					Unread: userNumUnreadNotifs,
-				},
-				Devices:  devices,
-				EventID:  event.EventID(),
-				ID:       event.EventID(),
-				RoomID:   event.RoomID(),
-				RoomName: roomName,
-				Sender:   event.Sender(),
-				Type:     event.Type(),
+		n := pushgateway.Notification{
+			Content: event.Content(),
+			Counts: &pushgateway.Counts{
+				Unread: userNumUnreadNotifs,
 			},
+			EventID:  event.EventID(),
+			ID:       event.EventID(),
+			RoomID:   event.RoomID(),
+			RoomName: roomName,
+			Sender:   event.Sender(),
+			Type:     event.Type(),
 		}
 		if mem, err := event.Membership(); err == nil {
-			req.Notification.Membership = mem
+			n.Membership = mem
 		}
 		if event.StateKey() != nil && *event.StateKey() == fmt.Sprintf("@%s:%s", localpart, s.cfg.Matrix.ServerName) {
-			req.Notification.UserIsTarget = true
-		}
-	}
-
-	logger.Debugf("Notifying push gateway %s", url)
-	var res pushgateway.NotifyResponse
-	if err := s.pgClient.Notify(ctx, url, &req, &res); err != nil {
-		logger.WithError(err).Errorf("Failed to notify push gateway %s", url)
-		return nil, err
-	}
-	logger.WithField("num_rejected", len(res.Rejected)).Tracef("Push gateway result")
-
-	if len(res.Rejected) == 0 {
-		return nil, nil
-	}
-
-	devMap := make(map[string]*pushgateway.Device, len(devices))
-	for _, d := range devices {
-		devMap[d.PushKey] = d
-	}
-	rejected := make([]*pushgateway.Device, 0, len(res.Rejected))
-	for _, pushKey := range res.Rejected {
-		d := devMap[pushKey]
-		if d != nil {
-			rejected = append(rejected, d)
-		}
-	}
-
-	return rejected, nil
-}
-
-// deleteRejectedPushers deletes the pushers associated with the given devices.
-func (s *OutputStreamEventConsumer) deleteRejectedPushers(ctx context.Context, devices []*pushgateway.Device, localpart string) {
-	log.WithFields(log.Fields{
-		"localpart":   localpart,
-		"app_id0":     devices[0].AppID,
-		"num_devices": len(devices),
-	}).Warnf("Deleting pushers rejected by the HTTP push gateway")
-
-	for _, d := range devices {
-		if err := s.db.RemovePusher(ctx, d.AppID, d.PushKey, localpart); err != nil {
-			log.WithFields(log.Fields{
-				"localpart": localpart,
-			}).WithError(err).Errorf("Unable to delete rejected pusher")
+			n.UserIsTarget = true
 		}
+		return n
 	}
 }
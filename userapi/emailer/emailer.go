@@ -0,0 +1,368 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package emailer sends digest emails of unread notifications to users who
+// have set up email pushers.
+package emailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pollInterval is how often the email pushers are checked for unread
+	// notifications.
+	pollInterval = time.Minute
+	// maxNotificationsPerEmail is the most notifications included in a
+	// single digest. Any others are sent in the next digest.
+	maxNotificationsPerEmail = 50
+)
+
+// An Emailer periodically checks the notifications of every user with an
+// email pusher, and sends them a digest of the ones they haven't read.
+type Emailer struct {
+	cfg      *config.UserAPI
+	db       storage.Database
+	rsAPI    rsapi.UserRoomserverAPI
+	html     *htmltemplate.Template
+	text     *texttemplate.Template
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// NewEmailer creates an emailer, loading the templates from the
+// configured template directory if there is one.
+func NewEmailer(cfg *config.UserAPI, db storage.Database, rsAPI rsapi.UserRoomserverAPI) (*Emailer, error) {
+	e := &Emailer{
+		cfg:      cfg,
+		db:       db,
+		rsAPI:    rsAPI,
+		sendMail: smtp.SendMail,
+	}
+	var err error
+	if dir := string(cfg.EmailNotifications.TemplateDir); dir != "" {
+		if e.html, err = htmltemplate.ParseFiles(filepath.Join(dir, "notif_mail.html")); err != nil {
+			return nil, fmt.Errorf("failed to parse HTML email template: %w", err)
+		}
+		if e.text, err = texttemplate.ParseFiles(filepath.Join(dir, "notif_mail.txt")); err != nil {
+			return nil, fmt.Errorf("failed to parse text email template: %w", err)
+		}
+		return e, nil
+	}
+	if e.html, err = htmltemplate.New("notif_mail.html").Parse(defaultHTMLTemplate); err != nil {
+		return nil, fmt.Errorf("failed to parse HTML email template: %w", err)
+	}
+	if e.text, err = texttemplate.New("notif_mail.txt").Parse(defaultTextTemplate); err != nil {
+		return nil, fmt.Errorf("failed to parse text email template: %w", err)
+	}
+	return e, nil
+}
+
+// Start checks the email pushers every poll interval until the process
+// is shut down.
+func (e *Emailer) Start(process *process.ProcessContext) {
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-process.Context().Done():
+				return
+			case now := <-ticker.C:
+				e.processPushers(process.Context(), now)
+			}
+		}
+	}()
+}
+
+func (e *Emailer) processPushers(ctx context.Context, now time.Time) {
+	pushers, err := e.db.GetEmailPushers(ctx)
+	if err != nil {
+		log.WithError(err).Error("Failed to get email pushers")
+		return
+	}
+	for i := range pushers {
+		if err = e.processPusher(ctx, &pushers[i], now); err != nil {
+			log.WithFields(log.Fields{
+				"localpart": pushers[i].Localpart,
+				"app_id":    pushers[i].Pusher.AppID,
+			}).WithError(err).Error("Failed to send notification email")
+		}
+	}
+}
+
+// processPusher sends a digest to an email pusher if it has notifications
+// which have been unread for longer than the notification delay, and it
+// hasn't been sent another digest within the throttle interval.
+func (e *Emailer) processPusher(ctx context.Context, p *tables.EmailPusher, now time.Time) error {
+	cfg := &e.cfg.EmailNotifications
+	if now.Sub(time.UnixMilli(p.LastSentTS)) < cfg.ThrottleInterval {
+		return nil
+	}
+	notifs, lastID, err := e.db.GetNotifications(ctx, p.Localpart, p.LastNotificationID, maxNotificationsPerEmail, tables.AllNotifications)
+	if err != nil {
+		return fmt.Errorf("e.db.GetNotifications: %w", err)
+	}
+
+	// Notifications from before the pusher was set up are never emailed.
+	createdMS := p.Pusher.PushKeyTS * 1000
+	unsent := notifs[:0]
+	for _, n := range notifs {
+		if int64(n.TS) >= createdMS {
+			unsent = append(unsent, n)
+		}
+	}
+	if len(unsent) == 0 {
+		if lastID > p.LastNotificationID {
+			return e.db.UpdateEmailPusher(ctx, p.Pusher.AppID, p.Pusher.PushKey, p.Localpart, lastID, p.LastSentTS)
+		}
+		return nil
+	}
+	// Give the user a chance to read the oldest notification somewhere
+	// else before emailing them about it.
+	if now.Sub(unsent[0].TS.Time()) < cfg.NotificationDelay {
+		return nil
+	}
+
+	msg, err := e.composeEmail(ctx, p, unsent, now)
+	if err != nil {
+		return fmt.Errorf("e.composeEmail: %w", err)
+	}
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(cfg.SMTPServer)
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	if err = e.sendMail(cfg.SMTPServer, auth, cfg.From, []string{p.Pusher.PushKey}, msg); err != nil {
+		return fmt.Errorf("e.sendMail: %w", err)
+	}
+	log.WithFields(log.Fields{
+		"localpart":         p.Localpart,
+		"num_notifications": len(unsent),
+	}).Debug("Sent notification email")
+	return e.db.UpdateEmailPusher(ctx, p.Pusher.AppID, p.Pusher.PushKey, p.Localpart, lastID, now.UnixMilli())
+}
+
+// digest is the data passed to the email templates.
+type digest struct {
+	AppName        string
+	UserID         string
+	Count          int
+	Rooms          []*digestRoom
+	UnsubscribeURL string
+}
+
+type digestRoom struct {
+	RoomID   string
+	Name     string
+	Link     string
+	Messages []*digestMessage
+}
+
+type digestMessage struct {
+	Sender    string
+	Body      string
+	Highlight bool
+	TS        time.Time
+}
+
+func (e *Emailer) composeEmail(ctx context.Context, p *tables.EmailPusher, notifs []*api.Notification, now time.Time) ([]byte, error) {
+	cfg := &e.cfg.EmailNotifications
+	userID := fmt.Sprintf("@%s:%s", p.Localpart, e.cfg.Matrix.ServerName)
+	d := &digest{
+		AppName:        cfg.AppName,
+		UserID:         userID,
+		Count:          len(notifs),
+		UnsubscribeURL: api.EmailUnsubscribeURL(cfg.PublicBaseURL, cfg.UnsubscribeSecret, userID, p.Pusher.AppID, p.Pusher.PushKey, now),
+	}
+
+	byRoom := map[string][]*api.Notification{}
+	for _, n := range notifs {
+		if _, ok := byRoom[n.RoomID]; !ok {
+			d.Rooms = append(d.Rooms, &digestRoom{RoomID: n.RoomID})
+		}
+		byRoom[n.RoomID] = append(byRoom[n.RoomID], n)
+	}
+	for _, room := range d.Rooms {
+		names := e.roomNames(ctx, room.RoomID, byRoom[room.RoomID])
+		room.Name = names.room
+		room.Link = cfg.ClientURL + room.RoomID
+		for _, n := range byRoom[room.RoomID] {
+			sender := n.Event.Sender
+			if name, ok := names.members[sender]; ok && name != "" {
+				sender = name
+			}
+			room.Messages = append(room.Messages, &digestMessage{
+				Sender:    sender,
+				Body:      messageBody(&n.Event),
+				Highlight: isHighlight(n.Actions),
+				TS:        n.TS.Time(),
+			})
+		}
+	}
+
+	subject := fmt.Sprintf("[%s] You have %d unread messages", cfg.AppName, d.Count)
+	if d.Count == 1 {
+		subject = fmt.Sprintf("[%s] You have an unread message", cfg.AppName)
+	}
+	if len(d.Rooms) == 1 {
+		subject += " in " + d.Rooms[0].Name
+	}
+
+	var text, html bytes.Buffer
+	if err := e.text.Execute(&text, d); err != nil {
+		return nil, fmt.Errorf("e.text.Execute: %w", err)
+	}
+	if err := e.html.Execute(&html, d); err != nil {
+		return nil, fmt.Errorf("e.html.Execute: %w", err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=UTF-8", text.Bytes()},
+		{"text/html; charset=UTF-8", html.Bytes()},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write(part.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	headers := []struct{ k, v string }{
+		{"From", cfg.From},
+		{"To", p.Pusher.PushKey},
+		{"Subject", mime.QEncoding.Encode("UTF-8", subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"List-Unsubscribe", "<" + d.UnsubscribeURL + ">"},
+		{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+		{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h.k, h.v)
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+type roomNames struct {
+	room    string
+	members map[string]string // user ID -> display name
+}
+
+// roomNames looks up the name of the room and the display names of the
+// senders of the notifications. It falls back to IDs if they aren't known.
+func (e *Emailer) roomNames(ctx context.Context, roomID string, notifs []*api.Notification) roomNames {
+	names := roomNames{room: roomID, members: map[string]string{}}
+	tuples := []gomatrixserverlib.StateKeyTuple{
+		{EventType: gomatrixserverlib.MRoomName},
+		{EventType: gomatrixserverlib.MRoomCanonicalAlias},
+	}
+	seen := map[string]struct{}{}
+	for _, n := range notifs {
+		if _, ok := seen[n.Event.Sender]; ok {
+			continue
+		}
+		seen[n.Event.Sender] = struct{}{}
+		tuples = append(tuples, gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: n.Event.Sender})
+	}
+	var res rsapi.QueryCurrentStateResponse
+	if err := e.rsAPI.QueryCurrentState(ctx, &rsapi.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: tuples,
+	}, &res); err != nil {
+		log.WithError(err).WithField("room_id", roomID).Warn("Failed to query room state for notification email")
+		return names
+	}
+
+	var content struct {
+		Name        string `json:"name"`
+		Alias       string `json:"alias"`
+		DisplayName string `json:"displayname"`
+	}
+	if ev := res.StateEvents[tuples[1]]; ev != nil && json.Unmarshal(ev.Content(), &content) == nil && content.Alias != "" {
+		names.room = content.Alias
+	}
+	if ev := res.StateEvents[tuples[0]]; ev != nil && json.Unmarshal(ev.Content(), &content) == nil && content.Name != "" {
+		names.room = content.Name
+	}
+	for _, tuple := range tuples[2:] {
+		content.DisplayName = ""
+		if ev := res.StateEvents[tuple]; ev != nil && json.Unmarshal(ev.Content(), &content) == nil {
+			names.members[tuple.StateKey] = content.DisplayName
+		}
+	}
+	return names
+}
+
+// messageBody returns the text to show for an event in a digest.
+func messageBody(ev *gomatrixserverlib.ClientEvent) string {
+	switch ev.Type {
+	case "m.room.encrypted":
+		return "Encrypted message"
+	case gomatrixserverlib.MRoomMember:
+		return "Invited you to the room"
+	}
+	var content struct {
+		Body string `json:"body"`
+	}
+	if err := json.Unmarshal(ev.Content, &content); err == nil && content.Body != "" {
+		return content.Body
+	}
+	return "Sent an event of type " + ev.Type
+}
+
+func isHighlight(actions []*pushrules.Action) bool {
+	_, tweaks, err := pushrules.ActionsToTweaks(actions)
+	if err != nil {
+		return false
+	}
+	return pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, false)
+}
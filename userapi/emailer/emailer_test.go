@@ -0,0 +1,228 @@
+package emailer
+
+import (
+	"context"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type fakeDB struct {
+	storage.Database
+	notifs  []*api.Notification
+	lastID  int64
+	updates []int64 // last notification IDs
+}
+
+func (f *fakeDB) GetNotifications(ctx context.Context, localpart string, fromID int64, limit int, filter tables.NotificationFilter) ([]*api.Notification, int64, error) {
+	if fromID >= f.lastID {
+		return nil, -1, nil
+	}
+	return f.notifs, f.lastID, nil
+}
+
+func (f *fakeDB) UpdateEmailPusher(ctx context.Context, appid, pushkey, localpart string, lastNotificationID, lastSentTS int64) error {
+	f.updates = append(f.updates, lastNotificationID)
+	return nil
+}
+
+type fakeRoomserver struct {
+	rsapi.UserRoomserverAPI
+}
+
+func (f *fakeRoomserver) QueryCurrentState(ctx context.Context, req *rsapi.QueryCurrentStateRequest, res *rsapi.QueryCurrentStateResponse) error {
+	return nil
+}
+
+type sentMail struct {
+	to  []string
+	msg string
+}
+
+func mustCreateEmailer(t *testing.T, db storage.Database) (*Emailer, *[]sentMail) {
+	t.Helper()
+	cfg := &config.UserAPI{Matrix: &config.Global{ServerName: "test"}}
+	cfg.EmailNotifications.Defaults()
+	cfg.EmailNotifications.Enabled = true
+	cfg.EmailNotifications.SMTPServer = "localhost:25"
+	cfg.EmailNotifications.From = "noreply@test"
+	cfg.EmailNotifications.PublicBaseURL = "https://matrix.test"
+	cfg.EmailNotifications.UnsubscribeSecret = "secret"
+	e, err := NewEmailer(cfg, db, &fakeRoomserver{})
+	if err != nil {
+		t.Fatalf("NewEmailer failed: %v", err)
+	}
+	var sent []sentMail
+	e.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sent = append(sent, sentMail{to: to, msg: string(msg)})
+		return nil
+	}
+	return e, &sent
+}
+
+func TestEmailerDigest(t *testing.T) {
+	now := time.Now()
+	notifTS := gomatrixserverlib.AsTimestamp(now.Add(-time.Hour))
+	db := &fakeDB{
+		lastID: 2,
+		notifs: []*api.Notification{
+			{
+				RoomID: "!room:test",
+				TS:     notifTS,
+				Event: gomatrixserverlib.ClientEvent{
+					Type:    "m.room.message",
+					Sender:  "@bob:test",
+					Content: gomatrixserverlib.RawJSON(`{"msgtype":"m.text","body":"<b>hello</b>"}`),
+				},
+				Actions: []*pushrules.Action{
+					{Kind: pushrules.NotifyAction},
+					{Kind: pushrules.SetTweakAction, Tweak: pushrules.HighlightTweak, Value: true},
+				},
+			},
+			{
+				RoomID: "!room:test",
+				TS:     notifTS,
+				Event: gomatrixserverlib.ClientEvent{
+					Type:    "m.room.encrypted",
+					Sender:  "@bob:test",
+					Content: gomatrixserverlib.RawJSON(`{}`),
+				},
+			},
+		},
+	}
+	e, sent := mustCreateEmailer(t, db)
+	pusher := &tables.EmailPusher{
+		Localpart: "alice",
+		Pusher: api.Pusher{
+			Kind:      api.EmailKind,
+			AppID:     "m.email",
+			PushKey:   "alice@example.com",
+			PushKeyTS: now.Add(-2 * time.Hour).Unix(),
+		},
+	}
+
+	if err := e.processPusher(context.Background(), pusher, now); err != nil {
+		t.Fatalf("processPusher failed: %v", err)
+	}
+	if len(*sent) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(*sent))
+	}
+	mail := (*sent)[0]
+	if len(mail.to) != 1 || mail.to[0] != "alice@example.com" {
+		t.Errorf("email sent to %v", mail.to)
+	}
+	for _, want := range []string{
+		"Subject: [Matrix] You have 2 unread messages in !room:test",
+		"&lt;b&gt;hello&lt;/b&gt;",  // escaped in the HTML part
+		"* @bob:test: <b>hello</b>", // highlighted in the text part
+		"Encrypted message",
+		"https://matrix.to/#/!room:test",
+	} {
+		if !strings.Contains(mail.msg, want) {
+			t.Errorf("email doesn't contain %q:\n%s", want, mail.msg)
+		}
+	}
+	if len(db.updates) != 1 || db.updates[0] != 2 {
+		t.Errorf("expected the pusher to be updated to notification 2, got %v", db.updates)
+	}
+
+	// The unsubscribe link must be valid for the pusher.
+	i := strings.Index(mail.msg, "List-Unsubscribe: <")
+	if i < 0 {
+		t.Fatalf("email has no List-Unsubscribe header")
+	}
+	link := mail.msg[i+len("List-Unsubscribe: <"):]
+	link = link[:strings.Index(link, ">")]
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("invalid unsubscribe link %q: %v", link, err)
+	}
+	if u.Path != api.EmailUnsubscribePath {
+		t.Errorf("unsubscribe link has path %q", u.Path)
+	}
+	if !strings.Contains(mail.msg, "List-Unsubscribe-Post: List-Unsubscribe=One-Click") {
+		t.Errorf("email doesn't support one-click unsubscribe")
+	}
+	secret := e.cfg.EmailNotifications.UnsubscribeSecret
+	q := u.Query()
+	if q.Get("user_id") != "@alice:test" || q.Get("app_id") != "m.email" || q.Get("pushkey") != "alice@example.com" {
+		t.Errorf("unsubscribe link is for the wrong pusher: %v", q)
+	}
+	if !api.VerifyEmailUnsubscribeToken(secret, q, now) {
+		t.Errorf("unsubscribe token doesn't verify")
+	}
+	if api.VerifyEmailUnsubscribeToken(secret, q, now.Add(api.EmailUnsubscribeLinkLifetime+time.Minute)) {
+		t.Errorf("unsubscribe token verifies after it expired")
+	}
+	if api.VerifyEmailUnsubscribeToken("another secret", q, now) {
+		t.Errorf("unsubscribe token verifies with another secret")
+	}
+	q.Set("user_id", "@mallory:test")
+	if api.VerifyEmailUnsubscribeToken(secret, q, now) {
+		t.Errorf("unsubscribe token verifies for another user")
+	}
+}
+
+func TestEmailerThrottling(t *testing.T) {
+	now := time.Now()
+	newNotif := func(age time.Duration) []*api.Notification {
+		return []*api.Notification{{
+			RoomID: "!room:test",
+			TS:     gomatrixserverlib.AsTimestamp(now.Add(-age)),
+			Event: gomatrixserverlib.ClientEvent{
+				Type:    "m.room.message",
+				Sender:  "@bob:test",
+				Content: gomatrixserverlib.RawJSON(`{"body":"hi"}`),
+			},
+		}}
+	}
+	tests := []struct {
+		name        string
+		notifs      []*api.Notification
+		lastSent    time.Duration // how long ago the last email was sent
+		pusherAge   time.Duration
+		wantSent    bool
+		wantUpdates int
+	}{
+		{"sends old notifications", newNotif(time.Hour), 0, 2 * time.Hour, true, 1},
+		{"waits for the notification delay", newNotif(time.Minute), 0, 2 * time.Hour, false, 0},
+		{"waits for the throttle interval", newNotif(time.Hour), 10 * time.Minute, 2 * time.Hour, false, 0},
+		{"skips notifications from before the pusher", newNotif(time.Hour), 0, time.Minute, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &fakeDB{notifs: tt.notifs, lastID: 1}
+			e, sent := mustCreateEmailer(t, db)
+			pusher := &tables.EmailPusher{
+				Localpart: "alice",
+				Pusher: api.Pusher{
+					AppID:     "m.email",
+					PushKey:   "alice@example.com",
+					PushKeyTS: now.Add(-tt.pusherAge).Unix(),
+				},
+			}
+			if tt.lastSent > 0 {
+				pusher.LastSentTS = now.Add(-tt.lastSent).UnixMilli()
+			}
+			if err := e.processPusher(context.Background(), pusher, now); err != nil {
+				t.Fatalf("processPusher failed: %v", err)
+			}
+			if got := len(*sent) > 0; got != tt.wantSent {
+				t.Errorf("sent email: got %v, want %v", got, tt.wantSent)
+			}
+			if len(db.updates) != tt.wantUpdates {
+				t.Errorf("pusher updates: got %d, want %d", len(db.updates), tt.wantUpdates)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package emailer
+
+// The built-in email templates. They can be replaced by putting
+// notif_mail.html and notif_mail.txt files in the configured template
+// directory, which are passed the same digest data.
+
+const defaultTextTemplate = `Hi {{ .UserID }},
+
+You have {{ .Count }} unread message{{ if ne .Count 1 }}s{{ end }} on {{ .AppName }}.
+{{ range .Rooms }}
+{{ .Name }} ({{ .Link }})
+{{ range .Messages }}{{ if .Highlight }}* {{ else }}  {{ end }}{{ .Sender }}: {{ .Body }}
+{{ end }}{{ end }}
+You are receiving this email because you asked to be notified about unread
+messages. To stop receiving these emails, visit:
+{{ .UnsubscribeURL }}
+`
+
+const defaultHTMLTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>{{ .AppName }}</title>
+<style>
+body { font-family: sans-serif; color: #2e2f32; }
+.room { margin: 1.5em 0; }
+.room h2 { font-size: 1.1em; margin: 0 0 0.5em 0; }
+.message { margin: 0.25em 0; }
+.highlight { font-weight: bold; }
+.sender { color: #737d8c; }
+.footer { margin-top: 2em; font-size: 0.8em; color: #737d8c; }
+</style>
+</head>
+<body>
+<p>Hi {{ .UserID }},</p>
+<p>You have {{ .Count }} unread message{{ if ne .Count 1 }}s{{ end }} on {{ .AppName }}.</p>
+{{ range .Rooms }}
+<div class="room">
+<h2><a href="{{ .Link }}">{{ .Name }}</a></h2>
+{{ range .Messages }}
+<div class="message{{ if .Highlight }} highlight{{ end }}"><span class="sender">{{ .Sender }}:</span> {{ .Body }}</div>
+{{ end }}
+</div>
+{{ end }}
+<div class="footer">
+You are receiving this email because you asked to be notified about unread messages.
+<a href="{{ .UnsubscribeURL }}">Unsubscribe</a>
+</div>
+</body>
+</html>
+`
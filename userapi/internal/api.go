@@ -30,6 +30,7 @@ import (
 
 	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -53,6 +54,7 @@ type UserInternalAPI struct {
 	AppServices []config.ApplicationService
 	KeyAPI      keyapi.UserKeyAPI
 	RSAPI       rsapi.UserRoomserverAPI
+	Cache       caching.PushCache
 }
 
 func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse) error {
@@ -70,6 +72,9 @@ func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAc
 		util.GetLogger(ctx).WithError(err).Error("a.DB.SaveAccountData failed")
 		return fmt.Errorf("failed to save account data: %w", err)
 	}
+	if req.DataType == pushRulesAccountDataType && req.RoomID == "" && a.Cache != nil {
+		a.Cache.InvalidatePushRules(req.UserID)
+	}
 	var ignoredUsers *synctypes.IgnoredUsers
 	if req.DataType == "m.ignored_user_list" {
 		ignoredUsers = &synctypes.IgnoredUsers{}
@@ -86,6 +91,47 @@ func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAc
 	return nil
 }
 
+// PerformAccountDataDeletion removes a piece of account data. Sync clients
+// are told about the removal through the same output stream as updates,
+// so that they see the key with empty content (MSC3391).
+func (a *UserInternalAPI) PerformAccountDataDeletion(ctx context.Context, req *api.PerformAccountDataDeletionRequest, res *struct{}) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot delete account data of remote users: got %s want %s", domain, a.ServerName)
+	}
+	if req.DataType == "" {
+		return fmt.Errorf("data type must not be empty")
+	}
+	deleted, err := a.DB.DeleteAccountData(ctx, local, req.RoomID, req.DataType)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("a.DB.DeleteAccountData failed")
+		return fmt.Errorf("failed to delete account data: %w", err)
+	}
+	if !deleted {
+		return nil
+	}
+	if req.DataType == pushRulesAccountDataType && req.RoomID == "" && a.Cache != nil {
+		a.Cache.InvalidatePushRules(req.UserID)
+	}
+	var ignoredUsers *synctypes.IgnoredUsers
+	if req.DataType == "m.ignored_user_list" {
+		ignoredUsers = &synctypes.IgnoredUsers{List: map[string]interface{}{}}
+	}
+	if err := a.SyncProducer.SendAccountData(req.UserID, eventutil.AccountData{
+		RoomID:       req.RoomID,
+		Type:         req.DataType,
+		IgnoredUsers: ignoredUsers,
+		Deleted:      true,
+	}); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("a.SyncProducer.SendAccountData failed")
+		return fmt.Errorf("failed to send account data to output: %w", err)
+	}
+	return nil
+}
+
 func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.PerformAccountCreationRequest, res *api.PerformAccountCreationResponse) error {
 	acc, err := a.DB.CreateAccount(ctx, req.Localpart, req.Password, req.AppServiceID, req.AccountType)
 	if err != nil {
@@ -28,6 +28,8 @@ import (
 const (
 	InputAccountDataPath = "/userapi/inputAccountData"
 
+	PerformAccountDataDeletionPath = "/userapi/performAccountDataDeletion"
+
 	PerformDeviceCreationPath          = "/userapi/performDeviceCreation"
 	PerformAccountCreationPath         = "/userapi/performAccountCreation"
 	PerformPasswordUpdatePath          = "/userapi/performPasswordUpdate"
@@ -91,6 +93,14 @@ func (h *httpUserInternalAPI) InputAccountData(ctx context.Context, req *api.Inp
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 }
 
+func (h *httpUserInternalAPI) PerformAccountDataDeletion(ctx context.Context, req *api.PerformAccountDataDeletionRequest, res *struct{}) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformAccountDataDeletion")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformAccountDataDeletionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
 func (h *httpUserInternalAPI) PerformAccountCreation(
 	ctx context.Context,
 	request *api.PerformAccountCreationRequest,
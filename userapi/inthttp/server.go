@@ -237,6 +237,19 @@ func AddRoutes(internalAPIMux *mux.Router, s api.UserInternalAPI) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(PerformAccountDataDeletionPath,
+		httputil.MakeInternalAPI("performAccountDataDeletion", func(req *http.Request) util.JSONResponse {
+			request := api.PerformAccountDataDeletionRequest{}
+			response := struct{}{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := s.PerformAccountDataDeletion(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(QueryKeyBackupPath,
 		httputil.MakeInternalAPI("queryKeyBackup", func(req *http.Request) util.JSONResponse {
 			request := api.QueryKeyBackupRequest{}
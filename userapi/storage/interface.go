@@ -53,6 +53,9 @@ type AccountData interface {
 	// If no account data could be found, returns nil
 	// Returns an error if there was an issue with the retrieval
 	GetAccountDataByType(ctx context.Context, localpart, roomID, dataType string) (data json.RawMessage, err error)
+	// DeleteAccountData removes the account data of the given type, returning
+	// whether there was any data to remove.
+	DeleteAccountData(ctx context.Context, localpart, roomID, dataType string) (deleted bool, err error)
 }
 
 type Device interface {
@@ -107,6 +110,8 @@ type Pusher interface {
 	GetPushers(ctx context.Context, localpart string) ([]api.Pusher, error)
 	RemovePusher(ctx context.Context, appid, pushkey, localpart string) error
 	RemovePushers(ctx context.Context, appid, pushkey string) error
+	GetEmailPushers(ctx context.Context) ([]tables.EmailPusher, error)
+	UpdateEmailPusher(ctx context.Context, appid, pushkey, localpart string, lastNotificationID, lastSentTS int64) error
 }
 
 type ThreePID interface {
@@ -117,12 +122,13 @@ type ThreePID interface {
 }
 
 type Notification interface {
-	InsertNotification(ctx context.Context, localpart, eventID string, pos int64, tweaks map[string]interface{}, n *api.Notification) error
+	InsertNotification(ctx context.Context, localpart, eventID, threadID string, pos int64, tweaks map[string]interface{}, n *api.Notification) error
 	DeleteNotificationsUpTo(ctx context.Context, localpart, roomID string, pos int64) (affected bool, err error)
-	SetNotificationsRead(ctx context.Context, localpart, roomID string, pos int64, read bool) (affected bool, err error)
+	SetNotificationsRead(ctx context.Context, localpart, roomID, threadID string, pos int64, read bool) (affected bool, err error)
 	GetNotifications(ctx context.Context, localpart string, fromID int64, limit int, filter tables.NotificationFilter) ([]*api.Notification, int64, error)
 	GetNotificationCount(ctx context.Context, localpart string, filter tables.NotificationFilter) (int64, error)
 	GetRoomNotificationCounts(ctx context.Context, localpart, roomID string) (total int64, highlight int64, _ error)
+	GetRoomThreadNotificationCounts(ctx context.Context, localpart, roomID string) (total, highlight map[string]int64, _ error)
 	DeleteOldNotifications(ctx context.Context) error
 }
 
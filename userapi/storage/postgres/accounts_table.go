@@ -87,18 +87,10 @@ func NewPostgresAccountsTable(db *sql.DB, serverName gomatrixserverlib.ServerNam
 		return nil, err
 	}
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations([]sqlutil.Migration{
-		{
-			Version: "userapi: add is active",
-			Up:      deltas.UpIsActive,
-			Down:    deltas.DownIsActive,
-		},
-		{
-			Version: "userapi: add account type",
-			Up:      deltas.UpAddAccountType,
-			Down:    deltas.DownAddAccountType,
-		},
-	}...)
+	m.AddMigrations(
+		deltas.IsActiveMigration,
+		deltas.AddAccountTypeMigration,
+	)
 	err = m.Up(context.Background())
 	if err != nil {
 		return nil, err
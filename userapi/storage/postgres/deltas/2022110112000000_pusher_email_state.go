@@ -0,0 +1,27 @@
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpPusherEmailState(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE userapi_pushers ADD COLUMN IF NOT EXISTS last_notification_id BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE userapi_pushers ADD COLUMN IF NOT EXISTS last_sent_ts_ms BIGINT NOT NULL DEFAULT 0;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownPusherEmailState(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE userapi_pushers DROP COLUMN IF EXISTS last_notification_id;
+ALTER TABLE userapi_pushers DROP COLUMN IF EXISTS last_sent_ts_ms;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -122,10 +122,7 @@ func NewPostgresDevicesTable(db *sql.DB, serverName gomatrixserverlib.ServerName
 		return nil, err
 	}
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(sqlutil.Migration{
-		Version: "userapi: add last_seen_ts",
-		Up:      deltas.UpLastSeenTSIP,
-	})
+	m.AddMigrations(deltas.LastSeenTSIPMigration)
 	err = m.Up(context.Background())
 	if err != nil {
 		return nil, err
@@ -23,19 +23,22 @@ import (
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/postgres/deltas"
 	"github.com/matrix-org/dendrite/userapi/storage/tables"
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
 )
 
 type notificationsStatements struct {
-	insertStmt             *sql.Stmt
-	deleteUpToStmt         *sql.Stmt
-	updateReadStmt         *sql.Stmt
-	selectStmt             *sql.Stmt
-	selectCountStmt        *sql.Stmt
-	selectRoomCountsStmt   *sql.Stmt
-	cleanNotificationsStmt *sql.Stmt
+	insertStmt                 *sql.Stmt
+	deleteUpToStmt             *sql.Stmt
+	updateReadStmt             *sql.Stmt
+	updateThreadReadStmt       *sql.Stmt
+	selectStmt                 *sql.Stmt
+	selectCountStmt            *sql.Stmt
+	selectRoomCountsStmt       *sql.Stmt
+	selectRoomThreadCountsStmt *sql.Stmt
+	cleanNotificationsStmt     *sql.Stmt
 }
 
 const notificationSchema = `
@@ -48,7 +51,9 @@ CREATE TABLE IF NOT EXISTS userapi_notifications (
     ts_ms BIGINT NOT NULL,
     highlight BOOLEAN NOT NULL,
     notification_json TEXT NOT NULL,
-    read BOOLEAN NOT NULL DEFAULT FALSE
+    read BOOLEAN NOT NULL DEFAULT FALSE,
+    -- The thread root event ID, or empty if the event is in the main timeline
+    thread_id TEXT NOT NULL DEFAULT ''
 );
 
 CREATE INDEX IF NOT EXISTS userapi_notification_localpart_room_id_event_id_idx ON userapi_notifications(localpart, room_id, event_id);
@@ -57,7 +62,7 @@ CREATE INDEX IF NOT EXISTS userapi_notification_localpart_id_idx ON userapi_noti
 `
 
 const insertNotificationSQL = "" +
-	"INSERT INTO userapi_notifications (localpart, room_id, event_id, stream_pos, ts_ms, highlight, notification_json) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	"INSERT INTO userapi_notifications (localpart, room_id, event_id, stream_pos, ts_ms, highlight, notification_json, thread_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
 
 const deleteNotificationsUpToSQL = "" +
 	"DELETE FROM userapi_notifications WHERE localpart = $1 AND room_id = $2 AND stream_pos <= $3"
@@ -65,6 +70,9 @@ const deleteNotificationsUpToSQL = "" +
 const updateNotificationReadSQL = "" +
 	"UPDATE userapi_notifications SET read = $1 WHERE localpart = $2 AND room_id = $3 AND stream_pos <= $4 AND read <> $1"
 
+const updateNotificationThreadReadSQL = "" +
+	"UPDATE userapi_notifications SET read = $1 WHERE localpart = $2 AND room_id = $3 AND stream_pos <= $4 AND read <> $1 AND thread_id = $5"
+
 const selectNotificationSQL = "" +
 	"SELECT id, room_id, ts_ms, read, notification_json FROM userapi_notifications WHERE localpart = $1 AND id > $2 AND (" +
 	"(($3 & 1) <> 0 AND highlight) OR (($3 & 2) <> 0 AND NOT highlight)" +
@@ -79,6 +87,10 @@ const selectRoomNotificationCountsSQL = "" +
 	"SELECT COUNT(*), COUNT(*) FILTER (WHERE highlight) FROM userapi_notifications " +
 	"WHERE localpart = $1 AND room_id = $2 AND NOT read"
 
+const selectRoomThreadNotificationCountsSQL = "" +
+	"SELECT thread_id, COUNT(*), COUNT(*) FILTER (WHERE highlight) FROM userapi_notifications " +
+	"WHERE localpart = $1 AND room_id = $2 AND thread_id <> '' AND NOT read GROUP BY thread_id"
+
 const cleanNotificationsSQL = "" +
 	"DELETE FROM userapi_notifications WHERE" +
 	" (highlight = FALSE AND ts_ms < $1) OR (highlight = TRUE AND ts_ms < $2)"
@@ -89,13 +101,20 @@ func NewPostgresNotificationTable(db *sql.DB) (tables.NotificationTable, error)
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(deltas.NotificationThreadIDMigration)
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	return s, sqlutil.StatementList{
 		{&s.insertStmt, insertNotificationSQL},
 		{&s.deleteUpToStmt, deleteNotificationsUpToSQL},
 		{&s.updateReadStmt, updateNotificationReadSQL},
+		{&s.updateThreadReadStmt, updateNotificationThreadReadSQL},
 		{&s.selectStmt, selectNotificationSQL},
 		{&s.selectCountStmt, selectNotificationCountSQL},
 		{&s.selectRoomCountsStmt, selectRoomNotificationCountsSQL},
+		{&s.selectRoomThreadCountsStmt, selectRoomThreadNotificationCountsSQL},
 		{&s.cleanNotificationsStmt, cleanNotificationsSQL},
 	}.Prepare(db)
 }
@@ -109,8 +128,9 @@ func (s *notificationsStatements) Clean(ctx context.Context, txn *sql.Tx) error
 	return err
 }
 
-// Insert inserts a notification into the database.
-func (s *notificationsStatements) Insert(ctx context.Context, txn *sql.Tx, localpart, eventID string, pos int64, highlight bool, n *api.Notification) error {
+// Insert inserts a notification into the database. The thread ID is empty
+// for events in the main timeline.
+func (s *notificationsStatements) Insert(ctx context.Context, txn *sql.Tx, localpart, eventID, threadID string, pos int64, highlight bool, n *api.Notification) error {
 	roomID, tsMS := n.RoomID, n.TS
 	nn := *n
 	// Clears out fields that have their own columns to (1) shrink the
@@ -121,7 +141,7 @@ func (s *notificationsStatements) Insert(ctx context.Context, txn *sql.Tx, local
 	if err != nil {
 		return err
 	}
-	_, err = sqlutil.TxStmt(txn, s.insertStmt).ExecContext(ctx, localpart, roomID, eventID, pos, tsMS, highlight, string(bs))
+	_, err = sqlutil.TxStmt(txn, s.insertStmt).ExecContext(ctx, localpart, roomID, eventID, pos, tsMS, highlight, string(bs), threadID)
 	return err
 }
 
@@ -139,9 +159,20 @@ func (s *notificationsStatements) DeleteUpTo(ctx context.Context, txn *sql.Tx, l
 	return nrows > 0, nil
 }
 
-// UpdateRead updates the "read" value for an event.
-func (s *notificationsStatements) UpdateRead(ctx context.Context, txn *sql.Tx, localpart, roomID string, pos int64, v bool) (affected bool, _ error) {
-	res, err := sqlutil.TxStmt(txn, s.updateReadStmt).ExecContext(ctx, v, localpart, roomID, pos)
+// UpdateRead updates the "read" value for an event. If the thread ID is
+// empty then notifications in all threads are updated, otherwise only those
+// in the thread. The main timeline has the thread ID "main".
+func (s *notificationsStatements) UpdateRead(ctx context.Context, txn *sql.Tx, localpart, roomID, threadID string, pos int64, v bool) (affected bool, _ error) {
+	var res sql.Result
+	var err error
+	switch threadID {
+	case "":
+		res, err = sqlutil.TxStmt(txn, s.updateReadStmt).ExecContext(ctx, v, localpart, roomID, pos)
+	case api.MainThreadID:
+		res, err = sqlutil.TxStmt(txn, s.updateThreadReadStmt).ExecContext(ctx, v, localpart, roomID, pos, "")
+	default:
+		res, err = sqlutil.TxStmt(txn, s.updateThreadReadStmt).ExecContext(ctx, v, localpart, roomID, pos, threadID)
+	}
 	if err != nil {
 		return false, err
 	}
@@ -149,7 +180,7 @@ func (s *notificationsStatements) UpdateRead(ctx context.Context, txn *sql.Tx, l
 	if err != nil {
 		return true, err
 	}
-	log.WithFields(log.Fields{"localpart": localpart, "room_id": roomID, "stream_pos": pos}).Tracef("UpdateRead: %d rows affected", nrows)
+	log.WithFields(log.Fields{"localpart": localpart, "room_id": roomID, "thread_id": threadID, "stream_pos": pos}).Tracef("UpdateRead: %d rows affected", nrows)
 	return nrows > 0, nil
 }
 
@@ -233,3 +264,24 @@ func (s *notificationsStatements) SelectRoomCounts(ctx context.Context, txn *sql
 	}
 	return 0, 0, rows.Err()
 }
+
+// SelectRoomThreadCounts returns the unread notification counts of each
+// thread in the room, not including the main timeline.
+func (s *notificationsStatements) SelectRoomThreadCounts(ctx context.Context, txn *sql.Tx, localpart, roomID string) (total, highlight map[string]int64, _ error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomThreadCountsStmt).QueryContext(ctx, localpart, roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "notifications.SelectRoomThreadCounts: rows.Close() failed")
+
+	total, highlight = map[string]int64{}, map[string]int64{}
+	for rows.Next() {
+		var threadID string
+		var threadTotal, threadHighlight int64
+		if err = rows.Scan(&threadID, &threadTotal, &threadHighlight); err != nil {
+			return nil, nil, err
+		}
+		total[threadID], highlight[threadID] = threadTotal, threadHighlight
+	}
+	return total, highlight, rows.Err()
+}
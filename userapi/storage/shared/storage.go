@@ -213,6 +213,20 @@ func (d *Database) GetAccountDataByType(
 	)
 }
 
+// DeleteAccountData removes the account data matching a given
+// localpart, room ID and type.
+// Returns false if there was no account data to remove
+// Returns an error if there was an issue with the deletion
+func (d *Database) DeleteAccountData(
+	ctx context.Context, localpart, roomID, dataType string,
+) (deleted bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		deleted, err = d.AccountDatas.DeleteAccountData(ctx, txn, localpart, roomID, dataType)
+		return err
+	})
+	return
+}
+
 // GetNewNumericLocalpart generates and returns a new unused numeric localpart
 func (d *Database) GetNewNumericLocalpart(
 	ctx context.Context,
@@ -664,9 +678,9 @@ func (d *Database) GetLoginTokenDataByToken(ctx context.Context, token string) (
 	return d.LoginTokens.SelectLoginToken(ctx, token)
 }
 
-func (d *Database) InsertNotification(ctx context.Context, localpart, eventID string, pos int64, tweaks map[string]interface{}, n *api.Notification) error {
+func (d *Database) InsertNotification(ctx context.Context, localpart, eventID, threadID string, pos int64, tweaks map[string]interface{}, n *api.Notification) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.Notifications.Insert(ctx, txn, localpart, eventID, pos, pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, false), n)
+		return d.Notifications.Insert(ctx, txn, localpart, eventID, threadID, pos, pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, false), n)
 	})
 }
 
@@ -678,9 +692,9 @@ func (d *Database) DeleteNotificationsUpTo(ctx context.Context, localpart, roomI
 	return
 }
 
-func (d *Database) SetNotificationsRead(ctx context.Context, localpart, roomID string, pos int64, b bool) (affected bool, err error) {
+func (d *Database) SetNotificationsRead(ctx context.Context, localpart, roomID, threadID string, pos int64, b bool) (affected bool, err error) {
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		affected, err = d.Notifications.UpdateRead(ctx, txn, localpart, roomID, pos, b)
+		affected, err = d.Notifications.UpdateRead(ctx, txn, localpart, roomID, threadID, pos, b)
 		return err
 	})
 	return
@@ -698,6 +712,10 @@ func (d *Database) GetRoomNotificationCounts(ctx context.Context, localpart, roo
 	return d.Notifications.SelectRoomCounts(ctx, nil, localpart, roomID)
 }
 
+func (d *Database) GetRoomThreadNotificationCounts(ctx context.Context, localpart, roomID string) (total, highlight map[string]int64, _ error) {
+	return d.Notifications.SelectRoomThreadCounts(ctx, nil, localpart, roomID)
+}
+
 func (d *Database) DeleteOldNotifications(ctx context.Context) error {
 	return d.Notifications.Clean(ctx, nil)
 }
@@ -759,6 +777,21 @@ func (d *Database) RemovePushers(
 	})
 }
 
+// GetEmailPushers returns the email pushers of all local users.
+func (d *Database) GetEmailPushers(ctx context.Context) ([]tables.EmailPusher, error) {
+	return d.Pushers.SelectEmailPushers(ctx, nil)
+}
+
+// UpdateEmailPusher records the last notification sent by an email
+// pusher, and when it was sent.
+func (d *Database) UpdateEmailPusher(
+	ctx context.Context, appid, pushkey, localpart string, lastNotificationID, lastSentTS int64,
+) error {
+	return d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
+		return d.Pushers.UpdateEmailPusher(ctx, txn, appid, pushkey, localpart, lastNotificationID, lastSentTS)
+	})
+}
+
 // UserStatistics populates types.UserStatistics, used in reports.
 func (d *Database) UserStatistics(ctx context.Context) (*types.UserStatistics, *types.DatabaseEngine, error) {
 	return d.Stats.UserStatistics(ctx, nil)
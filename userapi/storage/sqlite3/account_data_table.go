@@ -50,11 +50,15 @@ const selectAccountDataSQL = "" +
 const selectAccountDataByTypeSQL = "" +
 	"SELECT content FROM account_data WHERE localpart = $1 AND room_id = $2 AND type = $3"
 
+const deleteAccountDataSQL = "" +
+	"DELETE FROM account_data WHERE localpart = $1 AND room_id = $2 AND type = $3"
+
 type accountDataStatements struct {
 	db                          *sql.DB
 	insertAccountDataStmt       *sql.Stmt
 	selectAccountDataStmt       *sql.Stmt
 	selectAccountDataByTypeStmt *sql.Stmt
+	deleteAccountDataStmt       *sql.Stmt
 }
 
 func NewSQLiteAccountDataTable(db *sql.DB) (tables.AccountDataTable, error) {
@@ -69,6 +73,7 @@ func NewSQLiteAccountDataTable(db *sql.DB) (tables.AccountDataTable, error) {
 		{&s.insertAccountDataStmt, insertAccountDataSQL},
 		{&s.selectAccountDataStmt, selectAccountDataSQL},
 		{&s.selectAccountDataByTypeStmt, selectAccountDataByTypeSQL},
+		{&s.deleteAccountDataStmt, deleteAccountDataSQL},
 	}.Prepare(db)
 }
 
@@ -130,3 +135,14 @@ func (s *accountDataStatements) SelectAccountDataByType(
 	data = json.RawMessage(bytes)
 	return
 }
+
+func (s *accountDataStatements) DeleteAccountData(
+	ctx context.Context, txn *sql.Tx, localpart, roomID, dataType string,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteAccountDataStmt).ExecContext(ctx, localpart, roomID, dataType)
+	if err != nil {
+		return false, err
+	}
+	nrows, err := res.RowsAffected()
+	return nrows > 0, err
+}
@@ -0,0 +1,51 @@
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpNotificationThreadID(ctx context.Context, tx *sql.Tx) error {
+	// SQLite doesn't have "if exists", so check if the column exists. If the query doesn't return an error, it already exists.
+	_, err := tx.QueryContext(ctx, "SELECT thread_id FROM userapi_notifications LIMIT 1")
+	if err == nil {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, `ALTER TABLE userapi_notifications ADD COLUMN thread_id TEXT NOT NULL DEFAULT '';`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownNotificationThreadID(ctx context.Context, tx *sql.Tx) error {
+	// SQLite can't drop the column if it is preceded by a comment in the
+	// table schema, so the table has to be recreated instead.
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE userapi_notifications RENAME TO userapi_notifications_tmp;
+CREATE TABLE userapi_notifications (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	localpart TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	stream_pos BIGINT NOT NULL,
+	ts_ms BIGINT NOT NULL,
+	highlight BOOLEAN NOT NULL,
+	notification_json TEXT NOT NULL,
+	read BOOLEAN NOT NULL DEFAULT FALSE
+);
+INSERT INTO userapi_notifications (
+	id, localpart, room_id, event_id, stream_pos, ts_ms, highlight, notification_json, read
+) SELECT
+	id, localpart, room_id, event_id, stream_pos, ts_ms, highlight, notification_json, read
+FROM userapi_notifications_tmp;
+DROP TABLE userapi_notifications_tmp;
+CREATE INDEX IF NOT EXISTS userapi_notification_localpart_room_id_event_id_idx ON userapi_notifications(localpart, room_id, event_id);
+CREATE INDEX IF NOT EXISTS userapi_notification_localpart_room_id_id_idx ON userapi_notifications(localpart, room_id, id);
+CREATE INDEX IF NOT EXISTS userapi_notification_localpart_id_idx ON userapi_notifications(localpart, id);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
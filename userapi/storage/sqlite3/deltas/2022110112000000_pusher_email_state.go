@@ -0,0 +1,56 @@
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpPusherEmailState(ctx context.Context, tx *sql.Tx) error {
+	// SQLite doesn't have "if exists", so check if the columns exist. If the query doesn't return an error, they already exist.
+	rows, err := tx.QueryContext(ctx, "SELECT last_notification_id, last_sent_ts_ms FROM userapi_pushers LIMIT 1")
+	if err == nil {
+		return rows.Close()
+	}
+	_, err = tx.ExecContext(ctx, `
+ALTER TABLE userapi_pushers ADD COLUMN last_notification_id BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE userapi_pushers ADD COLUMN last_sent_ts_ms BIGINT NOT NULL DEFAULT 0;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownPusherEmailState(ctx context.Context, tx *sql.Tx) error {
+	// SQLite can't drop the columns if they are preceded by comments in the
+	// table schema, so the table has to be recreated instead.
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE userapi_pushers RENAME TO userapi_pushers_tmp;
+CREATE TABLE userapi_pushers (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	localpart TEXT NOT NULL,
+	session_id BIGINT DEFAULT NULL,
+	profile_tag TEXT,
+	kind TEXT NOT NULL,
+	app_id TEXT NOT NULL,
+	app_display_name TEXT NOT NULL,
+	device_display_name TEXT NOT NULL,
+	pushkey TEXT NOT NULL,
+	pushkey_ts_ms BIGINT NOT NULL DEFAULT 0,
+	lang TEXT NOT NULL,
+	data TEXT NOT NULL
+);
+INSERT INTO userapi_pushers (
+	id, localpart, session_id, profile_tag, kind, app_id, app_display_name, device_display_name, pushkey, pushkey_ts_ms, lang, data
+) SELECT
+	id, localpart, session_id, profile_tag, kind, app_id, app_display_name, device_display_name, pushkey, pushkey_ts_ms, lang, data
+FROM userapi_pushers_tmp;
+DROP TABLE userapi_pushers_tmp;
+CREATE INDEX IF NOT EXISTS userapi_pusher_app_id_pushkey_idx ON userapi_pushers(app_id, pushkey);
+CREATE INDEX IF NOT EXISTS userapi_pusher_localpart_idx ON userapi_pushers(localpart);
+CREATE UNIQUE INDEX IF NOT EXISTS userapi_pusher_app_id_pushkey_localpart_idx ON userapi_pushers(app_id, pushkey, localpart);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
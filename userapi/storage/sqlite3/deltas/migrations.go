@@ -0,0 +1,53 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import "github.com/matrix-org/dendrite/internal/sqlutil"
+
+var (
+	IsActiveMigration = sqlutil.Migration{
+		Version: "userapi: add is active",
+		Up:      UpIsActive,
+		Down:    DownIsActive,
+	}
+	LastSeenTSIPMigration = sqlutil.Migration{
+		Version: "userapi: add last_seen_ts",
+		Up:      UpLastSeenTSIP,
+		Down:    DownLastSeenTSIP,
+	}
+	AddAccountTypeMigration = sqlutil.Migration{
+		Version: "userapi: add account type",
+		Up:      UpAddAccountType,
+		Down:    DownAddAccountType,
+	}
+	NotificationThreadIDMigration = sqlutil.Migration{
+		Version: "userapi: add notification thread_id",
+		Up:      UpNotificationThreadID,
+		Down:    DownNotificationThreadID,
+	}
+	PusherEmailStateMigration = sqlutil.Migration{
+		Version: "userapi: add pusher email state",
+		Up:      UpPusherEmailState,
+		Down:    DownPusherEmailState,
+	}
+)
+
+var Migrations = []sqlutil.Migration{
+	IsActiveMigration,
+	LastSeenTSIPMigration,
+	AddAccountTypeMigration,
+	NotificationThreadIDMigration,
+	PusherEmailStateMigration,
+}
@@ -109,10 +109,7 @@ func NewSQLiteDevicesTable(db *sql.DB, serverName gomatrixserverlib.ServerName)
 		return nil, err
 	}
 	m := sqlutil.NewMigrator(db)
-	m.AddMigrations(sqlutil.Migration{
-		Version: "userapi: add last_seen_ts",
-		Up:      deltas.UpLastSeenTSIP,
-	})
+	m.AddMigrations(deltas.LastSeenTSIPMigration)
 	if err = m.Up(context.Background()); err != nil {
 		return nil, err
 	}
@@ -22,6 +22,7 @@ import (
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/sqlite3/deltas"
 	"github.com/matrix-org/dendrite/userapi/storage/tables"
 	"github.com/sirupsen/logrus"
 )
@@ -41,7 +42,11 @@ CREATE TABLE IF NOT EXISTS userapi_pushers (
 	pushkey TEXT NOT NULL,
 	pushkey_ts_ms BIGINT NOT NULL DEFAULT 0,
 	lang TEXT NOT NULL,
-	data TEXT NOT NULL
+	data TEXT NOT NULL,
+	-- The ID of the last notification sent in an email digest, for email pushers
+	last_notification_id BIGINT NOT NULL DEFAULT 0,
+	-- When the last email digest was sent, for email pushers
+	last_sent_ts_ms BIGINT NOT NULL DEFAULT 0
 );
 
 -- For faster deleting by app_id, pushkey pair.
@@ -62,6 +67,13 @@ const insertPusherSQL = "" +
 const selectPushersSQL = "" +
 	"SELECT session_id, pushkey, pushkey_ts_ms, kind, app_id, app_display_name, device_display_name, profile_tag, lang, data FROM userapi_pushers WHERE localpart = $1"
 
+const selectEmailPushersSQL = "" +
+	"SELECT localpart, session_id, pushkey, pushkey_ts_ms, kind, app_id, app_display_name, device_display_name, profile_tag, lang, data, last_notification_id, last_sent_ts_ms" +
+	" FROM userapi_pushers WHERE kind = 'email'"
+
+const updateEmailPusherSQL = "" +
+	"UPDATE userapi_pushers SET last_notification_id = $1, last_sent_ts_ms = $2 WHERE app_id = $3 AND pushkey = $4 AND localpart = $5"
+
 const deletePusherSQL = "" +
 	"DELETE FROM userapi_pushers WHERE app_id = $1 AND pushkey = $2 AND localpart = $3"
 
@@ -74,9 +86,16 @@ func NewSQLitePusherTable(db *sql.DB) (tables.PusherTable, error) {
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(deltas.PusherEmailStateMigration)
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	return s, sqlutil.StatementList{
 		{&s.insertPusherStmt, insertPusherSQL},
 		{&s.selectPushersStmt, selectPushersSQL},
+		{&s.selectEmailPushersStmt, selectEmailPushersSQL},
+		{&s.updateEmailPusherStmt, updateEmailPusherSQL},
 		{&s.deletePusherStmt, deletePusherSQL},
 		{&s.deletePushersByAppIdAndPushKeyStmt, deletePushersByAppIdAndPushKeySQL},
 	}.Prepare(db)
@@ -85,6 +104,8 @@ func NewSQLitePusherTable(db *sql.DB) (tables.PusherTable, error) {
 type pushersStatements struct {
 	insertPusherStmt                   *sql.Stmt
 	selectPushersStmt                  *sql.Stmt
+	selectEmailPushersStmt             *sql.Stmt
+	updateEmailPusherStmt              *sql.Stmt
 	deletePusherStmt                   *sql.Stmt
 	deletePushersByAppIdAndPushKeyStmt *sql.Stmt
 }
@@ -140,6 +161,54 @@ func (s *pushersStatements) SelectPushers(
 	return pushers, rows.Err()
 }
 
+// SelectEmailPushers returns all of the email pushers of local users.
+func (s *pushersStatements) SelectEmailPushers(
+	ctx context.Context, txn *sql.Tx,
+) ([]tables.EmailPusher, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectEmailPushersStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectEmailPushers: rows.close() failed")
+
+	var pushers []tables.EmailPusher
+	for rows.Next() {
+		var p tables.EmailPusher
+		var data []byte
+		err = rows.Scan(
+			&p.Localpart,
+			&p.Pusher.SessionID,
+			&p.Pusher.PushKey,
+			&p.Pusher.PushKeyTS,
+			&p.Pusher.Kind,
+			&p.Pusher.AppID,
+			&p.Pusher.AppDisplayName,
+			&p.Pusher.DeviceDisplayName,
+			&p.Pusher.ProfileTag,
+			&p.Pusher.Language,
+			&data,
+			&p.LastNotificationID,
+			&p.LastSentTS)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &p.Pusher.Data); err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, p)
+	}
+	return pushers, rows.Err()
+}
+
+// UpdateEmailPusher records how far through the user's notifications an
+// email pusher has got, and when it last sent an email.
+func (s *pushersStatements) UpdateEmailPusher(
+	ctx context.Context, txn *sql.Tx, appid, pushkey, localpart string, lastNotificationID, lastSentTS int64,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateEmailPusherStmt).ExecContext(ctx, lastNotificationID, lastSentTS, appid, pushkey, localpart)
+	return err
+}
+
 // deletePusher removes a single pusher by pushkey and user localpart.
 func (s *pushersStatements) DeletePusher(
 	ctx context.Context, txn *sql.Tx, appid, pushkey, localpart string,
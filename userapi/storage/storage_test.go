@@ -66,6 +66,19 @@ func Test_AccountData(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, contentRoom, roomData[room.ID]["m.fully_read"])
 		assert.Equal(t, contentGlobal, globalData["im.vector.setting.breadcrumbs"])
+
+		// Deleting account data only removes the given type
+		deleted, err := db.DeleteAccountData(ctx, localpart, "", "im.vector.setting.breadcrumbs")
+		assert.NoError(t, err, "unable to delete account data")
+		assert.True(t, deleted)
+		deleted, err = db.DeleteAccountData(ctx, localpart, "", "im.vector.setting.breadcrumbs")
+		assert.NoError(t, err, "unable to delete account data")
+		assert.False(t, deleted, "account data was deleted twice")
+
+		globalData, roomData, err = db.GetAccountData(ctx, localpart)
+		assert.NoError(t, err)
+		assert.NotContains(t, globalData, "im.vector.setting.breadcrumbs")
+		assert.Equal(t, contentRoom, roomData[room.ID]["m.fully_read"])
 	})
 }
 
@@ -446,6 +459,53 @@ func Test_Pusher(t *testing.T) {
 	})
 }
 
+func Test_EmailPusher(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceLocalpart, _, err := gomatrixserverlib.SplitID('@', alice.ID)
+	assert.NoError(t, err)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+
+		appID := util.RandomString(8)
+		emailPusher := api.Pusher{
+			PushKey: "alice@example.com",
+			Kind:    api.EmailKind,
+			AppID:   appID,
+			Data:    map[string]interface{}{"brand": "Dendrite"},
+		}
+		httpPusher := api.Pusher{
+			PushKey: util.RandomString(8),
+			Kind:    api.HTTPKind,
+			AppID:   appID,
+		}
+		assert.NoError(t, db.UpsertPusher(ctx, emailPusher, aliceLocalpart))
+		assert.NoError(t, db.UpsertPusher(ctx, httpPusher, aliceLocalpart))
+
+		// only the email pusher is returned, with no state yet
+		gotPushers, err := db.GetEmailPushers(ctx)
+		assert.NoError(t, err, "unable to get email pushers")
+		assert.Equal(t, []tables.EmailPusher{{Localpart: aliceLocalpart, Pusher: emailPusher}}, gotPushers)
+
+		assert.NoError(t, db.UpdateEmailPusher(ctx, appID, emailPusher.PushKey, aliceLocalpart, 42, 1234))
+		gotPushers, err = db.GetEmailPushers(ctx)
+		assert.NoError(t, err, "unable to get email pushers")
+		assert.Equal(t, 1, len(gotPushers))
+		assert.Equal(t, int64(42), gotPushers[0].LastNotificationID)
+		assert.Equal(t, int64(1234), gotPushers[0].LastSentTS)
+
+		// updating the pusher from the client keeps the state
+		emailPusher.DeviceDisplayName = "Email"
+		assert.NoError(t, db.UpsertPusher(ctx, emailPusher, aliceLocalpart))
+		gotPushers, err = db.GetEmailPushers(ctx)
+		assert.NoError(t, err, "unable to get email pushers")
+		assert.Equal(t, 1, len(gotPushers))
+		assert.Equal(t, emailPusher, gotPushers[0].Pusher)
+		assert.Equal(t, int64(42), gotPushers[0].LastNotificationID)
+	})
+}
+
 func Test_ThreePID(t *testing.T) {
 	alice := test.NewUser(t)
 	aliceLocalpart, _, err := gomatrixserverlib.SplitID('@', alice.ID)
@@ -513,7 +573,7 @@ func Test_Notification(t *testing.T) {
 				RoomID: roomID,
 				TS:     gomatrixserverlib.AsTimestamp(ts),
 			}
-			err = db.InsertNotification(ctx, aliceLocalpart, eventID, int64(i+1), nil, notification)
+			err = db.InsertNotification(ctx, aliceLocalpart, eventID, "", int64(i+1), nil, notification)
 			assert.NoError(t, err, "unable to insert notification")
 		}
 
@@ -531,7 +591,7 @@ func Test_Notification(t *testing.T) {
 		assert.Equal(t, int64(4), total)
 
 		// mark notification as read
-		affected, err := db.SetNotificationsRead(ctx, aliceLocalpart, room2.ID, 7, true)
+		affected, err := db.SetNotificationsRead(ctx, aliceLocalpart, room2.ID, "", 7, true)
 		assert.NoError(t, err, "unable to set notifications read")
 		assert.True(t, affected)
 
@@ -554,3 +614,64 @@ func Test_Notification(t *testing.T) {
 		assert.Equal(t, int64(0), total)
 	})
 }
+
+func Test_ThreadNotification(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	aliceLocalpart, _, err := gomatrixserverlib.SplitID('@', alice.ID)
+	assert.NoError(t, err)
+	room := test.NewRoom(t, alice)
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		// two notifications in the main timeline, and two in each of two threads
+		threadIDs := []string{"", "", "$thread1", "$thread1", "$thread2", "$thread2"}
+		for i, threadID := range threadIDs {
+			notification := &api.Notification{
+				Actions: []*pushrules.Action{
+					{},
+				},
+				Event: gomatrixserverlib.ClientEvent{
+					Content: gomatrixserverlib.RawJSON("{}"),
+				},
+				RoomID: room.ID,
+				TS:     gomatrixserverlib.AsTimestamp(time.Now()),
+			}
+			tweaks := map[string]interface{}{"highlight": i%2 == 0}
+			err = db.InsertNotification(ctx, aliceLocalpart, util.RandomString(16), threadID, int64(i+1), tweaks, notification)
+			assert.NoError(t, err, "unable to insert notification")
+		}
+
+		totals, highlights, err := db.GetRoomThreadNotificationCounts(ctx, aliceLocalpart, room.ID)
+		assert.NoError(t, err, "unable to get thread notification counts")
+		assert.Equal(t, map[string]int64{"$thread1": 2, "$thread2": 2}, totals)
+		assert.Equal(t, map[string]int64{"$thread1": 1, "$thread2": 1}, highlights)
+
+		// a receipt in one thread only marks that thread as read
+		affected, err := db.SetNotificationsRead(ctx, aliceLocalpart, room.ID, "$thread1", 6, true)
+		assert.NoError(t, err, "unable to set notifications read")
+		assert.True(t, affected)
+		totals, _, err = db.GetRoomThreadNotificationCounts(ctx, aliceLocalpart, room.ID)
+		assert.NoError(t, err, "unable to get thread notification counts")
+		assert.Equal(t, map[string]int64{"$thread2": 2}, totals)
+		total, _, err := db.GetRoomNotificationCounts(ctx, aliceLocalpart, room.ID)
+		assert.NoError(t, err, "unable to get notifications for room")
+		assert.Equal(t, int64(4), total)
+
+		// a receipt in the main timeline doesn't touch the threads
+		affected, err = db.SetNotificationsRead(ctx, aliceLocalpart, room.ID, api.MainThreadID, 6, true)
+		assert.NoError(t, err, "unable to set notifications read")
+		assert.True(t, affected)
+		total, _, err = db.GetRoomNotificationCounts(ctx, aliceLocalpart, room.ID)
+		assert.NoError(t, err, "unable to get notifications for room")
+		assert.Equal(t, int64(2), total)
+
+		// an unthreaded receipt marks everything as read
+		affected, err = db.SetNotificationsRead(ctx, aliceLocalpart, room.ID, "", 6, true)
+		assert.NoError(t, err, "unable to set notifications read")
+		assert.True(t, affected)
+		total, _, err = db.GetRoomNotificationCounts(ctx, aliceLocalpart, room.ID)
+		assert.NoError(t, err, "unable to get notifications for room")
+		assert.Equal(t, int64(0), total)
+	})
+}
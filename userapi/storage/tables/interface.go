@@ -29,6 +29,7 @@ type AccountDataTable interface {
 	InsertAccountData(ctx context.Context, txn *sql.Tx, localpart, roomID, dataType string, content json.RawMessage) error
 	SelectAccountData(ctx context.Context, localpart string) (map[string]json.RawMessage, map[string]map[string]json.RawMessage, error)
 	SelectAccountDataByType(ctx context.Context, localpart, roomID, dataType string) (data json.RawMessage, err error)
+	DeleteAccountData(ctx context.Context, txn *sql.Tx, localpart, roomID, dataType string) (deleted bool, err error)
 }
 
 type AccountsTable interface {
@@ -101,16 +102,19 @@ type PusherTable interface {
 	SelectPushers(ctx context.Context, txn *sql.Tx, localpart string) ([]api.Pusher, error)
 	DeletePusher(ctx context.Context, txn *sql.Tx, appid, pushkey, localpart string) error
 	DeletePushers(ctx context.Context, txn *sql.Tx, appid, pushkey string) error
+	SelectEmailPushers(ctx context.Context, txn *sql.Tx) ([]EmailPusher, error)
+	UpdateEmailPusher(ctx context.Context, txn *sql.Tx, appid, pushkey, localpart string, lastNotificationID, lastSentTS int64) error
 }
 
 type NotificationTable interface {
 	Clean(ctx context.Context, txn *sql.Tx) error
-	Insert(ctx context.Context, txn *sql.Tx, localpart, eventID string, pos int64, highlight bool, n *api.Notification) error
+	Insert(ctx context.Context, txn *sql.Tx, localpart, eventID, threadID string, pos int64, highlight bool, n *api.Notification) error
 	DeleteUpTo(ctx context.Context, txn *sql.Tx, localpart, roomID string, pos int64) (affected bool, _ error)
-	UpdateRead(ctx context.Context, txn *sql.Tx, localpart, roomID string, pos int64, v bool) (affected bool, _ error)
+	UpdateRead(ctx context.Context, txn *sql.Tx, localpart, roomID, threadID string, pos int64, v bool) (affected bool, _ error)
 	Select(ctx context.Context, txn *sql.Tx, localpart string, fromID int64, limit int, filter NotificationFilter) ([]*api.Notification, int64, error)
 	SelectCount(ctx context.Context, txn *sql.Tx, localpart string, filter NotificationFilter) (int64, error)
 	SelectRoomCounts(ctx context.Context, txn *sql.Tx, localpart, roomID string) (total int64, highlight int64, _ error)
+	SelectRoomThreadCounts(ctx context.Context, txn *sql.Tx, localpart, roomID string) (total, highlight map[string]int64, _ error)
 }
 
 type StatsTable interface {
@@ -140,3 +144,12 @@ const (
 	// uint32.
 	AllNotifications NotificationFilter = (1 << 31) - 1
 )
+
+// EmailPusher is an email pusher of a local user, along with how far
+// through the user's notifications it has got.
+type EmailPusher struct {
+	Localpart          string
+	Pusher             api.Pusher
+	LastNotificationID int64 // the ID of the last notification sent in a digest
+	LastSentTS         int64 // when the last digest was sent, in milliseconds
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/consumers"
+	"github.com/matrix-org/dendrite/userapi/emailer"
 	"github.com/matrix-org/dendrite/userapi/internal"
 	"github.com/matrix-org/dendrite/userapi/inthttp"
 	"github.com/matrix-org/dendrite/userapi/producers"
@@ -80,22 +81,33 @@ func NewInternalAPI(
 		KeyAPI:               keyAPI,
 		RSAPI:                rsAPI,
 		DisableTLSValidation: cfg.PushGatewayDisableTLSValidation,
+		Cache:                base.Caches,
 	}
 
+	pushSender := util.NewPushSender(base.ProcessContext, pgClient, db, base.EnableMetrics)
+
 	readConsumer := consumers.NewOutputReadUpdateConsumer(
-		base.ProcessContext, cfg, js, db, pgClient, userAPI, syncProducer,
+		base.ProcessContext, cfg, js, db, pushSender, userAPI, syncProducer,
 	)
 	if err := readConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start user API read update consumer")
 	}
 
 	eventConsumer := consumers.NewOutputStreamEventConsumer(
-		base.ProcessContext, cfg, js, db, pgClient, userAPI, rsAPI, syncProducer,
+		base.ProcessContext, cfg, js, db, pushSender, base.Caches, userAPI, rsAPI, syncProducer,
 	)
 	if err := eventConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start user API streamed event consumer")
 	}
 
+	if cfg.EmailNotifications.Enabled {
+		mailer, mailErr := emailer.NewEmailer(cfg, db, rsAPI)
+		if mailErr != nil {
+			logrus.WithError(mailErr).Panic("failed to start user API emailer")
+		}
+		mailer.Start(base.ProcessContext)
+	}
+
 	var cleanOldNotifs func()
 	cleanOldNotifs = func() {
 		logrus.Infof("Cleaning old notifications")
@@ -3,7 +3,6 @@ package util
 import (
 	"context"
 	"strings"
-	"time"
 
 	"github.com/matrix-org/dendrite/internal/pushgateway"
 	"github.com/matrix-org/dendrite/userapi/storage"
@@ -13,10 +12,9 @@ import (
 
 // NotifyUserCountsAsync sends notifications to a local user's
 // notification destinations. Database lookups run synchronously, but
-// a single goroutine is started when talking to the Push
-// gateways. There is no way to know when the background goroutine has
-// finished.
-func NotifyUserCountsAsync(ctx context.Context, pgClient pushgateway.Client, localpart string, db storage.Database) error {
+// the requests to the Push gateways are queued on the push sender.
+// There is no way to know when they have been sent.
+func NotifyUserCountsAsync(ctx context.Context, pushSender *PushSender, localpart string, db storage.Database) error {
 	pusherDevices, err := GetPushDevices(ctx, localpart, nil, db)
 	if err != nil {
 		return err
@@ -37,40 +35,21 @@ func NotifyUserCountsAsync(ctx context.Context, pgClient pushgateway.Client, loc
 		"pushkey":   pusherDevices[0].Device.PushKey,
 	}).Tracef("Notifying HTTP push gateway about notification counts")
 
-	// TODO: think about bounding this to one per user, and what
-	// ordering guarantees we must provide.
-	go func() {
-		// This background processing cannot be tied to a request.
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-
-		// TODO: we could batch all devices with the same URL, but
-		// Sytest requires consumers/roomserver.go to do it
-		// one-by-one, so we do the same here.
-		for _, pusherDevice := range pusherDevices {
-			// TODO: support "email".
-			if !strings.HasPrefix(pusherDevice.URL, "http") {
-				continue
-			}
-
-			req := pushgateway.NotifyRequest{
-				Notification: pushgateway.Notification{
-					Counts: &pushgateway.Counts{
-						Unread: int(userNumUnreadNotifs),
-					},
-					Devices: []*pushgateway.Device{&pusherDevice.Device},
-				},
-			}
-			if err := pgClient.Notify(ctx, pusherDevice.URL, &req, &pushgateway.NotifyResponse{}); err != nil {
-				log.WithFields(log.Fields{
-					"localpart": localpart,
-					"app_id0":   pusherDevice.Device.AppID,
-					"pushkey":   pusherDevice.Device.PushKey,
-				}).WithError(err).Error("HTTP push gateway request failed")
-				return
-			}
+	// Devices which use the same push gateway are sent one request.
+	devicesByURL := map[string][]*pushgateway.Device{}
+	for i := range pusherDevices {
+		// Email pushers are sent digests by the emailer instead.
+		if url := pusherDevices[i].URL; strings.HasPrefix(url, "http") {
+			devicesByURL[url] = append(devicesByURL[url], &pusherDevices[i].Device)
 		}
-	}()
+	}
+	for url, devices := range devicesByURL {
+		pushSender.Send(localpart, url, devices, pushgateway.Notification{
+			Counts: &pushgateway.Counts{
+				Unread: int(userNumUnreadNotifs),
+			},
+		})
+	}
 
 	return nil
 }
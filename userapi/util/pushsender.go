@@ -0,0 +1,299 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pushSenderQueueSize is the number of notifications which can be
+	// waiting to be sent before new ones are dropped.
+	pushSenderQueueSize = 4096
+	// pushSenderWorkers is the number of push gateway requests which can
+	// be in flight at once.
+	pushSenderWorkers = 16
+	// pushSenderMaxAttempts is the number of times that a notification is
+	// tried before it is given up on.
+	pushSenderMaxAttempts = 5
+	// pushSenderRequestTimeout bounds a single push gateway request.
+	pushSenderRequestTimeout = 30 * time.Second
+)
+
+var (
+	pushSenderMinBackoff = time.Second
+	pushSenderMaxBackoff = 5 * time.Minute
+)
+
+var pushSenderDropped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "userapi",
+		Name:      "push_notifications_dropped_total",
+		Help:      "How many push notifications were dropped because the push sender queue was full or their pusher was backing off",
+	},
+	// reason is "queue_full" or "backoff", and retry is "true" if the
+	// notification had already been tried. Notifications which are dropped
+	// because their pusher is backing off are counted once per device.
+	[]string{"reason", "retry"},
+)
+
+// A PushSender sends notifications to HTTP push gateways in the
+// background. Notifications are queued on a bounded queue and sent by a
+// fixed pool of workers, with one request for all of a user's devices
+// which use the same push gateway. Failed notifications are retried with
+// an exponential backoff, which is tracked per pusher so that a broken one
+// doesn't hold up notifications to the others. Notifications for pushers
+// which are backing off are dropped rather than waiting outside of the
+// queue, as the next notification will have the latest counts anyway.
+// Pushers whose push keys are rejected by the gateway are deleted.
+type PushSender struct {
+	process  *process.ProcessContext
+	pgClient pushgateway.Client
+	db       storage.Database
+	queue    chan *pushJob
+	mu       sync.Mutex
+	backoff  map[pusherKey]*pusherBackoff // protected by mu
+}
+
+type pusherKey struct {
+	appID   string
+	pushKey string
+}
+
+func keyOf(device *pushgateway.Device) pusherKey {
+	return pusherKey{device.AppID, device.PushKey}
+}
+
+type pusherBackoff struct {
+	failures int
+	until    time.Time
+}
+
+type pushJob struct {
+	localpart string
+	url       string
+	req       *pushgateway.NotifyRequest
+	attempts  int
+}
+
+// NewPushSender creates a push sender and starts its workers. The workers
+// stop when the process is shut down.
+func NewPushSender(process *process.ProcessContext, pgClient pushgateway.Client, db storage.Database, enableMetrics bool) *PushSender {
+	if enableMetrics {
+		prometheus.MustRegister(pushSenderDropped)
+	}
+	p := &PushSender{
+		process:  process,
+		pgClient: pgClient,
+		db:       db,
+		queue:    make(chan *pushJob, pushSenderQueueSize),
+		backoff:  map[pusherKey]*pusherBackoff{},
+	}
+	for i := 0; i < pushSenderWorkers; i++ {
+		go p.worker()
+	}
+	go p.cleanBackoff()
+	return p
+}
+
+// Send queues a notification for the devices of a local user which use
+// the push gateway at url. It never blocks: if the queue is full then the
+// notification is dropped.
+func (p *PushSender) Send(localpart, url string, devices []*pushgateway.Device, notification pushgateway.Notification) {
+	notification.Devices = devices
+	p.enqueue(&pushJob{
+		localpart: localpart,
+		url:       url,
+		req:       &pushgateway.NotifyRequest{Notification: notification},
+	})
+}
+
+func (p *PushSender) enqueue(job *pushJob) {
+	select {
+	case p.queue <- job:
+	default:
+		retry := job.attempts > 0
+		pushSenderDropped.WithLabelValues("queue_full", strconv.FormatBool(retry)).Inc()
+		logger := log.WithFields(log.Fields{
+			"localpart": job.localpart,
+			"url":       job.url,
+		})
+		if retry {
+			logger.Errorf("Push sender queue is full, dropping notification after %d attempts", job.attempts)
+		} else {
+			logger.Warn("Push sender queue is full, dropping notification")
+		}
+	}
+}
+
+// worker sends one notification at a time, so that a slow push gateway
+// only holds up the notification which is being sent to it.
+func (p *PushSender) worker() {
+	ctx := p.process.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-p.queue:
+			p.send(ctx, job)
+		}
+	}
+}
+
+func (p *PushSender) send(ctx context.Context, job *pushJob) {
+	logger := log.WithFields(log.Fields{
+		"localpart":   job.localpart,
+		"url":         job.url,
+		"num_devices": len(job.req.Notification.Devices),
+		"event_id":    job.req.Notification.EventID,
+	})
+
+	// Leave out the devices whose pushers are backing off. Only the retries
+	// of failed notifications wait outside of the queue, and there are at
+	// most pushSenderMaxAttempts of them for each notification.
+	devices := p.readyDevices(job.req.Notification.Devices)
+	if dropped := len(job.req.Notification.Devices) - len(devices); dropped > 0 {
+		pushSenderDropped.WithLabelValues("backoff", strconv.FormatBool(job.attempts > 0)).Add(float64(dropped))
+		logger.Debugf("Dropping notification for %d pushers which are backing off", dropped)
+	}
+	if len(devices) == 0 {
+		return
+	}
+	job.req.Notification.Devices = devices
+
+	reqctx, cancel := context.WithTimeout(ctx, pushSenderRequestTimeout)
+	defer cancel()
+	var res pushgateway.NotifyResponse
+	if err := p.pgClient.Notify(reqctx, job.url, job.req, &res); err != nil {
+		job.attempts++
+		wait := p.failed(devices)
+		if job.attempts >= pushSenderMaxAttempts {
+			// The pushers keep backing off, so that other notifications
+			// don't hit the push gateway again straight away.
+			logger.WithError(err).Errorf("Giving up on push gateway after %d attempts", job.attempts)
+			return
+		}
+		logger.WithError(err).Warnf("Push gateway request failed, retrying in %s", wait)
+		time.AfterFunc(wait, func() { p.enqueue(job) })
+		return
+	}
+	p.succeeded(devices)
+
+	for _, pushKey := range res.Rejected {
+		for _, device := range job.req.Notification.Devices {
+			if pushKey != device.PushKey {
+				continue
+			}
+			logger.WithField("app_id", device.AppID).Warn("Deleting pusher rejected by the HTTP push gateway")
+			if err := p.db.RemovePusher(ctx, device.AppID, device.PushKey, job.localpart); err != nil {
+				logger.WithError(err).Error("Unable to delete rejected pusher")
+			}
+		}
+	}
+}
+
+func (p *PushSender) backoffRemaining(device *pushgateway.Device) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b, ok := p.backoff[keyOf(device)]; ok {
+		return time.Until(b.until)
+	}
+	return 0
+}
+
+// readyDevices returns the devices whose pushers aren't backing off.
+func (p *PushSender) readyDevices(devices []*pushgateway.Device) []*pushgateway.Device {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	ready := make([]*pushgateway.Device, 0, len(devices))
+	for _, device := range devices {
+		if b, ok := p.backoff[keyOf(device)]; ok && now.Before(b.until) {
+			continue
+		}
+		ready = append(ready, device)
+	}
+	return ready
+}
+
+// failed records a failed request for the pushers of the devices, and
+// returns how long the push gateway should be left alone for.
+func (p *PushSender) failed(devices []*pushgateway.Device) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var longest time.Duration
+	for _, device := range devices {
+		b, ok := p.backoff[keyOf(device)]
+		if !ok {
+			b = &pusherBackoff{}
+			p.backoff[keyOf(device)] = b
+		}
+		wait := pushSenderMinBackoff << b.failures
+		if wait <= 0 || wait > pushSenderMaxBackoff {
+			wait = pushSenderMaxBackoff
+		} else {
+			b.failures++
+		}
+		b.until = time.Now().Add(wait)
+		if wait > longest {
+			longest = wait
+		}
+	}
+	return longest
+}
+
+func (p *PushSender) succeeded(devices []*pushgateway.Device) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, device := range devices {
+		delete(p.backoff, keyOf(device))
+	}
+}
+
+// cleanBackoff forgets the pushers which haven't failed for longer than
+// the maximum backoff, e.g. because they have been deleted, so that they
+// don't stay in the backoff map forever.
+func (p *PushSender) cleanBackoff() {
+	ticker := time.NewTicker(pushSenderMaxBackoff)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.process.Context().Done():
+			return
+		case now := <-ticker.C:
+			p.pruneBackoff(now)
+		}
+	}
+}
+
+func (p *PushSender) pruneBackoff(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, b := range p.backoff {
+		if now.Sub(b.until) > pushSenderMaxBackoff {
+			delete(p.backoff, key)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakePushGateway struct {
+	mu       sync.Mutex
+	failures int // the number of requests to fail before succeeding
+	rejected []string
+	requests []*pushgateway.NotifyRequest
+}
+
+func (f *fakePushGateway) Notify(ctx context.Context, url string, req *pushgateway.NotifyRequest, res *pushgateway.NotifyResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	if f.failures > 0 {
+		f.failures--
+		return fmt.Errorf("push gateway: 500 from %s", url)
+	}
+	res.Rejected = f.rejected
+	return nil
+}
+
+func (f *fakePushGateway) numRequests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+type fakePusherDB struct {
+	storage.Database
+	removed chan string
+}
+
+func (f *fakePusherDB) RemovePusher(ctx context.Context, appid, pushkey, localpart string) error {
+	f.removed <- localpart + "/" + appid + "/" + pushkey
+	return nil
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPushSender(t *testing.T) {
+	pushSenderMinBackoff = 10 * time.Millisecond
+	t.Cleanup(func() { pushSenderMinBackoff = time.Second })
+
+	device := &pushgateway.Device{AppID: "app", PushKey: "key"}
+	devices := []*pushgateway.Device{device}
+
+	t.Run("retries failed requests", func(t *testing.T) {
+		processCtx := process.NewProcessContext()
+		defer processCtx.ShutdownDendrite()
+		pg := &fakePushGateway{failures: 2}
+		sender := NewPushSender(processCtx, pg, &fakePusherDB{}, false)
+
+		sender.Send("alice", "http://gateway", devices, pushgateway.Notification{EventID: "$event"})
+		waitFor(t, "three requests", func() bool { return pg.numRequests() == 3 })
+
+		waitFor(t, "backoff to be reset", func() bool {
+			return sender.backoffRemaining(device) <= 0
+		})
+	})
+
+	t.Run("sends one request per push gateway", func(t *testing.T) {
+		processCtx := process.NewProcessContext()
+		defer processCtx.ShutdownDendrite()
+		pg := &fakePushGateway{}
+		sender := NewPushSender(processCtx, pg, &fakePusherDB{}, false)
+
+		other := &pushgateway.Device{AppID: "app", PushKey: "other"}
+		sender.Send("alice", "http://gateway", []*pushgateway.Device{device, other}, pushgateway.Notification{})
+		waitFor(t, "one request", func() bool { return pg.numRequests() == 1 })
+		pg.mu.Lock()
+		defer pg.mu.Unlock()
+		if got := pg.requests[0].Notification.Devices; len(got) != 2 || got[0] != device || got[1] != other {
+			t.Errorf("expected both devices in one request, got %v", got)
+		}
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		processCtx := process.NewProcessContext()
+		defer processCtx.ShutdownDendrite()
+		pg := &fakePushGateway{failures: pushSenderMaxAttempts + 1}
+		sender := NewPushSender(processCtx, pg, &fakePusherDB{}, false)
+
+		sender.Send("alice", "http://gateway", devices, pushgateway.Notification{})
+		waitFor(t, "all attempts", func() bool { return pg.numRequests() == pushSenderMaxAttempts })
+		// The pusher is still backing off, so that the next notification
+		// doesn't hit the push gateway again straight away.
+		if sender.backoffRemaining(device) <= 0 {
+			t.Errorf("expected the pusher to keep backing off after giving up")
+		}
+		time.Sleep(pushSenderMinBackoff << pushSenderMaxAttempts)
+		if got := pg.numRequests(); got != pushSenderMaxAttempts {
+			t.Errorf("got %d requests, want %d", got, pushSenderMaxAttempts)
+		}
+	})
+
+	t.Run("drops notifications for pushers which are backing off", func(t *testing.T) {
+		processCtx := process.NewProcessContext()
+		defer processCtx.ShutdownDendrite()
+		pg := &fakePushGateway{}
+		sender := NewPushSender(processCtx, pg, &fakePusherDB{}, false)
+
+		sender.mu.Lock()
+		sender.backoff[keyOf(device)] = &pusherBackoff{until: time.Now().Add(time.Hour)}
+		sender.mu.Unlock()
+		before := testutil.ToFloat64(pushSenderDropped.WithLabelValues("backoff", "false"))
+		other := &pushgateway.Device{AppID: "app", PushKey: "other"}
+		sender.Send("alice", "http://gateway", []*pushgateway.Device{device, other}, pushgateway.Notification{})
+		waitFor(t, "one request", func() bool { return pg.numRequests() == 1 })
+		pg.mu.Lock()
+		got := pg.requests[0].Notification.Devices
+		pg.mu.Unlock()
+		if len(got) != 1 || got[0] != other {
+			t.Errorf("expected only the device which isn't backing off, got %v", got)
+		}
+		if got := testutil.ToFloat64(pushSenderDropped.WithLabelValues("backoff", "false")); got != before+1 {
+			t.Errorf("expected a dropped notification to be counted, got %v", got-before)
+		}
+	})
+
+	t.Run("forgets pushers which stopped failing", func(t *testing.T) {
+		processCtx := process.NewProcessContext()
+		defer processCtx.ShutdownDendrite()
+		sender := NewPushSender(processCtx, &fakePushGateway{}, &fakePusherDB{}, false)
+
+		sender.failed(devices)
+		sender.pruneBackoff(time.Now())
+		if sender.backoffRemaining(device) <= 0 {
+			t.Fatalf("expected a pusher which is backing off to be kept")
+		}
+		sender.pruneBackoff(time.Now().Add(pushSenderMaxBackoff * 2))
+		if sender.backoffRemaining(device) > 0 {
+			t.Fatalf("expected a pusher which stopped failing to be forgotten")
+		}
+	})
+
+	t.Run("counts dropped retries", func(t *testing.T) {
+		sender := &PushSender{queue: make(chan *pushJob)}
+		before := testutil.ToFloat64(pushSenderDropped.WithLabelValues("queue_full", "true"))
+		sender.enqueue(&pushJob{localpart: "alice", attempts: 1})
+		if got := testutil.ToFloat64(pushSenderDropped.WithLabelValues("queue_full", "true")); got != before+1 {
+			t.Fatalf("expected a dropped retry to be counted, got %v", got-before)
+		}
+	})
+
+	t.Run("removes rejected pushers", func(t *testing.T) {
+		processCtx := process.NewProcessContext()
+		defer processCtx.ShutdownDendrite()
+		pg := &fakePushGateway{rejected: []string{"key"}}
+		db := &fakePusherDB{removed: make(chan string, 1)}
+		sender := NewPushSender(processCtx, pg, db, false)
+
+		sender.Send("alice", "http://gateway", devices, pushgateway.Notification{})
+		select {
+		case got := <-db.removed:
+			if want := "alice/app/key"; got != want {
+				t.Errorf("removed pusher %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the pusher to be removed")
+		}
+	})
+}